@@ -0,0 +1,292 @@
+package tango
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	AnnouncementInfo     = "info"
+	AnnouncementWarning  = "warning"
+	AnnouncementCritical = "critical"
+)
+
+// adminAuth guards the operator API with a static bearer token. Without
+// ADMIN_TOKEN the admin API is closed.
+func adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		want := "Bearer " + config.AdminToken
+		got := c.GetHeader("Authorization")
+		if config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+type Connection struct {
+	ClientID    string `json:"clientId"`
+	SessionID   string `json:"sessionId"`
+	Name        string `json:"name"`
+	Role        string `json:"role"`
+	Status      string `json:"status"`
+	JoinedAt    int64  `json:"joinedAt"`
+	Transport   string `json:"transport,omitempty"`
+	RemoteAddr  string `json:"remoteAddr,omitempty"`
+	Subprotocol string `json:"subprotocol,omitempty"`
+	AckedSeq    int64  `json:"ackedSeq"`
+}
+
+// getAdminSessions lists sessions across every workspace.
+func getAdminSessions(c *gin.Context) {
+	listSessions(c, func(string) bool { return true })
+}
+
+func getConnections(c *gin.Context) {
+	filter := c.Query("sessionId")
+	search, ok := searchQuery(c)
+	if !ok {
+		return
+	}
+
+	connections := []Connection{}
+	for _, session := range store.sessionList() {
+		if filter != "" && session.ID != filter {
+			continue
+		}
+		session.mu.Lock()
+		if search != nil && !search.Match(session) {
+			session.mu.Unlock()
+			continue
+		}
+		for _, client := range session.Clients {
+			conn := Connection{
+				ClientID:  client.ID,
+				SessionID: session.ID,
+				Name:      client.Name,
+				Role:      client.Role,
+				Status:    client.Status,
+				JoinedAt:  client.JoinedAt,
+				AckedSeq:  client.ackedSeq,
+			}
+			client.connMu.Lock()
+			if client.Conn != nil {
+				conn.Transport = TransportWebSocket
+				conn.RemoteAddr = client.Conn.RemoteAddr().String()
+				conn.Subprotocol = client.Conn.Subprotocol()
+				if isSocketIO(client.Conn) {
+					conn.Transport = TransportSocketIO
+				}
+			}
+			if client.events != nil {
+				conn.Transport = TransportEvents
+				conn.RemoteAddr = client.events.remoteAddr
+				if client.events.packets {
+					conn.Transport = TransportSocketIO
+				}
+			}
+			client.connMu.Unlock()
+			connections = append(connections, conn)
+		}
+		session.mu.Unlock()
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		if connections[i].SessionID != connections[j].SessionID {
+			return connections[i].SessionID < connections[j].SessionID
+		}
+		return connections[i].JoinedAt < connections[j].JoinedAt
+	})
+
+	c.JSON(http.StatusOK, gin.H{"connections": connections})
+}
+
+// disconnectClient removes client from its session without a reconnect
+// grace window, so its resume token stops working. Callers must hold
+// store.mu and session.mu.
+func disconnectClient(client *Client, session *Session, reason string) {
+	if client.graceTimer != nil {
+		client.graceTimer.Stop()
+		client.graceTimer = nil
+	}
+
+	closeWith(client, Message{Type: "disconnected", Payload: gin.H{"reason": reason}}, websocket.ClosePolicyViolation, reason)
+	removeClient(client, session)
+}
+
+// closeWith sends client a last message and closes its connection with the
+// given close code and reason. Detaching the connection first keeps the
+// read loop from treating the close as an ordinary disconnect.
+func closeWith(client *Client, message Message, code int, reason string) {
+	client.connMu.Lock()
+	conn, events := client.Conn, client.events
+	client.Conn, client.events = nil, nil
+	client.connMu.Unlock()
+	if events != nil {
+		events.send(message)
+		events.close()
+	}
+	if conn != nil {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		sendMessage(conn, message)
+		closing := websocket.FormatCloseMessage(code, reason)
+		conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(time.Second))
+		conn.Close()
+	}
+}
+
+func forceDisconnect(c *gin.Context) {
+	id := c.Param("id")
+
+	store.mu.Lock()
+	client, exists := store.Clients[id]
+	if !exists {
+		store.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+	session, exists := store.Sessions[client.SessionID]
+	if !exists {
+		store.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	session.mu.Lock()
+	disconnectClient(client, session, "disconnected by operator")
+	session.mu.Unlock()
+	store.mu.Unlock()
+
+	announceLeave(client, session)
+	auditRequest(c, "client.disconnect", "client", id, gin.H{"sessionId": session.ID})
+	c.Status(http.StatusNoContent)
+}
+
+// terminateSession ends a session regardless of who is connected, and with
+// purge=true deletes it outright instead of leaving it ended.
+func terminateSession(c *gin.Context) {
+	id := c.Param("id")
+	purge := c.Query("purge") == "true"
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	session, exists := store.Sessions[id]
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if !session.acceptsJoins() && !purge {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session already ended"})
+		return
+	}
+
+	endSession(session)
+	if purge {
+		purgeSession(session)
+		auditRequest(c, "session.terminate", "session", id, gin.H{"purged": true})
+		c.Status(http.StatusNoContent)
+		return
+	}
+	auditRequest(c, "session.terminate", "session", id, nil)
+	c.JSON(http.StatusOK, session)
+}
+
+func getRuntimeStats(c *gin.Context) {
+	sessions := make(map[string]int)
+	clients := make(map[string]int)
+	for _, session := range store.sessionList() {
+		session.mu.Lock()
+		sessions[session.Status]++
+		for _, client := range session.Clients {
+			clients[client.Status]++
+		}
+		session.mu.Unlock()
+	}
+
+	store.mu.RLock()
+	sessionCount, clientCount := len(store.Sessions), len(store.Clients)
+	store.mu.RUnlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := gin.H{
+		"uptime": time.Since(startedAt).Round(time.Second).String(),
+		"store": gin.H{
+			"sessions":         sessionCount,
+			"sessionsByStatus": sessions,
+			"clients":          clientCount,
+			"clientsByStatus":  clients,
+		},
+		"runtime": gin.H{
+			"goroutines":   runtime.NumGoroutine(),
+			"heapAlloc":    mem.HeapAlloc,
+			"heapObjects":  mem.HeapObjects,
+			"sys":          mem.Sys,
+			"numGC":        mem.NumGC,
+			"fanoutQueued": len(fanout.jobs),
+		},
+	}
+	if deduper, ok := blobs.(blobDeduper); ok {
+		stats["blobs"] = deduper.stats()
+	}
+	if blobCipher != nil {
+		stats["blobEncryption"] = blobCipher.encryptionStats()
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+type AnnouncementRequest struct {
+	Message string `json:"message" binding:"required,max=500"`
+	Level   string `json:"level"`
+}
+
+// announce broadcasts a service message, such as planned maintenance, to
+// every session that still has participants coming and going.
+func announce(c *gin.Context) {
+	var req AnnouncementRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch req.Level {
+	case "":
+		req.Level = AnnouncementInfo
+	case AnnouncementInfo, AnnouncementWarning, AnnouncementCritical:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "level must be info, warning or critical"})
+		return
+	}
+
+	message := Message{
+		Type: "announcement",
+		Payload: gin.H{
+			"message": req.Message,
+			"level":   req.Level,
+			"at":      getCurrentTimestamp(),
+		},
+	}
+	reached := 0
+	for _, session := range store.sessionList() {
+		session.mu.Lock()
+		open := session.acceptsJoins()
+		session.mu.Unlock()
+		if open {
+			broadcastToSession(requestSpan(c), session.ID, message, "")
+			reached++
+		}
+	}
+
+	auditRequest(c, "announcement.send", "server", "", gin.H{"level": req.Level, "sessions": reached})
+	c.JSON(http.StatusOK, gin.H{"sessions": reached})
+}
@@ -0,0 +1,100 @@
+package tango
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+type admissionError struct {
+	Status  int
+	Reason  string
+	Message string
+	Quota   *QuotaBreach
+	// StartsAt is when a session that has not started yet opens.
+	StartsAt int64
+}
+
+func (e *admissionError) Error() string {
+	return e.Message
+}
+
+// admit decides whether a new client may join session. The reason doubles
+// as the WebSocket message type sent when a join is refused after the
+// connection has already been upgraded. A resuming client already holds its
+// slot, so capacity is not checked again. Callers must hold store.mu and
+// session.mu.
+func admit(session *Session, resuming bool) *admissionError {
+	switch {
+	case !session.acceptsJoins():
+		return &admissionError{http.StatusGone, "session_ended", "Session has ended", nil, 0}
+	case isDraining():
+		return &admissionError{http.StatusServiceUnavailable, "server_shutting_down", "Server is shutting down", nil, 0}
+	case replicator.IsStandby():
+		return &admissionError{http.StatusServiceUnavailable, "server_standby", "Instance is a standby", nil, 0}
+	case session.startPending(getCurrentTimestamp()):
+		return &admissionError{http.StatusTooEarly, "session_not_started", "Session has not started yet", nil, session.StartAt}
+	case resuming:
+	case session.MaxClients > 0 && len(session.Clients) >= session.MaxClients:
+		return &admissionError{http.StatusConflict, "session_full", "Session is full", nil, 0}
+	case config.Limits.MaxConnections > 0 && len(store.Clients) >= config.Limits.MaxConnections:
+		return &admissionError{http.StatusServiceUnavailable, "server_full", "Server is at connection capacity", nil, 0}
+	}
+	if !resuming {
+		if breach := checkJoinQuota(session); breach != nil {
+			return &admissionError{http.StatusForbidden, "quota_exceeded", breach.message(), breach, 0}
+		}
+	}
+	return nil
+}
+
+// admitRequest checks that session takes the client before its connection
+// is set up, and answers the request when it does not.
+func admitRequest(c *gin.Context, session *Session, resuming bool) bool {
+	store.mu.RLock()
+	session.mu.Lock()
+	refusal := admit(session, resuming)
+	session.mu.Unlock()
+	store.mu.RUnlock()
+	if refusal != nil {
+		refuse(c, refusal)
+		return false
+	}
+	return true
+}
+
+// refuse answers a request with refusal.
+func refuse(c *gin.Context, refusal *admissionError) {
+	if refusal.Status == http.StatusServiceUnavailable {
+		c.Header("Retry-After", "5")
+	}
+	resp := gin.H{"error": refusal.Message, "reason": refusal.Reason}
+	if refusal.Quota != nil {
+		resp["quota"] = refusal.Quota
+	}
+	if refusal.StartsAt != 0 {
+		startsIn := startsIn(refusal.StartsAt)
+		c.Header("Retry-After", strconv.FormatInt(startsIn, 10))
+		resp["startsAt"], resp["startsIn"] = refusal.StartsAt, startsIn
+	}
+	c.JSON(refusal.Status, resp)
+}
+
+// refuseUpgraded reports a refusal on a connection that has already been
+// upgraded, where an HTTP status can no longer be sent.
+func refuseUpgraded(conn *websocket.Conn, sessionID string, refusal *admissionError) {
+	payload := gin.H{
+		"sessionId": sessionID,
+		"message":   refusal.Message,
+	}
+	if refusal.Quota != nil {
+		payload["quota"] = refusal.Quota
+	}
+	if refusal.StartsAt != 0 {
+		payload["startsAt"], payload["startsIn"] = refusal.StartsAt, startsIn(refusal.StartsAt)
+	}
+	sendMessage(conn, Message{Type: refusal.Reason, Payload: payload})
+	conn.Close()
+}
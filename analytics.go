@@ -0,0 +1,235 @@
+package tango
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	analyticsDays      = 90
+	defaultStatsWindow = 30
+	dayLayout          = "2006-01-02"
+)
+
+// sessionStats accumulates usage figures for one session. messages is
+// accessed atomically; the rest is guarded by session.mu.
+type sessionStats struct {
+	messages     int64
+	bytesRelayed int64
+	startedAt    int64
+	peakClients  int
+	joins        int
+	joiners      map[string]bool
+}
+
+// observeJoin counts a new participant. Participants have no stable
+// identity yet, so unique joiners are told apart by name. Callers must
+// hold session.mu.
+func (s *Session) observeJoin(client *Client) {
+	stats := &s.stats
+	if stats.startedAt == 0 {
+		stats.startedAt = getCurrentTimestamp()
+	}
+	if len(s.Clients) > stats.peakClients {
+		stats.peakClients = len(s.Clients)
+	}
+	stats.joins++
+	if stats.joiners == nil {
+		stats.joiners = make(map[string]bool)
+	}
+	day := analytics.today()
+	if !stats.joiners[client.Name] {
+		stats.joiners[client.Name] = true
+		day.observeJoiner(client.Name)
+	}
+	day.observePeak(len(s.Clients))
+	atomic.AddInt64(&day.stats.Joins, 1)
+}
+
+// duration is how long the session has been running, from its first join
+// until it ended. Callers must hold session.mu.
+func (s *Session) duration(now int64) int64 {
+	if s.stats.startedAt == 0 {
+		return 0
+	}
+	end := s.EndedAt
+	if end == 0 {
+		end = now
+	}
+	if end < s.stats.startedAt {
+		return 0
+	}
+	return end - s.stats.startedAt
+}
+
+func (s *Session) countMessage() {
+	atomic.AddInt64(&s.stats.messages, 1)
+	atomic.AddInt64(&analytics.today().stats.Messages, 1)
+}
+
+// countRelayed adds n bytes of screen data fanned out to viewers. Callers
+// must hold session.mu.
+func (s *Session) countRelayed(n int) {
+	s.stats.bytesRelayed += int64(n)
+	atomic.AddInt64(&analytics.today().stats.BytesRelayed, int64(n))
+	meter.addRelayed(s, n)
+}
+
+// DailyStats aggregates activity across sessions for one UTC day.
+type DailyStats struct {
+	Date            string `json:"date"`
+	SessionsCreated int64  `json:"sessionsCreated"`
+	SessionsEnded   int64  `json:"sessionsEnded"`
+	DurationSeconds int64  `json:"durationSeconds"`
+	PeakClients     int64  `json:"peakClients"`
+	Joins           int64  `json:"joins"`
+	Messages        int64  `json:"messages"`
+	BytesRelayed    int64  `json:"bytesRelayed"`
+	UniqueJoiners   int64  `json:"uniqueJoiners"`
+}
+
+// dailyCounter accumulates one day. The counters in stats are accessed
+// atomically; joiners is guarded by mu.
+type dailyCounter struct {
+	stats   DailyStats
+	joiners map[string]bool
+	mu      sync.Mutex
+}
+
+func (d *dailyCounter) observeJoiner(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.joiners[name] {
+		d.joiners[name] = true
+		atomic.AddInt64(&d.stats.UniqueJoiners, 1)
+	}
+}
+
+func (d *dailyCounter) observePeak(n int) {
+	for {
+		peak := atomic.LoadInt64(&d.stats.PeakClients)
+		if int64(n) <= peak || atomic.CompareAndSwapInt64(&d.stats.PeakClients, peak, int64(n)) {
+			return
+		}
+	}
+}
+
+func (d *dailyCounter) snapshot() DailyStats {
+	return DailyStats{
+		Date:            d.stats.Date,
+		SessionsCreated: atomic.LoadInt64(&d.stats.SessionsCreated),
+		SessionsEnded:   atomic.LoadInt64(&d.stats.SessionsEnded),
+		DurationSeconds: atomic.LoadInt64(&d.stats.DurationSeconds),
+		PeakClients:     atomic.LoadInt64(&d.stats.PeakClients),
+		Joins:           atomic.LoadInt64(&d.stats.Joins),
+		Messages:        atomic.LoadInt64(&d.stats.Messages),
+		BytesRelayed:    atomic.LoadInt64(&d.stats.BytesRelayed),
+		UniqueJoiners:   atomic.LoadInt64(&d.stats.UniqueJoiners),
+	}
+}
+
+// Analytics keeps a rolling window of daily aggregates.
+type Analytics struct {
+	days map[string]*dailyCounter
+	mu   sync.RWMutex
+}
+
+var analytics = &Analytics{days: make(map[string]*dailyCounter)}
+
+func (a *Analytics) today() *dailyCounter {
+	date := time.Now().UTC().Format(dayLayout)
+
+	a.mu.RLock()
+	day, exists := a.days[date]
+	a.mu.RUnlock()
+	if exists {
+		return day
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if day, exists = a.days[date]; exists {
+		return day
+	}
+	day = &dailyCounter{stats: DailyStats{Date: date}, joiners: make(map[string]bool)}
+	a.days[date] = day
+
+	cutoff := time.Now().UTC().AddDate(0, 0, -analyticsDays).Format(dayLayout)
+	for d := range a.days {
+		if d < cutoff {
+			delete(a.days, d)
+		}
+	}
+	return day
+}
+
+// Range returns the days between from and to inclusive, oldest first.
+func (a *Analytics) Range(from, to string) []DailyStats {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	days := []DailyStats{}
+	for date, day := range a.days {
+		if date >= from && date <= to {
+			days = append(days, day.snapshot())
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	return days
+}
+
+func getSessionStats(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	c.JSON(http.StatusOK, session.statsReport())
+}
+
+// statsReport describes the session's activity. Callers must hold s.mu.
+func (s *Session) statsReport() gin.H {
+	stats := &s.stats
+	return gin.H{
+		"sessionId":       s.ID,
+		"status":          s.Status,
+		"startedAt":       stats.startedAt,
+		"endedAt":         s.EndedAt,
+		"durationSeconds": s.duration(getCurrentTimestamp()),
+		"clients":         len(s.Clients),
+		"peakClients":     stats.peakClients,
+		"joins":           stats.joins,
+		"uniqueJoiners":   len(stats.joiners),
+		"messages":        atomic.LoadInt64(&stats.messages),
+		"bytesRelayed":    stats.bytesRelayed,
+	}
+}
+
+// getDailyStats reports daily aggregates for dashboards, covering the last
+// 30 days unless from and to (YYYY-MM-DD, UTC) say otherwise.
+func getDailyStats(c *gin.Context) {
+	now := time.Now().UTC()
+	to := c.DefaultQuery("to", now.Format(dayLayout))
+	from := c.DefaultQuery("from", now.AddDate(0, 0, 1-defaultStatsWindow).Format(dayLayout))
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse(dayLayout, date); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must be dates (YYYY-MM-DD)"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":          from,
+		"to":            to,
+		"retentionDays": analyticsDays,
+		"days":          analytics.Range(from, to),
+	})
+}
@@ -0,0 +1,242 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ToolPen       = "pen"
+	ToolHighlight = "highlight"
+	ToolLine      = "line"
+	ToolArrow     = "arrow"
+	ToolRect      = "rect"
+	ToolEllipse   = "ellipse"
+	ToolLaser     = "laser"
+
+	maxStrokePoints      = 2000
+	maxBufferedStrokes   = 500
+	maxStrokeWidth       = 64
+	maxAnnotationIDBytes = 64
+)
+
+var annotationTools = map[string]bool{
+	ToolPen:       true,
+	ToolHighlight: true,
+	ToolLine:      true,
+	ToolArrow:     true,
+	ToolRect:      true,
+	ToolEllipse:   true,
+	ToolLaser:     true,
+}
+
+// Stroke is one annotation drawn over the shared screen. Points are
+// normalised like cursor positions. Laser strokes are relayed but never
+// buffered, since they fade on the viewer side.
+type Stroke struct {
+	ID       string       `json:"id"`
+	ClientID string       `json:"clientId"`
+	Tool     string       `json:"tool"`
+	Color    string       `json:"color,omitempty"`
+	Width    float64      `json:"width,omitempty"`
+	Points   [][2]float64 `json:"points"`
+}
+
+// AnnotationBoard buffers each session's strokes so late joiners can be
+// brought up to date. Only the most recent maxBufferedStrokes are kept.
+type AnnotationBoard struct {
+	strokes map[string][]Stroke
+	mu      sync.Mutex
+}
+
+var annotations = &AnnotationBoard{strokes: make(map[string][]Stroke)}
+
+func (b *AnnotationBoard) Add(sessionID string, stroke Stroke) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	strokes := append(b.strokes[sessionID], stroke)
+	if len(strokes) > maxBufferedStrokes {
+		strokes = strokes[len(strokes)-maxBufferedStrokes:]
+	}
+	b.strokes[sessionID] = strokes
+}
+
+func (b *AnnotationBoard) Strokes(sessionID string) []Stroke {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]Stroke(nil), b.strokes[sessionID]...)
+}
+
+func (b *AnnotationBoard) Forget(sessionID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.strokes, sessionID)
+}
+
+// canAnnotate reports whether client may draw. Presenters always may;
+// viewers only when the session allows it.
+func canAnnotate(client *Client, session *Session) bool {
+	return client.Role == RolePresenter || session.ViewerAnnotations
+}
+
+// isHost reports whether client may run host-only controls: it joined as
+// a presenter, signed in as someone who may host the session, or it is the
+// presenter hosting a session created anonymously outside a workspace. The
+// role a client declares is not enough by itself.
+func isHost(client *Client) bool {
+	return atomic.LoadInt32(&client.host) == 1
+}
+
+// claimHost makes client the host of a session created anonymously outside
+// a workspace, which nobody hosts by right, if it is a presenter and no
+// client there hosts it yet. Callers must hold session.mu.
+func claimHost(session *Session, client *Client) {
+	if client.Role != RolePresenter || !hostless(session.CreatedBy, session.WorkspaceID) {
+		return
+	}
+	for _, other := range session.Clients {
+		if isHost(other) {
+			return
+		}
+	}
+	atomic.StoreInt32(&client.host, 1)
+}
+
+// passHost hands the host role of a session created anonymously outside a
+// workspace from client, which has left, to the presenter that has been
+// there longest. Callers must hold session.mu.
+func passHost(session *Session, client *Client) {
+	if !isHost(client) || !hostless(session.CreatedBy, session.WorkspaceID) {
+		return
+	}
+	var next *Client
+	for _, other := range session.Clients {
+		if other.Role != RolePresenter {
+			continue
+		}
+		if next == nil || other.JoinedAt < next.JoinedAt || other.JoinedAt == next.JoinedAt && other.ID < next.ID {
+			next = other
+		}
+	}
+	if next != nil {
+		atomic.StoreInt32(&next.host, 1)
+	}
+}
+
+// hostedBy reports whether a user may host the session: its creator, or an
+// owner or admin of its workspace. Sessions created anonymously outside a
+// workspace have none by right; see claimHost. Callers must not hold s.mu.
+func (s *Session) hostedBy(userID string, viaSSO bool) bool {
+	if userID == "" {
+		return false
+	}
+	s.mu.Lock()
+	createdBy, workspaceID := s.CreatedBy, s.WorkspaceID
+	s.mu.Unlock()
+
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+	ws, exists := workspaces.Workspaces[workspaceID]
+	if exists && !ws.admits(viaSSO) {
+		return false
+	}
+	if userID == createdBy {
+		return true
+	}
+	if !exists {
+		return false
+	}
+	member, ok := ws.Members[userID]
+	return ok && workspaceRoleRank[member.Role] >= workspaceRoleRank[RoleAdmin]
+}
+
+func decodeStroke(client *Client, msg InboundMessage) (Stroke, error) {
+	var stroke Stroke
+	if err := json.Unmarshal(msg.Payload, &stroke); err != nil {
+		return stroke, errors.New("annotation payload must be a stroke object")
+	}
+	if stroke.ID == "" || len(stroke.ID) > maxAnnotationIDBytes {
+		return stroke, fmt.Errorf("stroke id must be 1-%d characters", maxAnnotationIDBytes)
+	}
+	if !annotationTools[stroke.Tool] {
+		return stroke, errors.New("unknown annotation tool " + stroke.Tool)
+	}
+	if stroke.Width < 0 || stroke.Width > maxStrokeWidth {
+		return stroke, fmt.Errorf("stroke width must be between 0 and %d", maxStrokeWidth)
+	}
+	if len(stroke.Points) == 0 || len(stroke.Points) > maxStrokePoints {
+		return stroke, fmt.Errorf("strokes must have 1-%d points", maxStrokePoints)
+	}
+	for _, p := range stroke.Points {
+		if math.IsNaN(p[0]) || math.IsNaN(p[1]) || p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+			return stroke, errors.New("stroke points must be between 0 and 1")
+		}
+	}
+	stroke.ClientID = client.ID
+	return stroke, nil
+}
+
+func handleAnnotation(client *Client, session *Session, span *Span, msg InboundMessage) {
+	session.mu.Lock()
+	permitted := canAnnotate(client, session)
+	session.mu.Unlock()
+	if !permitted {
+		sendError(client, "forbidden", "Annotations are limited to presenters in this session")
+		return
+	}
+
+	stroke, err := decodeStroke(client, msg)
+	if err != nil {
+		span.SetError(err)
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+
+	if stroke.Tool != ToolLaser {
+		annotations.Add(session.ID, stroke)
+	}
+	broadcastToSession(span, session.ID, Message{Type: "annotation", Payload: stroke}, client.ID)
+}
+
+func handleAnnotationClear(client *Client, session *Session, span *Span) {
+	session.mu.Lock()
+	host := isHost(client)
+	session.mu.Unlock()
+	if !host {
+		sendError(client, "forbidden", "Only the host can clear annotations")
+		return
+	}
+
+	annotations.Forget(session.ID)
+	broadcastToSession(span, session.ID, Message{
+		Type: "annotation_clear",
+		Payload: gin.H{
+			"clientId": client.ID,
+		},
+	}, "")
+}
+
+// sendAnnotationSync replays buffered strokes to a client that just joined.
+func sendAnnotationSync(client *Client, session *Session) {
+	strokes := annotations.Strokes(session.ID)
+	if len(strokes) == 0 {
+		return
+	}
+
+	client.send(Message{
+		Type: "annotation_sync",
+		Payload: gin.H{
+			"sessionId": session.ID,
+			"strokes":   strokes,
+		},
+	})
+}
@@ -0,0 +1,162 @@
+package tango
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	anomalyWindow    = time.Minute
+	anomalyFactor    = 10.0
+	anomalyMinEvents = 20
+	anomalySmoothing = 0.2
+	// staleRollupAge is how long the sweeper keeps the rollup of an
+	// account that has stopped downloading.
+	staleRollupAge = 24 * time.Hour
+)
+
+type usageRollup struct {
+	windowStart time.Time
+	count       int
+	baseline    float64
+	flagged     bool
+}
+
+// Anomaly is a window in which a key saw far more events than usual.
+type Anomaly struct {
+	Key      string  `json:"key"`
+	Events   int     `json:"events"`
+	Baseline float64 `json:"baseline"`
+}
+
+type AnomalyDetector struct {
+	rollups map[string]*usageRollup
+	mu      sync.Mutex
+}
+
+func NewAnomalyDetector() *AnomalyDetector {
+	return &AnomalyDetector{
+		rollups: make(map[string]*usageRollup),
+	}
+}
+
+var detector = NewAnomalyDetector()
+
+// Observe records one event for key and reports whether the current window
+// is running far above the key's smoothed baseline. Each key is reported
+// once per window.
+func (d *AnomalyDetector) Observe(key string) (Anomaly, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	r, exists := d.rollups[key]
+	if !exists {
+		r = &usageRollup{windowStart: now}
+		d.rollups[key] = r
+	}
+
+	if elapsed := now.Sub(r.windowStart); elapsed >= anomalyWindow {
+		if r.baseline == 0 {
+			r.baseline = float64(r.count)
+		} else {
+			r.baseline = anomalySmoothing*float64(r.count) + (1-anomalySmoothing)*r.baseline
+		}
+		// Windows without events count as zero, so a key that was busy
+		// once and then went quiet does not keep a high baseline.
+		for idle := int(elapsed/anomalyWindow) - 1; idle > 0 && r.baseline > 0; idle-- {
+			r.baseline *= 1 - anomalySmoothing
+		}
+		r.windowStart = now
+		r.count = 0
+		r.flagged = false
+	}
+
+	r.count++
+
+	if r.flagged || r.count < anomalyMinEvents || r.baseline == 0 {
+		return Anomaly{}, false
+	}
+	if float64(r.count) >= r.baseline*anomalyFactor {
+		r.flagged = true
+		logger.Warn("anomaly detected", "key", key, "events", r.count, "baseline", r.baseline)
+		return Anomaly{Key: key, Events: r.count, Baseline: r.baseline}, true
+	}
+	return Anomaly{}, false
+}
+
+func (d *AnomalyDetector) Forget(key string) {
+	d.mu.Lock()
+	delete(d.rollups, key)
+	d.mu.Unlock()
+}
+
+// observeJoin counts a client joining session, for the session and for
+// its workspace.
+func observeJoin(session *Session) {
+	if anomaly, spiked := detector.Observe("session:" + session.ID); spiked {
+		reportAnomaly(anomaly, "anomaly.connections", "session", session.ID, session.WorkspaceID)
+	}
+	if session.WorkspaceID == "" {
+		return
+	}
+	if anomaly, spiked := detector.Observe("workspace:" + session.WorkspaceID); spiked {
+		reportAnomaly(anomaly, "anomaly.connections", "workspace", session.WorkspaceID, session.WorkspaceID)
+	}
+}
+
+// observeDownload counts the caller downloading something of workspaceID,
+// keyed by account, or by address for anonymous callers.
+func observeDownload(c *gin.Context, workspaceID string) {
+	resource, id := "ip", c.ClientIP()
+	if user := currentUser(c); user != nil {
+		resource, id = "user", user.ID
+	}
+	if anomaly, spiked := detector.Observe("downloads:" + resource + ":" + id); spiked {
+		reportAnomaly(anomaly, "anomaly.downloads", resource, id, workspaceID)
+	}
+}
+
+// reportAnomaly records an anomaly in the audit log and tells the owners
+// and admins of the workspace it happened in.
+func reportAnomaly(anomaly Anomaly, action, resource, resourceID, workspaceID string) {
+	details := gin.H{"events": anomaly.Events, "baseline": anomaly.Baseline, "window": anomalyWindow.String()}
+	if workspaceID != "" {
+		details["workspaceId"] = workspaceID
+	}
+	audit.Record(ActorSystem, action, resource, resourceID, "", details)
+	if workspaceID == "" {
+		return
+	}
+
+	text := "Unusually many connections to your workspace"
+	if action == "anomaly.downloads" {
+		text = "An account is downloading unusually much from your workspace"
+	}
+	for _, userID := range workspaceAdmins(workspaceID) {
+		notifications.Notify(userID, Notification{
+			Type: NotifyAnomaly,
+			Text: text,
+			Data: gin.H{"kind": action, "resource": resource, "resourceId": resourceID, "workspaceId": workspaceID, "events": anomaly.Events, "baseline": anomaly.Baseline},
+		})
+	}
+}
+
+// workspaceAdmins returns the IDs of the workspace's owners and admins.
+func workspaceAdmins(workspaceID string) []string {
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+	var ids []string
+	if ws, exists := workspaces.Workspaces[workspaceID]; exists {
+		for id, member := range ws.Members {
+			if workspaceRoleRank[member.Role] >= workspaceRoleRank[RoleAdmin] {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,236 @@
+package tango
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	auditMemoryLimit = 50000
+	defaultAuditPage = 100
+	maxAuditPage     = 1000
+)
+
+// ActorSystem marks actions taken by the server itself, such as the janitor
+// purging expired sessions.
+const ActorSystem = "system"
+
+type AuditEntry struct {
+	Seq        int64  `json:"seq"`
+	At         int64  `json:"at"`
+	Actor      string `json:"actor"`
+	Action     string `json:"action"`
+	Resource   string `json:"resource"`
+	ResourceID string `json:"resourceId,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+	Details    gin.H  `json:"details,omitempty"`
+}
+
+// AuditLog is an append-only record of administrative and destructive
+// actions. The most recent entries are kept in memory for querying; with a
+// file configured every entry is also appended to it as a JSON line, and the
+// file is replayed on startup.
+type AuditLog struct {
+	entries []AuditEntry
+	seq     int64
+	file    *os.File
+	mu      sync.Mutex
+}
+
+var audit = &AuditLog{}
+
+func openAuditLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	skipped := 0
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Seq <= audit.seq {
+			skipped++
+			continue
+		}
+		audit.seq = entry.Seq
+		audit.keep(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+	if skipped > 0 {
+		logger.Warn("skipped unreadable audit entries", "path", path, "count", skipped)
+	}
+	audit.file = file
+	return nil
+}
+
+// keep adds entry to the in-memory tail. Callers must hold a.mu.
+func (a *AuditLog) keep(entry AuditEntry) {
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > auditMemoryLimit {
+		a.entries = a.entries[len(a.entries)-auditMemoryLimit:]
+	}
+}
+
+func (a *AuditLog) Record(actor, action, resource, resourceID, requestID string, details gin.H) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.seq++
+	entry := AuditEntry{
+		Seq:        a.seq,
+		At:         time.Now().UnixMilli(),
+		Actor:      actor,
+		Action:     action,
+		Resource:   resource,
+		ResourceID: resourceID,
+		RequestID:  requestID,
+		Details:    details,
+	}
+	a.keep(entry)
+
+	if a.file == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		_, err = a.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		logger.Error("writing audit entry failed", "action", action, "error", err)
+	}
+}
+
+// auditRequest records an action taken through the HTTP API by the signed
+// in user, or by address for anonymous callers.
+func auditRequest(c *gin.Context, action, resource, resourceID string, details gin.H) {
+	actor := "ip:" + c.ClientIP()
+	if user := currentUser(c); user != nil {
+		actor = "user:" + user.ID
+	}
+	audit.Record(actor, action, resource, resourceID, c.Writer.Header().Get(requestIDHeader), details)
+}
+
+// auditClient records an action a participant took over its WebSocket.
+func auditClient(client *Client, action, resource, resourceID string, details gin.H) {
+	audit.Record("client:"+client.ID, action, resource, resourceID, "", details)
+}
+
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	Resource   string
+	ResourceID string
+	From       int64
+	To         int64
+	After      int64
+	Limit      int
+}
+
+func (f AuditFilter) Match(entry AuditEntry) bool {
+	switch {
+	case f.Actor != "" && entry.Actor != f.Actor:
+		return false
+	case f.Resource != "" && entry.Resource != f.Resource:
+		return false
+	case f.ResourceID != "" && entry.ResourceID != f.ResourceID:
+		return false
+	case f.From != 0 && entry.At < f.From:
+		return false
+	case f.To != 0 && entry.At > f.To:
+		return false
+	}
+	if prefix := strings.TrimSuffix(f.Action, "*"); prefix != f.Action {
+		return strings.HasPrefix(entry.Action, prefix)
+	}
+	return f.Action == "" || entry.Action == f.Action
+}
+
+// Query returns up to f.Limit matching entries after f.After in order, and
+// whether more remain.
+func (a *AuditLog) Query(f AuditFilter) ([]AuditEntry, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	matches := []AuditEntry{}
+	for _, entry := range a.entries {
+		if entry.Seq <= f.After || !f.Match(entry) {
+			continue
+		}
+		if len(matches) == f.Limit {
+			return matches, true
+		}
+		matches = append(matches, entry)
+	}
+	return matches, false
+}
+
+func getAuditLog(c *gin.Context) {
+	filter := AuditFilter{
+		Actor:      c.Query("actor"),
+		Action:     c.Query("action"),
+		Resource:   c.Query("resource"),
+		ResourceID: c.Query("resourceId"),
+		Limit:      defaultAuditPage,
+	}
+
+	// from and to take the same forms as other time filters and are
+	// inclusive to the second.
+	if value := c.Query("from"); value != "" {
+		ts, err := parseQueryTime(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a unix timestamp, date or RFC 3339 time"})
+			return
+		}
+		filter.From = ts * 1000
+	}
+	if value := c.Query("to"); value != "" {
+		ts, err := parseQueryTime(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a unix timestamp, date or RFC 3339 time"})
+			return
+		}
+		filter.To = ts*1000 + 999
+	}
+	if value := c.Query("after"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "after must be an audit sequence number"})
+			return
+		}
+		filter.After = n
+	}
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxAuditPage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxAuditPage)})
+			return
+		}
+		filter.Limit = n
+	}
+
+	entries, more := audit.Query(filter)
+	resp := gin.H{"entries": entries}
+	if more {
+		resp["nextAfter"] = entries[len(entries)-1].Seq
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,25 @@
+//go:build autocert
+
+package tango
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const autocertAvailable = true
+
+func autocertTLS(cfg TLSConfig) (*tls.Config, http.Handler, error) {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.AutocertHost),
+		Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+		Email:      cfg.AutocertEmail,
+	}
+
+	tlsConfig := manager.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+	return tlsConfig, manager.HTTPHandler(http.HandlerFunc(redirectToHTTPS)), nil
+}
@@ -0,0 +1,15 @@
+//go:build !autocert
+
+package tango
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+)
+
+const autocertAvailable = false
+
+func autocertTLS(cfg TLSConfig) (*tls.Config, http.Handler, error) {
+	return nil, nil, errors.New("autocert support is not compiled in; rebuild with -tags autocert")
+}
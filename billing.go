@@ -0,0 +1,325 @@
+package tango
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	stripeAPI                = "https://api.stripe.com"
+	stripeSignatureTolerance = 5 * time.Minute
+	// Stripe retries a delivery for up to three days.
+	stripeEventMemory   = 72 * time.Hour
+	maxStripeEventBytes = 1 << 20
+
+	// ActorStripe marks audit entries for changes made by Stripe events.
+	ActorStripe = "stripe"
+)
+
+var stripeClient = &http.Client{Timeout: 10 * time.Second}
+
+// workspaceBilling links a workspace to its Stripe customer. updatedAt is
+// the creation time of the last event applied, so late deliveries of older
+// events don't undo newer ones.
+type workspaceBilling struct {
+	customerID     string
+	subscriptionID string
+	updatedAt      int64
+}
+
+type stripeEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+type stripeSubscription struct {
+	ID       string            `json:"id"`
+	Customer string            `json:"customer"`
+	Status   string            `json:"status"`
+	Metadata map[string]string `json:"metadata"`
+	Items    struct {
+		Data []struct {
+			Price struct {
+				ID string `json:"id"`
+			} `json:"price"`
+		} `json:"data"`
+	} `json:"items"`
+}
+
+type stripeCheckout struct {
+	Customer          string `json:"customer"`
+	ClientReferenceID string `json:"client_reference_id"`
+}
+
+// stripeEventLog remembers recently handled event IDs, since Stripe may
+// deliver an event more than once.
+type stripeEventLog struct {
+	seen map[string]time.Time
+	mu   sync.Mutex
+}
+
+var stripeEvents = &stripeEventLog{seen: make(map[string]time.Time)}
+
+func (l *stripeEventLog) firstDelivery(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for seenID, at := range l.seen {
+		if now.Sub(at) > stripeEventMemory {
+			delete(l.seen, seenID)
+		}
+	}
+	if _, seen := l.seen[id]; seen {
+		return false
+	}
+	l.seen[id] = now
+	return true
+}
+
+// verifyStripeSignature checks the Stripe-Signature header: an HMAC of the
+// timestamp and body under the endpoint secret, made recently.
+func verifyStripeSignature(header string, body []byte, secret string, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, found := strings.Cut(part, "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return errors.New("malformed signature header")
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return errors.New("signature timestamp outside tolerance")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	want := mac.Sum(nil)
+	for _, signature := range signatures {
+		if got, err := hex.DecodeString(signature); err == nil && hmac.Equal(got, want) {
+			return nil
+		}
+	}
+	return errors.New("no matching signature")
+}
+
+// planFor returns the largest configured plan among the subscription's
+// prices, or nil when none of them is known.
+func planFor(sub stripeSubscription) *Plan {
+	var best *Plan
+	for i := range config.Billing.Plans {
+		plan := &config.Billing.Plans[i]
+		for _, item := range sub.Items.Data {
+			if containsString(plan.PriceIDs, item.Price.ID) {
+				best = plan
+			}
+		}
+	}
+	return best
+}
+
+// billingWorkspace finds the workspace a Stripe object belongs to, by the
+// workspace ID it carries or else by its customer. Callers must hold
+// workspaces.mu.
+func billingWorkspace(workspaceID, customerID string) *Workspace {
+	if ws, exists := workspaces.Workspaces[workspaceID]; exists {
+		return ws
+	}
+	if customerID == "" {
+		return nil
+	}
+	for _, ws := range workspaces.Workspaces {
+		if ws.billing.customerID == customerID {
+			return ws
+		}
+	}
+	return nil
+}
+
+// applySubscription sets the workspace's plan, and with it its quota, from
+// the subscription's state. Past-due subscriptions keep their plan while
+// Stripe retries payment; canceled or unpaid ones fall back to the default
+// quota. Callers must hold workspaces.mu.
+func applySubscription(ws *Workspace, sub stripeSubscription, event stripeEvent) (from, to string, applied bool) {
+	if event.Created < ws.billing.updatedAt {
+		return "", "", false
+	}
+	// The end of a subscription the workspace has since replaced changes
+	// nothing.
+	if event.Type == "customer.subscription.deleted" && ws.billing.subscriptionID != "" && ws.billing.subscriptionID != sub.ID {
+		return "", "", false
+	}
+	ws.billing = workspaceBilling{customerID: sub.Customer, subscriptionID: sub.ID, updatedAt: event.Created}
+	ws.SubscriptionStatus = sub.Status
+
+	var plan *Plan
+	switch sub.Status {
+	case "active", "trialing", "past_due":
+		if event.Type != "customer.subscription.deleted" {
+			plan = planFor(sub)
+		}
+	}
+
+	from = ws.Plan
+	ws.Plan, ws.Quota = "", nil
+	if plan != nil {
+		quota := plan.Quota
+		ws.Plan, ws.Quota = plan.Name, &quota
+	}
+	return from, ws.Plan, true
+}
+
+// stripeWebhook receives subscription events from Stripe. Events that
+// can't be tied to a workspace are acknowledged so Stripe stops retrying.
+func stripeWebhook(c *gin.Context) {
+	secret := config.Billing.StripeWebhookSecret
+	if secret == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Billing is not configured"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxStripeEventBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read event"})
+		return
+	}
+	if err := verifyStripeSignature(c.GetHeader("Stripe-Signature"), body, secret, time.Now()); err != nil {
+		requestLog(c).Warn("rejected stripe event", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
+		return
+	}
+
+	var event stripeEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Malformed event"})
+		return
+	}
+	if !stripeEvents.firstDelivery(event.ID) {
+		c.JSON(http.StatusOK, gin.H{"received": true})
+		return
+	}
+
+	switch event.Type {
+	case "checkout.session.completed":
+		var checkout stripeCheckout
+		if err := json.Unmarshal(event.Data.Object, &checkout); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Malformed checkout session"})
+			return
+		}
+		workspaces.mu.Lock()
+		if ws, exists := workspaces.Workspaces[checkout.ClientReferenceID]; exists && checkout.Customer != "" {
+			ws.billing.customerID = checkout.Customer
+		}
+		workspaces.mu.Unlock()
+
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		var sub stripeSubscription
+		if err := json.Unmarshal(event.Data.Object, &sub); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Malformed subscription"})
+			return
+		}
+		workspaces.mu.Lock()
+		ws := billingWorkspace(sub.Metadata["workspace_id"], sub.Customer)
+		if ws == nil {
+			workspaces.mu.Unlock()
+			requestLog(c).Warn("stripe subscription matches no workspace", "event", event.ID, "customer", sub.Customer)
+			break
+		}
+		from, to, applied := applySubscription(ws, sub, event)
+		id := ws.ID
+		workspaces.mu.Unlock()
+
+		if applied {
+			audit.Record(ActorStripe, "billing.subscription", "workspace", id, c.Writer.Header().Get(requestIDHeader),
+				gin.H{"event": event.ID, "status": sub.Status, "from": from, "to": to})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+type BillingPortalRequest struct {
+	WorkspaceID string `json:"workspaceId" binding:"required"`
+}
+
+// createBillingPortal opens a Stripe customer portal session where an
+// owner can change the workspace's plan or payment details.
+func createBillingPortal(c *gin.Context) {
+	var req BillingPortalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requireRole(c, req.WorkspaceID, RoleOwner) == nil {
+		return
+	}
+	if config.Billing.StripeSecretKey == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Billing is not configured"})
+		return
+	}
+
+	workspaces.mu.Lock()
+	customerID := ""
+	if ws, exists := workspaces.Workspaces[req.WorkspaceID]; exists {
+		customerID = ws.billing.customerID
+	}
+	workspaces.mu.Unlock()
+	if customerID == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "This workspace has no Stripe customer yet"})
+		return
+	}
+
+	form := url.Values{"customer": {customerID}}
+	if config.Billing.PortalReturnURL != "" {
+		form.Set("return_url", config.Billing.PortalReturnURL)
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, stripeAPI+"/v1/billing_portal/sessions", strings.NewReader(form.Encode()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	httpReq.SetBasicAuth(config.Billing.StripeSecretKey, "")
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var portal struct {
+		URL   string `json:"url"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	resp, err := stripeClient.Do(httpReq)
+	if err == nil {
+		defer resp.Body.Close()
+		err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&portal)
+	}
+	if err != nil || portal.URL == "" {
+		requestLog(c).Warn("creating stripe portal session failed", "workspace", req.WorkspaceID, "error", err, "stripe", portal.Error.Message)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not open the billing portal"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": portal.URL})
+}
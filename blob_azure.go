@@ -0,0 +1,265 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureVersion is the Blob service version requests and SAS tokens are
+// made for.
+const azureVersion = "2020-12-06"
+
+// AzureBlobStore keeps blobs as block blobs in an Azure Storage container,
+// authorising requests with the account key and signing URLs as service
+// SAS tokens.
+type AzureBlobStore struct {
+	endpoint  *url.URL
+	account   string
+	key       []byte
+	container string
+	prefix    string
+	client    *http.Client
+}
+
+func NewAzureBlobStore(cfg AzureConfig, prefix string) (*AzureBlobStore, error) {
+	key, err := base64.StdEncoding.DecodeString(cfg.AccountKey)
+	if err != nil {
+		return nil, fmt.Errorf("azure account key: %v", err)
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + cfg.Account + ".blob.core.windows.net"
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("azure endpoint: %v", err)
+	}
+	return &AzureBlobStore{
+		endpoint:  u,
+		account:   cfg.Account,
+		key:       key,
+		container: cfg.Container,
+		prefix:    prefix,
+		client:    &http.Client{Timeout: blobTimeout},
+	}, nil
+}
+
+// blobPath returns the escaped path of key's blob, below the endpoint.
+func (a *AzureBlobStore) blobPath(key string) string {
+	return "/" + url.PathEscape(a.container) + escapeBlobKey(a.prefix+key)
+}
+
+// resource is the blob's name as signatures canonicalise it: the account,
+// container and unescaped key.
+func (a *AzureBlobStore) resource(key string) string {
+	return "/" + a.account + "/" + a.container + "/" + a.prefix + key
+}
+
+func (a *AzureBlobStore) hmac(stringToSign string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *AzureBlobStore) do(ctx context.Context, method, key string, data []byte) (*http.Response, error) {
+	return a.send(ctx, method, a.blobPath(key), a.resource(key), nil, data)
+}
+
+// send makes a request to path with Shared Key authorisation, for the
+// canonical resource and query given.
+func (a *AzureBlobStore) send(ctx context.Context, method, path, resource string, query url.Values, data []byte) (*http.Response, error) {
+	target := a.endpoint.String() + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	length := ""
+	if data == nil {
+		req.Body, req.ContentLength = nil, 0
+	} else {
+		length = strconv.Itoa(len(data))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+	}
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureVersion)
+
+	// Shared Key signs the standard headers in a fixed order, then the
+	// x-ms- headers sorted by name.
+	canonicalHeaders := ""
+	if req.Header.Get("X-Ms-Blob-Type") != "" {
+		canonicalHeaders += "x-ms-blob-type:BlockBlob\n"
+	}
+	canonicalHeaders += "x-ms-date:" + req.Header.Get("X-Ms-Date") + "\n" + "x-ms-version:" + azureVersion + "\n"
+	stringToSign := method + "\n" + // verb
+		"\n\n" + // content encoding and language
+		length + "\n" +
+		"\n" + // content md5
+		req.Header.Get("Content-Type") + "\n" +
+		"\n\n\n\n\n\n" + // date and the conditional and range headers
+		canonicalHeaders +
+		resource
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stringToSign += "\n" + name + ":" + query.Get(name)
+	}
+	req.Header.Set("Authorization", "SharedKey "+a.account+":"+a.hmac(stringToSign))
+	return a.client.Do(req)
+}
+
+func (a *AzureBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := a.do(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return blobStatus(resp)
+}
+
+func (a *AzureBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := a.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := blobStatus(resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (a *AzureBlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := a.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := blobStatus(resp); err != ErrBlobNotFound {
+		return err
+	}
+	return nil
+}
+
+// listKeys lists the blobs under the prefix with List Blobs, a page at a
+// time.
+func (a *AzureBlobStore) listKeys(ctx context.Context, fn func(key string) error) error {
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}}
+		if a.prefix != "" {
+			query.Set("prefix", a.prefix)
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := a.send(ctx, http.MethodGet, "/"+url.PathEscape(a.container), "/"+a.account+"/"+a.container, query, nil)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Blobs struct {
+				Blob []struct {
+					Name string
+				}
+			}
+			NextMarker string
+		}
+		err = blobStatus(resp)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, blob := range page.Blobs.Blob {
+			if err := fn(strings.TrimPrefix(blob.Name, a.prefix)); err != nil {
+				return err
+			}
+		}
+		if page.NextMarker == "" {
+			return nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+// SignURL returns the blob's URL with a service SAS granting read access
+// for downloads, or create and write access for uploads. Uploads must say
+// they are creating a block blob.
+func (a *AzureBlobStore) SignURL(key string, opts URLOptions) (string, map[string]string, error) {
+	var permissions, disposition, contentType string
+	headers := map[string]string{}
+	switch opts.Method {
+	case http.MethodGet:
+		permissions, contentType = "r", opts.ContentType
+		if opts.Filename != "" {
+			disposition = attachment(opts.Filename)
+		}
+	case http.MethodPut:
+		permissions = "cw"
+		headers["x-ms-blob-type"] = "BlockBlob"
+		if opts.ContentType != "" {
+			headers["Content-Type"] = opts.ContentType
+		}
+	default:
+		return "", nil, fmt.Errorf("cannot sign %s requests", opts.Method)
+	}
+	expiry := time.Now().UTC().Add(opts.Expires).Format("2006-01-02T15:04:05Z")
+	protocol := "https"
+	if a.endpoint.Scheme == "http" {
+		protocol = "https,http"
+	}
+
+	stringToSign := strings.Join([]string{
+		permissions,
+		"", // start
+		expiry,
+		"/blob" + a.resource(key),
+		"", // stored access policy
+		"", // ip range
+		protocol,
+		azureVersion,
+		"b", // resource: a blob
+		"",  // snapshot
+		"",  // encryption scope
+		"",  // cache control
+		disposition,
+		"", // content encoding
+		"", // content language
+		contentType,
+	}, "\n")
+	query := url.Values{}
+	query.Set("sv", azureVersion)
+	query.Set("sr", "b")
+	query.Set("sp", permissions)
+	query.Set("se", expiry)
+	query.Set("spr", protocol)
+	if disposition != "" {
+		query.Set("rscd", disposition)
+	}
+	if contentType != "" {
+		query.Set("rsct", contentType)
+	}
+	query.Set("sig", a.hmac(stringToSign))
+	return a.endpoint.String() + a.blobPath(key) + "?" + query.Encode(), headers, nil
+}
@@ -0,0 +1,522 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// encryptedBlobMagic starts every blob the EncryptedBlobStore writes.
+	// Blobs without it were stored before encryption was turned on.
+	encryptedBlobMagic = "TGE1"
+	kmsKeyPrefix       = "kms:"
+	maxEnvelopeKeyID   = 255
+	dataKeyBytes       = 32
+	maxCachedDataKeys  = 1024
+)
+
+var (
+	errBlobCorrupt   = errors.New("encrypted blob is corrupt")
+	errRekeyRunning  = errors.New("blobs are already being re-encrypted")
+	errCannotList    = errors.New("the blob store cannot list its blobs")
+	errBlobPlaintext = errors.New("blob is stored in plaintext and encryption is required")
+)
+
+// keyWrapper encrypts data keys under a master key and decrypts them again.
+type keyWrapper interface {
+	wrap(ctx context.Context, dataKey []byte) ([]byte, error)
+	unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// localKey is a master key from the configuration. The key's ID is
+// authenticated with each data key it wraps.
+type localKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newLocalKey(id string, key []byte) (*localKey, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &localKey{id: id, aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *localKey) wrap(_ context.Context, dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, dataKey, []byte(k.id)), nil
+}
+
+func (k *localKey) unwrap(_ context.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < k.aead.NonceSize() {
+		return nil, errBlobCorrupt
+	}
+	nonce, sealed := wrapped[:k.aead.NonceSize()], wrapped[k.aead.NonceSize():]
+	return k.aead.Open(nil, nonce, sealed, []byte(k.id))
+}
+
+// kmsKey has a key in AWS KMS wrap data keys, so the master key never
+// leaves KMS. Unwrapped data keys are cached, as every read would
+// otherwise be a call to KMS.
+type kmsKey struct {
+	keyID    string
+	endpoint *url.URL
+	signer   awsSigner
+	client   *http.Client
+
+	cache map[string][]byte
+	mu    sync.Mutex
+}
+
+func newKMSKey(cfg KMSConfig) (*kmsKey, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + cfg.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("kms endpoint: %v", err)
+	}
+	return &kmsKey{
+		keyID:    cfg.KeyID,
+		endpoint: u,
+		signer:   awsSigner{accessKeyID: cfg.AccessKeyID, secret: cfg.SecretAccessKey, region: cfg.Region, service: "kms"},
+		client:   &http.Client{Timeout: 10 * time.Second},
+		cache:    make(map[string][]byte),
+	}, nil
+}
+
+// call posts a request to a KMS action and decodes the answer into out.
+func (k *kmsKey) call(ctx context.Context, action string, in, out interface{}) error {
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.endpoint.String()+"/", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	k.signer.sign(req, k.endpoint.Host, "/", "", sha256Hex(payload), time.Now().UTC())
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("kms %s returned %d: %s", action, resp.StatusCode, bytes.TrimSpace(detail))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (k *kmsKey) wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	var out struct {
+		CiphertextBlob []byte
+	}
+	err := k.call(ctx, "Encrypt", map[string]interface{}{"KeyId": k.keyID, "Plaintext": dataKey}, &out)
+	return out.CiphertextBlob, err
+}
+
+func (k *kmsKey) unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	k.mu.Lock()
+	dataKey, cached := k.cache[string(wrapped)]
+	k.mu.Unlock()
+	if cached {
+		return dataKey, nil
+	}
+	var out struct {
+		Plaintext []byte
+	}
+	if err := k.call(ctx, "Decrypt", map[string]interface{}{"KeyId": k.keyID, "CiphertextBlob": wrapped}, &out); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	if len(k.cache) >= maxCachedDataKeys {
+		k.cache = make(map[string][]byte)
+	}
+	k.cache[string(wrapped)] = out.Plaintext
+	k.mu.Unlock()
+	return out.Plaintext, nil
+}
+
+// EncryptionStats count what the EncryptedBlobStore did. PlaintextReads
+// are reads of blobs stored before encryption was turned on, and
+// PlaintextRefused those turned down because encryption is required.
+type EncryptionStats struct {
+	KeyID            string     `json:"keyId"`
+	Required         bool       `json:"required"`
+	Encrypted        int64      `json:"encrypted"`
+	Decrypted        int64      `json:"decrypted"`
+	PlaintextReads   int64      `json:"plaintextReads"`
+	PlaintextRefused int64      `json:"plaintextRefused"`
+	Rekey            *BlobRekey `json:"rekey,omitempty"`
+}
+
+// BlobRekey is a run over every blob in the store, moving those wrapped
+// under an old master key to the current one and encrypting those stored
+// in plaintext.
+type BlobRekey struct {
+	Running    bool   `json:"running"`
+	StartedAt  int64  `json:"startedAt"`
+	FinishedAt int64  `json:"finishedAt,omitempty"`
+	Scanned    int    `json:"scanned"`
+	Rewrapped  int    `json:"rewrapped"`
+	Encrypted  int    `json:"encrypted"`
+	Failed     int    `json:"failed"`
+	Error      string `json:"error,omitempty"`
+}
+
+// EncryptedBlobStore encrypts blobs before they reach the underlying store
+// with an envelope scheme: each blob has a data key of its own, for
+// AES-256-GCM, which is kept beside it wrapped by a master key. Blobs are
+// bound to their keys, so one cannot be passed off as another. Rotating
+// the master key only re-wraps data keys; the blobs themselves are not
+// encrypted again. Blobs stored before encryption was turned on are read
+// as they are, unless encryption is required: then they are refused, so a
+// plaintext blob slipped into the store cannot be served in place of one
+// the server encrypted.
+type EncryptedBlobStore struct {
+	inner    BlobStore
+	current  string
+	required bool
+	wrappers map[string]keyWrapper
+	stats    EncryptionStats
+	rekey    *BlobRekey
+	mu       sync.Mutex
+	// stripes serialise writing a key, so re-encrypting a blob cannot
+	// bring back an older version or one just deleted.
+	stripes [64]sync.Mutex
+}
+
+// NewEncryptedBlobStore encrypts the blobs put in inner with the master
+// keys cfg describes. The result does not sign URLs, as clients would get
+// the ciphertext.
+func NewEncryptedBlobStore(inner BlobStore, cfg BlobEncryptionConfig) (*EncryptedBlobStore, error) {
+	e := &EncryptedBlobStore{inner: inner, current: cfg.currentKey(), required: cfg.Required, wrappers: make(map[string]keyWrapper)}
+	for id, encoded := range cfg.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", id, err)
+		}
+		if e.wrappers[id], err = newLocalKey(id, key); err != nil {
+			return nil, fmt.Errorf("key %q: %v", id, err)
+		}
+	}
+	if cfg.KMS.KeyID != "" {
+		kms, err := newKMSKey(cfg.KMS)
+		if err != nil {
+			return nil, err
+		}
+		e.wrappers[kmsKeyPrefix+cfg.KMS.KeyID] = kms
+	}
+	e.stats.KeyID = e.current
+	e.stats.Required = e.required
+	return e, nil
+}
+
+func (e *EncryptedBlobStore) stripe(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &e.stripes[h.Sum32()%uint32(len(e.stripes))]
+}
+
+// seal encrypts data for key under a new data key, wrapped by the current
+// master key. The result is the magic, the master key's ID and the
+// wrapped data key, each after its length, the nonce and the ciphertext.
+func (e *EncryptedBlobStore) seal(ctx context.Context, key string, data []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeyBytes)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := e.wrappers[e.current].wrap(ctx, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := envelopeHeader(e.current, wrapped)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, []byte(key)), nil
+}
+
+func envelopeHeader(keyID string, wrapped []byte) []byte {
+	out := make([]byte, 0, len(encryptedBlobMagic)+3+len(keyID)+len(wrapped))
+	out = append(out, encryptedBlobMagic...)
+	out = append(out, byte(len(keyID)))
+	out = append(out, keyID...)
+	out = append(out, byte(len(wrapped)>>8), byte(len(wrapped)))
+	return append(out, wrapped...)
+}
+
+// envelope is an encrypted blob taken apart. body is the nonce and the
+// ciphertext.
+type envelope struct {
+	keyID   string
+	wrapped []byte
+	body    []byte
+}
+
+// parseEnvelope takes an encrypted blob apart, reporting false for a blob
+// that is not encrypted.
+func parseEnvelope(blob []byte) (envelope, bool, error) {
+	if !bytes.HasPrefix(blob, []byte(encryptedBlobMagic)) {
+		return envelope{}, false, nil
+	}
+	rest := blob[len(encryptedBlobMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0])+2 {
+		return envelope{}, true, errBlobCorrupt
+	}
+	var env envelope
+	env.keyID, rest = string(rest[1:1+int(rest[0])]), rest[1+int(rest[0]):]
+	n := int(binary.BigEndian.Uint16(rest))
+	if len(rest) < 2+n {
+		return envelope{}, true, errBlobCorrupt
+	}
+	env.wrapped, env.body = rest[2:2+n], rest[2+n:]
+	return env, true, nil
+}
+
+func (e *EncryptedBlobStore) dataKey(ctx context.Context, env envelope) ([]byte, error) {
+	wrapper, ok := e.wrappers[env.keyID]
+	if !ok {
+		return nil, fmt.Errorf("blob is encrypted under unknown master key %q", env.keyID)
+	}
+	return wrapper.unwrap(ctx, env.wrapped)
+}
+
+func (e *EncryptedBlobStore) open(ctx context.Context, key string, blob []byte) ([]byte, error) {
+	env, encrypted, err := parseEnvelope(blob)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		if e.required {
+			return nil, errBlobPlaintext
+		}
+		return blob, nil
+	}
+	dataKey, err := e.dataKey(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.body) < aead.NonceSize() {
+		return nil, errBlobCorrupt
+	}
+	return aead.Open(nil, env.body[:aead.NonceSize()], env.body[aead.NonceSize():], []byte(key))
+}
+
+func (e *EncryptedBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	sealed, err := e.seal(ctx, key, data)
+	if err != nil {
+		return err
+	}
+	lock := e.stripe(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := e.inner.Put(ctx, key, sealed); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.stats.Encrypted++
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *EncryptedBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	blob, err := e.inner.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := e.open(ctx, key, blob)
+	if errors.Is(err, errBlobPlaintext) {
+		e.mu.Lock()
+		e.stats.PlaintextRefused++
+		e.mu.Unlock()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decrypting blob %s: %w", key, err)
+	}
+	e.mu.Lock()
+	if bytes.HasPrefix(blob, []byte(encryptedBlobMagic)) {
+		e.stats.Decrypted++
+	} else {
+		e.stats.PlaintextReads++
+	}
+	e.mu.Unlock()
+	return data, nil
+}
+
+func (e *EncryptedBlobStore) Delete(ctx context.Context, key string) error {
+	lock := e.stripe(key)
+	lock.Lock()
+	defer lock.Unlock()
+	return e.inner.Delete(ctx, key)
+}
+
+// rekeyBlob moves one blob to the current master key, returning what it
+// did: "rewrapped", "encrypted", or "" when there was nothing to do.
+func (e *EncryptedBlobStore) rekeyBlob(ctx context.Context, key string) (string, error) {
+	lock := e.stripe(key)
+	lock.Lock()
+	defer lock.Unlock()
+	blob, err := e.inner.Get(ctx, key)
+	if errors.Is(err, ErrBlobNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	env, encrypted, err := parseEnvelope(blob)
+	if err != nil {
+		return "", err
+	}
+	if !encrypted {
+		sealed, err := e.seal(ctx, key, blob)
+		if err != nil {
+			return "", err
+		}
+		return "encrypted", e.inner.Put(ctx, key, sealed)
+	}
+	if env.keyID == e.current {
+		return "", nil
+	}
+	dataKey, err := e.dataKey(ctx, env)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := e.wrappers[e.current].wrap(ctx, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return "rewrapped", e.inner.Put(ctx, key, append(envelopeHeader(e.current, wrapped), env.body...))
+}
+
+// startRekey goes over every blob in the background, moving it to the
+// current master key.
+func (e *EncryptedBlobStore) startRekey() (BlobRekey, error) {
+	lister, ok := e.inner.(blobLister)
+	if !ok {
+		return BlobRekey{}, errCannotList
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.rekey != nil && e.rekey.Running {
+		return BlobRekey{}, errRekeyRunning
+	}
+	run := &BlobRekey{Running: true, StartedAt: getCurrentTimestamp()}
+	e.rekey = run
+	go func() {
+		ctx := context.Background()
+		err := lister.listKeys(ctx, func(key string) error {
+			did, err := e.rekeyBlob(ctx, key)
+			if err != nil {
+				logger.Warn("re-encrypting blob failed", "key", key, "error", err)
+			}
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			run.Scanned++
+			switch {
+			case err != nil:
+				run.Failed++
+			case did == "rewrapped":
+				run.Rewrapped++
+			case did == "encrypted":
+				run.Encrypted++
+			}
+			return nil
+		})
+		e.mu.Lock()
+		run.Running, run.FinishedAt = false, getCurrentTimestamp()
+		if err != nil {
+			run.Error = err.Error()
+		}
+		logger.Info("re-encrypting blobs finished", "scanned", run.Scanned, "rewrapped", run.Rewrapped, "encrypted", run.Encrypted, "failed", run.Failed)
+		e.mu.Unlock()
+	}()
+	return *run, nil
+}
+
+func (e *EncryptedBlobStore) encryptionStats() EncryptionStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stats := e.stats
+	if e.rekey != nil {
+		rekey := *e.rekey
+		stats.Rekey = &rekey
+	}
+	return stats
+}
+
+// blobLister is a BlobStore that can list the keys it holds.
+type blobLister interface {
+	listKeys(ctx context.Context, fn func(key string) error) error
+}
+
+func getBlobRekey(c *gin.Context) {
+	if blobCipher == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Blob encryption is not configured"})
+		return
+	}
+	c.JSON(http.StatusOK, blobCipher.encryptionStats())
+}
+
+// startBlobRekey re-encrypts the stored blobs under the current master
+// key, after a rotation. Old keys must stay configured until it is done.
+func startBlobRekey(c *gin.Context) {
+	if blobCipher == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Blob encryption is not configured"})
+		return
+	}
+	run, err := blobCipher.startRekey()
+	switch err {
+	case nil:
+	case errRekeyRunning:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		return
+	}
+	auditRequest(c, "blobs.rekey", "server", "", gin.H{"keyId": blobCipher.current})
+	c.JSON(http.StatusAccepted, run)
+}
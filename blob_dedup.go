@@ -0,0 +1,235 @@
+package tango
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+)
+
+// DedupStats describe what deduplication saves: Bytes is what the stored
+// keys add up to, StoredBytes what is actually kept.
+type DedupStats struct {
+	Keys        int   `json:"keys"`
+	Contents    int   `json:"contents"`
+	Bytes       int64 `json:"bytes"`
+	StoredBytes int64 `json:"storedBytes"`
+	SavedBytes  int64 `json:"savedBytes"`
+	// DedupedPuts counts puts whose content was stored already.
+	DedupedPuts int64 `json:"dedupedPuts"`
+}
+
+// blobContent is one distinct content, kept once under key in the
+// underlying store however many keys refer to it.
+type blobContent struct {
+	key  string
+	size int64
+	refs int
+}
+
+// DedupBlobStore stores identical blobs once. It keeps each content under
+// its SHA-256 digest in the underlying store and counts the keys referring
+// to it, deleting it with the last of them. The index of keys is kept in
+// memory, like the screenshots and guides the keys belong to.
+type DedupBlobStore struct {
+	inner    BlobStore
+	keys     map[string]string
+	contents map[string]*blobContent
+	// incoming holds the keys signed for direct uploads that have not
+	// been settled; their bytes are under the key itself.
+	incoming    map[string]bool
+	dedupedPuts int64
+	mu          sync.Mutex
+	// stripes serialise storing and deleting a content, so a put of a
+	// content cannot race the deletion of its last copy.
+	stripes [64]sync.Mutex
+}
+
+// signingDedupBlobStore is a DedupBlobStore over a store that signs URLs.
+type signingDedupBlobStore struct {
+	*DedupBlobStore
+	signer URLSigner
+}
+
+// NewDedupBlobStore deduplicates the blobs put in inner. The result signs
+// URLs when inner does.
+func NewDedupBlobStore(inner BlobStore) BlobStore {
+	d := &DedupBlobStore{
+		inner:    inner,
+		keys:     make(map[string]string),
+		contents: make(map[string]*blobContent),
+		incoming: make(map[string]bool),
+	}
+	if signer, ok := inner.(URLSigner); ok {
+		return signingDedupBlobStore{d, signer}
+	}
+	return d
+}
+
+func contentKey(digest string) string {
+	return "content/" + digest
+}
+
+func (d *DedupBlobStore) stripe(digest string) *sync.Mutex {
+	b, _ := hex.DecodeString(digest[:2])
+	return &d.stripes[int(b[0])%len(d.stripes)]
+}
+
+func (d *DedupBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	lock := d.stripe(digest)
+	lock.Lock()
+	d.mu.Lock()
+	content, stored := d.contents[digest]
+	d.mu.Unlock()
+	if !stored {
+		if err := d.inner.Put(ctx, contentKey(digest), data); err != nil {
+			lock.Unlock()
+			return err
+		}
+	}
+
+	d.mu.Lock()
+	previous, had := d.keys[key]
+	if had && previous == digest {
+		d.mu.Unlock()
+		lock.Unlock()
+		return nil
+	}
+	if stored {
+		d.dedupedPuts++
+	} else {
+		content = &blobContent{key: contentKey(digest), size: int64(len(data))}
+		d.contents[digest] = content
+	}
+	content.refs++
+	d.keys[key] = digest
+	d.mu.Unlock()
+	lock.Unlock()
+
+	if had {
+		return d.release(ctx, previous)
+	}
+	return nil
+}
+
+func (d *DedupBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	d.mu.Lock()
+	location, ok := d.location(key)
+	d.mu.Unlock()
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return d.inner.Get(ctx, location)
+}
+
+// location returns where key's bytes are in the underlying store. Callers
+// must hold d.mu.
+func (d *DedupBlobStore) location(key string) (string, bool) {
+	if digest, ok := d.keys[key]; ok {
+		return d.contents[digest].key, true
+	}
+	return key, d.incoming[key]
+}
+
+func (d *DedupBlobStore) Delete(ctx context.Context, key string) error {
+	d.mu.Lock()
+	digest, ok := d.keys[key]
+	delete(d.keys, key)
+	incoming := d.incoming[key]
+	delete(d.incoming, key)
+	d.mu.Unlock()
+	if incoming {
+		return d.inner.Delete(ctx, key)
+	}
+	if !ok {
+		return nil
+	}
+	return d.release(ctx, digest)
+}
+
+// release drops a reference to a content, deleting it with the last one.
+func (d *DedupBlobStore) release(ctx context.Context, digest string) error {
+	lock := d.stripe(digest)
+	lock.Lock()
+	defer lock.Unlock()
+	d.mu.Lock()
+	content := d.contents[digest]
+	if content.refs--; content.refs > 0 {
+		d.mu.Unlock()
+		return nil
+	}
+	delete(d.contents, digest)
+	d.mu.Unlock()
+	return d.inner.Delete(ctx, content.key)
+}
+
+// settle files away a claimed direct upload, whose bytes are data. If the
+// content is stored already the upload is deleted; otherwise it stays
+// where it is as the content's copy.
+func (d *DedupBlobStore) settle(ctx context.Context, key string, data []byte) error {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	lock := d.stripe(digest)
+	lock.Lock()
+	defer lock.Unlock()
+
+	d.mu.Lock()
+	if !d.incoming[key] {
+		d.mu.Unlock()
+		return nil
+	}
+	delete(d.incoming, key)
+	d.keys[key] = digest
+	content, stored := d.contents[digest]
+	if !stored {
+		d.contents[digest] = &blobContent{key: key, size: int64(len(data)), refs: 1}
+		d.mu.Unlock()
+		return nil
+	}
+	content.refs++
+	d.dedupedPuts++
+	d.mu.Unlock()
+	return d.inner.Delete(ctx, key)
+}
+
+func (d *DedupBlobStore) stats() DedupStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := DedupStats{Keys: len(d.keys), Contents: len(d.contents), DedupedPuts: d.dedupedPuts}
+	for _, content := range d.contents {
+		stats.Bytes += content.size * int64(content.refs)
+		stats.StoredBytes += content.size
+	}
+	stats.SavedBytes = stats.Bytes - stats.StoredBytes
+	return stats
+}
+
+// SignURL signs the URL of the content a key refers to. An upload goes to
+// the key itself and is deduplicated when it is settled.
+func (s signingDedupBlobStore) SignURL(key string, opts URLOptions) (string, map[string]string, error) {
+	s.mu.Lock()
+	location, ok := s.location(key)
+	if opts.Method == http.MethodPut {
+		location, ok = key, true
+		s.incoming[key] = true
+	}
+	s.mu.Unlock()
+	if !ok {
+		return "", nil, ErrBlobNotFound
+	}
+	return s.signer.SignURL(location, opts)
+}
+
+// blobSettler is a BlobStore that has to be told when a direct upload is
+// claimed.
+type blobSettler interface {
+	settle(ctx context.Context, key string, data []byte) error
+}
+
+// blobDeduper is a BlobStore that reports what deduplication saves.
+type blobDeduper interface {
+	stats() DedupStats
+}
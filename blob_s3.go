@@ -0,0 +1,319 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BlobS3    = "s3"
+	BlobGCS   = "gcs"
+	BlobAzure = "azure"
+
+	gcsEndpoint = "https://storage.googleapis.com"
+	// blobTimeout bounds a request to blob storage, which may carry a large
+	// export.
+	blobTimeout = 5 * time.Minute
+)
+
+// newBlobStore opens the blob storage cfg names, or returns nil for the
+// in-memory default.
+func newBlobStore(cfg BlobConfig) (BlobStore, error) {
+	switch cfg.Driver {
+	case BlobS3:
+		return NewS3BlobStore(cfg.S3, cfg.Prefix)
+	case BlobGCS:
+		return NewGCSBlobStore(cfg.GCS, cfg.Prefix)
+	case BlobAzure:
+		return NewAzureBlobStore(cfg.Azure, cfg.Prefix)
+	}
+	return nil, nil
+}
+
+// S3BlobStore keeps blobs as objects in an S3 bucket, signing requests and
+// URLs with AWS Signature Version 4. Cloud Storage speaks the same protocol
+// through its XML API, so it serves Cloud Storage buckets too.
+type S3BlobStore struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	pathStyle bool
+	signer    awsSigner
+	client    *http.Client
+}
+
+func NewS3BlobStore(cfg S3Config, prefix string) (*S3BlobStore, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %v", err)
+	}
+	return &S3BlobStore{
+		endpoint:  u,
+		bucket:    cfg.Bucket,
+		prefix:    prefix,
+		pathStyle: cfg.PathStyle,
+		signer:    awsSigner{accessKeyID: cfg.AccessKeyID, secret: cfg.SecretAccessKey, region: cfg.Region, service: "s3"},
+		client:    &http.Client{Timeout: blobTimeout},
+	}, nil
+}
+
+// NewGCSBlobStore reaches a Cloud Storage bucket with an HMAC key, which
+// its XML API accepts in place of AWS credentials.
+func NewGCSBlobStore(cfg GCSConfig, prefix string) (*S3BlobStore, error) {
+	u, _ := url.Parse(gcsEndpoint)
+	return &S3BlobStore{
+		endpoint:  u,
+		bucket:    cfg.Bucket,
+		prefix:    prefix,
+		pathStyle: true,
+		signer:    awsSigner{accessKeyID: cfg.AccessKeyID, secret: cfg.Secret, region: "auto", service: "s3"},
+		client:    &http.Client{Timeout: blobTimeout},
+	}, nil
+}
+
+// object returns the host and escaped path of key's object.
+func (s *S3BlobStore) object(key string) (string, string) {
+	host, path := s.endpoint.Host, escapeBlobKey(s.prefix+key)
+	if s.pathStyle {
+		path = "/" + url.PathEscape(s.bucket) + path
+	} else {
+		host = s.bucket + "." + host
+	}
+	return host, path
+}
+
+func (s *S3BlobStore) do(ctx context.Context, method, key string, data []byte) (*http.Response, error) {
+	host, path := s.object(key)
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint.Scheme+"://"+host+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		req.Body, req.ContentLength = nil, 0
+	}
+	s.signer.sign(req, host, path, "", sha256Hex(data), time.Now().UTC())
+	return s.client.Do(req)
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return blobStatus(resp)
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := blobStatus(resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := blobStatus(resp); err != ErrBlobNotFound {
+		return err
+	}
+	return nil
+}
+
+// listKeys lists the objects under the prefix with ListObjectsV2, a page
+// at a time.
+func (s *S3BlobStore) listKeys(ctx context.Context, fn func(key string) error) error {
+	host, path := s.endpoint.Host, "/"
+	if s.pathStyle {
+		path = "/" + url.PathEscape(s.bucket)
+	} else {
+		host = s.bucket + "." + host
+	}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		canonicalQuery := awsQuery(query)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.endpoint.Scheme+"://"+host+path+"?"+canonicalQuery, nil)
+		if err != nil {
+			return err
+		}
+		s.signer.sign(req, host, path, canonicalQuery, sha256Hex(nil), time.Now().UTC())
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = blobStatus(resp)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			if err := fn(strings.TrimPrefix(object.Key, s.prefix)); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// SignURL presigns a request for key in the query string. Only the host is
+// signed, so an upload's content type is checked when it is claimed.
+func (s *S3BlobStore) SignURL(key string, opts URLOptions) (string, map[string]string, error) {
+	host, path := s.object(key)
+	now := time.Now().UTC()
+	query := url.Values{}
+	headers := map[string]string{}
+	switch opts.Method {
+	case http.MethodGet:
+		if opts.ContentType != "" {
+			query.Set("response-content-type", opts.ContentType)
+		}
+		if opts.Filename != "" {
+			query.Set("response-content-disposition", attachment(opts.Filename))
+		}
+	case http.MethodPut:
+		if opts.ContentType != "" {
+			headers["Content-Type"] = opts.ContentType
+		}
+	default:
+		return "", nil, fmt.Errorf("cannot sign %s requests", opts.Method)
+	}
+	signed := s.signer.presign(opts.Method, host, path, query, opts.Expires, now)
+	return s.endpoint.Scheme + "://" + host + path + "?" + signed, headers, nil
+}
+
+// awsSigner signs requests with AWS Signature Version 4.
+type awsSigner struct {
+	accessKeyID, secret, region, service string
+}
+
+func (a awsSigner) scope(day string) string {
+	return day + "/" + a.region + "/" + a.service + "/aws4_request"
+}
+
+func (a awsSigner) signature(day, amzDate, canonical string) string {
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + a.scope(day) + "\n" + sha256Hex([]byte(canonical))
+	key := []byte("AWS4" + a.secret)
+	for _, part := range []string{day, a.region, a.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// sign adds the Authorization header to req, whose escaped path is path
+// and canonical query string query.
+func (a awsSigner) sign(req *http.Request, host, path, query, payloadHash string, now time.Time) {
+	amzDate, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := req.Method + "\n" + path + "\n" + query + "\n" +
+		"host:" + host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n\n" +
+		signedHeaders + "\n" + payloadHash
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.accessKeyID, a.scope(day), signedHeaders, a.signature(day, amzDate, canonical)))
+}
+
+// presign adds the signing parameters to query and returns it encoded,
+// signature last.
+func (a awsSigner) presign(method, host, path string, query url.Values, expires time.Duration, now time.Time) string {
+	amzDate, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", a.accessKeyID+"/"+a.scope(day))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	canonicalQuery := awsQuery(query)
+	canonical := method + "\n" + path + "\n" + canonicalQuery + "\n" +
+		"host:" + host + "\n\n" +
+		"host\nUNSIGNED-PAYLOAD"
+	return canonicalQuery + "&X-Amz-Signature=" + a.signature(day, amzDate, canonical)
+}
+
+// awsQuery encodes query the way Signature Version 4 wants it: sorted by
+// name, with spaces as %20.
+func awsQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// escapeBlobKey escapes each segment of key for use as a URL path.
+func escapeBlobKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func attachment(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
+
+// blobStatus turns an unsuccessful response from blob storage into an
+// error, ErrBlobNotFound for a 404.
+func blobStatus(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrBlobNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("blob storage returned %d: %s", resp.StatusCode, bytes.TrimSpace(detail))
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package tango
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scheduled sessions are offered as iCalendar events: one at a time for
+// download or as an email attachment, and together in a per-user feed that
+// calendar apps subscribe to. An event's UID is the session's, so the same
+// session seen through different routes is one event.
+
+const (
+	calendarEventLength = time.Hour
+	// calendarFeedWindow is how long a session stays in feeds after its
+	// start time.
+	calendarFeedWindow = 30 * 86400
+)
+
+// calendarEvent is what a session's event shows.
+type calendarEvent struct {
+	ID          string
+	Name        string
+	Description string
+	StartAt     int64
+}
+
+// eventOf returns session's event. Callers must hold session.mu.
+func eventOf(session *Session) calendarEvent {
+	return calendarEvent{
+		ID:          session.ID,
+		Name:        session.Name,
+		Description: session.Description,
+		StartAt:     session.StartAt,
+	}
+}
+
+// buildCalendar encodes events as an iCalendar file.
+func buildCalendar(name string, events []calendarEvent) []byte {
+	now := icsTime(getCurrentTimestamp())
+	var b strings.Builder
+	line := func(content string) {
+		writeFolded(&b, content)
+	}
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//Tango//Sessions//EN")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	if name != "" {
+		line("X-WR-CALNAME:" + icsEscape(name))
+	}
+	for _, event := range events {
+		link := ""
+		if config.Email.AppURL != "" {
+			link = strings.TrimSuffix(config.Email.AppURL, "/") + "/sessions/" + event.ID
+		}
+		description := event.Description
+		if link != "" {
+			description = strings.TrimSpace(description + "\n\nJoin: " + link)
+		}
+
+		line("BEGIN:VEVENT")
+		line("UID:" + event.ID + "@tango")
+		line("DTSTAMP:" + now)
+		line("DTSTART:" + icsTime(event.StartAt))
+		line("DTEND:" + icsTime(event.StartAt+int64(calendarEventLength.Seconds())))
+		line("SUMMARY:" + icsEscape(event.Name))
+		if description != "" {
+			line("DESCRIPTION:" + icsEscape(description))
+		}
+		if link != "" {
+			line("URL:" + link)
+		}
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return []byte(b.String())
+}
+
+func icsTime(t int64) string {
+	return time.Unix(t, 0).UTC().Format("20060102T150405Z")
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", "")
+
+func icsEscape(text string) string {
+	return icsEscaper.Replace(text)
+}
+
+// writeFolded writes a content line, folded every 75 octets without
+// splitting a UTF-8 sequence, as iCalendar requires.
+func writeFolded(b *strings.Builder, content string) {
+	limit := 75
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && content[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(content[:cut] + "\r\n ")
+		content = content[cut:]
+		// The leading space of a continuation counts towards its length.
+		limit = 74
+	}
+	b.WriteString(content + "\r\n")
+}
+
+// sessionInvite is the calendar attachment for a scheduled session.
+func sessionInvite(event calendarEvent) EmailAttachment {
+	return EmailAttachment{
+		Name:        "invite.ics",
+		ContentType: "text/calendar; charset=utf-8; method=PUBLISH",
+		Data:        buildCalendar("", []calendarEvent{event}),
+	}
+}
+
+func getSessionCalendar(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	session.mu.Lock()
+	trashed, event := session.Status == SessionTrashed, eventOf(session)
+	session.mu.Unlock()
+	if trashed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if event.StartAt == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session is not scheduled"})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="session.ics"`)
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", buildCalendar("", []calendarEvent{event}))
+}
+
+// calendarFeed is a user's calendar subscription. viaSSO records how the
+// user was signed in when making it, which decides the workspaces it
+// covers.
+type calendarFeed struct {
+	userID    string
+	viaSSO    bool
+	createdAt int64
+}
+
+// CalendarRegistry holds each user's calendar feed, keyed by the hash of
+// its token, and the scheduled sessions users were invited to by email.
+type CalendarRegistry struct {
+	feeds   map[string]*calendarFeed
+	byUser  map[string]string
+	invited map[string]map[string]bool
+	mu      sync.Mutex
+}
+
+var calendars = &CalendarRegistry{
+	feeds:   make(map[string]*calendarFeed),
+	byUser:  make(map[string]string),
+	invited: make(map[string]map[string]bool),
+}
+
+// create gives the user a new feed token, replacing any earlier one.
+func (r *CalendarRegistry) create(userID string, viaSSO bool) (string, *calendarFeed) {
+	token := randomToken(24)
+	feed := &calendarFeed{userID: userID, viaSSO: viaSSO, createdAt: getCurrentTimestamp()}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.feeds, r.byUser[userID])
+	r.feeds[hashToken(token)] = feed
+	r.byUser[userID] = hashToken(token)
+	return token, feed
+}
+
+func (r *CalendarRegistry) feedOf(userID string) *calendarFeed {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.feeds[r.byUser[userID]]
+}
+
+func (r *CalendarRegistry) byToken(token string) *calendarFeed {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.feeds[hashToken(token)]
+}
+
+// revoke removes the user's feed and reports whether there was one.
+func (r *CalendarRegistry) revoke(userID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hash, exists := r.byUser[userID]
+	delete(r.feeds, hash)
+	delete(r.byUser, userID)
+	return exists
+}
+
+func (r *CalendarRegistry) invite(userID, sessionID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.invited[userID] == nil {
+		r.invited[userID] = make(map[string]bool)
+	}
+	r.invited[userID][sessionID] = true
+}
+
+// invitedTo returns the IDs of the sessions the user was invited to.
+func (r *CalendarRegistry) invitedTo(userID string) map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make(map[string]bool, len(r.invited[userID]))
+	for id := range r.invited[userID] {
+		ids[id] = true
+	}
+	return ids
+}
+
+func (r *CalendarRegistry) forgetUser(userID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.feeds, r.byUser[userID])
+	delete(r.byUser, userID)
+	delete(r.invited, userID)
+}
+
+func (r *CalendarRegistry) forgetSession(sessionID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for userID, sessions := range r.invited {
+		delete(sessions, sessionID)
+		if len(sessions) == 0 {
+			delete(r.invited, userID)
+		}
+	}
+}
+
+// inviteByEmail puts a scheduled session in the feed of the user with
+// address, if there is one.
+func inviteByEmail(address, sessionID string) {
+	users.mu.Lock()
+	user := users.byEmail[normalizeEmail(address)]
+	users.mu.Unlock()
+	if user != nil {
+		calendars.invite(user.ID, sessionID)
+	}
+}
+
+// feedEvents returns the events of the scheduled sessions feed's user
+// created, can see through a workspace or was invited to, from the window
+// before now on, soonest first.
+func feedEvents(feed *calendarFeed, user *User, now int64) []calendarEvent {
+	mine := workspaces.memberships(user, feed.viaSSO)
+	invited := calendars.invitedTo(user.ID)
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	events := []calendarEvent{}
+	for _, session := range store.Sessions {
+		session.mu.Lock()
+		if session.StartAt != 0 && session.StartAt >= now-calendarFeedWindow && session.Status != SessionTrashed &&
+			(session.WorkspaceID == "" && session.CreatedBy == user.ID || mine[session.WorkspaceID] ||
+				invited[session.ID]) {
+			events = append(events, eventOf(session))
+		}
+		session.mu.Unlock()
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].StartAt != events[j].StartAt {
+			return events[i].StartAt < events[j].StartAt
+		}
+		return events[i].ID < events[j].ID
+	})
+	return events
+}
+
+// getCalendarFeed serves a user's feed to calendar apps, which cannot send
+// credentials, so the token in the URL is the credential.
+func getCalendarFeed(c *gin.Context) {
+	feed := calendars.byToken(strings.TrimSuffix(c.Param("token"), ".ics"))
+	var user *User
+	if feed != nil {
+		users.mu.Lock()
+		user = users.Users[feed.userID]
+		users.mu.Unlock()
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Calendar not found"})
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=300")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", buildCalendar("Tango sessions", feedEvents(feed, user, getCurrentTimestamp())))
+}
+
+func getCalendarSubscription(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	feed := calendars.feedOf(user.ID)
+	if feed == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "createdAt": feed.createdAt})
+}
+
+// createCalendarSubscription makes a new feed URL for the caller. Only its
+// hash is kept, so the URL is shown once, and making a new one retires the
+// old.
+func createCalendarSubscription(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	token, feed := calendars.create(user.ID, signedInWithSSO(c))
+	url := requestOrigin(c) + apiPrefix + "/calendars/" + token + ".ics"
+	auditRequest(c, "calendar.create", "user", user.ID, nil)
+	c.JSON(http.StatusCreated, gin.H{"url": url, "createdAt": feed.createdAt})
+}
+
+func deleteCalendarSubscription(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	if !calendars.revoke(user.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Calendar not found"})
+		return
+	}
+	auditRequest(c, "calendar.revoke", "user", user.ID, nil)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,263 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// FeatureCaptions is declared by clients that push captions without
+	// being presenters, such as a transcription plugin.
+	FeatureCaptions  = "captions"
+	CaptionSourceAPI = "api"
+
+	maxCaptionBytes        = 1000
+	maxCaptionIDBytes      = 64
+	maxCaptionSpeakerBytes = 100
+	maxCaptionLangBytes    = 16
+	maxStoredCaptions      = 5000
+	// captionIndexDelay batches the captions of a stretch of speech into
+	// one update of the session's search entry.
+	captionIndexDelay = 5 * time.Second
+)
+
+// Caption is a stretch of transcribed speech. Start and End are Unix times
+// in milliseconds. Interim captions are relayed as they are recognised and
+// replaced by a final one with the same ID; only final captions are kept.
+type Caption struct {
+	ID      string `json:"id"`
+	Text    string `json:"text"`
+	Start   int64  `json:"start"`
+	End     int64  `json:"end"`
+	Final   bool   `json:"final"`
+	Speaker string `json:"speaker,omitempty"`
+	Lang    string `json:"lang,omitempty"`
+	Source  string `json:"source"`
+}
+
+// validate checks a caption from source and fills in its defaults.
+func (c *Caption) validate(source string) error {
+	c.Text = strings.TrimSpace(c.Text)
+	if c.Text == "" || len(c.Text) > maxCaptionBytes {
+		return fmt.Errorf("caption text must be 1-%d bytes", maxCaptionBytes)
+	}
+	if len(c.ID) > maxCaptionIDBytes {
+		return fmt.Errorf("caption id must be at most %d characters", maxCaptionIDBytes)
+	}
+	if len(c.Speaker) > maxCaptionSpeakerBytes || len(c.Lang) > maxCaptionLangBytes {
+		return errors.New("caption speaker or lang is too long")
+	}
+	if c.Start < 0 || c.End < 0 || c.End != 0 && c.End < c.Start {
+		return errors.New("caption end must not be before its start")
+	}
+	if c.ID == "" {
+		c.ID = generateID()
+	}
+	now := time.Now().UnixMilli()
+	if c.End == 0 {
+		c.End = now
+	}
+	if c.Start == 0 {
+		c.Start = c.End
+	}
+	c.Source = source
+	return nil
+}
+
+// CaptionLog keeps the final captions of each session, the most recent
+// maxStoredCaptions of them, as the session's transcript.
+type CaptionLog struct {
+	captions map[string][]Caption
+	indexing map[string]bool
+	mu       sync.Mutex
+}
+
+var captions = &CaptionLog{
+	captions: make(map[string][]Caption),
+	indexing: make(map[string]bool),
+}
+
+// add stores caption and reports whether the session's search entry needs
+// an update scheduled.
+func (l *CaptionLog) add(sessionID string, caption Caption) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stored := append(l.captions[sessionID], caption)
+	if len(stored) > maxStoredCaptions {
+		stored = stored[len(stored)-maxStoredCaptions:]
+	}
+	l.captions[sessionID] = stored
+	if l.indexing[sessionID] {
+		return false
+	}
+	l.indexing[sessionID] = true
+	return true
+}
+
+// List returns a session's transcript in order of start time.
+func (l *CaptionLog) List(sessionID string) []Caption {
+	l.mu.Lock()
+	list := append([]Caption{}, l.captions[sessionID]...)
+	l.mu.Unlock()
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Start < list[j].Start })
+	return list
+}
+
+// Text returns a session's transcript as one text for the search index.
+func (l *CaptionLog) Text(sessionID string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	texts := make([]string, len(l.captions[sessionID]))
+	for i, caption := range l.captions[sessionID] {
+		texts[i] = caption.Text
+	}
+	return strings.Join(texts, " ")
+}
+
+func (l *CaptionLog) Forget(sessionID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.captions, sessionID)
+}
+
+// reindexLater updates session's search entry with its transcript once
+// the captions of the moment are in.
+func (l *CaptionLog) reindexLater(session *Session) {
+	time.AfterFunc(captionIndexDelay, func() {
+		l.mu.Lock()
+		delete(l.indexing, session.ID)
+		l.mu.Unlock()
+		reindexSession(session)
+	})
+}
+
+// relayCaption sends caption to the session and keeps it if it is final,
+// unless the session is end-to-end encrypted.
+func relayCaption(span *Span, session *Session, caption Caption, exclude string) {
+	broadcastToSession(span, session.ID, Message{Type: "caption", Payload: caption}, exclude)
+	if caption.Final && !session.E2EE && captions.add(session.ID, caption) {
+		captions.reindexLater(session)
+	}
+}
+
+// canCaption reports whether client may push captions. Callers must hold
+// session.mu.
+func canCaption(client *Client) bool {
+	if isHost(client) {
+		return true
+	}
+	for _, feature := range client.Features {
+		if feature == FeatureCaptions {
+			return true
+		}
+	}
+	return false
+}
+
+func handleCaption(client *Client, session *Session, span *Span, msg InboundMessage) {
+	session.mu.Lock()
+	permitted := canCaption(client)
+	session.mu.Unlock()
+	if !permitted {
+		sendError(client, "forbidden", "Only presenters and clients with the captions feature can send captions")
+		return
+	}
+
+	var caption Caption
+	if err := json.Unmarshal(msg.Payload, &caption); err != nil {
+		sendError(client, "invalid_payload", "caption payload must be an object with text")
+		return
+	}
+	if err := caption.validate(client.ID); err != nil {
+		span.SetError(err)
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	relayCaption(span, session, caption, client.ID)
+}
+
+// postCaptions takes captions from a server-side transcription service,
+// in order, and relays them like those sent over a connection.
+func postCaptions(c *gin.Context) {
+	var req struct {
+		Captions []Caption `json:"captions" binding:"required,min=1,max=100"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	if session.E2EE {
+		rejectEncrypted(c, "transcripts")
+		return
+	}
+	session.mu.Lock()
+	live := session.acceptsJoins()
+	session.mu.Unlock()
+	if !live {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session has ended"})
+		return
+	}
+	for i := range req.Captions {
+		if err := req.Captions[i].validate(CaptionSourceAPI); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("captions[%d]: %s", i, err)})
+			return
+		}
+	}
+
+	span := requestSpan(c)
+	for _, caption := range req.Captions {
+		relayCaption(span, session, caption, "")
+	}
+	c.JSON(http.StatusAccepted, gin.H{"relayed": len(req.Captions)})
+}
+
+// getCaptions returns a session's transcript as JSON or, with format=vtt,
+// as WebVTT timed from its first caption.
+func getCaptions(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	list := captions.List(session.ID)
+	if c.Query("format") != "vtt" {
+		c.JSON(http.StatusOK, gin.H{"captions": list})
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i, caption := range list {
+		b.WriteString("\n" + strconv.Itoa(i+1) + "\n")
+		b.WriteString(vttTime(caption.Start-list[0].Start) + " --> " + vttTime(caption.End-list[0].Start) + "\n")
+		if caption.Speaker != "" {
+			b.WriteString("<v " + vttEscape(caption.Speaker) + ">")
+		}
+		b.WriteString(vttEscape(caption.Text) + "\n")
+	}
+	c.Data(http.StatusOK, "text/vtt; charset=utf-8", []byte(b.String()))
+}
+
+func vttTime(ms int64) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\n", " ", "-->", "--&gt;")
+
+func vttEscape(text string) string {
+	return vttEscaper.Replace(text)
+}
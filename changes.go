@@ -0,0 +1,330 @@
+package tango
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	changeLogMemoryLimit = 100000
+	defaultChangePage    = 500
+	maxChangePage        = 5000
+
+	ChangeMessageRelayed = "message.relayed"
+)
+
+var errChangesDropped = errors.New("changes after that offset are no longer kept")
+
+// ChangeEvent is one change to the store. Lifecycle events carry the
+// payload their webhooks get as Data; message.relayed carries the message
+// type, its stream seq and how many clients it went to, never its payload.
+type ChangeEvent struct {
+	Offset    int64           `json:"offset"`
+	At        int64           `json:"at"`
+	Type      string          `json:"type"`
+	SessionID string          `json:"sessionId,omitempty"`
+	ClientID  string          `json:"clientId,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// ChangeLog is an append-only log of the changes to the store, numbered by
+// offset, for consumers that build indexes or analytics from it instead of
+// polling the API. Like the audit log it keeps the most recent events in
+// memory and, with a file configured, appends every event to it and replays
+// the file on startup, so offsets carry across restarts.
+type ChangeLog struct {
+	events  []ChangeEvent
+	offset  int64
+	file    *os.File
+	changed chan struct{}
+	stopped chan struct{}
+	mu      sync.Mutex
+}
+
+var changes = &ChangeLog{changed: make(chan struct{}), stopped: make(chan struct{})}
+
+func openChangeLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	changes.mu.Lock()
+	defer changes.mu.Unlock()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	skipped := 0
+	for scanner.Scan() {
+		var event ChangeEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.Offset <= changes.offset {
+			skipped++
+			continue
+		}
+		if event.Offset != changes.offset+1 {
+			// Keep the in-memory tail contiguous so reads can index it.
+			changes.events = nil
+		}
+		changes.offset = event.Offset
+		changes.keep(event)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+	if skipped > 0 {
+		logger.Warn("skipped unreadable change log entries", "path", path, "count", skipped)
+	}
+	changes.file = file
+	return nil
+}
+
+// keep adds event to the in-memory tail. Callers must hold l.mu.
+func (l *ChangeLog) keep(event ChangeEvent) {
+	l.events = append(l.events, event)
+	if len(l.events) > changeLogMemoryLimit {
+		l.events = l.events[len(l.events)-changeLogMemoryLimit:]
+	}
+}
+
+// Record appends a change. payload is encoded before Record returns, so
+// callers may pass state they hold the lock for.
+func (l *ChangeLog) Record(eventType string, payload interface{}) {
+	sessionID, clientID := eventSubject(payload)
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error("encoding change failed", "type", eventType, "error", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.offset++
+	event := ChangeEvent{
+		Offset:    l.offset,
+		At:        time.Now().UnixMilli(),
+		Type:      eventType,
+		SessionID: sessionID,
+		ClientID:  clientID,
+		Data:      data,
+	}
+	l.keep(event)
+	close(l.changed)
+	l.changed = make(chan struct{})
+	if l.file == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err == nil {
+		_, err = l.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		logger.Error("writing change failed", "type", eventType, "error", err)
+	}
+}
+
+// eventSubject returns the session and client an event payload is about.
+func eventSubject(payload interface{}) (sessionID, clientID string) {
+	if p, ok := payload.(gin.H); ok {
+		clientID, _ = p["clientId"].(string)
+	}
+	return eventSessionID(payload), clientID
+}
+
+type ChangeFilter struct {
+	Type      string
+	SessionID string
+}
+
+func (f ChangeFilter) Match(event ChangeEvent) bool {
+	if f.SessionID != "" && event.SessionID != f.SessionID {
+		return false
+	}
+	if prefix := strings.TrimSuffix(f.Type, "*"); prefix != f.Type {
+		return strings.HasPrefix(event.Type, prefix)
+	}
+	return f.Type == "" || event.Type == f.Type
+}
+
+// Read returns up to limit matching events after offset, the offset to
+// read from next, and whether more may remain. changed is closed when the
+// next event is appended. Reading from before the oldest event kept fails
+// with errChangesDropped.
+func (l *ChangeLog) Read(offset int64, f ChangeFilter, limit int) (events []ChangeEvent, next int64, more bool, changed <-chan struct{}, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changed, next, events = l.changed, offset, []ChangeEvent{}
+	if offset >= l.offset {
+		return events, next, false, changed, nil
+	}
+	if len(l.events) == 0 || offset+1 < l.events[0].Offset {
+		return nil, next, false, changed, errChangesDropped
+	}
+
+	for _, event := range l.events[offset+1-l.events[0].Offset:] {
+		if len(events) == limit {
+			return events, next, true, changed, nil
+		}
+		next = event.Offset
+		if f.Match(event) {
+			events = append(events, event)
+		}
+	}
+	return events, next, false, changed, nil
+}
+
+// latest returns up to limit of the most recent matching events, oldest
+// first, and the offset of the last event recorded.
+func (l *ChangeLog) latest(f ChangeFilter, limit int) ([]ChangeEvent, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var events []ChangeEvent
+	for i := len(l.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if f.Match(l.events[i]) {
+			events = append(events, l.events[i])
+		}
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, l.offset
+}
+
+// oldest returns the offset of the oldest event kept, or 0 if there is
+// none.
+func (l *ChangeLog) oldest() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) == 0 {
+		return 0
+	}
+	return l.events[0].Offset
+}
+
+// stop ends the streams subscribed to the log, so they do not hold up a
+// shutdown.
+func (l *ChangeLog) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.stopped:
+	default:
+		close(l.stopped)
+	}
+}
+
+// changeQuery parses the offset, filter and page size of a change log
+// request. The offset may also come from Last-Event-ID, which EventSource
+// sends when it reconnects.
+func changeQuery(c *gin.Context) (int64, ChangeFilter, int, error) {
+	filter := ChangeFilter{Type: c.Query("type"), SessionID: c.Query("sessionId")}
+	after, limit := int64(0), defaultChangePage
+
+	value := c.Query("after")
+	if value == "" {
+		value = c.GetHeader("Last-Event-ID")
+	}
+	if value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return 0, filter, 0, errors.New("after must be a change log offset")
+		}
+		after = n
+	}
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxChangePage {
+			return 0, filter, 0, fmt.Errorf("limit must be between 1 and %d", maxChangePage)
+		}
+		limit = n
+	}
+	return after, filter, limit, nil
+}
+
+func changesDropped(c *gin.Context) {
+	c.JSON(http.StatusGone, gin.H{"error": errChangesDropped.Error(), "oldest": changes.oldest()})
+}
+
+// getChanges returns a page of the change log after an offset.
+func getChanges(c *gin.Context) {
+	after, filter, limit, err := changeQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	events, next, more, _, err := changes.Read(after, filter, limit)
+	if err != nil {
+		changesDropped(c)
+		return
+	}
+	resp := gin.H{"changes": events, "next": next}
+	if more {
+		resp["more"] = true
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// streamChanges sends the change log from an offset as server-sent events,
+// each with its offset as the event id, and then follows it as changes are
+// recorded.
+func streamChanges(c *gin.Context) {
+	after, filter, _, err := changeQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	events, next, more, changed, err := changes.Read(after, filter, defaultChangePage)
+	if err != nil {
+		changesDropped(c)
+		return
+	}
+	startEventStream(c)
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		for _, event := range events {
+			data, _ := json.Marshal(event)
+			if _, err := fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", event.Offset, data); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+
+		if !more {
+			select {
+			case <-changed:
+			case <-keepAlive.C:
+				if _, err := io.WriteString(c.Writer, ": keepalive\n\n"); err != nil {
+					return
+				}
+				c.Writer.Flush()
+				events = nil
+				continue
+			case <-changes.stopped:
+				return
+			case <-c.Request.Context().Done():
+				return
+			}
+		}
+		events, next, more, changed, err = changes.Read(next, filter, defaultChangePage)
+		if err != nil {
+			// The stream fell behind the in-memory tail; the client sees
+			// the gap when it reconnects from its last id and gets a 410.
+			return
+		}
+	}
+}
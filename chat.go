@@ -0,0 +1,156 @@
+package tango
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxChatBytes     = 2000
+	maxStoredChat    = 5000
+	chatSyncMessages = 100
+	chatIndexDelay   = 5 * time.Second
+)
+
+// ChatMessage is one message of a session's chat. SentAt is a Unix time in
+// milliseconds.
+type ChatMessage struct {
+	ID       string `json:"id"`
+	Text     string `json:"text"`
+	ClientID string `json:"clientId"`
+	Name     string `json:"name"`
+	SentAt   int64  `json:"sentAt"`
+}
+
+// ChatLog keeps the chat history of each session, the most recent
+// maxStoredChat messages of it. Like the transcript it is indexed with the
+// session, so search finds sessions by what was written in them.
+type ChatLog struct {
+	messages map[string][]ChatMessage
+	indexing map[string]bool
+	mu       sync.Mutex
+}
+
+var chat = &ChatLog{
+	messages: make(map[string][]ChatMessage),
+	indexing: make(map[string]bool),
+}
+
+// add stores message and reports whether the session's search entry needs
+// an update scheduled.
+func (l *ChatLog) add(sessionID string, message ChatMessage) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stored := append(l.messages[sessionID], message)
+	if len(stored) > maxStoredChat {
+		stored = stored[len(stored)-maxStoredChat:]
+	}
+	l.messages[sessionID] = stored
+	if l.indexing[sessionID] {
+		return false
+	}
+	l.indexing[sessionID] = true
+	return true
+}
+
+// List returns a session's chat history, oldest first, or only its last
+// messages when last is positive.
+func (l *ChatLog) List(sessionID string, last int) []ChatMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stored := l.messages[sessionID]
+	if last > 0 && len(stored) > last {
+		stored = stored[len(stored)-last:]
+	}
+	return append([]ChatMessage{}, stored...)
+}
+
+// Text returns a session's chat history as one text for the search index.
+func (l *ChatLog) Text(sessionID string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	texts := make([]string, len(l.messages[sessionID]))
+	for i, message := range l.messages[sessionID] {
+		texts[i] = message.Text
+	}
+	return strings.Join(texts, "\n")
+}
+
+func (l *ChatLog) Forget(sessionID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.messages, sessionID)
+}
+
+// reindexLater updates session's search entry with its chat history once
+// the messages of the moment are in.
+func (l *ChatLog) reindexLater(session *Session) {
+	time.AfterFunc(chatIndexDelay, func() {
+		l.mu.Lock()
+		delete(l.indexing, session.ID)
+		l.mu.Unlock()
+		reindexSession(session)
+	})
+}
+
+// handleChat relays a chat message to the whole session, sender included
+// so it learns the message's ID, and keeps it unless the session is
+// end-to-end encrypted.
+func handleChat(client *Client, session *Session, span *Span, msg InboundMessage) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		sendError(client, "invalid_payload", "chat payload must be an object with text")
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" || len(req.Text) > maxChatBytes {
+		sendError(client, "invalid_payload", fmt.Sprintf("chat messages must be 1-%d bytes", maxChatBytes))
+		return
+	}
+
+	message := ChatMessage{
+		ID:       generateID(),
+		Text:     req.Text,
+		ClientID: client.ID,
+		Name:     client.Name,
+		SentAt:   time.Now().UnixMilli(),
+	}
+	broadcastToSession(span, session.ID, Message{Type: "chat", Payload: message}, "")
+	if !session.E2EE && chat.add(session.ID, message) {
+		chat.reindexLater(session)
+	}
+}
+
+// sendChatSync brings a client that just joined up to date with the last
+// messages of the chat.
+func sendChatSync(client *Client, session *Session) {
+	list := chat.List(session.ID, chatSyncMessages)
+	if len(list) == 0 {
+		return
+	}
+	client.send(Message{
+		Type: "chat_sync",
+		Payload: gin.H{
+			"sessionId": session.ID,
+			"messages":  list,
+		},
+	})
+}
+
+// getChat returns a session's chat history.
+func getChat(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": chat.List(session.ID, 0)})
+}
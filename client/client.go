@@ -0,0 +1,279 @@
+// Package client is a Go client for a Tango server: session CRUD over the
+// REST API, and joining sessions over the WebSocket protocol with typed
+// messages, callbacks and automatic reconnection.
+//
+//	c := client.New("https://tango.example.com", token)
+//	session, err := c.CreateSession(ctx, client.CreateSessionRequest{Name: "Demo"})
+//	conn, err := c.Join(ctx, session.ID, client.JoinOptions{Name: "bot", Role: client.RoleViewer}, client.Handlers{
+//		ScreenData: func(frame client.ScreenData) { ... },
+//	})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIVersion is the REST API version the client speaks.
+const APIVersion = "v1"
+
+// Client talks to one Tango server. Its zero value is not usable; create
+// one with New.
+type Client struct {
+	// BaseURL is the server's address, such as https://tango.example.com.
+	BaseURL string
+	// Token is the API token sent as a bearer token. It may be empty for
+	// sessions outside any workspace.
+	Token string
+	// HTTPClient makes REST calls. WebSocket connections don't use it.
+	HTTPClient *http.Client
+}
+
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Session mirrors the server's session representation.
+type Session struct {
+	ID                string            `json:"id"`
+	Name              string            `json:"name"`
+	ExternalRef       string            `json:"externalRef,omitempty"`
+	ExternalID        string            `json:"externalId,omitempty"`
+	WorkspaceID       string            `json:"workspaceId,omitempty"`
+	Owner             string            `json:"owner,omitempty"`
+	Description       string            `json:"description,omitempty"`
+	Tags              []string          `json:"tags,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	CollectionID      string            `json:"collectionId,omitempty"`
+	CreatedAt         int64             `json:"createdAt"`
+	Status            string            `json:"status"`
+	EndedAt           int64             `json:"endedAt,omitempty"`
+	DeletedAt         int64             `json:"deletedAt,omitempty"`
+	AutoEnd           bool              `json:"autoEnd"`
+	MaxClients        int               `json:"maxClients,omitempty"`
+	IdleTTL           int               `json:"idleTtlSeconds,omitempty"`
+	ViewerAnnotations bool              `json:"viewerAnnotations"`
+	SFU               bool              `json:"sfu"`
+	MaxFPS            int               `json:"maxFps,omitempty"`
+	WaitingRoom       bool              `json:"waitingRoom"`
+	WaitingTimeout    int               `json:"waitingTimeoutSeconds,omitempty"`
+	StartAt           int64             `json:"startAt,omitempty"`
+	RemindedAt        int64             `json:"remindedAt,omitempty"`
+}
+
+type CreateSessionRequest struct {
+	Name              string            `json:"name"`
+	ExternalRef       string            `json:"externalRef,omitempty"`
+	ExternalID        string            `json:"externalId,omitempty"`
+	Owner             string            `json:"owner,omitempty"`
+	Description       string            `json:"description,omitempty"`
+	Tags              []string          `json:"tags,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	AutoEnd           bool              `json:"autoEnd,omitempty"`
+	MaxClients        int               `json:"maxClients,omitempty"`
+	IdleTTL           int               `json:"idleTtlSeconds,omitempty"`
+	ViewerAnnotations bool              `json:"viewerAnnotations,omitempty"`
+	SFU               bool              `json:"sfu,omitempty"`
+	MaxFPS            int               `json:"maxFps,omitempty"`
+	WaitingRoom       bool              `json:"waitingRoom,omitempty"`
+	WaitingTimeout    int               `json:"waitingTimeoutSeconds,omitempty"`
+	// StartAt schedules the session to open at a later Unix time.
+	StartAt int64 `json:"startAt,omitempty"`
+	// Unique returns the existing session with the same ExternalRef
+	// instead of creating another.
+	Unique       bool   `json:"unique,omitempty"`
+	WorkspaceID  string `json:"workspaceId,omitempty"`
+	CollectionID string `json:"collectionId,omitempty"`
+}
+
+// UpdateSessionRequest changes the fields that are set. A nil metadata
+// value removes the key, and an empty CollectionID takes the session out
+// of its collection.
+type UpdateSessionRequest struct {
+	Name              *string            `json:"name,omitempty"`
+	Description       *string            `json:"description,omitempty"`
+	Tags              *[]string          `json:"tags,omitempty"`
+	Metadata          map[string]*string `json:"metadata,omitempty"`
+	ViewerAnnotations *bool              `json:"viewerAnnotations,omitempty"`
+	MaxFPS            *int               `json:"maxFps,omitempty"`
+	CollectionID      *string            `json:"collectionId,omitempty"`
+	WaitingRoom       *bool              `json:"waitingRoom,omitempty"`
+	WaitingTimeout    *int               `json:"waitingTimeoutSeconds,omitempty"`
+	StartAt           *int64             `json:"startAt,omitempty"`
+}
+
+// ListOptions narrows ListSessions. Zero fields are left out.
+type ListOptions struct {
+	// Query is a search expression, as accepted by the q parameter.
+	Query       string
+	WorkspaceID string
+	// Tags lists tags every session must carry.
+	Tags []string
+	// CollectionID is a collection, or "none" for sessions in none.
+	CollectionID string
+	Trashed      bool
+	Limit        int
+	Cursor       string
+}
+
+type SessionPage struct {
+	Sessions   []Session `json:"sessions"`
+	NextCursor string    `json:"nextCursor"`
+}
+
+// APIError is an error response from the server.
+type APIError struct {
+	StatusCode int
+	Message    string `json:"error"`
+	Reason     string `json:"reason"`
+}
+
+func (e *APIError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("tango: %s (%d %s)", e.Message, e.StatusCode, e.Reason)
+	}
+	return fmt.Sprintf("tango: %s (%d)", e.Message, e.StatusCode)
+}
+
+// apiError reads the error response resp.
+func apiError(resp *http.Response) *APIError {
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(apiErr)
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
+
+// Do sends a request to an API route without a wrapper of its own. path is
+// relative to the versioned API, as in "/sessions". The JSON response is
+// decoded into out, or copied as is when out is an io.Writer.
+func (c *Client) Do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	target := c.BaseURL + "/api/" + APIVersion + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return apiError(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if w, ok := out.(io.Writer); ok {
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) ListSessions(ctx context.Context, opts ListOptions) (*SessionPage, error) {
+	query := url.Values{}
+	if opts.Query != "" {
+		query.Set("q", opts.Query)
+	}
+	if opts.WorkspaceID != "" {
+		query.Set("workspaceId", opts.WorkspaceID)
+	}
+	for _, tag := range opts.Tags {
+		query.Add("tag", tag)
+	}
+	if opts.CollectionID != "" {
+		query.Set("collectionId", opts.CollectionID)
+	}
+	if opts.Trashed {
+		query.Set("trashed", "true")
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+
+	var page SessionPage
+	if err := c.Do(ctx, http.MethodGet, "/sessions", query, nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (c *Client) CreateSession(ctx context.Context, req CreateSessionRequest) (*Session, error) {
+	var session Session
+	if err := c.Do(ctx, http.MethodPost, "/sessions", nil, req, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (c *Client) GetSession(ctx context.Context, id string) (*Session, error) {
+	var session Session
+	if err := c.Do(ctx, http.MethodGet, "/sessions/"+url.PathEscape(id), nil, nil, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (c *Client) UpdateSession(ctx context.Context, id string, req UpdateSessionRequest) (*Session, error) {
+	var session Session
+	if err := c.Do(ctx, http.MethodPatch, "/sessions/"+url.PathEscape(id), nil, req, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// EndSession ends a session and disconnects its clients.
+func (c *Client) EndSession(ctx context.Context, id string) (*Session, error) {
+	var session Session
+	if err := c.Do(ctx, http.MethodPost, "/sessions/"+url.PathEscape(id)+"/end", nil, nil, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// DeleteSession moves a session to the trash, or with permanent deletes it
+// for good.
+func (c *Client) DeleteSession(ctx context.Context, id string, permanent bool) error {
+	var query url.Values
+	if permanent {
+		query = url.Values{"permanent": {"true"}}
+	}
+	return c.Do(ctx, http.MethodDelete, "/sessions/"+url.PathEscape(id), query, nil, nil)
+}
@@ -0,0 +1,542 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	// ackEvery is how many stream messages may go unacknowledged before an
+	// ack is sent; a partial batch is acknowledged after ackInterval.
+	ackEvery    = 16
+	ackInterval = time.Second
+
+	minReconnectDelay     = 250 * time.Millisecond
+	maxReconnectDelay     = 10 * time.Second
+	defaultReconnectTries = 10
+)
+
+var (
+	ErrSessionEnded = errors.New("tango: the session ended")
+	ErrNotConnected = errors.New("tango: not connected")
+	ErrClosed       = errors.New("tango: connection closed")
+)
+
+// JoinOptions describe the client joining a session.
+type JoinOptions struct {
+	Name     string
+	Role     string
+	Features []string
+	// Transport is TransportAuto, TransportWebSocket or TransportEvents.
+	Transport string
+	// MaxReconnectAttempts caps how often a dropped connection is retried
+	// in a row: 0 means 10, and a negative number disables reconnecting.
+	MaxReconnectAttempts int
+}
+
+// Conn is a client's connection to a session. It reconnects on its own
+// when the connection drops, resuming the same client within the server's
+// grace window and asking for the stream messages it missed. When a
+// WebSocket cannot get through, it switches to server-sent events for
+// good.
+type Conn struct {
+	client    *Client
+	sessionID string
+	opts      JoinOptions
+	handlers  Handlers
+
+	// writeMu serialises writes to tr.
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	tr          transport
+	events      bool
+	clientID    string
+	resumeToken string
+	lastSeq     int64
+	ackedSeq    int64
+	retryAfter  time.Duration
+	ended       bool
+	kicked      bool
+	closed      bool
+	// closing is closed by Close, and done once run has finished.
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// Join connects to a session. It returns once the server has admitted the
+// client, or with the error that kept it out.
+func (c *Client) Join(ctx context.Context, sessionID string, opts JoinOptions, handlers Handlers) (*Conn, error) {
+	conn := &Conn{
+		client:    c,
+		sessionID: sessionID,
+		opts:      opts,
+		handlers:  handlers,
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+		events:    opts.Transport == TransportEvents,
+	}
+	tr, joined, early, err := conn.dial(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	conn.admit(tr, joined)
+	go conn.run(tr, early)
+	return conn, nil
+}
+
+// ClientID is the id the server gave this client.
+func (c *Conn) ClientID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clientID
+}
+
+// Done is closed once the connection is gone for good.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// joinQuery is the handshake as query parameters.
+func (c *Conn) joinQuery(resume bool) url.Values {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	query := url.Values{}
+	if resume {
+		query.Set("resumeClientId", c.clientID)
+		query.Set("resumeToken", c.resumeToken)
+	} else {
+		query.Set("name", c.opts.Name)
+		query.Set("role", c.opts.Role)
+		if len(c.opts.Features) > 0 {
+			query.Set("features", strings.Join(c.opts.Features, ","))
+		}
+	}
+	return query
+}
+
+// dialWebSocket opens the session's WebSocket.
+func (c *Conn) dialWebSocket(ctx context.Context, query url.Values) (*websocket.Conn, error) {
+	target, err := url.Parse(c.client.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	switch target.Scheme {
+	case "https":
+		target.Scheme = "wss"
+	case "http":
+		target.Scheme = "ws"
+	}
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/ws/" + url.PathEscape(c.sessionID)
+	target.RawQuery = query.Encode()
+
+	header := http.Header{}
+	if c.client.Token != "" {
+		header.Set("Authorization", "Bearer "+c.client.Token)
+	}
+	dialer := websocket.Dialer{HandshakeTimeout: handshakeTimeout, Proxy: http.ProxyFromEnvironment}
+	ws, resp, err := dialer.DialContext(ctx, target.String(), header)
+	if err != nil && resp != nil {
+		defer resp.Body.Close()
+		apiErr := apiError(resp)
+		if resp.StatusCode == http.StatusUpgradeRequired || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			return nil, &errWebSocketBlocked{apiErr}
+		}
+		return nil, apiErr
+	}
+	return ws, err
+}
+
+// dial opens a connection and waits for session_joined. Messages the
+// server sent ahead of it are returned to be dispatched afterwards.
+func (c *Conn) dial(ctx context.Context, resume bool) (transport, Joined, []Message, error) {
+	query := c.joinQuery(resume)
+	c.mu.Lock()
+	events := c.events
+	c.mu.Unlock()
+
+	var tr transport
+	var err error
+	if !events {
+		tr, err = c.dialWebSocket(ctx, query)
+		if err != nil && c.opts.Transport == TransportAuto && websocketBlocked(err) {
+			events = true
+		}
+	}
+	if events {
+		var et *eventsTransport
+		if et, err = c.dialEvents(ctx, query); err == nil {
+			tr = et
+			c.mu.Lock()
+			c.events = true
+			c.mu.Unlock()
+		}
+	}
+	if err != nil {
+		return nil, Joined{}, nil, err
+	}
+
+	tr.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	var early []Message
+	for {
+		var msg Message
+		if err := tr.ReadJSON(&msg); err != nil {
+			tr.Close()
+			return nil, Joined{}, nil, err
+		}
+		switch msg.Type {
+		case "session_joined":
+			var joined Joined
+			if err := json.Unmarshal(msg.Payload, &joined); err != nil {
+				tr.Close()
+				return nil, Joined{}, nil, err
+			}
+			tr.SetReadDeadline(time.Time{})
+			return tr, joined, append([]Message{msg}, early...), nil
+		case "error":
+			protoErr := &ProtocolError{}
+			json.Unmarshal(msg.Payload, protoErr)
+			tr.Close()
+			return nil, Joined{}, nil, protoErr
+		case "waiting":
+			// Held in the session's waiting room: wait for a host to
+			// admit the client, up to the room's timeout.
+			var waiting struct {
+				TimeoutSeconds int `json:"timeoutSeconds"`
+			}
+			json.Unmarshal(msg.Payload, &waiting)
+			tr.SetReadDeadline(time.Now().Add(time.Duration(waiting.TimeoutSeconds)*time.Second + handshakeTimeout))
+			early = append(early, msg)
+		case "admission_rejected":
+			var rejected struct {
+				Reason string `json:"reason"`
+			}
+			json.Unmarshal(msg.Payload, &rejected)
+			tr.Close()
+			return nil, Joined{}, nil, &ProtocolError{Code: "admission_rejected", Message: rejected.Reason}
+		default:
+			early = append(early, msg)
+		}
+	}
+}
+
+// admit records the server's session_joined for tr.
+func (c *Conn) admit(tr transport, joined Joined) {
+	if et, ok := tr.(*eventsTransport); ok {
+		et.identify(joined)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tr = tr
+	c.clientID = joined.ClientID
+	c.resumeToken = joined.ResumeToken
+	if !joined.Resumed {
+		// A fresh join starts at the stream's head.
+		c.lastSeq = joined.Seq
+		c.ackedSeq = joined.Seq
+	}
+	c.retryAfter = 0
+}
+
+// run reads from tr until the connection is gone for good, reconnecting
+// in between.
+func (c *Conn) run(tr transport, pending []Message) {
+	var err error
+	for {
+		for _, msg := range pending {
+			c.handle(msg)
+		}
+		err = c.read(tr)
+
+		c.mu.Lock()
+		closed, ended, kicked := c.closed, c.ended, c.kicked
+		c.tr = nil
+		c.mu.Unlock()
+		if closed {
+			err = nil
+			break
+		}
+		if ended {
+			err = ErrSessionEnded
+			break
+		}
+		// An operator disconnected the client on purpose.
+		if kicked || websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			break
+		}
+		if tr, pending, err = c.reconnect(err); err != nil {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.closing)
+	}
+	c.mu.Unlock()
+	close(c.done)
+	if c.handlers.Closed != nil {
+		c.handlers.Closed(err)
+	}
+}
+
+// read dispatches messages from tr until it fails.
+func (c *Conn) read(tr transport) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(ackInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.ack(false)
+			}
+		}
+	}()
+
+	for {
+		var msg Message
+		if err := tr.ReadJSON(&msg); err != nil {
+			return err
+		}
+		c.handle(msg)
+	}
+}
+
+func (c *Conn) handle(msg Message) {
+	switch msg.Type {
+	case "session_ended":
+		c.mu.Lock()
+		c.ended = true
+		c.mu.Unlock()
+	case "disconnected":
+		c.mu.Lock()
+		c.kicked = true
+		c.mu.Unlock()
+	case "server_shutting_down":
+		var notice struct {
+			ReconnectAfter int64 `json:"reconnectAfter"`
+		}
+		json.Unmarshal(msg.Payload, &notice)
+		c.mu.Lock()
+		c.retryAfter = time.Duration(notice.ReconnectAfter) * time.Millisecond
+		c.mu.Unlock()
+	}
+	if msg.Seq > 0 {
+		c.mu.Lock()
+		if msg.Seq > c.lastSeq {
+			c.lastSeq = msg.Seq
+		}
+		c.mu.Unlock()
+		c.ack(true)
+	}
+	c.handlers.dispatch(msg)
+}
+
+// ack acknowledges the stream messages received so far. With batch it
+// only does so once ackEvery of them are waiting.
+func (c *Conn) ack(batch bool) {
+	c.mu.Lock()
+	seq := c.lastSeq
+	waiting := seq - c.ackedSeq
+	if waiting <= 0 || batch && waiting < ackEvery {
+		c.mu.Unlock()
+		return
+	}
+	c.ackedSeq = seq
+	c.mu.Unlock()
+	c.Send("ack", map[string]int64{"seq": seq})
+}
+
+// reconnect dials the session again after cause dropped the connection,
+// backing off between attempts.
+func (c *Conn) reconnect(cause error) (transport, []Message, error) {
+	tries := c.opts.MaxReconnectAttempts
+	if tries == 0 {
+		tries = defaultReconnectTries
+	}
+	delay := minReconnectDelay
+	for attempt := 1; attempt <= tries; attempt++ {
+		c.mu.Lock()
+		wait := delay
+		if c.retryAfter > 0 {
+			wait, c.retryAfter = c.retryAfter, 0
+		}
+		c.mu.Unlock()
+		if c.handlers.Reconnecting != nil {
+			c.handlers.Reconnecting(attempt, cause)
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.closing:
+			return nil, nil, ErrClosed
+		}
+
+		tr, joined, pending, err := c.dial(context.Background(), true)
+		var protoErr *ProtocolError
+		if errors.As(err, &protoErr) {
+			// The server let the client go: the grace window passed.
+			// Join again as a new client.
+			tr, joined, pending, err = c.dial(context.Background(), false)
+		}
+		if err == nil {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if closed {
+				tr.Close()
+				return nil, nil, ErrClosed
+			}
+			c.admit(tr, joined)
+			c.resend(joined)
+			return tr, pending, nil
+		}
+
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusGone) {
+			return nil, nil, err
+		}
+		cause = err
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+	return nil, nil, cause
+}
+
+// resend asks for the stream messages sent while the client was away.
+func (c *Conn) resend(joined Joined) {
+	c.mu.Lock()
+	from := c.lastSeq + 1
+	c.mu.Unlock()
+	if joined.Resumed && joined.Seq >= from {
+		c.Send("resend", map[string]int64{"from": from, "to": joined.Seq})
+	}
+}
+
+// Send sends a message of any type.
+func (c *Conn) Send(msgType string, payload interface{}) error {
+	c.mu.Lock()
+	tr, closed := c.tr, c.closed
+	c.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if tr == nil {
+		return ErrNotConnected
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return tr.WriteJSON(map[string]interface{}{"type": msgType, "payload": payload})
+}
+
+// SendScreenData relays a screen frame to the session. Only presenters
+// may send frames.
+func (c *Conn) SendScreenData(frame ScreenData) error {
+	frame.ClientID = ""
+	if frame.Encoding == "" {
+		frame.Encoding = EncodingText
+	}
+	return c.Send("screen_data", frame)
+}
+
+// SendCursor moves this client's cursor; hidden hides it.
+func (c *Conn) SendCursor(x, y float64, hidden bool) error {
+	return c.Send("cursor", Cursor{X: x, Y: y, Hidden: hidden})
+}
+
+func (c *Conn) React(emoji string) error {
+	return c.Send("reaction", map[string]string{"emoji": emoji})
+}
+
+func (c *Conn) RaiseHand(raised bool) error {
+	return c.Send("raise_hand", map[string]bool{"raised": raised})
+}
+
+// CreatePoll puts a question to the session. Only presenters may.
+func (c *Conn) CreatePoll(question string, options []string, multiple bool) error {
+	return c.Send("poll_create", map[string]interface{}{"question": question, "options": options, "multiple": multiple})
+}
+
+// Vote casts this client's ballot in a poll, replacing any earlier one.
+// Options are indexes into the poll's options.
+func (c *Conn) Vote(pollID string, options ...int) error {
+	return c.Send("poll_vote", map[string]interface{}{"pollId": pollID, "options": options})
+}
+
+func (c *Conn) ClosePoll(pollID string) error {
+	return c.Send("poll_close", map[string]string{"pollId": pollID})
+}
+
+// AskQuestion adds a question to the Q&A queue, where a host approves it.
+func (c *Conn) AskQuestion(text string) error {
+	return c.Send("qa_ask", map[string]string{"text": text})
+}
+
+func (c *Conn) UpvoteQuestion(questionID string, upvoted bool) error {
+	return c.Send("qa_upvote", map[string]interface{}{"questionId": questionID, "upvoted": upvoted})
+}
+
+// ModerateQuestion marks a question approved, answered or dismissed. Only
+// presenters may.
+func (c *Conn) ModerateQuestion(questionID, status string) error {
+	return c.Send("qa_moderate", map[string]string{"questionId": questionID, "status": status})
+}
+
+// Caption is a stretch of transcribed speech. Start and End are Unix times
+// in milliseconds; zero means now.
+type Caption struct {
+	ID      string `json:"id,omitempty"`
+	Text    string `json:"text"`
+	Start   int64  `json:"start,omitempty"`
+	End     int64  `json:"end,omitempty"`
+	Final   bool   `json:"final"`
+	Speaker string `json:"speaker,omitempty"`
+	Lang    string `json:"lang,omitempty"`
+	Source  string `json:"source,omitempty"`
+}
+
+// SendCaption relays a caption to the session. Interim captions should be
+// followed by a final one with the same ID. Only presenters and clients
+// joined with the "captions" feature may send them.
+func (c *Conn) SendCaption(caption Caption) error {
+	return c.Send("caption", caption)
+}
+
+// Close leaves the session and stops reconnecting.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	tr := c.tr
+	c.mu.Unlock()
+	close(c.closing)
+
+	if ws, ok := tr.(*websocket.Conn); ok {
+		c.writeMu.Lock()
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		c.writeMu.Unlock()
+	}
+	if tr != nil {
+		tr.Close()
+	}
+	return nil
+}
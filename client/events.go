@@ -0,0 +1,203 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// TransportAuto uses a WebSocket and falls back to server-sent events
+	// when something between the client and the server blocks it.
+	TransportAuto      = ""
+	TransportWebSocket = "websocket"
+	TransportEvents    = "sse"
+)
+
+// transport carries messages to and from the server. *websocket.Conn is
+// one; eventsTransport is the other.
+type transport interface {
+	ReadJSON(v interface{}) error
+	WriteJSON(v interface{}) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// errWebSocketBlocked wraps a WebSocket handshake that failed before it
+// reached the server's handler, such as a proxy refusing the upgrade or
+// stripping it so the server answers 426.
+type errWebSocketBlocked struct {
+	err error
+}
+
+func (e *errWebSocketBlocked) Error() string { return e.err.Error() }
+func (e *errWebSocketBlocked) Unwrap() error { return e.err }
+
+// eventsTransport receives a session over server-sent events and sends
+// each message with a POST request.
+type eventsTransport struct {
+	client    *Client
+	sessionID string
+	body      io.ReadCloser
+	reader    *bufio.Reader
+	cancel    context.CancelFunc
+
+	mu       sync.Mutex
+	clientID string
+	token    string
+	deadline *time.Timer
+}
+
+// dialEvents opens the session's event stream. ctx only bounds the dial.
+func (c *Conn) dialEvents(ctx context.Context, query url.Values) (*eventsTransport, error) {
+	target := c.client.BaseURL + "/api/" + APIVersion + "/sessions/" + url.PathEscape(c.sessionID) + "/events?" + query.Encode()
+	streamCtx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, target, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if c.client.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.client.Token)
+	}
+
+	dialed := make(chan struct{})
+	defer close(dialed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-dialed:
+		}
+	}()
+
+	// The stream outlives any client timeout, so only the transport is
+	// shared.
+	stream := &http.Client{Transport: c.client.HTTPClient.Transport}
+	resp, err := stream.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer resp.Body.Close()
+		apiErr := apiError(resp)
+		if apiErr.Reason == "resume_failed" {
+			return nil, &ProtocolError{Code: apiErr.Reason, Message: apiErr.Message}
+		}
+		return nil, apiErr
+	}
+	return &eventsTransport{
+		client:    c.client,
+		sessionID: c.sessionID,
+		body:      resp.Body,
+		reader:    bufio.NewReader(resp.Body),
+		cancel:    cancel,
+	}, nil
+}
+
+// identify records the client id and token that sending requires.
+func (t *eventsTransport) identify(joined Joined) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clientID, t.token = joined.ClientID, joined.ResumeToken
+}
+
+// ReadJSON decodes the data of the next event into v.
+func (t *eventsTransport) ReadJSON(v interface{}) error {
+	var data []byte
+	for {
+		line, err := t.reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			if len(data) > 0 {
+				return json.Unmarshal(data, v)
+			}
+		case bytes.HasPrefix(line, []byte("data:")):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" "))...)
+		}
+	}
+}
+
+func (t *eventsTransport) WriteJSON(v interface{}) error {
+	t.mu.Lock()
+	clientID, token := t.clientID, t.token
+	t.mu.Unlock()
+	if clientID == "" {
+		return ErrNotConnected
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	target := t.client.BaseURL + "/api/" + APIVersion + "/sessions/" + url.PathEscape(t.sessionID) +
+		"/events?clientId=" + url.QueryEscape(clientID)
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Client-Token", token)
+	if t.client.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.client.Token)
+	}
+	resp, err := t.client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return apiError(resp)
+	}
+	return nil
+}
+
+// SetReadDeadline closes the stream if no read completes by deadline; the
+// zero time clears it.
+func (t *eventsTransport) SetReadDeadline(deadline time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.deadline != nil {
+		t.deadline.Stop()
+		t.deadline = nil
+	}
+	if !deadline.IsZero() {
+		t.deadline = time.AfterFunc(time.Until(deadline), func() { t.Close() })
+	}
+	return nil
+}
+
+func (t *eventsTransport) Close() error {
+	t.cancel()
+	return t.body.Close()
+}
+
+// websocketBlocked reports whether err, from a WebSocket dial, suggests
+// trying server-sent events instead: the handshake was refused by
+// something other than the server, or the connection failed in a way a
+// proxy might cause.
+func websocketBlocked(err error) bool {
+	var blocked *errWebSocketBlocked
+	var apiErr *APIError
+	if errors.As(err, &blocked) {
+		return true
+	}
+	return !errors.As(err, &apiErr) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
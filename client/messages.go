@@ -0,0 +1,189 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	RolePresenter = "presenter"
+	RoleViewer    = "viewer"
+
+	EncodingText    = "text"
+	EncodingBase64  = "base64"
+	EncodingDataURL = "data-url"
+
+	FrameKey   = "key"
+	FrameDelta = "delta"
+)
+
+// Message is a frame received over the WebSocket. Seq is set on messages
+// of the session's stream, which can be resent after a reconnect.
+type Message struct {
+	Type    string          `json:"type"`
+	Seq     int64           `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Joined is the session_joined message that admits the connection, on
+// the first join and after every reconnect.
+type Joined struct {
+	SessionID   string `json:"sessionId"`
+	ClientID    string `json:"clientId"`
+	ResumeToken string `json:"resumeToken"`
+	Seq         int64  `json:"seq"`
+	Resumed     bool   `json:"resumed"`
+}
+
+// ClientEvent is a client_joined, client_left or client_reconnected
+// message. Only client_joined carries the name, role and features.
+type ClientEvent struct {
+	ClientID string   `json:"clientId"`
+	Name     string   `json:"name,omitempty"`
+	Role     string   `json:"role,omitempty"`
+	Features []string `json:"features,omitempty"`
+}
+
+// Presence describes one client in a presence_sync message.
+type Presence struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Role         string   `json:"role"`
+	Features     []string `json:"features,omitempty"`
+	Status       string   `json:"status"`
+	HandRaised   bool     `json:"handRaised"`
+	JoinedAt     int64    `json:"joinedAt"`
+	LastActiveAt int64    `json:"lastActiveAt"`
+}
+
+// ScreenData is a screen frame. ClientID names the presenter on received
+// frames and is ignored when sending.
+type ScreenData struct {
+	ClientID string `json:"clientId,omitempty"`
+	Encoding string `json:"encoding"`
+	Data     string `json:"data"`
+	Frame    string `json:"frame,omitempty"`
+	Seq      int64  `json:"seq,omitempty"`
+}
+
+type Cursor struct {
+	ClientID string  `json:"clientId,omitempty"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Hidden   bool    `json:"hidden,omitempty"`
+}
+
+type Announcement struct {
+	Message string `json:"message"`
+	Level   string `json:"level"`
+	At      int64  `json:"at"`
+}
+
+// Notification is one of the signed-in user's notifications, sent to every
+// connection they have open, with how many are unread.
+type Notification struct {
+	Notification struct {
+		ID        string                 `json:"id"`
+		Type      string                 `json:"type"`
+		Text      string                 `json:"text"`
+		SessionID string                 `json:"sessionId,omitempty"`
+		ActorID   string                 `json:"actorId,omitempty"`
+		Data      map[string]interface{} `json:"data,omitempty"`
+		Read      bool                   `json:"read"`
+		CreatedAt int64                  `json:"createdAt"`
+	} `json:"notification"`
+	Unread int `json:"unread"`
+}
+
+// ProtocolError is an error message from the server. Most leave the
+// connection open; a failed handshake closes it.
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("tango: %s: %s", e.Code, e.Message)
+}
+
+// Handlers are called for messages received on a connection. They run
+// one at a time on the connection's read goroutine, so a slow handler
+// holds up the messages behind it. Nil handlers are skipped.
+type Handlers struct {
+	Joined       func(Joined)
+	ClientJoined func(ClientEvent)
+	ClientLeft   func(ClientEvent)
+	Presence     func([]Presence)
+	ScreenData   func(ScreenData)
+	Cursors      func([]Cursor)
+	Announcement func(Announcement)
+	Notification func(Notification)
+	Error        func(ProtocolError)
+	// Message is called for every message, after its typed handler, and is
+	// the way to see message types without one.
+	Message func(Message)
+	// Reconnecting is called before each reconnect attempt with the error
+	// that dropped the connection or failed the previous attempt.
+	Reconnecting func(attempt int, err error)
+	// Closed is called once the connection is gone for good: with nil after
+	// Close, ErrSessionEnded when the session ended, or the last error.
+	Closed func(error)
+}
+
+// dispatch hands msg to its handlers.
+func (h *Handlers) dispatch(msg Message) {
+	switch msg.Type {
+	case "session_joined":
+		var joined Joined
+		if h.Joined != nil && json.Unmarshal(msg.Payload, &joined) == nil {
+			h.Joined(joined)
+		}
+	case "client_joined":
+		var event ClientEvent
+		if h.ClientJoined != nil && json.Unmarshal(msg.Payload, &event) == nil {
+			h.ClientJoined(event)
+		}
+	case "client_left":
+		var event ClientEvent
+		if h.ClientLeft != nil && json.Unmarshal(msg.Payload, &event) == nil {
+			h.ClientLeft(event)
+		}
+	case "presence_sync":
+		var sync struct {
+			Clients []Presence `json:"clients"`
+		}
+		if h.Presence != nil && json.Unmarshal(msg.Payload, &sync) == nil {
+			h.Presence(sync.Clients)
+		}
+	case "screen_data":
+		var frame ScreenData
+		if h.ScreenData != nil && json.Unmarshal(msg.Payload, &frame) == nil {
+			h.ScreenData(frame)
+		}
+	case "cursor":
+		var batch struct {
+			Cursors []Cursor `json:"cursors"`
+		}
+		if h.Cursors != nil && json.Unmarshal(msg.Payload, &batch) == nil {
+			h.Cursors(batch.Cursors)
+		}
+	case "announcement":
+		var announcement Announcement
+		if h.Announcement != nil && json.Unmarshal(msg.Payload, &announcement) == nil {
+			h.Announcement(announcement)
+		}
+	case "notification":
+		var notification Notification
+		if h.Notification != nil && json.Unmarshal(msg.Payload, &notification) == nil {
+			h.Notification(notification)
+		}
+	case "error":
+		var protoErr ProtocolError
+		if h.Error != nil && json.Unmarshal(msg.Payload, &protoErr) == nil {
+			h.Error(protoErr)
+		}
+	}
+	if h.Message != nil {
+		h.Message(msg)
+	}
+}
@@ -0,0 +1,130 @@
+package tango
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CloneSessionRequest struct {
+	Name         string  `json:"name"`
+	WorkspaceID  *string `json:"workspaceId"`
+	CollectionID *string `json:"collectionId"`
+}
+
+// cloneSession copies a session's details, settings and annotations into a
+// new scheduled session created by the caller, so a recurring walkthrough
+// can be set up once and reused. The copy stays in the source's workspace
+// unless workspaceId names another one, which needs the member role there;
+// "" makes it personal. It keeps the source's collection only when it stays
+// in the same workspace.
+func cloneSession(c *gin.Context) {
+	var req CloneSessionRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	source, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+
+	source.mu.Lock()
+	if source.Status == SessionTrashed {
+		source.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "Session is in the trash; restore it first"})
+		return
+	}
+	clone := &Session{
+		Name:              source.Name + " (copy)",
+		WorkspaceID:       source.WorkspaceID,
+		Description:       source.Description,
+		Tags:              append([]string(nil), source.Tags...),
+		CollectionID:      source.CollectionID,
+		AutoEnd:           source.AutoEnd,
+		MaxClients:        source.MaxClients,
+		IdleTTL:           source.IdleTTL,
+		ViewerAnnotations: source.ViewerAnnotations,
+		SFU:               source.SFU && sfuAvailable,
+		E2EE:              source.E2EE,
+		DisabledFeatures:  source.DisabledFeatures,
+		MaxFPS:            source.MaxFPS,
+		WaitingRoom:       source.WaitingRoom,
+		WaitingTimeout:    source.WaitingTimeout,
+		ClonedFrom:        source.ID,
+		Clients:           make(map[string]*Client),
+	}
+	if source.Metadata != nil {
+		clone.Metadata = make(map[string]string, len(source.Metadata))
+		for key, value := range source.Metadata {
+			clone.Metadata[key] = value
+		}
+	}
+	source.mu.Unlock()
+
+	if req.Name != "" {
+		clone.Name = req.Name
+	}
+	if req.WorkspaceID != nil && *req.WorkspaceID != clone.WorkspaceID {
+		clone.WorkspaceID = *req.WorkspaceID
+		clone.CollectionID = ""
+	}
+	if req.CollectionID != nil {
+		clone.CollectionID = *req.CollectionID
+	}
+	if clone.WorkspaceID != "" && requireRole(c, clone.WorkspaceID, RoleMember) == nil {
+		return
+	}
+	if err := collections.checkMove(clone.WorkspaceID, clone.CollectionID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if clone.WaitingRoom && currentUser(c) == nil && hostless("", clone.WorkspaceID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errWaitingRoomHost.Error()})
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if usage, ok := quotas.Take(c.ClientIP(), QuotaSessionCreates); !ok {
+		rejectOverQuota(c, usage, "Session creation quota exceeded")
+		return
+	}
+	if user := currentUser(c); user != nil {
+		clone.CreatedBy = user.ID
+	}
+	if breach := checkCreateQuota(clone.CreatedBy, clone.WorkspaceID); breach != nil {
+		rejectQuota(c, breach)
+		return
+	}
+
+	now := getCurrentTimestamp()
+	clone.ID = store.newSessionID()
+	clone.CreatedAt = now
+	clone.Status = SessionScheduled
+	clone.IdleSince = now
+	if clone.IdleTTL == 0 {
+		clone.IdleTTL = config.SessionIdleTTL
+	}
+
+	clone.mu.Lock()
+	defer clone.mu.Unlock()
+
+	store.Sessions[clone.ID] = clone
+	workspaces.indexSession(clone.ID, clone.WorkspaceID)
+	for _, stroke := range annotations.Strokes(source.ID) {
+		annotations.Add(clone.ID, stroke)
+	}
+	sessionHistory.created(clone, clone.CreatedBy)
+	emitEvent(EventSessionCreated, clone)
+	atomic.AddInt64(&analytics.today().stats.SessionsCreated, 1)
+	auditRequest(c, "session.clone", "session", clone.ID, gin.H{"sourceId": source.ID, "name": clone.Name})
+
+	c.JSON(http.StatusCreated, clone)
+}
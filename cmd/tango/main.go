@@ -0,0 +1,42 @@
+// Command tango runs the collaboration backend.
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	tango "github.com/tango-clone/backend"
+)
+
+func main() {
+	cfg, err := tango.LoadConfig(os.Args[1:])
+	if err != nil {
+		tango.NewLogger().Error("loading config failed", "error", err)
+		os.Exit(1)
+	}
+	srv, err := tango.NewServer(cfg)
+	if err != nil {
+		tango.NewLogger().Error("starting server failed", "error", err)
+		os.Exit(1)
+	}
+	logger := srv.Logger()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("shutdown requested", "signal", sig.String())
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainWindow())
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Error("persisting state failed", "error", err)
+		}
+	}()
+
+	if err := srv.Start(); err != nil {
+		logger.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+}
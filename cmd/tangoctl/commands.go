@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/tango-clone/backend/client"
+)
+
+func profileList(c *ctl, _ *pflag.FlagSet, _ []string) error {
+	rows := [][]string{}
+	for _, name := range c.profiles.names() {
+		profile := c.profiles.Profiles[name]
+		current := ""
+		if name == c.profiles.Current {
+			current = "*"
+		}
+		rows = append(rows, []string{current, name, profile.URL, strconv.FormatBool(profile.AdminToken != "")})
+	}
+	urls := map[string]string{}
+	for name, profile := range c.profiles.Profiles {
+		urls[name] = profile.URL
+	}
+	return c.print(object{"current": c.profiles.Current, "profiles": urls}, []string{"", "NAME", "URL", "OPERATOR"}, rows)
+}
+
+func profileUse(c *ctl, _ *pflag.FlagSet, args []string) error {
+	if _, exists := c.profiles.Profiles[args[0]]; !exists {
+		return fmt.Errorf("no profile named %q", args[0])
+	}
+	c.profiles.Current = args[0]
+	return c.profiles.save()
+}
+
+func profileSet(c *ctl, flags *pflag.FlagSet, args []string) error {
+	profile := c.profiles.Profiles[args[0]]
+	flags.Visit(func(f *pflag.Flag) {
+		switch f.Name {
+		case "url":
+			profile.URL = strings.TrimSuffix(f.Value.String(), "/")
+		case "token":
+			profile.Token = f.Value.String()
+		case "admin-token":
+			profile.AdminToken = f.Value.String()
+		}
+	})
+	if profile.URL == "" {
+		return errors.New("--url is required for a new profile")
+	}
+	if _, err := url.ParseRequestURI(profile.URL); err != nil {
+		return fmt.Errorf("--url: %v", err)
+	}
+	c.profiles.Profiles[args[0]] = profile
+	if c.profiles.Current == "" {
+		c.profiles.Current = args[0]
+	}
+	return c.profiles.save()
+}
+
+func profileDelete(c *ctl, _ *pflag.FlagSet, args []string) error {
+	if _, exists := c.profiles.Profiles[args[0]]; !exists {
+		return fmt.Errorf("no profile named %q", args[0])
+	}
+	delete(c.profiles.Profiles, args[0])
+	if c.profiles.Current == args[0] {
+		c.profiles.Current = ""
+	}
+	return c.profiles.save()
+}
+
+// object is an ad hoc JSON object.
+type object map[string]interface{}
+
+func sessionRows(sessions []client.Session) [][]string {
+	rows := make([][]string, 0, len(sessions))
+	for _, s := range sessions {
+		workspace := s.WorkspaceID
+		if workspace == "" {
+			workspace = "-"
+		}
+		rows = append(rows, []string{s.ID, s.Name, s.Status, workspace, formatTime(s.CreatedAt)})
+	}
+	return rows
+}
+
+var sessionHeader = []string{"ID", "NAME", "STATUS", "WORKSPACE", "CREATED"}
+
+func sessionsList(c *ctl, flags *pflag.FlagSet, _ []string) error {
+	opts := client.ListOptions{
+		Query:       flagString(flags, "query"),
+		WorkspaceID: flagString(flags, "workspace"),
+		Trashed:     flagBool(flags, "trashed"),
+		Limit:       flagInt(flags, "limit"),
+	}
+	api := c.api()
+	sessions := []client.Session{}
+	for {
+		page, err := api.ListSessions(c.ctx, opts)
+		if err != nil {
+			return err
+		}
+		sessions = append(sessions, page.Sessions...)
+		if !flagBool(flags, "all") || page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	return c.print(sessions, sessionHeader, sessionRows(sessions))
+}
+
+func sessionsGet(c *ctl, _ *pflag.FlagSet, args []string) error {
+	session, err := c.api().GetSession(c.ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.print(session, sessionHeader, sessionRows([]client.Session{*session}))
+}
+
+func sessionsCreate(c *ctl, flags *pflag.FlagSet, _ []string) error {
+	req := client.CreateSessionRequest{
+		Name:        flagString(flags, "name"),
+		WorkspaceID: flagString(flags, "workspace"),
+		Description: flagString(flags, "description"),
+	}
+	if req.Name == "" {
+		return errors.New("--name is required")
+	}
+	for _, tag := range strings.Split(flagString(flags, "tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			req.Tags = append(req.Tags, tag)
+		}
+	}
+	session, err := c.api().CreateSession(c.ctx, req)
+	if err != nil {
+		return err
+	}
+	return c.print(session, sessionHeader, sessionRows([]client.Session{*session}))
+}
+
+func sessionsEnd(c *ctl, _ *pflag.FlagSet, args []string) error {
+	session, err := c.api().EndSession(c.ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.print(session, sessionHeader, sessionRows([]client.Session{*session}))
+}
+
+func sessionsDelete(c *ctl, flags *pflag.FlagSet, args []string) error {
+	return c.api().DeleteSession(c.ctx, args[0], flagBool(flags, "permanent"))
+}
+
+// sessionsTail prints a session's messages as they arrive. Screen data is
+// summarised rather than printed.
+func sessionsTail(c *ctl, flags *pflag.FlagSet, args []string) error {
+	printMessage := func(msg client.Message) {
+		payload := string(msg.Payload)
+		if msg.Type == "screen_data" {
+			var frame client.ScreenData
+			json.Unmarshal(msg.Payload, &frame)
+			payload = fmt.Sprintf(`{"clientId":%q,"encoding":%q,"frame":%q,"bytes":%d}`, frame.ClientID, frame.Encoding, frame.Frame, len(frame.Data))
+		}
+		if c.json {
+			fmt.Fprintf(c.out, `{"at":%q,"type":%q,"seq":%d,"payload":%s}`+"\n", time.Now().Format(time.RFC3339Nano), msg.Type, msg.Seq, payload)
+			return
+		}
+		fmt.Fprintf(c.out, "%s %-20s %s\n", time.Now().Format("15:04:05.000"), msg.Type, payload)
+	}
+
+	closed := make(chan error, 1)
+	conn, err := c.api().Join(c.ctx, args[0], client.JoinOptions{Name: flagString(flags, "name"), Role: client.RoleViewer}, client.Handlers{
+		Message: printMessage,
+		Reconnecting: func(attempt int, err error) {
+			fmt.Fprintf(os.Stderr, "tangoctl: connection lost (%v), reconnecting (attempt %d)\n", err, attempt)
+		},
+		Closed: func(err error) { closed <- err },
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c.ctx.Done():
+		conn.Close()
+		<-closed
+		return nil
+	case err := <-closed:
+		if errors.Is(err, client.ErrSessionEnded) {
+			return nil
+		}
+		return err
+	}
+}
+
+type connection struct {
+	ClientID   string `json:"clientId"`
+	SessionID  string `json:"sessionId"`
+	Name       string `json:"name"`
+	Role       string `json:"role"`
+	Status     string `json:"status"`
+	JoinedAt   int64  `json:"joinedAt"`
+	Transport  string `json:"transport"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+func clientsList(c *ctl, flags *pflag.FlagSet, _ []string) error {
+	admin, err := c.admin()
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	if session := flagString(flags, "session"); session != "" {
+		query.Set("sessionId", session)
+	}
+	var resp struct {
+		Connections []connection `json:"connections"`
+	}
+	if err := admin.Do(c.ctx, http.MethodGet, "/admin/connections", query, nil, &resp); err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, conn := range resp.Connections {
+		rows = append(rows, []string{conn.ClientID, conn.SessionID, conn.Name, conn.Role, conn.Status, conn.Transport, conn.RemoteAddr, formatTime(conn.JoinedAt)})
+	}
+	return c.print(resp.Connections, []string{"CLIENT", "SESSION", "NAME", "ROLE", "STATUS", "TRANSPORT", "ADDRESS", "JOINED"}, rows)
+}
+
+func clientsKick(c *ctl, _ *pflag.FlagSet, args []string) error {
+	admin, err := c.admin()
+	if err != nil {
+		return err
+	}
+	return admin.Do(c.ctx, http.MethodDelete, "/admin/connections/"+url.PathEscape(args[0]), nil, nil, nil)
+}
+
+type dataExport struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Size   int    `json:"size"`
+	Error  string `json:"error"`
+}
+
+// exportData starts a data export, waits for the server to build it and
+// downloads the archive.
+func exportData(c *ctl, flags *pflag.FlagSet, _ []string) error {
+	api := c.api()
+	var export dataExport
+	if err := api.Do(c.ctx, http.MethodPost, "/users/me/export", nil, object{}, &export); err != nil {
+		return err
+	}
+	if flagBool(flags, "no-wait") {
+		return c.print(export, []string{"ID", "STATUS"}, [][]string{{export.ID, export.Status}})
+	}
+
+	for export.Status == "pending" {
+		select {
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		case <-time.After(time.Second):
+		}
+		if err := api.Do(c.ctx, http.MethodGet, "/users/me/exports/"+url.PathEscape(export.ID), nil, nil, &export); err != nil {
+			return err
+		}
+	}
+	if export.Status != "ready" {
+		return fmt.Errorf("export %s %s: %s", export.ID, export.Status, export.Error)
+	}
+
+	path := flagString(flags, "out")
+	if path == "" {
+		path = "tango-export-" + export.ID + ".zip"
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	err = api.Do(c.ctx, http.MethodGet, "/users/me/exports/"+url.PathEscape(export.ID)+"/download", nil, nil, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %s (%d bytes)\n", path, export.Size)
+	return nil
+}
@@ -0,0 +1,361 @@
+// Command tangoctl manages a Tango deployment through its API: sessions,
+// connected clients and data exports. Deployments are kept as profiles in
+// tangoctl's config file.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/tango-clone/backend/client"
+)
+
+// completionTimeout bounds the API calls made to complete arguments, so a
+// slow server doesn't hang the shell.
+const completionTimeout = 5 * time.Second
+
+type ctl struct {
+	ctx      context.Context
+	profiles *Profiles
+	profile  Profile
+	json     bool
+	out      io.Writer
+
+	// The global flags.
+	profileName string
+	url         string
+	token       string
+	output      string
+}
+
+// usageError is a mistake in the command line, which exits with status 2.
+type usageError struct{ err error }
+
+func (e usageError) Error() string { return e.err.Error() }
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := newRootCommand().ExecuteContext(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "tangoctl:", err)
+		if errors.As(err, new(usageError)) {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+func newRootCommand() *cobra.Command {
+	c := &ctl{out: os.Stdout}
+	root := &cobra.Command{
+		Use:   "tangoctl",
+		Short: "Manage a Tango deployment",
+		Long: `tangoctl manages a Tango deployment through its API: sessions, connected
+clients and data exports. Deployments are kept as profiles in
+$TANGOCTL_CONFIG, or tangoctl/config.yaml in the user's config directory.
+TANGO_URL, TANGO_TOKEN and TANGO_ADMIN_TOKEN override the profile's fields.`,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			return c.setup(cmd)
+		},
+	}
+	flags := root.PersistentFlags()
+	flags.StringVar(&c.profileName, "profile", "", "profile to use instead of the current one")
+	flags.StringVar(&c.url, "url", "", "server URL, overriding the profile")
+	flags.StringVar(&c.token, "token", "", "API token, overriding the profile")
+	flags.StringVarP(&c.output, "output", "o", "table", "output format: table or json")
+	root.RegisterFlagCompletionFunc("profile", c.completeProfiles)
+	root.RegisterFlagCompletionFunc("output", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return []string{"table", "json"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	root.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageError{fmt.Errorf("%v\nRun '%s --help' for usage.", err, cmd.CommandPath())}
+	})
+
+	root.AddCommand(profileCommand(c), sessionsCommand(c), clientsCommand(c), exportCommand(c))
+	return root
+}
+
+func profileCommand(c *ctl) *cobra.Command {
+	cmd := &cobra.Command{Use: "profile", Short: "Manage the deployments tangoctl talks to"}
+
+	set := &cobra.Command{
+		Use:               "set <name> --url <url> [--token <token>] [--admin-token <token>]",
+		Short:             "Create or change a profile",
+		Args:              exactArgs(1, "a profile name"),
+		ValidArgsFunction: c.completeProfiles,
+		RunE:              c.run(profileSet),
+	}
+	set.Flags().String("url", "", "server URL")
+	set.Flags().String("token", "", "API token")
+	set.Flags().String("admin-token", "", "operator token (ADMIN_TOKEN)")
+
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "list",
+			Short: "List profiles",
+			Args:  cobra.NoArgs,
+			RunE:  c.run(profileList),
+		},
+		&cobra.Command{
+			Use:               "use <name>",
+			Short:             "Make a profile the current one",
+			Args:              exactArgs(1, "a profile name"),
+			ValidArgsFunction: c.completeProfiles,
+			RunE:              c.run(profileUse),
+		},
+		set,
+		&cobra.Command{
+			Use:               "delete <name>",
+			Short:             "Delete a profile",
+			Args:              exactArgs(1, "a profile name"),
+			ValidArgsFunction: c.completeProfiles,
+			RunE:              c.run(profileDelete),
+		},
+	)
+	return cmd
+}
+
+func sessionsCommand(c *ctl) *cobra.Command {
+	cmd := &cobra.Command{Use: "sessions", Aliases: []string{"session"}, Short: "List, create, end and follow sessions"}
+
+	list := &cobra.Command{
+		Use:   "list [--query <q>] [--workspace <id>] [--trashed] [--limit <n>] [--all]",
+		Short: "List sessions",
+		Args:  cobra.NoArgs,
+		RunE:  c.run(sessionsList),
+	}
+	list.Flags().String("query", "", "search expression")
+	list.Flags().String("workspace", "", "only sessions of this workspace")
+	list.Flags().Bool("trashed", false, "list the trash instead")
+	list.Flags().Int("limit", 0, "page size")
+	list.Flags().Bool("all", false, "follow cursors through every page")
+
+	create := &cobra.Command{
+		Use:   "create --name <name> [--workspace <id>] [--tags <a,b>] [--description <text>]",
+		Short: "Create a session",
+		Args:  cobra.NoArgs,
+		RunE:  c.run(sessionsCreate),
+	}
+	create.Flags().String("name", "", "session name")
+	create.Flags().String("workspace", "", "workspace to create it in")
+	create.Flags().String("tags", "", "comma-separated tags")
+	create.Flags().String("description", "", "description")
+
+	del := &cobra.Command{
+		Use:               "delete <id> [--permanent]",
+		Short:             "Move a session to the trash, or delete it for good",
+		Args:              exactArgs(1, "a session id"),
+		ValidArgsFunction: c.completeSessions,
+		RunE:              c.run(sessionsDelete),
+	}
+	del.Flags().Bool("permanent", false, "skip the trash")
+
+	tail := &cobra.Command{
+		Use:               "tail <id> [--name <name>]",
+		Short:             "Join a session as a viewer and print its messages until interrupted",
+		Args:              exactArgs(1, "a session id"),
+		ValidArgsFunction: c.completeSessions,
+		RunE:              c.run(sessionsTail),
+	}
+	tail.Flags().String("name", "tangoctl", "name to join under")
+
+	cmd.AddCommand(
+		list,
+		&cobra.Command{
+			Use:               "get <id>",
+			Short:             "Show a session",
+			Args:              exactArgs(1, "a session id"),
+			ValidArgsFunction: c.completeSessions,
+			RunE:              c.run(sessionsGet),
+		},
+		create,
+		&cobra.Command{
+			Use:               "end <id>",
+			Short:             "End a session",
+			Args:              exactArgs(1, "a session id"),
+			ValidArgsFunction: c.completeSessions,
+			RunE:              c.run(sessionsEnd),
+		},
+		del,
+		tail,
+	)
+	return cmd
+}
+
+func clientsCommand(c *ctl) *cobra.Command {
+	cmd := &cobra.Command{Use: "clients", Aliases: []string{"client"}, Short: "List and disconnect connected clients (operator)"}
+
+	list := &cobra.Command{
+		Use:   "list [--session <id>]",
+		Short: "List connected clients",
+		Args:  cobra.NoArgs,
+		RunE:  c.run(clientsList),
+	}
+	list.Flags().String("session", "", "only clients of this session")
+	list.RegisterFlagCompletionFunc("session", c.completeSessions)
+
+	cmd.AddCommand(
+		list,
+		&cobra.Command{
+			Use:   "kick <client-id>",
+			Short: "Disconnect a client",
+			Args:  exactArgs(1, "a client id"),
+			RunE:  c.run(clientsKick),
+		},
+	)
+	return cmd
+}
+
+func exportCommand(c *ctl) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export [--out <file>] [--no-wait]",
+		Short: "Export the signed-in user's data and download the archive",
+		Args:  cobra.NoArgs,
+		RunE:  c.run(exportData),
+	}
+	cmd.Flags().String("out", "", "file to write the archive to (default tango-export-<id>.zip)")
+	cmd.Flags().Bool("no-wait", false, "start the export without waiting to download it")
+	return cmd
+}
+
+// run adapts a command's implementation to cobra.
+func (c *ctl) run(fn func(c *ctl, flags *pflag.FlagSet, args []string) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		return fn(c, cmd.Flags(), args)
+	}
+}
+
+// setup loads the profiles and, for commands that talk to a deployment,
+// picks the profile and applies the global flags over it.
+func (c *ctl) setup(cmd *cobra.Command) error {
+	if c.output != "table" && c.output != "json" {
+		return usageError{errors.New("-o must be table or json")}
+	}
+	c.json = c.output == "json"
+	if c.ctx = cmd.Context(); c.ctx == nil {
+		c.ctx = context.Background()
+	}
+
+	var err error
+	if c.profiles, err = loadProfiles(); err != nil {
+		return err
+	}
+	if cmd.HasParent() && cmd.Parent().Name() == "profile" {
+		return nil
+	}
+	if c.profile, err = c.profiles.resolve(c.profileName); err != nil {
+		return err
+	}
+	if c.url != "" {
+		c.profile.URL = c.url
+	}
+	if c.token != "" {
+		c.profile.Token = c.token
+	}
+	return nil
+}
+
+// exactArgs requires n positional arguments, described by what.
+func exactArgs(n int, what string) cobra.PositionalArgs {
+	return func(_ *cobra.Command, args []string) error {
+		if len(args) != n {
+			return usageError{fmt.Errorf("expected %s", what)}
+		}
+		return nil
+	}
+}
+
+func (c *ctl) completeProfiles(_ *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	profiles, err := loadProfiles()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return profiles.names(), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeSessions offers the IDs of the first page of sessions, described
+// by their names.
+func (c *ctl) completeSessions(cmd *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	if err := c.setup(cmd); err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, completionTimeout)
+	defer cancel()
+	page, err := c.api().ListSessions(ctx, client.ListOptions{})
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	ids := make([]string, 0, len(page.Sessions))
+	for _, s := range page.Sessions {
+		ids = append(ids, s.ID+"\t"+s.Name)
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+func (c *ctl) api() *client.Client {
+	return client.New(c.profile.URL, c.profile.Token)
+}
+
+// admin is a client with the operator token, for /admin routes.
+func (c *ctl) admin() (*client.Client, error) {
+	if c.profile.AdminToken == "" {
+		return nil, errors.New("this command needs the operator token: set adminToken in the profile or TANGO_ADMIN_TOKEN")
+	}
+	return client.New(c.profile.URL, c.profile.AdminToken), nil
+}
+
+// print writes v as JSON with -o json, and otherwise as a table of rows
+// under header.
+func (c *ctl) print(v interface{}, header []string, rows [][]string) error {
+	if c.json {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func flagString(flags *pflag.FlagSet, name string) string {
+	value, _ := flags.GetString(name)
+	return value
+}
+
+func flagBool(flags *pflag.FlagSet, name string) bool {
+	value, _ := flags.GetBool(name)
+	return value
+}
+
+func flagInt(flags *pflag.FlagSet, name string) int {
+	value, _ := flags.GetInt(name)
+	return value
+}
+
+func formatTime(unix int64) string {
+	if unix == 0 {
+		return "-"
+	}
+	return time.Unix(unix, 0).Local().Format("2006-01-02 15:04")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Profile is a deployment tangoctl can talk to.
+type Profile struct {
+	URL        string `yaml:"url"`
+	Token      string `yaml:"token,omitempty"`
+	AdminToken string `yaml:"adminToken,omitempty"`
+}
+
+// Profiles is tangoctl's config file.
+type Profiles struct {
+	Current  string             `yaml:"current,omitempty"`
+	Profiles map[string]Profile `yaml:"profiles"`
+}
+
+// profilesPath is $TANGOCTL_CONFIG, or tangoctl/config.yaml in the user's
+// config directory.
+func profilesPath() (string, error) {
+	if path := os.Getenv("TANGOCTL_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tangoctl", "config.yaml"), nil
+}
+
+func loadProfiles() (*Profiles, error) {
+	profiles := &Profiles{Profiles: map[string]Profile{}}
+	path, err := profilesPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, profiles); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if profiles.Profiles == nil {
+		profiles.Profiles = map[string]Profile{}
+	}
+	return profiles, nil
+}
+
+// save writes the config file, readable only by its owner since it holds
+// tokens.
+func (p *Profiles) save() error {
+	path, err := profilesPath()
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+func (p *Profiles) names() []string {
+	names := make([]string, 0, len(p.Profiles))
+	for name := range p.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolve picks the profile to use: the named one, or the current one.
+// TANGO_URL, TANGO_TOKEN and TANGO_ADMIN_TOKEN override its fields.
+func (p *Profiles) resolve(name string) (Profile, error) {
+	if name == "" {
+		name = p.Current
+	}
+	var profile Profile
+	if name != "" {
+		var exists bool
+		if profile, exists = p.Profiles[name]; !exists {
+			return Profile{}, fmt.Errorf("no profile named %q", name)
+		}
+	}
+	for env, target := range map[string]*string{
+		"TANGO_URL":         &profile.URL,
+		"TANGO_TOKEN":       &profile.Token,
+		"TANGO_ADMIN_TOKEN": &profile.AdminToken,
+	} {
+		if value := os.Getenv(env); value != "" {
+			*target = value
+		}
+	}
+	if profile.URL == "" {
+		profile.URL = "http://localhost:8080"
+	}
+	return profile, nil
+}
@@ -0,0 +1,252 @@
+package tango
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clients pick a wire encoding for the message envelope by offering a
+// WebSocket subprotocol. Without one, JSON text frames are used. Binary
+// encodings carry the same {type, payload} envelope; their payloads are
+// converted to JSON internally so every message type is handled by the same
+// code whatever the client speaks.
+const (
+	SubprotocolJSON     = "tango.json"
+	SubprotocolMsgpack  = "tango.msgpack"
+	SubprotocolProtobuf = "tango.proto"
+)
+
+var wireCodecs = map[string]wireCodec{
+	SubprotocolJSON:     jsonCodec{},
+	SubprotocolMsgpack:  msgpackCodec{},
+	SubprotocolProtobuf: protobufCodec{},
+}
+
+// wireCodec encodes and decodes message envelopes. Encode appends to dst so
+// callers can reuse buffers.
+type wireCodec interface {
+	Encode(dst []byte, message Message) ([]byte, error)
+	Decode(frame []byte) (InboundMessage, error)
+	FrameType() int
+}
+
+func codecFor(conn *websocket.Conn) wireCodec {
+	if isSocketIO(conn) {
+		return socketIOCodec{}
+	}
+	if codec, ok := wireCodecs[conn.Subprotocol()]; ok {
+		return codec
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(dst []byte, message Message) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	if err := json.NewEncoder(buf).Encode(message); err != nil {
+		return dst, err
+	}
+	// Encoder terminates each value with a newline.
+	data := buf.Bytes()
+	return data[:len(data)-1], nil
+}
+
+func (jsonCodec) Decode(frame []byte) (InboundMessage, error) {
+	return decodeInbound(frame), nil
+}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+// binaryInbound builds an InboundMessage from a decoded binary envelope.
+func binaryInbound(envelope interface{}, frame []byte) (InboundMessage, error) {
+	fields, ok := envelope.(map[string]interface{})
+	if !ok {
+		return InboundMessage{}, errors.New("envelope must be a map with type and payload")
+	}
+	msgType, _ := fields["type"].(string)
+	if msgType == "" {
+		return InboundMessage{}, errors.New("envelope type is required")
+	}
+
+	msg := InboundMessage{Type: msgType, raw: frame}
+	if payload, present := fields["payload"]; present && payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return InboundMessage{}, err
+		}
+		msg.Payload = data
+	}
+	return msg, nil
+}
+
+// genericValue reduces v to nil, bool, float64, int64, uint64, string,
+// []byte, []interface{} or map[string]interface{} so binary encoders only
+// handle those. Common payload shapes are walked directly; structs go
+// through a JSON round trip so their json tags apply.
+func genericValue(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case nil, bool, string, float64, int64, uint64, []byte:
+		return value, nil
+	case int:
+		return int64(value), nil
+	case int32:
+		return int64(value), nil
+	case float32:
+		return float64(value), nil
+	case json.RawMessage:
+		var decoded interface{}
+		if err := json.Unmarshal(value, &decoded); err != nil {
+			return nil, err
+		}
+		return decoded, nil
+	case []string:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			list[i] = item
+		}
+		return list, nil
+	case []interface{}:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			g, err := genericValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = g
+		}
+		return list, nil
+	case map[string]interface{}:
+		return genericMap(value)
+	case map[string]string:
+		m := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			m[k] = item
+		}
+		return m, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String && rv.Type().Elem().Kind() == reflect.Interface {
+		return genericMap(rv.Convert(reflect.TypeOf(map[string]interface{}{})).Interface().(map[string]interface{}))
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+func genericMap(value map[string]interface{}) (interface{}, error) {
+	m := make(map[string]interface{}, len(value))
+	for k, item := range value {
+		g, err := genericValue(item)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = g
+	}
+	return m, nil
+}
+
+func genericEnvelope(message Message) (map[string]interface{}, error) {
+	payload, err := genericValue(message.Payload)
+	if err != nil {
+		return nil, err
+	}
+	envelope := map[string]interface{}{"type": message.Type, "payload": payload}
+	if message.Seq != 0 {
+		envelope["seq"] = message.Seq
+	}
+	return envelope, nil
+}
+
+// Outbound messages are encoded into pooled buffers. A buffer that grew past
+// maxPooledBuffer, typically for a screen frame, is left to the GC rather
+// than pinned in the pool.
+const maxPooledBuffer = 256 << 10
+
+var frameBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+// writeMessage encodes message for conn into a pooled buffer and writes it.
+func writeMessage(conn *websocket.Conn, message Message) error {
+	codec := codecFor(conn)
+	buf := frameBuffers.Get().(*[]byte)
+	data, err := codec.Encode((*buf)[:0], message)
+	if err == nil {
+		conn.EnableWriteCompression(compressionFor(len(data)))
+		err = conn.WriteMessage(codec.FrameType(), data)
+	}
+	if data != nil && cap(data) <= maxPooledBuffer {
+		*buf = data[:0]
+	}
+	frameBuffers.Put(buf)
+	return err
+}
+
+// encodedFrames caches a broadcast message as a websocket.PreparedMessage
+// per codec, so it is encoded once per wire format in use and framed once
+// per compression setting rather than once per recipient. A session whose
+// clients all speak one format never pays for another.
+type encodedFrames struct {
+	mu       sync.Mutex
+	prepared map[wireCodec]*preparedFrame
+}
+
+type preparedFrame struct {
+	message *websocket.PreparedMessage
+	size    int
+}
+
+// shared returns a copy of m whose copies share one encoding cache.
+func (m Message) shared() Message {
+	m.encoded = &encodedFrames{prepared: make(map[wireCodec]*preparedFrame, 1)}
+	return m
+}
+
+func (m Message) prepare(codec wireCodec) (*preparedFrame, error) {
+	m.encoded.mu.Lock()
+	defer m.encoded.mu.Unlock()
+	if frame, ok := m.encoded.prepared[codec]; ok {
+		return frame, nil
+	}
+
+	data, err := codec.Encode(nil, m)
+	if err != nil {
+		return nil, err
+	}
+	prepared, err := websocket.NewPreparedMessage(codec.FrameType(), data)
+	if err != nil {
+		return nil, err
+	}
+	frame := &preparedFrame{message: prepared, size: len(data)}
+	m.encoded.prepared[codec] = frame
+	return frame, nil
+}
+
+// writePrepared writes a shared message to conn from its cached frames.
+func writePrepared(conn *websocket.Conn, message Message) error {
+	frame, err := message.prepare(codecFor(conn))
+	if err != nil {
+		return err
+	}
+	conn.EnableWriteCompression(compressionFor(frame.size))
+	return conn.WritePreparedMessage(frame.message)
+}
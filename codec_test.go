@@ -0,0 +1,130 @@
+package tango
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// viewerConns opens n WebSocket connections speaking subprotocol and
+// returns the server ends, which broadcasts write to. The client ends
+// read and discard everything until the benchmark ends.
+func viewerConns(b *testing.B, n int, subprotocol string) []*websocket.Conn {
+	b.Helper()
+	accepted := make(chan *websocket.Conn)
+	upgrader := websocket.Upgrader{Subprotocols: []string{subprotocol}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		accepted <- conn
+	}))
+	b.Cleanup(server.Close)
+
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol}}
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conns := make([]*websocket.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		client, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			for {
+				if _, _, err := client.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		conn := <-accepted
+		conns = append(conns, conn)
+		b.Cleanup(func() { conn.Close(); client.Close() })
+	}
+	return conns
+}
+
+func cursorMessage() Message {
+	return Message{Type: "cursor", Seq: 42, Payload: map[string]interface{}{
+		"clientId": "id_5BwbCxB1P2CINv22", "x": 0.4182, "y": 0.7731, "visible": true,
+	}}
+}
+
+func screenMessage() Message {
+	return Message{Type: "screen_frame", Seq: 42, Payload: map[string]interface{}{
+		"clientId": "id_5BwbCxB1P2CINv22", "keyframe": true, "data": strings.Repeat("A", 48<<10),
+	}}
+}
+
+// BenchmarkBroadcast writes one message to every viewer of a session,
+// from one shared PreparedMessage as broadcastToSession does, and by
+// encoding it for each viewer into a pooled buffer as direct sends do.
+func BenchmarkBroadcast(b *testing.B) {
+	messages := map[string]func() Message{"cursor": cursorMessage, "screen": screenMessage}
+	for _, viewers := range []int{100, 500} {
+		for _, kind := range []string{"cursor", "screen"} {
+			for _, subprotocol := range []string{SubprotocolJSON, SubprotocolMsgpack} {
+				name := fmt.Sprintf("viewers=%d/%s/%s", viewers, kind, subprotocol)
+				b.Run(name+"/prepared", func(b *testing.B) {
+					conns := viewerConns(b, viewers, subprotocol)
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						message := messages[kind]().shared()
+						for _, conn := range conns {
+							if err := writePrepared(conn, message); err != nil {
+								b.Fatal(err)
+							}
+						}
+					}
+				})
+				b.Run(name+"/per-recipient", func(b *testing.B) {
+					conns := viewerConns(b, viewers, subprotocol)
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						message := messages[kind]()
+						for _, conn := range conns {
+							if err := writeMessage(conn, message); err != nil {
+								b.Fatal(err)
+							}
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkEncode compares encoding into a buffer from frameBuffers with
+// encoding into a fresh one.
+func BenchmarkEncode(b *testing.B) {
+	for _, codec := range []string{SubprotocolJSON, SubprotocolMsgpack, SubprotocolProtobuf} {
+		message := cursorMessage()
+		b.Run(codec+"/pooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf := frameBuffers.Get().(*[]byte)
+				data, err := wireCodecs[codec].Encode((*buf)[:0], message)
+				if err != nil {
+					b.Fatal(err)
+				}
+				*buf = data[:0]
+				frameBuffers.Put(buf)
+			}
+		})
+		b.Run(codec+"/unpooled", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := wireCodecs[codec].Encode(nil, message); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
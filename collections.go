@@ -0,0 +1,401 @@
+package tango
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// collectionNone in a collectionId filter matches sessions and guides
+	// in no collection.
+	collectionNone = "none"
+
+	maxBulkSessions = 500
+)
+
+// Collection is a named folder of sessions and guides. Collections in a
+// workspace hold that workspace's sessions and guides; those outside any
+// workspace hold unscoped sessions and personal guides.
+type Collection struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	WorkspaceID string `json:"workspaceId,omitempty"`
+	CreatedBy   string `json:"createdBy,omitempty"`
+	CreatedAt   int64  `json:"createdAt"`
+}
+
+type CollectionRegistry struct {
+	Collections map[string]*Collection
+	mu          sync.Mutex
+}
+
+var collections = &CollectionRegistry{Collections: make(map[string]*Collection)}
+
+var (
+	errCollectionNotFound  = errors.New("Collection not found")
+	errCollectionWorkspace = errors.New("Collection is in a different workspace than the session or guide")
+)
+
+// get returns a copy of the collection, so callers need not hold r.mu.
+func (r *CollectionRegistry) get(id string) (Collection, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	col, exists := r.Collections[id]
+	if !exists {
+		return Collection{}, false
+	}
+	return *col, true
+}
+
+// named returns the collection called name in the workspace, if any.
+// Callers must hold r.mu.
+func (r *CollectionRegistry) named(workspaceID, name string) *Collection {
+	for _, col := range r.Collections {
+		if col.WorkspaceID == workspaceID && strings.EqualFold(col.Name, name) {
+			return col
+		}
+	}
+	return nil
+}
+
+// inCollection applies a collectionId filter, where "" matches everything
+// and collectionNone what is in no collection, to the collection id.
+func inCollection(id, filter string) bool {
+	switch filter {
+	case "":
+		return true
+	case collectionNone:
+		return id == ""
+	default:
+		return id == filter
+	}
+}
+
+// checkMove reports whether a session in workspaceID may be moved into the
+// collection id, where "" takes it out of any collection.
+func (r *CollectionRegistry) checkMove(workspaceID, id string) error {
+	if id == "" {
+		return nil
+	}
+	col, exists := r.get(id)
+	if !exists {
+		return errCollectionNotFound
+	}
+	if col.WorkspaceID != workspaceID {
+		return errCollectionWorkspace
+	}
+	return nil
+}
+
+// collectionFor looks up a collection the caller is allowed to see, like
+// sessionFor.
+func collectionFor(c *gin.Context, id string) (Collection, bool) {
+	col, exists := collections.get(id)
+	if !exists || !canAccess(c, col.WorkspaceID) {
+		return Collection{}, false
+	}
+	return col, true
+}
+
+type CreateCollectionRequest struct {
+	Name        string `json:"name" binding:"required,max=200"`
+	WorkspaceID string `json:"workspaceId"`
+}
+
+type UpdateCollectionRequest struct {
+	Name string `json:"name" binding:"required,max=200"`
+}
+
+func createCollection(c *gin.Context) {
+	var req CreateCollectionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.WorkspaceID != "" && requireRole(c, req.WorkspaceID, RoleMember) == nil {
+		return
+	}
+
+	col := &Collection{
+		ID:          generateID(),
+		Name:        req.Name,
+		WorkspaceID: req.WorkspaceID,
+		CreatedAt:   getCurrentTimestamp(),
+	}
+	if user := currentUser(c); user != nil {
+		col.CreatedBy = user.ID
+	}
+
+	collections.mu.Lock()
+	if collections.named(col.WorkspaceID, col.Name) != nil {
+		collections.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "A collection with that name already exists"})
+		return
+	}
+	collections.Collections[col.ID] = col
+	collections.mu.Unlock()
+
+	auditRequest(c, "collection.create", "collection", col.ID, gin.H{"name": col.Name})
+	c.JSON(http.StatusCreated, col)
+}
+
+// getCollections lists the collections the caller can see, with how many
+// sessions and guides each holds outside the trash.
+func getCollections(c *gin.Context) {
+	visible := listingScope(c)
+	counts := make(map[string]int)
+	for _, session := range store.sessionList() {
+		session.mu.Lock()
+		if session.CollectionID != "" && session.Status != SessionTrashed {
+			counts[session.CollectionID]++
+		}
+		session.mu.Unlock()
+	}
+	guideCounts := guides.collectionCounts()
+
+	collections.mu.Lock()
+	list := []gin.H{}
+	for _, col := range collections.Collections {
+		if visible(col.WorkspaceID) {
+			list = append(list, gin.H{"collection": *col, "sessionCount": counts[col.ID], "guideCount": guideCounts[col.ID]})
+		}
+	}
+	collections.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i]["collection"].(Collection), list[j]["collection"].(Collection)
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+	c.JSON(http.StatusOK, gin.H{"collections": list})
+}
+
+func getCollection(c *gin.Context) {
+	col, exists := collectionFor(c, c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": errCollectionNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, col)
+}
+
+func updateCollection(c *gin.Context) {
+	var req UpdateCollectionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	current, exists := collectionFor(c, c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": errCollectionNotFound.Error()})
+		return
+	}
+
+	collections.mu.Lock()
+	col, exists := collections.Collections[current.ID]
+	if !exists {
+		collections.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": errCollectionNotFound.Error()})
+		return
+	}
+	if other := collections.named(col.WorkspaceID, req.Name); other != nil && other != col {
+		collections.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "A collection with that name already exists"})
+		return
+	}
+	col.Name = req.Name
+	updated := *col
+	collections.mu.Unlock()
+
+	auditRequest(c, "collection.update", "collection", updated.ID, gin.H{"name": updated.Name})
+	c.JSON(http.StatusOK, updated)
+}
+
+// deleteCollection removes a collection. Its sessions and guides are kept
+// and taken out of it.
+func deleteCollection(c *gin.Context) {
+	col, exists := collectionFor(c, c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": errCollectionNotFound.Error()})
+		return
+	}
+
+	collections.mu.Lock()
+	delete(collections.Collections, col.ID)
+	collections.mu.Unlock()
+
+	authorID := ""
+	if user := currentUser(c); user != nil {
+		authorID = user.ID
+	}
+
+	for _, session := range store.sessionList() {
+		session.mu.Lock()
+		if session.CollectionID != col.ID {
+			session.mu.Unlock()
+			continue
+		}
+		before := detailsOf(session)
+		session.CollectionID = ""
+		sessionHistory.edited(session, before, authorID, VersionCollectionDeleted, 0)
+		emitEvent(EventSessionUpdated, session)
+		update := sessionUpdate(session)
+		session.mu.Unlock()
+		broadcastToSession(requestSpan(c), session.ID, Message{Type: "session_updated", Payload: update}, "")
+	}
+	guides.leaveCollection(col.ID, authorID)
+
+	auditRequest(c, "collection.delete", "collection", col.ID, gin.H{"name": col.Name})
+	c.Status(http.StatusNoContent)
+}
+
+// BulkUpdateSessionsRequest changes several sessions at once. AddTags and
+// RemoveTags are applied to each session's own tags, and CollectionID,
+// when present, moves every session into that collection, or out of any
+// with "".
+type BulkUpdateSessionsRequest struct {
+	SessionIDs   []string `json:"sessionIds" binding:"required,min=1"`
+	AddTags      []string `json:"addTags"`
+	RemoveTags   []string `json:"removeTags"`
+	CollectionID *string  `json:"collectionId"`
+}
+
+type BulkUpdateFailure struct {
+	SessionID string `json:"sessionId"`
+	Error     string `json:"error"`
+}
+
+// bulkUpdateSessions applies the same change to each session in turn. A
+// session that cannot take it is reported in failed and the rest are
+// still updated.
+func bulkUpdateSessions(c *gin.Context) {
+	var req BulkUpdateSessionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.SessionIDs) > maxBulkSessions {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at most 500 sessions can be updated at once"})
+		return
+	}
+	if len(req.AddTags) == 0 && len(req.RemoveTags) == 0 && req.CollectionID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "nothing to change; give addTags, removeTags or collectionId"})
+		return
+	}
+	if err := validateTags(req.AddTags); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updated := []string{}
+	failed := []BulkUpdateFailure{}
+	for _, id := range req.SessionIDs {
+		if err := bulkUpdateSession(c, id, req); err != nil {
+			failed = append(failed, BulkUpdateFailure{SessionID: id, Error: err.Error()})
+		} else {
+			updated = append(updated, id)
+		}
+	}
+
+	auditRequest(c, "session.bulk_update", "session", "", gin.H{"updated": len(updated), "failed": len(failed)})
+	c.JSON(http.StatusOK, gin.H{"updated": updated, "failed": failed})
+}
+
+func bulkUpdateSession(c *gin.Context, id string, req BulkUpdateSessionsRequest) error {
+	session, exists := sessionFor(c, id)
+	if !exists {
+		return errors.New("Session not found")
+	}
+
+	session.mu.Lock()
+	if session.Status == SessionTrashed {
+		session.mu.Unlock()
+		return errors.New("Session is in the trash; restore it first")
+	}
+	tags := mergeTags(session.Tags, req.AddTags, req.RemoveTags)
+	if err := validateTags(tags); err != nil {
+		session.mu.Unlock()
+		return err
+	}
+	if (len(req.AddTags) > 0 || len(req.RemoveTags) > 0) && editLockHeld(session, EditFieldTags) != "" {
+		session.mu.Unlock()
+		return errors.New("The tags are locked by a co-editor")
+	}
+	settleEdits(session)
+	collectionID := session.CollectionID
+	if req.CollectionID != nil {
+		if err := collections.checkMove(session.WorkspaceID, *req.CollectionID); err != nil {
+			session.mu.Unlock()
+			return err
+		}
+		collectionID = *req.CollectionID
+	}
+
+	before := detailsOf(session)
+	session.Tags = tags
+	session.CollectionID = collectionID
+	authorID := ""
+	if user := currentUser(c); user != nil {
+		authorID = user.ID
+	}
+	sessionHistory.edited(session, before, authorID, VersionBulkUpdated, 0)
+	syncEdits(session)
+	emitEvent(EventSessionUpdated, session)
+	update := sessionUpdate(session)
+	session.mu.Unlock()
+
+	broadcastToSession(requestSpan(c), id, Message{Type: "session_updated", Payload: update}, "")
+	return nil
+}
+
+// mergeTags returns tags with add appended and remove taken out, keeping
+// the order and dropping duplicates.
+func mergeTags(tags, add, remove []string) []string {
+	drop := make(map[string]bool, len(remove))
+	for _, tag := range remove {
+		drop[tag] = true
+	}
+	seen := make(map[string]bool)
+	merged := []string{}
+	for _, tag := range append(append([]string{}, tags...), add...) {
+		if drop[tag] || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		merged = append(merged, tag)
+	}
+	return merged
+}
+
+// getTags lists the tags on the sessions the caller can see, outside the
+// trash, with how many sessions carry each.
+func getTags(c *gin.Context) {
+	visible := listingScope(c)
+	counts := make(map[string]int)
+	for _, session := range store.sessionList() {
+		if !visible(session.WorkspaceID) {
+			continue
+		}
+		session.mu.Lock()
+		if session.Status != SessionTrashed {
+			for _, tag := range session.Tags {
+				counts[tag]++
+			}
+		}
+		session.mu.Unlock()
+	}
+
+	tags := make([]gin.H, 0, len(counts))
+	for tag, count := range counts {
+		tags = append(tags, gin.H{"tag": tag, "sessionCount": count})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i]["tag"].(string) < tags[j]["tag"].(string) })
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
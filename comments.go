@@ -0,0 +1,670 @@
+package tango
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxCommentsPerSession = 5000
+
+// mentionPattern matches @mentions, which name users by email, such as
+// @alice@example.com.
+var mentionPattern = regexp.MustCompile(`(^|[^\w.@])@([\w.%+-]+@[\w-]+(?:\.[\w-]+)+)`)
+
+// Comment is a note left on a session or a guide. Anchor says what in the
+// session it is about, such as a step, and is empty for the session as a
+// whole; on a guide, StepID names the step it is about. Replies name the
+// comment that opened their thread as ParentID; only threads, not
+// replies, are resolved. In end-to-end encrypted sessions the body is
+// encrypted and mentions are not looked for.
+type Comment struct {
+	ID         string   `json:"id"`
+	SessionID  string   `json:"sessionId,omitempty"`
+	GuideID    string   `json:"guideId,omitempty"`
+	StepID     string   `json:"stepId,omitempty"`
+	ParentID   string   `json:"parentId,omitempty"`
+	Anchor     string   `json:"anchor,omitempty"`
+	AuthorID   string   `json:"authorId,omitempty"`
+	Body       string   `json:"body"`
+	Mentions   []string `json:"mentions,omitempty"`
+	Resolved   bool     `json:"resolved,omitempty"`
+	ResolvedBy string   `json:"resolvedBy,omitempty"`
+	ResolvedAt int64    `json:"resolvedAt,omitempty"`
+	CreatedAt  int64    `json:"createdAt"`
+	EditedAt   int64    `json:"editedAt,omitempty"`
+	Encrypted  bool     `json:"encrypted,omitempty"`
+}
+
+// subject is what the comment is filed under on the board: its session,
+// or its guide.
+func (c *Comment) subject() string {
+	if c.GuideID != "" {
+		return guideCommentSubject(c.GuideID)
+	}
+	return c.SessionID
+}
+
+func guideCommentSubject(guideID string) string {
+	return "guide:" + guideID
+}
+
+// CommentThread is a comment with its replies, oldest first.
+type CommentThread struct {
+	Comment
+	Replies []Comment `json:"replies"`
+}
+
+// CommentBoard holds the comments on each session and guide in the order
+// they were made.
+type CommentBoard struct {
+	comments map[string][]*Comment
+	mu       sync.Mutex
+}
+
+var comments = &CommentBoard{comments: make(map[string][]*Comment)}
+
+var (
+	errCommentNotFound  = errors.New("Comment not found")
+	errTooManyComments  = errors.New("There are too many comments here")
+	errNotCommentAuthor = errors.New("Only the author can edit this comment")
+)
+
+// find returns a comment on subject. Callers must hold b.mu.
+func (b *CommentBoard) find(subject, id string) *Comment {
+	for _, comment := range b.comments[subject] {
+		if comment.ID == id {
+			return comment
+		}
+	}
+	return nil
+}
+
+func (b *CommentBoard) Add(comment *Comment) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subject := comment.subject()
+	if len(b.comments[subject]) >= maxCommentsPerSession {
+		return errTooManyComments
+	}
+	if comment.ParentID != "" {
+		parent := b.find(subject, comment.ParentID)
+		if parent == nil {
+			return errCommentNotFound
+		}
+		// Replies to replies join the thread they are in.
+		if parent.ParentID != "" {
+			comment.ParentID = parent.ParentID
+		}
+		comment.Anchor, comment.StepID = "", ""
+	}
+	b.comments[subject] = append(b.comments[subject], comment)
+	return nil
+}
+
+// Update applies fn to a copy of the comment and stores the result unless
+// fn fails.
+func (b *CommentBoard) Update(subject, id string, fn func(*Comment) error) (Comment, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	comment := b.find(subject, id)
+	if comment == nil {
+		return Comment{}, errCommentNotFound
+	}
+	updated := *comment
+	if err := fn(&updated); err != nil {
+		return Comment{}, err
+	}
+	*comment = updated
+	return updated, nil
+}
+
+// Delete removes a comment, and its replies when it opens a thread.
+func (b *CommentBoard) Delete(subject, id string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := b.comments[subject][:0]
+	removed := 0
+	for _, comment := range b.comments[subject] {
+		if comment.ID == id || comment.ParentID == id {
+			removed++
+			continue
+		}
+		kept = append(kept, comment)
+	}
+	b.comments[subject] = kept
+	return removed
+}
+
+func (b *CommentBoard) Get(subject, id string) (Comment, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if comment := b.find(subject, id); comment != nil {
+		return *comment, true
+	}
+	return Comment{}, false
+}
+
+// Threads returns the threads on a session or guide, oldest first,
+// keeping those that match keep.
+func (b *CommentBoard) Threads(subject string, keep func(*Comment) bool) []CommentThread {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	threads := []CommentThread{}
+	index := make(map[string]int)
+	for _, comment := range b.comments[subject] {
+		if comment.ParentID == "" && keep(comment) {
+			index[comment.ID] = len(threads)
+			threads = append(threads, CommentThread{Comment: *comment, Replies: []Comment{}})
+		}
+	}
+	for _, comment := range b.comments[subject] {
+		if i, ok := index[comment.ParentID]; ok {
+			threads[i].Replies = append(threads[i].Replies, *comment)
+		}
+	}
+	return threads
+}
+
+// participants returns the authors in a thread, its opener first.
+func (b *CommentBoard) participants(subject, threadID string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []string
+	for _, comment := range b.comments[subject] {
+		if comment.ID == threadID || comment.ParentID == threadID {
+			ids = append(ids, comment.AuthorID)
+		}
+	}
+	return ids
+}
+
+// By returns the comments userID wrote.
+func (b *CommentBoard) By(userID string) []Comment {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := []Comment{}
+	for _, subject := range b.comments {
+		for _, comment := range subject {
+			if comment.AuthorID == userID {
+				list = append(list, *comment)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt < list[j].CreatedAt })
+	return list
+}
+
+// forgetAuthor takes a deleted user's name off their comments and out of
+// mentions, leaving the threads readable.
+func (b *CommentBoard) forgetAuthor(userID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subject := range b.comments {
+		for _, comment := range subject {
+			if comment.AuthorID == userID {
+				comment.AuthorID = ""
+			}
+			if comment.ResolvedBy == userID {
+				comment.ResolvedBy = ""
+			}
+			var mentions []string
+			for _, id := range comment.Mentions {
+				if id != userID {
+					mentions = append(mentions, id)
+				}
+			}
+			comment.Mentions = mentions
+		}
+	}
+}
+
+func (b *CommentBoard) Forget(subject string) {
+	b.mu.Lock()
+	delete(b.comments, subject)
+	b.mu.Unlock()
+}
+
+// parseMentions returns the users mentioned in body who can see sessions
+// in workspaceID, in the order first mentioned. Mentions of anyone else
+// are left as plain text.
+func parseMentions(body, workspaceID string) []*User {
+	var mentioned []*User
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		users.mu.Lock()
+		user := users.byEmail[normalizeEmail(match[2])]
+		users.mu.Unlock()
+		if user == nil || seen[user.ID] {
+			continue
+		}
+		if workspaceID != "" && workspaces.roleOf(workspaceID, user, true) == "" {
+			continue
+		}
+		seen[user.ID] = true
+		mentioned = append(mentioned, user)
+	}
+	return mentioned
+}
+
+// commentTarget is the session or guide a comment route is for, with what
+// the handlers need to know about it.
+type commentTarget struct {
+	subject     string
+	sessionID   string
+	guideID     string
+	workspaceID string
+	// creator hears about new threads on the target.
+	creator string
+	name    string
+	// personal is set for a guide outside any workspace, which only its
+	// author can see.
+	personal  bool
+	encrypted bool
+	steps     map[string]bool
+}
+
+// comment starts a comment on the target.
+func (t *commentTarget) comment() *Comment {
+	return &Comment{SessionID: t.sessionID, GuideID: t.guideID, Encrypted: t.encrypted}
+}
+
+// eventPayload is what the target's comment events carry to say where
+// the comment was left.
+func (t *commentTarget) eventPayload() gin.H {
+	if t.guideID != "" {
+		return gin.H{"guideId": t.guideID, "workspaceId": t.workspaceID}
+	}
+	return gin.H{"sessionId": t.sessionID}
+}
+
+// notification starts a notification about the target.
+func (t *commentTarget) notification(comment Comment) Notification {
+	note := Notification{SessionID: t.sessionID, Data: gin.H{"commentId": comment.ID}}
+	if t.guideID != "" {
+		note.Data["guideId"] = t.guideID
+	}
+	return note
+}
+
+// commentLookup finds the target of a comment route and the signed-in
+// caller, responding and returning nil if either is missing.
+type commentLookup func(c *gin.Context) (*commentTarget, *User)
+
+// commentSession looks up the session a comment route is for.
+func commentSession(c *gin.Context) (*commentTarget, *User) {
+	user := requireUser(c)
+	if user == nil {
+		return nil, nil
+	}
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return nil, nil
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return &commentTarget{
+		subject:     session.ID,
+		sessionID:   session.ID,
+		workspaceID: session.WorkspaceID,
+		creator:     session.CreatedBy,
+		name:        session.Name,
+		encrypted:   session.E2EE,
+	}, user
+}
+
+// commentGuide looks up the guide a comment route is for. Comments follow
+// the guide: whoever can see it can read and leave them.
+func commentGuide(c *gin.Context) (*commentTarget, *User) {
+	user, guide, ok := guideFor(c)
+	if !ok {
+		return nil, nil
+	}
+	steps := make(map[string]bool, len(guide.Steps))
+	for _, step := range guide.Steps {
+		steps[step.ID] = true
+	}
+	return &commentTarget{
+		subject:     guideCommentSubject(guide.ID),
+		guideID:     guide.ID,
+		workspaceID: guide.WorkspaceID,
+		creator:     guide.CreatedBy,
+		name:        guide.Title,
+		personal:    guide.WorkspaceID == "",
+		steps:       steps,
+	}, user
+}
+
+// commentMentions returns the users mentioned in a comment on the target
+// who can see it, which are none if its comments are encrypted.
+func commentMentions(target *commentTarget, body string) []*User {
+	if target.encrypted {
+		return nil
+	}
+	mentioned := parseMentions(body, target.workspaceID)
+	if !target.personal {
+		return mentioned
+	}
+	var owner []*User
+	for _, u := range mentioned {
+		if u.ID == target.creator {
+			owner = append(owner, u)
+		}
+	}
+	return owner
+}
+
+// canModerate reports whether user may remove others' comments in a
+// workspace: its admins and owners can.
+func canModerate(c *gin.Context, workspaceID string, user *User) bool {
+	if workspaceID == "" {
+		return false
+	}
+	role := workspaces.roleOf(workspaceID, user, signedInWithSSO(c))
+	return workspaceRoleRank[role] >= workspaceRoleRank[RoleAdmin]
+}
+
+type CreateCommentRequest struct {
+	Body     string `json:"body" binding:"required,max=5000"`
+	ParentID string `json:"parentId"`
+	Anchor   string `json:"anchor" binding:"max=200"`
+	// StepID ties a comment on a guide to one of its steps.
+	StepID string `json:"stepId"`
+}
+
+type UpdateCommentRequest struct {
+	Body string `json:"body" binding:"required,max=5000"`
+}
+
+func createComment(c *gin.Context) {
+	addComment(c, commentSession)
+}
+
+func createGuideComment(c *gin.Context) {
+	addComment(c, commentGuide)
+}
+
+func addComment(c *gin.Context, lookup commentLookup) {
+	target, user := lookup(c)
+	if target == nil {
+		return
+	}
+	var req CreateCommentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Body) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must not be blank"})
+		return
+	}
+	if req.StepID != "" && !target.steps[req.StepID] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errStepNotFound.Error()})
+		return
+	}
+
+	comment := target.comment()
+	comment.ID = generateID()
+	comment.ParentID = req.ParentID
+	comment.Anchor = req.Anchor
+	comment.StepID = req.StepID
+	comment.AuthorID = user.ID
+	comment.Body = req.Body
+	comment.CreatedAt = getCurrentTimestamp()
+	mentioned := commentMentions(target, req.Body)
+	for _, u := range mentioned {
+		comment.Mentions = append(comment.Mentions, u.ID)
+	}
+	if err := comments.Add(comment); err != nil {
+		status := http.StatusConflict
+		if err == errCommentNotFound {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	payload := target.eventPayload()
+	payload["comment"] = *comment
+	emitEvent(EventCommentCreated, payload)
+	notifyMentions(target, *comment, mentioned, user)
+	notifyWatchers(target, *comment, mentioned, user)
+	c.JSON(http.StatusCreated, comment)
+}
+
+// notifyMentions emits comment.mentioned for each user mentioned in a
+// comment, other than its author, and notifies them.
+func notifyMentions(target *commentTarget, comment Comment, mentioned []*User, author *User) {
+	name := displayName(author)
+	for _, u := range mentioned {
+		if u.ID == author.ID {
+			continue
+		}
+		payload := target.eventPayload()
+		payload["commentId"] = comment.ID
+		payload["userId"] = u.ID
+		payload["email"] = u.Email
+		payload["authorId"] = author.ID
+		payload["body"] = comment.Body
+		emitEvent(EventCommentMentioned, payload)
+
+		note := target.notification(comment)
+		note.Type = NotifyMention
+		note.Text = name + " mentioned you in a comment on " + target.name
+		note.ActorID = author.ID
+		notifications.Notify(u.ID, note)
+	}
+}
+
+// notifyWatchers tells the creator of the session or guide and the others
+// in the comment's thread about it, leaving out its author and anyone it
+// mentions, who hear about it already.
+func notifyWatchers(target *commentTarget, comment Comment, mentioned []*User, author *User) {
+	skip := map[string]bool{author.ID: true, "": true}
+	for _, u := range mentioned {
+		skip[u.ID] = true
+	}
+	watchers := []string{target.creator}
+	if comment.ParentID != "" {
+		watchers = append(watchers, comments.participants(target.subject, comment.ParentID)...)
+	}
+
+	text := displayName(author) + " commented on " + target.name
+	if comment.ParentID != "" {
+		text = displayName(author) + " replied to a comment on " + target.name
+	}
+	for _, id := range watchers {
+		if skip[id] {
+			continue
+		}
+		skip[id] = true
+		note := target.notification(comment)
+		note.Type = NotifyComment
+		note.Text = text
+		note.ActorID = author.ID
+		notifications.Notify(id, note)
+	}
+}
+
+// getComments lists a session's comment threads, optionally only those on
+// an anchor or with the given resolved state.
+func getComments(c *gin.Context) {
+	listComments(c, commentSession)
+}
+
+// getGuideComments lists a guide's comment threads, optionally only those
+// on a ?stepId= or with the given resolved state.
+func getGuideComments(c *gin.Context) {
+	listComments(c, commentGuide)
+}
+
+func listComments(c *gin.Context, lookup commentLookup) {
+	target, _ := lookup(c)
+	if target == nil {
+		return
+	}
+	anchor, hasAnchor := c.GetQuery("anchor")
+	stepID, hasStep := c.GetQuery("stepId")
+	resolved := c.Query("resolved")
+	if resolved != "" && resolved != "true" && resolved != "false" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "resolved must be true or false"})
+		return
+	}
+	threads := comments.Threads(target.subject, func(comment *Comment) bool {
+		if hasAnchor && comment.Anchor != anchor || hasStep && comment.StepID != stepID {
+			return false
+		}
+		return resolved == "" || comment.Resolved == (resolved == "true")
+	})
+	c.JSON(http.StatusOK, gin.H{"comments": threads})
+}
+
+// updateComment edits a comment's body. Only its author can. Users newly
+// mentioned by the edit are notified.
+func updateComment(c *gin.Context) {
+	editComment(c, commentSession)
+}
+
+func updateGuideComment(c *gin.Context) {
+	editComment(c, commentGuide)
+}
+
+func editComment(c *gin.Context, lookup commentLookup) {
+	target, user := lookup(c)
+	if target == nil {
+		return
+	}
+	var req UpdateCommentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Body) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must not be blank"})
+		return
+	}
+
+	mentioned := commentMentions(target, req.Body)
+	var added []*User
+	comment, err := comments.Update(target.subject, c.Param("commentId"), func(comment *Comment) error {
+		if comment.AuthorID != user.ID {
+			return errNotCommentAuthor
+		}
+		before := make(map[string]bool, len(comment.Mentions))
+		for _, id := range comment.Mentions {
+			before[id] = true
+		}
+		comment.Mentions = nil
+		for _, u := range mentioned {
+			comment.Mentions = append(comment.Mentions, u.ID)
+			if !before[u.ID] {
+				added = append(added, u)
+			}
+		}
+		comment.Body = req.Body
+		comment.EditedAt = getCurrentTimestamp()
+		return nil
+	})
+	if !commentResult(c, err) {
+		return
+	}
+	notifyMentions(target, comment, added, user)
+	c.JSON(http.StatusOK, comment)
+}
+
+// commentResult responds to a failed comment change and reports whether
+// it succeeded.
+func commentResult(c *gin.Context, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case errCommentNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errNotCommentAuthor:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	}
+	return false
+}
+
+// deleteComment removes a comment, with its replies if it opens a thread.
+// Authors can delete their own comments, and workspace admins anyone's.
+func deleteComment(c *gin.Context) {
+	removeComment(c, commentSession)
+}
+
+func deleteGuideComment(c *gin.Context) {
+	removeComment(c, commentGuide)
+}
+
+func removeComment(c *gin.Context, lookup commentLookup) {
+	target, user := lookup(c)
+	if target == nil {
+		return
+	}
+	comment, exists := comments.Get(target.subject, c.Param("commentId"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": errCommentNotFound.Error()})
+		return
+	}
+	if comment.AuthorID != user.ID && !canModerate(c, target.workspaceID, user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the author or a workspace admin can delete this comment"})
+		return
+	}
+
+	removed := comments.Delete(target.subject, comment.ID)
+	if comment.AuthorID != user.ID {
+		details := target.eventPayload()
+		details["authorId"] = comment.AuthorID
+		details["removed"] = removed
+		auditRequest(c, "comment.delete", "comment", comment.ID, details)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func resolveComment(c *gin.Context) {
+	setResolved(c, commentSession, true)
+}
+
+func unresolveComment(c *gin.Context) {
+	setResolved(c, commentSession, false)
+}
+
+func resolveGuideComment(c *gin.Context) {
+	setResolved(c, commentGuide, true)
+}
+
+func unresolveGuideComment(c *gin.Context) {
+	setResolved(c, commentGuide, false)
+}
+
+// setResolved marks a thread resolved or open again. Anyone who can see
+// the session or guide can.
+func setResolved(c *gin.Context, lookup commentLookup, resolved bool) {
+	target, user := lookup(c)
+	if target == nil {
+		return
+	}
+	comment, err := comments.Update(target.subject, c.Param("commentId"), func(comment *Comment) error {
+		if comment.ParentID != "" {
+			return errors.New("Replies cannot be resolved; resolve the thread instead")
+		}
+		comment.Resolved = resolved
+		comment.ResolvedBy, comment.ResolvedAt = "", 0
+		if resolved {
+			comment.ResolvedBy, comment.ResolvedAt = user.ID, getCurrentTimestamp()
+		}
+		return nil
+	})
+	if !commentResult(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, comment)
+}
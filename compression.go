@@ -0,0 +1,86 @@
+package tango
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// wsTraffic counts WebSocket payload bytes handed to gorilla and the bytes
+// that actually reached the wire, so the effect of permessage-deflate can
+// be measured. Fields are accessed atomically.
+type wsTraffic struct {
+	messages     int64
+	compressed   int64
+	payloadBytes int64
+	wireBytes    int64
+}
+
+var traffic wsTraffic
+
+// compressionFor decides per message whether to compress: payloads under
+// the threshold cost more CPU to deflate than they save on the wire.
+func compressionFor(size int) bool {
+	cfg := config.Compression
+	compress := cfg.Enabled && size >= cfg.ThresholdBytes
+	atomic.AddInt64(&traffic.messages, 1)
+	atomic.AddInt64(&traffic.payloadBytes, int64(size))
+	if compress {
+		atomic.AddInt64(&traffic.compressed, 1)
+	}
+	return compress
+}
+
+// countingConn tallies bytes written to a hijacked WebSocket connection.
+type countingConn struct {
+	net.Conn
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&traffic.wireBytes, int64(n))
+	return n, err
+}
+
+// countingWriter hands gorilla a counting connection when it hijacks the
+// response for the WebSocket upgrade.
+type countingWriter struct {
+	gin.ResponseWriter
+}
+
+func (w countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return countingConn{conn}, brw, nil
+}
+
+func getCompressionStats(c *gin.Context) {
+	payload := atomic.LoadInt64(&traffic.payloadBytes)
+	wire := atomic.LoadInt64(&traffic.wireBytes)
+
+	ratio := 0.0
+	if wire > 0 {
+		ratio = float64(payload) / float64(wire)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":            config.Compression.Enabled,
+		"level":              config.Compression.Level,
+		"thresholdBytes":     config.Compression.ThresholdBytes,
+		"messages":           atomic.LoadInt64(&traffic.messages),
+		"compressedMessages": atomic.LoadInt64(&traffic.compressed),
+		"payloadBytes":       payload,
+		"wireBytes":          wire,
+		"ratio":              ratio,
+	})
+}
@@ -0,0 +1,1228 @@
+package tango
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	Port            int               `yaml:"port" json:"port"`
+	GRPCPort        int               `yaml:"grpcPort" json:"grpcPort"`
+	Environment     string            `yaml:"environment" json:"environment"`
+	AllowedOrigins  []string          `yaml:"allowedOrigins" json:"allowedOrigins"`
+	WSOriginPolicy  string            `yaml:"wsOriginPolicy" json:"wsOriginPolicy"`
+	TrustedProxies  []string          `yaml:"trustedProxies" json:"trustedProxies"`
+	CountryHeader   string            `yaml:"countryHeader" json:"countryHeader"`
+	Store           StoreConfig       `yaml:"store" json:"store"`
+	Blobs           BlobConfig        `yaml:"blobs" json:"blobs"`
+	Limits          LimitsConfig      `yaml:"limits" json:"limits"`
+	TLS             TLSConfig         `yaml:"tls" json:"tls"`
+	Log             LogConfig         `yaml:"log" json:"log"`
+	ShutdownDrain   int               `yaml:"shutdownDrainSeconds" json:"shutdownDrainSeconds"`
+	FaultInjection  bool              `yaml:"faultInjection" json:"faultInjection"`
+	FaultWorkspaces []string          `yaml:"faultInjectionWorkspaces" json:"faultInjectionWorkspaces"`
+	PrivateTargets  bool              `yaml:"allowPrivateTargets" json:"allowPrivateTargets"`
+	APIDocs         bool              `yaml:"apiDocs" json:"apiDocs"`
+	APISunset       string            `yaml:"legacyApiSunset" json:"legacyApiSunset"`
+	AdminToken      string            `yaml:"adminToken" json:"-"`
+	Replication     ReplicationConfig `yaml:"replication" json:"replication"`
+	Leader          LeaderConfig      `yaml:"leader" json:"leader"`
+	SweepSeconds    int               `yaml:"sweepIntervalSeconds" json:"sweepIntervalSeconds"`
+	SessionIdleTTL  int               `yaml:"sessionIdleTtlSeconds" json:"sessionIdleTtlSeconds"`
+	TrashRetention  int               `yaml:"trashRetentionSeconds" json:"trashRetentionSeconds"`
+	DeletionGrace   int               `yaml:"accountDeletionGraceSeconds" json:"accountDeletionGraceSeconds"`
+	ReminderLead    int               `yaml:"sessionReminderSeconds" json:"sessionReminderSeconds"`
+	ReconnectGrace  int               `yaml:"reconnectGraceSeconds" json:"reconnectGraceSeconds"`
+	WebRTC          WebRTCConfig      `yaml:"webrtc" json:"webrtc"`
+	Compression     CompressionConfig `yaml:"compression" json:"compression"`
+	Fanout          FanoutConfig      `yaml:"fanout" json:"fanout"`
+	OAuth           OAuthConfig       `yaml:"oauth" json:"oauth"`
+	UserQuota       UsageQuota        `yaml:"userQuota" json:"userQuota"`
+	WorkspaceQuota  UsageQuota        `yaml:"workspaceQuota" json:"workspaceQuota"`
+	Billing         BillingConfig     `yaml:"billing" json:"billing"`
+	Publish         PublishConfig     `yaml:"publish" json:"publish"`
+	Email           EmailConfig       `yaml:"email" json:"email"`
+	OCR             OCRConfig         `yaml:"ocr" json:"ocr"`
+	Suggest         SuggestConfig     `yaml:"suggest" json:"suggest"`
+	Search          SearchConfig      `yaml:"search" json:"search"`
+	FFmpegCommand   string            `yaml:"ffmpegCommand" json:"ffmpegCommand"`
+	ImageFormats    []string          `yaml:"imageFormats" json:"imageFormats"`
+	Schedules       map[string]string `yaml:"schedules" json:"schedules"`
+}
+
+// BillingConfig connects workspaces to Stripe subscriptions. Each plan
+// lists the Stripe price IDs that grant it and the quota it comes with.
+// Plans are listed from smallest to largest; a subscription with prices of
+// several plans gets the largest.
+type BillingConfig struct {
+	StripeSecretKey     string `yaml:"stripeSecretKey" json:"-"`
+	StripeWebhookSecret string `yaml:"stripeWebhookSecret" json:"-"`
+	PortalReturnURL     string `yaml:"portalReturnUrl" json:"portalReturnUrl"`
+	Plans               []Plan `yaml:"plans" json:"plans"`
+}
+
+type Plan struct {
+	Name     string     `yaml:"name" json:"name"`
+	PriceIDs []string   `yaml:"priceIds" json:"priceIds"`
+	Quota    UsageQuota `yaml:"quota" json:"quota"`
+}
+
+// UsageQuota caps what one user or one workspace may use. Zero means
+// unlimited.
+type UsageQuota struct {
+	ConcurrentSessions int   `yaml:"concurrentSessions" json:"concurrentSessions"`
+	ClientsPerSession  int   `yaml:"clientsPerSession" json:"clientsPerSession"`
+	StorageBytes       int64 `yaml:"storageBytes" json:"storageBytes"`
+	MonthlyRelayBytes  int64 `yaml:"monthlyRelayBytes" json:"monthlyRelayBytes"`
+}
+
+func (q UsageQuota) validate(scope string) []string {
+	if q.ConcurrentSessions < 0 || q.ClientsPerSession < 0 || q.StorageBytes < 0 || q.MonthlyRelayBytes < 0 {
+		return []string{scope + " quotas must not be negative"}
+	}
+	return nil
+}
+
+// OAuthConfig enables sign-in through external identity providers. A
+// provider is offered once it has a client ID and secret; RedirectBaseURL is
+// the public URL of this server, used to build the callback address
+// registered with the provider.
+type OAuthConfig struct {
+	RedirectBaseURL string              `yaml:"redirectBaseUrl" json:"redirectBaseUrl"`
+	Google          OAuthProviderConfig `yaml:"google" json:"google"`
+	GitHub          OAuthProviderConfig `yaml:"github" json:"github"`
+	SSO             SSOConfig           `yaml:"sso" json:"sso"`
+	SAML            SAMLConfig          `yaml:"saml" json:"saml"`
+}
+
+// SSOConfig points at an enterprise OpenID Connect identity provider. The
+// IdP's endpoints are discovered from Issuer; GroupsClaim names the ID token
+// claim that lists the user's groups, which workspaces map to roles.
+type SSOConfig struct {
+	Issuer       string   `yaml:"issuer" json:"issuer"`
+	ClientID     string   `yaml:"clientId" json:"clientId"`
+	ClientSecret string   `yaml:"clientSecret" json:"-"`
+	Scopes       []string `yaml:"scopes" json:"scopes"`
+	GroupsClaim  string   `yaml:"groupsClaim" json:"groupsClaim"`
+}
+
+func (s SSOConfig) Enabled() bool {
+	return s.Issuer != "" && s.ClientID != "" && s.ClientSecret != ""
+}
+
+// SAMLConfig points at an enterprise SAML 2.0 identity provider. The IdP's
+// metadata, with its sign-in endpoint and signing certificates, is fetched
+// from IdPMetadataURL or read from IdPMetadataFile. CertFile and KeyFile
+// give the server a key pair, needed only by IdPs that encrypt
+// assertions. The attributes name where assertions carry the user's email,
+// name and groups.
+type SAMLConfig struct {
+	IdPMetadataURL  string `yaml:"idpMetadataUrl" json:"idpMetadataUrl"`
+	IdPMetadataFile string `yaml:"idpMetadataFile" json:"idpMetadataFile"`
+	EntityID        string `yaml:"entityId" json:"entityId"`
+	CertFile        string `yaml:"certFile" json:"certFile"`
+	KeyFile         string `yaml:"keyFile" json:"-"`
+	EmailAttribute  string `yaml:"emailAttribute" json:"emailAttribute"`
+	NameAttribute   string `yaml:"nameAttribute" json:"nameAttribute"`
+	GroupsAttribute string `yaml:"groupsAttribute" json:"groupsAttribute"`
+}
+
+func (s SAMLConfig) Enabled() bool {
+	return s.IdPMetadataURL != "" || s.IdPMetadataFile != ""
+}
+
+type OAuthProviderConfig struct {
+	ClientID     string `yaml:"clientId" json:"clientId"`
+	ClientSecret string `yaml:"clientSecret" json:"-"`
+}
+
+func (p OAuthProviderConfig) Enabled() bool {
+	return p.ClientID != "" && p.ClientSecret != ""
+}
+
+// FanoutConfig tunes broadcast delivery. Broadcasts to at least
+// MinRecipients clients are spread over Workers goroutines; a write that
+// takes longer than SlowWriteMs counts against the receiver, and after
+// MaxSlowWrites in a row SlowPolicy decides whether it sheds lossy
+// messages or is disconnected.
+type FanoutConfig struct {
+	Workers        int    `yaml:"workers" json:"workers"`
+	MinRecipients  int    `yaml:"minRecipients" json:"minRecipients"`
+	WriteTimeoutMs int    `yaml:"writeTimeoutMs" json:"writeTimeoutMs"`
+	SlowWriteMs    int    `yaml:"slowWriteMs" json:"slowWriteMs"`
+	MaxSlowWrites  int    `yaml:"maxSlowWrites" json:"maxSlowWrites"`
+	SlowPolicy     string `yaml:"slowPolicy" json:"slowPolicy"`
+}
+
+func (f FanoutConfig) WriteTimeout() time.Duration {
+	return time.Duration(f.WriteTimeoutMs) * time.Millisecond
+}
+
+func (f FanoutConfig) SlowWrite() time.Duration {
+	return time.Duration(f.SlowWriteMs) * time.Millisecond
+}
+
+type CompressionConfig struct {
+	Enabled        bool `yaml:"enabled" json:"enabled"`
+	Level          int  `yaml:"level" json:"level"`
+	ThresholdBytes int  `yaml:"thresholdBytes" json:"thresholdBytes"`
+}
+
+type WebRTCConfig struct {
+	STUNURLs             []string `yaml:"stunUrls" json:"stunUrls"`
+	TURNURLs             []string `yaml:"turnUrls" json:"turnUrls"`
+	TURNUsername         string   `yaml:"turnUsername" json:"turnUsername"`
+	TURNCredential       string   `yaml:"turnCredential" json:"-"`
+	TURNSecret           string   `yaml:"turnSecret" json:"-"`
+	CredentialTTLSeconds int      `yaml:"credentialTtlSeconds" json:"credentialTtlSeconds"`
+}
+
+func (w WebRTCConfig) CredentialTTL() time.Duration {
+	return time.Duration(w.CredentialTTLSeconds) * time.Second
+}
+
+// PublishConfig sends lifecycle events to a Kafka topic or NATS subject.
+// URLs lists the Kafka brokers as host:port, or the NATS servers as
+// nats://[user:pass@]host:port; Events narrows what is sent.
+type PublishConfig struct {
+	Driver string   `yaml:"driver" json:"driver"`
+	URLs   []string `yaml:"urls" json:"-"`
+	Topic  string   `yaml:"topic" json:"topic"`
+	Events []string `yaml:"events" json:"events"`
+}
+
+// EmailConfig sends mail through an SMTP server or Amazon SES. AppURL is
+// the public address of the web app, which the links in emails point into;
+// TemplateDir holds templates that replace the built-in ones.
+type EmailConfig struct {
+	Driver      string     `yaml:"driver" json:"driver"`
+	From        string     `yaml:"from" json:"from"`
+	AppURL      string     `yaml:"appUrl" json:"appUrl"`
+	TemplateDir string     `yaml:"templateDir" json:"templateDir"`
+	SMTP        SMTPConfig `yaml:"smtp" json:"smtp"`
+	SES         SESConfig  `yaml:"ses" json:"ses"`
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host" json:"host"`
+	Port     int    `yaml:"port" json:"port"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"-"`
+}
+
+// SESConfig holds the credentials for the SES v2 API. Endpoint replaces the
+// regional one, for testing against a local stand-in.
+type SESConfig struct {
+	Region          string `yaml:"region" json:"region"`
+	AccessKeyID     string `yaml:"accessKeyId" json:"accessKeyId"`
+	SecretAccessKey string `yaml:"secretAccessKey" json:"-"`
+	Endpoint        string `yaml:"endpoint" json:"endpoint"`
+}
+
+// OCRConfig reads the text in uploaded screenshots, with the tesseract
+// command or an HTTP service that takes an image and answers {"text": ...}.
+type OCRConfig struct {
+	Driver    string `yaml:"driver" json:"driver"`
+	Command   string `yaml:"command" json:"command"`
+	Languages string `yaml:"languages" json:"languages"`
+	URL       string `yaml:"url" json:"url"`
+}
+
+func (o OCRConfig) validate() []string {
+	switch o.Driver {
+	case "":
+	case OCRTesseract:
+		if o.Command == "" {
+			return []string{"ocr command is required for tesseract"}
+		}
+	case OCRHTTP:
+		if !strings.HasPrefix(o.URL, "http://") && !strings.HasPrefix(o.URL, "https://") {
+			return []string{"ocr url must be an http or https URL"}
+		}
+	default:
+		return []string{fmt.Sprintf("unknown ocr driver %q", o.Driver)}
+	}
+	return nil
+}
+
+// SearchConfig keeps the search index in Postgres, searched with its
+// full-text search under the Language text search configuration. Without
+// a database URL the index is kept in memory.
+type SearchConfig struct {
+	DatabaseURL string `yaml:"databaseUrl" json:"-"`
+	Language    string `yaml:"language" json:"language"`
+}
+
+func (s SearchConfig) validate() []string {
+	if s.DatabaseURL == "" {
+		return nil
+	}
+	var problems []string
+	if !strings.HasPrefix(s.DatabaseURL, "postgres://") && !strings.HasPrefix(s.DatabaseURL, "postgresql://") {
+		problems = append(problems, "search databaseUrl must be a postgres:// URL")
+	}
+	if s.Language == "" {
+		problems = append(problems, "search language is required")
+	}
+	return problems
+}
+
+// SuggestConfig points at an OpenAI-compatible chat completions endpoint
+// that drafts screenshot titles and descriptions. It is off without a URL.
+type SuggestConfig struct {
+	URL    string `yaml:"url" json:"url"`
+	APIKey string `yaml:"apiKey" json:"-"`
+	Model  string `yaml:"model" json:"model"`
+}
+
+func (s SuggestConfig) validate() []string {
+	if s.URL == "" {
+		return nil
+	}
+	var problems []string
+	if !strings.HasPrefix(s.URL, "http://") && !strings.HasPrefix(s.URL, "https://") {
+		problems = append(problems, "suggest url must be an http or https URL")
+	}
+	if s.Model == "" {
+		problems = append(problems, "suggest model is required")
+	}
+	return problems
+}
+
+func (e EmailConfig) validate() []string {
+	var problems []string
+	switch e.Driver {
+	case "":
+		return nil
+	case EmailSMTP:
+		if e.SMTP.Host == "" {
+			problems = append(problems, "email smtp host is required")
+		}
+		if e.SMTP.Port <= 0 || e.SMTP.Port > 65535 {
+			problems = append(problems, "email smtp port must be between 1 and 65535")
+		}
+	case EmailSES:
+		if e.SES.Region == "" || e.SES.AccessKeyID == "" || e.SES.SecretAccessKey == "" {
+			problems = append(problems, "email ses region, accessKeyId and secretAccessKey are required")
+		}
+	default:
+		return []string{fmt.Sprintf("unknown email driver %q", e.Driver)}
+	}
+	if _, err := mail.ParseAddress(e.From); err != nil {
+		problems = append(problems, "email from must be an address like Tango <noreply@example.com>")
+	}
+	if !strings.HasPrefix(e.AppURL, "https://") && !strings.HasPrefix(e.AppURL, "http://") {
+		problems = append(problems, "email appUrl must be an http or https URL")
+	}
+	return problems
+}
+
+type ReplicationConfig struct {
+	Role       string `yaml:"role" json:"role"`
+	PeerURL    string `yaml:"peerUrl" json:"peerUrl"`
+	Token      string `yaml:"token" json:"-"`
+	IntervalMs int    `yaml:"intervalMs" json:"intervalMs"`
+}
+
+// LeaderConfig has instances elect the one that runs leader-only jobs
+// through a lease in Postgres. Without a database URL there is no
+// election. InstanceID names this instance as a lease holder; it defaults
+// to the host name and a random suffix.
+type LeaderConfig struct {
+	DatabaseURL  string `yaml:"databaseUrl" json:"-"`
+	LeaseSeconds int    `yaml:"leaseSeconds" json:"leaseSeconds"`
+	InstanceID   string `yaml:"instanceId" json:"instanceId"`
+}
+
+type StoreConfig struct {
+	Backend       string `yaml:"backend" json:"backend"`
+	StateFile     string `yaml:"stateFile" json:"stateFile"`
+	AuditFile     string `yaml:"auditFile" json:"auditFile"`
+	ChangeLogFile string `yaml:"changeLogFile" json:"changeLogFile"`
+}
+
+// BlobConfig keeps screenshots, guide images and exports in Amazon S3 or
+// an S3-compatible service, Google Cloud Storage or Azure Blob Storage
+// instead of in memory. Prefix is put in front of every key, so several
+// deployments can share a bucket. Clients upload to and download from
+// these stores directly, with URLs valid for SignedURLSeconds. Dedup keeps
+// identical blobs once, whichever store holds them, and Encryption
+// encrypts them before they are stored.
+type BlobConfig struct {
+	Driver           string               `yaml:"driver" json:"driver"`
+	Prefix           string               `yaml:"prefix" json:"prefix"`
+	SignedURLSeconds int                  `yaml:"signedUrlSeconds" json:"signedUrlSeconds"`
+	Dedup            bool                 `yaml:"dedup" json:"dedup"`
+	S3               S3Config             `yaml:"s3" json:"s3"`
+	GCS              GCSConfig            `yaml:"gcs" json:"gcs"`
+	Azure            AzureConfig          `yaml:"azure" json:"azure"`
+	Encryption       BlobEncryptionConfig `yaml:"encryption" json:"encryption"`
+}
+
+// S3Config names the bucket and its credentials. Endpoint replaces the
+// regional one for S3-compatible services such as MinIO, which usually
+// also need PathStyle.
+type S3Config struct {
+	Bucket          string `yaml:"bucket" json:"bucket"`
+	Region          string `yaml:"region" json:"region"`
+	Endpoint        string `yaml:"endpoint" json:"endpoint"`
+	AccessKeyID     string `yaml:"accessKeyId" json:"accessKeyId"`
+	SecretAccessKey string `yaml:"secretAccessKey" json:"-"`
+	PathStyle       bool   `yaml:"pathStyle" json:"pathStyle"`
+}
+
+// GCSConfig reaches a Cloud Storage bucket through its XML API with an HMAC
+// key of a service account.
+type GCSConfig struct {
+	Bucket      string `yaml:"bucket" json:"bucket"`
+	AccessKeyID string `yaml:"accessKeyId" json:"accessKeyId"`
+	Secret      string `yaml:"secret" json:"-"`
+}
+
+// AzureConfig names the storage account, its key and the container. Endpoint
+// replaces https://<account>.blob.core.windows.net, for sovereign clouds
+// and private endpoints.
+type AzureConfig struct {
+	Account    string `yaml:"account" json:"account"`
+	AccountKey string `yaml:"accountKey" json:"-"`
+	Container  string `yaml:"container" json:"container"`
+	Endpoint   string `yaml:"endpoint" json:"endpoint"`
+}
+
+// BlobEncryptionConfig gives the master keys that wrap the data key of
+// each blob. Keys maps key IDs to base64 256-bit keys, and KeyID names the
+// one new blobs are wrapped with; the others stay to read blobs wrapped
+// before a rotation. With KMS.KeyID set, a key in AWS KMS wraps new blobs
+// instead. Encryption is off when neither is given. Required refuses to
+// read blobs stored in plaintext, for once a rekey has encrypted them all.
+type BlobEncryptionConfig struct {
+	KeyID    string            `yaml:"keyId" json:"keyId"`
+	Keys     map[string]string `yaml:"keys" json:"-"`
+	KMS      KMSConfig         `yaml:"kms" json:"kms"`
+	Required bool              `yaml:"required" json:"required"`
+}
+
+// KMSConfig names a key in AWS KMS and the credentials to use it with.
+// Endpoint replaces the regional one.
+type KMSConfig struct {
+	KeyID           string `yaml:"keyId" json:"keyId"`
+	Region          string `yaml:"region" json:"region"`
+	Endpoint        string `yaml:"endpoint" json:"endpoint"`
+	AccessKeyID     string `yaml:"accessKeyId" json:"accessKeyId"`
+	SecretAccessKey string `yaml:"secretAccessKey" json:"-"`
+}
+
+func (e BlobEncryptionConfig) Enabled() bool {
+	return e.KMS.KeyID != "" || len(e.Keys) > 0
+}
+
+// currentKey is the ID of the master key new blobs are wrapped with.
+func (e BlobEncryptionConfig) currentKey() string {
+	if e.KMS.KeyID != "" {
+		return kmsKeyPrefix + e.KMS.KeyID
+	}
+	if e.KeyID == "" && len(e.Keys) == 1 {
+		for id := range e.Keys {
+			return id
+		}
+	}
+	return e.KeyID
+}
+
+func (e BlobEncryptionConfig) validate() []string {
+	var problems []string
+	if e.Required && !e.Enabled() {
+		problems = append(problems, "blobs encryption cannot be required without a key")
+	}
+	for id, key := range e.Keys {
+		if id == "" || len(id) > 64 || strings.ContainsAny(id, ":,") {
+			problems = append(problems, fmt.Sprintf("blobs encryption key id %q must be 1 to 64 characters without : or ,", id))
+		}
+		if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != dataKeyBytes {
+			problems = append(problems, fmt.Sprintf("blobs encryption key %q must be %d bytes in base64", id, dataKeyBytes))
+		}
+	}
+	if e.KeyID != "" && e.Keys[e.KeyID] == "" {
+		problems = append(problems, fmt.Sprintf("blobs encryption keyId %q is not one of the keys", e.KeyID))
+	}
+	if e.KMS.KeyID == "" {
+		if e.KeyID == "" && len(e.Keys) > 1 {
+			problems = append(problems, "blobs encryption keyId must name the key to encrypt with")
+		}
+		return problems
+	}
+	// Envelopes give the master key's ID a length byte.
+	if len(kmsKeyPrefix+e.KMS.KeyID) > maxEnvelopeKeyID {
+		problems = append(problems, fmt.Sprintf("blobs encryption kms keyId must be at most %d bytes", maxEnvelopeKeyID-len(kmsKeyPrefix)))
+	}
+	if e.KMS.Region == "" || e.KMS.AccessKeyID == "" || e.KMS.SecretAccessKey == "" {
+		problems = append(problems, "blobs encryption kms region, accessKeyId and secretAccessKey are required")
+	}
+	if e.KMS.Endpoint != "" && !strings.HasPrefix(e.KMS.Endpoint, "https://") && !strings.HasPrefix(e.KMS.Endpoint, "http://") {
+		problems = append(problems, "blobs encryption kms endpoint must be an http or https URL")
+	}
+	return problems
+}
+
+func (b BlobConfig) validate() []string {
+	var problems []string
+	switch b.Driver {
+	case "":
+		return nil
+	case BlobS3:
+		if b.S3.Bucket == "" || b.S3.Region == "" || b.S3.AccessKeyID == "" || b.S3.SecretAccessKey == "" {
+			problems = append(problems, "blobs s3 bucket, region, accessKeyId and secretAccessKey are required")
+		}
+		if b.S3.Endpoint != "" && !strings.HasPrefix(b.S3.Endpoint, "https://") && !strings.HasPrefix(b.S3.Endpoint, "http://") {
+			problems = append(problems, "blobs s3 endpoint must be an http or https URL")
+		}
+	case BlobGCS:
+		if b.GCS.Bucket == "" || b.GCS.AccessKeyID == "" || b.GCS.Secret == "" {
+			problems = append(problems, "blobs gcs bucket, accessKeyId and secret are required")
+		}
+	case BlobAzure:
+		if b.Azure.Account == "" || b.Azure.AccountKey == "" || b.Azure.Container == "" {
+			problems = append(problems, "blobs azure account, accountKey and container are required")
+		} else if _, err := base64.StdEncoding.DecodeString(b.Azure.AccountKey); err != nil {
+			problems = append(problems, "blobs azure accountKey must be base64")
+		}
+		if b.Azure.Endpoint != "" && !strings.HasPrefix(b.Azure.Endpoint, "https://") && !strings.HasPrefix(b.Azure.Endpoint, "http://") {
+			problems = append(problems, "blobs azure endpoint must be an http or https URL")
+		}
+	default:
+		return []string{fmt.Sprintf("unknown blobs driver %q", b.Driver)}
+	}
+	if b.SignedURLSeconds <= 0 || b.SignedURLSeconds > 7*86400 {
+		problems = append(problems, "blobs signedUrlSeconds must be between 1 and 604800")
+	}
+	return problems
+}
+
+type LimitsConfig struct {
+	RequestsPerMinute     int   `yaml:"requestsPerMinute" json:"requestsPerMinute"`
+	SessionCreatesPerHour int   `yaml:"sessionCreatesPerHour" json:"sessionCreatesPerHour"`
+	MessagesPerSecond     int   `yaml:"messagesPerSecond" json:"messagesPerSecond"`
+	MaxMessageBytes       int64 `yaml:"maxMessageBytes" json:"maxMessageBytes"`
+	MaxConnections        int   `yaml:"maxConnections" json:"maxConnections"`
+}
+
+type TLSConfig struct {
+	CertFile         string `yaml:"certFile" json:"certFile"`
+	KeyFile          string `yaml:"keyFile" json:"keyFile"`
+	AutocertHost     string `yaml:"autocertHost" json:"autocertHost"`
+	AutocertEmail    string `yaml:"autocertEmail" json:"autocertEmail"`
+	AutocertCacheDir string `yaml:"autocertCacheDir" json:"autocertCacheDir"`
+	HTTPPort         int    `yaml:"httpPort" json:"httpPort"`
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.AutocertHost != ""
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" json:"level"`
+	Format string `yaml:"format" json:"format"`
+}
+
+// DefaultConfig is the configuration used when nothing overrides it.
+func DefaultConfig() *Config {
+	return &Config{
+		Port:           8080,
+		Environment:    EnvDevelopment,
+		WSOriginPolicy: OriginPolicyStrict,
+		Store: StoreConfig{
+			Backend: "memory",
+		},
+		Blobs: BlobConfig{
+			SignedURLSeconds: 900,
+			Dedup:            true,
+		},
+		Limits: LimitsConfig{
+			RequestsPerMinute:     600,
+			SessionCreatesPerHour: 100,
+			MessagesPerSecond:     30,
+			MaxMessageBytes:       1 << 20,
+			MaxConnections:        10000,
+		},
+		TLS: TLSConfig{
+			AutocertCacheDir: "certs",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		ShutdownDrain:  10,
+		SweepSeconds:   300,
+		SessionIdleTTL: 86400,
+		TrashRetention: 7 * 86400,
+		DeletionGrace:  7 * 86400,
+		ReminderLead:   900,
+		ReconnectGrace: 10,
+		WebRTC: WebRTCConfig{
+			STUNURLs:             []string{"stun:stun.l.google.com:19302"},
+			CredentialTTLSeconds: 3600,
+		},
+		Compression: CompressionConfig{
+			Enabled:        true,
+			Level:          1,
+			ThresholdBytes: 1024,
+		},
+		Fanout: FanoutConfig{
+			Workers:        16,
+			MinRecipients:  32,
+			WriteTimeoutMs: 5000,
+			SlowWriteMs:    250,
+			MaxSlowWrites:  5,
+			SlowPolicy:     SlowPolicyDrop,
+		},
+		Replication: ReplicationConfig{
+			IntervalMs: 1000,
+		},
+		Leader: LeaderConfig{
+			LeaseSeconds: 15,
+		},
+		Email: EmailConfig{
+			SMTP: SMTPConfig{Port: 587},
+		},
+		OCR: OCRConfig{
+			Command:   "tesseract",
+			Languages: "eng",
+		},
+		Search: SearchConfig{
+			Language: "simple",
+		},
+		FFmpegCommand: "ffmpeg",
+		ImageFormats:  []string{ImageAVIF, ImageWebP},
+		OAuth: OAuthConfig{
+			SSO: SSOConfig{
+				Scopes:      []string{"openid", "email", "profile"},
+				GroupsClaim: "groups",
+			},
+			SAML: SAMLConfig{
+				EmailAttribute:  "email",
+				NameAttribute:   "name",
+				GroupsAttribute: "groups",
+			},
+		},
+	}
+}
+
+var config = DefaultConfig()
+
+// LoadConfig layers configuration sources in increasing precedence:
+// built-in defaults, the YAML file named by -config or CONFIG_FILE,
+// environment variables, and finally command-line flags.
+func LoadConfig(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("tango", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	port := fs.Int("port", 0, "port to listen on")
+	origins := fs.String("origins", "", "comma-separated list of allowed CORS origins")
+	stateFile := fs.String("state-file", "", "file used to persist sessions across restarts")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file")
+	tlsKey := fs.String("tls-key", "", "TLS private key file")
+	autocertHost := fs.String("autocert-host", "", "hostname to provision a Let's Encrypt certificate for")
+	logLevel := fs.String("log-level", "", "log level (debug, info, warn, error)")
+	logFormat := fs.String("log-format", "", "log format (text, json)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", *path, err)
+		}
+	}
+
+	if err := applyEnv(cfg); err != nil {
+		return nil, err
+	}
+
+	if *port != 0 {
+		cfg.Port = *port
+	}
+	if *origins != "" {
+		cfg.AllowedOrigins = splitList(*origins)
+	}
+	if *stateFile != "" {
+		cfg.Store.StateFile = *stateFile
+	}
+	if *tlsCert != "" {
+		cfg.TLS.CertFile = *tlsCert
+	}
+	if *tlsKey != "" {
+		cfg.TLS.KeyFile = *tlsKey
+	}
+	if *autocertHost != "" {
+		cfg.TLS.AutocertHost = *autocertHost
+	}
+	if *logLevel != "" {
+		cfg.Log.Level = *logLevel
+	}
+	if *logFormat != "" {
+		cfg.Log.Format = *logFormat
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func applyEnv(cfg *Config) error {
+	ints := map[string]*int{
+		"PORT":                     &cfg.Port,
+		"GRPC_PORT":                &cfg.GRPCPort,
+		"RATE_LIMIT_PER_MINUTE":    &cfg.Limits.RequestsPerMinute,
+		"SESSION_CREATES_PER_HOUR": &cfg.Limits.SessionCreatesPerHour,
+		"MESSAGES_PER_SECOND":      &cfg.Limits.MessagesPerSecond,
+		"MAX_CONNECTIONS":          &cfg.Limits.MaxConnections,
+		"SHUTDOWN_DRAIN_SECONDS":   &cfg.ShutdownDrain,
+		"HTTP_PORT":                &cfg.TLS.HTTPPort,
+		"REPLICATION_INTERVAL_MS":  &cfg.Replication.IntervalMs,
+		"LEADER_LEASE_SECONDS":     &cfg.Leader.LeaseSeconds,
+		"SWEEP_INTERVAL_SECONDS":   &cfg.SweepSeconds,
+		"SESSION_IDLE_TTL_SECONDS": &cfg.SessionIdleTTL,
+		"TRASH_RETENTION_SECONDS":  &cfg.TrashRetention,
+		"TURN_CREDENTIAL_TTL":      &cfg.WebRTC.CredentialTTLSeconds,
+		"WS_COMPRESSION_LEVEL":     &cfg.Compression.Level,
+		"WS_COMPRESSION_THRESHOLD": &cfg.Compression.ThresholdBytes,
+		"RECONNECT_GRACE_SECONDS":  &cfg.ReconnectGrace,
+		"FANOUT_WORKERS":           &cfg.Fanout.Workers,
+		"FANOUT_MIN_RECIPIENTS":    &cfg.Fanout.MinRecipients,
+		"WS_WRITE_TIMEOUT_MS":      &cfg.Fanout.WriteTimeoutMs,
+		"WS_SLOW_WRITE_MS":         &cfg.Fanout.SlowWriteMs,
+		"WS_MAX_SLOW_WRITES":       &cfg.Fanout.MaxSlowWrites,
+
+		"USER_MAX_SESSIONS":                 &cfg.UserQuota.ConcurrentSessions,
+		"USER_MAX_CLIENTS_PER_SESSION":      &cfg.UserQuota.ClientsPerSession,
+		"WORKSPACE_MAX_SESSIONS":            &cfg.WorkspaceQuota.ConcurrentSessions,
+		"WORKSPACE_MAX_CLIENTS_PER_SESSION": &cfg.WorkspaceQuota.ClientsPerSession,
+		"ACCOUNT_DELETION_GRACE_SECONDS":    &cfg.DeletionGrace,
+		"SESSION_REMINDER_SECONDS":          &cfg.ReminderLead,
+		"SMTP_PORT":                         &cfg.Email.SMTP.Port,
+		"BLOB_SIGNED_URL_SECONDS":           &cfg.Blobs.SignedURLSeconds,
+	}
+	for name, target := range ints {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		*target = n
+	}
+
+	strs := map[string]*string{
+		"STORE_BACKEND":       &cfg.Store.Backend,
+		"STATE_FILE":          &cfg.Store.StateFile,
+		"AUDIT_LOG_FILE":      &cfg.Store.AuditFile,
+		"CHANGE_LOG_FILE":     &cfg.Store.ChangeLogFile,
+		"TLS_CERT_FILE":       &cfg.TLS.CertFile,
+		"TLS_KEY_FILE":        &cfg.TLS.KeyFile,
+		"AUTOCERT_HOST":       &cfg.TLS.AutocertHost,
+		"AUTOCERT_EMAIL":      &cfg.TLS.AutocertEmail,
+		"AUTOCERT_CACHE":      &cfg.TLS.AutocertCacheDir,
+		"LOG_LEVEL":           &cfg.Log.Level,
+		"LOG_FORMAT":          &cfg.Log.Format,
+		"REPLICATION_ROLE":    &cfg.Replication.Role,
+		"REPLICATION_PEER":    &cfg.Replication.PeerURL,
+		"REPLICATION_TOKEN":   &cfg.Replication.Token,
+		"LEADER_DATABASE_URL": &cfg.Leader.DatabaseURL,
+		"INSTANCE_ID":         &cfg.Leader.InstanceID,
+		"TURN_USERNAME":       &cfg.WebRTC.TURNUsername,
+		"TURN_CREDENTIAL":     &cfg.WebRTC.TURNCredential,
+		"TURN_SECRET":         &cfg.WebRTC.TURNSecret,
+		"ADMIN_TOKEN":         &cfg.AdminToken,
+		"LEGACY_API_SUNSET":   &cfg.APISunset,
+		"ENVIRONMENT":         &cfg.Environment,
+		"WS_ORIGIN_POLICY":    &cfg.WSOriginPolicy,
+		"WS_SLOW_POLICY":      &cfg.Fanout.SlowPolicy,
+		"PUBLISH_DRIVER":      &cfg.Publish.Driver,
+		"PUBLISH_TOPIC":       &cfg.Publish.Topic,
+
+		"OAUTH_REDIRECT_BASE_URL": &cfg.OAuth.RedirectBaseURL,
+		"GOOGLE_CLIENT_ID":        &cfg.OAuth.Google.ClientID,
+		"GOOGLE_CLIENT_SECRET":    &cfg.OAuth.Google.ClientSecret,
+		"GITHUB_CLIENT_ID":        &cfg.OAuth.GitHub.ClientID,
+		"GITHUB_CLIENT_SECRET":    &cfg.OAuth.GitHub.ClientSecret,
+		"OIDC_ISSUER":             &cfg.OAuth.SSO.Issuer,
+		"OIDC_CLIENT_ID":          &cfg.OAuth.SSO.ClientID,
+		"OIDC_CLIENT_SECRET":      &cfg.OAuth.SSO.ClientSecret,
+		"OIDC_GROUPS_CLAIM":       &cfg.OAuth.SSO.GroupsClaim,
+		"SAML_IDP_METADATA_URL":   &cfg.OAuth.SAML.IdPMetadataURL,
+		"SAML_IDP_METADATA_FILE":  &cfg.OAuth.SAML.IdPMetadataFile,
+		"SAML_ENTITY_ID":          &cfg.OAuth.SAML.EntityID,
+		"SAML_CERT_FILE":          &cfg.OAuth.SAML.CertFile,
+		"SAML_KEY_FILE":           &cfg.OAuth.SAML.KeyFile,
+		"SAML_EMAIL_ATTRIBUTE":    &cfg.OAuth.SAML.EmailAttribute,
+		"SAML_NAME_ATTRIBUTE":     &cfg.OAuth.SAML.NameAttribute,
+		"SAML_GROUPS_ATTRIBUTE":   &cfg.OAuth.SAML.GroupsAttribute,
+
+		"STRIPE_SECRET_KEY":         &cfg.Billing.StripeSecretKey,
+		"STRIPE_WEBHOOK_SECRET":     &cfg.Billing.StripeWebhookSecret,
+		"BILLING_PORTAL_RETURN_URL": &cfg.Billing.PortalReturnURL,
+
+		"EMAIL_DRIVER":          &cfg.Email.Driver,
+		"EMAIL_FROM":            &cfg.Email.From,
+		"EMAIL_APP_URL":         &cfg.Email.AppURL,
+		"EMAIL_TEMPLATE_DIR":    &cfg.Email.TemplateDir,
+		"SMTP_HOST":             &cfg.Email.SMTP.Host,
+		"SMTP_USERNAME":         &cfg.Email.SMTP.Username,
+		"SMTP_PASSWORD":         &cfg.Email.SMTP.Password,
+		"SES_REGION":            &cfg.Email.SES.Region,
+		"SES_ENDPOINT":          &cfg.Email.SES.Endpoint,
+		"AWS_ACCESS_KEY_ID":     &cfg.Email.SES.AccessKeyID,
+		"AWS_SECRET_ACCESS_KEY": &cfg.Email.SES.SecretAccessKey,
+
+		"BLOB_DRIVER":             &cfg.Blobs.Driver,
+		"BLOB_PREFIX":             &cfg.Blobs.Prefix,
+		"S3_BUCKET":               &cfg.Blobs.S3.Bucket,
+		"S3_REGION":               &cfg.Blobs.S3.Region,
+		"S3_ENDPOINT":             &cfg.Blobs.S3.Endpoint,
+		"S3_ACCESS_KEY_ID":        &cfg.Blobs.S3.AccessKeyID,
+		"S3_SECRET_ACCESS_KEY":    &cfg.Blobs.S3.SecretAccessKey,
+		"GCS_BUCKET":              &cfg.Blobs.GCS.Bucket,
+		"GCS_HMAC_ACCESS_ID":      &cfg.Blobs.GCS.AccessKeyID,
+		"GCS_HMAC_SECRET":         &cfg.Blobs.GCS.Secret,
+		"AZURE_STORAGE_ACCOUNT":   &cfg.Blobs.Azure.Account,
+		"AZURE_STORAGE_KEY":       &cfg.Blobs.Azure.AccountKey,
+		"AZURE_STORAGE_CONTAINER": &cfg.Blobs.Azure.Container,
+		"AZURE_STORAGE_ENDPOINT":  &cfg.Blobs.Azure.Endpoint,
+		"BLOB_ENCRYPTION_KEY_ID":  &cfg.Blobs.Encryption.KeyID,
+		"KMS_KEY_ID":              &cfg.Blobs.Encryption.KMS.KeyID,
+		"KMS_REGION":              &cfg.Blobs.Encryption.KMS.Region,
+		"KMS_ENDPOINT":            &cfg.Blobs.Encryption.KMS.Endpoint,
+		"KMS_ACCESS_KEY_ID":       &cfg.Blobs.Encryption.KMS.AccessKeyID,
+		"KMS_SECRET_ACCESS_KEY":   &cfg.Blobs.Encryption.KMS.SecretAccessKey,
+
+		"OCR_DRIVER":    &cfg.OCR.Driver,
+		"OCR_COMMAND":   &cfg.OCR.Command,
+		"OCR_LANGUAGES": &cfg.OCR.Languages,
+		"OCR_URL":       &cfg.OCR.URL,
+
+		"SEARCH_DATABASE_URL": &cfg.Search.DatabaseURL,
+		"SEARCH_LANGUAGE":     &cfg.Search.Language,
+
+		"SUGGEST_URL":     &cfg.Suggest.URL,
+		"SUGGEST_API_KEY": &cfg.Suggest.APIKey,
+		"SUGGEST_MODEL":   &cfg.Suggest.Model,
+		"FFMPEG_COMMAND":  &cfg.FFmpegCommand,
+		"COUNTRY_HEADER":  &cfg.CountryHeader,
+	}
+	for name, target := range strs {
+		if value := os.Getenv(name); value != "" {
+			*target = value
+		}
+	}
+
+	int64s := map[string]*int64{
+		"MAX_MESSAGE_BYTES":             &cfg.Limits.MaxMessageBytes,
+		"USER_STORAGE_BYTES":            &cfg.UserQuota.StorageBytes,
+		"USER_MONTHLY_RELAY_BYTES":      &cfg.UserQuota.MonthlyRelayBytes,
+		"WORKSPACE_STORAGE_BYTES":       &cfg.WorkspaceQuota.StorageBytes,
+		"WORKSPACE_MONTHLY_RELAY_BYTES": &cfg.WorkspaceQuota.MonthlyRelayBytes,
+	}
+	for name, target := range int64s {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			*target = n
+		}
+	}
+
+	if value := os.Getenv("FAULT_INJECTION"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("FAULT_INJECTION: %v", err)
+		}
+		cfg.FaultInjection = enabled
+	}
+
+	if value := os.Getenv("ALLOW_PRIVATE_TARGETS"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("ALLOW_PRIVATE_TARGETS: %v", err)
+		}
+		cfg.PrivateTargets = enabled
+	}
+
+	if value := os.Getenv("API_DOCS"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("API_DOCS: %v", err)
+		}
+		cfg.APIDocs = enabled
+	}
+
+	if value := os.Getenv("BLOB_DEDUP"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("BLOB_DEDUP: %v", err)
+		}
+		cfg.Blobs.Dedup = enabled
+	}
+
+	if value := os.Getenv("BLOB_ENCRYPTION_REQUIRED"); value != "" {
+		required, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("BLOB_ENCRYPTION_REQUIRED: %v", err)
+		}
+		cfg.Blobs.Encryption.Required = required
+	}
+
+	if value := os.Getenv("BLOB_ENCRYPTION_KEYS"); value != "" {
+		cfg.Blobs.Encryption.Keys = make(map[string]string)
+		for i, entry := range splitList(value) {
+			id, key, ok := strings.Cut(entry, ":")
+			if !ok {
+				return fmt.Errorf("BLOB_ENCRYPTION_KEYS: entry %d is not id:key", i+1)
+			}
+			cfg.Blobs.Encryption.Keys[id] = key
+		}
+	}
+
+	if value := os.Getenv("S3_PATH_STYLE"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("S3_PATH_STYLE: %v", err)
+		}
+		cfg.Blobs.S3.PathStyle = enabled
+	}
+
+	if value := os.Getenv("WS_COMPRESSION"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("WS_COMPRESSION: %v", err)
+		}
+		cfg.Compression.Enabled = enabled
+	}
+
+	if value := os.Getenv("ALLOWED_ORIGINS"); value != "" {
+		cfg.AllowedOrigins = splitList(value)
+	}
+	if value := os.Getenv("FAULT_INJECTION_WORKSPACES"); value != "" {
+		cfg.FaultWorkspaces = splitList(value)
+	}
+	if value := os.Getenv("TRUSTED_PROXIES"); value != "" {
+		cfg.TrustedProxies = splitList(value)
+	}
+	if value := os.Getenv("STUN_URLS"); value != "" {
+		cfg.WebRTC.STUNURLs = splitList(value)
+	}
+	if value := os.Getenv("TURN_URLS"); value != "" {
+		cfg.WebRTC.TURNURLs = splitList(value)
+	}
+	if value := os.Getenv("OIDC_SCOPES"); value != "" {
+		cfg.OAuth.SSO.Scopes = splitList(value)
+	}
+	for job := range defaultSchedules(cfg) {
+		if value := os.Getenv(scheduleEnv(job)); value != "" {
+			if cfg.Schedules == nil {
+				cfg.Schedules = make(map[string]string)
+			}
+			cfg.Schedules[job] = value
+		}
+	}
+	if value := os.Getenv("IMAGE_FORMATS"); value == "none" {
+		cfg.ImageFormats = nil
+	} else if value != "" {
+		cfg.ImageFormats = splitList(value)
+	}
+	if value := os.Getenv("PUBLISH_URLS"); value != "" {
+		cfg.Publish.URLs = splitList(value)
+	}
+	if value := os.Getenv("PUBLISH_EVENTS"); value != "" {
+		cfg.Publish.Events = splitList(value)
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.Port <= 0 || c.Port > 65535 {
+		problems = append(problems, "port must be between 1 and 65535")
+	}
+	if _, known := defaultOrigins[c.Environment]; !known && c.Environment != "" {
+		problems = append(problems, fmt.Sprintf("unknown environment %q", c.Environment))
+	}
+	if c.FaultInjection && c.Environment == EnvProduction {
+		problems = append(problems, "faultInjection must not be enabled in production")
+	}
+	if c.FaultInjection && len(c.FaultWorkspaces) == 0 {
+		problems = append(problems, "faultInjection needs faultInjectionWorkspaces to list the workspaces it may be used in")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if !validOriginPattern(origin) {
+			problems = append(problems, fmt.Sprintf("allowed origin %q must be * or scheme://host[:port], where the host may start with *. and the port may be *", origin))
+		}
+	}
+	switch c.WSOriginPolicy {
+	case "", OriginPolicyStrict, OriginPolicyAny:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown websocket origin policy %q", c.WSOriginPolicy))
+	}
+	for _, proxy := range c.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				problems = append(problems, fmt.Sprintf("trusted proxy %q is not an IP address or CIDR range", proxy))
+			}
+		}
+	}
+	if c.Store.Backend != "memory" {
+		problems = append(problems, fmt.Sprintf("unsupported store backend %q", c.Store.Backend))
+	}
+	if c.Limits.RequestsPerMinute <= 0 || c.Limits.SessionCreatesPerHour <= 0 || c.Limits.MessagesPerSecond <= 0 || c.Limits.MaxMessageBytes <= 0 {
+		problems = append(problems, "limits must be positive")
+	}
+	if c.Limits.MaxConnections < 0 {
+		problems = append(problems, "maxConnections must not be negative")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problems = append(problems, "tls certFile and keyFile must be set together")
+	}
+	if c.TLS.AutocertHost != "" && c.TLS.CertFile != "" {
+		problems = append(problems, "tls autocertHost cannot be combined with certFile")
+	}
+	if c.TLS.HTTPPort < 0 || c.TLS.HTTPPort > 65535 || (c.TLS.HTTPPort != 0 && c.TLS.HTTPPort == c.Port) {
+		problems = append(problems, "tls httpPort must be a free port between 1 and 65535")
+	}
+	if c.GRPCPort < 0 || c.GRPCPort > 65535 || (c.GRPCPort != 0 && (c.GRPCPort == c.Port || c.GRPCPort == c.TLS.HTTPPort)) {
+		problems = append(problems, "grpcPort must be a free port between 1 and 65535")
+	}
+	if _, ok := parseLevel(c.Log.Level); !ok {
+		problems = append(problems, fmt.Sprintf("unknown log level %q", c.Log.Level))
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		problems = append(problems, fmt.Sprintf("unknown log format %q", c.Log.Format))
+	}
+	switch c.Replication.Role {
+	case "":
+	case RolePrimary, RoleStandby:
+		if !grpcAvailable {
+			problems = append(problems, "replication streams over gRPC, which needs a binary built with -tags grpc")
+		}
+		if c.Replication.Token == "" {
+			problems = append(problems, "replication token is required")
+		}
+		if c.Replication.IntervalMs <= 0 {
+			problems = append(problems, "replication intervalMs must be positive")
+		}
+		if peer, err := url.Parse(c.Replication.PeerURL); c.Replication.PeerURL != "" && (err != nil || peer.Scheme != "grpc" && peer.Scheme != "grpcs" || peer.Port() == "") {
+			problems = append(problems, "replication peerUrl must be a grpc:// or grpcs:// URL with a port")
+		}
+		if c.Replication.Role == RoleStandby && c.GRPCPort == 0 {
+			problems = append(problems, "a replication standby needs grpcPort to receive snapshots on")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown replication role %q", c.Replication.Role))
+	}
+	if c.Leader.DatabaseURL != "" {
+		if !strings.HasPrefix(c.Leader.DatabaseURL, "postgres://") && !strings.HasPrefix(c.Leader.DatabaseURL, "postgresql://") {
+			problems = append(problems, "leader databaseUrl must be a postgres:// URL")
+		}
+		if c.Leader.LeaseSeconds < 3 {
+			problems = append(problems, "leader leaseSeconds must be at least 3")
+		}
+	}
+	if c.APISunset != "" {
+		if _, err := time.Parse(dayLayout, c.APISunset); err != nil {
+			problems = append(problems, "legacyApiSunset must be a date like 2027-01-31")
+		}
+	}
+	if c.SweepSeconds <= 0 {
+		problems = append(problems, "sweepIntervalSeconds must be positive")
+	}
+	if c.SessionIdleTTL < 0 {
+		problems = append(problems, "sessionIdleTtlSeconds must not be negative")
+	}
+	if c.TrashRetention < 0 {
+		problems = append(problems, "trashRetentionSeconds must not be negative")
+	}
+	if c.DeletionGrace < 0 {
+		problems = append(problems, "accountDeletionGraceSeconds must not be negative")
+	}
+	if c.ReminderLead < 0 {
+		problems = append(problems, "sessionReminderSeconds must not be negative")
+	}
+	if c.WebRTC.CredentialTTLSeconds <= 0 {
+		problems = append(problems, "webrtc credentialTtlSeconds must be positive")
+	}
+	if c.Compression.Level < -2 || c.Compression.Level > 9 {
+		problems = append(problems, "compression level must be between -2 and 9")
+	}
+	if c.Compression.ThresholdBytes < 0 {
+		problems = append(problems, "compression thresholdBytes must not be negative")
+	}
+	if c.Fanout.Workers <= 0 {
+		problems = append(problems, "fanout workers must be positive")
+	}
+	if c.Fanout.MinRecipients < 0 {
+		problems = append(problems, "fanout minRecipients must not be negative")
+	}
+	if c.Fanout.WriteTimeoutMs <= 0 || c.Fanout.SlowWriteMs <= 0 {
+		problems = append(problems, "fanout writeTimeoutMs and slowWriteMs must be positive")
+	}
+	if c.Fanout.MaxSlowWrites <= 0 {
+		problems = append(problems, "fanout maxSlowWrites must be positive")
+	}
+	switch c.Fanout.SlowPolicy {
+	case SlowPolicyDrop, SlowPolicyDisconnect:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown slow receiver policy %q", c.Fanout.SlowPolicy))
+	}
+	problems = append(problems, validateSchedules(c)...)
+	switch c.Publish.Driver {
+	case "":
+	case PublishKafka, PublishNATS:
+		if len(c.Publish.URLs) == 0 || c.Publish.Topic == "" {
+			problems = append(problems, "publish urls and topic are required")
+		}
+		for _, event := range c.Publish.Events {
+			if !knownEvents[event] {
+				problems = append(problems, fmt.Sprintf("cannot publish unknown event %q", event))
+			}
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown publish driver %q", c.Publish.Driver))
+	}
+	problems = append(problems, c.Blobs.validate()...)
+	problems = append(problems, c.Blobs.Encryption.validate()...)
+	for _, format := range c.ImageFormats {
+		if imageFormatTypes[format] == "" {
+			problems = append(problems, fmt.Sprintf("unknown image format %q", format))
+		}
+	}
+	problems = append(problems, c.Email.validate()...)
+	problems = append(problems, c.OCR.validate()...)
+	problems = append(problems, c.Search.validate()...)
+	problems = append(problems, c.Suggest.validate()...)
+	if c.ReconnectGrace < 0 {
+		problems = append(problems, "reconnectGraceSeconds must not be negative")
+	}
+	if c.ShutdownDrain < 0 {
+		problems = append(problems, "shutdownDrainSeconds must not be negative")
+	}
+	problems = append(problems, c.UserQuota.validate("userQuota")...)
+	problems = append(problems, c.WorkspaceQuota.validate("workspaceQuota")...)
+	prices := make(map[string]string)
+	for i, plan := range c.Billing.Plans {
+		if plan.Name == "" {
+			problems = append(problems, fmt.Sprintf("billing plan %d needs a name", i+1))
+		}
+		for _, price := range plan.PriceIDs {
+			if other, taken := prices[price]; taken {
+				problems = append(problems, fmt.Sprintf("price %q belongs to both %q and %q", price, other, plan.Name))
+			}
+			prices[price] = plan.Name
+		}
+		problems = append(problems, plan.Quota.validate("plan "+plan.Name)...)
+	}
+	if len(c.Billing.Plans) > 0 && c.Billing.StripeWebhookSecret == "" {
+		problems = append(problems, "billing plans need stripeWebhookSecret to receive subscription events")
+	}
+	if (c.OAuth.Google.Enabled() || c.OAuth.GitHub.Enabled() || c.OAuth.SSO.Enabled() || c.OAuth.SAML.Enabled()) && c.OAuth.RedirectBaseURL == "" {
+		problems = append(problems, "oauth redirectBaseUrl is required when a provider is configured")
+	}
+	if c.OAuth.SSO.Issuer != "" && !strings.HasPrefix(c.OAuth.SSO.Issuer, "https://") {
+		problems = append(problems, "sso issuer must be an https URL")
+	}
+	if c.OAuth.SSO.Enabled() && c.OAuth.SSO.GroupsClaim == "" {
+		problems = append(problems, "sso groupsClaim must not be empty")
+	}
+	if c.OAuth.SSO.Enabled() && !containsString(c.OAuth.SSO.Scopes, "openid") {
+		problems = append(problems, "sso scopes must include openid")
+	}
+	if saml := c.OAuth.SAML; saml.Enabled() {
+		// The IdP posts its response across sites, which only carries the
+		// state cookie when it is Secure.
+		if !strings.HasPrefix(c.OAuth.RedirectBaseURL, "https://") {
+			problems = append(problems, "oauth redirectBaseUrl must be an https URL for saml")
+		}
+		if saml.IdPMetadataURL != "" && saml.IdPMetadataFile != "" {
+			problems = append(problems, "saml takes idpMetadataUrl or idpMetadataFile, not both")
+		}
+		if saml.IdPMetadataURL != "" && !strings.HasPrefix(saml.IdPMetadataURL, "https://") {
+			problems = append(problems, "saml idpMetadataUrl must be an https URL")
+		}
+		if (saml.CertFile == "") != (saml.KeyFile == "") {
+			problems = append(problems, "saml certFile and keyFile must be set together")
+		}
+		if saml.EmailAttribute == "" || saml.GroupsAttribute == "" {
+			problems = append(problems, "saml emailAttribute and groupsAttribute must not be empty")
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (c *Config) Addr() string {
+	return ":" + strconv.Itoa(c.Port)
+}
+
+func (c *Config) DrainWindow() time.Duration {
+	return time.Duration(c.ShutdownDrain) * time.Second
+}
+
+func (c *Config) ReconnectGraceWindow() time.Duration {
+	return time.Duration(c.ReconnectGrace) * time.Second
+}
+
+func (c *Config) TrashRetentionWindow() time.Duration {
+	return time.Duration(c.TrashRetention) * time.Second
+}
+
+func (c *Config) SweepInterval() time.Duration {
+	return time.Duration(c.SweepSeconds) * time.Second
+}
+
+// apply pushes the loaded configuration into the subsystems that were set
+// up with defaults at package init.
+func (c *Config) apply() {
+	level, _ := parseLevel(c.Log.Level)
+	logger.SetLevel(level)
+	logger.SetJSON(c.Log.Format == "json")
+	upgrader.EnableCompression = c.Compression.Enabled
+
+	quotas.mu.Lock()
+	quotas.Quotas[QuotaRequests] = Quota{Limit: c.Limits.RequestsPerMinute, Window: time.Minute}
+	quotas.Quotas[QuotaSessionCreates] = Quota{Limit: c.Limits.SessionCreatesPerHour, Window: time.Hour}
+	quotas.mu.Unlock()
+}
+
+func getConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, config)
+}
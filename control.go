@@ -0,0 +1,217 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inputMaxRate bounds how many input frames per second a controller may
+// send; pointer moves arrive far faster than ordinary messages.
+const inputMaxRate = 240
+
+var inputKinds = map[string]bool{
+	"mousemove": true,
+	"mousedown": true,
+	"mouseup":   true,
+	"wheel":     true,
+	"keydown":   true,
+	"keyup":     true,
+}
+
+// InputEvent is a mouse or keyboard event a controller sends to the
+// presenter. Pointer coordinates are normalised like cursor positions.
+type InputEvent struct {
+	Kind      string   `json:"kind"`
+	X         float64  `json:"x,omitempty"`
+	Y         float64  `json:"y,omitempty"`
+	Button    int      `json:"button,omitempty"`
+	DeltaX    float64  `json:"deltaX,omitempty"`
+	DeltaY    float64  `json:"deltaY,omitempty"`
+	Key       string   `json:"key,omitempty"`
+	Code      string   `json:"code,omitempty"`
+	Modifiers []string `json:"modifiers,omitempty"`
+}
+
+// Remote control follows a request/grant handshake: a viewer sends
+// control_request, a host answers with control_grant or control_deny, and
+// from then on the controller's input frames are relayed to the hosts until
+// a host sends control_revoke or the controller sends control_release. One
+// client holds control at a time.
+
+// sendToHosts delivers message to every presenter in session. Callers must
+// hold session.mu.
+func sendToHosts(session *Session, message Message) {
+	for _, client := range session.Clients {
+		if isHost(client) {
+			deliver(client, message)
+		}
+	}
+}
+
+func controlTarget(msg InboundMessage) (string, error) {
+	var req struct {
+		ClientID string `json:"clientId"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.ClientID == "" {
+		return "", errors.New("payload must name a clientId")
+	}
+	return req.ClientID, nil
+}
+
+func handleControlRequest(client *Client, session *Session) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if isHost(client) {
+		client.send(controlError("Hosts already control their own screen"))
+		return
+	}
+	if session.controlRequests == nil {
+		session.controlRequests = make(map[string]bool)
+	}
+	session.controlRequests[client.ID] = true
+
+	sendToHosts(session, Message{
+		Type: "control_requested",
+		Payload: gin.H{
+			"clientId": client.ID,
+			"name":     client.Name,
+		},
+	})
+}
+
+func handleControlAnswer(client *Client, session *Session, msg InboundMessage, grant bool) {
+	targetID, err := controlTarget(msg)
+	if err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if !isHost(client) {
+		client.send(controlError("Only the host can answer control requests"))
+		return
+	}
+	target, exists := session.Clients[targetID]
+	if !exists || !session.controlRequests[targetID] {
+		client.send(controlError("That client has no pending control request"))
+		return
+	}
+	delete(session.controlRequests, targetID)
+
+	if !grant {
+		deliver(target, Message{Type: "control_denied", Payload: gin.H{"by": client.ID}})
+		return
+	}
+
+	if previous, held := session.Clients[session.controllerID]; held && previous != target {
+		deliver(previous, Message{Type: "control_revoked", Payload: gin.H{"by": client.ID}})
+	}
+	session.controllerID = target.ID
+	deliver(target, Message{Type: "control_granted", Payload: gin.H{"by": client.ID}})
+	auditClient(client, "control.grant", "client", target.ID, gin.H{"sessionId": session.ID})
+	broadcastControlChanged(session)
+}
+
+// handleControlRevoke ends the current grant. Hosts may revoke it at any
+// time and the controller may give it up.
+func handleControlRevoke(client *Client, session *Session) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.controllerID == "" {
+		return
+	}
+	if !isHost(client) && client.ID != session.controllerID {
+		client.send(controlError("Only the host or the controller can end remote control"))
+		return
+	}
+
+	if controller, exists := session.Clients[session.controllerID]; exists {
+		deliver(controller, Message{Type: "control_revoked", Payload: gin.H{"by": client.ID}})
+	}
+	auditClient(client, "control.revoke", "client", session.controllerID, gin.H{"sessionId": session.ID})
+	session.controllerID = ""
+	broadcastControlChanged(session)
+}
+
+// releaseControl drops any grant or pending request held by a departing
+// client. Callers must hold session.mu.
+func releaseControl(client *Client, session *Session) {
+	delete(session.controlRequests, client.ID)
+	if session.controllerID == client.ID {
+		session.controllerID = ""
+		broadcastControlChanged(session)
+	}
+}
+
+// broadcastControlChanged tells the session who holds control. Callers must
+// hold session.mu.
+func broadcastControlChanged(session *Session) {
+	for _, client := range session.Clients {
+		deliver(client, Message{
+			Type: "control_changed",
+			Payload: gin.H{
+				"controllerId": session.controllerID,
+			},
+		})
+	}
+}
+
+func controlError(message string) Message {
+	return Message{
+		Type: "error",
+		Payload: gin.H{
+			"code":    "forbidden",
+			"message": message,
+		},
+	}
+}
+
+func decodeInput(msg InboundMessage) (InputEvent, error) {
+	var event InputEvent
+	if err := json.Unmarshal(msg.Payload, &event); err != nil {
+		return event, errors.New("input payload must be an event object")
+	}
+	if !inputKinds[event.Kind] {
+		return event, errors.New("unknown input kind " + event.Kind)
+	}
+	if math.IsNaN(event.X) || math.IsNaN(event.Y) || event.X < 0 || event.X > 1 || event.Y < 0 || event.Y > 1 {
+		return event, errors.New("input x and y must be between 0 and 1")
+	}
+	return event, nil
+}
+
+// handleInput relays a controller's input to the hosts. Like cursor
+// frames, input bypasses the regular limiter and tracing.
+func handleInput(client *Client, session *Session, msg InboundMessage) {
+	if ok, _, _ := client.inputLimiter.Allow(); !ok {
+		return
+	}
+
+	event, err := decodeInput(msg)
+	if err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.controllerID != client.ID {
+		client.send(controlError("Remote control has not been granted"))
+		return
+	}
+	sendToHosts(session, Message{
+		Type: "input",
+		Payload: gin.H{
+			"clientId": client.ID,
+			"event":    event,
+		},
+	})
+}
@@ -0,0 +1,106 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	cursorTick = 50 * time.Millisecond
+	// cursorMaxRate bounds how many cursor frames per second a client may
+	// send before extra frames are dropped without notice.
+	cursorMaxRate = 120
+)
+
+// CursorPosition is a pointer location normalised to the shared screen, so
+// 0,0 is the top-left corner and 1,1 the bottom-right.
+type CursorPosition struct {
+	ClientID string  `json:"clientId"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Hidden   bool    `json:"hidden,omitempty"`
+}
+
+// CursorRelay coalesces cursor updates so each client's latest position is
+// relayed at most once per tick, however fast it is sent.
+type CursorRelay struct {
+	pending map[string]map[string]CursorPosition
+	mu      sync.Mutex
+}
+
+var cursors = &CursorRelay{pending: make(map[string]map[string]CursorPosition)}
+
+func startCursorRelay(tick time.Duration) {
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for range ticker.C {
+			cursors.flush()
+		}
+	}()
+}
+
+func (r *CursorRelay) Update(sessionID string, pos CursorPosition) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	latest, exists := r.pending[sessionID]
+	if !exists {
+		latest = make(map[string]CursorPosition)
+		r.pending[sessionID] = latest
+	}
+	latest[pos.ClientID] = pos
+}
+
+func (r *CursorRelay) flush() {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[string]map[string]CursorPosition)
+	r.mu.Unlock()
+
+	for sessionID, latest := range pending {
+		batch := make([]CursorPosition, 0, len(latest))
+		for _, pos := range latest {
+			batch = append(batch, pos)
+		}
+		broadcastToSession(nil, sessionID, Message{
+			Type: "cursor",
+			Payload: gin.H{
+				"cursors": batch,
+			},
+		}, "")
+	}
+}
+
+func decodeCursorPosition(client *Client, msg InboundMessage) (CursorPosition, error) {
+	var pos CursorPosition
+	if err := json.Unmarshal(msg.Payload, &pos); err != nil {
+		return pos, errors.New("cursor payload must be an object with x and y")
+	}
+	if math.IsNaN(pos.X) || math.IsNaN(pos.Y) || pos.X < 0 || pos.X > 1 || pos.Y < 0 || pos.Y > 1 {
+		return pos, errors.New("cursor x and y must be between 0 and 1")
+	}
+	pos.ClientID = client.ID
+	return pos, nil
+}
+
+// handleCursor queues a cursor update. Cursor frames bypass the regular
+// message limiter and tracing because they arrive at pointer-move rates;
+// they have their own, more generous limiter instead.
+func handleCursor(client *Client, session *Session, msg InboundMessage) {
+	if ok, _, _ := client.cursorLimiter.Allow(); !ok {
+		return
+	}
+
+	pos, err := decodeCursorPosition(client, msg)
+	if err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	cursors.Update(session.ID, pos)
+}
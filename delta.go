@@ -0,0 +1,129 @@
+package tango
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Screen frames may be sent as a keyframe followed by deltas against it.
+// Each frame carries a sequence number; a delta is only relayed when it
+// directly follows the last accepted frame of the current keyframe's chain.
+// The chain is buffered so late joiners can be brought up to date, and the
+// sender is asked for a fresh keyframe once the chain grows long or breaks.
+const (
+	FrameFull  = ""
+	FrameKey   = "key"
+	FrameDelta = "delta"
+
+	maxDeltaChain      = 60
+	maxDeltaChainBytes = 8 << 20
+)
+
+var errBrokenChain = errors.New("delta does not follow the current keyframe chain")
+
+// frameChain is a session's current keyframe and the deltas accepted since.
+// It is guarded by session.mu.
+type frameChain struct {
+	key       *Message
+	deltas    []Message
+	bytes     int
+	lastSeq   int64
+	broken    bool
+	requested bool
+	// overflow is set once the chain is too large to buffer; late joiners
+	// then wait for the next keyframe instead of a replay.
+	overflow bool
+}
+
+// accept validates data against the chain and records it. Callers must
+// hold session.mu.
+func (fc *frameChain) accept(data ScreenData, message Message) error {
+	switch data.Frame {
+	case FrameKey:
+		*fc = frameChain{key: &message, lastSeq: data.Seq}
+	case FrameDelta:
+		if fc.key == nil || fc.broken || data.Seq != fc.lastSeq+1 {
+			fc.broken = true
+			return errBrokenChain
+		}
+		fc.lastSeq = data.Seq
+		if fc.overflow {
+			return nil
+		}
+		fc.bytes += len(data.Data)
+		if len(fc.deltas) >= maxDeltaChain || fc.bytes > maxDeltaChainBytes {
+			fc.overflow = true
+			fc.deltas = nil
+			return nil
+		}
+		fc.deltas = append(fc.deltas, message)
+	}
+	return nil
+}
+
+// wantsKeyframe reports whether the sender should be asked for a new
+// keyframe, and remembers that it has been so it is asked only once per
+// chain.
+func (fc *frameChain) wantsKeyframe() bool {
+	if fc.requested || (fc.key == nil && !fc.broken) {
+		return false
+	}
+	if fc.broken || fc.overflow || len(fc.deltas) >= maxDeltaChain {
+		fc.requested = true
+		return true
+	}
+	return false
+}
+
+// breakChain marks the chain unusable after a delta was dropped for every
+// viewer, e.g. by the session frame-rate cap. Callers must hold session.mu.
+func (fc *frameChain) breakChain(data ScreenData) {
+	if data.Frame == FrameDelta {
+		fc.broken = true
+	}
+}
+
+// requestKeyframe asks sender for a new keyframe. Callers must hold
+// session.mu.
+func requestKeyframe(sender *Client, reason string) {
+	deliver(sender, Message{
+		Type: "keyframe_request",
+		Payload: gin.H{
+			"reason": reason,
+		},
+	})
+}
+
+// sendFrameSync replays the current keyframe chain to a client that just
+// joined so it can render the screen before the next keyframe.
+func sendFrameSync(client *Client, session *Session) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	fc := &session.frames
+	if fc.key == nil || fc.broken {
+		client.frames.needsKey = true
+		return
+	}
+	if fc.overflow {
+		client.frames.needsKey = true
+		requestSessionKeyframe(session, client, "late_joiner")
+		return
+	}
+
+	deliver(client, *fc.key)
+	for _, delta := range fc.deltas {
+		deliver(client, delta)
+	}
+}
+
+// requestSessionKeyframe asks every presenter in session other than client
+// for a new keyframe. Callers must hold session.mu.
+func requestSessionKeyframe(session *Session, client *Client, reason string) {
+	for _, other := range session.Clients {
+		if other.ID != client.ID && other.Role == RolePresenter {
+			requestKeyframe(other, reason)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// End-to-end encrypted sessions keep their content from the server.
+// Clients agree on a session key among themselves: each announces a public
+// key with e2ee_key, which the server relays and hands to later joiners,
+// and e2ee_key_share passes the session key, wrapped for one client, on to
+// it unread. Frames then travel in the e2ee encoding, and screenshots,
+// recordings and comments are stored as the clients encrypted them. What
+// needs the plaintext on the server is turned off and listed in the
+// session's disabledFeatures.
+
+const (
+	EncodingE2EE = "e2ee"
+
+	// encryptedContentType is the type of screenshots and recordings the
+	// server cannot look into.
+	encryptedContentType = "application/octet-stream"
+
+	maxE2EEKeyBytes   = 4 << 10
+	maxE2EEShareBytes = 16 << 10
+)
+
+// e2eeDisabledFeatures are the features an end-to-end encrypted session
+// goes without.
+var e2eeDisabledFeatures = []string{
+	"ocr",
+	"recording_playback",
+	"suggestions",
+	"guides",
+	"screenshot_links",
+	"image_transcoding",
+	"direct_uploads",
+	"transcripts",
+	"chat_history",
+	"mentions",
+}
+
+var (
+	errNotEncrypted   = errors.New("the session is not end-to-end encrypted")
+	errE2EEFrames     = errors.New("frames of an end-to-end encrypted session must use the e2ee encoding")
+	errPlaintextFrame = errors.New("the e2ee encoding is only for end-to-end encrypted sessions")
+	errE2EESFU        = errors.New("end-to-end encrypted sessions cannot use the SFU, which decrypts media")
+)
+
+// rejectEncrypted responds that feature is off in the session because it
+// is end-to-end encrypted.
+func rejectEncrypted(c *gin.Context, feature string) {
+	c.JSON(http.StatusConflict, gin.H{
+		"error":   "The session is end-to-end encrypted, so the server cannot offer " + feature,
+		"feature": feature,
+	})
+}
+
+type e2eeKey struct {
+	PublicKey string `json:"publicKey"`
+}
+
+type e2eeKeyShare struct {
+	To   string `json:"to"`
+	Data string `json:"data"`
+}
+
+// handleE2EEKey records the sender's public key and relays it to the rest
+// of the session.
+func handleE2EEKey(client *Client, session *Session, span *Span, msg InboundMessage) {
+	if !session.E2EE {
+		sendError(client, "e2ee_disabled", errNotEncrypted.Error())
+		return
+	}
+	var key e2eeKey
+	if err := json.Unmarshal(msg.Payload, &key); err != nil || key.PublicKey == "" || len(key.PublicKey) > maxE2EEKeyBytes {
+		sendError(client, "invalid_payload", "e2ee_key payload must be an object with a publicKey of at most 4 KB")
+		return
+	}
+	session.mu.Lock()
+	client.e2eeKey = key.PublicKey
+	session.mu.Unlock()
+	broadcastToSession(span, session.ID, Message{Type: "e2ee_key", Payload: gin.H{"clientId": client.ID, "publicKey": key.PublicKey}}, client.ID)
+}
+
+// handleE2EEKeyShare passes a wrapped key on to the one client it is for.
+func handleE2EEKeyShare(client *Client, session *Session, span *Span, msg InboundMessage) {
+	if !session.E2EE {
+		sendError(client, "e2ee_disabled", errNotEncrypted.Error())
+		return
+	}
+	var share e2eeKeyShare
+	if err := json.Unmarshal(msg.Payload, &share); err != nil || share.To == "" || share.Data == "" || len(share.Data) > maxE2EEShareBytes {
+		sendError(client, "invalid_payload", "e2ee_key_share payload must be an object with to and data of at most 16 KB")
+		return
+	}
+
+	session.mu.Lock()
+	target, exists := session.Clients[share.To]
+	session.mu.Unlock()
+	if !exists {
+		sendError(client, "unknown_recipient", "Client "+share.To+" is not in this session")
+		return
+	}
+	span.SetError(deliver(target, Message{Type: "e2ee_key_share", Payload: gin.H{"from": client.ID, "data": share.Data}}))
+}
+
+// sendE2EEKeySync gives a client that just joined the public keys of the
+// others in the session.
+func sendE2EEKeySync(client *Client, session *Session) {
+	if !session.E2EE {
+		return
+	}
+	keys := []gin.H{}
+	session.mu.Lock()
+	for id, other := range session.Clients {
+		if id != client.ID && other.e2eeKey != "" {
+			keys = append(keys, gin.H{"clientId": id, "publicKey": other.e2eeKey})
+		}
+	}
+	session.mu.Unlock()
+	client.send(Message{Type: "e2ee_keys", Payload: gin.H{"sessionId": session.ID, "keys": keys}})
+}
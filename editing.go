@@ -0,0 +1,556 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Co-editing of a session's details runs over its WebSocket. Connections
+// send edit_join to take part and get an edit_sync with the name,
+// description and tags, each text field's revision, the held locks and who
+// else is editing.
+//
+// Text fields are edited with operational transform in the ot.js format:
+// edit_op carries the field, the revision the client last saw and the
+// operation. The server transforms it past anything applied since, applies
+// it, answers the sender with edit_ack and relays the transformed op to the
+// other editors. Tags are edited by name with edit_tags, add, remove or
+// move placing a tag after an anchor, and everyone gets the resulting list.
+// edit_focus shares a co-editor's field and selection. Where merging is not
+// wanted, edit_lock reserves a field for one connection until edit_unlock,
+// edit_leave or disconnect.
+//
+// Edits are kept as one version per stretch of work by the same user,
+// recorded when someone else edits, the session is changed over the API,
+// or the author stops editing.
+
+const (
+	EditFieldName        = "name"
+	EditFieldDescription = "description"
+	EditFieldTags        = "tags"
+
+	// maxEditLog is how many operations each text field keeps for
+	// transforming late ones; clients further behind must rejoin.
+	maxEditLog = 1000
+	// maxDescriptionLen matches the limit on UpdateSessionRequest.
+	maxDescriptionLen = 2000
+)
+
+var (
+	errNotEditing     = errors.New("Send edit_join before editing")
+	errCannotEdit     = errors.New("Only presenters and signed-in users can edit the session")
+	errEditTrashed    = errors.New("Session is in the trash; restore it first")
+	errUnknownField   = errors.New("field must be name, description or tags")
+	errStaleRevision  = errors.New("revision is too old or unknown; send edit_join to resync")
+	errEmptyName      = errors.New("name cannot be empty")
+	errLongDesc       = errors.New("description must be at most 2000 characters")
+	errUnknownTagEdit = errors.New("op must be add, remove or move")
+)
+
+// Editor is a connection taking part in editing, with where its cursor is.
+type Editor struct {
+	ClientID  string         `json:"clientId"`
+	Name      string         `json:"name"`
+	Field     string         `json:"field,omitempty"`
+	Selection *EditSelection `json:"selection,omitempty"`
+}
+
+// EditSelection is a range in a text field, in UTF-16 code units. Anchor
+// and Head are equal for a plain cursor.
+type EditSelection struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
+
+// editDoc is the operation log of one text field. ops[i] took the field from
+// revision first+i to first+i+1.
+type editDoc struct {
+	revision int
+	first    int
+	ops      []textOp
+}
+
+func (d *editDoc) record(op textOp) {
+	d.ops = append(d.ops, op)
+	d.revision++
+	if len(d.ops) > maxEditLog {
+		d.ops = append([]textOp{}, d.ops[len(d.ops)-maxEditLog:]...)
+		d.first = d.revision - maxEditLog
+	}
+}
+
+// rebase transforms op, made against revision, past the operations applied
+// since.
+func (d *editDoc) rebase(op textOp, revision int) (textOp, error) {
+	if revision < d.first || revision > d.revision {
+		return nil, errStaleRevision
+	}
+	for _, applied := range d.ops[revision-d.first:] {
+		var err error
+		if op, _, err = transformOps(op, applied); err != nil {
+			return nil, err
+		}
+	}
+	return op, nil
+}
+
+// editingState is a session's co-editing state, guarded by session.mu.
+type editingState struct {
+	docs    map[string]*editDoc
+	editors map[string]*Editor
+	locks   map[string]string
+	// text is the value of each field as the editors last saw it, so
+	// changes made through the API can be sent on to them.
+	text map[string]string
+	tags []string
+	// pending is the session's details before the edits not yet recorded
+	// as a version, which pendingAuthor made.
+	pending       *SessionDetails
+	pendingAuthor string
+}
+
+func editingFor(session *Session) *editingState {
+	if session.editing == nil {
+		session.editing = &editingState{
+			docs:    map[string]*editDoc{EditFieldName: {}, EditFieldDescription: {}},
+			editors: make(map[string]*Editor),
+			locks:   make(map[string]string),
+			text:    map[string]string{EditFieldName: session.Name, EditFieldDescription: session.Description},
+			tags:    session.Tags,
+		}
+	}
+	return session.editing
+}
+
+func fieldText(session *Session, field string) string {
+	if field == EditFieldName {
+		return session.Name
+	}
+	return session.Description
+}
+
+func setFieldText(session *Session, field, text string) {
+	if field == EditFieldName {
+		session.Name = text
+	} else {
+		session.Description = text
+	}
+}
+
+func canEdit(client *Client) bool {
+	return isHost(client) || client.userID != ""
+}
+
+// sendToEditors delivers message to everyone editing session but exclude.
+// Callers must hold session.mu.
+func sendToEditors(session *Session, message Message, exclude string) {
+	if session.editing == nil {
+		return
+	}
+	for id := range session.editing.editors {
+		if client, exists := session.Clients[id]; exists && id != exclude {
+			deliver(client, message)
+		}
+	}
+}
+
+func (e *editingState) editorList(session *Session) []Editor {
+	list := make([]Editor, 0, len(e.editors))
+	for id, editor := range e.editors {
+		if _, exists := session.Clients[id]; exists {
+			list = append(list, *editor)
+		}
+	}
+	return list
+}
+
+func broadcastEditors(session *Session) {
+	sendToEditors(session, Message{
+		Type:    "edit_presence",
+		Payload: gin.H{"editors": session.editing.editorList(session)},
+	}, "")
+}
+
+// editBy notes that authorID is about to change the session, first
+// recording any edits someone else left pending. Callers must hold
+// session.mu.
+func (e *editingState) editBy(session *Session, authorID string) {
+	if e.pending != nil && e.pendingAuthor != authorID {
+		e.flush(session)
+	}
+	if e.pending == nil {
+		before := detailsOf(session)
+		e.pending = &before
+		e.pendingAuthor = authorID
+	}
+}
+
+// flush records the pending edits as a version and reports whether there
+// were any.
+func (e *editingState) flush(session *Session) bool {
+	if e.pending == nil {
+		return false
+	}
+	sessionHistory.edited(session, *e.pending, e.pendingAuthor, VersionEdited, 0)
+	e.pending = nil
+	e.pendingAuthor = ""
+	return true
+}
+
+// settleEdits records any pending co-edits before the session is changed
+// over the API. Callers must hold session.mu.
+func settleEdits(session *Session) {
+	if session.editing != nil {
+		session.editing.flush(session)
+	}
+}
+
+// syncEdits brings the editors up to date after the session was changed
+// outside the editing channel: a text field that differs from what they
+// last saw is replaced wholesale and the tag list is resent. Callers must
+// hold session.mu.
+func syncEdits(session *Session) {
+	e := session.editing
+	if e == nil {
+		return
+	}
+	for _, field := range []string{EditFieldName, EditFieldDescription} {
+		current := fieldText(session, field)
+		if current == e.text[field] {
+			continue
+		}
+		op := replaceOp(e.text[field], current)
+		doc := e.docs[field]
+		doc.record(op)
+		e.text[field] = current
+		e.moveSelections(field, op, "")
+		sendToEditors(session, Message{
+			Type:    "edit_op",
+			Payload: gin.H{"field": field, "revision": doc.revision, "operation": op},
+		}, "")
+	}
+	if !reflect.DeepEqual(session.Tags, e.tags) {
+		e.tags = session.Tags
+		sendToEditors(session, Message{Type: "edit_tags", Payload: gin.H{"tags": session.Tags}}, "")
+	}
+}
+
+func (e *editingState) moveSelections(field string, op textOp, exclude string) {
+	for id, editor := range e.editors {
+		if id == exclude || editor.Field != field || editor.Selection == nil {
+			continue
+		}
+		editor.Selection = &EditSelection{
+			Anchor: op.transformIndex(editor.Selection.Anchor),
+			Head:   op.transformIndex(editor.Selection.Head),
+		}
+	}
+}
+
+// editLockHeld returns the first of fields a co-editor holds a lock on, or
+// "". Callers must hold session.mu.
+func editLockHeld(session *Session, fields ...string) string {
+	if session.editing == nil {
+		return ""
+	}
+	for _, field := range fields {
+		if _, held := session.editing.locks[field]; held {
+			return field
+		}
+	}
+	return ""
+}
+
+// joinedEditor returns the session's editing state if client has joined it,
+// telling the client otherwise. Callers must hold session.mu.
+func joinedEditor(client *Client, session *Session) *editingState {
+	if session.editing == nil || session.editing.editors[client.ID] == nil {
+		sendError(client, "invalid_payload", errNotEditing.Error())
+		return nil
+	}
+	if session.Status == SessionTrashed {
+		sendError(client, "forbidden", errEditTrashed.Error())
+		return nil
+	}
+	return session.editing
+}
+
+func handleEditJoin(client *Client, session *Session) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if !canEdit(client) {
+		sendError(client, "forbidden", errCannotEdit.Error())
+		return
+	}
+	if session.Status == SessionTrashed {
+		sendError(client, "forbidden", errEditTrashed.Error())
+		return
+	}
+	e := editingFor(session)
+	syncEdits(session)
+	if e.editors[client.ID] == nil {
+		e.editors[client.ID] = &Editor{ClientID: client.ID, Name: client.Name}
+	}
+
+	fields := gin.H{}
+	for _, field := range []string{EditFieldName, EditFieldDescription} {
+		fields[field] = gin.H{"text": e.text[field], "revision": e.docs[field].revision}
+	}
+	deliver(client, Message{
+		Type: "edit_sync",
+		Payload: gin.H{
+			"fields":  fields,
+			"tags":    session.Tags,
+			"locks":   e.locks,
+			"editors": e.editorList(session),
+		},
+	})
+	broadcastEditors(session)
+}
+
+func handleEditLeave(client *Client, session *Session) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	leaveEditing(client, session)
+}
+
+// leaveEditing takes client out of editing, releasing its locks and
+// recording its edits. Callers must hold session.mu.
+func leaveEditing(client *Client, session *Session) {
+	e := session.editing
+	if e == nil || e.editors[client.ID] == nil {
+		return
+	}
+	delete(e.editors, client.ID)
+	for field, holder := range e.locks {
+		if holder == client.ID {
+			delete(e.locks, field)
+			sendToEditors(session, Message{Type: "edit_unlocked", Payload: gin.H{"field": field}}, "")
+		}
+	}
+	if len(e.editors) == 0 || (client.userID != "" && e.pendingAuthor == client.userID) {
+		if e.flush(session) {
+			emitEvent(EventSessionUpdated, session)
+			update := sessionUpdate(session)
+			for _, other := range session.Clients {
+				deliver(other, Message{Type: "session_updated", Payload: update})
+			}
+		}
+	}
+	if len(e.editors) == 0 {
+		session.editing = nil
+		return
+	}
+	broadcastEditors(session)
+}
+
+func handleEditFocus(client *Client, session *Session, msg InboundMessage) {
+	var req struct {
+		Field     string         `json:"field"`
+		Selection *EditSelection `json:"selection"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	if req.Field != "" && req.Field != EditFieldName && req.Field != EditFieldDescription && req.Field != EditFieldTags {
+		sendError(client, "invalid_payload", errUnknownField.Error())
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	e := joinedEditor(client, session)
+	if e == nil {
+		return
+	}
+	editor := e.editors[client.ID]
+	editor.Field = req.Field
+	editor.Selection = req.Selection
+	if req.Field == "" || req.Field == EditFieldTags {
+		editor.Selection = nil
+	}
+	sendToEditors(session, Message{
+		Type:    "edit_presence",
+		Payload: gin.H{"editors": e.editorList(session)},
+	}, client.ID)
+}
+
+func handleEditOp(client *Client, session *Session, msg InboundMessage) {
+	var req struct {
+		Field     string `json:"field"`
+		Revision  int    `json:"revision"`
+		Operation textOp `json:"operation"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	if req.Field != EditFieldName && req.Field != EditFieldDescription {
+		sendError(client, "invalid_payload", "field must be name or description")
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	e := joinedEditor(client, session)
+	if e == nil {
+		return
+	}
+	if holder, held := e.locks[req.Field]; held && holder != client.ID {
+		sendError(client, "field_locked", "The "+req.Field+" is locked by another editor")
+		return
+	}
+	syncEdits(session)
+
+	doc := e.docs[req.Field]
+	op, err := doc.rebase(req.Operation, req.Revision)
+	if err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	text, err := op.apply(e.text[req.Field])
+	if err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	if req.Field == EditFieldName && text == "" {
+		sendError(client, "invalid_payload", errEmptyName.Error())
+		return
+	}
+	if req.Field == EditFieldDescription && utf8.RuneCountInString(text) > maxDescriptionLen {
+		sendError(client, "invalid_payload", errLongDesc.Error())
+		return
+	}
+
+	e.editBy(session, client.userID)
+	setFieldText(session, req.Field, text)
+	e.text[req.Field] = text
+	doc.record(op)
+	e.moveSelections(req.Field, op, client.ID)
+
+	deliver(client, Message{Type: "edit_ack", Payload: gin.H{"field": req.Field, "revision": doc.revision}})
+	sendToEditors(session, Message{
+		Type: "edit_op",
+		Payload: gin.H{
+			"field":     req.Field,
+			"revision":  doc.revision,
+			"operation": op,
+			"clientId":  client.ID,
+		},
+	}, client.ID)
+}
+
+func handleEditTags(client *Client, session *Session, msg InboundMessage) {
+	var req struct {
+		Op    string `json:"op"`
+		Tag   string `json:"tag"`
+		After string `json:"after"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.Tag == "" {
+		sendError(client, "invalid_payload", "payload must give an op and a tag")
+		return
+	}
+	if req.Op != "add" && req.Op != "remove" && req.Op != "move" {
+		sendError(client, "invalid_payload", errUnknownTagEdit.Error())
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	e := joinedEditor(client, session)
+	if e == nil {
+		return
+	}
+	if holder, held := e.locks[EditFieldTags]; held && holder != client.ID {
+		sendError(client, "field_locked", "The tags are locked by another editor")
+		return
+	}
+
+	tags := editTags(session.Tags, req.Op, req.Tag, req.After)
+	if err := validateTags(tags); err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	e.editBy(session, client.userID)
+	session.Tags = tags
+	e.tags = tags
+	sendToEditors(session, Message{Type: "edit_tags", Payload: gin.H{"tags": tags, "clientId": client.ID}}, "")
+}
+
+// editTags applies a tag edit to a copy of tags. add and move place the tag
+// just after the anchor, or at the end when the anchor is not there, so
+// concurrent edits still land next to what their sender saw. Adding a tag
+// that is present moves it, and removing or moving one that is not there
+// changes nothing.
+func editTags(tags []string, op, tag, after string) []string {
+	present := hasTag(tags, tag)
+	if (op != "add" && !present) || (op != "remove" && present && tag == after) {
+		return tags
+	}
+	out := make([]string, 0, len(tags)+1)
+	for _, t := range tags {
+		if t != tag {
+			out = append(out, t)
+		}
+	}
+	if op == "remove" {
+		return out
+	}
+	at := len(out)
+	for i, t := range out {
+		if t == after {
+			at = i + 1
+			break
+		}
+	}
+	out = append(out, "")
+	copy(out[at+1:], out[at:])
+	out[at] = tag
+	return out
+}
+
+func handleEditLock(client *Client, session *Session, msg InboundMessage, lock bool) {
+	var req struct {
+		Field string `json:"field"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	if req.Field != EditFieldName && req.Field != EditFieldDescription && req.Field != EditFieldTags {
+		sendError(client, "invalid_payload", errUnknownField.Error())
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	e := joinedEditor(client, session)
+	if e == nil {
+		return
+	}
+	holder, held := e.locks[req.Field]
+	if lock {
+		if held && holder != client.ID {
+			sendError(client, "field_locked", "The "+req.Field+" is locked by another editor")
+			return
+		}
+		e.locks[req.Field] = client.ID
+		sendToEditors(session, Message{Type: "edit_locked", Payload: gin.H{"field": req.Field, "clientId": client.ID}}, "")
+		return
+	}
+	if !held {
+		return
+	}
+	if holder != client.ID && !isHost(client) {
+		sendError(client, "forbidden", "Only the editor holding the lock or a host can release it")
+		return
+	}
+	delete(e.locks, req.Field)
+	sendToEditors(session, Message{Type: "edit_unlocked", Payload: gin.H{"field": req.Field, "by": client.ID}}, "")
+}
@@ -0,0 +1,478 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EmailSMTP = "smtp"
+	EmailSES  = "ses"
+
+	emailQueueSize = 256
+	maxDigestItems = 20
+)
+
+// The kinds of email sent, which are also the names of their templates.
+const (
+	EmailInvitation = "invitation"
+	EmailShare      = "share"
+	EmailSignIn     = "sign-in"
+	EmailDigest     = "digest"
+)
+
+var (
+	errEmailDisabled  = errors.New("Email is not configured on this server")
+	errEmailQueueFull = errors.New("email queue full")
+)
+
+// Email is a rendered message ready for a sender.
+type Email struct {
+	From        string
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []EmailAttachment
+}
+
+// EmailAttachment is a file sent along with an email.
+type EmailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// emailSender hands a message to a mail service. Send returns once the
+// service has accepted it.
+type emailSender interface {
+	Send(ctx context.Context, email Email) error
+}
+
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+type emailJob struct {
+	kind  string
+	email Email
+}
+
+// mailer renders emails from templates and sends them from a queue, so
+// handlers never wait on the mail service.
+var mailer struct {
+	sender    emailSender
+	from      string
+	appURL    string
+	templates map[string]*emailTemplate
+	queue     chan emailJob
+	stop      chan struct{}
+	done      chan struct{}
+
+	sent    int64
+	failed  int64
+	dropped int64
+}
+
+func startMailer(cfg EmailConfig) error {
+	var sender emailSender
+	switch cfg.Driver {
+	case "":
+		return nil
+	case EmailSMTP:
+		sender = newSMTPSender(cfg.SMTP)
+	case EmailSES:
+		sender = newSESSender(cfg.SES)
+	default:
+		return fmt.Errorf("unknown email driver %q", cfg.Driver)
+	}
+	templates, err := loadEmailTemplates(cfg.TemplateDir)
+	if err != nil {
+		return err
+	}
+
+	mailer.sender = sender
+	mailer.from = cfg.From
+	mailer.appURL = strings.TrimSuffix(cfg.AppURL, "/")
+	mailer.templates = templates
+	mailer.queue = make(chan emailJob, emailQueueSize)
+	mailer.stop = make(chan struct{})
+	mailer.done = make(chan struct{})
+	go runMailer()
+	return nil
+}
+
+func emailEnabled() bool {
+	return mailer.queue != nil
+}
+
+// emailLink is the web app URL for path.
+func emailLink(path string) string {
+	return mailer.appURL + path
+}
+
+// loadEmailTemplates parses the built-in templates, replacing each part
+// with <kind>.subject, <kind>.txt or <kind>.html from dir where present.
+func loadEmailTemplates(dir string) (map[string]*emailTemplate, error) {
+	templates := make(map[string]*emailTemplate)
+	for kind, source := range defaultEmailTemplates {
+		parts := map[string]string{".subject": source.subject, ".txt": source.text, ".html": source.html}
+		if dir != "" {
+			for ext := range parts {
+				data, err := os.ReadFile(filepath.Join(dir, kind+ext))
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				parts[ext] = string(data)
+			}
+		}
+
+		var t emailTemplate
+		var err error
+		if t.subject, err = texttemplate.New(kind + ".subject").Parse(parts[".subject"]); err != nil {
+			return nil, err
+		}
+		if t.text, err = texttemplate.New(kind + ".txt").Parse(parts[".txt"]); err != nil {
+			return nil, err
+		}
+		if t.html, err = htmltemplate.New(kind + ".html").Parse(parts[".html"]); err != nil {
+			return nil, err
+		}
+		templates[kind] = &t
+	}
+	return templates, nil
+}
+
+func renderEmail(kind, to string, data gin.H) (Email, error) {
+	t := mailer.templates[kind]
+	data["AppURL"] = mailer.appURL
+	var subject, text, html bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return Email{}, err
+	}
+	if err := t.text.Execute(&text, data); err != nil {
+		return Email{}, err
+	}
+	if err := t.html.Execute(&html, data); err != nil {
+		return Email{}, err
+	}
+	return Email{
+		From:    mailer.from,
+		To:      to,
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// sendEmail renders the template for kind with data and queues the result
+// for to, with any attachments.
+func sendEmail(kind, to string, data gin.H, attachments ...EmailAttachment) error {
+	if !emailEnabled() {
+		return errEmailDisabled
+	}
+	email, err := renderEmail(kind, to, data)
+	if err != nil {
+		logger.Error("rendering email failed", "kind", kind, "error", err)
+		return err
+	}
+	email.Attachments = attachments
+	select {
+	case mailer.queue <- emailJob{kind: kind, email: email}:
+		return nil
+	default:
+		atomic.AddInt64(&mailer.dropped, 1)
+		logger.Warn("email queue full, dropping email", "kind", kind)
+		return errEmailQueueFull
+	}
+}
+
+func runMailer() {
+	defer close(mailer.done)
+	for {
+		select {
+		case job := <-mailer.queue:
+			deliverEmail(job)
+		case <-mailer.stop:
+			for {
+				select {
+				case job := <-mailer.queue:
+					deliverEmail(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliverEmail sends job, retrying with the same backoff as outbound HTTP
+// calls.
+func deliverEmail(job emailJob) {
+	var err error
+	for attempt := 1; attempt <= outboundMaxAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), outboundTimeout)
+		err = mailer.sender.Send(ctx, job.email)
+		cancel()
+		if err == nil {
+			atomic.AddInt64(&mailer.sent, 1)
+			return
+		}
+		if attempt < outboundMaxAttempts {
+			time.Sleep(backoff(attempt))
+		}
+	}
+	atomic.AddInt64(&mailer.failed, 1)
+	logger.Error("sending email failed", "kind", job.kind, "error", err)
+}
+
+// stopMailer sends the emails still queued, until ctx is done.
+func stopMailer(ctx context.Context) {
+	if mailer.queue == nil {
+		return
+	}
+	close(mailer.stop)
+	select {
+	case <-mailer.done:
+	case <-ctx.Done():
+		logger.Warn("email queue not drained", "emails", len(mailer.queue))
+	}
+}
+
+func getMailerStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"driver":  config.Email.Driver,
+		"queued":  len(mailer.queue),
+		"sent":    atomic.LoadInt64(&mailer.sent),
+		"failed":  atomic.LoadInt64(&mailer.failed),
+		"dropped": atomic.LoadInt64(&mailer.dropped),
+	})
+}
+
+// EmailPreferences are the optional emails a user has agreed to. Sign-in
+// links are always sent, since the user asked for them.
+type EmailPreferences struct {
+	Invitations bool `json:"invitations"`
+	Shares      bool `json:"shares"`
+	Digest      bool `json:"digest"`
+}
+
+type EmailPreferenceRegistry struct {
+	prefs map[string]EmailPreferences
+	mu    sync.Mutex
+}
+
+var emailPreferences = &EmailPreferenceRegistry{prefs: make(map[string]EmailPreferences)}
+
+func (r *EmailPreferenceRegistry) get(userID string) EmailPreferences {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prefs, exists := r.prefs[userID]; exists {
+		return prefs
+	}
+	return EmailPreferences{Invitations: true, Shares: true, Digest: true}
+}
+
+func (r *EmailPreferenceRegistry) set(userID string, prefs EmailPreferences) {
+	r.mu.Lock()
+	r.prefs[userID] = prefs
+	r.mu.Unlock()
+}
+
+func (r *EmailPreferenceRegistry) forgetUser(userID string) {
+	r.mu.Lock()
+	delete(r.prefs, userID)
+	r.mu.Unlock()
+}
+
+// wantsEmail reports whether the owner of address takes emails of kind.
+// Addresses without an account have no preferences and get everything.
+func wantsEmail(address, kind string) bool {
+	users.mu.Lock()
+	user := users.byEmail[normalizeEmail(address)]
+	users.mu.Unlock()
+	if user == nil {
+		return true
+	}
+	prefs := emailPreferences.get(user.ID)
+	switch kind {
+	case EmailInvitation:
+		return prefs.Invitations
+	case EmailShare:
+		return prefs.Shares
+	case EmailDigest:
+		return prefs.Digest
+	}
+	return true
+}
+
+func getEmailPreferences(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	c.JSON(http.StatusOK, emailPreferences.get(user.ID))
+}
+
+// UpdateEmailPreferencesRequest changes the preferences given and leaves
+// the rest as they are.
+type UpdateEmailPreferencesRequest struct {
+	Invitations *bool `json:"invitations"`
+	Shares      *bool `json:"shares"`
+	Digest      *bool `json:"digest"`
+}
+
+func updateEmailPreferences(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	var req UpdateEmailPreferencesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	prefs := emailPreferences.get(user.ID)
+	if req.Invitations != nil {
+		prefs.Invitations = *req.Invitations
+	}
+	if req.Shares != nil {
+		prefs.Shares = *req.Shares
+	}
+	if req.Digest != nil {
+		prefs.Digest = *req.Digest
+	}
+	emailPreferences.set(user.ID, prefs)
+	c.JSON(http.StatusOK, prefs)
+}
+
+type ShareSessionRequest struct {
+	Emails  []string `json:"emails" binding:"required,min=1,max=20,dive,email"`
+	Message string   `json:"message" binding:"max=1000"`
+}
+
+// shareSession emails a link to the session to each address, skipping
+// users who turned share emails off. Recipients still need access to the
+// session to open it. A scheduled session comes with a calendar invite and
+// joins the calendar feeds of recipients who have accounts.
+func shareSession(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	var req ShareSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	if !emailEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errEmailDisabled.Error()})
+		return
+	}
+	session.mu.Lock()
+	trashed, name, event := session.Status == SessionTrashed, session.Name, eventOf(session)
+	session.mu.Unlock()
+	if trashed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	var attachments []EmailAttachment
+	starts := ""
+	if event.StartAt != 0 {
+		attachments = append(attachments, sessionInvite(event))
+		starts = time.Unix(event.StartAt, 0).UTC().Format("January 2, 2006 at 15:04 UTC")
+	}
+
+	sent, skipped := []string{}, []string{}
+	for _, address := range req.Emails {
+		address = normalizeEmail(address)
+		if containsString(sent, address) || containsString(skipped, address) {
+			continue
+		}
+		if !wantsEmail(address, EmailShare) || sendEmail(EmailShare, address, gin.H{
+			"Sender":  displayName(user),
+			"Session": name,
+			"Message": req.Message,
+			"Link":    emailLink("/sessions/" + session.ID),
+			"Starts":  starts,
+		}, attachments...) != nil {
+			skipped = append(skipped, address)
+		} else {
+			sent = append(sent, address)
+			if event.StartAt != 0 {
+				inviteByEmail(address, session.ID)
+			}
+		}
+	}
+
+	auditRequest(c, "session.share", "session", session.ID, gin.H{"sent": len(sent), "skipped": len(skipped)})
+	c.JSON(http.StatusAccepted, gin.H{"sent": sent, "skipped": skipped})
+}
+
+// sendDigests emails each user who wants a digest the notifications they
+// got in the day before now and have not read yet.
+func sendDigests(now int64) int {
+	if !emailEnabled() {
+		return 0
+	}
+	type recipient struct{ id, email, name string }
+	var recipients []recipient
+	users.mu.Lock()
+	for _, user := range users.Users {
+		name := user.Name
+		if name == "" {
+			name = user.Email
+		}
+		recipients = append(recipients, recipient{user.ID, user.Email, name})
+	}
+	users.mu.Unlock()
+
+	sent := 0
+	for _, r := range recipients {
+		if !emailPreferences.get(r.id).Digest {
+			continue
+		}
+		notes := notifications.unreadSince(r.id, now-24*60*60)
+		if len(notes) == 0 {
+			continue
+		}
+		count := len(notes)
+		if len(notes) > maxDigestItems {
+			notes = notes[:maxDigestItems]
+		}
+		err := sendEmail(EmailDigest, r.email, gin.H{
+			"Name":          r.name,
+			"Count":         count,
+			"More":          count - len(notes),
+			"Notifications": notes,
+			"Link":          emailLink("/notifications"),
+		})
+		if err == nil {
+			sent++
+		}
+	}
+	return sent
+}
@@ -0,0 +1,128 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const sesSendPath = "/v2/email/outbound-emails"
+
+// sesSender delivers mail through the Amazon SES v2 SendEmail API, signing
+// each request with AWS Signature Version 4.
+type sesSender struct {
+	cfg      SESConfig
+	endpoint string
+	client   *http.Client
+}
+
+func newSESSender(cfg SESConfig) *sesSender {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://email." + cfg.Region + ".amazonaws.com"
+	}
+	return &sesSender{cfg: cfg, endpoint: endpoint, client: &http.Client{Timeout: outboundTimeout}}
+}
+
+type sesContent struct {
+	Data    string `json:"Data"`
+	Charset string `json:"Charset"`
+}
+
+type sesSimple struct {
+	Subject sesContent
+	Body    struct{ Text, Html sesContent }
+}
+
+func (s *sesSender) Send(ctx context.Context, email Email) error {
+	var body struct {
+		FromEmailAddress string
+		Destination      struct{ ToAddresses []string }
+		Content          struct {
+			Simple *sesSimple `json:",omitempty"`
+			// Raw carries messages with attachments, which Simple cannot.
+			Raw *struct{ Data []byte } `json:",omitempty"`
+		}
+	}
+	body.FromEmailAddress = email.From
+	body.Destination.ToAddresses = []string{email.To}
+	if len(email.Attachments) > 0 {
+		raw, err := buildMIMEMessage(email)
+		if err != nil {
+			return err
+		}
+		body.Content.Raw = &struct{ Data []byte }{raw}
+	} else {
+		body.Content.Simple = &sesSimple{Subject: sesContent{Data: email.Subject, Charset: "UTF-8"}}
+		body.Content.Simple.Body.Text = sesContent{Data: email.Text, Charset: "UTF-8"}
+		body.Content.Simple.Body.Html = sesContent{Data: email.HTML, Charset: "UTF-8"}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+sesSendPath, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.sign(req, payload, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("ses returned %d: %s", resp.StatusCode, bytes.TrimSpace(detail))
+	}
+	return nil
+}
+
+// sign adds the Signature Version 4 headers for the ses service to req.
+func (s *sesSender) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	u, _ := url.Parse(s.endpoint)
+	payloadHash := sha256Hex(payload)
+	signedHeaders := "content-type;host;x-amz-date"
+	canonical := "POST\n" + sesSendPath + "\n\n" +
+		"content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + u.Host + "\n" +
+		"x-amz-date:" + amzDate + "\n\n" +
+		signedHeaders + "\n" + payloadHash
+
+	scope := day + "/" + s.cfg.Region + "/ses/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := []byte("AWS4" + s.cfg.SecretAccessKey)
+	for _, part := range []string{day, s.cfg.Region, "ses", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,143 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// smtpSender delivers mail through an SMTP relay. Port 465 speaks TLS from
+// the start; on other ports the connection is upgraded with STARTTLS when
+// the server offers it.
+type smtpSender struct {
+	cfg SMTPConfig
+}
+
+func newSMTPSender(cfg SMTPConfig) *smtpSender {
+	return &smtpSender{cfg: cfg}
+}
+
+func (s *smtpSender) Send(ctx context.Context, email Email) error {
+	from, err := mail.ParseAddress(email.From)
+	if err != nil {
+		return err
+	}
+	message, err := buildMIMEMessage(email)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	tlsConfig := &tls.Config{ServerName: s.cfg.Host}
+	if s.cfg.Port == 465 {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	client, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok && s.cfg.Port != 465 {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if s.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(email.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// buildMIMEMessage encodes email as a multipart/alternative message with
+// plain text and HTML bodies, wrapped in a multipart/mixed one with the
+// attachments when there are any.
+func buildMIMEMessage(email Email) ([]byte, error) {
+	boundary := "tango-" + randomToken(12)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", email.From)
+	fmt.Fprintf(&b, "To: %s\r\n", email.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@tango>\r\n", generateID())
+	b.WriteString("MIME-Version: 1.0\r\n")
+	mixed := ""
+	if len(email.Attachments) > 0 {
+		mixed = "tango-" + randomToken(12)
+		fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mixed)
+		fmt.Fprintf(&b, "--%s\r\n", mixed)
+	}
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", email.Text},
+		{"text/html", email.HTML},
+	} {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		w := quotedprintable.NewWriter(&b)
+		if _, err := w.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	if mixed == "" {
+		return b.Bytes(), nil
+	}
+
+	for _, attachment := range email.Attachments {
+		fmt.Fprintf(&b, "\r\n--%s\r\n", mixed)
+		fmt.Fprintf(&b, "Content-Type: %s\r\n", attachment.ContentType)
+		fmt.Fprintf(&b, "Content-Disposition: %s\r\n", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+		b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			b.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		b.WriteString(encoded + "\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", mixed)
+	return b.Bytes(), nil
+}
@@ -0,0 +1,79 @@
+package tango
+
+type emailTemplateSource struct {
+	subject string
+	text    string
+	html    string
+}
+
+// defaultEmailTemplates are the templates used unless the template
+// directory overrides them. Each is given the fields its sender passes,
+// plus AppURL.
+var defaultEmailTemplates = map[string]emailTemplateSource{
+	EmailInvitation: {
+		subject: `{{.Inviter}} invited you to {{.Workspace}} on Tango`,
+		text: `{{.Inviter}} invited you to join the workspace {{.Workspace}} as {{.Role}}.
+
+Accept the invitation:
+{{.Link}}
+
+The invitation expires on {{.Expires}}.
+`,
+		html: `<p>{{.Inviter}} invited you to join the workspace <strong>{{.Workspace}}</strong> as {{.Role}}.</p>
+<p><a href="{{.Link}}">Accept the invitation</a></p>
+<p>The invitation expires on {{.Expires}}.</p>
+`,
+	},
+	EmailShare: {
+		subject: `{{.Sender}} shared "{{.Session}}" with you`,
+		text: `{{.Sender}} shared the session "{{.Session}}" with you.
+{{if .Message}}
+{{.Message}}
+{{end}}{{if .Starts}}
+It starts on {{.Starts}}. The attached invite adds it to your calendar.
+{{end}}
+Open it:
+{{.Link}}
+`,
+		html: `<p>{{.Sender}} shared the session <strong>{{.Session}}</strong> with you.</p>
+{{if .Message}}<blockquote>{{.Message}}</blockquote>
+{{end}}{{if .Starts}}<p>It starts on {{.Starts}}. The attached invite adds it to your calendar.</p>
+{{end}}<p><a href="{{.Link}}">Open the session</a></p>
+`,
+	},
+	EmailSignIn: {
+		subject: `Your Tango sign-in link`,
+		text: `Use this link to sign in to Tango. It works once and expires in {{.Expires}}.
+
+{{.Link}}
+
+If you did not ask to sign in, you can ignore this email.
+`,
+		html: `<p>Use this link to sign in to Tango. It works once and expires in {{.Expires}}.</p>
+<p><a href="{{.Link}}">Sign in to Tango</a></p>
+<p>If you did not ask to sign in, you can ignore this email.</p>
+`,
+	},
+	EmailDigest: {
+		subject: `{{.Count}} new notification{{if ne .Count 1}}s{{end}} on Tango`,
+		text: `Hi {{.Name}}, here is what you missed on Tango today:
+{{range .Notifications}}
+- {{.Text}}{{end}}
+{{if .More}}
+and {{.More}} more.
+{{end}}
+See them all:
+{{.Link}}
+
+You can turn this digest off in your email preferences.
+`,
+		html: `<p>Hi {{.Name}}, here is what you missed on Tango today:</p>
+<ul>
+{{range .Notifications}}<li>{{.Text}}</li>
+{{end}}</ul>
+{{if .More}}<p>and {{.More}} more.</p>
+{{end}}<p><a href="{{.Link}}">See them all</a></p>
+<p>You can turn this digest off in your email preferences.</p>
+`,
+	},
+}
@@ -0,0 +1,162 @@
+package tango
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	SlowPolicyDrop       = "drop"
+	SlowPolicyDisconnect = "disconnect"
+
+	// shedWindow is how long a slow receiver under the drop policy skips
+	// lossy messages before it is given another chance.
+	shedWindow = 2 * time.Second
+)
+
+// lossyTypes are messages a lagging client can miss without losing state:
+// the next frame, cursor tick or bandwidth report supersedes them.
+var lossyTypes = map[string]bool{
+	"screen_data": true,
+	"cursor":      true,
+	"reactions":   true,
+	"bandwidth":   true,
+}
+
+type fanoutJob struct {
+	run  func()
+	done *sync.WaitGroup
+}
+
+// fanoutPool spreads deliveries to large sessions across a fixed set of
+// workers so one slow socket does not hold up every recipient behind it.
+// Counters are accessed atomically.
+type fanoutPool struct {
+	jobs        chan fanoutJob
+	workers     int
+	fanouts     int64
+	deliveries  int64
+	slowWrites  int64
+	timeouts    int64
+	shed        int64
+	disconnects int64
+}
+
+var fanout fanoutPool
+
+func startFanout(workers int) {
+	fanout.workers = workers
+	fanout.jobs = make(chan fanoutJob, workers*4)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range fanout.jobs {
+				job.run()
+				job.done.Done()
+			}
+		}()
+	}
+}
+
+// fanOut calls send for every recipient and returns once all of them have
+// finished. Small recipient lists are delivered inline; the pool only pays
+// off once a broadcast is wide enough for write latency to add up.
+func fanOut(recipients []*Client, send func(i int, client *Client)) {
+	if fanout.jobs == nil || len(recipients) < config.Fanout.MinRecipients {
+		for i, client := range recipients {
+			send(i, client)
+		}
+		return
+	}
+
+	atomic.AddInt64(&fanout.fanouts, 1)
+	atomic.AddInt64(&fanout.deliveries, int64(len(recipients)))
+	var wg sync.WaitGroup
+	wg.Add(len(recipients))
+	for i, client := range recipients {
+		i, client := i, client
+		fanout.jobs <- fanoutJob{run: func() { send(i, client) }, done: &wg}
+	}
+	wg.Wait()
+}
+
+// write sends message on the client's connection under its write deadline
+// and applies the slow receiver policy. Callers must hold c.connMu.
+func (c *Client) write(message Message) error {
+	if c.events != nil {
+		// Event streams are written from their own queue, which applies
+		// its own slow receiver policy.
+		return c.events.send(message)
+	}
+	if c.Conn == nil {
+		return nil
+	}
+	if lossyTypes[message.Type] && time.Now().Before(c.shedUntil) {
+		atomic.AddInt64(&fanout.shed, 1)
+		return nil
+	}
+
+	start := time.Now()
+	c.Conn.SetWriteDeadline(start.Add(config.Fanout.WriteTimeout()))
+	err := sendMessage(c.Conn, message)
+	elapsed := time.Since(start)
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		// gorilla poisons the connection after a failed write, so there is
+		// nothing left to salvage; closing it ends the read loop and lets
+		// the client reconnect.
+		atomic.AddInt64(&fanout.timeouts, 1)
+		c.log.Warn("closing connection after write timeout", "timeout", config.Fanout.WriteTimeout())
+		c.Conn.Close()
+		return err
+	}
+
+	if elapsed < config.Fanout.SlowWrite() {
+		c.slowWrites = 0
+		return err
+	}
+	atomic.AddInt64(&fanout.slowWrites, 1)
+	c.slowWrites++
+	if c.slowWrites < config.Fanout.MaxSlowWrites {
+		return err
+	}
+
+	c.slowWrites = 0
+	switch config.Fanout.SlowPolicy {
+	case SlowPolicyDisconnect:
+		atomic.AddInt64(&fanout.disconnects, 1)
+		c.log.Warn("disconnecting slow receiver", "lastWrite", elapsed)
+		closing := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow receiver")
+		c.Conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(time.Second))
+		c.Conn.Close()
+	default:
+		c.log.Info("shedding lossy messages for slow receiver", "lastWrite", elapsed, "window", shedWindow)
+		c.shedUntil = time.Now().Add(shedWindow)
+	}
+	return err
+}
+
+func getFanoutStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"workers":        fanout.workers,
+		"minRecipients":  config.Fanout.MinRecipients,
+		"writeTimeoutMs": config.Fanout.WriteTimeoutMs,
+		"slowWriteMs":    config.Fanout.SlowWriteMs,
+		"maxSlowWrites":  config.Fanout.MaxSlowWrites,
+		"slowPolicy":     config.Fanout.SlowPolicy,
+		"queued":         len(fanout.jobs),
+		"fanouts":        atomic.LoadInt64(&fanout.fanouts),
+		"deliveries":     atomic.LoadInt64(&fanout.deliveries),
+		"slowWrites":     atomic.LoadInt64(&fanout.slowWrites),
+		"timeouts":       atomic.LoadInt64(&fanout.timeouts),
+		"shed":           atomic.LoadInt64(&fanout.shed),
+		"disconnects":    atomic.LoadInt64(&fanout.disconnects),
+	})
+}
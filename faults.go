@@ -0,0 +1,191 @@
+package tango
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxDelayedMessages caps a client's queue of delayed messages. Past it,
+// messages are dropped as on a congested network, so long delays on a busy
+// session can't grow the queue without limit.
+const maxDelayedMessages = 1000
+
+// FaultProfile degrades outbound delivery to a single client so QA can
+// exercise client behaviour on poor networks. Profiles can only be set when
+// the instance is configured with faultInjection enabled, outside
+// production, and only on clients of the workspaces listed in
+// faultInjectionWorkspaces.
+type FaultProfile struct {
+	DelayMs  int     `json:"delayMs"`
+	JitterMs int     `json:"jitterMs"`
+	DropRate float64 `json:"dropRate"`
+}
+
+func (f *FaultProfile) drop() bool {
+	return f.DropRate > 0 && rand.Float64() < f.DropRate
+}
+
+func (f *FaultProfile) delay() time.Duration {
+	d := time.Duration(f.DelayMs) * time.Millisecond
+	if f.JitterMs > 0 {
+		d += time.Duration(rand.Intn(2*f.JitterMs+1)-f.JitterMs) * time.Millisecond
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// delayedMessage is a message a fault profile holds back until due.
+type delayedMessage struct {
+	message Message
+	due     time.Time
+}
+
+// deliver sends message to client, applying its fault profile if any.
+// Delayed messages wait in the client's queue, so they still arrive in
+// order, as they would over a slow network.
+func deliver(client *Client, message Message) error {
+	client.connMu.Lock()
+	defer client.connMu.Unlock()
+
+	faults := client.faults
+	if faults != nil && faults.drop() {
+		return nil
+	}
+	var d time.Duration
+	if faults != nil {
+		d = faults.delay()
+	}
+	if d == 0 && len(client.delayed) == 0 {
+		return client.write(message)
+	}
+	client.hold(message, d)
+	return nil
+}
+
+// hold queues message to be written after d, but not before the messages
+// queued ahead of it. Callers must hold c.connMu.
+func (c *Client) hold(message Message, d time.Duration) {
+	if len(c.delayed) >= maxDelayedMessages {
+		c.log.Debug("fault queue full, dropping message", "type", message.Type)
+		return
+	}
+	due := time.Now().Add(d)
+	if n := len(c.delayed); n > 0 && due.Before(c.delayed[n-1].due) {
+		due = c.delayed[n-1].due
+	}
+	c.delayed = append(c.delayed, delayedMessage{message: message, due: due})
+	if !c.draining {
+		c.draining = true
+		go c.drainDelayed()
+	}
+}
+
+// drainDelayed writes the client's held messages as they fall due, until
+// none are left.
+func (c *Client) drainDelayed() {
+	for {
+		store.mu.RLock()
+		_, connected := store.Clients[c.ID]
+		store.mu.RUnlock()
+
+		c.connMu.Lock()
+		if len(c.delayed) == 0 {
+			c.draining = false
+			c.connMu.Unlock()
+			return
+		}
+		next := c.delayed[0]
+		if wait := time.Until(next.due); wait > 0 {
+			c.connMu.Unlock()
+			time.Sleep(wait)
+			continue
+		}
+		c.delayed[0] = delayedMessage{}
+		c.delayed = c.delayed[1:]
+		if connected {
+			c.write(next.message)
+		}
+		c.connMu.Unlock()
+	}
+}
+
+// faultsAllowed reports whether fault profiles may be set on clients of
+// workspaceID.
+func (c *Config) faultsAllowed(workspaceID string) bool {
+	if !c.FaultInjection || c.Environment == EnvProduction || workspaceID == "" {
+		return false
+	}
+	for _, id := range c.FaultWorkspaces {
+		if id == workspaceID {
+			return true
+		}
+	}
+	return false
+}
+
+func setClientFaults(c *gin.Context) {
+	if !config.FaultInjection || config.Environment == EnvProduction {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Fault injection is disabled on this instance"})
+		return
+	}
+
+	var req FaultProfile
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.DelayMs < 0 || req.JitterMs < 0 || req.DelayMs > 30000 || req.JitterMs > 30000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "delayMs and jitterMs must be between 0 and 30000"})
+		return
+	}
+	if req.DropRate < 0 || req.DropRate > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "dropRate must be between 0 and 1"})
+		return
+	}
+
+	store.mu.RLock()
+	client, exists := store.Clients[c.Param("id")]
+	var workspaceID string
+	if exists {
+		if session, ok := store.Sessions[client.SessionID]; ok {
+			workspaceID = session.WorkspaceID
+		}
+	}
+	store.mu.RUnlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+	if !config.faultsAllowed(workspaceID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Fault injection is not enabled for this client's workspace"})
+		return
+	}
+
+	client.connMu.Lock()
+	client.faults = &req
+	client.connMu.Unlock()
+	client.log.Warn("fault injection enabled", "delayMs", req.DelayMs, "jitterMs", req.JitterMs, "dropRate", req.DropRate)
+	auditRequest(c, "faults.set", "client", client.ID, gin.H{"delayMs": req.DelayMs, "jitterMs": req.JitterMs, "dropRate": req.DropRate})
+	c.JSON(http.StatusOK, req)
+}
+
+func clearClientFaults(c *gin.Context) {
+	store.mu.RLock()
+	client, exists := store.Clients[c.Param("id")]
+	store.mu.RUnlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+
+	client.connMu.Lock()
+	client.faults = nil
+	client.connMu.Unlock()
+	auditRequest(c, "faults.clear", "client", client.ID, nil)
+	c.Status(http.StatusNoContent)
+}
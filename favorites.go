@@ -0,0 +1,235 @@
+package tango
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	FavoriteSession = "session"
+	FavoriteGuide   = "guide"
+
+	maxRecentItems = 50
+)
+
+type itemRef struct {
+	Type string
+	ID   string
+}
+
+// FavoriteItem is an item a user starred or viewed, and when.
+type FavoriteItem struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	At   int64  `json:"at"`
+}
+
+// Favorites holds what each signed-in user has starred and the items they
+// viewed most recently, newest first, for the home screen.
+type Favorites struct {
+	starred map[string]map[itemRef]int64
+	recent  map[string][]FavoriteItem
+	mu      sync.Mutex
+}
+
+var favorites = &Favorites{
+	starred: make(map[string]map[itemRef]int64),
+	recent:  make(map[string][]FavoriteItem),
+}
+
+func (f *Favorites) star(userID string, ref itemRef) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.starred[userID] == nil {
+		f.starred[userID] = make(map[itemRef]int64)
+	}
+	if at, exists := f.starred[userID][ref]; exists {
+		return at
+	}
+	at := getCurrentTimestamp()
+	f.starred[userID][ref] = at
+	return at
+}
+
+func (f *Favorites) unstar(userID string, ref itemRef) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.starred[userID], ref)
+	if len(f.starred[userID]) == 0 {
+		delete(f.starred, userID)
+	}
+}
+
+// viewed moves ref to the front of the user's recent items.
+func (f *Favorites) viewed(userID string, ref itemRef) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	recent := []FavoriteItem{{Type: ref.Type, ID: ref.ID, At: getCurrentTimestamp()}}
+	for _, item := range f.recent[userID] {
+		if item.Type != ref.Type || item.ID != ref.ID {
+			recent = append(recent, item)
+		}
+	}
+	if len(recent) > maxRecentItems {
+		recent = recent[:maxRecentItems]
+	}
+	f.recent[userID] = recent
+}
+
+func (f *Favorites) starredBy(userID string) []FavoriteItem {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	items := make([]FavoriteItem, 0, len(f.starred[userID]))
+	for ref, at := range f.starred[userID] {
+		items = append(items, FavoriteItem{Type: ref.Type, ID: ref.ID, At: at})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].At != items[j].At {
+			return items[i].At > items[j].At
+		}
+		return items[i].ID < items[j].ID
+	})
+	return items
+}
+
+func (f *Favorites) recentFor(userID string) []FavoriteItem {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FavoriteItem{}, f.recent[userID]...)
+}
+
+// forgetItem drops an item that no longer exists from every user's stars
+// and recent items.
+func (f *Favorites) forgetItem(ref itemRef) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for userID, stars := range f.starred {
+		delete(stars, ref)
+		if len(stars) == 0 {
+			delete(f.starred, userID)
+		}
+	}
+	for userID, recent := range f.recent {
+		for i, item := range recent {
+			if item.Type == ref.Type && item.ID == ref.ID {
+				f.recent[userID] = append(recent[:i:i], recent[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (f *Favorites) forgetUser(userID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.starred, userID)
+	delete(f.recent, userID)
+}
+
+// favoriteItems pairs up to limit items, or all with a negative limit,
+// with the sessions and guides they refer to, leaving out trashed ones and
+// those the caller can no longer see.
+func favoriteItems(c *gin.Context, user *User, items []FavoriteItem, limit int) []gin.H {
+	list := []gin.H{}
+	for _, item := range items {
+		if len(list) == limit {
+			break
+		}
+		if item.Type == FavoriteGuide {
+			guide, exists := guides.get(item.ID)
+			if exists && guide.TrashedAt == 0 && canSeeGuide(c, user, guide) {
+				list = append(list, gin.H{"type": item.Type, "id": item.ID, "at": item.At, "guide": guide})
+			}
+			continue
+		}
+		if item.Type != FavoriteSession {
+			continue
+		}
+		session, exists := sessionFor(c, item.ID)
+		if !exists {
+			continue
+		}
+		session.mu.Lock()
+		trashed := session.Status == SessionTrashed
+		data, err := json.Marshal(session)
+		session.mu.Unlock()
+		if !trashed && err == nil {
+			list = append(list, gin.H{"type": item.Type, "id": item.ID, "at": item.At, "session": json.RawMessage(data)})
+		}
+	}
+	return list
+}
+
+func starSession(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	at := favorites.star(user.ID, itemRef{Type: FavoriteSession, ID: session.ID})
+	c.JSON(http.StatusOK, FavoriteItem{Type: FavoriteSession, ID: session.ID, At: at})
+}
+
+func unstarSession(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	favorites.unstar(user.ID, itemRef{Type: FavoriteSession, ID: c.Param("id")})
+	c.Status(http.StatusNoContent)
+}
+
+func starGuide(c *gin.Context) {
+	user, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	at := favorites.star(user.ID, itemRef{Type: FavoriteGuide, ID: guide.ID})
+	c.JSON(http.StatusOK, FavoriteItem{Type: FavoriteGuide, ID: guide.ID, At: at})
+}
+
+func unstarGuide(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	favorites.unstar(user.ID, itemRef{Type: FavoriteGuide, ID: c.Param("id")})
+	c.Status(http.StatusNoContent)
+}
+
+// getStarred lists the caller's starred items, most recently starred
+// first.
+func getStarred(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": favoriteItems(c, user, favorites.starredBy(user.ID), -1)})
+}
+
+// getRecent lists the items the caller viewed most recently, newest first.
+func getRecent(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	limit := maxRecentItems
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxRecentItems {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxRecentItems)})
+			return
+		}
+		limit = n
+	}
+	c.JSON(http.StatusOK, gin.H{"items": favoriteItems(c, user, favorites.recentFor(user.ID), limit)})
+}
@@ -0,0 +1,253 @@
+package tango
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Quality tiers bound how many screen frames a viewer receives. A viewer
+// asks for a tier with set_quality; the server may serve it a lower one
+// while its connection is backed up.
+const (
+	TierFull    = "full"
+	TierHalf    = "half"
+	TierPreview = "preview"
+
+	previewInterval = time.Second
+	// A write slower than slowWriteThreshold means the client's socket
+	// buffer is full. slowWritesToDowngrade of them step the client down a
+	// tier; fastFramesToUpgrade clean frames in a row step it back up.
+	slowWriteThreshold    = 50 * time.Millisecond
+	slowWritesToDowngrade = 3
+	fastFramesToUpgrade   = 100
+
+	bandwidthInterval = 5 * time.Second
+)
+
+var tierRank = map[string]int{TierPreview: 0, TierHalf: 1, TierFull: 2}
+var tiersByRank = []string{TierPreview, TierHalf, TierFull}
+
+// frameStats tracks screen frame delivery to one client. It is guarded by
+// session.mu.
+type frameStats struct {
+	requested string
+	tier      string
+	seq       int
+	lastSent  time.Time
+	slow      int
+	fast      int
+
+	// needsKey is set once a delta-coded frame was withheld from this
+	// client; it then only receives the next keyframe.
+	needsKey bool
+
+	sent      int
+	dropped   int
+	throttled int
+	bytes     int
+}
+
+func newFrameStats() *frameStats {
+	return &frameStats{requested: TierFull, tier: TierFull}
+}
+
+// admits reports whether the next frame should go to this client at its
+// current tier.
+func (f *frameStats) admits(now time.Time) bool {
+	f.seq++
+	switch f.tier {
+	case TierHalf:
+		return f.seq%2 == 0
+	case TierPreview:
+		return now.Sub(f.lastSent) >= previewInterval
+	}
+	return true
+}
+
+// observeWrite adjusts the tier from how long a delivery took.
+func (f *frameStats) observeWrite(d time.Duration) {
+	if d >= slowWriteThreshold {
+		f.fast = 0
+		f.slow++
+		if f.slow >= slowWritesToDowngrade && tierRank[f.tier] > 0 {
+			f.tier = tiersByRank[tierRank[f.tier]-1]
+			f.slow = 0
+		}
+		return
+	}
+
+	f.slow = 0
+	f.fast++
+	if f.fast >= fastFramesToUpgrade && tierRank[f.tier] < tierRank[f.requested] {
+		f.tier = tiersByRank[tierRank[f.tier]+1]
+		f.fast = 0
+	}
+}
+
+// relayFrame sends a screen frame from sender to the rest of the session,
+// applying the session's frame-rate cap, the keyframe chain, and each
+// viewer's tier.
+func relayFrame(parent *Span, session *Session, sender *Client, data ScreenData) error {
+	payload := gin.H{
+		"clientId": sender.ID,
+		"encoding": data.Encoding,
+		"data":     data.Data,
+	}
+	if data.Frame != FrameFull {
+		payload["frame"] = data.Frame
+		payload["seq"] = data.Seq
+	}
+	message := Message{Type: "screen_data", Payload: payload}
+
+	session.mu.Lock()
+	chain := &session.frames
+	now := time.Now()
+	if data.Frame != FrameKey && session.MaxFPS > 0 && now.Sub(session.lastFrame) < time.Second/time.Duration(session.MaxFPS) {
+		sender.frames.throttled++
+		chain.breakChain(data)
+		requestChainKeyframe(session, sender)
+		session.mu.Unlock()
+		return nil
+	}
+	if err := chain.accept(data, message); err != nil {
+		requestChainKeyframe(session, sender)
+		session.mu.Unlock()
+		return err
+	}
+	session.lastFrame = now
+	message = session.stream.stamp(message, sender.ID).shared()
+	requestChainKeyframe(session, sender)
+
+	recipients := make([]*Client, 0, len(session.Clients))
+	for id, client := range session.Clients {
+		if id == sender.ID {
+			continue
+		}
+		stats := client.frames
+		if data.Frame == FrameDelta && stats.needsKey {
+			stats.dropped++
+			continue
+		}
+		if !stats.admits(now) {
+			stats.dropped++
+			if data.Frame != FrameFull {
+				stats.needsKey = true
+			}
+			continue
+		}
+
+		if data.Frame == FrameKey {
+			stats.needsKey = false
+		}
+		stats.lastSent = now
+		stats.sent++
+		stats.bytes += len(data.Data)
+		recipients = append(recipients, client)
+	}
+	session.countRelayed(len(data.Data) * len(recipients))
+	session.sendMu.Lock()
+	session.mu.Unlock()
+
+	elapsed := make([]time.Duration, len(recipients))
+	fanOut(recipients, func(i int, client *Client) {
+		span := startSpan(parent, "ws.deliver", SpanKindProducer)
+		span.SetAttr("session.id", session.ID)
+		span.SetAttr("client.id", client.ID)
+		start := time.Now()
+		span.SetError(deliver(client, message))
+		elapsed[i] = time.Since(start)
+		span.Finish()
+	})
+	session.sendMu.Unlock()
+
+	session.mu.Lock()
+	for i, client := range recipients {
+		client.frames.observeWrite(elapsed[i])
+	}
+	session.mu.Unlock()
+	return nil
+}
+
+// requestChainKeyframe asks sender for a keyframe when the session's chain
+// can no longer be extended. Callers must hold session.mu.
+func requestChainKeyframe(session *Session, sender *Client) {
+	if session.frames.wantsKeyframe() {
+		requestKeyframe(sender, "chain")
+	}
+}
+
+func handleSetQuality(client *Client, session *Session, msg InboundMessage) {
+	var req struct {
+		Tier string `json:"tier"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		sendError(client, "invalid_payload", "set_quality payload must name a tier")
+		return
+	}
+	if _, known := tierRank[req.Tier]; !known {
+		sendError(client, "invalid_payload", "tier must be full, half or preview")
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	// A client held below its requested tier only climbs back through
+	// observeWrite, but can always ask for less.
+	stats := client.frames
+	downgraded := tierRank[stats.tier] < tierRank[stats.requested]
+	stats.requested = req.Tier
+	if !downgraded || tierRank[req.Tier] < tierRank[stats.tier] {
+		stats.tier = req.Tier
+	}
+	stats.fast = 0
+}
+
+// startBandwidthReports periodically tells each client that sent or was
+// due screen frames how delivery went over the last interval.
+func startBandwidthReports(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			reportBandwidth(interval)
+		}
+	}()
+}
+
+func reportBandwidth(interval time.Duration) {
+	for _, session := range store.sessionList() {
+		session.mu.Lock()
+		reportSessionBandwidth(session, interval)
+		session.mu.Unlock()
+	}
+}
+
+// reportSessionBandwidth sends bandwidth reports to the clients of session.
+// Callers must hold session.mu.
+func reportSessionBandwidth(session *Session, interval time.Duration) {
+	seconds := interval.Seconds()
+	for _, client := range session.Clients {
+		stats := client.frames
+		if stats.sent+stats.dropped+stats.throttled == 0 {
+			continue
+		}
+
+		deliver(client, Message{
+			Type: "bandwidth",
+			Payload: gin.H{
+				"tier":            stats.tier,
+				"requestedTier":   stats.requested,
+				"fps":             float64(stats.sent) / seconds,
+				"framesSent":      stats.sent,
+				"framesDropped":   stats.dropped,
+				"framesThrottled": stats.throttled,
+				"bytesPerSecond":  float64(stats.bytes) / seconds,
+				"intervalMs":      interval.Milliseconds(),
+			},
+		})
+		stats.sent, stats.dropped, stats.throttled, stats.bytes = 0, 0, 0, 0
+	}
+}
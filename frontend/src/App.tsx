@@ -23,9 +23,11 @@ function App() {
   const [sessions, setSessions] = useState<Session[]>([]);
   const [newSessionName, setNewSessionName] = useState('');
   const [activeSession, setActiveSession] = useState<Session | null>(null);
-  const [socket, setSocket] = useState<WebSocket | null>(null);
+  // An EventSource stands in for the WebSocket when the network blocks it.
+  const [socket, setSocket] = useState<WebSocket | EventSource | null>(null);
   const [connected, setConnected] = useState(false);
   const [clientId, setClientId] = useState<string | null>(null);
+  const [clientToken, setClientToken] = useState<string | null>(null);
   const [messages, setMessages] = useState<string[]>([]);
 
   const API_URL = import.meta.env.VITE_API_URL || 'http://localhost:8080';
@@ -42,6 +44,7 @@ function App() {
       setSocket(null);
       setConnected(false);
       setClientId(null);
+      setClientToken(null);
     }
 
     return () => {
@@ -53,7 +56,7 @@ function App() {
 
   const fetchSessions = async () => {
     try {
-      const response = await fetch(`${API_URL}/api/sessions`);
+      const response = await fetch(`${API_URL}/api/v1/sessions`);
       const data = await response.json();
       setSessions(data.sessions || []);
     } catch (error) {
@@ -65,7 +68,7 @@ function App() {
     if (!newSessionName.trim()) return;
 
     try {
-      const response = await fetch(`${API_URL}/api/sessions`, {
+      const response = await fetch(`${API_URL}/api/v1/sessions`, {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
@@ -86,7 +89,7 @@ function App() {
 
   const deleteSession = async (id: string) => {
     try {
-      const response = await fetch(`${API_URL}/api/sessions/${id}`, {
+      const response = await fetch(`${API_URL}/api/v1/sessions/${id}`, {
         method: 'DELETE',
       });
 
@@ -101,40 +104,53 @@ function App() {
     }
   };
 
+  const handleMessage = (message: WebSocketMessage) => {
+    switch (message.type) {
+      case 'session_joined':
+        setClientId(message.payload.clientId);
+        setClientToken(message.payload.resumeToken);
+        break;
+      case 'client_joined':
+        setMessages(prev => [...prev, `${message.payload.name || `Client ${message.payload.clientId}`} joined`]);
+        break;
+      case 'client_left':
+        setMessages(prev => [...prev, `Client ${message.payload.clientId} left`]);
+        break;
+      case 'screen_data':
+        setMessages(prev => [...prev, `Received data from ${message.payload.clientId}`]);
+        break;
+      default:
+        console.log('Unknown message type:', message.type);
+    }
+  };
+
   const connectWebSocket = (sessionId: string) => {
     const protocol = API_URL.startsWith('https://') ? 'wss://' : 'ws://';
     const host = API_URL.replace(/^https?:\/\//, '');
     const ws = new WebSocket(`${protocol}${host}/ws/${sessionId}`);
+    let opened = false;
 
     ws.onopen = () => {
       console.log('WebSocket connected');
+      opened = true;
+      ws.send(JSON.stringify({
+        type: 'join',
+        payload: { name: 'Web viewer', role: 'viewer', features: [] }
+      }));
       setConnected(true);
     };
 
     ws.onmessage = (event) => {
-      const message: WebSocketMessage = JSON.parse(event.data);
-      
-      switch (message.type) {
-        case 'session_joined':
-          setClientId(message.payload.clientId);
-          break;
-        case 'client_joined':
-          setMessages(prev => [...prev, `Client ${message.payload.clientId} joined`]);
-          break;
-        case 'client_left':
-          setMessages(prev => [...prev, `Client ${message.payload.clientId} left`]);
-          break;
-        case 'screen_data':
-          setMessages(prev => [...prev, `Received data from ${message.payload.clientId}`]);
-          break;
-        default:
-          console.log('Unknown message type:', message.type);
-      }
+      handleMessage(JSON.parse(event.data));
     };
 
     ws.onclose = () => {
       console.log('WebSocket disconnected');
       setConnected(false);
+      if (!opened) {
+        console.log('WebSocket unavailable, falling back to server-sent events');
+        connectEvents(sessionId);
+      }
     };
 
     ws.onerror = (error) => {
@@ -144,12 +160,43 @@ function App() {
     setSocket(ws);
   };
 
+  const connectEvents = (sessionId: string) => {
+    const query = new URLSearchParams({ name: 'Web viewer', role: 'viewer' });
+    const events = new EventSource(`${API_URL}/api/v1/sessions/${sessionId}/events?${query}`);
+
+    events.onopen = () => {
+      console.log('Event stream connected');
+      setConnected(true);
+    };
+
+    events.onmessage = (event) => {
+      handleMessage(JSON.parse(event.data));
+    };
+
+    events.onerror = () => {
+      // EventSource reconnects on its own unless the server refused it.
+      if (events.readyState === EventSource.CLOSED) {
+        console.log('Event stream closed');
+        setConnected(false);
+      }
+    };
+
+    setSocket(events);
+  };
+
   const sendTestMessage = () => {
-    if (socket && socket.readyState === WebSocket.OPEN) {
-      socket.send(JSON.stringify({ 
-        action: 'test', 
-        timestamp: new Date().toISOString() 
-      }));
+    const message = JSON.stringify({
+      action: 'test',
+      timestamp: new Date().toISOString()
+    });
+    if (socket instanceof WebSocket && socket.readyState === WebSocket.OPEN) {
+      socket.send(message);
+    } else if (socket instanceof EventSource && activeSession && clientId && clientToken) {
+      fetch(`${API_URL}/api/v1/sessions/${activeSession.id}/events?clientId=${clientId}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Client-Token': clientToken },
+        body: message,
+      }).catch(error => console.error('Error sending message:', error));
     }
   };
 
@@ -0,0 +1,1187 @@
+package tango
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// The GraphQL endpoint serves a fixed schema with a small hand-written
+// executor. It supports queries with aliases, arguments and variables;
+// fragments, directives, mutations and introspection are not supported.
+
+const (
+	maxGraphQLQueryBytes = 16 << 10
+	maxGraphQLDepth      = 8
+
+	subprotocolGraphQLWS = "graphql-transport-ws"
+)
+
+// gqlField describes a field of a schema type. Type names a scalar (ID,
+// String, Int, Boolean) or an object type; Args map argument names to
+// their types, with a trailing ! when required. Without Resolve a field
+// reads the same-named property of its parent.
+type gqlField struct {
+	Type    string
+	List    bool
+	Args    map[string]string
+	Resolve func(ctx *gqlContext, parent gqlObject, args map[string]interface{}) (interface{}, error)
+}
+
+// gqlObject is a resolved object: its JSON properties, and the value they
+// came from for fields that need to look further.
+type gqlObject struct {
+	fields map[string]interface{}
+	source interface{}
+}
+
+var gqlScalars = map[string]bool{"ID": true, "String": true, "Int": true, "Boolean": true}
+
+var gqlSchema map[string]map[string]gqlField
+
+func init() {
+	gqlSchema = map[string]map[string]gqlField{
+		"Query": {
+			"sessions": {Type: "Session", List: true, Args: map[string]string{"workspaceId": "ID", "trashed": "Boolean", "first": "Int"}, Resolve: gqlSessions},
+			"session":  {Type: "Session", Args: map[string]string{"id": "ID!"}, Resolve: gqlSession},
+			"me":       {Type: "User", Resolve: gqlMe},
+		},
+		"Subscription": {
+			"clientEvents": {Type: "ClientEvent", Args: map[string]string{"sessionId": "ID!"}},
+		},
+		"Session": {
+			"id":          {Type: "ID"},
+			"name":        {Type: "String"},
+			"status":      {Type: "String"},
+			"workspaceId": {Type: "ID"},
+			"owner":       {Type: "String"},
+			"description": {Type: "String"},
+			"tags":        {Type: "String", List: true},
+			"createdAt":   {Type: "Int"},
+			"endedAt":     {Type: "Int"},
+			"maxClients":  {Type: "Int"},
+			"clientCount": {Type: "Int", Resolve: gqlClientCount},
+			"clients":     {Type: "Client", List: true, Resolve: gqlClients},
+			"stats":       {Type: "SessionStats", Resolve: gqlStats},
+			"guides":      {Type: "Guide", List: true, Resolve: gqlSessionGuides},
+		},
+		"Client": {
+			"id":           {Type: "ID"},
+			"name":         {Type: "String"},
+			"role":         {Type: "String"},
+			"status":       {Type: "String"},
+			"features":     {Type: "String", List: true},
+			"handRaised":   {Type: "Boolean"},
+			"joinedAt":     {Type: "Int"},
+			"lastActiveAt": {Type: "Int"},
+		},
+		"SessionStats": {
+			"startedAt":       {Type: "Int"},
+			"endedAt":         {Type: "Int"},
+			"durationSeconds": {Type: "Int"},
+			"clients":         {Type: "Int"},
+			"peakClients":     {Type: "Int"},
+			"joins":           {Type: "Int"},
+			"uniqueJoiners":   {Type: "Int"},
+			"messages":        {Type: "Int"},
+			"bytesRelayed":    {Type: "Int"},
+		},
+		"Guide": {
+			"id":           {Type: "ID"},
+			"title":        {Type: "String"},
+			"description":  {Type: "String"},
+			"status":       {Type: "String"},
+			"workspaceId":  {Type: "ID"},
+			"sessionId":    {Type: "ID"},
+			"recordingId":  {Type: "ID"},
+			"createdBy":    {Type: "ID"},
+			"createdAt":    {Type: "Int"},
+			"updatedAt":    {Type: "Int"},
+			"tags":         {Type: "String", List: true},
+			"collectionId": {Type: "ID"},
+			"steps":        {Type: "GuideStep", List: true},
+		},
+		"GuideStep": {
+			"id":          {Type: "ID"},
+			"title":       {Type: "String"},
+			"description": {Type: "String"},
+			"pageUrl":     {Type: "String"},
+			"selector":    {Type: "String"},
+			"at":          {Type: "Int"},
+			"text":        {Type: "String"},
+			"image":       {Type: "GuideImage"},
+		},
+		"GuideImage": {
+			"contentType": {Type: "String"},
+			"size":        {Type: "Int"},
+			"width":       {Type: "Int"},
+			"height":      {Type: "Int"},
+		},
+		"User": {
+			"id":         {Type: "ID"},
+			"email":      {Type: "String"},
+			"name":       {Type: "String"},
+			"createdAt":  {Type: "Int"},
+			"workspaces": {Type: "WorkspaceMembership", List: true, Resolve: gqlUserWorkspaces},
+		},
+		"WorkspaceMembership": {
+			"role":      {Type: "String"},
+			"workspace": {Type: "Workspace"},
+		},
+		"Workspace": {
+			"id":        {Type: "ID"},
+			"name":      {Type: "String"},
+			"createdAt": {Type: "Int"},
+			"plan":      {Type: "String"},
+		},
+		"ClientEvent": {
+			"event":     {Type: "String"},
+			"sessionId": {Type: "ID"},
+			"clientId":  {Type: "ID"},
+			"name":      {Type: "String"},
+			"role":      {Type: "String"},
+			"at":        {Type: "Int"},
+		},
+	}
+}
+
+// toGQLObject captures v's JSON properties.
+func toGQLObject(v interface{}, source interface{}) (gqlObject, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return gqlObject{}, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return gqlObject{}, err
+	}
+	return gqlObject{fields: fields, source: source}, nil
+}
+
+// sessionObject snapshots session for the executor.
+func sessionObject(session *Session) (gqlObject, error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return toGQLObject(session, session)
+}
+
+func gqlSessions(ctx *gqlContext, _ gqlObject, args map[string]interface{}) (interface{}, error) {
+	visible := listingScope(ctx.c)
+	only, _ := args["workspaceId"].(string)
+	trashed, _ := args["trashed"].(bool)
+
+	var sessions []*Session
+	for _, session := range store.sessionList() {
+		session.mu.Lock()
+		if visible(session.WorkspaceID) && (only == "" || session.WorkspaceID == only) && (session.Status == SessionTrashed) == trashed {
+			sessions = append(sessions, session)
+		}
+		session.mu.Unlock()
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].CreatedAt != sessions[j].CreatedAt {
+			return sessions[i].CreatedAt < sessions[j].CreatedAt
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	if first, ok := args["first"].(int); ok {
+		if first < 0 || first > maxPageSize {
+			return nil, fmt.Errorf("first must be between 0 and %d", maxPageSize)
+		}
+		if first < len(sessions) {
+			sessions = sessions[:first]
+		}
+	}
+
+	list := make([]interface{}, 0, len(sessions))
+	for _, session := range sessions {
+		obj, err := sessionObject(session)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+	return list, nil
+}
+
+func gqlSession(ctx *gqlContext, _ gqlObject, args map[string]interface{}) (interface{}, error) {
+	session, exists := sessionFor(ctx.c, args["id"].(string))
+	if !exists {
+		return nil, nil
+	}
+	return sessionObject(session)
+}
+
+func gqlMe(ctx *gqlContext, _ gqlObject, _ map[string]interface{}) (interface{}, error) {
+	user := currentUser(ctx.c)
+	if user == nil {
+		return nil, nil
+	}
+	users.mu.Lock()
+	profile := *user
+	users.mu.Unlock()
+	return toGQLObject(profile, user)
+}
+
+func gqlUserWorkspaces(_ *gqlContext, parent gqlObject, _ map[string]interface{}) (interface{}, error) {
+	memberships := workspaces.listFor(parent.source.(*User))
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+	list := make([]interface{}, 0, len(memberships))
+	for _, membership := range memberships {
+		obj, err := toGQLObject(membership, nil)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+	return list, nil
+}
+
+func gqlClientCount(_ *gqlContext, parent gqlObject, _ map[string]interface{}) (interface{}, error) {
+	session := parent.source.(*Session)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return len(session.Clients), nil
+}
+
+func gqlClients(_ *gqlContext, parent gqlObject, _ map[string]interface{}) (interface{}, error) {
+	session := parent.source.(*Session)
+	session.mu.Lock()
+	clients := roster(session)
+	session.mu.Unlock()
+
+	list := make([]interface{}, 0, len(clients))
+	for _, client := range clients {
+		obj, err := toGQLObject(client, nil)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+	return list, nil
+}
+
+func gqlStats(_ *gqlContext, parent gqlObject, _ map[string]interface{}) (interface{}, error) {
+	session := parent.source.(*Session)
+	session.mu.Lock()
+	report := session.statsReport()
+	session.mu.Unlock()
+	return toGQLObject(report, nil)
+}
+
+// gqlSessionGuides lists the guides made from a session that the caller
+// may see, newest first. As on the REST API, guides are only shown to
+// signed-in users, and those in the trash are left out.
+func gqlSessionGuides(ctx *gqlContext, parent gqlObject, _ map[string]interface{}) (interface{}, error) {
+	session := parent.source.(*Session)
+	list := []interface{}{}
+	user := currentUser(ctx.c)
+	if user == nil {
+		return list, nil
+	}
+
+	var made []Guide
+	guides.mu.Lock()
+	for _, guide := range guides.Guides {
+		if guide.SessionID == session.ID && guide.TrashedAt == 0 {
+			made = append(made, guide.snapshot())
+		}
+	}
+	guides.mu.Unlock()
+	sort.Slice(made, func(i, j int) bool {
+		if made[i].CreatedAt != made[j].CreatedAt {
+			return made[i].CreatedAt > made[j].CreatedAt
+		}
+		return made[i].ID < made[j].ID
+	})
+
+	for _, guide := range made {
+		if !canSeeGuide(ctx.c, user, guide) {
+			continue
+		}
+		obj, err := toGQLObject(guide, nil)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+	return list, nil
+}
+
+// Documents
+
+type gqlSelection struct {
+	Alias      string
+	Name       string
+	Args       map[string]interface{}
+	Selections []gqlSelection
+}
+
+// gqlVariable is a $reference in an argument value.
+type gqlVariable string
+
+type gqlVariableDef struct {
+	Type    string
+	Default interface{}
+}
+
+type gqlOperation struct {
+	Type       string
+	Name       string
+	Variables  map[string]gqlVariableDef
+	Selections []gqlSelection
+}
+
+type gqlToken struct {
+	kind  byte // 'n'ame, 'i'nt, 'f'loat, 's'tring or the punctuator itself
+	value string
+}
+
+type gqlParser struct {
+	src    string
+	pos    int
+	tok    gqlToken
+	parsed error
+}
+
+func (p *gqlParser) next() {
+	for p.pos < len(p.src) {
+		ch := p.src[p.pos]
+		if ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == ',' || ch == 0xef || ch == 0xbb || ch == 0xbf {
+			p.pos++
+		} else if ch == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else {
+			break
+		}
+	}
+	if p.pos >= len(p.src) {
+		p.tok = gqlToken{kind: 0}
+		return
+	}
+
+	start := p.pos
+	ch := p.src[p.pos]
+	switch {
+	case strings.IndexByte("!$():=@[]{}|&", ch) >= 0:
+		p.pos++
+		p.tok = gqlToken{kind: ch, value: string(ch)}
+	case ch == '.':
+		if strings.HasPrefix(p.src[p.pos:], "...") {
+			p.fail("fragments are not supported")
+		} else {
+			p.fail("unexpected character .")
+		}
+	case ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z':
+		for p.pos < len(p.src) && isGQLNameChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = gqlToken{kind: 'n', value: p.src[start:p.pos]}
+	case ch == '-' || ch >= '0' && ch <= '9':
+		p.pos++
+		kind := byte('i')
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			if c == '.' || c == 'e' || c == 'E' || (c == '-' || c == '+') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E') {
+				kind = 'f'
+			} else if c < '0' || c > '9' {
+				break
+			}
+			p.pos++
+		}
+		p.tok = gqlToken{kind: kind, value: p.src[start:p.pos]}
+	case ch == '"':
+		if strings.HasPrefix(p.src[p.pos:], `"""`) {
+			p.fail("block strings are not supported")
+			return
+		}
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != '"' && p.src[p.pos] != '\n' {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.src) || p.src[p.pos] != '"' {
+			p.fail("unterminated string")
+			return
+		}
+		p.pos++
+		var s string
+		if err := json.Unmarshal([]byte(p.src[start:p.pos]), &s); err != nil {
+			p.fail("invalid string " + p.src[start:p.pos])
+			return
+		}
+		p.tok = gqlToken{kind: 's', value: s}
+	default:
+		p.fail(fmt.Sprintf("unexpected character %q", ch))
+	}
+}
+
+func isGQLNameChar(ch byte) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9'
+}
+
+func (p *gqlParser) fail(message string) {
+	if p.parsed == nil {
+		p.parsed = fmt.Errorf("syntax error at offset %d: %s", p.pos, message)
+	}
+	p.tok = gqlToken{kind: 0}
+	p.pos = len(p.src)
+}
+
+func (p *gqlParser) expect(kind byte) string {
+	if p.tok.kind != kind {
+		want := string(kind)
+		if kind == 'n' {
+			want = "a name"
+		}
+		p.fail("expected " + want)
+		return ""
+	}
+	value := p.tok.value
+	p.next()
+	return value
+}
+
+// parseGraphQL parses a document into its operations.
+func parseGraphQL(src string) ([]gqlOperation, error) {
+	p := &gqlParser{src: src}
+	p.next()
+	var operations []gqlOperation
+	for p.tok.kind != 0 {
+		op := gqlOperation{Type: "query", Variables: map[string]gqlVariableDef{}}
+		if p.tok.kind == 'n' {
+			switch p.tok.value {
+			case "query", "mutation", "subscription":
+				op.Type = p.tok.value
+			case "fragment":
+				p.fail("fragments are not supported")
+			default:
+				p.fail("unexpected " + p.tok.value)
+			}
+			p.next()
+			if p.tok.kind == 'n' {
+				op.Name = p.expect('n')
+			}
+			if p.tok.kind == '(' {
+				p.next()
+				for p.tok.kind == '$' && p.parsed == nil {
+					p.next()
+					name := p.expect('n')
+					p.expect(':')
+					def := gqlVariableDef{Type: p.parseType()}
+					if p.tok.kind == '=' {
+						p.next()
+						def.Default = p.parseValue(true)
+					}
+					op.Variables[name] = def
+				}
+				p.expect(')')
+			}
+		}
+		op.Selections = p.parseSelections(0)
+		if p.parsed != nil {
+			return nil, p.parsed
+		}
+		operations = append(operations, op)
+	}
+	if p.parsed != nil {
+		return nil, p.parsed
+	}
+	if len(operations) == 0 {
+		return nil, errors.New("the document contains no operation")
+	}
+	return operations, nil
+}
+
+func (p *gqlParser) parseType() string {
+	var t string
+	if p.tok.kind == '[' {
+		p.next()
+		t = "[" + p.parseType() + "]"
+		p.expect(']')
+	} else {
+		t = p.expect('n')
+	}
+	if p.tok.kind == '!' {
+		p.next()
+		t += "!"
+	}
+	return t
+}
+
+func (p *gqlParser) parseSelections(depth int) []gqlSelection {
+	if depth > maxGraphQLDepth {
+		p.fail("the query is nested too deeply")
+		return nil
+	}
+	p.expect('{')
+	var selections []gqlSelection
+	for p.tok.kind != '}' && p.parsed == nil {
+		if p.tok.kind == '@' {
+			p.fail("directives are not supported")
+			return nil
+		}
+		sel := gqlSelection{Name: p.expect('n')}
+		if p.tok.kind == ':' {
+			p.next()
+			sel.Alias, sel.Name = sel.Name, p.expect('n')
+		}
+		if p.tok.kind == '(' {
+			p.next()
+			sel.Args = map[string]interface{}{}
+			for p.tok.kind != ')' && p.parsed == nil {
+				name := p.expect('n')
+				p.expect(':')
+				sel.Args[name] = p.parseValue(false)
+			}
+			p.expect(')')
+		}
+		if p.tok.kind == '@' {
+			p.fail("directives are not supported")
+			return nil
+		}
+		if p.tok.kind == '{' {
+			sel.Selections = p.parseSelections(depth + 1)
+		}
+		selections = append(selections, sel)
+	}
+	p.expect('}')
+	if len(selections) == 0 {
+		p.fail("selection sets must not be empty")
+	}
+	return selections
+}
+
+func (p *gqlParser) parseValue(constant bool) interface{} {
+	tok := p.tok
+	switch tok.kind {
+	case '$':
+		if constant {
+			p.fail("variables are not allowed here")
+			return nil
+		}
+		p.next()
+		return gqlVariable(p.expect('n'))
+	case 'i':
+		p.next()
+		n, err := strconv.Atoi(tok.value)
+		if err != nil {
+			p.fail("invalid integer " + tok.value)
+		}
+		return n
+	case 'f':
+		p.next()
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			p.fail("invalid number " + tok.value)
+		}
+		return f
+	case 's':
+		p.next()
+		return tok.value
+	case 'n':
+		p.next()
+		switch tok.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return tok.value
+	case '[':
+		p.next()
+		list := []interface{}{}
+		for p.tok.kind != ']' && p.parsed == nil {
+			list = append(list, p.parseValue(constant))
+		}
+		p.expect(']')
+		return list
+	case '{':
+		p.next()
+		obj := map[string]interface{}{}
+		for p.tok.kind != '}' && p.parsed == nil {
+			name := p.expect('n')
+			p.expect(':')
+			obj[name] = p.parseValue(constant)
+		}
+		p.expect('}')
+		return obj
+	}
+	p.fail("expected a value")
+	return nil
+}
+
+// Execution
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlResult is a response object whose properties keep the order they
+// were selected in.
+type gqlResult struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (r *gqlResult) set(key string, value interface{}) {
+	if _, exists := r.values[key]; !exists {
+		r.keys = append(r.keys, key)
+	}
+	r.values[key] = value
+}
+
+func (r *gqlResult) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		value, err := json.Marshal(r.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type gqlContext struct {
+	c      *gin.Context
+	vars   map[string]interface{}
+	errors []gqlError
+}
+
+// selectOperation picks the operation to run and applies its variables.
+func selectOperation(operations []gqlOperation, name string, variables map[string]interface{}) (gqlOperation, map[string]interface{}, error) {
+	var op *gqlOperation
+	for i := range operations {
+		if name == "" && len(operations) == 1 || operations[i].Name == name {
+			op = &operations[i]
+		}
+	}
+	if op == nil {
+		if name == "" {
+			return gqlOperation{}, nil, errors.New("operationName is required for documents with several operations")
+		}
+		return gqlOperation{}, nil, fmt.Errorf("unknown operation %q", name)
+	}
+	if op.Type == "mutation" {
+		return gqlOperation{}, nil, errors.New("mutations are not supported; use the REST API")
+	}
+
+	vars := map[string]interface{}{}
+	for varName, def := range op.Variables {
+		value, given := variables[varName]
+		if !given || value == nil {
+			value = def.Default
+		}
+		if value == nil && strings.HasSuffix(def.Type, "!") {
+			return gqlOperation{}, nil, fmt.Errorf("variable $%s is required", varName)
+		}
+		coerced, err := coerceGQLInput(strings.TrimSuffix(def.Type, "!"), value)
+		if err != nil {
+			return gqlOperation{}, nil, fmt.Errorf("variable $%s: %v", varName, err)
+		}
+		vars[varName] = coerced
+	}
+	return *op, vars, validateSelections(rootType(op.Type), op.Selections, op.Variables)
+}
+
+func rootType(operationType string) string {
+	if operationType == "subscription" {
+		return "Subscription"
+	}
+	return "Query"
+}
+
+func validateSelections(typeName string, selections []gqlSelection, vars map[string]gqlVariableDef) error {
+	for _, sel := range selections {
+		if sel.Name == "__typename" {
+			continue
+		}
+		field, exists := gqlSchema[typeName][sel.Name]
+		if !exists {
+			return fmt.Errorf("%s has no field %q", typeName, sel.Name)
+		}
+		for name, value := range sel.Args {
+			if _, known := field.Args[name]; !known {
+				return fmt.Errorf("%s.%s has no argument %q", typeName, sel.Name, name)
+			}
+			if ref, isVar := value.(gqlVariable); isVar {
+				if _, declared := vars[string(ref)]; !declared {
+					return fmt.Errorf("variable $%s is not declared", ref)
+				}
+			}
+		}
+		for name, argType := range field.Args {
+			if _, given := sel.Args[name]; strings.HasSuffix(argType, "!") && !given {
+				return fmt.Errorf("%s.%s needs argument %q", typeName, sel.Name, name)
+			}
+		}
+		scalar := gqlScalars[field.Type]
+		if scalar && sel.Selections != nil {
+			return fmt.Errorf("%s.%s is a %s and takes no selection", typeName, sel.Name, field.Type)
+		}
+		if !scalar {
+			if sel.Selections == nil {
+				return fmt.Errorf("%s.%s needs a selection of %s fields", typeName, sel.Name, field.Type)
+			}
+			if err := validateSelections(field.Type, sel.Selections, vars); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func coerceGQLInput(typeName string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch typeName {
+	case "ID", "String":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		if n, ok := value.(int); ok && typeName == "ID" {
+			return strconv.Itoa(n), nil
+		}
+	case "Int":
+		switch n := value.(type) {
+		case int:
+			return n, nil
+		case float64:
+			if n == float64(int(n)) {
+				return int(n), nil
+			}
+		}
+	case "Boolean":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %s", typeName)
+	}
+	return nil, fmt.Errorf("expected %s", typeName)
+}
+
+func (ctx *gqlContext) args(field gqlField, sel gqlSelection) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	for name, argType := range field.Args {
+		value, given := sel.Args[name]
+		if ref, isVar := value.(gqlVariable); isVar {
+			value, given = ctx.vars[string(ref)], true
+		}
+		coerced, err := coerceGQLInput(strings.TrimSuffix(argType, "!"), value)
+		if err != nil {
+			return nil, fmt.Errorf("argument %q: %v", name, err)
+		}
+		if coerced == nil && strings.HasSuffix(argType, "!") {
+			return nil, fmt.Errorf("argument %q must not be null", name)
+		}
+		if given && coerced != nil {
+			args[name] = coerced
+		}
+	}
+	return args, nil
+}
+
+// resolveObject runs selections against parent, an object of typeName.
+func (ctx *gqlContext) resolveObject(typeName string, parent gqlObject, selections []gqlSelection, path []interface{}) *gqlResult {
+	result := &gqlResult{values: map[string]interface{}{}}
+	for _, sel := range selections {
+		key := sel.Name
+		if sel.Alias != "" {
+			key = sel.Alias
+		}
+		if sel.Name == "__typename" {
+			result.set(key, typeName)
+			continue
+		}
+		fieldPath := append(append([]interface{}(nil), path...), key)
+		field := gqlSchema[typeName][sel.Name]
+
+		var value interface{}
+		var err error
+		if field.Resolve != nil {
+			var args map[string]interface{}
+			if args, err = ctx.args(field, sel); err == nil {
+				value, err = field.Resolve(ctx, parent, args)
+			}
+		} else {
+			value = parent.fields[sel.Name]
+		}
+		if err != nil {
+			ctx.errors = append(ctx.errors, gqlError{Message: err.Error(), Path: fieldPath})
+			result.set(key, nil)
+			continue
+		}
+		result.set(key, ctx.complete(field, sel, value, fieldPath))
+	}
+	return result
+}
+
+// complete shapes a resolved value to the field's type.
+func (ctx *gqlContext) complete(field gqlField, sel gqlSelection, value interface{}, path []interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if field.List {
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			single := field
+			single.List = false
+			list[i] = ctx.complete(single, sel, item, append(append([]interface{}(nil), path...), i))
+		}
+		return list
+	}
+
+	switch field.Type {
+	case "Int":
+		if n, ok := value.(float64); ok {
+			return int64(n)
+		}
+		return value
+	case "ID", "String", "Boolean":
+		return value
+	}
+
+	obj, ok := value.(gqlObject)
+	if !ok {
+		fields, isMap := value.(map[string]interface{})
+		if !isMap {
+			return nil
+		}
+		obj = gqlObject{fields: fields}
+	}
+	return ctx.resolveObject(field.Type, obj, sel.Selections, path)
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// prepareGraphQL parses and validates a request.
+func prepareGraphQL(req graphqlRequest) (gqlOperation, map[string]interface{}, error) {
+	if len(req.Query) > maxGraphQLQueryBytes {
+		return gqlOperation{}, nil, fmt.Errorf("queries are limited to %d bytes", maxGraphQLQueryBytes)
+	}
+	operations, err := parseGraphQL(req.Query)
+	if err != nil {
+		return gqlOperation{}, nil, err
+	}
+	return selectOperation(operations, req.OperationName, req.Variables)
+}
+
+func executeQuery(c *gin.Context, op gqlOperation, vars map[string]interface{}) gin.H {
+	ctx := &gqlContext{c: c, vars: vars}
+	data := ctx.resolveObject("Query", gqlObject{}, op.Selections, nil)
+	resp := gin.H{"data": data}
+	if len(ctx.errors) > 0 {
+		resp["errors"] = ctx.errors
+	}
+	return resp
+}
+
+// graphqlQuery serves queries: POST with a JSON body, or GET with query,
+// operationName and variables parameters. A GET that upgrades to a
+// WebSocket carries subscriptions instead.
+func graphqlQuery(c *gin.Context) {
+	if c.Request.Method == http.MethodGet && websocket.IsWebSocketUpgrade(c.Request) {
+		graphqlSubscriptions(c)
+		return
+	}
+
+	var req graphqlRequest
+	if c.Request.Method == http.MethodPost {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"errors": []gqlError{{Message: err.Error()}}})
+			return
+		}
+	} else {
+		req.Query = c.Query("query")
+		req.OperationName = c.Query("operationName")
+		if raw := c.Query("variables"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &req.Variables); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"errors": []gqlError{{Message: "variables must be a JSON object"}}})
+				return
+			}
+		}
+	}
+
+	op, vars, err := prepareGraphQL(req)
+	if err == nil && op.Type == "subscription" {
+		err = errors.New("subscriptions need a WebSocket connection to " + apiPrefix + "/graphql")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": []gqlError{{Message: err.Error()}}})
+		return
+	}
+	c.JSON(http.StatusOK, executeQuery(c, op, vars))
+}
+
+// Subscriptions use the graphql-transport-ws protocol.
+
+var graphqlUpgrader = websocket.Upgrader{
+	CheckOrigin:  upgrader.CheckOrigin,
+	Subprotocols: []string{subprotocolGraphQLWS},
+}
+
+type gqlWSMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type gqlConnection struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	subs    map[string]func()
+	mu      sync.Mutex
+}
+
+func (gc *gqlConnection) send(msgType, id string, payload interface{}) error {
+	msg := gin.H{"type": msgType}
+	if id != "" {
+		msg["id"] = id
+	}
+	if payload != nil {
+		msg["payload"] = payload
+	}
+	gc.writeMu.Lock()
+	defer gc.writeMu.Unlock()
+	gc.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return gc.conn.WriteJSON(msg)
+}
+
+func (gc *gqlConnection) closeWith(code int, reason string) {
+	gc.writeMu.Lock()
+	gc.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	gc.writeMu.Unlock()
+	gc.conn.Close()
+}
+
+func graphqlSubscriptions(c *gin.Context) {
+	conn, err := graphqlUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		requestLog(c).Warn("graphql websocket upgrade failed", "error", err)
+		return
+	}
+	gc := &gqlConnection{conn: conn, subs: map[string]func(){}}
+	defer func() {
+		gc.mu.Lock()
+		for _, stop := range gc.subs {
+			stop()
+		}
+		gc.mu.Unlock()
+		conn.Close()
+	}()
+
+	conn.SetReadLimit(maxGraphQLQueryBytes * 2)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	acknowledged := false
+	for {
+		var msg gqlWSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case "connection_init":
+			if acknowledged {
+				gc.closeWith(4429, "Too many initialisation requests")
+				return
+			}
+			var init struct {
+				Authorization string `json:"authorization"`
+			}
+			json.Unmarshal(msg.Payload, &init)
+			if token := strings.TrimPrefix(init.Authorization, "Bearer "); token != "" {
+				user, method := users.byToken(token)
+				if user == nil {
+					gc.closeWith(4403, "Forbidden")
+					return
+				}
+				c.Set("user", user)
+				c.Set("authMethod", method)
+			}
+			acknowledged = true
+			conn.SetReadDeadline(time.Time{})
+			gc.send("connection_ack", "", nil)
+		case "ping":
+			gc.send("pong", "", nil)
+		case "pong":
+		case "subscribe":
+			if !acknowledged {
+				gc.closeWith(4401, "Unauthorized")
+				return
+			}
+			var req graphqlRequest
+			if err := json.Unmarshal(msg.Payload, &req); err != nil || msg.ID == "" {
+				gc.closeWith(4400, "Invalid subscribe message")
+				return
+			}
+			gc.mu.Lock()
+			_, taken := gc.subs[msg.ID]
+			gc.mu.Unlock()
+			if taken {
+				gc.closeWith(4409, "Subscriber for "+msg.ID+" already exists")
+				return
+			}
+			gc.subscribe(c, msg.ID, req)
+		case "complete":
+			gc.mu.Lock()
+			if stop, exists := gc.subs[msg.ID]; exists {
+				stop()
+				delete(gc.subs, msg.ID)
+			}
+			gc.mu.Unlock()
+		default:
+			gc.closeWith(4400, "Unknown message type "+msg.Type)
+			return
+		}
+	}
+}
+
+func (gc *gqlConnection) subscribe(c *gin.Context, id string, req graphqlRequest) {
+	op, vars, err := prepareGraphQL(req)
+	if err != nil {
+		gc.send("error", id, []gqlError{{Message: err.Error()}})
+		return
+	}
+	if op.Type != "subscription" {
+		gc.send("next", id, executeQuery(c, op, vars))
+		gc.send("complete", id, nil)
+		return
+	}
+	if len(op.Selections) != 1 {
+		gc.send("error", id, []gqlError{{Message: "subscriptions must select exactly one field"}})
+		return
+	}
+
+	sel := op.Selections[0]
+	ctx := &gqlContext{c: c, vars: vars}
+	args, err := ctx.args(gqlSchema["Subscription"][sel.Name], sel)
+	if err != nil {
+		gc.send("error", id, []gqlError{{Message: err.Error()}})
+		return
+	}
+	sessionID := args["sessionId"].(string)
+	if _, exists := sessionFor(c, sessionID); !exists {
+		gc.send("error", id, []gqlError{{Message: "Session not found"}})
+		return
+	}
+
+	// Events queue up here so the listener never blocks emitEvent; a
+	// subscriber that falls this far behind misses events.
+	queue := make(chan gqlObject, 64)
+	done := make(chan struct{})
+	stopListening := eventFeed.listen(func(event string, payload interface{}) {
+		switch event {
+		case EventClientJoined, EventClientLeft:
+		case EventSessionDeleted, EventSessionExpired:
+			if eventSessionID(payload) == sessionID {
+				select {
+				case queue <- gqlObject{}:
+				default:
+				}
+			}
+			return
+		default:
+			return
+		}
+		p, _ := payload.(gin.H)
+		if p["sessionId"] != sessionID {
+			return
+		}
+		fields := map[string]interface{}{"event": event, "at": float64(getCurrentTimestamp())}
+		for _, key := range []string{"sessionId", "clientId", "name", "role"} {
+			fields[key] = p[key]
+		}
+		select {
+		case queue <- gqlObject{fields: fields}:
+		default:
+		}
+	})
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			stopListening()
+			close(done)
+		})
+	}
+	gc.mu.Lock()
+	gc.subs[id] = stop
+	gc.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case obj := <-queue:
+				if obj.fields == nil {
+					// The session is gone.
+					stop()
+					gc.mu.Lock()
+					delete(gc.subs, id)
+					gc.mu.Unlock()
+					gc.send("complete", id, nil)
+					return
+				}
+				ctx := &gqlContext{c: c, vars: vars}
+				data := &gqlResult{values: map[string]interface{}{}}
+				key := sel.Name
+				if sel.Alias != "" {
+					key = sel.Alias
+				}
+				data.set(key, ctx.resolveObject("ClientEvent", obj, sel.Selections, []interface{}{key}))
+				if gc.send("next", id, gin.H{"data": data}) != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// eventSessionID reads the session an event is about.
+func eventSessionID(payload interface{}) string {
+	switch p := payload.(type) {
+	case *Session:
+		return p.ID
+	case gin.H:
+		id, _ := p["sessionId"].(string)
+		return id
+	}
+	return ""
+}
@@ -0,0 +1,272 @@
+//go:build grpc
+
+package tango
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const grpcAvailable = true
+
+// rawFrame carries a message's protobuf encoding as is. Messages are
+// encoded with the helpers in protowire.go rather than generated code.
+type rawFrame struct {
+	data []byte
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return v.(*rawFrame).data, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	v.(*rawFrame).data = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+type grpcGateway struct {
+	handler http.Handler
+	// wsURL is this server's own WebSocket endpoint, which streams are
+	// bridged to.
+	wsURL  url.URL
+	dialer websocket.Dialer
+}
+
+// startGRPC serves the gRPC API on cfg.GRPCPort. Errors from the listener
+// are sent to errs. The returned function stops the server.
+func startGRPC(handler http.Handler, cfg *Config, tlsConfig *tls.Config, errs chan<- error) (func(), error) {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(cfg.GRPCPort))
+	if err != nil {
+		return nil, err
+	}
+
+	gateway := &grpcGateway{
+		handler: handler,
+		wsURL:   url.URL{Scheme: "ws", Host: "127.0.0.1:" + strconv.Itoa(cfg.Port)},
+		dialer:  websocket.Dialer{Subprotocols: []string{SubprotocolProtobuf}, HandshakeTimeout: 10 * time.Second},
+	}
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(rawCodec{})}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		// The bridge dials this very server over loopback, where the
+		// certificate's names don't match.
+		gateway.wsURL.Scheme = "wss"
+		gateway.dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	server := grpc.NewServer(opts...)
+	server.RegisterService(gateway.serviceDesc(), gateway)
+	server.RegisterService(replicationServiceDesc(), nil)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	logger.Info("grpc server starting", "addr", listener.Addr().String())
+	return server.Stop, nil
+}
+
+func (g *grpcGateway) serviceDesc() *grpc.ServiceDesc {
+	desc := &grpc.ServiceDesc{
+		ServiceName: grpcService,
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Stream",
+			Handler:       g.stream,
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+		Metadata: "proto/tango.proto",
+	}
+	for _, method := range grpcMethods {
+		method := method
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: method.Name,
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var req rawFrame
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				return g.unary(ctx, method, req.data)
+			},
+		})
+	}
+	return desc
+}
+
+// forwardHeader carries the caller's credentials, address and request ID
+// over to the REST and WebSocket handlers.
+func forwardHeader(ctx context.Context) http.Header {
+	header := http.Header{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		header.Set("Authorization", auth[0])
+	}
+	if id := md.Get("x-request-id"); len(id) > 0 {
+		header.Set(requestIDHeader, id[0])
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			header.Set("X-Forwarded-For", host)
+		}
+	}
+	return header
+}
+
+func (g *grpcGateway) unary(ctx context.Context, method grpcMethod, data []byte) (interface{}, error) {
+	call, err := decodeSessionCall(data)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	path := method.Path
+	if strings.Contains(path, "{id}") {
+		if call.ID == "" {
+			return nil, status.Error(codes.InvalidArgument, "id is required")
+		}
+		path = strings.Replace(path, "{id}", url.PathEscape(call.ID), 1)
+	}
+	body := call.Body
+	if body == nil && (method.Method == http.MethodPost || method.Method == http.MethodPatch) {
+		body = map[string]interface{}{}
+	}
+
+	code, respBody, err := restCall(g.handler, method.Method, path, call.Query, body, forwardHeader(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if code >= http.StatusBadRequest {
+		return nil, restError(code, respBody)
+	}
+
+	result := map[string]interface{}{}
+	if len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, &result); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	encoded, err := encodeProtoStruct(result)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &rawFrame{data: encoded}, nil
+}
+
+// restError turns a REST error response into a gRPC status.
+func restError(code int, body []byte) error {
+	var resp struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(body, &resp)
+	if resp.Error == "" {
+		resp.Error = http.StatusText(code)
+	}
+
+	grpcCode := codes.Unknown
+	switch {
+	case resp.Reason == "quota_exceeded" || code == http.StatusTooManyRequests:
+		grpcCode = codes.ResourceExhausted
+	case code == http.StatusBadRequest:
+		grpcCode = codes.InvalidArgument
+	case code == http.StatusUnauthorized:
+		grpcCode = codes.Unauthenticated
+	case code == http.StatusForbidden:
+		grpcCode = codes.PermissionDenied
+	case code == http.StatusNotFound:
+		grpcCode = codes.NotFound
+	case code == http.StatusConflict:
+		grpcCode = codes.FailedPrecondition
+	case code == http.StatusServiceUnavailable:
+		grpcCode = codes.Unavailable
+	case code >= http.StatusInternalServerError:
+		grpcCode = codes.Internal
+	}
+	return status.Error(grpcCode, resp.Error)
+}
+
+// stream bridges a bidirectional stream onto a WebSocket connection to the
+// session named by the session-id metadata. Stream messages are the
+// Envelope of the tango.proto subprotocol, passed through unchanged, so
+// the stream speaks the WebSocket protocol: it opens with a join message
+// and receives every message type the WebSocket does.
+func (g *grpcGateway) stream(_ interface{}, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+	sessionID := md.Get("session-id")
+	if len(sessionID) == 0 || sessionID[0] == "" {
+		return status.Error(codes.InvalidArgument, "session-id metadata is required")
+	}
+
+	target := g.wsURL
+	target.Path = "/ws/" + url.PathEscape(sessionID[0])
+	query := url.Values{}
+	for key, param := range map[string]string{"resume-client-id": "resumeClientId", "resume-token": "resumeToken"} {
+		if value := md.Get(key); len(value) > 0 {
+			query.Set(param, value[0])
+		}
+	}
+	target.RawQuery = query.Encode()
+
+	conn, resp, err := g.dialer.DialContext(ctx, target.String(), forwardHeader(ctx))
+	if err != nil {
+		if resp != nil {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+			return restError(resp.StatusCode, body)
+		}
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer conn.Close()
+
+	go func() {
+		for {
+			var frame rawFrame
+			if err := stream.RecvMsg(&frame); err != nil {
+				// The client is done sending: close the WebSocket the way
+				// a leaving client would.
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+				return
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, frame.data); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			if closed, ok := err.(*websocket.CloseError); ok {
+				return status.Error(codes.Unavailable, closed.Text)
+			}
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		if err := stream.SendMsg(&rawFrame{data: data}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !grpc
+
+package tango
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+const grpcAvailable = false
+
+func startGRPC(handler http.Handler, cfg *Config, tlsConfig *tls.Config, errs chan<- error) (func(), error) {
+	return nil, errGRPCUnavailable
+}
+
+func sendSnapshot(cfg ReplicationConfig, version int64, body []byte) error {
+	return errGRPCUnavailable
+}
@@ -0,0 +1,136 @@
+package tango
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+)
+
+// The gRPC API (proto/tango.proto) is served on its own port by binaries
+// built with -tags grpc. Its unary calls are dispatched through the REST
+// handlers, so both APIs share validation, auth, quotas and auditing, and
+// its stream is bridged onto the WebSocket endpoint using the protobuf
+// envelope of the tango.proto subprotocol.
+
+const grpcService = "tango.v1.Tango"
+
+// grpcMethod maps a unary RPC onto the REST route that implements it.
+// {id} in the path is replaced by the request's session ID.
+type grpcMethod struct {
+	Name   string
+	Method string
+	Path   string
+}
+
+var grpcMethods = []grpcMethod{
+	{"ListSessions", http.MethodGet, apiPrefix + "/sessions"},
+	{"CreateSession", http.MethodPost, apiPrefix + "/sessions"},
+	{"GetSession", http.MethodGet, apiPrefix + "/sessions/{id}"},
+	{"UpdateSession", http.MethodPatch, apiPrefix + "/sessions/{id}"},
+	{"EndSession", http.MethodPost, apiPrefix + "/sessions/{id}/end"},
+	{"DeleteSession", http.MethodDelete, apiPrefix + "/sessions/{id}"},
+}
+
+var errGRPCUnavailable = errors.New("gRPC support is not compiled in; rebuild with -tags grpc")
+
+// restCall runs a REST request through handler in-process and returns the
+// response status and body.
+func restCall(handler http.Handler, method, path string, query url.Values, body map[string]interface{}, header http.Header) (int, []byte, error) {
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.URL.RawQuery = query.Encode()
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.Bytes(), nil
+}
+
+// encodeProtoStruct encodes v as a google.protobuf.Struct message.
+func encodeProtoStruct(v map[string]interface{}) ([]byte, error) {
+	var fields []byte
+	value, err := appendProtoValue(nil, v)
+	if err != nil {
+		return nil, err
+	}
+	// The Value wraps the Struct as its only field; unwrap it.
+	err = walkProto(value, func(field, wire int, data []byte, _ uint64) error {
+		fields = data
+		return nil
+	})
+	return fields, err
+}
+
+// decodeProtoStruct decodes a google.protobuf.Struct message.
+func decodeProtoStruct(data []byte) (map[string]interface{}, error) {
+	value, err := decodeProtoValue(appendProtoBytes(nil, valueStruct, data), 0)
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := value.(map[string]interface{})
+	return fields, nil
+}
+
+// sessionCall is a decoded SessionRequest message.
+type sessionCall struct {
+	ID    string
+	Body  map[string]interface{}
+	Query url.Values
+}
+
+// decodeSessionCall reads a SessionRequest: the session ID as field 1, the
+// request body as a Struct in field 2 and query parameters as
+// map<string, string> field 3.
+func decodeSessionCall(data []byte) (sessionCall, error) {
+	call := sessionCall{Query: url.Values{}}
+	err := walkProto(data, func(field, wire int, value []byte, _ uint64) error {
+		if wire != protoBytes {
+			return nil
+		}
+		switch field {
+		case 1:
+			call.ID = string(value)
+		case 2:
+			body, err := decodeProtoStruct(value)
+			if err != nil {
+				return err
+			}
+			call.Body = body
+		case 3:
+			var key, item string
+			err := walkProto(value, func(field, wire int, data []byte, _ uint64) error {
+				switch field {
+				case 1:
+					key = string(data)
+				case 2:
+					item = string(data)
+				}
+				return nil
+			})
+			call.Query.Set(key, item)
+			return err
+		}
+		return nil
+	})
+	return call, err
+}
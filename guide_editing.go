@@ -0,0 +1,617 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Guides are edited together over a WebSocket at /api/v1/guides/:id/edit,
+// open to whoever can see the guide. Browsers that cannot send an
+// Authorization header pass their API token as ?token=. On connecting, an
+// editor gets an edit_sync with the steps' titles and descriptions, each
+// with its revision, the step order, the held locks and who else is
+// editing, and sends the same frames as session co-editing.
+//
+// A step's title and description are edited with operational transform in
+// the ot.js format: edit_op carries the stepId, the field, the revision the
+// editor last saw and the operation. The server transforms it past what was
+// applied since, applies it, answers with edit_ack and relays the
+// transformed op to the others. edit_order moves a step to just after
+// another (or to the front when after is empty) and everyone gets the
+// resulting order. edit_focus shares an editor's step, field and selection.
+// Where merging is not wanted, edit_lock reserves a step for one editor,
+// so nobody else can edit, move or delete it, until edit_unlock or
+// disconnect.
+//
+// Changes made over the API are sent on to editors as they happen. Edits
+// are kept as one version per stretch of work by the same user.
+
+const (
+	GuideFieldTitle       = "title"
+	GuideFieldDescription = "description"
+
+	// maxStepTitleLen matches the limit on UpdateStepRequest.
+	maxStepTitleLen      = 200
+	maxGuideEditFrame    = 64 << 10
+	guideEditWriteWindow = 10 * time.Second
+)
+
+var (
+	errUnknownStepField = errors.New("field must be title or description")
+	errEmptyStepTitle   = errors.New("title cannot be empty")
+	errLongStepTitle    = errors.New("title must be at most 200 characters")
+)
+
+// GuideEditor is someone editing a guide, with where their cursor is.
+type GuideEditor struct {
+	ClientID  string         `json:"clientId"`
+	Name      string         `json:"name"`
+	StepID    string         `json:"stepId,omitempty"`
+	Field     string         `json:"field,omitempty"`
+	Selection *EditSelection `json:"selection,omitempty"`
+}
+
+type guideEditorConn struct {
+	GuideEditor
+	userID string
+	// moderator may release others' locks: the guide's author and its
+	// workspace's admins.
+	moderator bool
+	conn      *websocket.Conn
+	writeMu   sync.Mutex
+}
+
+func (e *guideEditorConn) send(message Message) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	e.conn.SetWriteDeadline(time.Now().Add(guideEditWriteWindow))
+	if err := e.conn.WriteJSON(message); err != nil {
+		e.conn.Close()
+	}
+}
+
+func (e *guideEditorConn) sendError(code, message string) {
+	e.send(Message{Type: "error", Payload: gin.H{"code": code, "message": message}})
+}
+
+// guideRoom is the co-editing state of one guide. docs and text are keyed
+// by stepTextKey, and text is each field as the editors last saw it, so
+// changes made over the API can be sent on to them.
+type guideRoom struct {
+	guideID string
+	editors map[string]*guideEditorConn
+	docs    map[string]*editDoc
+	text    map[string]string
+	order   []string
+	locks   map[string]string
+	mu      sync.Mutex
+}
+
+// guideRooms holds the guides being edited. Its mu is taken before a
+// room's, and a room's before guides.mu.
+var guideRooms = struct {
+	rooms map[string]*guideRoom
+	mu    sync.Mutex
+}{rooms: make(map[string]*guideRoom)}
+
+func stepTextKey(stepID, field string) string {
+	return stepID + "/" + field
+}
+
+func stepText(step GuideStep, field string) string {
+	if field == GuideFieldTitle {
+		return step.Title
+	}
+	return step.Description
+}
+
+func stepIDs(steps []GuideStep) []string {
+	ids := make([]string, 0, len(steps))
+	for _, step := range steps {
+		ids = append(ids, step.ID)
+	}
+	return ids
+}
+
+func findStep(steps []GuideStep, id string) (GuideStep, bool) {
+	for _, step := range steps {
+		if step.ID == id {
+			return step, true
+		}
+	}
+	return GuideStep{}, false
+}
+
+// guideStepsLocked reports whether a co-editor holds a lock on any of the
+// guide's steps named, or on any step at all when none are named.
+func guideStepsLocked(guideID string, stepIDs ...string) bool {
+	guideRooms.mu.Lock()
+	room := guideRooms.rooms[guideID]
+	guideRooms.mu.Unlock()
+	if room == nil {
+		return false
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if len(stepIDs) == 0 {
+		return len(room.locks) > 0
+	}
+	for _, id := range stepIDs {
+		if _, held := room.locks[id]; held {
+			return true
+		}
+	}
+	return false
+}
+
+// syncGuideEditors brings the editors of a guide up to date after it was
+// changed over the API.
+func syncGuideEditors(guideID string) {
+	guideRooms.mu.Lock()
+	room := guideRooms.rooms[guideID]
+	guideRooms.mu.Unlock()
+	if room == nil {
+		return
+	}
+	guide, exists := guides.get(guideID)
+	if !exists {
+		return
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	room.sync(guide)
+}
+
+// broadcast delivers message to everyone editing the guide but exclude.
+// Callers must hold r.mu.
+func (r *guideRoom) broadcast(message Message, exclude string) {
+	for id, editor := range r.editors {
+		if id != exclude {
+			editor.send(message)
+		}
+	}
+}
+
+func (r *guideRoom) editorList() []GuideEditor {
+	list := make([]GuideEditor, 0, len(r.editors))
+	for _, editor := range r.editors {
+		list = append(list, editor.GuideEditor)
+	}
+	return list
+}
+
+func (r *guideRoom) broadcastPresence(exclude string) {
+	r.broadcast(Message{Type: "edit_presence", Payload: gin.H{"editors": r.editorList()}}, exclude)
+}
+
+// doc returns the operation log of a step's field, starting it at text.
+// Callers must hold r.mu.
+func (r *guideRoom) doc(key, text string) *editDoc {
+	doc, exists := r.docs[key]
+	if !exists {
+		doc = &editDoc{}
+		r.docs[key] = doc
+		r.text[key] = text
+	}
+	return doc
+}
+
+// sync sends the editors what changed in guide since they last saw it: a
+// step field that differs is replaced wholesale, a new order is resent,
+// and the locks and logs of removed steps are dropped. Callers must hold
+// r.mu.
+func (r *guideRoom) sync(guide Guide) {
+	for key, doc := range r.docs {
+		stepID := key[:strings.LastIndexByte(key, '/')]
+		field := key[len(stepID)+1:]
+		step, exists := findStep(guide.Steps, stepID)
+		if !exists {
+			delete(r.docs, key)
+			delete(r.text, key)
+			continue
+		}
+		current := stepText(step, field)
+		if current == r.text[key] {
+			continue
+		}
+		op := replaceOp(r.text[key], current)
+		doc.record(op)
+		r.text[key] = current
+		r.moveSelections(stepID, field, op, "")
+		r.broadcast(Message{
+			Type:    "edit_op",
+			Payload: gin.H{"stepId": stepID, "field": field, "revision": doc.revision, "operation": op},
+		}, "")
+	}
+	order := stepIDs(guide.Steps)
+	if !reflect.DeepEqual(order, r.order) {
+		r.order = order
+		r.broadcast(Message{Type: "edit_order", Payload: gin.H{"order": order}}, "")
+	}
+	for stepID := range r.locks {
+		if _, exists := findStep(guide.Steps, stepID); !exists {
+			delete(r.locks, stepID)
+			r.broadcast(Message{Type: "edit_unlocked", Payload: gin.H{"stepId": stepID}}, "")
+		}
+	}
+}
+
+func (r *guideRoom) moveSelections(stepID, field string, op textOp, exclude string) {
+	for id, editor := range r.editors {
+		if id == exclude || editor.StepID != stepID || editor.Field != field || editor.Selection == nil {
+			continue
+		}
+		editor.Selection = &EditSelection{
+			Anchor: op.transformIndex(editor.Selection.Anchor),
+			Head:   op.transformIndex(editor.Selection.Head),
+		}
+	}
+}
+
+// lockedByOther refuses a change to a step another editor holds a lock
+// on. Callers must hold r.mu.
+func (r *guideRoom) lockedByOther(editor *guideEditorConn, stepID string) bool {
+	if holder, held := r.locks[stepID]; held && holder != editor.ClientID {
+		editor.sendError("step_locked", "The step is locked by another editor")
+		return true
+	}
+	return false
+}
+
+// current looks up the guide and brings the editors up to date with it,
+// telling editor if it is gone. Callers must hold r.mu.
+func (r *guideRoom) current(editor *guideEditorConn) (Guide, bool) {
+	guide, exists := guides.get(r.guideID)
+	if !exists || guide.TrashedAt != 0 {
+		editor.sendError("not_found", errGuideNotFound.Error())
+		return Guide{}, false
+	}
+	r.sync(guide)
+	return guide, true
+}
+
+// editGuide upgrades to the co-editing WebSocket of a guide.
+func editGuide(c *gin.Context) {
+	signInWithToken(c, c.Query("token"))
+	user, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(c.Request) {
+		c.JSON(http.StatusUpgradeRequired, gin.H{"error": "WebSocket upgrade required"})
+		return
+	}
+	conn, err := upgrader.Upgrade(countingWriter{c.Writer}, c.Request, nil)
+	if err != nil {
+		requestLog(c).Warn("guide editing upgrade failed", "guide", guide.ID, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	editor := &guideEditorConn{
+		GuideEditor: GuideEditor{ClientID: generateID(), Name: displayName(user)},
+		userID:      user.ID,
+		moderator:   guide.CreatedBy == user.ID || canModerate(c, guide.WorkspaceID, user),
+		conn:        conn,
+	}
+	room := joinGuideRoom(guide, editor)
+	defer room.leave(editor)
+
+	conn.SetReadLimit(maxGuideEditFrame)
+	for {
+		var msg InboundMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		room.handle(editor, msg)
+	}
+}
+
+// joinGuideRoom adds editor to the guide's room, starting one if nobody is
+// editing it, and sends it the guide as it stands.
+func joinGuideRoom(guide Guide, editor *guideEditorConn) *guideRoom {
+	guideRooms.mu.Lock()
+	room := guideRooms.rooms[guide.ID]
+	if room == nil {
+		room = &guideRoom{
+			guideID: guide.ID,
+			editors: make(map[string]*guideEditorConn),
+			docs:    make(map[string]*editDoc),
+			text:    make(map[string]string),
+			order:   stepIDs(guide.Steps),
+			locks:   make(map[string]string),
+		}
+		guideRooms.rooms[guide.ID] = room
+	}
+	room.mu.Lock()
+	guideRooms.mu.Unlock()
+	defer room.mu.Unlock()
+
+	room.sync(guide)
+	room.editors[editor.ClientID] = editor
+	steps := make([]gin.H, 0, len(guide.Steps))
+	for _, step := range guide.Steps {
+		fields := gin.H{}
+		for _, field := range []string{GuideFieldTitle, GuideFieldDescription} {
+			key := stepTextKey(step.ID, field)
+			doc := room.doc(key, stepText(step, field))
+			fields[field] = gin.H{"text": room.text[key], "revision": doc.revision}
+		}
+		steps = append(steps, gin.H{"id": step.ID, "fields": fields})
+	}
+	editor.send(Message{
+		Type: "edit_sync",
+		Payload: gin.H{
+			"clientId": editor.ClientID,
+			"steps":    steps,
+			"order":    room.order,
+			"locks":    room.locks,
+			"editors":  room.editorList(),
+		},
+	})
+	room.broadcastPresence("")
+	return room
+}
+
+// leave takes editor out of the room, releasing its locks and recording
+// its edits. The room closes with its last editor.
+func (r *guideRoom) leave(editor *guideEditorConn) {
+	guideRooms.mu.Lock()
+	defer guideRooms.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.editors, editor.ClientID)
+	for stepID, holder := range r.locks {
+		if holder == editor.ClientID {
+			delete(r.locks, stepID)
+			r.broadcast(Message{Type: "edit_unlocked", Payload: gin.H{"stepId": stepID}}, "")
+		}
+	}
+	if author, editing := guideHistory.pendingAuthor(r.guideID); editing && (len(r.editors) == 0 || author == editor.userID) {
+		guides.settleEdits(r.guideID)
+	}
+	if len(r.editors) == 0 {
+		delete(guideRooms.rooms, r.guideID)
+		return
+	}
+	r.broadcastPresence("")
+}
+
+func (r *guideRoom) handle(editor *guideEditorConn, msg InboundMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch msg.Type {
+	case "edit_op":
+		r.handleOp(editor, msg.Payload)
+	case "edit_order":
+		r.handleOrder(editor, msg.Payload)
+	case "edit_focus":
+		r.handleFocus(editor, msg.Payload)
+	case "edit_lock":
+		r.handleLock(editor, msg.Payload, true)
+	case "edit_unlock":
+		r.handleLock(editor, msg.Payload, false)
+	default:
+		editor.sendError("unknown_type", "Unknown message type: "+msg.Type)
+	}
+}
+
+func (r *guideRoom) handleOp(editor *guideEditorConn, payload json.RawMessage) {
+	var req struct {
+		StepID    string `json:"stepId"`
+		Field     string `json:"field"`
+		Revision  int    `json:"revision"`
+		Operation textOp `json:"operation"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		editor.sendError("invalid_payload", err.Error())
+		return
+	}
+	if req.Field != GuideFieldTitle && req.Field != GuideFieldDescription {
+		editor.sendError("invalid_payload", errUnknownStepField.Error())
+		return
+	}
+	if r.lockedByOther(editor, req.StepID) {
+		return
+	}
+	guide, ok := r.current(editor)
+	if !ok {
+		return
+	}
+	step, exists := findStep(guide.Steps, req.StepID)
+	if !exists {
+		editor.sendError("invalid_payload", errStepNotFound.Error())
+		return
+	}
+
+	key := stepTextKey(step.ID, req.Field)
+	doc := r.doc(key, stepText(step, req.Field))
+	op, err := doc.rebase(req.Operation, req.Revision)
+	if err != nil {
+		editor.sendError("invalid_payload", err.Error())
+		return
+	}
+	text, err := op.apply(r.text[key])
+	if err != nil {
+		editor.sendError("invalid_payload", err.Error())
+		return
+	}
+	switch {
+	case req.Field == GuideFieldTitle && text == "":
+		err = errEmptyStepTitle
+	case req.Field == GuideFieldTitle && utf8.RuneCountInString(text) > maxStepTitleLen:
+		err = errLongStepTitle
+	case req.Field == GuideFieldDescription && utf8.RuneCountInString(text) > maxDescriptionLen:
+		err = errLongDesc
+	}
+	if err == nil {
+		err = guides.coedit(r.guideID, editor.userID, func(guide *Guide) error {
+			for i := range guide.Steps {
+				if current := &guide.Steps[i]; current.ID == step.ID {
+					if req.Field == GuideFieldTitle {
+						current.Title = text
+					} else {
+						current.Description = text
+					}
+					return nil
+				}
+			}
+			return errStepNotFound
+		})
+	}
+	if err != nil {
+		editor.sendError("invalid_payload", err.Error())
+		return
+	}
+	r.text[key] = text
+	doc.record(op)
+	r.moveSelections(step.ID, req.Field, op, editor.ClientID)
+
+	editor.send(Message{Type: "edit_ack", Payload: gin.H{"stepId": step.ID, "field": req.Field, "revision": doc.revision}})
+	r.broadcast(Message{
+		Type: "edit_op",
+		Payload: gin.H{
+			"stepId":    step.ID,
+			"field":     req.Field,
+			"revision":  doc.revision,
+			"operation": op,
+			"clientId":  editor.ClientID,
+		},
+	}, editor.ClientID)
+}
+
+// handleOrder moves a step to just after another, so moves made at the
+// same time still land next to what their sender saw. An after that is no
+// longer in the guide moves the step to the end.
+func (r *guideRoom) handleOrder(editor *guideEditorConn, payload json.RawMessage) {
+	var req struct {
+		StepID string `json:"stepId"`
+		After  string `json:"after"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil || req.StepID == "" {
+		editor.sendError("invalid_payload", "payload must give a stepId")
+		return
+	}
+	if r.lockedByOther(editor, req.StepID) {
+		return
+	}
+	guide, ok := r.current(editor)
+	if !ok {
+		return
+	}
+	if _, exists := findStep(guide.Steps, req.StepID); !exists {
+		editor.sendError("invalid_payload", errStepNotFound.Error())
+		return
+	}
+
+	order := moveStep(r.order, req.StepID, req.After)
+	err := guides.coedit(r.guideID, editor.userID, func(guide *Guide) error {
+		steps, err := reorderSteps(guide.Steps, order)
+		if err != nil {
+			return err
+		}
+		guide.Steps = steps
+		return nil
+	})
+	if err != nil {
+		editor.sendError("invalid_payload", err.Error())
+		return
+	}
+	r.order = order
+	r.broadcast(Message{Type: "edit_order", Payload: gin.H{"order": order, "clientId": editor.ClientID}}, "")
+}
+
+// moveStep returns a copy of ids with id moved to just after after, to
+// the front when after is empty, or to the end when after is not there.
+func moveStep(ids []string, id, after string) []string {
+	if id == after {
+		return ids
+	}
+	out := make([]string, 0, len(ids))
+	for _, other := range ids {
+		if other != id {
+			out = append(out, other)
+		}
+	}
+	at := len(out)
+	if after == "" {
+		at = 0
+	}
+	for i, other := range out {
+		if other == after {
+			at = i + 1
+			break
+		}
+	}
+	out = append(out, "")
+	copy(out[at+1:], out[at:])
+	out[at] = id
+	return out
+}
+
+func (r *guideRoom) handleFocus(editor *guideEditorConn, payload json.RawMessage) {
+	var req struct {
+		StepID    string         `json:"stepId"`
+		Field     string         `json:"field"`
+		Selection *EditSelection `json:"selection"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		editor.sendError("invalid_payload", err.Error())
+		return
+	}
+	if req.Field != "" && req.Field != GuideFieldTitle && req.Field != GuideFieldDescription {
+		editor.sendError("invalid_payload", errUnknownStepField.Error())
+		return
+	}
+	editor.StepID, editor.Field, editor.Selection = req.StepID, req.Field, req.Selection
+	if req.StepID == "" || req.Field == "" {
+		editor.Field, editor.Selection = "", nil
+	}
+	r.broadcastPresence(editor.ClientID)
+}
+
+func (r *guideRoom) handleLock(editor *guideEditorConn, payload json.RawMessage, lock bool) {
+	var req struct {
+		StepID string `json:"stepId"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil || req.StepID == "" {
+		editor.sendError("invalid_payload", "payload must give a stepId")
+		return
+	}
+	holder, held := r.locks[req.StepID]
+	if lock {
+		if r.lockedByOther(editor, req.StepID) {
+			return
+		}
+		guide, ok := r.current(editor)
+		if !ok {
+			return
+		}
+		if _, exists := findStep(guide.Steps, req.StepID); !exists {
+			editor.sendError("invalid_payload", errStepNotFound.Error())
+			return
+		}
+		r.locks[req.StepID] = editor.ClientID
+		r.broadcast(Message{Type: "edit_locked", Payload: gin.H{"stepId": req.StepID, "clientId": editor.ClientID}}, "")
+		return
+	}
+	if !held {
+		return
+	}
+	if holder != editor.ClientID && !editor.moderator {
+		editor.sendError("forbidden", "Only the editor holding the lock, the guide's author or a workspace admin can release it")
+		return
+	}
+	delete(r.locks, req.StepID)
+	r.broadcast(Message{Type: "edit_unlocked", Payload: gin.H{"stepId": req.StepID, "by": editor.ClientID}}, "")
+}
@@ -0,0 +1,381 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	GuideExportGIF = "gif"
+	GuideExportMP4 = "mp4"
+
+	defaultExportWidth       = 800
+	minExportWidth           = 320
+	defaultExportStepSeconds = 3
+	videoTimeout             = 5 * time.Minute
+)
+
+var (
+	captionBarColor  = color.RGBA{0x1f, 0x29, 0x37, 0xff}
+	captionTextColor = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// GuideExport is a guide rendered as an animated GIF or MP4 video, one
+// frame per step with its title as a caption, built in the background and
+// kept for a day. Progress runs from 0 to 100.
+type GuideExport struct {
+	ID          string `json:"id"`
+	GuideID     string `json:"guideId"`
+	Format      string `json:"format"`
+	Status      string `json:"status"`
+	Progress    int    `json:"progress"`
+	CreatedAt   int64  `json:"createdAt"`
+	CompletedAt int64  `json:"completedAt,omitempty"`
+	ExpiresAt   int64  `json:"expiresAt"`
+	Size        int    `json:"size,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	userID string
+}
+
+func (e *GuideExport) blobKey() string {
+	return "guide-exports/" + e.ID
+}
+
+type GuideExportRegistry struct {
+	exports map[string]*GuideExport
+	mu      sync.Mutex
+}
+
+var guideExports = &GuideExportRegistry{exports: make(map[string]*GuideExport)}
+
+// prune drops expired exports and their files, and with forUser every
+// export of that user.
+func (r *GuideExportRegistry) prune(now int64, forUser string) {
+	var pruned []*GuideExport
+	r.mu.Lock()
+	for id, export := range r.exports {
+		if export.ExpiresAt <= now || export.userID == forUser {
+			delete(r.exports, id)
+			pruned = append(pruned, export)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, export := range pruned {
+		if err := blobs.Delete(context.Background(), export.blobKey()); err != nil {
+			logger.Warn("deleting guide export failed", "export", export.ID, "error", err)
+		}
+	}
+}
+
+func (r *GuideExportRegistry) lookup(c *gin.Context, user *User, guideID string) (GuideExport, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	export, exists := r.exports[c.Param("exportId")]
+	if !exists || export.userID != user.ID || export.GuideID != guideID || export.ExpiresAt <= getCurrentTimestamp() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return GuideExport{}, false
+	}
+	return *export, true
+}
+
+func (r *GuideExportRegistry) progress(export *GuideExport, progress int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	export.Progress = progress
+}
+
+type GuideExportRequest struct {
+	Format      string `json:"format" binding:"required,oneof=gif mp4"`
+	StepSeconds int    `json:"stepSeconds" binding:"min=0,max=10"`
+	Width       int    `json:"width" binding:"min=0,max=1600"`
+}
+
+func requestGuideExport(c *gin.Context) {
+	var req GuideExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	if len(guide.Steps) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "The guide has no steps"})
+		return
+	}
+	if req.Format == GuideExportMP4 {
+		if _, err := exec.LookPath(config.FFmpegCommand); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MP4 export needs ffmpeg on the server"})
+			return
+		}
+	}
+	if req.StepSeconds == 0 {
+		req.StepSeconds = defaultExportStepSeconds
+	}
+	if req.Width == 0 {
+		req.Width = defaultExportWidth
+	}
+	if req.Width < minExportWidth {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("width must be at least %d", minExportWidth)})
+		return
+	}
+
+	now := time.Now()
+	export := &GuideExport{
+		ID:        generateID(),
+		GuideID:   guide.ID,
+		Format:    req.Format,
+		Status:    ExportPending,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(exportTTL).Unix(),
+		userID:    user.ID,
+	}
+	guideExports.mu.Lock()
+	for _, other := range guideExports.exports {
+		if other.userID == user.ID && other.GuideID == guide.ID && other.Status == ExportPending {
+			pending := *other
+			guideExports.mu.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": "An export of this guide is already being made", "export": pending})
+			return
+		}
+	}
+	guideExports.exports[export.ID] = export
+	snapshot := *export
+	guideExports.mu.Unlock()
+
+	go func() {
+		data, err := renderGuide(export, guide, req)
+		if err == nil {
+			err = blobs.Put(context.Background(), export.blobKey(), data)
+		}
+		guideExports.mu.Lock()
+		export.CompletedAt = getCurrentTimestamp()
+		if err != nil {
+			export.Status, export.Error = ExportFailed, "The export could not be made"
+			guideExports.mu.Unlock()
+			logger.Error("exporting guide failed", "guide", guide.ID, "format", req.Format, "error", err)
+			return
+		}
+		export.Status, export.Progress, export.Size = ExportReady, 100, len(data)
+		_, live := guideExports.exports[export.ID]
+		guideExports.mu.Unlock()
+		if !live {
+			blobs.Delete(context.Background(), export.blobKey())
+		}
+	}()
+
+	c.JSON(http.StatusAccepted, snapshot)
+}
+
+func getGuideExport(c *gin.Context) {
+	user, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	if export, ok := guideExports.lookup(c, user, guide.ID); ok {
+		c.JSON(http.StatusOK, export)
+	}
+}
+
+func downloadGuideExport(c *gin.Context) {
+	user, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	export, ok := guideExports.lookup(c, user, guide.ID)
+	if !ok {
+		return
+	}
+	if export.Status != ExportReady {
+		c.JSON(http.StatusConflict, gin.H{"error": "The export is not ready", "export": export})
+		return
+	}
+	observeDownload(c, guide.WorkspaceID)
+	contentType, filename := "image/gif", "guide-"+guide.ID+"."+export.Format
+	if export.Format == GuideExportMP4 {
+		contentType = "video/mp4"
+	}
+	if redirectToBlob(c, export.blobKey(), contentType, filename) {
+		return
+	}
+	data, err := blobs.Get(c.Request.Context(), export.blobKey())
+	if errors.Is(err, ErrBlobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// renderGuide draws a frame per step and encodes them, reporting progress
+// on export as it goes: drawing takes it to 90, encoding to 100.
+func renderGuide(export *GuideExport, guide Guide, req GuideExportRequest) ([]byte, error) {
+	watermark := workspaceWatermark(guide.WorkspaceID)
+	frames := make([]*image.RGBA, len(guide.Steps))
+	for i, step := range guide.Steps {
+		var shot image.Image
+		if step.Image != nil {
+			data, err := blobs.Get(context.Background(), stepBlobKey(guide.ID, step.ID))
+			if err == nil {
+				shot, _, err = image.Decode(bytes.NewReader(data))
+			}
+			if err != nil {
+				logger.Warn("guide export is missing a step image", "guide", guide.ID, "step", step.ID, "error", err)
+			}
+		}
+		frames[i] = renderFrame(shot, fmt.Sprintf("%d/%d %s", i+1, len(guide.Steps), step.Title), req.Width, watermark)
+		guideExports.progress(export, (i+1)*90/len(guide.Steps))
+	}
+	if req.Format == GuideExportMP4 {
+		return encodeMP4(frames, req.StepSeconds)
+	}
+	return encodeGIF(frames, req.StepSeconds)
+}
+
+// renderFrame fits shot into a 16:9 area above a bar with caption in it,
+// with the workspace's watermark, if any, over the area. Both sides are
+// even, as video encoders need: the scale, and so every part of the bar,
+// is.
+func renderFrame(shot image.Image, caption string, width int, watermark *Watermark) *image.RGBA {
+	width &^= 1
+	scale := width / 400
+	if scale < 2 {
+		scale = 2
+	}
+	pad := 3 * scale
+	lineHeight := (glyphHeight + 3) * scale
+	areaHeight := (width * 9 / 16) &^ 1
+	barHeight := 2*lineHeight + 2*pad
+
+	frame := image.NewRGBA(image.Rect(0, 0, width, areaHeight+barHeight))
+	draw.Draw(frame, image.Rect(0, 0, width, areaHeight), image.White, image.Point{}, draw.Src)
+	draw.Draw(frame, image.Rect(0, areaHeight, width, areaHeight+barHeight), image.NewUniform(captionBarColor), image.Point{}, draw.Src)
+	if shot != nil {
+		scaleInto(frame, image.Rect(0, 0, width, areaHeight), shot)
+	}
+	watermark.apply(frame, image.Rect(0, 0, width, areaHeight))
+
+	perLine := (width - 2*pad + scale) / ((glyphWidth + 1) * scale)
+	for i, line := range wrapText(caption, perLine, 2) {
+		drawText(frame, image.Pt(pad, areaHeight+pad+i*lineHeight+scale), line, scale, captionTextColor)
+	}
+	return frame
+}
+
+// scaleInto draws src as large as fits in area, centred, averaging the
+// pixels each destination pixel covers.
+func scaleInto(dst *image.RGBA, area image.Rectangle, src image.Image) {
+	sb := src.Bounds()
+	if sb.Empty() {
+		return
+	}
+	w, h := area.Dx(), sb.Dy()*area.Dx()/sb.Dx()
+	if h > area.Dy() {
+		w, h = sb.Dx()*area.Dy()/sb.Dy(), area.Dy()
+	}
+	if w == 0 || h == 0 {
+		return
+	}
+	x0, y0 := area.Min.X+(area.Dx()-w)/2, area.Min.Y+(area.Dy()-h)/2
+	for y := 0; y < h; y++ {
+		sy0, sy1 := sb.Min.Y+y*sb.Dy()/h, sb.Min.Y+(y+1)*sb.Dy()/h
+		if sy1 == sy0 {
+			sy1++
+		}
+		for x := 0; x < w; x++ {
+			sx0, sx1 := sb.Min.X+x*sb.Dx()/w, sb.Min.X+(x+1)*sb.Dx()/w
+			if sx1 == sx0 {
+				sx1++
+			}
+			var r, g, b, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, _ := src.At(sx, sy).RGBA()
+					r, g, b, n = r+pr, g+pg, b+pb, n+1
+				}
+			}
+			dst.SetRGBA(x0+x, y0+y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(b / n >> 8), 0xff})
+		}
+	}
+}
+
+func encodeGIF(frames []*image.RGBA, stepSeconds int) ([]byte, error) {
+	anim := &gif.GIF{}
+	for _, frame := range frames {
+		paletted := image.NewPaletted(frame.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, frame.Bounds(), frame, image.Point{})
+		anim.Image = append(anim.Image, paletted)
+		anim.Delay = append(anim.Delay, stepSeconds*100)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeMP4 has ffmpeg turn the frames, piped in as PNGs, into an H.264
+// video. The last frame is sent twice, since ffmpeg otherwise shows the
+// last image of a sequence only for a moment.
+func encodeMP4(frames []*image.RGBA, stepSeconds int) ([]byte, error) {
+	out, err := os.CreateTemp("", "tango-guide-*.mp4")
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	ctx, cancel := context.WithTimeout(context.Background(), videoTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, config.FFmpegCommand,
+		"-hide_banner", "-loglevel", "error",
+		"-f", "image2pipe", "-framerate", "1/"+strconv.Itoa(stepSeconds), "-i", "-",
+		"-vf", "fps=25,format=yuv420p", "-c:v", "libx264", "-movflags", "+faststart",
+		"-y", out.Name())
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	var writeErr error
+	for _, frame := range append(frames, frames[len(frames)-1]) {
+		if writeErr = png.Encode(stdin, frame); writeErr != nil {
+			break
+		}
+	}
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	return os.ReadFile(out.Name())
+}
@@ -0,0 +1,413 @@
+package tango
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxGuideVersions = 200
+
+// GuideContent is what a guide's versions capture: its details and its
+// steps in order. Text read from images is left out, as it is not an edit.
+type GuideContent struct {
+	Title        string      `json:"title"`
+	Description  string      `json:"description,omitempty"`
+	Status       string      `json:"status"`
+	Tags         []string    `json:"tags,omitempty"`
+	CollectionID string      `json:"collectionId,omitempty"`
+	Steps        []GuideStep `json:"steps"`
+}
+
+// contentOf copies a guide's content. Callers must hold guides.mu or own
+// the guide.
+func contentOf(guide *Guide) GuideContent {
+	content := GuideContent{
+		Title:        guide.Title,
+		Description:  guide.Description,
+		Status:       guide.Status,
+		Tags:         append([]string(nil), guide.Tags...),
+		CollectionID: guide.CollectionID,
+		Steps:        make([]GuideStep, 0, len(guide.Steps)),
+	}
+	for _, step := range guide.Steps {
+		step.Text = ""
+		if step.Image != nil {
+			image := *step.Image
+			step.Image = &image
+		}
+		content.Steps = append(content.Steps, step)
+	}
+	return content
+}
+
+// GuideVersion is a guide's content after one change to it. A version is
+// never changed once recorded; rolling back records a new one.
+type GuideVersion struct {
+	Version      int          `json:"version"`
+	GuideID      string       `json:"guideId"`
+	Content      GuideContent `json:"content"`
+	Change       string       `json:"change"`
+	AuthorID     string       `json:"authorId,omitempty"`
+	RestoredFrom int          `json:"restoredFrom,omitempty"`
+	CreatedAt    int64        `json:"createdAt"`
+}
+
+// GuideHistory keeps the most recent versions of each guide, oldest first.
+// Co-edits are kept as one version per stretch of work by the same user:
+// pending names who has been co-editing a guide since its last version.
+type GuideHistory struct {
+	versions map[string][]*GuideVersion
+	pending  map[string]string
+	mu       sync.Mutex
+}
+
+var guideHistory = &GuideHistory{versions: make(map[string][]*GuideVersion), pending: make(map[string]string)}
+
+// record adds a version of the guide. before is its content ahead of the
+// change: a guide with no history yet gets it as its first version, and
+// co-edits still pending are recorded as it first.
+func (h *GuideHistory) record(guideID string, before GuideContent, version GuideVersion) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if version.Change != VersionCreated {
+		h.baseline(guideID, before)
+	}
+	h.flush(guideID, before)
+	h.append(guideID, version)
+}
+
+// edited notes that authorID co-edited the guide, whose content was before
+// until then. Edits someone else left pending are recorded first.
+func (h *GuideHistory) edited(guideID string, before GuideContent, authorID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.baseline(guideID, before)
+	if author, editing := h.pending[guideID]; editing && author != authorID {
+		h.flush(guideID, before)
+	}
+	h.pending[guideID] = authorID
+}
+
+// settle records the guide's pending co-edits, leaving it with content,
+// and reports whether there were any.
+func (h *GuideHistory) settle(guideID string, content GuideContent) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.flush(guideID, content)
+}
+
+// pendingAuthor returns who has co-edits of the guide pending, if anyone.
+func (h *GuideHistory) pendingAuthor(guideID string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	author, editing := h.pending[guideID]
+	return author, editing
+}
+
+// baseline records content as the first version of a guide with no history
+// yet. Callers must hold h.mu.
+func (h *GuideHistory) baseline(guideID string, content GuideContent) {
+	if len(h.versions[guideID]) == 0 {
+		h.append(guideID, GuideVersion{Content: content, Change: VersionInitial})
+	}
+}
+
+// flush records pending co-edits, which left the guide with content.
+// Callers must hold h.mu.
+func (h *GuideHistory) flush(guideID string, content GuideContent) bool {
+	author, editing := h.pending[guideID]
+	if !editing {
+		return false
+	}
+	delete(h.pending, guideID)
+	h.append(guideID, GuideVersion{Content: content, Change: VersionEdited, AuthorID: author})
+	return true
+}
+
+// append adds a version unless its content is the same as the latest.
+// Callers must hold h.mu.
+func (h *GuideHistory) append(guideID string, version GuideVersion) {
+	versions := h.versions[guideID]
+	next := 1
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		if reflect.DeepEqual(latest.Content, version.Content) {
+			return
+		}
+		next = latest.Version + 1
+	}
+	version.Version = next
+	version.GuideID = guideID
+	version.CreatedAt = getCurrentTimestamp()
+	versions = append(versions, &version)
+	if len(versions) > maxGuideVersions {
+		versions = versions[len(versions)-maxGuideVersions:]
+	}
+	h.versions[guideID] = versions
+}
+
+func (h *GuideHistory) list(guideID string) []GuideVersion {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	versions := h.versions[guideID]
+	list := make([]GuideVersion, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		list = append(list, *versions[i])
+	}
+	return list
+}
+
+// get returns a version of the guide; 0 means the latest.
+func (h *GuideHistory) get(guideID string, version int) (GuideVersion, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	versions := h.versions[guideID]
+	if len(versions) == 0 {
+		return GuideVersion{}, false
+	}
+	if version == 0 {
+		return *versions[len(versions)-1], true
+	}
+	for _, v := range versions {
+		if v.Version == version {
+			return *v, true
+		}
+	}
+	return GuideVersion{}, false
+}
+
+func (h *GuideHistory) Forget(guideID string) {
+	h.mu.Lock()
+	delete(h.versions, guideID)
+	delete(h.pending, guideID)
+	h.mu.Unlock()
+}
+
+// forgetAuthor drops a deleted user's name from the versions they made.
+func (h *GuideHistory) forgetAuthor(userID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, versions := range h.versions {
+		for i, v := range versions {
+			if v.AuthorID == userID {
+				anonymous := *v
+				anonymous.AuthorID = ""
+				versions[i] = &anonymous
+			}
+		}
+	}
+	for guideID, author := range h.pending {
+		if author == userID {
+			h.pending[guideID] = ""
+		}
+	}
+}
+
+// StepChange is what changed in a step kept between two versions.
+type StepChange struct {
+	StepID string        `json:"stepId"`
+	Fields []FieldChange `json:"fields"`
+}
+
+// GuideVersionDiff is what changed between two versions of a guide: the
+// details that differ, the tags added and removed, the steps added and
+// removed, the changes to steps in both, and whether the steps in both
+// were reordered.
+type GuideVersionDiff struct {
+	From           int           `json:"from"`
+	To             int           `json:"to"`
+	Fields         []FieldChange `json:"fields"`
+	TagsAdded      []string      `json:"tagsAdded"`
+	TagsRemoved    []string      `json:"tagsRemoved"`
+	TagsReordered  bool          `json:"tagsReordered"`
+	StepsAdded     []GuideStep   `json:"stepsAdded"`
+	StepsRemoved   []GuideStep   `json:"stepsRemoved"`
+	StepsChanged   []StepChange  `json:"stepsChanged"`
+	StepsReordered bool          `json:"stepsReordered"`
+}
+
+func diffGuides(from, to GuideVersion) GuideVersionDiff {
+	a, b := from.Content, to.Content
+	diff := GuideVersionDiff{
+		From: from.Version,
+		To:   to.Version,
+		Fields: changedFields([]FieldChange{
+			{"title", a.Title, b.Title},
+			{"description", a.Description, b.Description},
+			{"status", a.Status, b.Status},
+			{"collectionId", a.CollectionID, b.CollectionID},
+		}),
+		StepsAdded:   []GuideStep{},
+		StepsRemoved: []GuideStep{},
+		StepsChanged: []StepChange{},
+	}
+	diff.TagsAdded, diff.TagsRemoved, diff.TagsReordered = diffTags(a.Tags, b.Tags)
+
+	before := make(map[string]GuideStep, len(a.Steps))
+	for _, step := range a.Steps {
+		before[step.ID] = step
+	}
+	after := make(map[string]bool, len(b.Steps))
+	var keptA, keptB []string
+	for _, step := range b.Steps {
+		after[step.ID] = true
+		old, exists := before[step.ID]
+		if !exists {
+			diff.StepsAdded = append(diff.StepsAdded, step)
+			continue
+		}
+		keptB = append(keptB, step.ID)
+		fields := changedFields([]FieldChange{
+			{"title", old.Title, step.Title},
+			{"description", old.Description, step.Description},
+			{"pageUrl", old.PageURL, step.PageURL},
+			{"selector", old.Selector, step.Selector},
+			{"image", old.Image != nil, step.Image != nil},
+		})
+		if len(fields) > 0 {
+			diff.StepsChanged = append(diff.StepsChanged, StepChange{StepID: step.ID, Fields: fields})
+		}
+	}
+	for _, step := range a.Steps {
+		if after[step.ID] {
+			keptA = append(keptA, step.ID)
+		} else {
+			diff.StepsRemoved = append(diff.StepsRemoved, step)
+		}
+	}
+	diff.StepsReordered = !reflect.DeepEqual(keptA, keptB)
+	return diff
+}
+
+// changedFields keeps the changes whose value differs.
+func changedFields(fields []FieldChange) []FieldChange {
+	changed := []FieldChange{}
+	for _, f := range fields {
+		if f.From != f.To {
+			changed = append(changed, f)
+		}
+	}
+	return changed
+}
+
+func getGuideVersions(c *gin.Context) {
+	_, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": guideHistory.list(guide.ID)})
+}
+
+func getGuideVersion(c *gin.Context) {
+	_, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	n, ok := versionParam(c, "version", c.Param("version"))
+	if !ok {
+		return
+	}
+	version, exists := guideHistory.get(guide.ID, n)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	c.JSON(http.StatusOK, version)
+}
+
+// diffGuideVersions compares version from with version to, the latest if
+// not given.
+func diffGuideVersions(c *gin.Context) {
+	_, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	from, ok := versionParam(c, "from", c.Query("from"))
+	if !ok {
+		return
+	}
+	to := 0
+	if value := c.Query("to"); value != "" {
+		if to, ok = versionParam(c, "to", value); !ok {
+			return
+		}
+	}
+	a, existsA := guideHistory.get(guide.ID, from)
+	b, existsB := guideHistory.get(guide.ID, to)
+	if !existsA || !existsB {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	c.JSON(http.StatusOK, diffGuides(a, b))
+}
+
+// rollbackGuide puts a guide back as it was in an earlier version,
+// recording that as a new version. Steps still in the guide keep their
+// images and the text read from them; steps deleted since come back
+// without an image, as theirs was deleted with them, and steps added
+// since are deleted.
+func rollbackGuide(c *gin.Context) {
+	user, current, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	n, ok := versionParam(c, "version", c.Param("version"))
+	if !ok {
+		return
+	}
+	version, exists := guideHistory.get(current.ID, n)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	target := version.Content
+	if guideStepsLocked(current.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cannot roll back while a co-editor holds a step lock"})
+		return
+	}
+	if err := collections.checkMove(current.WorkspaceID, target.CollectionID); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cannot roll back: " + err.Error()})
+		return
+	}
+
+	var removed []GuideStep
+	var owner, workspaceID string
+	guide, err := guides.apply(current.ID, GuideVersion{Change: VersionRolledBack, AuthorID: user.ID, RestoredFrom: n}, func(guide *Guide) error {
+		kept := make(map[string]GuideStep, len(guide.Steps))
+		for _, step := range guide.Steps {
+			kept[step.ID] = step
+		}
+		steps := make([]GuideStep, 0, len(target.Steps))
+		for _, old := range target.Steps {
+			step, exists := kept[old.ID]
+			if !exists {
+				step = old
+				step.Image = nil
+			}
+			delete(kept, old.ID)
+			step.Title, step.Description, step.PageURL, step.Selector, step.At = old.Title, old.Description, old.PageURL, old.Selector, old.At
+			steps = append(steps, step)
+		}
+		for _, step := range guide.Steps {
+			if _, dropped := kept[step.ID]; dropped {
+				removed = append(removed, step)
+			}
+		}
+		owner, workspaceID = guide.CreatedBy, guide.WorkspaceID
+		guide.Title, guide.Description, guide.Status, guide.Steps = target.Title, target.Description, target.Status, steps
+		guide.Tags, guide.CollectionID = append([]string(nil), target.Tags...), target.CollectionID
+		return nil
+	})
+	if !guideResult(c, err) {
+		return
+	}
+	dropStepImages(c.Request.Context(), current.ID, owner, workspaceID, removed)
+	auditRequest(c, "guide.rollback", "guide", guide.ID, gin.H{"version": n})
+	if current.Status != GuidePublished && guide.Status == GuidePublished {
+		emitEvent(EventGuidePublished, guide)
+	}
+	c.JSON(http.StatusOK, guide)
+}
@@ -0,0 +1,415 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	guideDocumentFormat  = "tango.guide"
+	guideDocumentVersion = 1
+
+	maxImportSteps = 200
+	maxImportBytes = 200 << 20
+	// importMemory is how much of a multipart import is held in memory
+	// before the rest goes to temporary files.
+	importMemory = 32 << 20
+)
+
+// GuideDocument is the interchange format guides are imported from and
+// exported in, so they can be authored elsewhere or moved between
+// instances.
+type GuideDocument struct {
+	Format      string         `json:"format"`
+	Version     int            `json:"version"`
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Status      string         `json:"status,omitempty"`
+	Steps       []DocumentStep `json:"steps"`
+}
+
+type DocumentStep struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	PageURL     string         `json:"pageUrl,omitempty"`
+	Selector    string         `json:"selector,omitempty"`
+	At          int64          `json:"at,omitempty"`
+	Image       *DocumentImage `json:"image,omitempty"`
+}
+
+// DocumentImage is a step's PNG or JPEG image, either inline as base64
+// Data or as the name of a File uploaded with the document.
+type DocumentImage struct {
+	Data string `json:"data,omitempty"`
+	File string `json:"file,omitempty"`
+}
+
+var (
+	markdownImage = regexp.MustCompile(`!\[[^\]]*\]\(\s*<?([^)\s>]+)>?(?:\s+"[^"]*")?\s*\)`)
+	stepNumbering = regexp.MustCompile(`^\d+[.)]\s+`)
+)
+
+// parseMarkdownGuide reads a guide written in Markdown: the first level-one
+// heading is its title and the text under it the description, each
+// level-two or level-three heading starts a step, and the first image
+// under a step is its image. Images are data: URIs or the names of files
+// uploaded with the document.
+func parseMarkdownGuide(text string) GuideDocument {
+	doc := GuideDocument{Format: guideDocumentFormat, Version: guideDocumentVersion}
+	var step *DocumentStep
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) == 0 {
+			return
+		}
+		text := strings.Join(paragraph, " ")
+		paragraph = nil
+		target := &doc.Description
+		if step != nil {
+			target = &step.Description
+		}
+		if *target != "" {
+			*target += "\n\n"
+		}
+		*target += text
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "# ") && step == nil && doc.Title == "":
+			flush()
+			doc.Title = strings.TrimSpace(line[2:])
+			continue
+		case strings.HasPrefix(line, "## "), strings.HasPrefix(line, "### "):
+			flush()
+			title := strings.TrimSpace(strings.TrimLeft(line, "#"))
+			doc.Steps = append(doc.Steps, DocumentStep{Title: stepNumbering.ReplaceAllString(title, "")})
+			step = &doc.Steps[len(doc.Steps)-1]
+			continue
+		case line == "":
+			flush()
+			continue
+		}
+		for _, match := range markdownImage.FindAllStringSubmatch(line, -1) {
+			if step == nil || step.Image != nil {
+				continue
+			}
+			if strings.HasPrefix(match[1], "data:") {
+				step.Image = &DocumentImage{Data: match[1]}
+			} else {
+				step.Image = &DocumentImage{File: match[1]}
+			}
+		}
+		if rest := strings.TrimSpace(markdownImage.ReplaceAllString(line, "")); rest != "" {
+			paragraph = append(paragraph, rest)
+		}
+	}
+	flush()
+	return doc
+}
+
+// readGuideImport reads the document from a JSON or Markdown body, or from
+// the guide field of a multipart form along with the image files uploaded
+// next to it, keyed by file name.
+func readGuideImport(c *gin.Context) (GuideDocument, map[string]*multipart.FileHeader, error) {
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var doc GuideDocument
+		if err := json.NewDecoder(c.Request.Body).Decode(&doc); err != nil {
+			return doc, nil, fmt.Errorf("the guide is not valid JSON: %v", err)
+		}
+		return doc, nil, nil
+	case "text/markdown", "text/plain":
+		text, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return GuideDocument{}, nil, err
+		}
+		return parseMarkdownGuide(string(text)), nil, nil
+	case "multipart/form-data":
+	default:
+		return GuideDocument{}, nil, errors.New("send the guide as application/json, text/markdown or multipart/form-data")
+	}
+
+	if err := c.Request.ParseMultipartForm(importMemory); err != nil {
+		return GuideDocument{}, nil, fmt.Errorf("reading the form: %v", err)
+	}
+	form := c.Request.MultipartForm
+	var text string
+	if values := form.Value["guide"]; len(values) > 0 {
+		text = values[0]
+	} else if headers := form.File["guide"]; len(headers) > 0 {
+		file, err := headers[0].Open()
+		if err != nil {
+			return GuideDocument{}, nil, err
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return GuideDocument{}, nil, err
+		}
+		text = string(data)
+	} else {
+		return GuideDocument{}, nil, errors.New("the form has no guide field")
+	}
+	files := make(map[string]*multipart.FileHeader)
+	for field, headers := range form.File {
+		if field == "guide" {
+			continue
+		}
+		for _, header := range headers {
+			files[header.Filename] = header
+		}
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(text), "{") {
+		var doc GuideDocument
+		if err := json.Unmarshal([]byte(text), &doc); err != nil {
+			return doc, nil, fmt.Errorf("the guide is not valid JSON: %v", err)
+		}
+		return doc, files, nil
+	}
+	return parseMarkdownGuide(text), files, nil
+}
+
+// importedImage is a step image checked and ready to store.
+type importedImage struct {
+	data  []byte
+	image GuideImage
+}
+
+// loadDocumentImage decodes an inline image or reads an uploaded one, and
+// checks it is a PNG or JPEG screenshot.
+func loadDocumentImage(img *DocumentImage, files map[string]*multipart.FileHeader) (importedImage, error) {
+	var data []byte
+	switch {
+	case img.Data != "":
+		encoded := img.Data
+		if strings.HasPrefix(encoded, "data:") {
+			comma := strings.IndexByte(encoded, ',')
+			if comma < 0 || !strings.HasSuffix(encoded[:comma], ";base64") {
+				return importedImage{}, errors.New("data URIs must be base64 encoded")
+			}
+			encoded = encoded[comma+1:]
+		}
+		if base64.StdEncoding.DecodedLen(len(encoded)) > maxScreenshotBytes+2 {
+			return importedImage{}, fmt.Errorf("images must be at most %d bytes", maxScreenshotBytes)
+		}
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return importedImage{}, errors.New("the image is not valid base64")
+		}
+	case img.File != "":
+		header, exists := files[img.File]
+		if !exists {
+			header, exists = files[path.Base(img.File)]
+		}
+		if !exists {
+			return importedImage{}, fmt.Errorf("%s was not uploaded", img.File)
+		}
+		if header.Size > maxScreenshotBytes {
+			return importedImage{}, fmt.Errorf("images must be at most %d bytes", maxScreenshotBytes)
+		}
+		file, err := header.Open()
+		if err != nil {
+			return importedImage{}, err
+		}
+		data, err = io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return importedImage{}, err
+		}
+	default:
+		return importedImage{}, errors.New("the image has neither data nor a file")
+	}
+	if len(data) > maxScreenshotBytes {
+		return importedImage{}, fmt.Errorf("images must be at most %d bytes", maxScreenshotBytes)
+	}
+	contentType := http.DetectContentType(data)
+	if contentType != "image/png" && contentType != "image/jpeg" {
+		return importedImage{}, errors.New("images must be PNG or JPEG")
+	}
+	bounds, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return importedImage{}, errors.New("the image could not be decoded")
+	}
+	return importedImage{data: data, image: GuideImage{ContentType: contentType, Size: len(data), Width: bounds.Width, Height: bounds.Height}}, nil
+}
+
+// importSteps checks a document and turns its steps into guide steps, with
+// the images to store for them.
+func importSteps(doc GuideDocument, files map[string]*multipart.FileHeader) ([]GuideStep, map[string]importedImage, error) {
+	switch {
+	case doc.Format != "" && doc.Format != guideDocumentFormat:
+		return nil, nil, fmt.Errorf("format must be %s", guideDocumentFormat)
+	case doc.Version > guideDocumentVersion:
+		return nil, nil, fmt.Errorf("version %d is newer than this server reads", doc.Version)
+	case strings.TrimSpace(doc.Title) == "" || len(doc.Title) > maxScreenshotTitleBytes:
+		return nil, nil, fmt.Errorf("the guide needs a title of at most %d bytes", maxScreenshotTitleBytes)
+	case len(doc.Description) > maxScreenshotDescBytes:
+		return nil, nil, fmt.Errorf("the description must be at most %d bytes", maxScreenshotDescBytes)
+	case doc.Status != "" && doc.Status != GuideDraft && doc.Status != GuidePublished:
+		return nil, nil, errors.New("status must be draft or published")
+	case len(doc.Steps) == 0 || len(doc.Steps) > maxImportSteps:
+		return nil, nil, fmt.Errorf("a guide needs between 1 and %d steps", maxImportSteps)
+	}
+
+	steps := make([]GuideStep, 0, len(doc.Steps))
+	images := make(map[string]importedImage)
+	for i, in := range doc.Steps {
+		step := GuideStep{
+			ID:          generateID(),
+			Title:       strings.TrimSpace(in.Title),
+			Description: strings.TrimSpace(in.Description),
+			PageURL:     in.PageURL,
+			Selector:    in.Selector,
+			At:          in.At,
+		}
+		if step.Title == "" {
+			step.Title = fmt.Sprintf("Step %d", i+1)
+		}
+		switch {
+		case len(step.Title) > maxScreenshotTitleBytes, len(step.Description) > maxScreenshotDescBytes:
+			return nil, nil, fmt.Errorf("step %d: titles must be at most %d bytes and descriptions %d", i+1, maxScreenshotTitleBytes, maxScreenshotDescBytes)
+		case len(step.PageURL) > maxScreenshotURLBytes, len(step.Selector) > maxSelectorBytes:
+			return nil, nil, fmt.Errorf("step %d: pageUrl must be at most %d bytes and selector %d", i+1, maxScreenshotURLBytes, maxSelectorBytes)
+		}
+		if in.Image != nil {
+			img, err := loadDocumentImage(in.Image, files)
+			if err != nil {
+				return nil, nil, fmt.Errorf("step %d: %v", i+1, err)
+			}
+			image := img.image
+			step.Image = &image
+			images[step.ID] = img
+		}
+		steps = append(steps, step)
+	}
+	return steps, images, nil
+}
+
+// importGuide creates a guide from a document, personal or in the
+// ?workspaceId= workspace.
+func importGuide(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	workspaceID := c.Query("workspaceId")
+	if workspaceID != "" && requireRole(c, workspaceID, RoleMember) == nil {
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	doc, files, err := readGuideImport(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	steps, images, err := importSteps(doc, files)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var size int64
+	for _, img := range images {
+		size += int64(len(img.data))
+	}
+	if breach := meter.reserveStorage(user.ID, workspaceID, size); breach != nil {
+		rejectQuota(c, breach)
+		return
+	}
+	guide := &Guide{
+		ID:          generateID(),
+		Title:       strings.TrimSpace(doc.Title),
+		Description: strings.TrimSpace(doc.Description),
+		Status:      GuideDraft,
+		WorkspaceID: workspaceID,
+		CreatedBy:   user.ID,
+		CreatedAt:   getCurrentTimestamp(),
+		Steps:       steps,
+	}
+	if doc.Status != "" {
+		guide.Status = doc.Status
+	}
+	for stepID, img := range images {
+		if err := blobs.Put(c.Request.Context(), stepBlobKey(guide.ID, stepID), img.data); err != nil {
+			logger.Error("storing imported guide image failed", "guide", guide.ID, "step", stepID, "error", err)
+			discardGuide(guide)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "The guide's images could not be stored"})
+			return
+		}
+	}
+
+	created := guides.add(guide)
+	if ocrEnabled() {
+		for stepID := range images {
+			queueStepOCR(guide.ID, stepID)
+		}
+	}
+
+	auditRequest(c, "guide.import", "guide", created.ID, gin.H{"steps": len(created.Steps), "images": len(images)})
+	emitEvent(EventGuideCreated, created)
+	c.JSON(http.StatusCreated, created)
+}
+
+// getGuideDocument exports a guide in the interchange format, with its
+// images inline, ready to import elsewhere.
+func getGuideDocument(c *gin.Context) {
+	_, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	doc, err := guideDocument(c.Request.Context(), guide)
+	if err != nil {
+		logger.Error("reading guide images failed", "guide", guide.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The guide's images could not be read"})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="guide-`+guide.ID+`.json"`)
+	c.JSON(http.StatusOK, doc)
+}
+
+func guideDocument(ctx context.Context, guide Guide) (GuideDocument, error) {
+	doc := GuideDocument{
+		Format:      guideDocumentFormat,
+		Version:     guideDocumentVersion,
+		Title:       guide.Title,
+		Description: guide.Description,
+		Status:      guide.Status,
+		Steps:       make([]DocumentStep, 0, len(guide.Steps)),
+	}
+	for _, step := range guide.Steps {
+		out := DocumentStep{
+			Title:       step.Title,
+			Description: step.Description,
+			PageURL:     step.PageURL,
+			Selector:    step.Selector,
+			At:          step.At,
+		}
+		data, err := stepImage(ctx, guide.ID, step)
+		if err != nil {
+			return GuideDocument{}, err
+		}
+		if data != nil {
+			out.Image = &DocumentImage{Data: base64.StdEncoding.EncodeToString(data)}
+		}
+		doc.Steps = append(doc.Steps, out)
+	}
+	return doc, nil
+}
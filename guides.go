@@ -0,0 +1,917 @@
+package tango
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	GuideDraft     = "draft"
+	GuidePublished = "published"
+)
+
+var errGuideNotFound = errors.New("Guide not found")
+
+// Guide is a step-by-step how-to, assembled from a session's screenshots
+// or one of its recordings and then edited. Each step keeps its own copy
+// of its image, so a guide outlives the session it came from. Guides in a
+// workspace are shared with its members; those outside any workspace
+// belong to their author. A deleted guide waits in the trash, with
+// TrashedAt set, until it is restored or purged.
+type Guide struct {
+	ID           string            `json:"id"`
+	Title        string            `json:"title"`
+	Description  string            `json:"description,omitempty"`
+	Status       string            `json:"status"`
+	WorkspaceID  string            `json:"workspaceId,omitempty"`
+	SessionID    string            `json:"sessionId,omitempty"`
+	RecordingID  string            `json:"recordingId,omitempty"`
+	CreatedBy    string            `json:"createdBy,omitempty"`
+	CreatedAt    int64             `json:"createdAt"`
+	UpdatedAt    int64             `json:"updatedAt,omitempty"`
+	TrashedAt    int64             `json:"trashedAt,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	CollectionID string            `json:"collectionId,omitempty"`
+	ExternalID   string            `json:"externalId,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Steps        []GuideStep       `json:"steps"`
+	Pushes       []GuidePush       `json:"pushes,omitempty"`
+}
+
+type GuideStep struct {
+	ID          string      `json:"id"`
+	Title       string      `json:"title"`
+	Description string      `json:"description,omitempty"`
+	PageURL     string      `json:"pageUrl,omitempty"`
+	Selector    string      `json:"selector,omitempty"`
+	At          int64       `json:"at"`
+	Image       *GuideImage `json:"image,omitempty"`
+	// Text is what OCR read from the image.
+	Text string `json:"text,omitempty"`
+}
+
+type GuideImage struct {
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+}
+
+func (g *Guide) snapshot() Guide {
+	snapshot := *g
+	snapshot.Tags = append([]string(nil), g.Tags...)
+	snapshot.Metadata = copyMetadata(g.Metadata)
+	snapshot.Steps = append([]GuideStep{}, g.Steps...)
+	snapshot.Pushes = append([]GuidePush(nil), g.Pushes...)
+	return snapshot
+}
+
+// imageBytes is the storage the guide's images take.
+func (g *Guide) imageBytes() int64 {
+	var size int64
+	for _, step := range g.Steps {
+		if step.Image != nil {
+			size += int64(step.Image.Size)
+		}
+	}
+	return size
+}
+
+func stepBlobKey(guideID, stepID string) string {
+	return "guides/" + guideID + "/" + stepID
+}
+
+type GuideRegistry struct {
+	Guides map[string]*Guide
+	mu     sync.Mutex
+}
+
+var guides = &GuideRegistry{Guides: make(map[string]*Guide)}
+
+func (r *GuideRegistry) get(id string) (Guide, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	guide, exists := r.Guides[id]
+	if !exists {
+		return Guide{}, false
+	}
+	return guide.snapshot(), true
+}
+
+// indexGuide brings guide's search entry up to date; guides in the trash
+// have none.
+func indexGuide(guide *Guide) {
+	if guide.TrashedAt != 0 {
+		searchIndex.Remove(SearchGuide, guide.ID)
+		return
+	}
+	searchIndex.Put(guideSearchDoc(guide))
+}
+
+// add registers a new guide, indexes it for search and returns a snapshot
+// of it.
+func (r *GuideRegistry) add(guide *Guide) Guide {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Guides[guide.ID] = guide
+	indexGuide(guide)
+	guideHistory.record(guide.ID, GuideContent{}, GuideVersion{Content: contentOf(guide), Change: VersionCreated, AuthorID: guide.CreatedBy})
+	return guide.snapshot()
+}
+
+// update applies change, made by authorID, to a guide and returns the
+// result. A change to its content is recorded as a version.
+func (r *GuideRegistry) update(id, authorID string, change func(*Guide) error) (Guide, error) {
+	return r.apply(id, GuideVersion{Change: VersionUpdated, AuthorID: authorID}, change)
+}
+
+// apply is update that records the change as version. Anyone co-editing
+// the guide is brought up to date.
+func (r *GuideRegistry) apply(id string, version GuideVersion, change func(*Guide) error) (Guide, error) {
+	r.mu.Lock()
+	guide, exists := r.Guides[id]
+	if !exists {
+		r.mu.Unlock()
+		return Guide{}, errGuideNotFound
+	}
+	before := contentOf(guide)
+	if err := change(guide); err != nil {
+		r.mu.Unlock()
+		return Guide{}, err
+	}
+	guide.UpdatedAt = getCurrentTimestamp()
+	indexGuide(guide)
+	version.Content = contentOf(guide)
+	guideHistory.record(guide.ID, before, version)
+	updated := guide.snapshot()
+	r.mu.Unlock()
+
+	syncGuideEditors(id)
+	return updated, nil
+}
+
+// coedit applies a co-editor's change. It is recorded as a version once
+// someone else changes the guide or the co-editor stops editing.
+func (r *GuideRegistry) coedit(id, authorID string, change func(*Guide) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	guide, exists := r.Guides[id]
+	if !exists || guide.TrashedAt != 0 {
+		return errGuideNotFound
+	}
+	before := contentOf(guide)
+	if err := change(guide); err != nil {
+		return err
+	}
+	guide.UpdatedAt = getCurrentTimestamp()
+	indexGuide(guide)
+	guideHistory.edited(id, before, authorID)
+	return nil
+}
+
+// settleEdits records the co-edits of a guide not yet kept as a version.
+func (r *GuideRegistry) settleEdits(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if guide, exists := r.Guides[id]; exists {
+		guideHistory.settle(id, contentOf(guide))
+	}
+}
+
+// setStepText records the text read from a step's image, which also
+// describes a step that has no description. It is not an edit, so the
+// guide's UpdatedAt is left alone.
+func (r *GuideRegistry) setStepText(guideID, stepID, text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	guide, exists := r.Guides[guideID]
+	if !exists {
+		return
+	}
+	for i := range guide.Steps {
+		if step := &guide.Steps[i]; step.ID == stepID {
+			step.Text = text
+			if step.Description == "" {
+				step.Description = clipDescription(text)
+			}
+			indexGuide(guide)
+			return
+		}
+	}
+}
+
+// externalIDTaken reports whether another guide where guide is, the same
+// workspace or, for a personal guide, the same author's, carries
+// externalID. Callers must hold r.mu.
+func (r *GuideRegistry) externalIDTaken(guide *Guide, externalID string) bool {
+	for _, other := range r.Guides {
+		if other != guide && other.ExternalID == externalID && other.WorkspaceID == guide.WorkspaceID &&
+			(guide.WorkspaceID != "" || other.CreatedBy == guide.CreatedBy) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectionCounts counts the guides outside the trash in each collection.
+func (r *GuideRegistry) collectionCounts() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[string]int)
+	for _, guide := range r.Guides {
+		if guide.CollectionID != "" && guide.TrashedAt == 0 {
+			counts[guide.CollectionID]++
+		}
+	}
+	return counts
+}
+
+// leaveCollection takes the guides in a deleted collection out of it,
+// recording a version of each.
+func (r *GuideRegistry) leaveCollection(collectionID, authorID string) {
+	r.mu.Lock()
+	var ids []string
+	for _, guide := range r.Guides {
+		if guide.CollectionID == collectionID {
+			ids = append(ids, guide.ID)
+		}
+	}
+	r.mu.Unlock()
+	for _, id := range ids {
+		r.apply(id, GuideVersion{Change: VersionCollectionDeleted, AuthorID: authorID}, func(guide *Guide) error {
+			if guide.CollectionID == collectionID {
+				guide.CollectionID = ""
+			}
+			return nil
+		})
+	}
+}
+
+// By returns the guides userID made.
+func (r *GuideRegistry) By(userID string) []Guide {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := []Guide{}
+	for _, guide := range r.Guides {
+		if guide.CreatedBy == userID {
+			list = append(list, guide.snapshot())
+		}
+	}
+	return list
+}
+
+// forgetUser deletes the user's personal guides and those of removed
+// workspaces, and takes the user's name off the rest.
+func (r *GuideRegistry) forgetUser(userID string, removed map[string]bool) {
+	r.mu.Lock()
+	var deleted []*Guide
+	for id, guide := range r.Guides {
+		switch {
+		case removed[guide.WorkspaceID], guide.WorkspaceID == "" && guide.CreatedBy == userID:
+			delete(r.Guides, id)
+			deleted = append(deleted, guide)
+		case guide.CreatedBy == userID:
+			guide.CreatedBy = ""
+		}
+	}
+	r.mu.Unlock()
+	for _, guide := range deleted {
+		discardGuide(guide)
+	}
+}
+
+// discardGuide deletes a removed guide's images, comments and versions,
+// gives their storage back and drops it from search.
+func discardGuide(guide *Guide) {
+	searchIndex.Remove(SearchGuide, guide.ID)
+	comments.Forget(guideCommentSubject(guide.ID))
+	guideHistory.Forget(guide.ID)
+	favorites.forgetItem(itemRef{Type: FavoriteGuide, ID: guide.ID})
+	meter.releaseStorage(guide.CreatedBy, guide.WorkspaceID, guide.imageBytes())
+	var keys []string
+	for _, step := range guide.Steps {
+		if step.Image != nil {
+			keys = append(keys, stepBlobKey(guide.ID, step.ID))
+		}
+	}
+	imageVariants.Forget(keys...)
+	go func() {
+		for _, step := range guide.Steps {
+			if step.Image == nil {
+				continue
+			}
+			if err := blobs.Delete(context.Background(), stepBlobKey(guide.ID, step.ID)); err != nil {
+				logger.Warn("deleting guide image failed", "guide", guide.ID, "step", step.ID, "error", err)
+			}
+		}
+	}()
+}
+
+func canSeeGuide(c *gin.Context, user *User, guide Guide) bool {
+	if guide.WorkspaceID == "" {
+		return guide.CreatedBy == user.ID
+	}
+	return canAccess(c, guide.WorkspaceID)
+}
+
+// guideFor looks up a guide the signed-in caller may see, responding when
+// there is none. Guides in the trash are reported as missing.
+func guideFor(c *gin.Context) (*User, Guide, bool) {
+	return findGuide(c, false)
+}
+
+// findGuide is guideFor that also finds guides in the trash when trashed
+// is set.
+func findGuide(c *gin.Context, trashed bool) (*User, Guide, bool) {
+	user := requireUser(c)
+	if user == nil {
+		return nil, Guide{}, false
+	}
+	guide, exists := guides.get(c.Param("id"))
+	if !exists || !canSeeGuide(c, user, guide) || guide.TrashedAt != 0 && !trashed {
+		notFound(c, errGuideNotFound.Error())
+		return nil, Guide{}, false
+	}
+	return user, guide, true
+}
+
+// draftSteps turns a session's screenshots into guide steps. Each
+// screenshot marks a moment: a click when it names the element, otherwise
+// a keyframe. A screenshot that shows the same page, element and text as
+// the one before adds nothing and is skipped. Steps without a title of
+// their own are named after what was done, and described by what was
+// said since the step before or else by the text read from the image.
+func draftSteps(shots []Screenshot, spoken []Caption) ([]GuideStep, []Screenshot) {
+	var steps []GuideStep
+	var kept []Screenshot
+	var last *Screenshot
+	since := int64(0)
+	for i := range shots {
+		shot := shots[i]
+		if last != nil && shot.PageURL == last.PageURL && shot.Selector == last.Selector && shot.Text == last.Text {
+			continue
+		}
+		step := GuideStep{
+			ID:          generateID(),
+			Title:       shot.Title,
+			Description: shot.Description,
+			PageURL:     shot.PageURL,
+			Selector:    shot.Selector,
+			At:          shot.CreatedAt,
+			Text:        shot.Text,
+		}
+		if step.Title == "" {
+			step.Title = stepTitle(shot.PageURL, shot.Selector, len(steps)+1)
+		}
+		if step.Description == "" {
+			step.Description = spokenBetween(spoken, since, (shot.CreatedAt+1)*1000)
+		}
+		if step.Description == "" {
+			step.Description = clipDescription(shot.Text)
+		}
+		steps = append(steps, step)
+		kept = append(kept, shot)
+		last = &shots[i]
+		since = (shot.CreatedAt + 1) * 1000
+	}
+	return steps, kept
+}
+
+// stepTitle names the nth step after what was done: a click on selector,
+// or a visit to pageURL.
+func stepTitle(pageURL, selector string, n int) string {
+	page := ""
+	if u, err := url.Parse(pageURL); err == nil && u.Host != "" {
+		page = u.Host + strings.TrimSuffix(u.Path, "/")
+	}
+	switch {
+	case selector != "" && page != "":
+		return fmt.Sprintf("Click %s on %s", selector, page)
+	case selector != "":
+		return "Click " + selector
+	case page != "":
+		return "Go to " + page
+	}
+	return fmt.Sprintf("Step %d", n)
+}
+
+// spokenBetween joins the captions that ended in [from, to), in Unix
+// milliseconds, into a description.
+func spokenBetween(spoken []Caption, from, to int64) string {
+	var texts []string
+	for _, caption := range spoken {
+		if caption.End >= from && caption.End < to {
+			texts = append(texts, caption.Text)
+		}
+	}
+	return clipDescription(strings.Join(texts, " "))
+}
+
+// clipDescription cuts text to the length of a step description.
+func clipDescription(text string) string {
+	if len(text) > maxScreenshotDescBytes {
+		text = strings.ToValidUTF8(text[:maxScreenshotDescBytes], "")
+	}
+	return text
+}
+
+// assembleGuide drafts a guide from a session's screenshots and captions,
+// copying each step's image for the guide to keep.
+func assembleGuide(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	session.mu.Lock()
+	trashed := session.Status == SessionTrashed
+	title, description, workspaceID := session.Name, session.Description, session.WorkspaceID
+	tags, collectionID := append([]string(nil), session.Tags...), session.CollectionID
+	session.mu.Unlock()
+	if trashed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if session.E2EE {
+		rejectEncrypted(c, "guides")
+		return
+	}
+
+	steps, shots := draftSteps(screenshots.List(session.ID), captions.List(session.ID))
+	if len(steps) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "The session has no screenshots to make steps from"})
+		return
+	}
+	var size int64
+	for _, shot := range shots {
+		size += int64(shot.Size)
+	}
+	if breach := meter.reserveStorage(user.ID, workspaceID, size); breach != nil {
+		rejectQuota(c, breach)
+		return
+	}
+
+	guide := &Guide{
+		ID:           generateID(),
+		Title:        title,
+		Description:  description,
+		Status:       GuideDraft,
+		WorkspaceID:  workspaceID,
+		SessionID:    session.ID,
+		CreatedBy:    user.ID,
+		CreatedAt:    getCurrentTimestamp(),
+		Tags:         tags,
+		CollectionID: collectionID,
+	}
+	for i, shot := range shots {
+		data, err := blobs.Get(c.Request.Context(), shot.blobKey())
+		if err == nil {
+			err = blobs.Put(c.Request.Context(), stepBlobKey(guide.ID, steps[i].ID), data)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrBlobNotFound) {
+				logger.Warn("copying guide image failed", "guide", guide.ID, "screenshot", shot.ID, "error", err)
+			}
+			meter.releaseStorage(user.ID, workspaceID, int64(shot.Size))
+			continue
+		}
+		steps[i].Image = &GuideImage{ContentType: shot.ContentType, Size: shot.Size, Width: shot.Width, Height: shot.Height}
+	}
+	guide.Steps = steps
+	created := guides.add(guide)
+	if ocrEnabled() {
+		for i, shot := range shots {
+			if shot.OCRStatus == OCRPending && steps[i].Image != nil {
+				queueStepOCR(guide.ID, steps[i].ID)
+			}
+		}
+	}
+
+	auditRequest(c, "guide.create", "guide", created.ID, gin.H{"sessionId": session.ID, "steps": len(created.Steps)})
+	emitEvent(EventGuideCreated, created)
+	c.JSON(http.StatusCreated, created)
+}
+
+// getGuides lists the caller's personal guides and those of their
+// workspaces, narrowed to one workspace with ?workspaceId=, newest first.
+// Like sessions, they can be narrowed to those with every ?tag= given, to
+// a ?collectionId=, and by externalId and metadata.<key>. ?trashed=true lists the ones in the trash instead.
+func getGuides(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	visible := listingScope(c)
+	only := c.Query("workspaceId")
+	trashed := c.Query("trashed") == "true"
+	tags, collectionID := c.QueryArray("tag"), c.Query("collectionId")
+	query := c.Request.URL.Query()
+
+	guides.mu.Lock()
+	list := []Guide{}
+	for _, guide := range guides.Guides {
+		if (guide.TrashedAt != 0) != trashed || !hasTags(guide.Tags, tags) || !inCollection(guide.CollectionID, collectionID) ||
+			!matchesResourceFilter(query, guide.ExternalID, guide.Metadata) {
+			continue
+		}
+		if guide.WorkspaceID == "" && only == "" && guide.CreatedBy == user.ID ||
+			guide.WorkspaceID != "" && visible(guide.WorkspaceID) {
+			list = append(list, guide.snapshot())
+		}
+	}
+	guides.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt != list[j].CreatedAt {
+			return list[i].CreatedAt > list[j].CreatedAt
+		}
+		return list[i].ID < list[j].ID
+	})
+	c.JSON(http.StatusOK, gin.H{"guides": list})
+}
+
+func getGuide(c *gin.Context) {
+	user, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	favorites.viewed(user.ID, itemRef{Type: FavoriteGuide, ID: guide.ID})
+	c.JSON(http.StatusOK, guide)
+}
+
+type UpdateGuideRequest struct {
+	Title        *string            `json:"title" binding:"omitempty,min=1,max=200"`
+	Description  *string            `json:"description" binding:"omitempty,max=2000"`
+	Status       *string            `json:"status" binding:"omitempty,oneof=draft published"`
+	Tags         *[]string          `json:"tags"`
+	CollectionID *string            `json:"collectionId"`
+	ExternalID   *string            `json:"externalId"`
+	Metadata     map[string]*string `json:"metadata"`
+	// StepIDs reorders the steps. It must list every step once.
+	StepIDs []string `json:"stepIds"`
+}
+
+func updateGuide(c *gin.Context) {
+	var req UpdateGuideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Tags != nil {
+		if err := validateTags(*req.Tags); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	user, current, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	if req.CollectionID != nil {
+		if err := collections.checkMove(current.WorkspaceID, *req.CollectionID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.StepIDs != nil && guideStepsLocked(current.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Steps cannot be reordered while a co-editor holds a step lock"})
+		return
+	}
+	published := false
+	guide, err := guides.update(current.ID, user.ID, func(guide *Guide) error {
+		var steps []GuideStep
+		if req.StepIDs != nil {
+			var err error
+			if steps, err = reorderSteps(guide.Steps, req.StepIDs); err != nil {
+				return err
+			}
+		}
+		if req.ExternalID != nil && *req.ExternalID != "" && *req.ExternalID != guide.ExternalID && guides.externalIDTaken(guide, *req.ExternalID) {
+			return errExternalIDTaken
+		}
+		var metadata map[string]string
+		if req.Metadata != nil {
+			var err error
+			if metadata, err = mergeMetadata(guide.Metadata, req.Metadata); err != nil {
+				return err
+			}
+		}
+
+		if steps != nil {
+			guide.Steps = steps
+		}
+		if req.Title != nil {
+			guide.Title = *req.Title
+		}
+		if req.Description != nil {
+			guide.Description = *req.Description
+		}
+		if req.Status != nil {
+			published = guide.Status != GuidePublished && *req.Status == GuidePublished
+			guide.Status = *req.Status
+		}
+		if req.Tags != nil {
+			guide.Tags = append([]string(nil), *req.Tags...)
+		}
+		if req.CollectionID != nil {
+			guide.CollectionID = *req.CollectionID
+		}
+		if req.ExternalID != nil {
+			guide.ExternalID = *req.ExternalID
+		}
+		if req.Metadata != nil {
+			guide.Metadata = metadata
+		}
+		return nil
+	})
+	if !guideResult(c, err) {
+		return
+	}
+	auditRequest(c, "guide.update", "guide", guide.ID, gin.H{"status": guide.Status})
+	if published {
+		emitEvent(EventGuidePublished, guide)
+	}
+	c.JSON(http.StatusOK, guide)
+}
+
+func reorderSteps(steps []GuideStep, ids []string) ([]GuideStep, error) {
+	byID := make(map[string]GuideStep, len(steps))
+	for _, step := range steps {
+		byID[step.ID] = step
+	}
+	if len(ids) != len(steps) {
+		return nil, errors.New("stepIds must list every step once")
+	}
+	reordered := make([]GuideStep, 0, len(ids))
+	for _, id := range ids {
+		step, exists := byID[id]
+		if !exists {
+			return nil, errors.New("stepIds must list every step once")
+		}
+		delete(byID, id)
+		reordered = append(reordered, step)
+	}
+	return reordered, nil
+}
+
+// guideResult responds to a failed guide update and reports whether it
+// succeeded.
+func guideResult(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errGuideNotFound), errors.Is(err, errStepNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errExternalIDTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+	return false
+}
+
+// deleteGuide moves a guide to the trash, from where it can be restored
+// until the retention window passes. Deleting a trashed guide, passing
+// permanent=true, or running with no retention removes it for good.
+func deleteGuide(c *gin.Context) {
+	_, current, ok := findGuide(c, true)
+	if !ok {
+		return
+	}
+	if c.Query("permanent") == "true" || config.TrashRetention == 0 || current.TrashedAt != 0 {
+		guides.purge(current.ID)
+		auditRequest(c, "guide.purge", "guide", current.ID, gin.H{"title": current.Title})
+		c.Status(http.StatusNoContent)
+		return
+	}
+	guides.mu.Lock()
+	if guide, exists := guides.Guides[current.ID]; exists {
+		guide.TrashedAt = getCurrentTimestamp()
+		indexGuide(guide)
+	}
+	guides.mu.Unlock()
+	auditRequest(c, "guide.trash", "guide", current.ID, gin.H{"title": current.Title})
+	c.Status(http.StatusNoContent)
+}
+
+// purge deletes a guide for good.
+func (r *GuideRegistry) purge(id string) {
+	r.mu.Lock()
+	guide, exists := r.Guides[id]
+	delete(r.Guides, id)
+	r.mu.Unlock()
+	if exists {
+		discardGuide(guide)
+	}
+}
+
+func restoreGuide(c *gin.Context) {
+	_, current, ok := findGuide(c, true)
+	if !ok {
+		return
+	}
+	guides.mu.Lock()
+	guide, exists := guides.Guides[current.ID]
+	trashed := exists && guide.TrashedAt != 0
+	if trashed {
+		guide.TrashedAt = 0
+		indexGuide(guide)
+		current = guide.snapshot()
+	}
+	guides.mu.Unlock()
+	if !trashed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Guide is not in the trash"})
+		return
+	}
+	auditRequest(c, "guide.restore", "guide", current.ID, nil)
+	c.JSON(http.StatusOK, current)
+}
+
+// cloneGuide copies a guide the caller can see, with its steps and their
+// images, into a new draft that the caller owns. The copy is personal, or
+// in the ?workspaceId= workspace; it does not keep the session it came
+// from or its pushes.
+func cloneGuide(c *gin.Context) {
+	user, source, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	workspaceID := c.Query("workspaceId")
+	if workspaceID != "" && requireRole(c, workspaceID, RoleMember) == nil {
+		return
+	}
+	size := source.imageBytes()
+	if breach := meter.reserveStorage(user.ID, workspaceID, size); breach != nil {
+		rejectQuota(c, breach)
+		return
+	}
+
+	guide := &Guide{
+		ID:          generateID(),
+		Title:       source.Title,
+		Description: source.Description,
+		Status:      GuideDraft,
+		WorkspaceID: workspaceID,
+		CreatedBy:   user.ID,
+		CreatedAt:   getCurrentTimestamp(),
+		Tags:        source.Tags,
+		Metadata:    source.Metadata,
+		Steps:       make([]GuideStep, 0, len(source.Steps)),
+	}
+	// The copy stays in the source's collection only if it stays in its
+	// workspace.
+	if source.WorkspaceID == workspaceID {
+		guide.CollectionID = source.CollectionID
+	}
+	for _, step := range source.Steps {
+		copied := step
+		copied.ID = generateID()
+		if step.Image != nil {
+			image := *step.Image
+			copied.Image = &image
+			data, err := stepImage(c.Request.Context(), source.ID, step)
+			if err == nil && data != nil {
+				err = blobs.Put(c.Request.Context(), stepBlobKey(guide.ID, copied.ID), data)
+			}
+			if err != nil || data == nil {
+				if err != nil {
+					logger.Warn("copying guide image failed", "guide", guide.ID, "step", step.ID, "error", err)
+				}
+				meter.releaseStorage(user.ID, workspaceID, int64(image.Size))
+				copied.Image = nil
+			}
+		}
+		guide.Steps = append(guide.Steps, copied)
+	}
+	created := guides.add(guide)
+
+	auditRequest(c, "guide.clone", "guide", created.ID, gin.H{"from": source.ID, "workspaceId": workspaceID})
+	emitEvent(EventGuideCreated, created)
+	c.JSON(http.StatusCreated, created)
+}
+
+var errStepNotFound = errors.New("Step not found")
+
+type UpdateStepRequest struct {
+	Title       *string `json:"title" binding:"omitempty,min=1,max=200"`
+	Description *string `json:"description" binding:"omitempty,max=2000"`
+}
+
+func updateStep(c *gin.Context) {
+	var req UpdateStepRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, current, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	if guideStepsLocked(current.ID, c.Param("stepId")) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The step is locked by a co-editor"})
+		return
+	}
+	guide, err := guides.update(current.ID, user.ID, func(guide *Guide) error {
+		for i := range guide.Steps {
+			if guide.Steps[i].ID != c.Param("stepId") {
+				continue
+			}
+			if req.Title != nil {
+				guide.Steps[i].Title = *req.Title
+			}
+			if req.Description != nil {
+				guide.Steps[i].Description = *req.Description
+			}
+			return nil
+		}
+		return errStepNotFound
+	})
+	if !guideResult(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, guide)
+}
+
+func deleteStep(c *gin.Context) {
+	user, current, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	if guideStepsLocked(current.ID, c.Param("stepId")) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The step is locked by a co-editor"})
+		return
+	}
+	var removed GuideStep
+	var owner, workspaceID string
+	_, err := guides.update(current.ID, user.ID, func(guide *Guide) error {
+		for i, step := range guide.Steps {
+			if step.ID == c.Param("stepId") {
+				removed, owner, workspaceID = step, guide.CreatedBy, guide.WorkspaceID
+				guide.Steps = append(guide.Steps[:i:i], guide.Steps[i+1:]...)
+				return nil
+			}
+		}
+		return errStepNotFound
+	})
+	if !guideResult(c, err) {
+		return
+	}
+	dropStepImages(c.Request.Context(), current.ID, owner, workspaceID, []GuideStep{removed})
+	c.Status(http.StatusNoContent)
+}
+
+// dropStepImages deletes the images of steps removed from a guide and
+// gives their storage back to owner and workspaceID.
+func dropStepImages(ctx context.Context, guideID, owner, workspaceID string, steps []GuideStep) {
+	for _, step := range steps {
+		if step.Image == nil {
+			continue
+		}
+		meter.releaseStorage(owner, workspaceID, int64(step.Image.Size))
+		if err := blobs.Delete(ctx, stepBlobKey(guideID, step.ID)); err != nil {
+			logger.Warn("deleting guide image failed", "guide", guideID, "step", step.ID, "error", err)
+		}
+		imageVariants.Forget(stepBlobKey(guideID, step.ID))
+	}
+}
+
+func getStepImage(c *gin.Context) {
+	_, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	for _, step := range guide.Steps {
+		if step.ID != c.Param("stepId") || step.Image == nil {
+			continue
+		}
+		key, contentType := negotiateImage(c, stepBlobKey(guide.ID, step.ID), step.Image.ContentType)
+		if redirectToBlob(c, key, contentType, "") {
+			return
+		}
+		data, err := blobs.Get(c.Request.Context(), key)
+		if errors.Is(err, ErrBlobNotFound) {
+			break
+		}
+		if err != nil {
+			logger.Error("reading guide image failed", "guide", guide.ID, "step", step.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "The image could not be read"})
+			return
+		}
+		c.Header("Cache-Control", "private, max-age=86400")
+		c.Data(http.StatusOK, contentType, data)
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+}
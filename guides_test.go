@@ -0,0 +1,86 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func cloneRequest(user *User, guideID, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/guides/"+guideID+"/clone"+query, nil)
+	c.Params = gin.Params{{Key: "id", Value: guideID}}
+	c.Set("user", user)
+	cloneGuide(c)
+	return w
+}
+
+func TestCloneGuideCopiesStepsAndImages(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	author := &User{ID: "u_author"}
+	copier := &User{ID: "u_copier"}
+	workspaces.mu.Lock()
+	workspaces.Workspaces["ws_clone"] = &Workspace{ID: "ws_clone", Members: map[string]*Membership{
+		author.ID: {UserID: author.ID, Role: RoleOwner},
+		copier.ID: {UserID: copier.ID, Role: RoleMember},
+	}}
+	workspaces.mu.Unlock()
+
+	image := []byte("step image")
+	source := &Guide{
+		ID:          "g_source",
+		Title:       "Pay an invoice",
+		Status:      GuidePublished,
+		WorkspaceID: "ws_clone",
+		SessionID:   "s_source",
+		CreatedBy:   author.ID,
+		Steps: []GuideStep{
+			{ID: "st_1", Title: "Open billing", Image: &GuideImage{ContentType: "image/png", Size: len(image)}},
+			{ID: "st_2", Title: "Click pay"},
+		},
+	}
+	if err := blobs.Put(context.Background(), stepBlobKey(source.ID, "st_1"), image); err != nil {
+		t.Fatal(err)
+	}
+	guides.add(source)
+
+	w := cloneRequest(copier, source.ID, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("clone answered %d: %s", w.Code, w.Body)
+	}
+	var clone Guide
+	if err := json.Unmarshal(w.Body.Bytes(), &clone); err != nil {
+		t.Fatal(err)
+	}
+	if clone.ID == source.ID || clone.CreatedBy != copier.ID || clone.WorkspaceID != "" || clone.SessionID != "" || clone.Status != GuideDraft {
+		t.Errorf("clone = %+v, want a personal draft of %s owned by %s", clone, source.ID, copier.ID)
+	}
+	if len(clone.Steps) != 2 || clone.Steps[0].Title != "Open billing" || clone.Steps[1].Title != "Click pay" {
+		t.Fatalf("clone steps = %+v", clone.Steps)
+	}
+	if clone.Steps[0].ID == "st_1" || clone.Steps[1].ID == "st_2" {
+		t.Errorf("clone reuses step IDs: %+v", clone.Steps)
+	}
+	copied, err := blobs.Get(context.Background(), stepBlobKey(clone.ID, clone.Steps[0].ID))
+	if err != nil || !bytes.Equal(copied, image) {
+		t.Errorf("cloned image = %q, %v; want %q", copied, err, image)
+	}
+
+	w = cloneRequest(copier, source.ID, "?workspaceId=ws_clone")
+	if err := json.Unmarshal(w.Body.Bytes(), &clone); err != nil || w.Code != http.StatusCreated || clone.WorkspaceID != "ws_clone" {
+		t.Errorf("clone into workspace answered %d: %s", w.Code, w.Body)
+	}
+
+	if w := cloneRequest(copier, clone.ID, "?workspaceId=ws_elsewhere"); w.Code != http.StatusNotFound {
+		t.Errorf("clone into a workspace the caller is not in answered %d, want 404", w.Code)
+	}
+	if w := cloneRequest(&User{ID: "u_stranger"}, source.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("clone by a non-member answered %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,136 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	RolePresenter = "presenter"
+	RoleViewer    = "viewer"
+
+	handshakeTimeout   = 10 * time.Second
+	handshakeMaxBytes  = 4096
+	maxClientNameLen   = 64
+	maxClientFeatures  = 16
+	maxFeatureNameSize = 32
+)
+
+// JoinRequest is the handshake a client must complete before it is added to
+// a session, either as the first frame ({"type":"join","payload":{...}}) or
+// as query parameters on the upgrade request. A client reconnecting within
+// the grace window sends the id and resume token from its session_joined
+// message instead of a name and role.
+type JoinRequest struct {
+	Name           string   `json:"name"`
+	Role           string   `json:"role"`
+	Features       []string `json:"features"`
+	ResumeClientID string   `json:"resumeClientId"`
+	ResumeToken    string   `json:"resumeToken"`
+	// Token is an API token for clients that cannot send an Authorization
+	// header, such as browsers. It ties the connection to the user, who
+	// then gets their notifications over it.
+	Token string `json:"token"`
+}
+
+func (j *JoinRequest) validate() error {
+	if j.ResumeClientID != "" {
+		if j.ResumeToken == "" {
+			return errors.New("resumeToken is required to resume a client")
+		}
+		return nil
+	}
+
+	j.Name = strings.TrimSpace(j.Name)
+	if j.Name == "" || len(j.Name) > maxClientNameLen {
+		return fmt.Errorf("name must be 1-%d characters", maxClientNameLen)
+	}
+	if j.Role != RolePresenter && j.Role != RoleViewer {
+		return fmt.Errorf("role must be %s or %s", RolePresenter, RoleViewer)
+	}
+	if len(j.Features) > maxClientFeatures {
+		return fmt.Errorf("at most %d features may be declared", maxClientFeatures)
+	}
+	for _, feature := range j.Features {
+		if feature == "" || len(feature) > maxFeatureNameSize {
+			return fmt.Errorf("feature names must be 1-%d characters", maxFeatureNameSize)
+		}
+	}
+	return nil
+}
+
+// joinFromQuery reads the handshake from the upgrade request. It reports
+// false when the client did not use query parameters. The API token may
+// come as ?token= either way, and is signed in with before access is
+// resolved (see signInFromQuery).
+func joinFromQuery(c *gin.Context) (JoinRequest, bool) {
+	name, named := c.GetQuery("name")
+	resume, resuming := c.GetQuery("resumeClientId")
+	if !named && !resuming {
+		return JoinRequest{}, false
+	}
+	return JoinRequest{
+		Name:           name,
+		Role:           c.Query("role"),
+		Features:       splitList(c.Query("features")),
+		ResumeClientID: resume,
+		ResumeToken:    c.Query("resumeToken"),
+		Token:          c.Query("token"),
+	}, true
+}
+
+// signInFromQuery signs the caller in with the API token in ?token=,
+// which is how browsers authenticate the requests that open realtime
+// connections.
+// It is done before the session is looked up, so a member is let in, or
+// told why not, before the connection is upgraded.
+func signInFromQuery(c *gin.Context) {
+	signInWithToken(c, c.Query("token"))
+}
+
+// readJoin waits for the join frame on a freshly upgraded connection.
+func readJoin(conn *websocket.Conn) (JoinRequest, error) {
+	conn.SetReadLimit(handshakeMaxBytes)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, frame, err := conn.ReadMessage()
+	if err != nil {
+		return JoinRequest{}, err
+	}
+
+	msg, err := codecFor(conn).Decode(frame)
+	if err != nil {
+		return JoinRequest{}, err
+	}
+	if msg.Type != "join" {
+		return JoinRequest{}, errors.New("the first message must be a join")
+	}
+
+	var join JoinRequest
+	if err := json.Unmarshal(msg.Payload, &join); err != nil {
+		return JoinRequest{}, errors.New("join payload must be an object with name, role and features")
+	}
+	return join, nil
+}
+
+// rejectHandshake tells the client why it was not admitted and closes the
+// connection.
+func rejectHandshake(conn *websocket.Conn, err error) {
+	sendMessage(conn, Message{
+		Type: "error",
+		Payload: gin.H{
+			"code":    "handshake_required",
+			"message": err.Error(),
+		},
+	})
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "handshake required"), time.Now().Add(time.Second))
+	conn.Close()
+}
@@ -0,0 +1,94 @@
+package tango
+
+import (
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const storeProbeTimeout = time.Second
+
+var (
+	startedAt = time.Now()
+	draining  int32
+)
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// probeStore reports whether the store lock can be taken promptly. A lock
+// held for longer than storeProbeTimeout means the instance is wedged.
+func probeStore() bool {
+	acquired := make(chan struct{})
+	go func() {
+		store.mu.Lock()
+		store.mu.Unlock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return true
+	case <-time.After(storeProbeTimeout):
+		return false
+	}
+}
+
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "ok",
+		"uptime":    time.Since(startedAt).Round(time.Second).String(),
+		"startedAt": startedAt.Unix(),
+	})
+}
+
+func livez(c *gin.Context) {
+	storeOK := probeStore()
+
+	status := http.StatusOK
+	if !storeOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	c.JSON(status, gin.H{
+		"status": statusText(storeOK),
+		"checks": gin.H{
+			"store":      statusText(storeOK),
+			"goroutines": runtime.NumGoroutine(),
+			// Anything but zero means the random source is suspect.
+			"idCollisions": atomic.LoadInt64(&idCollisions),
+		},
+	})
+}
+
+func readyz(c *gin.Context) {
+	storeOK := probeStore()
+	notDraining := !isDraining()
+	standby := replicator.IsStandby()
+	ready := storeOK && notDraining && !standby
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	c.JSON(status, gin.H{
+		"status": statusText(ready),
+		"checks": gin.H{
+			"store":    statusText(storeOK),
+			"draining": !notDraining,
+			"standby":  standby,
+		},
+	})
+}
+
+func statusText(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "fail"
+}
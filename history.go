@@ -0,0 +1,398 @@
+package tango
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxSessionVersions = 500
+
+// How a version came about.
+const (
+	VersionCreated           = "created"
+	VersionInitial           = "initial"
+	VersionUpdated           = "updated"
+	VersionBulkUpdated       = "bulk_updated"
+	VersionCollectionDeleted = "collection_deleted"
+	VersionRolledBack        = "rolled_back"
+	VersionEdited            = "edited"
+)
+
+// SessionDetails are the editable details of a session, which is what its
+// versions capture.
+type SessionDetails struct {
+	Name              string            `json:"name"`
+	Description       string            `json:"description,omitempty"`
+	Tags              []string          `json:"tags"`
+	Metadata          map[string]string `json:"metadata"`
+	CollectionID      string            `json:"collectionId,omitempty"`
+	ViewerAnnotations bool              `json:"viewerAnnotations"`
+	MaxFPS            int               `json:"maxFps,omitempty"`
+}
+
+// detailsOf copies the session's details. Callers must hold session.mu.
+func detailsOf(session *Session) SessionDetails {
+	details := SessionDetails{
+		Name:              session.Name,
+		Description:       session.Description,
+		Tags:              append([]string{}, session.Tags...),
+		Metadata:          make(map[string]string, len(session.Metadata)),
+		CollectionID:      session.CollectionID,
+		ViewerAnnotations: session.ViewerAnnotations,
+		MaxFPS:            session.MaxFPS,
+	}
+	for key, value := range session.Metadata {
+		details.Metadata[key] = value
+	}
+	return details
+}
+
+// SessionVersion is the details of a session after one change to them. A
+// version is never changed once recorded; rolling back records a new one.
+type SessionVersion struct {
+	Version      int            `json:"version"`
+	SessionID    string         `json:"sessionId"`
+	Details      SessionDetails `json:"details"`
+	Change       string         `json:"change"`
+	AuthorID     string         `json:"authorId,omitempty"`
+	RestoredFrom int            `json:"restoredFrom,omitempty"`
+	CreatedAt    int64          `json:"createdAt"`
+}
+
+// VersionHistory keeps the most recent versions of each session, oldest
+// first.
+type VersionHistory struct {
+	versions map[string][]*SessionVersion
+	mu       sync.Mutex
+}
+
+var sessionHistory = &VersionHistory{versions: make(map[string][]*SessionVersion)}
+
+// append adds a version of the session's details unless they are the same
+// as the latest. Callers must hold h.mu.
+func (h *VersionHistory) append(sessionID string, version SessionVersion) {
+	versions := h.versions[sessionID]
+	next := 1
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		if reflect.DeepEqual(latest.Details, version.Details) {
+			return
+		}
+		next = latest.Version + 1
+	}
+	version.Version = next
+	version.SessionID = sessionID
+	version.CreatedAt = getCurrentTimestamp()
+	versions = append(versions, &version)
+	if len(versions) > maxSessionVersions {
+		versions = versions[len(versions)-maxSessionVersions:]
+	}
+	h.versions[sessionID] = versions
+}
+
+// created records the first version of a new session. Callers must hold
+// session.mu.
+func (h *VersionHistory) created(session *Session, authorID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.append(session.ID, SessionVersion{Details: detailsOf(session), Change: VersionCreated, AuthorID: authorID})
+}
+
+// baseline records details as the first version of a session with no
+// history yet, such as one restored from disk. Callers must hold h.mu.
+func (h *VersionHistory) baseline(session *Session, details SessionDetails) {
+	if len(h.versions[session.ID]) == 0 {
+		h.append(session.ID, SessionVersion{Details: details, Change: VersionInitial, AuthorID: session.CreatedBy})
+	}
+}
+
+// edited records the session's details after a change. before is what they
+// were, kept as the first version if there is none. Callers must hold
+// session.mu.
+func (h *VersionHistory) edited(session *Session, before SessionDetails, authorID, change string, restoredFrom int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.baseline(session, before)
+	h.append(session.ID, SessionVersion{Details: detailsOf(session), Change: change, AuthorID: authorID, RestoredFrom: restoredFrom})
+}
+
+func (h *VersionHistory) list(sessionID string) []SessionVersion {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	versions := h.versions[sessionID]
+	list := make([]SessionVersion, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		list = append(list, *versions[i])
+	}
+	return list
+}
+
+// get returns a version of the session; 0 means the latest.
+func (h *VersionHistory) get(sessionID string, version int) (SessionVersion, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	versions := h.versions[sessionID]
+	if len(versions) == 0 {
+		return SessionVersion{}, false
+	}
+	if version == 0 {
+		return *versions[len(versions)-1], true
+	}
+	for _, v := range versions {
+		if v.Version == version {
+			return *v, true
+		}
+	}
+	return SessionVersion{}, false
+}
+
+func (h *VersionHistory) Forget(sessionID string) {
+	h.mu.Lock()
+	delete(h.versions, sessionID)
+	h.mu.Unlock()
+}
+
+// forgetAuthor drops a deleted user's name from the versions they made.
+func (h *VersionHistory) forgetAuthor(userID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, versions := range h.versions {
+		for i, v := range versions {
+			if v.AuthorID == userID {
+				anonymous := *v
+				anonymous.AuthorID = ""
+				versions[i] = &anonymous
+			}
+		}
+	}
+}
+
+// FieldChange is one changed value in a diff.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// VersionDiff is what changed between two versions of a session: the plain
+// fields that differ, the tags added and removed and whether the tags kept
+// were reordered, and the metadata keys added, removed and changed.
+type VersionDiff struct {
+	From            int               `json:"from"`
+	To              int               `json:"to"`
+	Fields          []FieldChange     `json:"fields"`
+	TagsAdded       []string          `json:"tagsAdded"`
+	TagsRemoved     []string          `json:"tagsRemoved"`
+	TagsReordered   bool              `json:"tagsReordered"`
+	MetadataAdded   map[string]string `json:"metadataAdded"`
+	MetadataRemoved map[string]string `json:"metadataRemoved"`
+	MetadataChanged []FieldChange     `json:"metadataChanged"`
+}
+
+func diffVersions(from, to SessionVersion) VersionDiff {
+	a, b := from.Details, to.Details
+	diff := VersionDiff{
+		From:            from.Version,
+		To:              to.Version,
+		Fields:          []FieldChange{},
+		TagsAdded:       []string{},
+		TagsRemoved:     []string{},
+		MetadataAdded:   map[string]string{},
+		MetadataRemoved: map[string]string{},
+		MetadataChanged: []FieldChange{},
+	}
+	for _, f := range []FieldChange{
+		{"name", a.Name, b.Name},
+		{"description", a.Description, b.Description},
+		{"collectionId", a.CollectionID, b.CollectionID},
+		{"viewerAnnotations", a.ViewerAnnotations, b.ViewerAnnotations},
+		{"maxFps", a.MaxFPS, b.MaxFPS},
+	} {
+		if f.From != f.To {
+			diff.Fields = append(diff.Fields, f)
+		}
+	}
+
+	diff.TagsAdded, diff.TagsRemoved, diff.TagsReordered = diffTags(a.Tags, b.Tags)
+
+	for key, value := range a.Metadata {
+		if other, exists := b.Metadata[key]; !exists {
+			diff.MetadataRemoved[key] = value
+		} else if other != value {
+			diff.MetadataChanged = append(diff.MetadataChanged, FieldChange{Field: key, From: value, To: other})
+		}
+	}
+	for key, value := range b.Metadata {
+		if _, exists := a.Metadata[key]; !exists {
+			diff.MetadataAdded[key] = value
+		}
+	}
+	sort.Slice(diff.MetadataChanged, func(i, j int) bool { return diff.MetadataChanged[i].Field < diff.MetadataChanged[j].Field })
+	return diff
+}
+
+// diffTags compares two tag lists: the tags only in b, those only in a,
+// and whether the tags in both are in a different order.
+func diffTags(a, b []string) (added, removed []string, reordered bool) {
+	added, removed = []string{}, []string{}
+	var keptA, keptB []string
+	for _, tag := range a {
+		if containsString(b, tag) {
+			keptA = append(keptA, tag)
+		} else {
+			removed = append(removed, tag)
+		}
+	}
+	for _, tag := range b {
+		if containsString(a, tag) {
+			keptB = append(keptB, tag)
+		} else {
+			added = append(added, tag)
+		}
+	}
+	return added, removed, !reflect.DeepEqual(keptA, keptB)
+}
+
+// versionParam parses a version number from the path or query, answering
+// 400 if it is not a positive number.
+func versionParam(c *gin.Context, name, value string) (int, bool) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be a version number"})
+		return 0, false
+	}
+	return n, true
+}
+
+// historySession looks up the session named in the path for the version
+// endpoints, making sure it has a first version to show.
+func historySession(c *gin.Context) *Session {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return nil
+	}
+	session.mu.Lock()
+	sessionHistory.mu.Lock()
+	sessionHistory.baseline(session, detailsOf(session))
+	sessionHistory.mu.Unlock()
+	session.mu.Unlock()
+	return session
+}
+
+func getSessionVersions(c *gin.Context) {
+	session := historySession(c)
+	if session == nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": sessionHistory.list(session.ID)})
+}
+
+func getSessionVersion(c *gin.Context) {
+	session := historySession(c)
+	if session == nil {
+		return
+	}
+	n, ok := versionParam(c, "version", c.Param("version"))
+	if !ok {
+		return
+	}
+	version, exists := sessionHistory.get(session.ID, n)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	c.JSON(http.StatusOK, version)
+}
+
+// diffSessionVersions compares version from with version to, the latest
+// if not given.
+func diffSessionVersions(c *gin.Context) {
+	session := historySession(c)
+	if session == nil {
+		return
+	}
+	from, ok := versionParam(c, "from", c.Query("from"))
+	if !ok {
+		return
+	}
+	to := 0
+	if value := c.Query("to"); value != "" {
+		if to, ok = versionParam(c, "to", value); !ok {
+			return
+		}
+	}
+	a, existsA := sessionHistory.get(session.ID, from)
+	b, existsB := sessionHistory.get(session.ID, to)
+	if !existsA || !existsB {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	c.JSON(http.StatusOK, diffVersions(a, b))
+}
+
+// rollbackSession puts a session's details back as they were in an earlier
+// version, recording that as a new version.
+func rollbackSession(c *gin.Context) {
+	session := historySession(c)
+	if session == nil {
+		return
+	}
+	n, ok := versionParam(c, "version", c.Param("version"))
+	if !ok {
+		return
+	}
+	version, exists := sessionHistory.get(session.ID, n)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	target := version.Details
+
+	session.mu.Lock()
+	if session.Status == SessionTrashed {
+		session.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "Session is in the trash; restore it first"})
+		return
+	}
+	if err := collections.checkMove(session.WorkspaceID, target.CollectionID); err != nil {
+		session.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "Cannot roll back: " + err.Error()})
+		return
+	}
+	if field := editLockHeld(session, EditFieldName, EditFieldDescription, EditFieldTags); field != "" {
+		session.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "Cannot roll back while the " + field + " is locked by a co-editor"})
+		return
+	}
+	settleEdits(session)
+	before := detailsOf(session)
+	session.Name = target.Name
+	session.Description = target.Description
+	session.Tags = append([]string{}, target.Tags...)
+	session.Metadata = make(map[string]string, len(target.Metadata))
+	for key, value := range target.Metadata {
+		session.Metadata[key] = value
+	}
+	session.CollectionID = target.CollectionID
+	session.ViewerAnnotations = target.ViewerAnnotations
+	session.MaxFPS = target.MaxFPS
+	authorID := ""
+	if user := currentUser(c); user != nil {
+		authorID = user.ID
+	}
+	sessionHistory.edited(session, before, authorID, VersionRolledBack, n)
+	syncEdits(session)
+	emitEvent(EventSessionUpdated, session)
+	c.JSON(http.StatusOK, session)
+	update := sessionUpdate(session)
+	session.mu.Unlock()
+
+	auditRequest(c, "session.rollback", "session", session.ID, gin.H{"version": n})
+	broadcastToSession(requestSpan(c), session.ID, Message{Type: "session_updated", Payload: update}, "")
+}
@@ -0,0 +1,98 @@
+package tango
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// idCollisions counts generated IDs that were already taken in the store.
+// Accessed atomically.
+var idCollisions int64
+
+// randomBytes fills b from crypto/rand. IDs and tokens guessed from a
+// weak source would let anyone join or resume other people's sessions, so
+// there is no fallback.
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand unavailable: " + err.Error())
+	}
+}
+
+// randomToken returns n random bytes, URL-safe base64 encoded.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	randomBytes(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// generateID returns an opaque 96-bit random ID for records that are not
+// looked up by untrusted callers often enough to need a collision check.
+func generateID() string {
+	return "id_" + randomToken(12)
+}
+
+// ulidSource produces ULIDs: a 48-bit millisecond timestamp followed by 80
+// random bits, so IDs sort by creation time to the millisecond. The random
+// part is drawn afresh for every ID, even within a millisecond: the
+// monotonic variant increments it instead, which would let anyone holding
+// one session ID work out the IDs of sessions created next to it.
+type ulidSource struct{}
+
+var ulids ulidSource
+
+func (ulidSource) next(now time.Time) string {
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	var id [16]byte
+	binary.BigEndian.PutUint16(id[:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	randomBytes(id[6:])
+	return encodeULID(id)
+}
+
+// encodeULID writes the 128-bit id as 26 Crockford base32 characters.
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// newSessionID returns a ULID not yet used by any session. Callers must
+// hold s.mu for writing and insert the session before releasing it.
+func (s *InMemoryStore) newSessionID() string {
+	return uniqueID(func() string { return ulids.next(time.Now()) }, func(id string) bool {
+		_, taken := s.Sessions[id]
+		return taken
+	})
+}
+
+// newClientID returns a client ID not yet used by any connected client.
+// Callers must hold s.mu for writing and insert the client before
+// releasing it.
+func (s *InMemoryStore) newClientID() string {
+	return uniqueID(generateID, func(id string) bool {
+		_, taken := s.Clients[id]
+		return taken
+	})
+}
+
+func uniqueID(generate func() string, taken func(string) bool) string {
+	for attempt := 1; ; attempt++ {
+		id := generate()
+		if !taken(id) {
+			return id
+		}
+		atomic.AddInt64(&idCollisions, 1)
+		logger.Warn("generated id collided with an existing one", "id", id, "attempt", attempt)
+	}
+}
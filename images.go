@@ -0,0 +1,208 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ImageAVIF = "avif"
+	ImageWebP = "webp"
+
+	transcodeTimeout = 30 * time.Second
+)
+
+var imageFormatTypes = map[string]string{
+	ImageAVIF: "image/avif",
+	ImageWebP: "image/webp",
+}
+
+// errVariantLarger marks a variant that came out no smaller than the
+// original, which is served instead.
+var errVariantLarger = errors.New("the variant is not smaller than the original")
+
+// imageVariant is an image transcoded to another format. ready is closed
+// once the variant is stored or has failed.
+type imageVariant struct {
+	ready chan struct{}
+	err   error
+}
+
+// ImageVariants caches screenshots and guide images transcoded to the
+// formats clients accept, in the BlobStore beside the originals. A variant
+// is made by the first request that asks for it; others wait for it.
+type ImageVariants struct {
+	variants map[string]*imageVariant
+	mu       sync.Mutex
+}
+
+var imageVariants = &ImageVariants{variants: make(map[string]*imageVariant)}
+
+func variantKey(key, format string) string {
+	return "variants/" + format + "/" + key
+}
+
+var (
+	transcoderOnce  sync.Once
+	transcoderFound bool
+)
+
+// canTranscode reports whether ffmpeg is there to make variants with.
+func canTranscode() bool {
+	transcoderOnce.Do(func() {
+		_, err := exec.LookPath(config.FFmpegCommand)
+		transcoderFound = err == nil
+	})
+	return transcoderFound
+}
+
+// acceptedFormat picks the first of the configured formats the request's
+// Accept header names, or "" if it names none. Wildcards do not count, as
+// browsers send them for every image.
+func acceptedFormat(c *gin.Context) string {
+	accepted := make(map[string]bool)
+	for _, item := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && name == "q" {
+				quality, _ = strconv.ParseFloat(value, 64)
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(mediaType))] = quality > 0
+	}
+	for _, format := range config.ImageFormats {
+		if accepted[imageFormatTypes[format]] {
+			return format
+		}
+	}
+	return ""
+}
+
+// negotiateImage returns the key and type to serve the image at key in:
+// a variant in a format the client prefers, made now if need be, or the
+// original. Responses differ by Accept either way.
+func negotiateImage(c *gin.Context, key, contentType string) (string, string) {
+	c.Header("Vary", "Accept")
+	format := acceptedFormat(c)
+	if format == "" || !canTranscode() {
+		return key, contentType
+	}
+	if err := imageVariants.get(c.Request.Context(), key, format); err != nil {
+		if err != errVariantLarger {
+			logger.Warn("transcoding image failed", "key", key, "format", format, "error", err)
+		}
+		return key, contentType
+	}
+	return variantKey(key, format), imageFormatTypes[format]
+}
+
+// get makes sure the variant of key in format is stored. A failure is
+// remembered, so the image is not transcoded again on every request.
+func (v *ImageVariants) get(ctx context.Context, key, format string) error {
+	v.mu.Lock()
+	variant, exists := v.variants[variantKey(key, format)]
+	if !exists {
+		variant = &imageVariant{ready: make(chan struct{})}
+		v.variants[variantKey(key, format)] = variant
+	}
+	v.mu.Unlock()
+	if exists {
+		select {
+		case <-variant.ready:
+			return variant.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// The variant outlives the request that made it.
+	variant.err = v.make(context.Background(), key, format)
+	close(variant.ready)
+	return variant.err
+}
+
+func (v *ImageVariants) make(ctx context.Context, key, format string) error {
+	original, err := blobs.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	data, err := transcodeImage(ctx, original, format)
+	if err != nil {
+		return err
+	}
+	if len(data) >= len(original) {
+		return errVariantLarger
+	}
+	return blobs.Put(ctx, variantKey(key, format), data)
+}
+
+// Forget deletes the variants of the images at keys, once any being made
+// are done.
+func (v *ImageVariants) Forget(keys ...string) {
+	forgotten := make(map[string]*imageVariant)
+	v.mu.Lock()
+	for _, key := range keys {
+		for format := range imageFormatTypes {
+			if variant, exists := v.variants[variantKey(key, format)]; exists {
+				delete(v.variants, variantKey(key, format))
+				forgotten[variantKey(key, format)] = variant
+			}
+		}
+	}
+	v.mu.Unlock()
+	if len(forgotten) == 0 {
+		return
+	}
+	go func() {
+		for key, variant := range forgotten {
+			if <-variant.ready; variant.err != nil {
+				continue
+			}
+			if err := blobs.Delete(context.Background(), key); err != nil {
+				logger.Warn("deleting image variant failed", "key", key, "error", err)
+			}
+		}
+	}()
+}
+
+// transcodeImage has ffmpeg encode a PNG or JPEG image as WebP or AVIF. The
+// output goes to a file, as the AVIF muxer needs to seek.
+func transcodeImage(ctx context.Context, data []byte, format string) ([]byte, error) {
+	out, err := os.CreateTemp("", "tango-image-*."+format)
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-f", "image2pipe", "-i", "-", "-frames:v", "1"}
+	switch format {
+	case ImageWebP:
+		args = append(args, "-c:v", "libwebp", "-quality", "80")
+	case ImageAVIF:
+		args = append(args, "-c:v", "libaom-av1", "-still-picture", "1", "-crf", "32", "-cpu-used", "6", "-pix_fmt", "yuv420p")
+	default:
+		return nil, fmt.Errorf("cannot transcode to %s", format)
+	}
+	ctx, cancel := context.WithTimeout(ctx, transcodeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, config.FFmpegCommand, append(args, "-y", out.Name())...)
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return os.ReadFile(out.Name())
+}
@@ -0,0 +1,41 @@
+package tango
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+func expireIdleSessions(now int64) int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	expired := 0
+	for id, session := range store.Sessions {
+		session.mu.Lock()
+		if session.Status == SessionTrashed || session.IdleTTL <= 0 || session.IdleSince == 0 ||
+			len(session.Clients) > 0 || now-session.IdleSince < int64(session.IdleTTL) {
+			session.mu.Unlock()
+			continue
+		}
+
+		delete(store.Sessions, id)
+		workspaces.forgetSession(id)
+		detector.Forget("session:" + id)
+		annotations.Forget(id)
+		polls.Forget(id)
+		questions.Forget(id)
+		captions.Forget(id)
+		chat.Forget(id)
+		screenshots.Forget(session)
+		recordings.Forget(session)
+		comments.Forget(id)
+		sessionHistory.Forget(id)
+		calendars.forgetSession(id)
+		favorites.forgetItem(itemRef{Type: FavoriteSession, ID: id})
+		go sfu.Close(id)
+		emitEvent(EventSessionExpired, session)
+		audit.Record(ActorSystem, "session.expire", "session", id, "", gin.H{"reason": "idle"})
+		session.mu.Unlock()
+		expired++
+	}
+	return expired
+}
@@ -0,0 +1,170 @@
+package tango
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const journalMaxEvents = 10000
+
+type JournalEntry struct {
+	Seq       int64  `json:"seq"`
+	Event     string `json:"event"`
+	SessionID string `json:"sessionId"`
+	ClientID  string `json:"clientId,omitempty"`
+	At        int64  `json:"at"`
+}
+
+// Journal keeps an ordered, bounded log of lifecycle events per session so
+// past membership can be replayed for debugging and abuse investigations.
+type Journal struct {
+	entries   map[string][]JournalEntry
+	truncated map[string]bool
+	seq       int64
+	mu        sync.Mutex
+}
+
+func NewJournal() *Journal {
+	return &Journal{
+		entries:   make(map[string][]JournalEntry),
+		truncated: make(map[string]bool),
+	}
+}
+
+var journal = NewJournal()
+
+func (j *Journal) Record(event string, payload interface{}) {
+	sessionID, clientID := eventSubject(payload)
+	if sessionID == "" {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq++
+	entries := append(j.entries[sessionID], JournalEntry{
+		Seq:       j.seq,
+		Event:     event,
+		SessionID: sessionID,
+		ClientID:  clientID,
+		At:        time.Now().UnixMilli(),
+	})
+	if len(entries) > journalMaxEvents {
+		entries = entries[len(entries)-journalMaxEvents:]
+		j.truncated[sessionID] = true
+	}
+	j.entries[sessionID] = entries
+}
+
+func (j *Journal) Forget(sessionID string) {
+	j.mu.Lock()
+	delete(j.entries, sessionID)
+	delete(j.truncated, sessionID)
+	j.mu.Unlock()
+}
+
+type MemberSnapshot struct {
+	ClientID string `json:"clientId"`
+	JoinedAt int64  `json:"joinedAt"`
+}
+
+type SessionSnapshot struct {
+	SessionID string           `json:"sessionId"`
+	At        int64            `json:"at"`
+	Exists    bool             `json:"exists"`
+	Status    string           `json:"status,omitempty"`
+	Members   []MemberSnapshot `json:"members"`
+	Events    int              `json:"eventsReplayed"`
+	Truncated bool             `json:"truncated"`
+}
+
+// StateAt replays the journal for sessionID up to and including at, a unix
+// time in milliseconds.
+func (j *Journal) StateAt(sessionID string, at int64) (SessionSnapshot, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries, exists := j.entries[sessionID]
+	if !exists {
+		return SessionSnapshot{}, false
+	}
+
+	snapshot := SessionSnapshot{
+		SessionID: sessionID,
+		At:        at,
+		Members:   []MemberSnapshot{},
+		Truncated: j.truncated[sessionID],
+	}
+	members := make(map[string]int64)
+	var trashedFrom string
+
+	for _, entry := range entries {
+		if entry.At > at {
+			break
+		}
+		snapshot.Events++
+
+		switch entry.Event {
+		case EventSessionCreated:
+			snapshot.Exists = true
+			snapshot.Status = SessionScheduled
+		case EventClientJoined:
+			members[entry.ClientID] = entry.At
+			snapshot.Status = SessionLive
+		case EventSessionStarted:
+			snapshot.Status = SessionLive
+		case EventClientLeft:
+			delete(members, entry.ClientID)
+		case EventSessionEnded:
+			snapshot.Status = SessionEnded
+			members = make(map[string]int64)
+		case EventSessionArchived:
+			snapshot.Status = SessionArchived
+		case EventSessionTrashed:
+			trashedFrom = snapshot.Status
+			snapshot.Status = SessionTrashed
+			members = make(map[string]int64)
+		case EventSessionRestored:
+			snapshot.Status = trashedFrom
+		case EventSessionDeleted:
+			snapshot.Exists = false
+			snapshot.Status = ""
+			members = make(map[string]int64)
+		}
+	}
+
+	for clientID, joinedAt := range members {
+		snapshot.Members = append(snapshot.Members, MemberSnapshot{ClientID: clientID, JoinedAt: joinedAt})
+	}
+	sort.Slice(snapshot.Members, func(a, b int) bool {
+		return snapshot.Members[a].JoinedAt < snapshot.Members[b].JoinedAt
+	})
+	return snapshot, true
+}
+
+func getSessionStateAt(c *gin.Context) {
+	id := c.Param("id")
+
+	at := time.Now().UnixMilli()
+	if raw := c.Query("at"); raw != "" {
+		seconds, err := parseQueryTime(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "at must be a date, RFC 3339 time or unix timestamp"})
+			return
+		}
+		at = seconds*1000 + 999
+	}
+
+	snapshot, exists := journal.StateAt(id, at)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No history for session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, snapshot)
+}
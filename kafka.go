@@ -0,0 +1,422 @@
+package tango
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kafka API keys and versions the publisher speaks: Produce v3 is the first
+// with record batches, which carry headers, and Metadata v1 the first that
+// says which broker is the controller.
+const (
+	kafkaProduce     = 0
+	kafkaMetadata    = 3
+	kafkaProduceV    = 3
+	kafkaMetadataV   = 1
+	kafkaAcksAll     = -1
+	kafkaMaxResponse = 16 << 20
+)
+
+// Kafka error codes after which the partition leaders must be looked up
+// again.
+var kafkaStaleMetadata = map[int16]bool{
+	3:  true, // UNKNOWN_TOPIC_OR_PARTITION
+	5:  true, // LEADER_NOT_AVAILABLE
+	6:  true, // NOT_LEADER_OR_FOLLOWER
+	74: true, // FENCED_LEADER_EPOCH
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaPublisher produces to a Kafka topic over the Kafka wire protocol,
+// which for a producer of single records is small enough not to need a
+// client library. It looks up the topic's partitions and their leaders from
+// the configured brokers, hashes each event's key to a partition so a
+// session's events stay in order, and waits for all in-sync replicas to
+// have the record. A failed connection or a stale leader drops what it knew
+// and looks it up again on the next publish.
+type kafkaPublisher struct {
+	brokers []string
+	topic   string
+
+	mu          sync.Mutex
+	correlation int32
+	leaders     []string // broker address by partition
+	conns       map[string]*kafkaConn
+}
+
+type kafkaConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newKafkaPublisher(cfg PublishConfig) (eventPublisher, error) {
+	return &kafkaPublisher{brokers: cfg.URLs, topic: cfg.Topic, conns: make(map[string]*kafkaConn)}, nil
+}
+
+func (k *kafkaPublisher) Publish(ctx context.Context, key string, event []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.leaders == nil {
+		if err := k.lookup(ctx); err != nil {
+			return err
+		}
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	partition := int32(hash.Sum32() % uint32(len(k.leaders)))
+	leader := k.leaders[partition]
+
+	var req kafkaEncoder
+	req.string(nil) // no transactional ID
+	req.int16(kafkaAcksAll)
+	req.int32(int32(outboundTimeout / time.Millisecond))
+	req.int32(1)
+	req.string(&k.topic)
+	req.int32(1)
+	req.int32(partition)
+	req.bytes(kafkaRecordBatch([]byte(key), event, time.Now()))
+
+	resp, err := k.call(ctx, leader, kafkaProduce, kafkaProduceV, req.buf)
+	if err != nil {
+		return err
+	}
+	var code int16
+	for topics := resp.int32(); topics > 0 && resp.err == nil; topics-- {
+		resp.string()
+		for partitions := resp.int32(); partitions > 0 && resp.err == nil; partitions-- {
+			resp.int32()
+			if c := resp.int16(); c != 0 {
+				code = c
+			}
+			resp.int64() // base offset
+			resp.int64() // log append time
+		}
+	}
+	if resp.err != nil {
+		k.drop(leader)
+		return fmt.Errorf("kafka %s: %v", leader, resp.err)
+	}
+	if code != 0 {
+		if kafkaStaleMetadata[code] {
+			k.leaders = nil
+		}
+		return fmt.Errorf("kafka %s: produce failed with error code %d", leader, code)
+	}
+	return nil
+}
+
+func (k *kafkaPublisher) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var err error
+	for addr, c := range k.conns {
+		if closeErr := c.conn.Close(); err == nil {
+			err = closeErr
+		}
+		delete(k.conns, addr)
+	}
+	k.leaders = nil
+	return err
+}
+
+// lookup asks the configured brokers in turn for the leaders of the topic's
+// partitions. Callers must hold k.mu.
+func (k *kafkaPublisher) lookup(ctx context.Context) error {
+	var req kafkaEncoder
+	req.int32(1)
+	req.string(&k.topic)
+
+	var err error
+	for _, broker := range k.brokers {
+		var resp *kafkaDecoder
+		if resp, err = k.call(ctx, broker, kafkaMetadata, kafkaMetadataV, req.buf); err != nil {
+			continue
+		}
+		if err = k.readMetadata(resp); err == nil {
+			return nil
+		}
+		err = fmt.Errorf("kafka %s: %v", broker, err)
+	}
+	return err
+}
+
+func (k *kafkaPublisher) readMetadata(resp *kafkaDecoder) error {
+	addrs := make(map[int32]string)
+	for brokers := resp.int32(); brokers > 0 && resp.err == nil; brokers-- {
+		id := resp.int32()
+		host := resp.string()
+		port := resp.int32()
+		resp.string() // rack
+		addrs[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	resp.int32() // controller
+
+	var leaders []string
+	for topics := resp.int32(); topics > 0 && resp.err == nil; topics-- {
+		code := resp.int16()
+		name := resp.string()
+		resp.int8() // internal
+		partitions := resp.int32()
+		if partitions < 0 || partitions > 1<<16 {
+			return errors.New("malformed metadata")
+		}
+		found := make([]string, partitions)
+		for i := int32(0); i < partitions && resp.err == nil; i++ {
+			resp.int16()
+			id := resp.int32()
+			leader := resp.int32()
+			resp.int32Array() // replicas
+			resp.int32Array() // in-sync replicas
+			if id >= 0 && id < partitions {
+				found[id] = addrs[leader]
+			}
+		}
+		if name != k.topic {
+			continue
+		}
+		if code != 0 {
+			return fmt.Errorf("topic %s: error code %d", k.topic, code)
+		}
+		leaders = found
+	}
+	if resp.err != nil {
+		return resp.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("topic %s has no partitions", k.topic)
+	}
+	for partition, leader := range leaders {
+		if leader == "" {
+			return fmt.Errorf("partition %d of %s has no leader", partition, k.topic)
+		}
+	}
+	k.leaders = leaders
+	return nil
+}
+
+// call sends a request to a broker and reads its response, dialling the
+// broker first if need be. Callers must hold k.mu.
+func (k *kafkaPublisher) call(ctx context.Context, addr string, apiKey, version int16, body []byte) (*kafkaDecoder, error) {
+	c, err := k.connect(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(outboundTimeout)
+	}
+	c.conn.SetDeadline(deadline)
+
+	k.correlation++
+	client := "tango"
+	var req kafkaEncoder
+	req.int32(0) // size, filled in below
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(k.correlation)
+	req.string(&client)
+	req.buf = append(req.buf, body...)
+	binary.BigEndian.PutUint32(req.buf, uint32(len(req.buf)-4))
+
+	response, err := c.exchange(req.buf)
+	if err == nil && len(response) >= 4 && int32(binary.BigEndian.Uint32(response)) != k.correlation {
+		err = errors.New("response out of order")
+	}
+	if err != nil {
+		k.drop(addr)
+		return nil, fmt.Errorf("kafka %s: %v", addr, err)
+	}
+	return &kafkaDecoder{buf: response[4:]}, nil
+}
+
+func (k *kafkaPublisher) connect(ctx context.Context, addr string) (*kafkaConn, error) {
+	if c, exists := k.conns[addr]; exists {
+		return c, nil
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &kafkaConn{conn: conn, reader: bufio.NewReader(conn)}
+	k.conns[addr] = c
+	return c, nil
+}
+
+// drop closes the connection to a broker and forgets the leaders, which
+// may have moved. Callers must hold k.mu.
+func (k *kafkaPublisher) drop(addr string) {
+	if c, exists := k.conns[addr]; exists {
+		c.conn.Close()
+		delete(k.conns, addr)
+	}
+	k.leaders = nil
+}
+
+func (c *kafkaConn) exchange(request []byte) ([]byte, error) {
+	if _, err := c.conn.Write(request); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.reader, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > kafkaMaxResponse {
+		return nil, fmt.Errorf("response of %d bytes", n)
+	}
+	response := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// kafkaRecordBatch encodes a record batch, in the v2 format, of one record
+// with a content-type header.
+func kafkaRecordBatch(key, value []byte, at time.Time) []byte {
+	var record kafkaEncoder
+	record.int8(0)   // attributes
+	record.varint(0) // timestamp delta
+	record.varint(0) // offset delta
+	record.varbytes(key)
+	record.varbytes(value)
+	record.varint(1)
+	record.varbytes([]byte("content-type"))
+	record.varbytes([]byte(cloudEventsContentType))
+
+	ms := at.UnixNano() / int64(time.Millisecond)
+	var batch kafkaEncoder
+	batch.int64(0)  // base offset
+	batch.int32(0)  // length, filled in below
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(0)  // CRC, filled in below
+	crcStart := len(batch.buf)
+	batch.int16(0) // attributes: no compression, create time
+	batch.int32(0) // last offset delta
+	batch.int64(ms)
+	batch.int64(ms)
+	batch.int64(-1) // producer ID
+	batch.int16(-1) // producer epoch
+	batch.int32(-1) // base sequence
+	batch.int32(1)
+	batch.varint(int64(len(record.buf)))
+	batch.buf = append(batch.buf, record.buf...)
+
+	binary.BigEndian.PutUint32(batch.buf[8:], uint32(len(batch.buf)-12))
+	binary.BigEndian.PutUint32(batch.buf[crcStart-4:], crc32.Checksum(batch.buf[crcStart:], crc32c))
+	return batch.buf
+}
+
+type kafkaEncoder struct {
+	buf []byte
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+
+// string writes a nullable string; nil is null.
+func (e *kafkaEncoder) string(s *string) {
+	if s == nil {
+		e.int16(-1)
+		return
+	}
+	e.int16(int16(len(*s)))
+	e.buf = append(e.buf, *s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+func (e *kafkaEncoder) varbytes(b []byte) {
+	e.varint(int64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// kafkaDecoder reads a response, remembering the first error so a caller
+// can read a whole structure and check once.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if n < 0 {
+		n = 0
+	}
+	if d.err != nil || n > len(d.buf) {
+		if d.err == nil {
+			d.err = errors.New("truncated response")
+		}
+		return make([]byte, n)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	return int8(d.take(1)[0])
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	return int16(binary.BigEndian.Uint16(d.take(2)))
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	return int32(binary.BigEndian.Uint32(d.take(4)))
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	return int64(binary.BigEndian.Uint64(d.take(8)))
+}
+
+// string reads a nullable string; null reads as "".
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *kafkaDecoder) int32Array() {
+	n := d.int32()
+	if n > 0 {
+		d.take(4 * int(n))
+	}
+}
@@ -0,0 +1,187 @@
+package tango
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Leader election hands the leader-only jobs to one instance at a time
+// when several run against shared state. The instances contend for a
+// lease, a row in Postgres naming its holder and when it expires by the
+// database's clock. The holder renews it every third of its length; if the
+// holder dies or loses the database, the lease lapses and another instance
+// takes it over. An instance stops counting itself leader once its own
+// lease would have expired, measured from before the renewal was sent, so
+// two instances never both believe they lead.
+const (
+	schedulerLease = "scheduler"
+
+	leaderLeaseSchema = `
+CREATE TABLE IF NOT EXISTS tango_leases (
+	name       text PRIMARY KEY,
+	holder     text NOT NULL,
+	expires_at timestamptz NOT NULL
+)`
+
+	// The lease is taken when it is free or lapsed, and renewed when held.
+	leaderLeaseAcquire = `
+INSERT INTO tango_leases (name, holder, expires_at)
+VALUES ($1, $2, now() + $3::bigint * interval '1 millisecond')
+ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+WHERE tango_leases.holder = excluded.holder OR tango_leases.expires_at < now()
+RETURNING holder`
+)
+
+// LeaderStatus describes the scheduler lease as this instance last saw it.
+type LeaderStatus struct {
+	InstanceID string `json:"instanceId"`
+	Holder     string `json:"holder,omitempty"`
+	ExpiresAt  int64  `json:"expiresAt,omitempty"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+type LeaderElection struct {
+	db     *sql.DB
+	ttl    time.Duration
+	status LeaderStatus
+	// heldUntil is when this instance's hold on the lease runs out by
+	// its own clock; zero while another instance holds it.
+	heldUntil time.Time
+	stop      chan struct{}
+	done      chan struct{}
+	mu        sync.Mutex
+}
+
+// leaderElection is nil unless a lease database is configured, in which
+// case a lone instance leads as before.
+var leaderElection *LeaderElection
+
+func startLeaderElection(cfg LeaderConfig) error {
+	if cfg.DatabaseURL == "" {
+		return nil
+	}
+	db, err := sql.Open("postgres", cfg.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), outboundTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, leaderLeaseSchema); err != nil {
+		db.Close()
+		return fmt.Errorf("creating lease table: %v", err)
+	}
+
+	instanceID := cfg.InstanceID
+	if instanceID == "" {
+		host, _ := os.Hostname()
+		instanceID = host + "-" + randomToken(6)
+	}
+	leaderElection = &LeaderElection{
+		db:     db,
+		ttl:    time.Duration(cfg.LeaseSeconds) * time.Second,
+		status: LeaderStatus{InstanceID: instanceID},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go leaderElection.run()
+	return nil
+}
+
+// stopLeaderElection gives up the lease, so another instance can take over
+// without waiting for it to lapse.
+func stopLeaderElection(ctx context.Context) {
+	e := leaderElection
+	if e == nil {
+		return
+	}
+	close(e.stop)
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+	}
+	e.mu.Lock()
+	e.heldUntil = time.Time{}
+	e.mu.Unlock()
+	if _, err := e.db.ExecContext(ctx, `DELETE FROM tango_leases WHERE name = $1 AND holder = $2`, schedulerLease, e.status.InstanceID); err != nil {
+		logger.Warn("releasing scheduler lease failed", "error", err)
+	}
+	e.db.Close()
+}
+
+func (e *LeaderElection) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		// A standby's store is overwritten by the primary's snapshots,
+		// so it does not contend until it is promoted.
+		if !replicator.IsStandby() {
+			e.contend()
+		}
+		select {
+		case <-ticker.C:
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// contend takes or renews the lease. When the database can't be reached,
+// a held lease is kept until it runs out.
+func (e *LeaderElection) contend() {
+	sent := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl/3)
+	defer cancel()
+
+	var holder string
+	err := e.db.QueryRowContext(ctx, leaderLeaseAcquire, schedulerLease, e.status.InstanceID, e.ttl.Milliseconds()).Scan(&holder)
+	acquired := err == nil
+	var expiresAt time.Time
+	if err == sql.ErrNoRows {
+		err = e.db.QueryRowContext(ctx, `SELECT holder, expires_at FROM tango_leases WHERE name = $1`, schedulerLease).Scan(&holder, &expiresAt)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	wasLeader := e.leading(sent)
+	switch {
+	case err != nil:
+		e.status.LastError = err.Error()
+		logger.Warn("scheduler lease check failed", "error", err)
+	case acquired:
+		e.heldUntil = sent.Add(e.ttl)
+		e.status.Holder, e.status.ExpiresAt, e.status.LastError = holder, e.heldUntil.Unix(), ""
+	default:
+		e.heldUntil = time.Time{}
+		e.status.Holder, e.status.ExpiresAt, e.status.LastError = holder, expiresAt.Unix(), ""
+	}
+	if leading := e.leading(time.Now()); leading != wasLeader {
+		if leading {
+			logger.Info("acquired scheduler lease", "instance", e.status.InstanceID)
+		} else {
+			logger.Warn("lost scheduler lease", "instance", e.status.InstanceID, "holder", e.status.Holder)
+		}
+	}
+}
+
+// leading reports whether the lease is held at now. Callers must hold
+// e.mu.
+func (e *LeaderElection) leading(now time.Time) bool {
+	return now.Before(e.heldUntil)
+}
+
+func (e *LeaderElection) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading(time.Now())
+}
+
+func (e *LeaderElection) Status() LeaderStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.status
+}
@@ -0,0 +1,94 @@
+package tango
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SessionScheduled = "scheduled"
+	SessionLive      = "live"
+	SessionEnded     = "ended"
+	SessionArchived  = "archived"
+	SessionTrashed   = "trashed"
+)
+
+// acceptsJoins reports whether new clients may connect. Ended and archived
+// sessions stay readable through the REST API but refuse new participants.
+func (s *Session) acceptsJoins() bool {
+	return s.Status == SessionScheduled || s.Status == SessionLive
+}
+
+// endSession moves session to the ended state and disconnects its clients.
+// Callers must hold session.mu.
+func endSession(session *Session) {
+	if !session.acceptsJoins() {
+		return
+	}
+
+	session.Status = SessionEnded
+	session.EndedAt = getCurrentTimestamp()
+
+	for _, client := range session.Clients {
+		client.send(Message{
+			Type: "session_ended",
+			Payload: gin.H{
+				"sessionId": session.ID,
+			},
+		})
+		client.closeConn()
+	}
+	turnAwayAll(session, "session_ended")
+
+	day := analytics.today()
+	atomic.AddInt64(&day.stats.SessionsEnded, 1)
+	atomic.AddInt64(&day.stats.DurationSeconds, session.duration(session.EndedAt))
+	emitEvent(EventSessionEnded, session)
+}
+
+func endSessionHandler(c *gin.Context) {
+	id := c.Param("id")
+
+	session, exists := sessionFor(c, id)
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if !session.acceptsJoins() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session already ended"})
+		return
+	}
+
+	endSession(session)
+	auditRequest(c, "session.end", "session", id, nil)
+	c.JSON(http.StatusOK, session)
+}
+
+func archiveSession(c *gin.Context) {
+	id := c.Param("id")
+
+	session, exists := sessionFor(c, id)
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.Status != SessionEnded {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only ended sessions can be archived"})
+		return
+	}
+
+	session.Status = SessionArchived
+	emitEvent(EventSessionArchived, session)
+	auditRequest(c, "session.archive", "session", id, nil)
+	c.JSON(http.StatusOK, session)
+}
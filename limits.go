@@ -0,0 +1,180 @@
+package tango
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	QuotaRequests       = "requests"
+	QuotaSessionCreates = "session_creates"
+)
+
+type Quota struct {
+	Limit  int
+	Window time.Duration
+}
+
+type QuotaUsage struct {
+	Category  string `json:"category"`
+	Limit     int    `json:"limit"`
+	Used      int    `json:"used"`
+	Remaining int    `json:"remaining"`
+	Reset     int64  `json:"reset"`
+}
+
+type quotaWindow struct {
+	start time.Time
+	count int
+}
+
+type QuotaTracker struct {
+	Quotas map[string]Quota
+	usage  map[string]map[string]*quotaWindow
+	mu     sync.Mutex
+}
+
+func NewQuotaTracker() *QuotaTracker {
+	return &QuotaTracker{
+		Quotas: map[string]Quota{
+			QuotaRequests:       {Limit: 600, Window: time.Minute},
+			QuotaSessionCreates: {Limit: 100, Window: time.Hour},
+		},
+		usage: make(map[string]map[string]*quotaWindow),
+	}
+}
+
+var quotas = NewQuotaTracker()
+
+// window returns the caller's current window for category, starting a new
+// one if the previous window has elapsed. Callers must hold t.mu.
+func (t *QuotaTracker) window(caller, category string) *quotaWindow {
+	windows, exists := t.usage[caller]
+	if !exists {
+		windows = make(map[string]*quotaWindow)
+		t.usage[caller] = windows
+	}
+
+	now := time.Now()
+	w, exists := windows[category]
+	if !exists || now.Sub(w.start) >= t.Quotas[category].Window {
+		w = &quotaWindow{start: now}
+		windows[category] = w
+	}
+	return w
+}
+
+func (t *QuotaTracker) snapshot(category string, w *quotaWindow) QuotaUsage {
+	quota := t.Quotas[category]
+	remaining := quota.Limit - w.count
+	if remaining < 0 {
+		remaining = 0
+	}
+	return QuotaUsage{
+		Category:  category,
+		Limit:     quota.Limit,
+		Used:      w.count,
+		Remaining: remaining,
+		Reset:     w.start.Add(quota.Window).Unix(),
+	}
+}
+
+// Take consumes one unit of category for caller and reports whether the
+// caller was still within its quota.
+func (t *QuotaTracker) Take(caller, category string) (QuotaUsage, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w := t.window(caller, category)
+	if w.count >= t.Quotas[category].Limit {
+		return t.snapshot(category, w), false
+	}
+	w.count++
+	return t.snapshot(category, w), true
+}
+
+func (t *QuotaTracker) Usage(caller string) []QuotaUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	usage := make([]QuotaUsage, 0, len(t.Quotas))
+	for _, category := range []string{QuotaRequests, QuotaSessionCreates} {
+		usage = append(usage, t.snapshot(category, t.window(caller, category)))
+	}
+	return usage
+}
+
+func setRateLimitHeaders(c *gin.Context, usage QuotaUsage) {
+	c.Header("X-RateLimit-Limit", strconv.Itoa(usage.Limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(usage.Remaining))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(usage.Reset, 10))
+}
+
+func apiQuota() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		usage, ok := quotas.Take(c.ClientIP(), QuotaRequests)
+		setRateLimitHeaders(c, usage)
+		if !ok {
+			rejectOverQuota(c, usage, "Rate limit exceeded")
+			return
+		}
+		c.Next()
+	}
+}
+
+func rejectOverQuota(c *gin.Context, usage QuotaUsage, message string) {
+	c.Header("Retry-After", strconv.FormatInt(usage.Reset-getCurrentTimestamp(), 10))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": message})
+}
+
+// messageLimiter is a token bucket bounding how fast one WebSocket client
+// may push frames into its session.
+type messageLimiter struct {
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	notified bool
+}
+
+func newMessageLimiter(perSecond int) *messageLimiter {
+	return &messageLimiter{
+		rate:   float64(perSecond),
+		burst:  float64(perSecond),
+		tokens: float64(perSecond),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token if one is available. When it is not, it also reports
+// how long until the next token and whether the client should be told; the
+// client is notified once per throttled stretch rather than once per frame.
+func (l *messageLimiter) Allow() (bool, time.Duration, bool) {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		l.notified = false
+		return true, 0, false
+	}
+
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	notify := !l.notified
+	l.notified = true
+	return false, wait, notify
+}
+
+func getLimits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"limits": quotas.Usage(c.ClientIP()),
+	})
+}
@@ -0,0 +1,195 @@
+package tango
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+var zerologLevels = map[Level]zerolog.Level{
+	LevelDebug: zerolog.DebugLevel,
+	LevelInfo:  zerolog.InfoLevel,
+	LevelWarn:  zerolog.WarnLevel,
+	LevelError: zerolog.ErrorLevel,
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func parseLevel(name string) (Level, bool) {
+	for level, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return level, true
+		}
+	}
+	return LevelInfo, false
+}
+
+const requestIDHeader = "X-Request-ID"
+
+func init() {
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+	zerolog.TimestampFunc = func() time.Time { return time.Now().UTC() }
+	zerolog.MessageFieldName = "msg"
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+}
+
+// logOutput writes zerolog's JSON entries to stderr as they are, or as
+// text lines of time, level, message and the fields sorted by key.
+type logOutput struct {
+	json int32
+	text zerolog.ConsoleWriter
+}
+
+func newLogOutput() *logOutput {
+	return &logOutput{text: zerolog.ConsoleWriter{
+		Out:     os.Stderr,
+		NoColor: true,
+		FormatTimestamp: func(t interface{}) string {
+			return fmt.Sprint(t)
+		},
+		FormatLevel: func(level interface{}) string {
+			return fmt.Sprintf("%-5s", strings.ToUpper(fmt.Sprint(level)))
+		},
+	}}
+}
+
+func (o *logOutput) Write(entry []byte) (int, error) {
+	if atomic.LoadInt32(&o.json) == 1 {
+		return os.Stderr.Write(entry)
+	}
+	return o.text.Write(entry)
+}
+
+// Logger writes leveled entries carrying a fixed set of key/value fields
+// through zerolog. Loggers derived with With share the output. The level
+// is zerolog's global level, so changing it at runtime applies to every
+// logger at once.
+type Logger struct {
+	out *logOutput
+	zl  zerolog.Logger
+}
+
+func NewLogger() *Logger {
+	out := newLogOutput()
+	return &Logger{out: out, zl: zerolog.New(zerolog.SyncWriter(out)).With().Timestamp().Logger()}
+}
+
+var logger = NewLogger()
+
+func (l *Logger) With(kv ...interface{}) *Logger {
+	return &Logger{out: l.out, zl: l.zl.With().Fields(kv).Logger()}
+}
+
+func (l *Logger) Level() Level {
+	global := zerolog.GlobalLevel()
+	for level, zl := range zerologLevels {
+		if zl == global {
+			return level
+		}
+	}
+	return LevelInfo
+}
+
+func (l *Logger) SetLevel(level Level) {
+	zerolog.SetGlobalLevel(zerologLevels[level])
+}
+
+func (l *Logger) SetJSON(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&l.out.json, v)
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.zl.Debug().Fields(kv).Msg(msg) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.zl.Info().Fields(kv).Msg(msg) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.zl.Warn().Fields(kv).Msg(msg) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.zl.Error().Fields(kv).Msg(msg) }
+
+// requestLogger tags each request with an ID, taken from the incoming
+// X-Request-ID header when present, and logs the request once it completes.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader(requestIDHeader)
+		if id == "" {
+			id = generateID()
+		}
+		c.Header(requestIDHeader, id)
+		c.Set("logger", logger.With("requestId", id))
+
+		c.Next()
+
+		fields := []interface{}{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency", time.Since(start).String(),
+			"ip", c.ClientIP(),
+		}
+		if legacy := legacyPath(c); legacy != "" {
+			fields = append(fields, "legacyPath", legacy)
+		}
+		requestLog(c).Info("request", fields...)
+	}
+}
+
+func requestLog(c *gin.Context) *Logger {
+	if l, ok := c.Get("logger"); ok {
+		return l.(*Logger)
+	}
+	return logger
+}
+
+func getLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": logger.Level().String()})
+}
+
+type LogLevelRequest struct {
+	Level string `json:"level" binding:"required"`
+}
+
+func setLogLevel(c *gin.Context) {
+	var req LogLevelRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	level, ok := parseLevel(req.Level)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown log level: " + req.Level})
+		return
+	}
+
+	logger.SetLevel(level)
+	auditRequest(c, "log.level", "server", "", gin.H{"level": level.String()})
+	c.JSON(http.StatusOK, gin.H{"level": level.String()})
+}
@@ -1,39 +1,141 @@
-package main
+package tango
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
 type Session struct {
-	ID        string             `json:"id"`
-	Name      string             `json:"name"`
-	CreatedAt int64              `json:"createdAt"`
-	Clients   map[string]*Client `json:"-"`
-	mu        sync.Mutex         `json:"-"`
+	ID                string             `json:"id"`
+	Name              string             `json:"name"`
+	ExternalRef       string             `json:"externalRef,omitempty"`
+	ExternalID        string             `json:"externalId,omitempty"`
+	WorkspaceID       string             `json:"workspaceId,omitempty"`
+	Owner             string             `json:"owner,omitempty"`
+	CreatedBy         string             `json:"createdBy,omitempty"`
+	Description       string             `json:"description,omitempty"`
+	Tags              []string           `json:"tags,omitempty"`
+	Metadata          map[string]string  `json:"metadata,omitempty"`
+	CollectionID      string             `json:"collectionId,omitempty"`
+	CreatedAt         int64              `json:"createdAt"`
+	Status            string             `json:"status"`
+	EndedAt           int64              `json:"endedAt,omitempty"`
+	DeletedAt         int64              `json:"deletedAt,omitempty"`
+	TrashedFrom       string             `json:"trashedFrom,omitempty"`
+	AutoEnd           bool               `json:"autoEnd"`
+	MaxClients        int                `json:"maxClients,omitempty"`
+	IdleTTL           int                `json:"idleTtlSeconds,omitempty"`
+	IdleSince         int64              `json:"idleSince,omitempty"`
+	ViewerAnnotations bool               `json:"viewerAnnotations"`
+	SFU               bool               `json:"sfu"`
+	E2EE              bool               `json:"e2ee"`
+	DisabledFeatures  []string           `json:"disabledFeatures,omitempty"`
+	MaxFPS            int                `json:"maxFps,omitempty"`
+	WaitingRoom       bool               `json:"waitingRoom"`
+	WaitingTimeout    int                `json:"waitingTimeoutSeconds,omitempty"`
+	StartAt           int64              `json:"startAt,omitempty"`
+	RemindedAt        int64              `json:"remindedAt,omitempty"`
+	ClonedFrom        string             `json:"clonedFrom,omitempty"`
+	TemplateID        string             `json:"templateId,omitempty"`
+	Clients           map[string]*Client `json:"-"`
+	mu                sync.Mutex         `json:"-"`
+	sendMu            sync.Mutex
+
+	controllerID    string
+	controlRequests map[string]bool
+	editing         *editingState
+	waiting         map[string]*waitingClient
+	lastFrame       time.Time
+	frames          frameChain
+	stream          sessionStream
+	stats           sessionStats
 }
 
 type Client struct {
-	ID       string          `json:"id"`
-	Name     string          `json:"name"`
-	Conn     *websocket.Conn `json:"-"`
-	SessionID string          `json:"sessionId"`
+	ID         string          `json:"id"`
+	Name       string          `json:"name"`
+	Conn       *websocket.Conn `json:"-"`
+	SessionID  string          `json:"sessionId"`
+	Role       string          `json:"role"`
+	Features   []string        `json:"features,omitempty"`
+	JoinedAt   int64           `json:"joinedAt"`
+	Status     string          `json:"status"`
+	HandRaised bool            `json:"handRaised"`
+	log        *Logger         `json:"-"`
+	limiter    *messageLimiter
+	faults     *FaultProfile
+	connMu     sync.Mutex
+	// recvMu serialises the handling of the client's messages, which can
+	// arrive on concurrent requests over server-sent events.
+	recvMu sync.Mutex
+	// events stands in for Conn when the client joined over server-sent
+	// events. Like Conn it is guarded by connMu.
+	events *eventStream
+	// slowWrites and shedUntil are guarded by connMu.
+	slowWrites int
+	shedUntil  time.Time
+	// delayed holds the messages a fault profile delays, in the order
+	// they are to be written, and draining is set while a goroutine
+	// writes them. Both are guarded by connMu.
+	delayed  []delayedMessage
+	draining bool
+
+	cursorLimiter   *messageLimiter
+	reactionLimiter *messageLimiter
+	handLimiter     *messageLimiter
+	inputLimiter    *messageLimiter
+	frames          *frameStats
+	resumeToken     string
+	graceTimer      *time.Timer
+	ackedSeq        int64
+	ackLag          time.Duration
+	resyncSent      bool
+	// userID is the signed-in user the client joined as, if any, and
+	// viaSSO whether they signed in with single sign-on. Both are set
+	// before the client is added and never change. host is 1 while the
+	// client hosts the session and is accessed atomically; see isHost.
+	userID string
+	viaSSO bool
+	host   int32
+	// lastActive is accessed atomically; see touch.
+	lastActive int64
+	// held is set when the client joined into a waiting room, before it
+	// is welcomed. waiting is 1 while it is still held, and is accessed
+	// atomically.
+	held    bool
+	waiting int32
+	// e2eeKey is the public key the client announced in an end-to-end
+	// encrypted session. It is guarded by the session's mu.
+	e2eeKey string
 }
 
 type Message struct {
 	Type    string      `json:"type"`
+	Seq     int64       `json:"seq,omitempty"`
 	Payload interface{} `json:"payload"`
+	encoded *encodedFrames
 }
 
+// Locking is sharded so a busy session cannot stall the rest of the server.
+// store.mu guards only the Sessions and Clients maps. Each session's mu
+// guards its fields, its client set and the state of its clients, and must
+// be held while the session is encoded. A session's sendMu orders its
+// broadcasts, which are written after mu is released. A client's connMu
+// guards Conn and faults and serialises writes to the socket. Locks are
+// taken in that order: store.mu, session mu, sendMu, connMu. A client's
+// recvMu is held while one of its messages is handled, before any of them.
 type InMemoryStore struct {
 	Sessions map[string]*Session
 	Clients  map[string]*Client
-	mu       sync.Mutex
+	mu       sync.RWMutex
 }
 
 func NewInMemoryStore() *InMemoryStore {
@@ -43,226 +145,912 @@ func NewInMemoryStore() *InMemoryStore {
 	}
 }
 
+// findLiveSession returns a session in workspaceID that still accepts joins
+// and matches externalRef, or name when no reference is given. Callers must
+// hold s.mu.
+func (s *InMemoryStore) findLiveSession(workspaceID, name, externalRef string) *Session {
+	for _, session := range s.Sessions {
+		session.mu.Lock()
+		match := session.acceptsJoins() && session.WorkspaceID == workspaceID && (externalRef != "" && session.ExternalRef == externalRef ||
+			externalRef == "" && session.Name == name)
+		session.mu.Unlock()
+		if match {
+			return session
+		}
+	}
+	return nil
+}
+
+// session looks up a session by id.
+func (s *InMemoryStore) session(id string) (*Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, exists := s.Sessions[id]
+	return session, exists
+}
+
+// sessionList and clientList snapshot the store's maps so callers can walk
+// them, and write to clients, without holding store.mu.
+func (s *InMemoryStore) sessionList() []*Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sessions := make([]*Session, 0, len(s.Sessions))
+	for _, session := range s.Sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (s *InMemoryStore) clientList() []*Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	clients := make([]*Client, 0, len(s.Clients))
+	for _, client := range s.Clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// findByExternalID returns the session in the workspace carrying
+// externalID. External IDs are unique within a workspace, and among
+// sessions outside any. Callers must hold s.mu.
+func (s *InMemoryStore) findByExternalID(workspaceID, externalID string) *Session {
+	for _, session := range s.Sessions {
+		session.mu.Lock()
+		match := session.ExternalID == externalID && session.WorkspaceID == workspaceID
+		session.mu.Unlock()
+		if match {
+			return session
+		}
+	}
+	return nil
+}
+
 var (
-	store      = NewInMemoryStore()
-	upgrader   = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins for demo purposes
-		},
+	store    = NewInMemoryStore()
+	upgrader = websocket.Upgrader{
+		CheckOrigin:  checkOrigin,
+		Subprotocols: []string{SubprotocolMsgpack, SubprotocolProtobuf, SubprotocolJSON},
 	}
 )
 
-func main() {
-	r := gin.Default()
+func getSessions(c *gin.Context) {
+	listSessions(c, listingScope(c))
+}
+
+// searchQuery parses the q parameter, answering 400 with where the query
+// went wrong if it doesn't parse. A missing q gives a nil query.
+func searchQuery(c *gin.Context) (SessionQuery, bool) {
+	q := c.Query("q")
+	if q == "" {
+		return nil, true
+	}
+	search, err := ParseSessionQuery(q)
+	if err != nil {
+		qerr := err.(*QueryError)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":    qerr.Error(),
+			"position": qerr.Pos,
+			"token":    qerr.Token,
+		})
+		return nil, false
+	}
+	return search, true
+}
 
-	config := cors.DefaultConfig()
-	config.AllowAllOrigins = true
-	config.AllowCredentials = true
-	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization"}
-	r.Use(cors.New(config))
+// listSessions answers with a page of the sessions in the workspaces
+// visible reports true for that match the request's search and filters.
+func listSessions(c *gin.Context, visible func(workspaceID string) bool) {
+	search, ok := searchQuery(c)
+	if !ok {
+		return
+	}
 
-	api := r.Group("/api")
-	{
-		api.GET("/sessions", getSessions)
-		api.POST("/sessions", createSession)
-		api.GET("/sessions/:id", getSession)
-		api.DELETE("/sessions/:id", deleteSession)
+	query := c.Request.URL.Query()
+	page, err := parseSessionPage(query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	r.GET("/ws/:sessionId", handleWebSocket)
+	all := store.sessionList()
+	sessions := make([]*Session, 0, len(all))
+	keys := make(map[*Session]pageCursor, len(all))
+	for _, session := range all {
+		if !visible(session.WorkspaceID) {
+			continue
+		}
+		session.mu.Lock()
+		if (search == nil || search.Match(session)) && page.Match(session) &&
+			matchesResourceFilter(query, session.ExternalID, session.Metadata) {
+			sessions = append(sessions, session)
+			keys[session] = page.cursorFor(session)
+		}
+		session.mu.Unlock()
+	}
 
-	log.Println("Server starting on :8080")
-	if err := r.Run(":8080"); err != nil {
-		log.Fatal("Failed to start server: ", err)
+	sessions, next := page.Apply(sessions, keys)
+	encoded, err := encodeSessions(sessions)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"sessions": encoded}
+	if next != "" {
+		resp["nextCursor"] = next
 	}
+	c.JSON(http.StatusOK, resp)
 }
 
-func getSessions(c *gin.Context) {
-	store.mu.Lock()
-	defer store.mu.Unlock()
-
-	sessions := make([]*Session, 0, len(store.Sessions))
-	for _, session := range store.Sessions {
-		sessions = append(sessions, session)
+// encodeSessions encodes each session under its own lock.
+func encodeSessions(sessions []*Session) ([]json.RawMessage, error) {
+	encoded := make([]json.RawMessage, 0, len(sessions))
+	for _, session := range sessions {
+		session.mu.Lock()
+		data, err := json.Marshal(session)
+		session.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, data)
 	}
+	return encoded, nil
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"sessions": sessions,
-	})
+type CreateSessionRequest struct {
+	Name              string            `json:"name" binding:"required"`
+	ExternalRef       string            `json:"externalRef"`
+	ExternalID        string            `json:"externalId"`
+	Owner             string            `json:"owner"`
+	Description       string            `json:"description" binding:"max=2000"`
+	Tags              []string          `json:"tags"`
+	Metadata          map[string]string `json:"metadata"`
+	AutoEnd           bool              `json:"autoEnd"`
+	MaxClients        int               `json:"maxClients" binding:"min=0"`
+	IdleTTL           int               `json:"idleTtlSeconds" binding:"min=0"`
+	ViewerAnnotations bool              `json:"viewerAnnotations"`
+	SFU               bool              `json:"sfu"`
+	E2EE              bool              `json:"e2ee"`
+	MaxFPS            int               `json:"maxFps" binding:"min=0,max=120"`
+	WaitingRoom       bool              `json:"waitingRoom"`
+	WaitingTimeout    int               `json:"waitingTimeoutSeconds" binding:"min=0"`
+	StartAt           int64             `json:"startAt" binding:"min=0"`
+	Unique            bool              `json:"unique"`
+	WorkspaceID       string            `json:"workspaceId"`
+	CollectionID      string            `json:"collectionId"`
+	// templateID is set when the session is made from a template.
+	templateID string
 }
 
 func createSession(c *gin.Context) {
-	var req struct {
-		Name string `json:"name" binding:"required"`
-	}
+	var req CreateSessionRequest
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	startSession(c, req)
+}
+
+// startSession creates the session req describes and responds with it.
+func startSession(c *gin.Context, req CreateSessionRequest) {
+	if err := validateMetadata(req.Metadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateTags(req.Tags); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.WorkspaceID != "" && requireRole(c, req.WorkspaceID, RoleMember) == nil {
+		return
+	}
+	if err := collections.checkMove(req.WorkspaceID, req.CollectionID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.SFU && req.E2EE {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errE2EESFU.Error()})
+		return
+	}
+	if req.SFU && !sfuAvailable {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errSFUUnavailable.Error()})
+		return
+	}
+	if req.StartAt != 0 && req.StartAt <= getCurrentTimestamp() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errStartInPast.Error()})
+		return
+	}
+	if req.WaitingRoom && currentUser(c) == nil && hostless("", req.WorkspaceID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errWaitingRoomHost.Error()})
+		return
+	}
 
+	// store.mu is released before responding and emitting, so neither
+	// holds up the rest of the store.
 	store.mu.Lock()
-	defer store.mu.Unlock()
 
-	id := generateID()
+	if req.Unique {
+		if existing := store.findLiveSession(req.WorkspaceID, req.Name, req.ExternalRef); existing != nil {
+			store.mu.Unlock()
+			existing.mu.Lock()
+			defer existing.mu.Unlock()
+			c.JSON(http.StatusOK, existing)
+			return
+		}
+	}
+
+	if req.ExternalID != "" && store.findByExternalID(req.WorkspaceID, req.ExternalID) != nil {
+		store.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": errExternalIDTaken.Error()})
+		return
+	}
+
+	if usage, ok := quotas.Take(c.ClientIP(), QuotaSessionCreates); !ok {
+		store.mu.Unlock()
+		rejectOverQuota(c, usage, "Session creation quota exceeded")
+		return
+	}
+
+	createdBy := ""
+	if user := currentUser(c); user != nil {
+		createdBy = user.ID
+	}
+	if breach := checkCreateQuota(createdBy, req.WorkspaceID); breach != nil {
+		store.mu.Unlock()
+		rejectQuota(c, breach)
+		return
+	}
+
+	idleTTL := req.IdleTTL
+	if idleTTL == 0 {
+		idleTTL = config.SessionIdleTTL
+	}
+
+	now := getCurrentTimestamp()
 	session := &Session{
-		ID:        id,
-		Name:      req.Name,
-		CreatedAt: getCurrentTimestamp(),
-		Clients:   make(map[string]*Client),
+		ID:                store.newSessionID(),
+		Name:              req.Name,
+		ExternalRef:       req.ExternalRef,
+		ExternalID:        req.ExternalID,
+		WorkspaceID:       req.WorkspaceID,
+		Owner:             req.Owner,
+		CreatedBy:         createdBy,
+		Description:       req.Description,
+		Tags:              req.Tags,
+		Metadata:          req.Metadata,
+		CollectionID:      req.CollectionID,
+		CreatedAt:         now,
+		Status:            SessionScheduled,
+		AutoEnd:           req.AutoEnd,
+		MaxClients:        req.MaxClients,
+		IdleTTL:           idleTTL,
+		IdleSince:         now,
+		ViewerAnnotations: req.ViewerAnnotations,
+		SFU:               req.SFU,
+		E2EE:              req.E2EE,
+		MaxFPS:            req.MaxFPS,
+		WaitingRoom:       req.WaitingRoom,
+		WaitingTimeout:    req.WaitingTimeout,
+		StartAt:           req.StartAt,
+		TemplateID:        req.templateID,
+		Clients:           make(map[string]*Client),
+	}
+	if session.E2EE {
+		session.DisabledFeatures = e2eeDisabledFeatures
 	}
+	if session.StartAt != 0 {
+		// The idle clock starts when the session opens.
+		session.IdleSince = 0
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
 
-	store.Sessions[id] = session
+	store.Sessions[session.ID] = session
+	workspaces.indexSession(session.ID, session.WorkspaceID)
+	store.mu.Unlock()
+
+	sessionHistory.created(session, createdBy)
+	emitEvent(EventSessionCreated, session)
+	atomic.AddInt64(&analytics.today().stats.SessionsCreated, 1)
+	auditRequest(c, "session.create", "session", session.ID, gin.H{"name": session.Name})
 
 	c.JSON(http.StatusCreated, session)
 }
 
 func getSession(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	if user := currentUser(c); user != nil {
+		favorites.viewed(user.ID, itemRef{Type: FavoriteSession, ID: session.ID})
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	c.JSON(http.StatusOK, session)
+}
+
+type UpdateSessionRequest struct {
+	Name              *string            `json:"name" binding:"omitempty,min=1"`
+	Description       *string            `json:"description" binding:"omitempty,max=2000"`
+	Tags              *[]string          `json:"tags"`
+	Metadata          map[string]*string `json:"metadata"`
+	ViewerAnnotations *bool              `json:"viewerAnnotations"`
+	MaxFPS            *int               `json:"maxFps" binding:"omitempty,min=0,max=120"`
+	CollectionID      *string            `json:"collectionId"`
+	WaitingRoom       *bool              `json:"waitingRoom"`
+	WaitingTimeout    *int               `json:"waitingTimeoutSeconds" binding:"omitempty,min=0"`
+	StartAt           *int64             `json:"startAt" binding:"omitempty,min=0"`
+}
+
+// sessionUpdate is the session_updated message sent to a session's clients
+// when its details change. Callers must hold session.mu.
+func sessionUpdate(session *Session) gin.H {
+	return gin.H{
+		"sessionId":    session.ID,
+		"name":         session.Name,
+		"description":  session.Description,
+		"tags":         session.Tags,
+		"metadata":     session.Metadata,
+		"collectionId": session.CollectionID,
+
+		"viewerAnnotations": session.ViewerAnnotations,
+		"maxFps":            session.MaxFPS,
+		"waitingRoom":       session.WaitingRoom,
+	}
+}
+
+// updateSession applies a partial update. Metadata keys are merged into the
+// existing map, and a null value removes the key.
+func updateSession(c *gin.Context) {
 	id := c.Param("id")
 
-	store.mu.Lock()
-	defer store.mu.Unlock()
+	var req UpdateSessionRequest
 
-	session, exists := store.Sessions[id]
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Tags != nil {
+		if err := validateTags(*req.Tags); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	session, exists := sessionFor(c, id)
 	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		notFound(c, "Session not found")
 		return
 	}
 
+	session.mu.Lock()
+	if session.Status == SessionTrashed {
+		session.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "Session is in the trash; restore it first"})
+		return
+	}
+	var editedFields []string
+	if req.Name != nil {
+		editedFields = append(editedFields, EditFieldName)
+	}
+	if req.Description != nil {
+		editedFields = append(editedFields, EditFieldDescription)
+	}
+	if req.Tags != nil {
+		editedFields = append(editedFields, EditFieldTags)
+	}
+	if field := editLockHeld(session, editedFields...); field != "" {
+		session.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "The " + field + " is locked by a co-editor"})
+		return
+	}
+	if req.StartAt != nil {
+		if session.Status != SessionScheduled {
+			session.mu.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": "Session has already started"})
+			return
+		}
+		if *req.StartAt != 0 && *req.StartAt <= getCurrentTimestamp() {
+			session.mu.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": errStartInPast.Error()})
+			return
+		}
+	}
+	if req.WaitingRoom != nil && *req.WaitingRoom && hostless(session.CreatedBy, session.WorkspaceID) {
+		session.mu.Unlock()
+		c.JSON(http.StatusBadRequest, gin.H{"error": errWaitingRoomHost.Error()})
+		return
+	}
+	settleEdits(session)
+	before := detailsOf(session)
+	metadata, err := mergeMetadata(session.Metadata, req.Metadata)
+	if err != nil {
+		session.mu.Unlock()
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.CollectionID != nil {
+		if err := collections.checkMove(session.WorkspaceID, *req.CollectionID); err != nil {
+			session.mu.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		session.CollectionID = *req.CollectionID
+	}
+
+	if req.Name != nil {
+		session.Name = *req.Name
+	}
+	if req.Description != nil {
+		session.Description = *req.Description
+	}
+	if req.Tags != nil {
+		session.Tags = *req.Tags
+	}
+	if req.Metadata != nil {
+		session.Metadata = metadata
+	}
+	if req.ViewerAnnotations != nil {
+		session.ViewerAnnotations = *req.ViewerAnnotations
+	}
+	if req.MaxFPS != nil {
+		session.MaxFPS = *req.MaxFPS
+	}
+	openedWaitingRoom := false
+	if req.WaitingRoom != nil {
+		openedWaitingRoom = session.WaitingRoom && !*req.WaitingRoom
+		session.WaitingRoom = *req.WaitingRoom
+	}
+	if req.WaitingTimeout != nil {
+		session.WaitingTimeout = *req.WaitingTimeout
+	}
+	if req.StartAt != nil {
+		reschedule(session, *req.StartAt)
+	}
+	authorID := ""
+	if user := currentUser(c); user != nil {
+		authorID = user.ID
+	}
+	sessionHistory.edited(session, before, authorID, VersionUpdated, 0)
+	syncEdits(session)
+	emitEvent(EventSessionUpdated, session)
 	c.JSON(http.StatusOK, session)
+
+	update := sessionUpdate(session)
+	session.mu.Unlock()
+
+	broadcastToSession(requestSpan(c), id, Message{Type: "session_updated", Payload: update}, "")
+	if openedWaitingRoom {
+		admitAll(session)
+	}
 }
 
+// deleteSession moves a session to the trash, from where it can be
+// restored until the retention window passes. Deleting a trashed session,
+// passing permanent=true, or running with no retention removes it for good.
 func deleteSession(c *gin.Context) {
 	id := c.Param("id")
+	permanent := c.Query("permanent") == "true" || config.TrashRetention == 0
 
 	store.mu.Lock()
 	defer store.mu.Unlock()
 
-	if _, exists := store.Sessions[id]; !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+	session, exists := store.Sessions[id]
+	if !exists || !canAccess(c, session.WorkspaceID) {
+		notFound(c, "Session not found")
 		return
 	}
 
-	for _, client := range store.Sessions[id].Clients {
-		if client.Conn != nil {
-			client.Conn.Close()
-		}
-		delete(store.Clients, client.ID)
-	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
 
-	delete(store.Sessions, id)
+	if permanent || session.Status == SessionTrashed {
+		purgeSession(session)
+		auditRequest(c, "session.purge", "session", id, nil)
+	} else {
+		trashSession(session)
+		auditRequest(c, "session.trash", "session", id, nil)
+	}
 	c.Status(http.StatusNoContent)
 }
 
 func handleWebSocket(c *gin.Context) {
 	sessionID := c.Param("sessionId")
 
-	store.mu.Lock()
-	session, exists := store.Sessions[sessionID]
-	if !exists {
-		store.mu.Unlock()
-		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+	// An anonymous caller may still sign in with the token in its join
+	// frame, so only it is upgraded before access is known.
+	signInFromQuery(c)
+	session, exists := store.session(sessionID)
+	if !exists || (currentUser(c) != nil && !canAccess(c, session.WorkspaceID)) {
+		notFound(c, "Session not found")
 		return
 	}
-	store.mu.Unlock()
+	if !websocket.IsWebSocketUpgrade(c.Request) {
+		// Typically a proxy that strips the upgrade; point the client at
+		// the server-sent events transport instead.
+		c.JSON(http.StatusUpgradeRequired, gin.H{
+			"error":  "WebSocket upgrade required",
+			"events": apiPrefix + "/sessions/" + sessionID + "/events",
+		})
+		return
+	}
+	if !admitRequest(c, session, c.Query("resumeClientId") != "") {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(countingWriter{c.Writer}, c.Request, nil)
+	if err != nil {
+		requestLog(c).Warn("websocket upgrade failed", "sessionId", sessionID, "error", err)
+		return
+	}
+	conn.SetCompressionLevel(config.Compression.Level)
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	join, ok := joinFromQuery(c)
+	if !ok {
+		join, err = readJoin(conn)
+	}
+	if err == nil {
+		err = join.validate()
+	}
 	if err != nil {
-		log.Println("Failed to upgrade connection:", err)
+		requestLog(c).Info("websocket handshake rejected", "sessionId", sessionID, "error", err)
+		rejectHandshake(conn, err)
+		return
+	}
+	if _, ok := joinFor(c, sessionID, join); !ok {
+		refuseUpgraded(conn, sessionID, refusedJoin(c))
+		return
+	}
+	if join.ResumeClientID != "" {
+		resumeWebSocket(c, session, join, conn)
 		return
 	}
 
-	clientID := generateID()
-	client := &Client{
-		ID:        clientID,
-		Conn:      conn,
-		SessionID: sessionID,
+	client := newClient(sessionID, join)
+	client.Conn = conn
+	if refusal := addClient(c, session, client); refusal != nil {
+		refuseUpgraded(conn, sessionID, refusal)
+		return
+	}
+	welcomeClient(c, session, client)
+	go handleMessages(client, session, conn)
+}
+
+func newClient(sessionID string, join JoinRequest) *Client {
+	now := getCurrentTimestamp()
+	var userID, method string
+	if join.Token != "" {
+		if user, m := users.byToken(join.Token); user != nil {
+			userID, method = user.ID, m
+		}
+	}
+	return &Client{
+		Name:       join.Name,
+		SessionID:  sessionID,
+		Role:       join.Role,
+		Features:   join.Features,
+		JoinedAt:   now,
+		Status:     ClientConnected,
+		lastActive: now,
+		limiter:    newMessageLimiter(config.Limits.MessagesPerSecond),
+
+		cursorLimiter:   newMessageLimiter(cursorMaxRate),
+		reactionLimiter: newMessageLimiter(reactionMaxRate),
+		handLimiter:     newMessageLimiter(handMaxRate),
+		inputLimiter:    newMessageLimiter(inputMaxRate),
+		frames:          newFrameStats(),
+		resumeToken:     randomToken(16),
+		userID:          userID,
+		viaSSO:          method == AuthSSO,
+	}
+}
+
+// addClient registers client in session unless admission now refuses it.
+func addClient(c *gin.Context, session *Session, client *Client) *admissionError {
+	if user := currentUser(c); user != nil && client.userID == "" {
+		client.userID, client.viaSSO = user.ID, signedInWithSSO(c)
+	}
+	if client.Role == RolePresenter && session.hostedBy(client.userID, client.viaSSO) {
+		client.host = 1
 	}
 
 	store.mu.Lock()
-	store.Clients[clientID] = client
-	session.Clients[clientID] = client
-	store.mu.Unlock()
+	defer store.mu.Unlock()
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if refusal := admit(session, false); refusal != nil {
+		return refusal
+	}
+	claimHost(session, client)
+	client.ID = store.newClientID()
+	client.log = requestLog(c).With("sessionId", session.ID, "clientId", client.ID)
+	if holdsInWaitingRoom(session, client) {
+		holdClient(session, client)
+		return nil
+	}
+	registerClient(session, client)
+	return nil
+}
+
+// registerClient makes client a member of session. Callers must hold
+// store.mu and session.mu.
+func registerClient(session *Session, client *Client) {
+	store.Clients[client.ID] = client
+	session.Clients[client.ID] = client
+	session.Status = SessionLive
+	session.IdleSince = 0
+	session.observeJoin(client)
+	client.ackedSeq = session.stream.seq
+}
 
-	sendMessage(conn, Message{
+// welcomeClient sends a newly added client its session_joined and the
+// session's state, and announces it to the others. A client held in the
+// waiting room is told to wait instead.
+func welcomeClient(c *gin.Context, session *Session, client *Client) {
+	if client.held && announceWaiting(session, client) {
+		return
+	}
+	greetClient(requestSpan(c), session, client)
+}
+
+func greetClient(span *Span, session *Session, client *Client) {
+	observeJoin(session)
+	emitEvent(EventClientJoined, gin.H{
+		"sessionId": session.ID,
+		"clientId":  client.ID,
+		"name":      client.Name,
+		"role":      client.Role,
+	})
+
+	client.send(Message{
 		Type: "session_joined",
 		Payload: gin.H{
-			"sessionId": sessionID,
-			"clientId":  clientID,
+			"sessionId":   session.ID,
+			"clientId":    client.ID,
+			"resumeToken": client.resumeToken,
+			"seq":         client.ackedSeq,
 		},
 	})
+	sendPresenceSync(client, session)
+	sendAnnotationSync(client, session)
+	sendPollSync(client, session)
+	sendQuestionSync(client, session)
+	sendChatSync(client, session)
+	sendFrameSync(client, session)
+	sendE2EEKeySync(client, session)
+	if isHost(client) {
+		sendWaitingRoom(client, session)
+	}
 
-	broadcastToSession(sessionID, Message{
+	broadcastToSession(span, session.ID, Message{
 		Type: "client_joined",
 		Payload: gin.H{
-			"clientId": clientID,
+			"clientId": client.ID,
+			"name":     client.Name,
+			"role":     client.Role,
+			"features": client.Features,
 		},
-	}, clientID)
-
-	go handleMessages(client, session)
+	}, client.ID)
 }
 
-func handleMessages(client *Client, session *Session) {
+func handleMessages(client *Client, session *Session, conn *websocket.Conn) {
 	defer func() {
-		if client.Conn != nil {
-			client.Conn.Close()
-		}
-
-		store.mu.Lock()
-		delete(store.Clients, client.ID)
-		delete(session.Clients, client.ID)
-		store.mu.Unlock()
-
-		broadcastToSession(session.ID, Message{
-			Type: "client_left",
-			Payload: gin.H{
-				"clientId": client.ID,
-			},
-		}, "")
+		conn.Close()
+		connectionEnded(client, session, func() bool { return client.releaseConn(conn) })
 	}()
 
+	// Frames over the configured cap are rejected with an error message;
+	// anything beyond twice the cap is a protocol violation and gorilla
+	// closes the connection with 1009 before we buffer it.
+	maxBytes := config.Limits.MaxMessageBytes
+	conn.SetReadLimit(2 * maxBytes)
+
+	codec := codecFor(conn)
 	for {
-		_, message, err := client.Conn.ReadMessage()
+		_, message, err := conn.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			client.log.Warn("closing client over message size limit", "limit", maxBytes)
+			break
+		}
 		if err != nil {
-			log.Printf("Error reading message: %v", err)
+			client.log.Debug("websocket read ended", "error", err)
 			break
 		}
-
-		broadcastToSession(session.ID, Message{
-			Type: "screen_data",
-			Payload: gin.H{
-				"clientId": client.ID,
-				"data":     string(message),
-			},
-		}, client.ID)
+		receive(client, session, message, codec)
 	}
 }
 
-func broadcastToSession(sessionID string, message Message, excludeClientID string) {
+// connectionEnded holds client for a reconnect, or lets it leave, once its
+// connection is gone. release detaches the connection and reports whether
+// it was still the client's.
+func connectionEnded(client *Client, session *Session, release func() bool) {
 	store.mu.Lock()
-	session, exists := store.Sessions[sessionID]
-	if !exists {
+	session.mu.Lock()
+	if !release() {
+		// A resumed connection has taken over this client.
+		session.mu.Unlock()
 		store.mu.Unlock()
 		return
 	}
+	if client.held && session.Clients[client.ID] != client {
+		leaveWaitingRoom(session, client)
+		session.mu.Unlock()
+		store.mu.Unlock()
+		return
+	}
+	if holdForReconnect(client, session) {
+		session.mu.Unlock()
+		store.mu.Unlock()
+		client.log.Debug("client disconnected, holding for reconnect")
+		return
+	}
+	removeClient(client, session)
+	session.mu.Unlock()
+	store.mu.Unlock()
 
+	announceLeave(client, session)
+}
+
+// receive handles one frame from client, whichever transport carried it.
+func receive(client *Client, session *Session, message []byte, codec wireCodec) {
+	client.recvMu.Lock()
+	defer client.recvMu.Unlock()
+	maxBytes := config.Limits.MaxMessageBytes
+	client.touch()
+	session.countMessage()
+
+	if int64(len(message)) > maxBytes {
+		client.log.Warn("rejected oversized message", "bytes", len(message), "limit", maxBytes)
+		sendError(client, "message_too_large", fmt.Sprintf("Messages are limited to %d bytes", maxBytes))
+		return
+	}
+
+	if isWaiting(client) {
+		sendError(client, "waiting", "Wait for the host to admit you")
+		return
+	}
+
+	msg, err := codec.Decode(message)
+	if err != nil {
+		sendError(client, "invalid_frame", err.Error())
+		return
+	}
+	switch msg.Type {
+	case "cursor":
+		handleCursor(client, session, msg)
+		return
+	case "input":
+		handleInput(client, session, msg)
+		return
+	}
+
+	if ok, wait, notify := client.limiter.Allow(); !ok {
+		if notify {
+			client.log.Warn("client rate limited")
+			client.send(Message{
+				Type: "rate_limited",
+				Payload: gin.H{
+					"retryAfter": wait.Milliseconds(),
+				},
+			})
+		}
+		return
+	}
+
+	span := startSpan(nil, "ws.message", SpanKindServer)
+	span.SetAttr("session.id", session.ID)
+	span.SetAttr("client.id", client.ID)
+	span.SetAttr("message.bytes", len(message))
+
+	handleInbound(client, session, span, msg)
+
+	span.Finish()
+}
+
+// broadcastToSession snapshots the session's recipients under its lock and
+// writes to them after releasing it, holding sendMu so recipients see
+// broadcasts in sequence order.
+func broadcastToSession(parent *Span, sessionID string, message Message, excludeClientID string) {
+	session, exists := store.session(sessionID)
+	if !exists {
+		return
+	}
+
+	session.mu.Lock()
+	message = session.stream.stamp(message, excludeClientID).shared()
+	recipients := make([]*Client, 0, len(session.Clients))
 	for id, client := range session.Clients {
 		if id != excludeClientID {
-			sendMessage(client.Conn, message)
+			recipients = append(recipients, client)
 		}
 	}
-	store.mu.Unlock()
-}
+	session.sendMu.Lock()
+	session.mu.Unlock()
+	defer session.sendMu.Unlock()
 
-func sendMessage(conn *websocket.Conn, message Message) {
-	if conn != nil {
-		if err := conn.WriteJSON(message); err != nil {
-			log.Printf("Error sending message: %v", err)
+	// Frames, cursors and the like are too frequent to be worth logging.
+	if !lossyTypes[message.Type] {
+		relayed := gin.H{
+			"sessionId":  sessionID,
+			"type":       message.Type,
+			"seq":        message.Seq,
+			"recipients": len(recipients),
+		}
+		if excludeClientID != "" {
+			relayed["clientId"] = excludeClientID
 		}
+		changes.Record(ChangeMessageRelayed, relayed)
+	}
+
+	fanOut(recipients, func(_ int, client *Client) {
+		span := startSpan(parent, "ws.deliver", SpanKindProducer)
+		span.SetAttr("session.id", sessionID)
+		span.SetAttr("client.id", client.ID)
+		span.SetError(deliver(client, message))
+		span.Finish()
+	})
+}
+
+// send writes message to the client's current connection, bypassing any
+// fault profile.
+func (c *Client) send(message Message) error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if len(c.delayed) > 0 {
+		// Stay behind the messages a fault profile delays.
+		c.hold(message, 0)
+		return nil
+	}
+	return c.write(message)
+}
+
+func (c *Client) closeConn() {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.closeTransport()
+}
+
+// closeTransport closes the client's connection, whichever kind it is.
+// Callers must hold c.connMu.
+func (c *Client) closeTransport() {
+	if c.Conn != nil {
+		c.Conn.Close()
 	}
+	if c.events != nil {
+		c.events.close()
+	}
+}
+
+// releaseConn detaches conn from the client and reports whether it was
+// still the client's connection.
+func (c *Client) releaseConn(conn *websocket.Conn) bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.Conn != conn {
+		return false
+	}
+	c.Conn = nil
+	return true
 }
 
-func generateID() string {
-	return "id_" + randomString(8)
+func sendMessage(conn *websocket.Conn, message Message) error {
+	if conn == nil {
+		return nil
+	}
+	var err error
+	if message.encoded != nil {
+		err = writePrepared(conn, message)
+	} else {
+		err = writeMessage(conn, message)
+	}
+	if err != nil {
+		logger.Warn("websocket write failed", "error", err)
+	}
+	return err
 }
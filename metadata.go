@@ -0,0 +1,115 @@
+package tango
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	metadataMaxKeys     = 32
+	metadataMaxKeyLen   = 64
+	metadataMaxValueLen = 512
+	metadataQueryPrefix = "metadata."
+
+	maxTags   = 20
+	maxTagLen = 32
+)
+
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > metadataMaxKeys {
+		return fmt.Errorf("metadata may hold at most %d keys", metadataMaxKeys)
+	}
+	for key, value := range metadata {
+		if key == "" || len(key) > metadataMaxKeyLen {
+			return fmt.Errorf("metadata keys must be 1-%d characters", metadataMaxKeyLen)
+		}
+		if len(value) > metadataMaxValueLen {
+			return fmt.Errorf("metadata value for %q exceeds %d characters", key, metadataMaxValueLen)
+		}
+	}
+	return nil
+}
+
+var errExternalIDTaken = errors.New("externalId already in use")
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
+
+// mergeMetadata applies a metadata update to a copy of metadata: each key
+// is set, or removed when its value is null. The result is validated.
+func mergeMetadata(metadata map[string]string, update map[string]*string) (map[string]string, error) {
+	merged := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		merged[key] = value
+	}
+	for key, value := range update {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = *value
+		}
+	}
+	if err := validateMetadata(merged); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+func validateTags(tags []string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	for _, tag := range tags {
+		if tag == "" || len(tag) > maxTagLen {
+			return fmt.Errorf("tags must be 1-%d characters", maxTagLen)
+		}
+	}
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTags reports whether tags include every one of want.
+func hasTags(tags, want []string) bool {
+	for _, tag := range want {
+		if !hasTag(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesResourceFilter applies the externalId and metadata.<key> query
+// parameters shared by list endpoints.
+func matchesResourceFilter(query url.Values, externalID string, metadata map[string]string) bool {
+	if want := query.Get("externalId"); want != "" && want != externalID {
+		return false
+	}
+	for param, values := range query {
+		if !strings.HasPrefix(param, metadataQueryPrefix) || len(values) == 0 {
+			continue
+		}
+		value, exists := metadata[strings.TrimPrefix(param, metadataQueryPrefix)]
+		if !exists || value != values[0] {
+			return false
+		}
+	}
+	return true
+}
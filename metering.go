@@ -0,0 +1,359 @@
+package tango
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ScopeUser      = "user"
+	ScopeWorkspace = "workspace"
+
+	QuotaConcurrentSessions = "concurrentSessions"
+	QuotaClientsPerSession  = "clientsPerSession"
+	QuotaStorageBytes       = "storageBytes"
+	QuotaMonthlyRelayBytes  = "monthlyRelayBytes"
+
+	monthLayout = "2006-01"
+)
+
+// QuotaBreach explains a refusal caused by a usage quota, so clients can
+// tell which limit they hit and whose it is.
+type QuotaBreach struct {
+	Scope   string `json:"scope"`
+	ScopeID string `json:"scopeId"`
+	Quota   string `json:"quota"`
+	Limit   int64  `json:"limit"`
+	Used    int64  `json:"used"`
+}
+
+func (b *QuotaBreach) message() string {
+	return "The " + b.Scope + " has reached its " + b.Quota + " quota"
+}
+
+func rejectQuota(c *gin.Context, breach *QuotaBreach) {
+	c.JSON(http.StatusForbidden, gin.H{"error": breach.message(), "reason": "quota_exceeded", "quota": breach})
+}
+
+// usageCounter meters one user or workspace. Relayed bytes count toward
+// the calendar month (UTC) in month and start over with the next one.
+type usageCounter struct {
+	month        string
+	relayedBytes int64
+	storageBytes int64
+}
+
+func (u *usageCounter) relayed(month string) int64 {
+	if u == nil || u.month != month {
+		return 0
+	}
+	return u.relayedBytes
+}
+
+// Meter keeps usage that isn't derived from live sessions. Figures are in
+// memory only and start over when the server restarts.
+type Meter struct {
+	users      map[string]*usageCounter
+	workspaces map[string]*usageCounter
+	mu         sync.Mutex
+}
+
+var meter = &Meter{
+	users:      make(map[string]*usageCounter),
+	workspaces: make(map[string]*usageCounter),
+}
+
+func currentMonth() string {
+	return time.Now().UTC().Format(monthLayout)
+}
+
+// counter returns the scope's counter, creating it on first use. Callers
+// must hold m.mu.
+func (m *Meter) counter(scope, id string) *usageCounter {
+	counters := m.users
+	if scope == ScopeWorkspace {
+		counters = m.workspaces
+	}
+	u, exists := counters[id]
+	if !exists {
+		u = &usageCounter{}
+		counters[id] = u
+	}
+	return u
+}
+
+// meterScope is a user or workspace that usage is billed to.
+type meterScope struct {
+	kind string
+	id   string
+}
+
+// billedTo lists who usage is billed to: the user and the workspace,
+// where there are any.
+func billedTo(userID, workspaceID string) []meterScope {
+	var scopes []meterScope
+	if userID != "" {
+		scopes = append(scopes, meterScope{ScopeUser, userID})
+	}
+	if workspaceID != "" {
+		scopes = append(scopes, meterScope{ScopeWorkspace, workspaceID})
+	}
+	return scopes
+}
+
+// addRelayed meters n bytes relayed in session to whoever created it and
+// its workspace. Callers must hold session.mu.
+func (m *Meter) addRelayed(session *Session, n int) {
+	scopes := billedTo(session.CreatedBy, session.WorkspaceID)
+	if len(scopes) == 0 {
+		return
+	}
+	month := currentMonth()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, scope := range scopes {
+		u := m.counter(scope.kind, scope.id)
+		if u.month != month {
+			u.month, u.relayedBytes = month, 0
+		}
+		u.relayedBytes += int64(n)
+	}
+}
+
+func (m *Meter) relayed(scope, id string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counter(scope, id).relayed(currentMonth())
+}
+
+func (m *Meter) storage(scope, id string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counter(scope, id).storageBytes
+}
+
+// reserveStorage accounts n bytes of stored screenshots or recordings to
+// the user and workspace, refusing if either would go over its quota.
+func (m *Meter) reserveStorage(userID, workspaceID string, n int64) *QuotaBreach {
+	scopes := billedTo(userID, workspaceID)
+	limits := make([]int64, len(scopes))
+	for i, scope := range scopes {
+		limits[i] = quotaFor(scope.kind, scope.id).StorageBytes
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, scope := range scopes {
+		if used := m.counter(scope.kind, scope.id).storageBytes; limits[i] > 0 && used+n > limits[i] {
+			return &QuotaBreach{Scope: scope.kind, ScopeID: scope.id, Quota: QuotaStorageBytes, Limit: limits[i], Used: used}
+		}
+	}
+	for _, scope := range scopes {
+		m.counter(scope.kind, scope.id).storageBytes += n
+	}
+	return nil
+}
+
+// chargeStorage accounts n bytes to the user and workspace without
+// checking their quotas, for data an operator brings in.
+func (m *Meter) chargeStorage(userID, workspaceID string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, scope := range billedTo(userID, workspaceID) {
+		m.counter(scope.kind, scope.id).storageBytes += n
+	}
+}
+
+// releaseStorage gives back bytes reserved with reserveStorage.
+func (m *Meter) releaseStorage(userID, workspaceID string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, scope := range billedTo(userID, workspaceID) {
+		m.counter(scope.kind, scope.id).storageBytes -= n
+	}
+}
+
+// quotaFor returns the quota in force for a user or workspace. Operators
+// can override the configured workspace quota per workspace.
+func quotaFor(scope, id string) UsageQuota {
+	if scope == ScopeUser {
+		return config.UserQuota
+	}
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+	if ws, exists := workspaces.Workspaces[id]; exists && ws.Quota != nil {
+		return *ws.Quota
+	}
+	return config.WorkspaceQuota
+}
+
+// liveSessions counts the sessions billed to the scope that still accept
+// joins, and the most clients any of them has. Callers must hold store.mu.
+func liveSessions(scope, id string) (sessions int64, clients int64) {
+	for _, session := range store.Sessions {
+		session.mu.Lock()
+		billed := scope == ScopeUser && session.CreatedBy == id || scope == ScopeWorkspace && session.WorkspaceID == id
+		if billed && session.acceptsJoins() {
+			sessions++
+			if n := int64(len(session.Clients)); n > clients {
+				clients = n
+			}
+		}
+		session.mu.Unlock()
+	}
+	return sessions, clients
+}
+
+// checkRelayQuota refuses when a scope has used up its monthly relayed
+// bandwidth.
+func checkRelayQuota(scope, id string) *QuotaBreach {
+	limit := quotaFor(scope, id).MonthlyRelayBytes
+	if used := meter.relayed(scope, id); limit > 0 && used >= limit {
+		return &QuotaBreach{Scope: scope, ScopeID: id, Quota: QuotaMonthlyRelayBytes, Limit: limit, Used: used}
+	}
+	return nil
+}
+
+// checkCreateQuota decides whether userID may start another session in
+// workspaceID. Callers must hold store.mu.
+func checkCreateQuota(userID, workspaceID string) *QuotaBreach {
+	for _, scope := range billedTo(userID, workspaceID) {
+		limit := int64(quotaFor(scope.kind, scope.id).ConcurrentSessions)
+		if limit > 0 {
+			if used, _ := liveSessions(scope.kind, scope.id); used >= limit {
+				return &QuotaBreach{Scope: scope.kind, ScopeID: scope.id, Quota: QuotaConcurrentSessions, Limit: limit, Used: used}
+			}
+		}
+		if breach := checkRelayQuota(scope.kind, scope.id); breach != nil {
+			return breach
+		}
+	}
+	return nil
+}
+
+// checkJoinQuota decides whether another client may join session. Callers
+// must hold session.mu.
+func checkJoinQuota(session *Session) *QuotaBreach {
+	for _, scope := range billedTo(session.CreatedBy, session.WorkspaceID) {
+		limit := int64(quotaFor(scope.kind, scope.id).ClientsPerSession)
+		if used := int64(len(session.Clients)); limit > 0 && used >= limit {
+			return &QuotaBreach{Scope: scope.kind, ScopeID: scope.id, Quota: QuotaClientsPerSession, Limit: limit, Used: used}
+		}
+		if breach := checkRelayQuota(scope.kind, scope.id); breach != nil {
+			return breach
+		}
+	}
+	return nil
+}
+
+type UsageItem struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+}
+
+type UsageReport struct {
+	Scope              string    `json:"scope"`
+	ID                 string    `json:"id"`
+	Name               string    `json:"name,omitempty"`
+	ConcurrentSessions UsageItem `json:"concurrentSessions"`
+	ClientsPerSession  UsageItem `json:"clientsPerSession"`
+	StorageBytes       UsageItem `json:"storageBytes"`
+	MonthlyRelayBytes  UsageItem `json:"monthlyRelayBytes"`
+}
+
+// usageReport describes a scope's usage against its quota. For clients
+// per session, used is the largest live session. A limit of 0 means
+// unlimited.
+func usageReport(scope, id, name string) UsageReport {
+	quota := quotaFor(scope, id)
+	store.mu.RLock()
+	sessions, clients := liveSessions(scope, id)
+	store.mu.RUnlock()
+	return UsageReport{
+		Scope:              scope,
+		ID:                 id,
+		Name:               name,
+		ConcurrentSessions: UsageItem{Used: sessions, Limit: int64(quota.ConcurrentSessions)},
+		ClientsPerSession:  UsageItem{Used: clients, Limit: int64(quota.ClientsPerSession)},
+		StorageBytes:       UsageItem{Used: meter.storage(scope, id), Limit: quota.StorageBytes},
+		MonthlyRelayBytes:  UsageItem{Used: meter.relayed(scope, id), Limit: quota.MonthlyRelayBytes},
+	}
+}
+
+// getUsage reports the caller's own usage and that of each workspace they
+// belong to, or only ?workspaceId= when given.
+func getUsage(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+
+	only := c.Query("workspaceId")
+	if only != "" && !canAccess(c, only) {
+		notFound(c, "Workspace not found")
+		return
+	}
+
+	mine := workspaces.memberships(user, signedInWithSSO(c))
+	names := make(map[string]string)
+	workspaces.mu.Lock()
+	for id := range mine {
+		if ws, exists := workspaces.Workspaces[id]; exists && (only == "" || id == only) {
+			names[id] = ws.Name
+		}
+	}
+	workspaces.mu.Unlock()
+
+	reports := make([]UsageReport, 0, len(names))
+	for id, name := range names {
+		reports = append(reports, usageReport(ScopeWorkspace, id, name))
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].ID < reports[j].ID })
+
+	c.JSON(http.StatusOK, gin.H{
+		"period":     currentMonth(),
+		"user":       usageReport(ScopeUser, user.ID, user.Email),
+		"workspaces": reports,
+	})
+}
+
+type WorkspaceQuotaRequest struct {
+	Quota *UsageQuota `json:"quota"`
+}
+
+// setWorkspaceQuota lets an operator replace the quota of one workspace,
+// for instance to match its plan. Null restores the configured default.
+func setWorkspaceQuota(c *gin.Context) {
+	id := c.Param("id")
+
+	var req WorkspaceQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Quota != nil && len(req.Quota.validate("workspace")) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quotas must not be negative"})
+		return
+	}
+
+	workspaces.mu.Lock()
+	ws, exists := workspaces.Workspaces[id]
+	name := ""
+	if exists {
+		ws.Quota = req.Quota
+		name = ws.Name
+	}
+	workspaces.mu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+
+	auditRequest(c, "workspace.quota", "workspace", id, gin.H{"quota": req.Quota})
+	c.JSON(http.StatusOK, usageReport(ScopeWorkspace, id, name))
+}
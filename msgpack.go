@@ -0,0 +1,332 @@
+package tango
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// msgpackCodec implements the subset of MessagePack needed for message
+// envelopes: nil, booleans, integers, floats, strings, binary, arrays and
+// string-keyed maps. Extension types are rejected.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(dst []byte, message Message) ([]byte, error) {
+	envelope, err := genericEnvelope(message)
+	if err != nil {
+		return dst, err
+	}
+	return appendMsgpack(dst, envelope)
+}
+
+func (msgpackCodec) Decode(frame []byte) (InboundMessage, error) {
+	d := msgpackDecoder{data: frame}
+	envelope, err := d.value(0)
+	if err != nil {
+		return InboundMessage{}, err
+	}
+	if d.pos != len(frame) {
+		return InboundMessage{}, errors.New("msgpack: trailing bytes after envelope")
+	}
+	return binaryInbound(envelope, frame)
+}
+
+func (msgpackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	switch value := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if value {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case int64:
+		return appendMsgpackInt(b, value), nil
+	case uint64:
+		if value <= math.MaxInt64 {
+			return appendMsgpackInt(b, int64(value)), nil
+		}
+		b = append(b, 0xcf)
+		return appendUint64(b, value), nil
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+			return appendMsgpackInt(b, int64(value)), nil
+		}
+		b = append(b, 0xcb)
+		return appendUint64(b, math.Float64bits(value)), nil
+	case string:
+		n := len(value)
+		switch {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = append(b, 0xda)
+			b = appendUint16(b, uint16(n))
+		default:
+			b = append(b, 0xdb)
+			b = appendUint32(b, uint32(n))
+		}
+		return append(b, value...), nil
+	case []byte:
+		n := len(value)
+		switch {
+		case n <= math.MaxUint8:
+			b = append(b, 0xc4, byte(n))
+		case n <= math.MaxUint16:
+			b = append(b, 0xc5)
+			b = appendUint16(b, uint16(n))
+		default:
+			b = append(b, 0xc6)
+			b = appendUint32(b, uint32(n))
+		}
+		return append(b, value...), nil
+	case []interface{}:
+		b = appendMsgpackLen(b, len(value), 0x90, 0xdc)
+		var err error
+		for _, item := range value {
+			if b, err = appendMsgpack(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		b = appendMsgpackLen(b, len(value), 0x80, 0xde)
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var err error
+		for _, k := range keys {
+			if b, err = appendMsgpack(b, k); err != nil {
+				return nil, err
+			}
+			if b, err = appendMsgpack(b, value[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("msgpack: cannot encode %T", v)
+}
+
+// appendMsgpackLen writes an array or map header: the fix form when n < 16,
+// otherwise the 16- or 32-bit form that follows code16.
+func appendMsgpackLen(b []byte, n int, fix, code16 byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, code16)
+		return appendUint16(b, uint16(n))
+	default:
+		b = append(b, code16+1)
+		return appendUint32(b, uint32(n))
+	}
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		b = append(b, 0xd1)
+		return appendUint16(b, uint16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		b = append(b, 0xd2)
+		return appendUint32(b, uint32(n))
+	}
+	b = append(b, 0xd3)
+	return appendUint64(b, uint64(n))
+}
+
+// maxMsgpackDepth bounds nesting so hostile frames cannot exhaust the stack.
+const maxMsgpackDepth = 32
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.take(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("msgpack: nesting too deep")
+	}
+	head, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	c := head[0]
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return d.mapping(int(c&0x0f), depth)
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.take(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		if n <= math.MaxInt64 {
+			return int64(n), err
+		}
+		return n, err
+	case 0xd0:
+		n, err := d.uint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return int64(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapping(int(n), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", c)
+}
+
+func (d *msgpackDecoder) str(n int) (interface{}, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) array(n, depth int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	list := make([]interface{}, n)
+	for i := range list {
+		item, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = item
+	}
+	return list, nil
+}
+
+func (d *msgpackDecoder) mapping(n, depth int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map keys must be strings")
+		}
+		if m[k], err = d.value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(n>>32)), uint32(n))
+}
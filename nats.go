@@ -0,0 +1,169 @@
+package tango
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsPublisher publishes to NATS over its text protocol, which is small
+// enough not to need a client library. Each publish is followed by a PING
+// and waits for the PONG, so it only returns once the server has processed
+// the message. A failed connection is dropped and dialled again on the next
+// publish, trying the configured servers in order.
+type natsPublisher struct {
+	servers []string
+	subject string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+func newNATSPublisher(cfg PublishConfig) *natsPublisher {
+	return &natsPublisher{servers: cfg.URLs, subject: cfg.Topic}
+}
+
+func (n *natsPublisher) Publish(ctx context.Context, _ string, event []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	err := n.exchange(ctx, fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", n.subject, len(event), event))
+	if err != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+	return err
+}
+
+func (n *natsPublisher) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn = nil
+	return err
+}
+
+// connect dials the first server that accepts the connection. Callers
+// must hold n.mu.
+func (n *natsPublisher) connect(ctx context.Context) error {
+	var err error
+	for _, server := range n.servers {
+		if err = n.dial(ctx, server); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (n *natsPublisher) dial(ctx context.Context, server string) error {
+	target, err := url.Parse(server)
+	if err != nil {
+		return err
+	}
+	host := target.Host
+	if target.Port() == "" {
+		host = net.JoinHostPort(target.Hostname(), "4222")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The server opens with INFO and upgrades to TLS after it when asked
+	// to.
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats %s: expected INFO, got %q: %v", target.Host, strings.TrimSpace(line), err)
+	}
+	var info natsInfo
+	json.Unmarshal([]byte(line[len("INFO "):]), &info)
+	if info.TLSRequired || target.Scheme == "tls" {
+		secure := tls.Client(conn, &tls.Config{ServerName: target.Hostname()})
+		if err := secure.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn, reader = secure, bufio.NewReader(secure)
+	}
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "tango",
+		"lang":     "go",
+		"version":  "1",
+		"protocol": 1,
+	}
+	if user := target.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			options["user"], options["pass"] = user.Username(), pass
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+
+	n.conn, n.reader = conn, reader
+	if err := n.exchange(ctx, "CONNECT "+string(connect)+"\r\nPING\r\n"); err != nil {
+		conn.Close()
+		n.conn = nil
+		return fmt.Errorf("nats %s: %v", target.Host, err)
+	}
+	return nil
+}
+
+// exchange writes commands, which end in a PING, and waits for the PONG,
+// answering the server's own pings meanwhile. Callers must hold n.mu.
+func (n *natsPublisher) exchange(ctx context.Context, commands string) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(outboundTimeout)
+	}
+	n.conn.SetDeadline(deadline)
+	if _, err := n.conn.Write([]byte(commands)); err != nil {
+		return err
+	}
+	for {
+		line, err := n.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(line, "PONG"):
+			return nil
+		case strings.HasPrefix(line, "PING"):
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + strings.Trim(strings.TrimSpace(line[len("-ERR"):]), "'"))
+		}
+	}
+}
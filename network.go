@@ -0,0 +1,328 @@
+package tango
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reasons a NetworkPolicy turns a request away.
+const (
+	NetworkIPDenied          = "ip_denied"
+	NetworkIPNotAllowed      = "ip_not_allowed"
+	NetworkCountryDenied     = "country_denied"
+	NetworkCountryNotAllowed = "country_not_allowed"
+
+	// blockedAuditInterval is how often the same address being turned away
+	// from the same workspace is audited.
+	blockedAuditInterval = time.Minute
+	maxBlockedAudits     = 10000
+
+	// networkDecisionsKey holds, per request, what each workspace's policy
+	// decided; networkDeniedKey the workspace a lookup was turned away from.
+	networkDecisionsKey = "networkDecisions"
+	networkDeniedKey    = "networkDenied"
+)
+
+var errSelfBlock = errors.New("the policy would block the address you are calling from")
+
+// NetworkPolicy limits where a workspace can be reached from. Addresses
+// and countries on a deny list are turned away; when an allow list is
+// set, only what is on it gets in. Countries are ISO 3166 codes, which the
+// proxy in front of the server sends in the header config.CountryHeader
+// names; a request without one does not get past an allow list.
+type NetworkPolicy struct {
+	AllowCIDRs     []string `json:"allowCidrs,omitempty" binding:"max=200"`
+	DenyCIDRs      []string `json:"denyCidrs,omitempty" binding:"max=200"`
+	AllowCountries []string `json:"allowCountries,omitempty" binding:"max=250"`
+	DenyCountries  []string `json:"denyCountries,omitempty" binding:"max=250"`
+
+	allow, deny []*net.IPNet
+}
+
+// prepare parses the policy's ranges, which may also be single addresses,
+// and normalises its countries, returning an error that can be shown to
+// the client if the policy is unusable.
+func (p *NetworkPolicy) prepare() error {
+	if len(p.AllowCIDRs)+len(p.DenyCIDRs)+len(p.AllowCountries)+len(p.DenyCountries) == 0 {
+		return errors.New("a network policy needs at least one address range or country")
+	}
+	var err error
+	if p.allow, err = parseCIDRs(p.AllowCIDRs); err != nil {
+		return err
+	}
+	if p.deny, err = parseCIDRs(p.DenyCIDRs); err != nil {
+		return err
+	}
+	if len(p.AllowCountries)+len(p.DenyCountries) > 0 && config.CountryHeader == "" {
+		return errors.New("country rules need the server to know where requests come from; COUNTRY_HEADER is not set")
+	}
+	for _, countries := range [][]string{p.AllowCountries, p.DenyCountries} {
+		for i, country := range countries {
+			country = strings.ToUpper(strings.TrimSpace(country))
+			if len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+				return fmt.Errorf("%q is not a two-letter country code", countries[i])
+			}
+			countries[i] = country
+		}
+	}
+	return nil
+}
+
+func parseCIDRs(ranges []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		if ip := net.ParseIP(r); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", r)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ip != nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide returns why a request from ip in country is turned away, or ""
+// if it is let in. A deny list wins over an allow list.
+func (p *NetworkPolicy) decide(ip net.IP, country string) string {
+	switch {
+	case containsIP(p.deny, ip):
+		return NetworkIPDenied
+	case country != "" && containsString(p.DenyCountries, country):
+		return NetworkCountryDenied
+	case len(p.allow) > 0 && !containsIP(p.allow, ip):
+		return NetworkIPNotAllowed
+	case len(p.AllowCountries) > 0 && !containsString(p.AllowCountries, country):
+		return NetworkCountryNotAllowed
+	}
+	return ""
+}
+
+// workspaceNetworkPolicy returns the network policy of a workspace, or
+// nil. A policy is replaced rather than changed, so it can be used
+// unlocked.
+func workspaceNetworkPolicy(workspaceID string) *NetworkPolicy {
+	if workspaceID == "" {
+		return nil
+	}
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+	if ws, exists := workspaces.Workspaces[workspaceID]; exists {
+		return ws.NetworkPolicy
+	}
+	return nil
+}
+
+// requestNetwork returns the caller's address and, when the server is told
+// it, country.
+func requestNetwork(c *gin.Context) (net.IP, string) {
+	country := ""
+	if config.CountryHeader != "" {
+		country = strings.ToUpper(strings.TrimSpace(c.GetHeader(config.CountryHeader)))
+	}
+	return net.ParseIP(c.ClientIP()), country
+}
+
+// networkBlock returns why the caller cannot reach a workspace from where
+// it is, or "" if it can, auditing the refusal without responding. Each
+// workspace is decided once per request, so a listing that filters many of
+// its resources neither repeats the check nor audits it more than once.
+func networkBlock(c *gin.Context, workspaceID string) string {
+	decisions, _ := c.Value(networkDecisionsKey).(*networkDecisions)
+	if decisions == nil {
+		decisions = &networkDecisions{reasons: make(map[string]string)}
+		c.Set(networkDecisionsKey, decisions)
+	}
+	// Realtime connections keep using their handshake's context from more
+	// than one goroutine.
+	decisions.mu.Lock()
+	defer decisions.mu.Unlock()
+	if reason, decided := decisions.reasons[workspaceID]; decided {
+		return reason
+	}
+
+	reason := ""
+	ip, country := requestNetwork(c)
+	if policy := workspaceNetworkPolicy(workspaceID); policy != nil {
+		reason = policy.decide(ip, country)
+	}
+	decisions.reasons[workspaceID] = reason
+	if reason != "" && blockedAudits.due(workspaceID, c.ClientIP(), reason) {
+		auditRequest(c, "workspace.network.blocked", "workspace", workspaceID, gin.H{
+			"ip": c.ClientIP(), "country": country, "reason": reason, "method": c.Request.Method, "path": c.Request.URL.Path,
+		})
+	}
+	return reason
+}
+
+type networkDecisions struct {
+	reasons map[string]string
+	mu      sync.Mutex
+}
+
+// networkPermits reports whether the caller may reach a workspace from
+// where it is, without responding.
+func networkPermits(c *gin.Context, workspaceID string) bool {
+	return networkBlock(c, workspaceID) == ""
+}
+
+// denyNetwork notes that a lookup failed only because of the network
+// policy of workspaceID, for notFound to report.
+func denyNetwork(c *gin.Context, workspaceID string) {
+	c.Set(networkDeniedKey, workspaceID)
+}
+
+// notFound responds that a resource is missing, unless the caller is a
+// member turned away by its workspace's network policy: that gets the
+// network_restricted 403, so being blocked is not mistaken for a deleted
+// resource. Non-members still see the 404.
+func notFound(c *gin.Context, message string) {
+	if workspaceID := c.GetString(networkDeniedKey); workspaceID != "" {
+		rejectNetwork(c, workspaceID, networkBlock(c, workspaceID))
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": message})
+}
+
+// refusedJoin is why a realtime join to a session the caller may not see
+// is refused after the upgrade: hiddenSession, or the network restriction
+// notFound would report.
+func refusedJoin(c *gin.Context) *admissionError {
+	if c.GetString(networkDeniedKey) == "" {
+		return hiddenSession
+	}
+	return &admissionError{Status: http.StatusForbidden, Reason: "network_restricted", Message: "This workspace cannot be reached from your network"}
+}
+
+// rejectNetwork responds that a workspace cannot be reached from the
+// caller's network, and why.
+func rejectNetwork(c *gin.Context, workspaceID, reason string) {
+	body := gin.H{
+		"error":       "This workspace cannot be reached from your network",
+		"code":        "network_restricted",
+		"reason":      reason,
+		"workspaceId": workspaceID,
+		"ip":          c.ClientIP(),
+	}
+	if _, country := requestNetwork(c); country != "" {
+		body["country"] = country
+	}
+	c.JSON(http.StatusForbidden, body)
+}
+
+// blockedAuditLog remembers when a blocked address was last audited, so a
+// client retrying in a loop does not flood the audit log.
+type blockedAuditLog struct {
+	last map[string]time.Time
+	mu   sync.Mutex
+}
+
+var blockedAudits = &blockedAuditLog{last: make(map[string]time.Time)}
+
+func (b *blockedAuditLog) due(workspaceID, ip, reason string) bool {
+	key := workspaceID + "|" + ip + "|" + reason
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if last, seen := b.last[key]; seen && now.Sub(last) < blockedAuditInterval {
+		return false
+	}
+	if len(b.last) >= maxBlockedAudits {
+		for k, last := range b.last {
+			if now.Sub(last) >= blockedAuditInterval {
+				delete(b.last, k)
+			}
+		}
+	}
+	b.last[key] = now
+	return true
+}
+
+func getNetworkPolicy(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleAdmin) == nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"networkPolicy": workspaceNetworkPolicy(id)})
+}
+
+// updateNetworkPolicy replaces the workspace's network policy. A policy
+// that would turn the caller away is refused, so an admin cannot lock
+// themselves out.
+func updateNetworkPolicy(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleAdmin) == nil {
+		return
+	}
+	var req NetworkPolicy
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.prepare(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ip, country := requestNetwork(c)
+	if reason := req.decide(ip, country); reason != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": errSelfBlock.Error(), "reason": reason, "ip": c.ClientIP()})
+		return
+	}
+
+	workspaces.mu.Lock()
+	ws, exists := workspaces.Workspaces[id]
+	if exists {
+		ws.NetworkPolicy = &req
+	}
+	workspaces.mu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+
+	auditRequest(c, "workspace.network.update", "workspace", id, gin.H{
+		"allowCidrs": req.AllowCIDRs, "denyCidrs": req.DenyCIDRs, "allowCountries": req.AllowCountries, "denyCountries": req.DenyCountries,
+	})
+	c.JSON(http.StatusOK, gin.H{"networkPolicy": req})
+}
+
+func deleteNetworkPolicy(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleAdmin) == nil {
+		return
+	}
+	workspaces.mu.Lock()
+	ws, exists := workspaces.Workspaces[id]
+	if exists {
+		ws.NetworkPolicy = nil
+	}
+	workspaces.mu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+	auditRequest(c, "workspace.network.delete", "workspace", id, nil)
+	c.Status(http.StatusNoContent)
+}
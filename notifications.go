@@ -0,0 +1,194 @@
+package tango
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	NotifyComment    = "comment"
+	NotifyMention    = "mention"
+	NotifyInvitation = "invitation"
+	NotifyExport     = "export"
+	NotifyReminder   = "reminder"
+	NotifyAnomaly    = "anomaly"
+
+	maxNotificationsPerUser = 200
+	defaultNotificationPage = 50
+)
+
+// Notification tells a user about something that concerns them. Text is
+// ready to show; the IDs and Data let the frontend link to the subject.
+type Notification struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Text      string `json:"text"`
+	SessionID string `json:"sessionId,omitempty"`
+	ActorID   string `json:"actorId,omitempty"`
+	Data      gin.H  `json:"data,omitempty"`
+	Read      bool   `json:"read"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// NotificationCenter keeps each user's most recent notifications, oldest
+// first, and pushes new ones to the sessions the user has open.
+type NotificationCenter struct {
+	inbox map[string][]*Notification
+	mu    sync.Mutex
+}
+
+var notifications = &NotificationCenter{inbox: make(map[string][]*Notification)}
+
+// Notify adds note to the user's inbox and sends it, with the new unread
+// count, as a notification message to every connection the user has
+// open. Callers must not hold store, session or client locks.
+func (n *NotificationCenter) Notify(userID string, note Notification) {
+	note.ID = generateID()
+	note.CreatedAt = getCurrentTimestamp()
+
+	n.mu.Lock()
+	inbox := append(n.inbox[userID], &note)
+	if len(inbox) > maxNotificationsPerUser {
+		inbox = inbox[len(inbox)-maxNotificationsPerUser:]
+	}
+	n.inbox[userID] = inbox
+	unread := n.unread(userID)
+	n.mu.Unlock()
+
+	sendToUser(userID, Message{Type: "notification", Payload: gin.H{"notification": note, "unread": unread}})
+}
+
+// unread counts the user's unread notifications. Callers must hold n.mu.
+func (n *NotificationCenter) unread(userID string) int {
+	count := 0
+	for _, note := range n.inbox[userID] {
+		if !note.Read {
+			count++
+		}
+	}
+	return count
+}
+
+// List returns up to limit of the user's notifications, newest first.
+func (n *NotificationCenter) List(userID string, unreadOnly bool, limit int) ([]Notification, int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	list := []Notification{}
+	inbox := n.inbox[userID]
+	for i := len(inbox) - 1; i >= 0 && len(list) < limit; i-- {
+		if !unreadOnly || !inbox[i].Read {
+			list = append(list, *inbox[i])
+		}
+	}
+	return list, n.unread(userID)
+}
+
+// unreadSince returns the user's unread notifications created at or after
+// since, newest first.
+func (n *NotificationCenter) unreadSince(userID string, since int64) []Notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var list []Notification
+	inbox := n.inbox[userID]
+	for i := len(inbox) - 1; i >= 0 && inbox[i].CreatedAt >= since; i-- {
+		if !inbox[i].Read {
+			list = append(list, *inbox[i])
+		}
+	}
+	return list
+}
+
+// MarkRead marks the given notifications read, or all of them when ids is
+// empty, and returns how many remain unread.
+func (n *NotificationCenter) MarkRead(userID string, ids []string) int {
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, note := range n.inbox[userID] {
+		if len(ids) == 0 || want[note.ID] {
+			note.Read = true
+		}
+	}
+	return n.unread(userID)
+}
+
+func (n *NotificationCenter) forgetUser(userID string) {
+	n.mu.Lock()
+	delete(n.inbox, userID)
+	n.mu.Unlock()
+}
+
+// sendToUser sends message to every client connected as the user.
+func sendToUser(userID string, message Message) {
+	for _, client := range store.clientList() {
+		if client.userID == userID {
+			client.send(message)
+		}
+	}
+}
+
+// displayName is how a user is named in notifications.
+func displayName(user *User) string {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	if user.Name != "" {
+		return user.Name
+	}
+	return user.Email
+}
+
+func getNotifications(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	limit := defaultNotificationPage
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxNotificationsPerUser {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxNotificationsPerUser)})
+			return
+		}
+		limit = n
+	}
+	list, unread := notifications.List(user.ID, c.Query("unread") == "true", limit)
+	c.JSON(http.StatusOK, gin.H{"notifications": list, "unread": unread})
+}
+
+func getUnreadCount(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	_, unread := notifications.List(user.ID, true, 0)
+	c.JSON(http.StatusOK, gin.H{"unread": unread})
+}
+
+type MarkReadRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// markNotificationsRead marks notifications read, all of them unless ids
+// are given, and tells the user's other connections the new count.
+func markNotificationsRead(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	var req MarkReadRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	unread := notifications.MarkRead(user.ID, req.IDs)
+	sendToUser(user.ID, Message{Type: "notifications_read", Payload: gin.H{"unread": unread}})
+	c.JSON(http.StatusOK, gin.H{"unread": unread})
+}
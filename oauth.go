@@ -0,0 +1,429 @@
+package tango
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	oauthStateTTL    = 10 * time.Minute
+	oauthStateCookie = "tango_oauth_state"
+	oauthTimeout     = 10 * time.Second
+)
+
+// oauthProfile is what a provider tells us about the person signing in.
+// Nonce and Groups only come from OpenID Connect ID tokens.
+type oauthProfile struct {
+	Subject  string
+	Email    string
+	Name     string
+	Verified bool
+	Nonce    string
+	Groups   []string
+}
+
+type oauthTokens struct {
+	AccessToken string
+	IDToken     string
+}
+
+type oauthEndpoints struct {
+	AuthURL  string
+	TokenURL string
+}
+
+func staticEndpoints(authURL, tokenURL string) func() (oauthEndpoints, error) {
+	return func() (oauthEndpoints, error) {
+		return oauthEndpoints{AuthURL: authURL, TokenURL: tokenURL}, nil
+	}
+}
+
+// oauthProvider describes an identity provider. Providers with a nonce send
+// one in the authorization request and expect it back in the ID token.
+type oauthProvider struct {
+	Nonce     bool
+	scopes    func() []string
+	config    func() OAuthProviderConfig
+	endpoints func() (oauthEndpoints, error)
+	profile   func(tokens oauthTokens) (oauthProfile, error)
+}
+
+func fixedScopes(scopes ...string) func() []string {
+	return func() []string { return scopes }
+}
+
+var oauthProviders = map[string]*oauthProvider{
+	"google": {
+		scopes:    fixedScopes("openid", "email", "profile"),
+		config:    func() OAuthProviderConfig { return config.OAuth.Google },
+		endpoints: staticEndpoints("https://accounts.google.com/o/oauth2/v2/auth", "https://oauth2.googleapis.com/token"),
+		profile:   googleProfile,
+	},
+	"github": {
+		scopes:    fixedScopes("read:user", "user:email"),
+		config:    func() OAuthProviderConfig { return config.OAuth.GitHub },
+		endpoints: staticEndpoints("https://github.com/login/oauth/authorize", "https://github.com/login/oauth/access_token"),
+		profile:   githubProfile,
+	},
+	ProviderSSO: {
+		Nonce:     true,
+		scopes:    func() []string { return config.OAuth.SSO.Scopes },
+		config:    ssoClient,
+		endpoints: ssoEndpoints,
+		profile:   ssoProfile,
+	},
+}
+
+var oauthClient = &http.Client{Timeout: oauthTimeout}
+
+func enabledOAuthProviders() []string {
+	names := []string{}
+	for name, provider := range oauthProviders {
+		if provider.config().Enabled() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// oauthState remembers an authorization request between the redirect to
+// the provider and its callback. The PKCE verifier never leaves the server.
+// SAML sign-ins keep the ID of their request, which the assertion must
+// answer.
+type oauthState struct {
+	provider  string
+	verifier  string
+	nonce     string
+	requestID string
+	returnTo  string
+	expiresAt time.Time
+}
+
+type oauthStateStore struct {
+	states map[string]oauthState
+	mu     sync.Mutex
+}
+
+var oauthStates = &oauthStateStore{states: make(map[string]oauthState)}
+
+func (s *oauthStateStore) put(key string, state oauthState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, st := range s.states {
+		if now.After(st.expiresAt) {
+			delete(s.states, k)
+		}
+	}
+	s.states[key] = state
+}
+
+// take returns and forgets the state so each one is used at most once.
+func (s *oauthStateStore) take(key string) (oauthState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, exists := s.states[key]
+	delete(s.states, key)
+	if !exists || time.Now().After(state.expiresAt) {
+		return oauthState{}, false
+	}
+	return state, true
+}
+
+func oauthRedirectURI(name string) string {
+	return strings.TrimSuffix(config.OAuth.RedirectBaseURL, "/") + apiPrefix + "/auth/oauth/" + name + "/callback"
+}
+
+// validReturnTo accepts a relative path, or an absolute URL on an origin
+// explicitly listed in the CORS configuration. The wildcard origin does not
+// count: the API token travels in the redirect.
+func validReturnTo(value string) bool {
+	if value == "" {
+		return true
+	}
+	if strings.HasPrefix(value, "/") && !strings.HasPrefix(value, "//") && !strings.HasPrefix(value, "/\\") {
+		return true
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	origin := u.Scheme + "://" + u.Host
+	for _, allowed := range config.origins() {
+		if !strings.Contains(allowed, "*") && originMatches(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupOAuthProvider(c *gin.Context) (string, *oauthProvider, bool) {
+	name := c.Param("provider")
+	provider, known := oauthProviders[name]
+	if !known || !provider.config().Enabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown or unconfigured OAuth provider"})
+		return "", nil, false
+	}
+	return name, provider, true
+}
+
+// getOAuthProviders lists the OAuth providers, and whether SAML sign-in,
+// which has routes of its own, is configured.
+func getOAuthProviders(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"providers": enabledOAuthProviders(), "saml": config.OAuth.SAML.Enabled()})
+}
+
+// startOAuth redirects the browser to the provider's consent screen. The
+// state is bound to the browser with a cookie so a callback cannot be
+// replayed into someone else's session.
+func startOAuth(c *gin.Context) {
+	name, provider, ok := lookupOAuthProvider(c)
+	if !ok {
+		return
+	}
+	returnTo := c.Query("returnTo")
+	if !validReturnTo(returnTo) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "returnTo must be a relative path or an allowed origin"})
+		return
+	}
+
+	endpoints, err := provider.endpoints()
+	if err != nil {
+		requestLog(c).Warn("oauth provider discovery failed", "provider", name, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not reach the " + name + " identity provider"})
+		return
+	}
+
+	state := oauthState{
+		provider:  name,
+		verifier:  randomToken(32),
+		returnTo:  returnTo,
+		expiresAt: time.Now().Add(oauthStateTTL),
+	}
+	challenge := sha256.Sum256([]byte(state.verifier))
+	key := randomToken(24)
+
+	query := url.Values{
+		"client_id":             {provider.config().ClientID},
+		"redirect_uri":          {oauthRedirectURI(name)},
+		"response_type":         {"code"},
+		"scope":                 {strings.Join(provider.scopes(), " ")},
+		"state":                 {key},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if provider.Nonce {
+		state.nonce = randomToken(16)
+		query.Set("nonce", state.nonce)
+	}
+	oauthStates.put(key, state)
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oauthStateCookie, key, int(oauthStateTTL.Seconds()), apiPrefix+"/auth/oauth", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, endpoints.AuthURL+"?"+query.Encode())
+}
+
+func oauthCallback(c *gin.Context) {
+	name, provider, ok := lookupOAuthProvider(c)
+	if !ok {
+		return
+	}
+	if reason := c.Query("error"); reason != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign-in was not completed: " + reason})
+		return
+	}
+
+	code, key := c.Query("code"), c.Query("state")
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+	cookie, _ := c.Cookie(oauthStateCookie)
+	state, exists := oauthStates.take(key)
+	if key == "" || !exists || state.provider != name || subtle.ConstantTimeCompare([]byte(cookie), []byte(key)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in attempt; start again"})
+		return
+	}
+	c.SetCookie(oauthStateCookie, "", -1, apiPrefix+"/auth/oauth", "", c.Request.TLS != nil, true)
+
+	tokens, err := exchangeOAuthCode(name, provider, code, state.verifier)
+	if err != nil {
+		requestLog(c).Warn("oauth code exchange failed", "provider", name, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not complete sign-in with " + name})
+		return
+	}
+	profile, err := provider.profile(tokens)
+	if err != nil {
+		requestLog(c).Warn("oauth profile lookup failed", "provider", name, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not read your " + name + " profile"})
+		return
+	}
+	if provider.Nonce && subtle.ConstantTimeCompare([]byte(profile.Nonce), []byte(state.nonce)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in attempt; start again"})
+		return
+	}
+	if profile.Email == "" || !profile.Verified {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your " + name + " account has no verified email address"})
+		return
+	}
+
+	method := AuthOAuth
+	if name == ProviderSSO {
+		method = AuthSSO
+	}
+	completeSignIn(c, name, method, profile, state.returnTo)
+}
+
+// completeSignIn signs in the person a provider vouched for, issuing an
+// API token. Single sign-on also applies the workspaces' group mappings.
+// The token is returned, or sent to returnTo in the fragment.
+func completeSignIn(c *gin.Context, name, method string, profile oauthProfile, returnTo string) {
+	users.mu.Lock()
+	user, linked := users.signIn(name, profile)
+	token := users.issueToken(user, method)
+	users.mu.Unlock()
+
+	details := gin.H{"provider": name, "linked": linked}
+	if method == AuthSSO {
+		details["workspaces"] = workspaces.syncGroups(user, profile.Groups)
+	}
+	audit.Record("user:"+user.ID, "user.login", "user", user.ID, c.Writer.Header().Get(requestIDHeader), details)
+
+	if returnTo != "" {
+		fragment := url.Values{"token": {token}}.Encode()
+		c.Redirect(http.StatusFound, returnTo+"#"+fragment)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": user, "token": token})
+}
+
+func exchangeOAuthCode(name string, provider *oauthProvider, code, verifier string) (oauthTokens, error) {
+	endpoints, err := provider.endpoints()
+	if err != nil {
+		return oauthTokens{}, err
+	}
+	cfg := provider.config()
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oauthRedirectURI(name)},
+		"client_id":     {cfg.ClientID},
+		"client_secret": {cfg.ClientSecret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoints.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauthTokens{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := oauthJSON(req, &resp); err != nil {
+		return oauthTokens{}, err
+	}
+	if resp.Error != "" {
+		return oauthTokens{}, fmt.Errorf("%s: %s", resp.Error, resp.Description)
+	}
+	if resp.AccessToken == "" {
+		return oauthTokens{}, errors.New("token response carried no access token")
+	}
+	return oauthTokens{AccessToken: resp.AccessToken, IDToken: resp.IDToken}, nil
+}
+
+func oauthJSON(req *http.Request, out interface{}) error {
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 && !strings.Contains(string(body), `"error"`) {
+		return fmt.Errorf("%s responded with status %d", req.URL.Host, resp.StatusCode)
+	}
+	return json.Unmarshal(body, out)
+}
+
+func bearerGet(rawURL, accessToken string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	return oauthJSON(req, out)
+}
+
+func googleProfile(tokens oauthTokens) (oauthProfile, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := bearerGet("https://openidconnect.googleapis.com/v1/userinfo", tokens.AccessToken, &info); err != nil {
+		return oauthProfile{}, err
+	}
+	if info.Sub == "" {
+		return oauthProfile{}, errors.New("userinfo carried no subject")
+	}
+	return oauthProfile{Subject: info.Sub, Email: info.Email, Name: info.Name, Verified: info.EmailVerified}, nil
+}
+
+// githubProfile reads the account and its primary verified email, which
+// /user only reports when the address is public.
+func githubProfile(tokens oauthTokens) (oauthProfile, error) {
+	var account struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := bearerGet("https://api.github.com/user", tokens.AccessToken, &account); err != nil {
+		return oauthProfile{}, err
+	}
+	if account.ID == 0 {
+		return oauthProfile{}, errors.New("user response carried no id")
+	}
+	profile := oauthProfile{Subject: strconv.FormatInt(account.ID, 10), Name: account.Name}
+	if profile.Name == "" {
+		profile.Name = account.Login
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := bearerGet("https://api.github.com/user/emails", tokens.AccessToken, &emails); err != nil {
+		return oauthProfile{}, err
+	}
+	for _, e := range emails {
+		if e.Primary {
+			profile.Email, profile.Verified = e.Email, e.Verified
+		}
+	}
+	return profile, nil
+}
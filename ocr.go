@@ -0,0 +1,270 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	OCRTesseract = "tesseract"
+	OCRHTTP      = "http"
+
+	ocrQueueSize   = 256
+	ocrMaxAttempts = 3
+	ocrTimeout     = time.Minute
+	maxOCRText     = 64 << 10
+)
+
+var errOCRQueueFull = errors.New("ocr queue full")
+
+// ocrProvider reads the text in an image.
+type ocrProvider interface {
+	Recognize(ctx context.Context, image []byte, contentType string) (string, error)
+}
+
+// tesseractOCR runs the tesseract command, passing the image on stdin.
+type tesseractOCR struct {
+	command   string
+	languages string
+}
+
+func (t tesseractOCR) Recognize(ctx context.Context, image []byte, _ string) (string, error) {
+	cmd := exec.CommandContext(ctx, t.command, "stdin", "stdout", "-l", t.languages)
+	cmd.Stdin = bytes.NewReader(image)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("tesseract: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return string(out), nil
+}
+
+// httpOCR posts the image to a service that answers {"text": "..."}.
+type httpOCR struct {
+	url    string
+	client *http.Client
+}
+
+func (h httpOCR) Recognize(ctx context.Context, image []byte, contentType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(image))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("ocr service returned %d: %s", resp.StatusCode, bytes.TrimSpace(detail))
+	}
+	var result struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4*maxOCRText)).Decode(&result); err != nil {
+		return "", fmt.Errorf("decoding ocr response: %v", err)
+	}
+	return result.Text, nil
+}
+
+// ocrJob names a screenshot to read, or a guide step whose image to read.
+type ocrJob struct {
+	sessionID    string
+	screenshotID string
+	guideID      string
+	stepID       string
+}
+
+// ocr reads uploaded screenshots and guide images from a queue, so uploads
+// never wait on recognition.
+var ocr struct {
+	provider ocrProvider
+	queue    chan ocrJob
+	stop     chan struct{}
+	done     chan struct{}
+
+	recognized int64
+	failed     int64
+	dropped    int64
+}
+
+func startOCR(cfg OCRConfig) error {
+	switch cfg.Driver {
+	case "":
+		return nil
+	case OCRTesseract:
+		ocr.provider = tesseractOCR{command: cfg.Command, languages: cfg.Languages}
+	case OCRHTTP:
+		ocr.provider = httpOCR{url: cfg.URL, client: &http.Client{Timeout: ocrTimeout}}
+	default:
+		return fmt.Errorf("unknown ocr driver %q", cfg.Driver)
+	}
+	ocr.queue = make(chan ocrJob, ocrQueueSize)
+	ocr.stop = make(chan struct{})
+	ocr.done = make(chan struct{})
+	go runOCR()
+	return nil
+}
+
+func ocrEnabled() bool {
+	return ocr.queue != nil
+}
+
+func queueOCR(sessionID, screenshotID string) error {
+	select {
+	case ocr.queue <- ocrJob{sessionID: sessionID, screenshotID: screenshotID}:
+		return nil
+	default:
+		atomic.AddInt64(&ocr.dropped, 1)
+		logger.Warn("ocr queue full, skipping screenshot", "session", sessionID, "screenshot", screenshotID)
+		return errOCRQueueFull
+	}
+}
+
+// queueStepOCR reads the image of a guide step that did not come with its
+// text.
+func queueStepOCR(guideID, stepID string) error {
+	select {
+	case ocr.queue <- ocrJob{guideID: guideID, stepID: stepID}:
+		return nil
+	default:
+		atomic.AddInt64(&ocr.dropped, 1)
+		logger.Warn("ocr queue full, skipping guide step", "guide", guideID, "step", stepID)
+		return errOCRQueueFull
+	}
+}
+
+func runOCR() {
+	defer close(ocr.done)
+	for {
+		select {
+		case job := <-ocr.queue:
+			if job.guideID != "" {
+				recognizeStep(job)
+			} else {
+				recognizeScreenshot(job)
+			}
+		case <-ocr.stop:
+			return
+		}
+	}
+}
+
+// recognizeScreenshot reads a screenshot's text, retrying with backoff,
+// and records the outcome on the screenshot.
+func recognizeScreenshot(job ocrJob) {
+	shot, exists := screenshots.find(job.sessionID, job.screenshotID)
+	if !exists {
+		return
+	}
+	image, err := blobs.Get(context.Background(), shot.blobKey())
+	if errors.Is(err, ErrBlobNotFound) {
+		return
+	}
+
+	var text string
+	if err == nil {
+		text, err = recognize(image, shot.ContentType)
+	}
+	if err != nil {
+		atomic.AddInt64(&ocr.failed, 1)
+		logger.Error("ocr failed", "session", job.sessionID, "screenshot", job.screenshotID, "error", err)
+	} else {
+		atomic.AddInt64(&ocr.recognized, 1)
+	}
+	finishOCR(job, normalizeOCRText(text), err)
+}
+
+// recognizeStep reads a guide step's image. A step whose image cannot be
+// read just stays without text.
+func recognizeStep(job ocrJob) {
+	guide, exists := guides.get(job.guideID)
+	if !exists {
+		return
+	}
+	var step *GuideStep
+	for i := range guide.Steps {
+		if guide.Steps[i].ID == job.stepID && guide.Steps[i].Image != nil {
+			step = &guide.Steps[i]
+		}
+	}
+	if step == nil {
+		return
+	}
+	image, err := blobs.Get(context.Background(), stepBlobKey(guide.ID, step.ID))
+	if errors.Is(err, ErrBlobNotFound) {
+		return
+	}
+	var text string
+	if err == nil {
+		text, err = recognize(image, step.Image.ContentType)
+	}
+	if err != nil {
+		atomic.AddInt64(&ocr.failed, 1)
+		logger.Error("ocr failed", "guide", job.guideID, "step", job.stepID, "error", err)
+		return
+	}
+	atomic.AddInt64(&ocr.recognized, 1)
+	if text = normalizeOCRText(text); text != "" {
+		guides.setStepText(job.guideID, job.stepID, text)
+	}
+}
+
+func recognize(image []byte, contentType string) (string, error) {
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), ocrTimeout)
+		text, err := ocr.provider.Recognize(ctx, image, contentType)
+		cancel()
+		if err == nil || attempt == ocrMaxAttempts {
+			return text, err
+		}
+		time.Sleep(backoff(attempt))
+	}
+}
+
+// normalizeOCRText collapses the layout whitespace OCR produces and caps
+// the text's length.
+func normalizeOCRText(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > maxOCRText {
+		text = strings.ToValidUTF8(text[:maxOCRText], "")
+	}
+	return text
+}
+
+// stopOCR abandons the screenshots still queued, which stay pending, once
+// the one being read is done or ctx is.
+func stopOCR(ctx context.Context) {
+	if ocr.queue == nil {
+		return
+	}
+	close(ocr.stop)
+	select {
+	case <-ocr.done:
+	case <-ctx.Done():
+	}
+}
+
+func getOCRStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"driver":     config.OCR.Driver,
+		"queued":     len(ocr.queue),
+		"recognized": atomic.LoadInt64(&ocr.recognized),
+		"failed":     atomic.LoadInt64(&ocr.failed),
+		"dropped":    atomic.LoadInt64(&ocr.dropped),
+	})
+}
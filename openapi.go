@@ -0,0 +1,506 @@
+package tango
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiOperation documents one REST route for the OpenAPI spec. Request and
+// Response hold a value of the body's Go type, from which the schema is
+// derived, or fields for an object put together in the handler.
+type apiOperation struct {
+	Summary  string
+	Query    []string
+	Request  interface{}
+	Response interface{}
+	Status   int
+}
+
+// fields describes a JSON object built with gin.H, property by property.
+type fields map[string]interface{}
+
+// listOf describes a JSON array of its one element.
+type listOf []interface{}
+
+var (
+	sessionPage = fields{"sessions": []Session{}, "nextCursor": ""}
+	userToken   = fields{"user": User{}, "token": ""}
+	anyObject   = fields{}
+)
+
+// apiOperations documents the routes registered in main, keyed by method
+// and gin path. Routes missing here still appear in the spec, undescribed.
+var apiOperations = map[string]apiOperation{
+	"GET /api/v1/server-info": {Summary: "Describe the server's build, features, protocol and limits", Response: anyObject},
+	"GET /api/v1/limits":      {Summary: "Show the caller's rate limit usage", Response: fields{"limits": []QuotaUsage{}}},
+
+	"GET /api/v1/search": {Summary: "Search the text of the sessions and guides the caller can see", Query: []string{"q", "type", "workspaceId", "tag", "collectionId", "offset", "limit"},
+		Response: fields{"results": []SearchResult{}, "total": 0}},
+	"GET /api/v1/sessions": {Summary: "List sessions", Query: []string{"q", "name", "owner", "workspaceId", "tag", "collectionId", "trashed", "externalId", "limit", "sort", "order", "createdAfter", "cursor"},
+		Response: sessionPage},
+	"POST /api/v1/sessions": {Summary: "Create a session, or return the existing one for a unique externalRef", Request: CreateSessionRequest{},
+		Response: Session{}, Status: http.StatusCreated},
+	"POST /api/v1/sessions/bulk": {Summary: "Add and remove tags on several sessions, or move them to a collection", Request: BulkUpdateSessionsRequest{},
+		Response: fields{"updated": []string{}, "failed": []BulkUpdateFailure{}}},
+	"GET /api/v1/sessions/:id":          {Summary: "Get a session", Response: Session{}},
+	"PATCH /api/v1/sessions/:id":        {Summary: "Update a session's details", Request: UpdateSessionRequest{}, Response: Session{}},
+	"DELETE /api/v1/sessions/:id":       {Summary: "Move a session to the trash, or delete it for good", Query: []string{"permanent"}, Status: http.StatusNoContent},
+	"GET /api/v1/sessions/:id/comments": {Summary: "List a session's comment threads", Query: []string{"anchor", "resolved"}, Response: fields{"comments": []CommentThread{}}},
+	"POST /api/v1/sessions/:id/comments": {Summary: "Comment on a session or reply to a thread, notifying @mentioned users", Request: CreateCommentRequest{},
+		Response: Comment{}, Status: http.StatusCreated},
+	"PATCH /api/v1/sessions/:id/comments/:commentId":                      {Summary: "Edit one of the caller's comments", Request: UpdateCommentRequest{}, Response: Comment{}},
+	"DELETE /api/v1/sessions/:id/comments/:commentId":                     {Summary: "Delete a comment and, for a thread, its replies", Status: http.StatusNoContent},
+	"POST /api/v1/sessions/:id/comments/:commentId/resolve":               {Summary: "Resolve a comment thread", Response: Comment{}},
+	"POST /api/v1/sessions/:id/comments/:commentId/unresolve":             {Summary: "Reopen a resolved comment thread", Response: Comment{}},
+	"PUT /api/v1/sessions/:id/star":                                       {Summary: "Star a session for the caller", Response: FavoriteItem{}},
+	"GET /api/v1/sessions/:id/versions":                                   {Summary: "List the versions of a session's details, newest first", Response: fields{"versions": []SessionVersion{}}},
+	"GET /api/v1/sessions/:id/versions/diff":                              {Summary: "Compare two versions of a session's details", Query: []string{"from", "to"}, Response: VersionDiff{}},
+	"GET /api/v1/sessions/:id/versions/:version":                          {Summary: "Get one version of a session's details", Response: SessionVersion{}},
+	"POST /api/v1/sessions/:id/versions/:version/rollback":                {Summary: "Put a session's details back as they were in a version", Response: Session{}},
+	"GET /api/v1/sessions/:id/waiting":                                    {Summary: "List the clients waiting to be admitted to a session", Response: fields{"enabled": false, "waiting": []WaitingEntry{}}},
+	"POST /api/v1/sessions/:id/waiting/:clientId/admit":                   {Summary: "Admit a client from the waiting room", Status: http.StatusNoContent},
+	"POST /api/v1/sessions/:id/waiting/:clientId/reject":                  {Summary: "Turn away a client in the waiting room", Status: http.StatusNoContent},
+	"POST /api/v1/sessions/:id/clone":                                     {Summary: "Copy a session into a new one owned by the caller", Request: CloneSessionRequest{}, Response: Session{}, Status: http.StatusCreated},
+	"POST /api/v1/sessions/:id/share":                                     {Summary: "Email a link to a session", Request: ShareSessionRequest{}, Response: fields{"sent": []string{}, "skipped": []string{}}, Status: http.StatusAccepted},
+	"GET /api/v1/sessions/:id/polls":                                      {Summary: "List a session's polls and their results, as JSON or CSV", Query: []string{"format"}, Response: fields{"polls": []Poll{}}},
+	"GET /api/v1/sessions/:id/captions":                                   {Summary: "Get a session's caption transcript as JSON or WebVTT", Query: []string{"format"}, Response: fields{"captions": []Caption{}}},
+	"POST /api/v1/sessions/:id/captions":                                  {Summary: "Relay captions from a server-side transcription service", Request: fields{"captions": []Caption{}}, Response: fields{"relayed": 0}},
+	"GET /api/v1/sessions/:id/chat":                                       {Summary: "Get a session's chat history", Response: fields{"messages": []ChatMessage{}}},
+	"GET /api/v1/sessions/:id/screenshots":                                {Summary: "List a session's screenshots with the text read from them", Response: fields{"screenshots": []Screenshot{}}},
+	"POST /api/v1/sessions/:id/screenshots":                               {Summary: "Upload a PNG or JPEG screenshot as the request body", Response: Screenshot{}, Status: http.StatusCreated},
+	"POST /api/v1/sessions/:id/screenshots/uploads":                       {Summary: "Start a direct upload of a screenshot to blob storage with a signed URL", Request: DirectUploadRequest{}, Response: DirectUpload{}, Status: http.StatusCreated},
+	"POST /api/v1/sessions/:id/screenshots/uploads/:uploadId":             {Summary: "Claim a finished direct upload as a screenshot", Response: Screenshot{}, Status: http.StatusCreated},
+	"POST /api/v1/sessions/:id/screenshots/polish":                        {Summary: "Title and describe the session's untitled screenshots with suggestions, in the background", Response: fields{"screenshots": 0}, Status: http.StatusAccepted},
+	"PATCH /api/v1/sessions/:id/screenshots/:screenshotId":                {Summary: "Set a screenshot's title or description", Request: UpdateScreenshotRequest{}, Response: Screenshot{}},
+	"POST /api/v1/sessions/:id/screenshots/:screenshotId/suggest":         {Summary: "Suggest a title and description for a screenshot from its text, page URL and selector", Response: Suggestion{}},
+	"GET /api/v1/sessions/:id/screenshots/:screenshotId":                  {Summary: "Download a screenshot's image"},
+	"DELETE /api/v1/sessions/:id/screenshots/:screenshotId":               {Summary: "Delete a screenshot", Status: http.StatusNoContent},
+	"GET /api/v1/sessions/:id/screenshots/:screenshotId/links":            {Summary: "List a screenshot's live public links", Response: []ScreenshotLink{}},
+	"POST /api/v1/sessions/:id/screenshots/:screenshotId/links":           {Summary: "Create a public link to a screenshot, served with the workspace's watermark", Request: CreateScreenshotLinkRequest{}, Response: ScreenshotLink{}, Status: http.StatusCreated},
+	"DELETE /api/v1/sessions/:id/screenshots/:screenshotId/links/:linkId": {Summary: "Revoke a public link to a screenshot", Status: http.StatusNoContent},
+	"GET /api/v1/shared/screenshots/:token":                               {Summary: "Get a screenshot through a public link, watermarked"},
+	"GET /api/v1/sessions/:id/recordings":                                 {Summary: "List a session's recordings", Query: []string{"externalId"}, Response: fields{"recordings": []Recording{}}},
+	"POST /api/v1/sessions/:id/recordings/uploads":                        {Summary: "Start a resumable upload of a recording, with its size and SHA-256 digest", Request: RecordingUploadRequest{}, Response: RecordingUpload{}, Status: http.StatusCreated},
+	"GET /api/v1/sessions/:id/recordings/uploads/:uploadId":               {Summary: "Report how many bytes of an upload have arrived, to resume it", Response: RecordingUpload{}},
+	"PATCH /api/v1/sessions/:id/recordings/uploads/:uploadId":             {Summary: "Append the body to an upload at the Upload-Offset header, checked against Upload-Checksum if given", Response: RecordingUpload{}},
+	"POST /api/v1/sessions/:id/recordings/uploads/:uploadId":              {Summary: "Finish a complete upload, verifying its digest, and return the recording", Response: Recording{}, Status: http.StatusCreated},
+	"DELETE /api/v1/sessions/:id/recordings/uploads/:uploadId":            {Summary: "Cancel an upload", Status: http.StatusNoContent},
+	"GET /api/v1/sessions/:id/recordings/:recordingId":                    {Summary: "Download a recording"},
+	"DELETE /api/v1/sessions/:id/recordings/:recordingId":                 {Summary: "Delete a recording", Status: http.StatusNoContent},
+	"POST /api/v1/sessions/:id/recordings/:recordingId/guides":            {Summary: "Start drafting a guide from a recording's events, or its keyframes", Response: Recording{}, Status: http.StatusAccepted},
+	"GET /api/v1/sessions/:id/questions":                                  {Summary: "List a session's Q&A questions, most upvoted first, as JSON or CSV", Query: []string{"status", "format"}, Response: fields{"questions": []Question{}}},
+	"GET /api/v1/sessions/:id/calendar.ics":                               {Summary: "Download a scheduled session as an iCalendar event"},
+	"DELETE /api/v1/sessions/:id/star":                                    {Summary: "Unstar a session", Status: http.StatusNoContent},
+	"GET /api/v1/sessions/:id/clients":                                    {Summary: "List a session's connected clients", Response: fields{"clients": []Presence{}, "seq": int64(0)}},
+	"GET /api/v1/sessions/:id/stats":                                      {Summary: "Report a session's activity figures", Response: anyObject},
+	"POST /api/v1/sessions/:id/end":                                       {Summary: "End a session", Response: Session{}},
+	"POST /api/v1/sessions/:id/archive":                                   {Summary: "Archive an ended session", Response: Session{}},
+	"POST /api/v1/sessions/:id/restore":                                   {Summary: "Restore a session from the trash", Response: Session{}},
+	"GET /api/v1/sessions/:id/events": {Summary: "Join a session over server-sent events, for networks that block WebSockets",
+		Query: []string{"name", "role", "features", "resumeClientId", "resumeToken", "token"}},
+	"POST /api/v1/sessions/:id/events": {Summary: "Send a message as a client joined over server-sent events", Query: []string{"clientId"},
+		Request: anyObject, Status: http.StatusAccepted},
+	"GET /api/v1/stats/daily": {Summary: "Aggregate session figures per UTC day", Query: []string{"from", "to"},
+		Response: fields{"from": "", "to": "", "retentionDays": 0, "days": []DailyStats{}}},
+
+	"GET /api/v1/usage": {Summary: "Report usage against quotas for the caller and their workspaces", Query: []string{"workspaceId"},
+		Response: fields{"period": "", "user": UsageReport{}, "workspaces": []UsageReport{}}},
+	"POST /api/v1/billing/portal":         {Summary: "Open a Stripe billing portal session for a workspace", Request: BillingPortalRequest{}, Response: fields{"url": ""}},
+	"POST /api/v1/billing/stripe/webhook": {Summary: "Receive Stripe subscription events", Response: fields{"received": true}},
+
+	"GET /api/v1/graphql": {Summary: "Run a GraphQL query, or upgrade to a graphql-transport-ws WebSocket for subscriptions",
+		Query: []string{"query", "operationName", "variables"}, Response: fields{"data": anyObject, "errors": listOf{anyObject}}},
+	"POST /api/v1/graphql": {Summary: "Run a GraphQL query", Request: graphqlRequest{}, Response: fields{"data": anyObject, "errors": listOf{anyObject}}},
+
+	"GET /api/v1/me":                                  {Summary: "Show the signed-in user and their workspaces", Response: fields{"user": User{}, "workspaces": listOf{anyObject}}},
+	"GET /api/v1/users/me/starred":                    {Summary: "List the caller's starred items, most recently starred first", Response: fields{"items": listOf{anyObject}}},
+	"GET /api/v1/users/me/recent":                     {Summary: "List the items the caller viewed most recently", Query: []string{"limit"}, Response: fields{"items": listOf{anyObject}}},
+	"GET /api/v1/users/me/notifications":              {Summary: "List the caller's notifications, newest first", Query: []string{"limit", "unread"}, Response: fields{"notifications": []Notification{}, "unread": 0}},
+	"GET /api/v1/users/me/notifications/unread":       {Summary: "Count the caller's unread notifications", Response: fields{"unread": 0}},
+	"GET /api/v1/users/me/email-preferences":          {Summary: "Get which optional emails the caller receives", Response: EmailPreferences{}},
+	"PATCH /api/v1/users/me/email-preferences":        {Summary: "Change which optional emails the caller receives", Request: UpdateEmailPreferencesRequest{}, Response: EmailPreferences{}},
+	"GET /api/v1/users/me/calendar":                   {Summary: "Show whether the caller has a calendar feed", Response: fields{"enabled": false, "createdAt": int64(0)}},
+	"POST /api/v1/users/me/calendar":                  {Summary: "Make a new calendar feed URL for the caller, retiring the old one", Response: fields{"url": "", "createdAt": int64(0)}, Status: http.StatusCreated},
+	"DELETE /api/v1/users/me/calendar":                {Summary: "Turn off the caller's calendar feed", Status: http.StatusNoContent},
+	"GET /api/v1/calendars/:token":                    {Summary: "Get a user's scheduled sessions as an iCalendar feed"},
+	"POST /api/v1/users/me/notifications/read":        {Summary: "Mark the given notifications read, or all of them", Request: MarkReadRequest{}, Response: fields{"unread": 0}},
+	"POST /api/v1/users/me/export":                    {Summary: "Start building an archive of the caller's data", Response: DataExport{}, Status: http.StatusAccepted},
+	"GET /api/v1/users/me/exports/:exportId":          {Summary: "Check on a data export", Response: DataExport{}},
+	"GET /api/v1/users/me/exports/:exportId/download": {Summary: "Download a finished data export as a zip"},
+	"POST /api/v1/users/me/deletion": {Summary: "Schedule the caller's account for deletion", Response: fields{"deletionScheduledAt": int64(0)},
+		Status: http.StatusAccepted},
+	"DELETE /api/v1/users/me/deletion": {Summary: "Call off a scheduled account deletion", Status: http.StatusNoContent},
+
+	"POST /api/v1/auth/email":                                 {Summary: "Email a one-time sign-in link to a registered address", Request: EmailSignInRequest{}, Response: fields{"message": ""}, Status: http.StatusAccepted},
+	"POST /api/v1/auth/email/redeem":                          {Summary: "Trade a sign-in link code for a new API token", Request: RedeemSignInRequest{}, Response: fields{"user": User{}, "token": ""}},
+	"GET /api/v1/auth/providers":                              {Summary: "List the configured sign-in providers", Response: fields{"providers": []string{}}},
+	"GET /api/v1/auth/oauth/:provider":                        {Summary: "Start signing in with a provider", Query: []string{"returnTo"}, Status: http.StatusFound},
+	"GET /api/v1/auth/oauth/:provider/callback":               {Summary: "Finish signing in with a provider", Query: []string{"code", "state", "error"}, Response: userToken},
+	"GET /api/v1/auth/saml/metadata":                          {Summary: "Get the SAML service provider metadata"},
+	"GET /api/v1/auth/saml/login":                             {Summary: "Start signing in through the SAML IdP", Query: []string{"returnTo"}, Status: http.StatusFound},
+	"POST /api/v1/auth/saml/acs":                              {Summary: "Finish signing in through the SAML IdP", Response: userToken},
+	"GET /api/v1/tags":                                        {Summary: "List the tags on the sessions the caller can see, with how many carry each", Query: []string{"workspaceId"}, Response: fields{"tags": listOf{anyObject}}},
+	"GET /api/v1/templates":                                   {Summary: "List the caller's personal templates and those of their workspaces", Query: []string{"workspaceId"}, Response: fields{"templates": []SessionTemplate{}}},
+	"POST /api/v1/templates":                                  {Summary: "Save a session configuration as a template", Request: TemplateRequest{}, Response: SessionTemplate{}, Status: http.StatusCreated},
+	"GET /api/v1/templates/:id":                               {Summary: "Get a template", Response: SessionTemplate{}},
+	"PUT /api/v1/templates/:id":                               {Summary: "Replace a template's configuration", Request: TemplateRequest{}, Response: SessionTemplate{}},
+	"DELETE /api/v1/templates/:id":                            {Summary: "Delete a template", Status: http.StatusNoContent},
+	"POST /api/v1/sessions/:id/guides":                        {Summary: "Assemble a draft guide from a session's screenshots and captions", Response: Guide{}, Status: http.StatusCreated},
+	"GET /api/v1/guides":                                      {Summary: "List the caller's guides and those of their workspaces, newest first", Query: []string{"workspaceId", "tag", "collectionId", "externalId", "trashed"}, Response: fields{"guides": []Guide{}}},
+	"GET /api/v1/guides/:id":                                  {Summary: "Get a guide with its steps", Response: Guide{}},
+	"PATCH /api/v1/guides/:id":                                {Summary: "Retitle, tag, file, label, publish or reorder a guide", Request: UpdateGuideRequest{}, Response: Guide{}},
+	"DELETE /api/v1/guides/:id":                               {Summary: "Move a guide to the trash, or delete it and its images for good", Query: []string{"permanent"}, Status: http.StatusNoContent},
+	"POST /api/v1/guides/:id/restore":                         {Summary: "Restore a guide from the trash", Response: Guide{}},
+	"PUT /api/v1/guides/:id/star":                             {Summary: "Star a guide for the caller", Response: FavoriteItem{}},
+	"DELETE /api/v1/guides/:id/star":                          {Summary: "Unstar a guide", Status: http.StatusNoContent},
+	"POST /api/v1/guides/:id/clone":                           {Summary: "Copy a guide, with its steps and images, into a new draft", Query: []string{"workspaceId"}, Response: Guide{}, Status: http.StatusCreated},
+	"GET /api/v1/guides/:id/edit":                             {Summary: "Upgrade to a WebSocket for editing a guide's steps together", Query: []string{"token"}, Status: http.StatusSwitchingProtocols},
+	"GET /api/v1/guides/:id/versions":                         {Summary: "List the versions of a guide, newest first", Response: fields{"versions": []GuideVersion{}}},
+	"GET /api/v1/guides/:id/versions/diff":                    {Summary: "Compare the details and steps of two versions of a guide", Query: []string{"from", "to"}, Response: GuideVersionDiff{}},
+	"GET /api/v1/guides/:id/versions/:version":                {Summary: "Get one version of a guide", Response: GuideVersion{}},
+	"POST /api/v1/guides/:id/versions/:version/rollback":      {Summary: "Put a guide back as it was in a version", Response: Guide{}},
+	"GET /api/v1/guides/:id/comments":                         {Summary: "List a guide's comment threads", Query: []string{"stepId", "resolved"}, Response: fields{"comments": []CommentThread{}}},
+	"POST /api/v1/guides/:id/comments":                        {Summary: "Comment on a guide or one of its steps, or reply to a thread, notifying @mentioned users", Request: CreateCommentRequest{}, Response: Comment{}, Status: http.StatusCreated},
+	"PATCH /api/v1/guides/:id/comments/:commentId":            {Summary: "Edit one of the caller's comments on a guide", Request: UpdateCommentRequest{}, Response: Comment{}},
+	"DELETE /api/v1/guides/:id/comments/:commentId":           {Summary: "Delete a comment on a guide and, for a thread, its replies", Status: http.StatusNoContent},
+	"POST /api/v1/guides/:id/comments/:commentId/resolve":     {Summary: "Resolve a comment thread on a guide", Response: Comment{}},
+	"POST /api/v1/guides/:id/comments/:commentId/unresolve":   {Summary: "Reopen a resolved comment thread on a guide", Response: Comment{}},
+	"PATCH /api/v1/guides/:id/steps/:stepId":                  {Summary: "Edit a guide step's title or description", Request: UpdateStepRequest{}, Response: Guide{}},
+	"DELETE /api/v1/guides/:id/steps/:stepId":                 {Summary: "Remove a step from a guide", Status: http.StatusNoContent},
+	"POST /api/v1/guides/:id/steps/:stepId/suggest":           {Summary: "Suggest a title and description for a guide step from its text, page URL and selector", Response: Suggestion{}},
+	"POST /api/v1/guides/:id/polish":                          {Summary: "Rewrite the guide's step titles and descriptions with suggestions, in the background", Response: fields{"steps": 0}, Status: http.StatusAccepted},
+	"GET /api/v1/guides/:id/steps/:stepId/image":              {Summary: "Download a guide step's image"},
+	"POST /api/v1/guides/:id/exports":                         {Summary: "Start rendering a guide as an animated GIF or MP4 video", Request: GuideExportRequest{}, Response: GuideExport{}, Status: http.StatusAccepted},
+	"GET /api/v1/guides/:id/exports/:exportId":                {Summary: "Get a guide export's status and progress", Response: GuideExport{}},
+	"GET /api/v1/guides/:id/exports/:exportId/download":       {Summary: "Download a finished guide export"},
+	"POST /api/v1/guides/import":                              {Summary: "Import a guide from the JSON interchange format or Markdown, with its images", Query: []string{"workspaceId"}, Request: GuideDocument{}, Response: Guide{}, Status: http.StatusCreated},
+	"GET /api/v1/guides/:id/document":                         {Summary: "Export a guide in the JSON interchange format, images inline", Response: GuideDocument{}},
+	"GET /api/v1/guides/:id/pushes":                           {Summary: "List what pushing a guide to Confluence or Notion created, newest first", Response: fields{"pushes": listOf{GuidePush{}}}},
+	"POST /api/v1/guides/:id/pushes":                          {Summary: "Push a guide into its workspace's Confluence or Notion", Request: PushGuideRequest{}, Response: GuidePush{}, Status: http.StatusCreated},
+	"POST /api/v1/templates/:id/instantiate":                  {Summary: "Create a session from a template", Request: InstantiateTemplateRequest{}, Response: Session{}, Status: http.StatusCreated},
+	"GET /api/v1/collections":                                 {Summary: "List the collections the caller can see, with their session and guide counts", Query: []string{"workspaceId"}, Response: fields{"collections": listOf{anyObject}}},
+	"POST /api/v1/collections":                                {Summary: "Create a collection of sessions", Request: CreateCollectionRequest{}, Response: Collection{}, Status: http.StatusCreated},
+	"GET /api/v1/collections/:id":                             {Summary: "Get a collection", Response: Collection{}},
+	"PATCH /api/v1/collections/:id":                           {Summary: "Rename a collection", Request: UpdateCollectionRequest{}, Response: Collection{}},
+	"DELETE /api/v1/collections/:id":                          {Summary: "Delete a collection, keeping its sessions", Status: http.StatusNoContent},
+	"GET /api/v1/workspaces":                                  {Summary: "List the caller's workspaces", Response: fields{"workspaces": listOf{anyObject}}},
+	"POST /api/v1/workspaces":                                 {Summary: "Create a workspace owned by the caller", Request: CreateWorkspaceRequest{}, Response: Workspace{}, Status: http.StatusCreated},
+	"GET /api/v1/workspaces/:id":                              {Summary: "Get a workspace and its members", Response: fields{"workspace": Workspace{}, "members": []Membership{}}},
+	"GET /api/v1/workspaces/:id/invitations":                  {Summary: "List a workspace's pending invitations", Response: fields{"invitations": []Invitation{}}},
+	"POST /api/v1/workspaces/:id/invitations":                 {Summary: "Invite someone to a workspace", Request: CreateInvitationRequest{}, Response: fields{"invitation": Invitation{}, "token": "", "emailed": false}, Status: http.StatusCreated},
+	"DELETE /api/v1/workspaces/:id/invitations/:invitationId": {Summary: "Revoke an invitation", Status: http.StatusNoContent},
+	"PATCH /api/v1/workspaces/:id/members/:userId":            {Summary: "Change a member's role", Request: UpdateMemberRequest{}, Response: Membership{}},
+	"DELETE /api/v1/workspaces/:id/members/:userId":           {Summary: "Remove a member from a workspace", Status: http.StatusNoContent},
+	"PUT /api/v1/workspaces/:id/sso":                          {Summary: "Configure a workspace's single sign-on", Request: WorkspaceSSO{}, Response: fields{"sso": WorkspaceSSO{}}},
+	"GET /api/v1/workspaces/:id/retention":                    {Summary: "Show a workspace's retention policy and what it would delete now", Response: fields{"retention": RetentionPolicy{}, "report": RetentionReport{}}},
+	"PUT /api/v1/workspaces/:id/retention": {Summary: "Set a workspace's retention policy, or try one out", Query: []string{"dryRun"}, Request: RetentionPolicy{},
+		Response: fields{"retention": RetentionPolicy{}, "report": RetentionReport{}}},
+	"GET /api/v1/workspaces/:id/watermark":               {Summary: "Get the watermark drawn over a workspace's shared and exported images", Response: fields{"watermark": Watermark{}}},
+	"PUT /api/v1/workspaces/:id/watermark":               {Summary: "Set a workspace's watermark: text, a base64 logo, position and opacity", Request: Watermark{}, Response: fields{"watermark": Watermark{}}},
+	"DELETE /api/v1/workspaces/:id/watermark":            {Summary: "Remove a workspace's watermark", Status: http.StatusNoContent},
+	"GET /api/v1/workspaces/:id/network-policy":          {Summary: "Get the address ranges and countries a workspace can be reached from", Response: fields{"networkPolicy": NetworkPolicy{}}},
+	"PUT /api/v1/workspaces/:id/network-policy":          {Summary: "Restrict a workspace to or away from address ranges and countries", Request: NetworkPolicy{}, Response: fields{"networkPolicy": NetworkPolicy{}}},
+	"DELETE /api/v1/workspaces/:id/network-policy":       {Summary: "Remove a workspace's network policy", Status: http.StatusNoContent},
+	"GET /api/v1/workspaces/:id/integrations":            {Summary: "List a workspace's Confluence and Notion integrations, without their secrets", Response: fields{"integrations": fields{"confluence": ConfluenceCredentials{}, "notion": NotionCredentials{}}}},
+	"PUT /api/v1/workspaces/:id/integrations/confluence": {Summary: "Check and save a workspace's Confluence credentials", Request: ConfluenceCredentialsRequest{}, Response: ConfluenceCredentials{}},
+	"PUT /api/v1/workspaces/:id/integrations/notion":     {Summary: "Check and save a workspace's Notion token", Request: NotionCredentialsRequest{}, Response: NotionCredentials{}},
+	"DELETE /api/v1/workspaces/:id/integrations/:target": {Summary: "Remove a workspace's Confluence or Notion integration", Status: http.StatusNoContent},
+	"POST /api/v1/invitations/:token/accept": {Summary: "Accept an invitation, signing up if needed",
+		Response: fields{"workspace": Workspace{}, "membership": Membership{}, "user": User{}, "token": ""}},
+
+	"GET /api/v1/webhooks":                {Summary: "List webhooks", Query: []string{"workspaceId"}, Response: fields{"webhooks": []Webhook{}}},
+	"POST /api/v1/webhooks":               {Summary: "Register a webhook", Request: CreateWebhookRequest{}, Response: Webhook{}, Status: http.StatusCreated},
+	"DELETE /api/v1/webhooks/:id":         {Summary: "Delete a webhook", Status: http.StatusNoContent},
+	"GET /api/v1/webhooks/:id/deliveries": {Summary: "List a webhook's recent deliveries", Response: fields{"deliveries": []WebhookDelivery{}}},
+	"GET /api/v1/triggers":                {Summary: "List the triggers low-code platforms can start workflows from, with sample payloads", Response: fields{"triggers": []Trigger{}}},
+	"GET /api/v1/triggers/:key": {Summary: "Poll a trigger for its items, newest first", Query: []string{"after", "limit", "workspaceId"},
+		Response: fields{"items": []TriggerItem{}, "cursor": "", "more": false}},
+	"POST /api/v1/triggers/:key/subscriptions": {Summary: "Subscribe a webhook to a trigger", Request: SubscribeTriggerRequest{},
+		Response: fields{"id": "", "trigger": "", "targetUrl": "", "workspaceId": "", "secret": ""}, Status: http.StatusCreated},
+	"GET /api/v1/webrtc/config":             {Summary: "Get ICE servers with short-lived TURN credentials", Query: []string{"clientId"}, Response: fields{"iceServers": []ICEServer{}, "ttl": 0}},
+	"GET /api/v1/integrations/slack":        {Summary: "List Slack integrations", Response: fields{"integrations": []SlackIntegration{}}},
+	"POST /api/v1/integrations/slack":       {Summary: "Add a Slack integration", Request: CreateSlackIntegrationRequest{}, Response: SlackIntegration{}, Status: http.StatusCreated},
+	"PATCH /api/v1/integrations/slack/:id":  {Summary: "Change the events or URL of a Slack integration", Request: UpdateSlackIntegrationRequest{}, Response: SlackIntegration{}},
+	"DELETE /api/v1/integrations/slack/:id": {Summary: "Remove a Slack integration", Status: http.StatusNoContent},
+
+	"GET /api/v1/admin/sessions": {Summary: "List sessions across every workspace", Query: []string{"q", "name", "owner", "workspaceId", "tag", "collectionId", "trashed", "externalId", "limit", "sort", "order", "createdAfter", "cursor"},
+		Response: sessionPage},
+	"GET /api/v1/admin/connections":             {Summary: "List every connection, optionally of the sessions a search matches", Query: []string{"sessionId", "q"}, Response: fields{"connections": []Connection{}}},
+	"DELETE /api/v1/admin/connections/:id":      {Summary: "Disconnect a client without a reconnect grace window", Status: http.StatusNoContent},
+	"POST /api/v1/admin/sessions/:id/terminate": {Summary: "End a session, and with purge delete it", Query: []string{"purge"}, Response: Session{}},
+	"GET /api/v1/admin/config":                  {Summary: "Show the effective configuration without secrets", Response: Config{}},
+	"GET /api/v1/admin/audit": {Summary: "Query the audit log", Query: []string{"actor", "action", "resource", "resourceId", "from", "to", "after", "limit"},
+		Response: fields{"entries": []AuditEntry{}, "nextAfter": int64(0)}},
+	"GET /api/v1/admin/log-level":              {Summary: "Show the log level", Response: fields{"level": ""}},
+	"PUT /api/v1/admin/log-level":              {Summary: "Change the log level", Request: LogLevelRequest{}, Response: fields{"level": ""}},
+	"GET /api/v1/admin/runtime":                {Summary: "Report store sizes, goroutines and heap figures", Response: anyObject},
+	"GET /api/v1/admin/integrations/health":    {Summary: "Show the circuit breakers of outbound integrations", Response: fields{"integrations": []CircuitBreaker{}}},
+	"POST /api/v1/admin/users":                 {Summary: "Provision a user and its first API token", Request: CreateUserRequest{}, Response: userToken, Status: http.StatusCreated},
+	"PUT /api/v1/admin/workspaces/:id/quota":   {Summary: "Override a workspace's quota", Request: WorkspaceQuotaRequest{}, Response: UsageReport{}},
+	"GET /api/v1/admin/workspaces/:id/archive": {Summary: "Download a workspace with its sessions, guides, media and settings as a zip archive"},
+	"POST /api/v1/admin/workspaces/import":     {Summary: "Import a workspace archive as a new workspace", Response: WorkspaceImport{}, Status: http.StatusCreated},
+	"POST /api/v1/admin/announcements":         {Summary: "Send an announcement to every open session", Request: AnnouncementRequest{}, Response: fields{"sessions": 0}},
+	"GET /api/v1/admin/sessions/:id/state":     {Summary: "Replay a session's membership at a point in time", Query: []string{"at"}, Response: SessionSnapshot{}},
+	"PUT /api/v1/admin/clients/:id/faults":     {Summary: "Inject network faults into a client's connection", Request: FaultProfile{}, Response: FaultProfile{}},
+	"DELETE /api/v1/admin/clients/:id/faults":  {Summary: "Clear a client's injected faults", Status: http.StatusNoContent},
+	"GET /api/v1/admin/compression":            {Summary: "Report WebSocket compression figures", Response: anyObject},
+	"GET /api/v1/admin/fanout":                 {Summary: "Report broadcast fan-out figures", Response: anyObject},
+	"GET /api/v1/admin/sweeper":                {Summary: "Show the state of the stale connection sweeper", Response: anyObject},
+	"POST /api/v1/admin/sweeper/run":           {Summary: "Run the sweeper now", Query: []string{"dryRun"}, Response: SweepReport{}},
+	"GET /api/v1/admin/changes": {Summary: "Read the change log after an offset; 410 once the offset is no longer kept", Query: []string{"after", "type", "sessionId", "limit"},
+		Response: fields{"changes": []ChangeEvent{}, "next": int64(0), "more": false}},
+	"GET /api/v1/admin/changes/stream":  {Summary: "Follow the change log from an offset as server-sent events", Query: []string{"after", "type", "sessionId"}},
+	"GET /api/v1/admin/ocr":             {Summary: "Report screenshot OCR figures", Response: anyObject},
+	"GET /api/v1/admin/email":           {Summary: "Report email delivery figures", Response: anyObject},
+	"GET /api/v1/admin/publisher":       {Summary: "Report Kafka or NATS event publishing figures", Response: anyObject},
+	"GET /api/v1/admin/jobs":            {Summary: "List scheduled jobs with their schedules and last runs", Response: fields{"leader": false, "jobs": []ScheduledJob{}}},
+	"POST /api/v1/admin/jobs/:name/run": {Summary: "Run a scheduled job now", Response: JobRun{}},
+	"GET /api/v1/admin/blobs/rekey":     {Summary: "Report blob encryption figures and the last re-encryption run", Response: EncryptionStats{}},
+	"POST /api/v1/admin/blobs/rekey":    {Summary: "Re-encrypt every blob under the current master key in the background", Response: BlobRekey{}, Status: http.StatusAccepted},
+}
+
+// apiRoutes is the router's route table, recorded once routes are
+// registered.
+var apiRoutes gin.RoutesInfo
+
+var openAPI struct {
+	spec gin.H
+	once sync.Once
+}
+
+// openAPISchemas turns Go types into OpenAPI schemas, collecting named
+// structs as components.
+type openAPISchemas struct {
+	components gin.H
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (s *openAPISchemas) of(value interface{}) gin.H {
+	switch v := value.(type) {
+	case fields:
+		properties := gin.H{}
+		for name, field := range v {
+			properties[name] = s.of(field)
+		}
+		return gin.H{"type": "object", "properties": properties}
+	case listOf:
+		return gin.H{"type": "array", "items": s.of(v[0])}
+	}
+	return s.forType(reflect.TypeOf(value))
+}
+
+func (s *openAPISchemas) forType(t reflect.Type) gin.H {
+	if t == nil {
+		return gin.H{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.forType(t.Elem())
+	case reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return gin.H{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return gin.H{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return gin.H{"type": "number"}
+	case reflect.String:
+		return gin.H{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return gin.H{"type": "string", "format": "byte"}
+		}
+		return gin.H{"type": "array", "items": s.forType(t.Elem())}
+	case reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": s.forType(t.Elem())}
+	case reflect.Struct:
+		if t == timeType {
+			return gin.H{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, done := s.components[t.Name()]; !done {
+			// Claim the name first so self-referencing types terminate.
+			s.components[t.Name()] = gin.H{}
+			s.components[t.Name()] = s.object(t)
+		}
+		return gin.H{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return gin.H{}
+}
+
+// object describes a struct the way encoding/json writes it and binding
+// reads it: json tags name the properties and binding:"required" marks
+// them required.
+func (s *openAPISchemas) object(t reflect.Type) gin.H {
+	properties := gin.H{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && options == "" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			embedded := s.object(field.Type)
+			for key, schema := range embedded["properties"].(gin.H) {
+				properties[key] = schema
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.forType(field.Type)
+		if containsString(strings.Split(field.Tag.Get("binding"), ","), "required") {
+			required = append(required, name)
+		}
+	}
+	schema := gin.H{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// openAPIPath turns a gin path into an OpenAPI one and lists its
+// parameters.
+func openAPIPath(path string) (string, []string) {
+	segments := strings.Split(path, "/")
+	var params []string
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			params = append(params, segment[1:])
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func buildOpenAPI(routes gin.RoutesInfo) gin.H {
+	schemas := &openAPISchemas{components: gin.H{}}
+	errorResponse := gin.H{"description": "Error", "content": gin.H{"application/json": gin.H{
+		"schema": schemas.of(fields{"error": ""}),
+	}}}
+
+	paths := gin.H{}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, apiPrefix+"/") || route.Path == apiPrefix+"/openapi.json" || route.Path == apiPrefix+"/docs" {
+			continue
+		}
+		path, pathParams := openAPIPath(route.Path)
+		doc, documented := apiOperations[route.Method+" "+route.Path]
+
+		parameters := []gin.H{}
+		for _, name := range pathParams {
+			parameters = append(parameters, gin.H{"name": name, "in": "path", "required": true, "schema": gin.H{"type": "string"}})
+		}
+		for _, name := range doc.Query {
+			parameters = append(parameters, gin.H{"name": name, "in": "query", "schema": gin.H{"type": "string"}})
+		}
+
+		status := doc.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := gin.H{"description": http.StatusText(status)}
+		if doc.Response != nil {
+			success["content"] = gin.H{"application/json": gin.H{"schema": schemas.of(doc.Response)}}
+		}
+		operation := gin.H{
+			"operationId": strings.ToLower(route.Method) + strings.NewReplacer("/", "_", ":", "", "-", "_").Replace(strings.TrimPrefix(route.Path, apiPrefix)),
+			"tags":        []string{openAPITag(route.Path)},
+			"parameters":  parameters,
+			"responses": gin.H{
+				strconv.Itoa(status): success,
+				"default":            errorResponse,
+			},
+		}
+		if documented {
+			operation["summary"] = doc.Summary
+		}
+		if doc.Request != nil {
+			operation["requestBody"] = gin.H{"required": true, "content": gin.H{"application/json": gin.H{"schema": schemas.of(doc.Request)}}}
+		}
+		if strings.HasPrefix(route.Path, apiPrefix+"/admin/") {
+			operation["security"] = []gin.H{{"adminToken": []string{}}}
+		}
+
+		item, exists := paths[path].(gin.H)
+		if !exists {
+			item = gin.H{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":   "Tango API",
+			"version": version,
+		},
+		"paths": paths,
+		"components": gin.H{
+			"schemas": schemas.components,
+			"securitySchemes": gin.H{
+				"bearerToken": gin.H{"type": "http", "scheme": "bearer", "description": "A user's API token"},
+				"adminToken":  gin.H{"type": "http", "scheme": "bearer", "description": "The operator token, ADMIN_TOKEN"},
+			},
+		},
+		"security": []gin.H{{"bearerToken": []string{}}, {}},
+	}
+}
+
+// openAPITag groups routes by the resource after the API prefix, or after
+// its /admin for operator routes.
+func openAPITag(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, apiPrefix+"/"), "/")
+	if segments[0] == "admin" {
+		return "admin"
+	}
+	return segments[0]
+}
+
+// getOpenAPI serves the OpenAPI 3 description of the REST API, built from
+// the router's routes on first request.
+func getOpenAPI(c *gin.Context) {
+	openAPI.once.Do(func() {
+		openAPI.spec = buildOpenAPI(apiRoutes)
+	})
+	c.JSON(http.StatusOK, openAPI.spec)
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Tango API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "/api/v1/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// getAPIDocs serves Swagger UI for the spec. The UI's assets load from a
+// CDN, so the page needs internet access in the browser.
+func getAPIDocs(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUIPage))
+}
@@ -0,0 +1,147 @@
+package tango
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	EnvDevelopment = "development"
+	EnvStaging     = "staging"
+	EnvProduction  = "production"
+
+	// OriginPolicyStrict refuses WebSocket upgrades from browsers on
+	// origins that are not allowed; OriginPolicyAny takes them from
+	// anywhere.
+	OriginPolicyStrict = "strict"
+	OriginPolicyAny    = "any"
+)
+
+// defaultOrigins are the origins allowed in each environment when none are
+// configured. Production allows none, so only pages served from the
+// server's own origin can call it.
+var defaultOrigins = map[string][]string{
+	EnvDevelopment: {"*"},
+	EnvStaging:     {"http://localhost:*", "http://127.0.0.1:*"},
+	EnvProduction:  {},
+}
+
+// origins returns the allowed origins: the configured ones, or the
+// environment's defaults.
+func (c *Config) origins() []string {
+	if len(c.AllowedOrigins) > 0 {
+		return c.AllowedOrigins
+	}
+	if c.Environment == "" {
+		return defaultOrigins[EnvDevelopment]
+	}
+	return defaultOrigins[c.Environment]
+}
+
+// splitOrigin takes an origin, or a pattern for one, apart. The port is ""
+// when the origin has none.
+func splitOrigin(origin string) (scheme, host, port string, ok bool) {
+	scheme, rest, ok := strings.Cut(origin, "://")
+	if !ok || scheme == "" || rest == "" || strings.ContainsAny(rest, "/?#@ ") {
+		return "", "", "", false
+	}
+	host = rest
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "]") {
+		host, port = rest[:i], rest[i+1:]
+	}
+	return strings.ToLower(scheme), strings.ToLower(host), port, host != ""
+}
+
+// validOriginPattern reports whether pattern is "*" or an origin whose
+// host may start with "*." for any subdomain and whose port may be "*" for
+// any port.
+func validOriginPattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	_, host, port, ok := splitOrigin(pattern)
+	if !ok || strings.Contains(strings.TrimPrefix(host, "*."), "*") || host == "*." {
+		return false
+	}
+	if port == "*" || port == "" {
+		return true
+	}
+	for _, r := range port {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func originMatches(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	pScheme, pHost, pPort, _ := splitOrigin(pattern)
+	scheme, host, port, ok := splitOrigin(origin)
+	if !ok || scheme != pScheme || (pPort != "*" && pPort != port) {
+		return false
+	}
+	if suffix := strings.TrimPrefix(pHost, "*"); suffix != pHost {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pHost
+}
+
+// originAllowed reports whether a browser on origin may call the server.
+func originAllowed(origin string) bool {
+	for _, pattern := range config.origins() {
+		if originMatches(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin decides whether to upgrade a WebSocket request. Clients
+// that are not browsers send no Origin and pages served by the server
+// itself share its host; both are always let in.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || config.WSOriginPolicy == OriginPolicyAny {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if originAllowed(origin) {
+		return true
+	}
+	logger.Warn("refused websocket upgrade from an unlisted origin", "origin", origin, "path", r.URL.Path)
+	return false
+}
+
+// corsHandler answers cross-origin requests from the allowed origins.
+// WebSocket upgrades are left to checkOrigin, under the WebSocket origin
+// policy.
+func corsHandler() gin.HandlerFunc {
+	corsConfig := cors.DefaultConfig()
+	if containsString(config.origins(), "*") {
+		corsConfig.AllowAllOrigins = true
+	} else {
+		corsConfig.AllowOriginFunc = originAllowed
+	}
+	corsConfig.AllowCredentials = true
+	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	corsConfig.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", apiVersionHeader, clientTokenHeader, uploadOffsetHeader, uploadChecksumHeader}
+	corsConfig.ExposeHeaders = []string{apiVersionHeader, "Deprecation", "Sunset", "Link", uploadOffsetHeader}
+	handler := cors.New(corsConfig)
+	return func(c *gin.Context) {
+		if websocket.IsWebSocketUpgrade(c.Request) {
+			c.Next()
+			return
+		}
+		handler(c)
+	}
+}
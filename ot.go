@@ -0,0 +1,254 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"unicode/utf16"
+)
+
+// textOp is an operational transform edit of a text, in the wire format of
+// ot.js: a list of components, each a positive number to keep that many
+// characters, a negative number to delete that many, or a string to
+// insert. Lengths count UTF-16 code units, as JavaScript strings do. The
+// op spans the whole text, so its base length must match the text's.
+type textOp []opComponent
+
+type opComponent struct {
+	retain int
+	delete int
+	insert []uint16
+}
+
+var (
+	errInvalidOp  = errors.New("operation must be a list of non-zero numbers and non-empty strings")
+	errOpMismatch = errors.New("operation does not span the text it is applied to")
+)
+
+func (op *textOp) UnmarshalJSON(data []byte) error {
+	var raw []interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return errInvalidOp
+	}
+	var parsed textOp
+	for _, item := range raw {
+		switch v := item.(type) {
+		case float64:
+			if v == 0 || v != math.Trunc(v) || math.Abs(v) > math.MaxInt32 {
+				return errInvalidOp
+			}
+			if v > 0 {
+				parsed = parsed.retain(int(v))
+			} else {
+				parsed = parsed.del(int(-v))
+			}
+		case string:
+			if v == "" {
+				return errInvalidOp
+			}
+			parsed = parsed.insert(utf16.Encode([]rune(v)))
+		default:
+			return errInvalidOp
+		}
+	}
+	*op = parsed
+	return nil
+}
+
+func (op textOp) MarshalJSON() ([]byte, error) {
+	out := make([]interface{}, len(op))
+	for i, c := range op {
+		switch {
+		case c.retain > 0:
+			out[i] = c.retain
+		case c.delete > 0:
+			out[i] = -c.delete
+		default:
+			out[i] = string(utf16.Decode(c.insert))
+		}
+	}
+	return json.Marshal(out)
+}
+
+// The builders below merge a component into the last one where they are of
+// the same kind, and keep an insert ahead of a delete at the same place, so
+// equivalent ops always come out the same.
+
+func (op textOp) retain(n int) textOp {
+	if n <= 0 {
+		return op
+	}
+	if last := len(op) - 1; last >= 0 && op[last].retain > 0 {
+		op[last].retain += n
+		return op
+	}
+	return append(op, opComponent{retain: n})
+}
+
+func (op textOp) del(n int) textOp {
+	if n <= 0 {
+		return op
+	}
+	if last := len(op) - 1; last >= 0 && op[last].delete > 0 {
+		op[last].delete += n
+		return op
+	}
+	return append(op, opComponent{delete: n})
+}
+
+func (op textOp) insert(s []uint16) textOp {
+	if len(s) == 0 {
+		return op
+	}
+	last := len(op) - 1
+	if last >= 0 && op[last].insert != nil {
+		op[last].insert = append(append([]uint16{}, op[last].insert...), s...)
+		return op
+	}
+	if last >= 0 && op[last].delete > 0 {
+		if last > 0 && op[last-1].insert != nil {
+			op[last-1].insert = append(append([]uint16{}, op[last-1].insert...), s...)
+			return op
+		}
+		deleted := op[last]
+		op[last] = opComponent{insert: s}
+		return append(op, deleted)
+	}
+	return append(op, opComponent{insert: s})
+}
+
+// baseLen is the length of the text the op applies to.
+func (op textOp) baseLen() int {
+	n := 0
+	for _, c := range op {
+		n += c.retain + c.delete
+	}
+	return n
+}
+
+// apply returns text with op applied.
+func (op textOp) apply(text string) (string, error) {
+	units := utf16.Encode([]rune(text))
+	if op.baseLen() != len(units) {
+		return "", errOpMismatch
+	}
+	out := make([]uint16, 0, len(units))
+	pos := 0
+	for _, c := range op {
+		switch {
+		case c.retain > 0:
+			out = append(out, units[pos:pos+c.retain]...)
+			pos += c.retain
+		case c.delete > 0:
+			pos += c.delete
+		default:
+			out = append(out, c.insert...)
+		}
+	}
+	return string(utf16.Decode(out)), nil
+}
+
+// replaceOp is the op that turns old into new wholesale, for changes made
+// outside the editing channel.
+func replaceOp(old, new string) textOp {
+	var op textOp
+	op = op.del(len(utf16.Encode([]rune(old))))
+	return op.insert(utf16.Encode([]rune(new)))
+}
+
+// transformOps returns a' and b' such that applying a then b' gives the same
+// text as b then a', for two ops made concurrently on the same text. Where
+// both insert at the same place, a's insert goes first. This is the
+// transform of ot.js, so its clients converge with the server.
+func transformOps(a, b textOp) (textOp, textOp, error) {
+	if a.baseLen() != b.baseLen() {
+		return nil, nil, errOpMismatch
+	}
+	var aPrime, bPrime textOp
+	i, j := 0, 0
+	var ca, cb *opComponent
+	next := func(op textOp, k *int) *opComponent {
+		if *k >= len(op) {
+			return nil
+		}
+		c := op[*k]
+		*k++
+		return &c
+	}
+	ca, cb = next(a, &i), next(b, &j)
+	for ca != nil || cb != nil {
+		if ca != nil && ca.insert != nil {
+			aPrime = aPrime.insert(ca.insert)
+			bPrime = bPrime.retain(len(ca.insert))
+			ca = next(a, &i)
+			continue
+		}
+		if cb != nil && cb.insert != nil {
+			aPrime = aPrime.retain(len(cb.insert))
+			bPrime = bPrime.insert(cb.insert)
+			cb = next(b, &j)
+			continue
+		}
+		if ca == nil || cb == nil {
+			return nil, nil, errOpMismatch
+		}
+
+		// Both are retains or deletes: consume the shorter of the two.
+		lenA, lenB := ca.retain+ca.delete, cb.retain+cb.delete
+		n := lenA
+		if lenB < n {
+			n = lenB
+		}
+		switch {
+		case ca.retain > 0 && cb.retain > 0:
+			aPrime = aPrime.retain(n)
+			bPrime = bPrime.retain(n)
+		case ca.delete > 0 && cb.retain > 0:
+			aPrime = aPrime.del(n)
+		case ca.retain > 0 && cb.delete > 0:
+			bPrime = bPrime.del(n)
+		}
+		// Where both delete the same characters, neither needs to again.
+
+		if lenA == n {
+			ca = next(a, &i)
+		} else if ca.retain > 0 {
+			ca.retain -= n
+		} else {
+			ca.delete -= n
+		}
+		if lenB == n {
+			cb = next(b, &j)
+		} else if cb.retain > 0 {
+			cb.retain -= n
+		} else {
+			cb.delete -= n
+		}
+	}
+	return aPrime, bPrime, nil
+}
+
+// transformIndex moves a cursor position past op, as ot.js does for
+// selections.
+func (op textOp) transformIndex(index int) int {
+	newIndex := index
+	for _, c := range op {
+		switch {
+		case c.retain > 0:
+			index -= c.retain
+		case c.delete > 0:
+			if c.delete < index {
+				newIndex -= c.delete
+			} else {
+				newIndex -= index
+			}
+			index -= c.delete
+		default:
+			newIndex += len(c.insert)
+		}
+		if index < 0 {
+			break
+		}
+	}
+	return newIndex
+}
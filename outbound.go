@@ -0,0 +1,291 @@
+package tango
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+const (
+	outboundMaxAttempts    = 4
+	outboundInitialBackoff = time.Second
+	outboundMaxBackoff     = 30 * time.Second
+	outboundTimeout        = 10 * time.Second
+	breakerThreshold       = 5
+	breakerCooldown        = 30 * time.Second
+)
+
+var (
+	errCircuitOpen   = errors.New("circuit breaker open")
+	errPrivateTarget = errors.New("the address is not public")
+)
+
+// reservedNetworks are ranges outside the public internet that net.IP has
+// no predicate for: "this network", carrier-grade NAT (where some clouds
+// serve instance metadata), IETF protocol assignments, benchmarking,
+// reserved space and NAT64.
+var reservedNetworks, _ = parseCIDRs([]string{
+	"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96", "64:ff9b:1::/48",
+})
+
+// publicAddress reports whether ip is on the public internet, so not a
+// loopback, private, link-local (which holds cloud metadata services),
+// multicast or reserved address.
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || containsIP(reservedNetworks, ip))
+}
+
+// checkPublicURL checks that a URL a user supplied is http or https and
+// that its host only resolves to public addresses, unless the server
+// allows private targets.
+func checkPublicURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("the URL must be an absolute http or https URL")
+	}
+	if config.PrivateTargets {
+		return nil
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !publicAddress(ip) {
+			return fmt.Errorf("%s: %w", host, errPrivateTarget)
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("%s cannot be resolved", host)
+	}
+	for _, addr := range addrs {
+		if !publicAddress(addr.IP) {
+			return fmt.Errorf("%s resolves to %s: %w", host, addr.IP, errPrivateTarget)
+		}
+	}
+	return nil
+}
+
+// dialPublic refuses connections to addresses that are not public. It
+// runs once the host is resolved, so a name that resolved to a public
+// address when it was checked cannot be pointed elsewhere later.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	if config.PrivateTargets {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return fmt.Errorf("%s: %w", host, errPrivateTarget)
+	}
+	return nil
+}
+
+type CircuitBreaker struct {
+	Target      string `json:"target"`
+	State       string `json:"state"`
+	Failures    int    `json:"consecutiveFailures"`
+	LastError   string `json:"lastError,omitempty"`
+	LastSuccess int64  `json:"lastSuccess,omitempty"`
+	LastFailure int64  `json:"lastFailure,omitempty"`
+	openedAt    time.Time
+	// probing is set while the one trial call of a half-open breaker is
+	// in flight.
+	probing bool
+}
+
+// state returns the breaker's state as a call would find it, without
+// changing it: open breakers whose cooldown has elapsed are half-open.
+func (b *CircuitBreaker) state() string {
+	if b.State == BreakerOpen && time.Since(b.openedAt) >= breakerCooldown {
+		return BreakerHalfOpen
+	}
+	return b.State
+}
+
+// allow reports whether a call may proceed, moving an open breaker to
+// half-open once its cooldown has elapsed. A half-open breaker lets a
+// single trial call through until it is recorded.
+func (b *CircuitBreaker) allow() bool {
+	b.State = b.state()
+	switch b.State {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+func (b *CircuitBreaker) record(err error) {
+	b.probing = false
+	if err == nil {
+		b.State = BreakerClosed
+		b.Failures = 0
+		b.LastSuccess = getCurrentTimestamp()
+		return
+	}
+
+	b.Failures++
+	b.LastError = err.Error()
+	b.LastFailure = getCurrentTimestamp()
+	if b.State == BreakerHalfOpen || b.Failures >= breakerThreshold {
+		b.State = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// OutboundClient is the shared layer for calls to third-party endpoints.
+// Each target gets its own circuit breaker so one flaky integration cannot
+// tie up retries for the others.
+type OutboundClient struct {
+	client   *http.Client
+	public   *http.Client
+	breakers map[string]*CircuitBreaker
+	mu       sync.Mutex
+}
+
+func NewOutboundClient() *OutboundClient {
+	dialer := &net.Dialer{Timeout: outboundTimeout, Control: dialPublic}
+	return &OutboundClient{
+		client: &http.Client{Timeout: outboundTimeout},
+		// The public client goes through no proxy, as dialPublic would
+		// check the proxy's address instead of the target's.
+		public: &http.Client{Timeout: outboundTimeout, Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: outboundTimeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		}},
+		breakers: make(map[string]*CircuitBreaker),
+	}
+}
+
+var outbound = NewOutboundClient()
+
+func (o *OutboundClient) breaker(target string) *CircuitBreaker {
+	b, exists := o.breakers[target]
+	if !exists {
+		b = &CircuitBreaker{Target: target, State: BreakerClosed}
+		o.breakers[target] = b
+	}
+	return b
+}
+
+func backoff(attempt int) time.Duration {
+	delay := outboundInitialBackoff << uint(attempt-1)
+	if delay > outboundMaxBackoff {
+		delay = outboundMaxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Do sends the request built by newRequest to target, retrying failures with
+// jittered exponential backoff. It returns the last status code seen and the
+// number of attempts made.
+func (o *OutboundClient) Do(target string, newRequest func() (*http.Request, error)) (int, int, error) {
+	return o.do(o.client, target, newRequest)
+}
+
+// DoPublic is Do for URLs users supply, such as webhooks: it only connects
+// to public addresses.
+func (o *OutboundClient) DoPublic(target string, newRequest func() (*http.Request, error)) (int, int, error) {
+	return o.do(o.public, target, newRequest)
+}
+
+func (o *OutboundClient) do(client *http.Client, target string, newRequest func() (*http.Request, error)) (int, int, error) {
+	var (
+		status int
+		err    error
+	)
+
+	for attempt := 1; attempt <= outboundMaxAttempts; attempt++ {
+		o.mu.Lock()
+		allowed := o.breaker(target).allow()
+		o.mu.Unlock()
+		if !allowed {
+			return status, attempt - 1, errCircuitOpen
+		}
+
+		status, err = send(client, newRequest)
+
+		o.mu.Lock()
+		o.breaker(target).record(err)
+		o.mu.Unlock()
+
+		if err == nil || errors.Is(err, errPrivateTarget) {
+			return status, attempt, err
+		}
+		if attempt < outboundMaxAttempts {
+			time.Sleep(backoff(attempt))
+		}
+	}
+	return status, outboundMaxAttempts, err
+}
+
+func send(client *http.Client, newRequest func() (*http.Request, error)) (int, error) {
+	req, err := newRequest()
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (o *OutboundClient) Forget(target string) {
+	o.mu.Lock()
+	delete(o.breakers, target)
+	o.mu.Unlock()
+}
+
+func (o *OutboundClient) Health() []CircuitBreaker {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	health := make([]CircuitBreaker, 0, len(o.breakers))
+	for _, b := range o.breakers {
+		breaker := *b
+		breaker.State = b.state()
+		health = append(health, breaker)
+	}
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].Target < health[j].Target
+	})
+	return health
+}
+
+func getIntegrationHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"integrations": outbound.Health(),
+	})
+}
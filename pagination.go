@@ -0,0 +1,199 @@
+package tango
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// sessionSortFields are the keys sessions can be ordered by. Ties are broken
+// by ID so that every ordering is total and cursors stay stable.
+var sessionSortFields = map[string]bool{
+	"createdAt":   true,
+	"name":        true,
+	"clientCount": true,
+}
+
+type SessionPage struct {
+	Limit        int
+	Sort         string
+	Desc         bool
+	After        *pageCursor
+	NameContains string
+	Owner        string
+	CreatedAfter int64
+	Trashed      bool
+	Tags         []string
+	CollectionID string
+}
+
+// pageCursor identifies the last session of the previous page by its sort
+// key and ID. It is handed to clients as opaque base64.
+type pageCursor struct {
+	Sort   string  `json:"s"`
+	Desc   bool    `json:"d,omitempty"`
+	Number float64 `json:"n,omitempty"`
+	Text   string  `json:"t,omitempty"`
+	ID     string  `json:"i"`
+}
+
+func encodeCursor(cur pageCursor) string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var cur pageCursor
+	if err := json.Unmarshal(data, &cur); err != nil || cur.ID == "" {
+		return nil, errors.New("invalid cursor")
+	}
+	return &cur, nil
+}
+
+func parseSessionPage(query url.Values) (SessionPage, error) {
+	page := SessionPage{
+		Limit:        defaultPageSize,
+		Sort:         "createdAt",
+		NameContains: strings.ToLower(query.Get("name")),
+		Owner:        query.Get("owner"),
+		Trashed:      query.Get("trashed") == "true",
+		Tags:         query["tag"],
+		CollectionID: query.Get("collectionId"),
+	}
+
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageSize {
+			return page, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+		page.Limit = n
+	}
+
+	if value := query.Get("sort"); value != "" {
+		if !sessionSortFields[value] {
+			return page, errors.New("sort must be one of createdAt, name, clientCount")
+		}
+		page.Sort = value
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		page.Desc = true
+	default:
+		return page, errors.New("order must be asc or desc")
+	}
+
+	if value := query.Get("createdAfter"); value != "" {
+		ts, err := parseQueryTime(value)
+		if err != nil {
+			return page, errors.New("createdAfter must be a unix timestamp, date or RFC 3339 time")
+		}
+		page.CreatedAfter = ts
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cur, err := decodeCursor(value)
+		if err != nil {
+			return page, err
+		}
+		if cur.Sort != page.Sort || cur.Desc != page.Desc {
+			return page, errors.New("cursor was issued for a different sort order")
+		}
+		page.After = cur
+	}
+	return page, nil
+}
+
+// Match applies the page's simple filters. Trashed sessions are listed
+// only when asked for, and then exclusively. Callers must hold s.mu.
+func (p SessionPage) Match(s *Session) bool {
+	if (s.Status == SessionTrashed) != p.Trashed {
+		return false
+	}
+	if p.NameContains != "" && !strings.Contains(strings.ToLower(s.Name), p.NameContains) {
+		return false
+	}
+	if p.Owner != "" && s.Owner != p.Owner {
+		return false
+	}
+	if !hasTags(s.Tags, p.Tags) || !inCollection(s.CollectionID, p.CollectionID) {
+		return false
+	}
+	return p.CreatedAfter == 0 || s.CreatedAt > p.CreatedAfter
+}
+
+// cursorFor returns the sort key of s. Callers must hold s.mu.
+func (p SessionPage) cursorFor(s *Session) pageCursor {
+	cur := pageCursor{Sort: p.Sort, Desc: p.Desc, ID: s.ID}
+	if p.Sort == "name" {
+		cur.Text = s.Name
+	} else {
+		cur.Number = sessionNumberField(s, p.sortField())
+	}
+	return cur
+}
+
+func (p SessionPage) sortField() string {
+	if p.Sort == "clientCount" {
+		return "participants"
+	}
+	return p.Sort
+}
+
+// less orders two cursors, which double as sort keys, in page order.
+func (p SessionPage) less(a, b pageCursor) bool {
+	var before, after bool
+	if p.Sort == "name" {
+		before, after = a.Text < b.Text, a.Text > b.Text
+	} else {
+		before, after = a.Number < b.Number, a.Number > b.Number
+	}
+	if !before && !after {
+		before = a.ID < b.ID
+		if p.Desc {
+			before = a.ID > b.ID
+		}
+		return before
+	}
+	if p.Desc {
+		return after
+	}
+	return before
+}
+
+// Apply sorts sessions by their keys from cursorFor and returns the
+// requested page together with the cursor for the next one, which is empty
+// on the last page.
+func (p SessionPage) Apply(sessions []*Session, keys map[*Session]pageCursor) ([]*Session, string) {
+	sort.Slice(sessions, func(i, j int) bool {
+		return p.less(keys[sessions[i]], keys[sessions[j]])
+	})
+
+	start := 0
+	if p.After != nil {
+		start = sort.Search(len(sessions), func(i int) bool {
+			return p.less(*p.After, keys[sessions[i]])
+		})
+	}
+	sessions = sessions[start:]
+
+	if len(sessions) <= p.Limit {
+		return sessions, ""
+	}
+	sessions = sessions[:p.Limit]
+	return sessions, encodeCursor(keys[sessions[len(sessions)-1]])
+}
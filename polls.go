@@ -0,0 +1,346 @@
+package tango
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PollOpen   = "open"
+	PollClosed = "closed"
+
+	maxPollOptions       = 10
+	maxPollQuestionBytes = 500
+	maxPollOptionBytes   = 200
+	maxPollsPerSession   = 50
+	// pollResultsDelay gathers the votes cast in a burst into one
+	// poll_results broadcast.
+	pollResultsDelay = 500 * time.Millisecond
+)
+
+var (
+	errPollNotFound = errors.New("poll not found")
+	errPollClosed   = errors.New("poll is closed")
+	errTooManyPolls = fmt.Errorf("a session can have at most %d polls", maxPollsPerSession)
+)
+
+// Poll is a question hosts put to a session. Each voter, a signed-in user
+// or else a client, has one ballot, which a later vote replaces. The
+// server keeps the tally.
+type Poll struct {
+	ID        string       `json:"id"`
+	Question  string       `json:"question"`
+	Options   []PollOption `json:"options"`
+	Multiple  bool         `json:"multiple"`
+	Status    string       `json:"status"`
+	CreatedBy string       `json:"createdBy"`
+	CreatedAt int64        `json:"createdAt"`
+	ClosedAt  int64        `json:"closedAt,omitempty"`
+	Voters    int          `json:"voters"`
+
+	ballots        map[string][]int
+	resultsPending bool
+}
+
+type PollOption struct {
+	Text  string `json:"text"`
+	Votes int    `json:"votes"`
+}
+
+func (p *Poll) snapshot() Poll {
+	snapshot := *p
+	snapshot.Options = append([]PollOption(nil), p.Options...)
+	snapshot.ballots = nil
+	return snapshot
+}
+
+// PollBoard keeps each session's polls, oldest first.
+type PollBoard struct {
+	polls map[string][]*Poll
+	mu    sync.Mutex
+}
+
+var polls = &PollBoard{polls: make(map[string][]*Poll)}
+
+func (b *PollBoard) create(sessionID string, poll *Poll) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.polls[sessionID]) >= maxPollsPerSession {
+		return errTooManyPolls
+	}
+	b.polls[sessionID] = append(b.polls[sessionID], poll)
+	return nil
+}
+
+// find returns a session's poll. Callers must hold b.mu.
+func (b *PollBoard) find(sessionID, pollID string) *Poll {
+	for _, poll := range b.polls[sessionID] {
+		if poll.ID == pollID {
+			return poll
+		}
+	}
+	return nil
+}
+
+// vote records voter's ballot and reports whether a results broadcast
+// needs scheduling.
+func (b *PollBoard) vote(sessionID, pollID, voter string, choices []int) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	poll := b.find(sessionID, pollID)
+	if poll == nil {
+		return false, errPollNotFound
+	}
+	if poll.Status != PollOpen {
+		return false, errPollClosed
+	}
+	if len(choices) == 0 || len(choices) > 1 && !poll.Multiple {
+		return false, errors.New("choose one option, or several in a poll that allows it")
+	}
+	seen := make(map[int]bool, len(choices))
+	for _, choice := range choices {
+		if choice < 0 || choice >= len(poll.Options) || seen[choice] {
+			return false, errors.New("options must be distinct indexes into the poll's options")
+		}
+		seen[choice] = true
+	}
+
+	for _, choice := range poll.ballots[voter] {
+		poll.Options[choice].Votes--
+	}
+	for _, choice := range choices {
+		poll.Options[choice].Votes++
+	}
+	poll.ballots[voter] = append([]int(nil), choices...)
+	poll.Voters = len(poll.ballots)
+
+	if poll.resultsPending {
+		return false, nil
+	}
+	poll.resultsPending = true
+	return true, nil
+}
+
+// results returns a poll's current tally for broadcasting.
+func (b *PollBoard) results(sessionID, pollID string) (Poll, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	poll := b.find(sessionID, pollID)
+	if poll == nil {
+		return Poll{}, false
+	}
+	poll.resultsPending = false
+	return poll.snapshot(), true
+}
+
+func (b *PollBoard) close(sessionID, pollID string) (Poll, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	poll := b.find(sessionID, pollID)
+	if poll == nil {
+		return Poll{}, errPollNotFound
+	}
+	if poll.Status != PollOpen {
+		return Poll{}, errPollClosed
+	}
+	poll.Status = PollClosed
+	poll.ClosedAt = getCurrentTimestamp()
+	return poll.snapshot(), nil
+}
+
+func (b *PollBoard) List(sessionID string) []Poll {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := []Poll{}
+	for _, poll := range b.polls[sessionID] {
+		list = append(list, poll.snapshot())
+	}
+	return list
+}
+
+func (b *PollBoard) Forget(sessionID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.polls, sessionID)
+}
+
+// voterOf is who a client votes as: its user when signed in, so votes
+// follow the person across connections.
+func voterOf(client *Client) string {
+	if client.userID != "" {
+		return "user:" + client.userID
+	}
+	return "client:" + client.ID
+}
+
+func handlePollCreate(client *Client, session *Session, span *Span, msg InboundMessage) {
+	session.mu.Lock()
+	host := isHost(client)
+	session.mu.Unlock()
+	if !host {
+		sendError(client, "forbidden", "Only the host can start polls")
+		return
+	}
+
+	var req struct {
+		Question string   `json:"question"`
+		Options  []string `json:"options"`
+		Multiple bool     `json:"multiple"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		sendError(client, "invalid_payload", "poll_create payload must be an object with question and options")
+		return
+	}
+	req.Question = strings.TrimSpace(req.Question)
+	if req.Question == "" || len(req.Question) > maxPollQuestionBytes {
+		sendError(client, "invalid_payload", fmt.Sprintf("question must be 1-%d bytes", maxPollQuestionBytes))
+		return
+	}
+	if len(req.Options) < 2 || len(req.Options) > maxPollOptions {
+		sendError(client, "invalid_payload", fmt.Sprintf("a poll needs 2-%d options", maxPollOptions))
+		return
+	}
+	poll := &Poll{
+		ID:        generateID(),
+		Question:  req.Question,
+		Multiple:  req.Multiple,
+		Status:    PollOpen,
+		CreatedBy: client.ID,
+		CreatedAt: getCurrentTimestamp(),
+		ballots:   make(map[string][]int),
+	}
+	for _, option := range req.Options {
+		option = strings.TrimSpace(option)
+		if option == "" || len(option) > maxPollOptionBytes {
+			sendError(client, "invalid_payload", fmt.Sprintf("options must be 1-%d bytes", maxPollOptionBytes))
+			return
+		}
+		poll.Options = append(poll.Options, PollOption{Text: option})
+	}
+	created := poll.snapshot()
+	if err := polls.create(session.ID, poll); err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+
+	auditClient(client, "poll.create", "poll", poll.ID, gin.H{"sessionId": session.ID, "question": poll.Question})
+	broadcastToSession(span, session.ID, Message{Type: "poll", Payload: created}, "")
+}
+
+func handlePollVote(client *Client, session *Session, msg InboundMessage) {
+	var req struct {
+		PollID  string `json:"pollId"`
+		Options []int  `json:"options"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.PollID == "" {
+		sendError(client, "invalid_payload", "poll_vote payload must be an object with pollId and options")
+		return
+	}
+	schedule, err := polls.vote(session.ID, req.PollID, voterOf(client), req.Options)
+	if err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	if schedule {
+		sessionID, pollID := session.ID, req.PollID
+		time.AfterFunc(pollResultsDelay, func() {
+			if poll, ok := polls.results(sessionID, pollID); ok {
+				broadcastPollResults(sessionID, poll)
+			}
+		})
+	}
+}
+
+func broadcastPollResults(sessionID string, poll Poll) {
+	broadcastToSession(nil, sessionID, Message{
+		Type: "poll_results",
+		Payload: gin.H{
+			"pollId":  poll.ID,
+			"options": poll.Options,
+			"voters":  poll.Voters,
+			"status":  poll.Status,
+		},
+	}, "")
+}
+
+func handlePollClose(client *Client, session *Session, span *Span, msg InboundMessage) {
+	session.mu.Lock()
+	host := isHost(client)
+	session.mu.Unlock()
+	if !host {
+		sendError(client, "forbidden", "Only the host can close polls")
+		return
+	}
+
+	var req struct {
+		PollID string `json:"pollId"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.PollID == "" {
+		sendError(client, "invalid_payload", "poll_close payload must be an object with pollId")
+		return
+	}
+	poll, err := polls.close(session.ID, req.PollID)
+	if err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+
+	auditClient(client, "poll.close", "poll", poll.ID, gin.H{"sessionId": session.ID, "voters": poll.Voters})
+	broadcastToSession(span, session.ID, Message{Type: "poll_closed", Payload: poll}, "")
+}
+
+// sendPollSync brings a client that just joined up to date with the
+// session's polls.
+func sendPollSync(client *Client, session *Session) {
+	list := polls.List(session.ID)
+	if len(list) == 0 {
+		return
+	}
+	client.send(Message{
+		Type: "poll_sync",
+		Payload: gin.H{
+			"sessionId": session.ID,
+			"polls":     list,
+		},
+	})
+}
+
+// getPolls lists a session's polls with their results, as JSON or, with
+// format=csv, one row per option.
+func getPolls(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	list := polls.List(session.ID)
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, gin.H{"polls": list})
+		return
+	}
+
+	rows := [][]string{{"poll_id", "question", "status", "voters", "option", "votes"}}
+	for _, poll := range list {
+		for _, option := range poll.Options {
+			rows = append(rows, []string{poll.ID, poll.Question, poll.Status, strconv.Itoa(poll.Voters), option.Text, strconv.Itoa(option.Votes)})
+		}
+	}
+	writeCSV(c, "polls.csv", rows)
+}
+
+func writeCSV(c *gin.Context, name string, rows [][]string) {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.WriteAll(rows)
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", []byte(b.String()))
+}
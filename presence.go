@@ -0,0 +1,92 @@
+package tango
+
+import (
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Presence struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Role         string   `json:"role"`
+	Features     []string `json:"features,omitempty"`
+	Status       string   `json:"status"`
+	HandRaised   bool     `json:"handRaised"`
+	JoinedAt     int64    `json:"joinedAt"`
+	LastActiveAt int64    `json:"lastActiveAt"`
+	AckedSeq     int64    `json:"ackedSeq"`
+	LagMs        int64    `json:"lagMs"`
+}
+
+// touch records inbound activity. It runs on the client's read loop, so it
+// avoids taking any lock.
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.lastActive, getCurrentTimestamp())
+}
+
+func (c *Client) presence() Presence {
+	return Presence{
+		ID:           c.ID,
+		Name:         c.Name,
+		Role:         c.Role,
+		Features:     c.Features,
+		Status:       c.Status,
+		HandRaised:   c.HandRaised,
+		JoinedAt:     c.JoinedAt,
+		LastActiveAt: atomic.LoadInt64(&c.lastActive),
+		AckedSeq:     c.ackedSeq,
+		LagMs:        c.ackLag.Milliseconds(),
+	}
+}
+
+// roster lists the session's connected clients in join order. Callers must
+// hold session.mu.
+func roster(session *Session) []Presence {
+	clients := make([]Presence, 0, len(session.Clients))
+	for _, client := range session.Clients {
+		clients = append(clients, client.presence())
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].JoinedAt != clients[j].JoinedAt {
+			return clients[i].JoinedAt < clients[j].JoinedAt
+		}
+		return clients[i].ID < clients[j].ID
+	})
+	return clients
+}
+
+func getSessionClients(c *gin.Context) {
+	id := c.Param("id")
+
+	session, exists := sessionFor(c, id)
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"clients": roster(session),
+		"seq":     session.stream.seq,
+	})
+}
+
+// sendPresenceSync gives a new joiner the current roster so it does not
+// have to rebuild it from join and leave events.
+func sendPresenceSync(client *Client, session *Session) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	client.send(Message{
+		Type: "presence_sync",
+		Payload: gin.H{
+			"sessionId": session.ID,
+			"clients":   roster(session),
+		},
+	})
+}
@@ -0,0 +1,450 @@
+package tango
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+
+	exportTTL = 24 * time.Hour
+)
+
+// DataExport is an archive of everything held about a user, built in the
+// background and kept for a day.
+type DataExport struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	CreatedAt   int64  `json:"createdAt"`
+	CompletedAt int64  `json:"completedAt,omitempty"`
+	ExpiresAt   int64  `json:"expiresAt"`
+	Size        int    `json:"size,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	userID string
+}
+
+// blobKey names the export's archive in the BlobStore.
+func (e *DataExport) blobKey() string {
+	return "exports/" + e.ID
+}
+
+type ExportRegistry struct {
+	exports map[string]*DataExport
+	mu      sync.Mutex
+}
+
+var exports = &ExportRegistry{exports: make(map[string]*DataExport)}
+
+// prune drops expired exports and their archives, and with forUser every
+// export of that user.
+func (r *ExportRegistry) prune(now int64, forUser string) {
+	var pruned []*DataExport
+	r.mu.Lock()
+	for id, export := range r.exports {
+		if export.ExpiresAt <= now || export.userID == forUser {
+			delete(r.exports, id)
+			pruned = append(pruned, export)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, export := range pruned {
+		if err := blobs.Delete(context.Background(), export.blobKey()); err != nil {
+			logger.Warn("deleting export archive failed", "export", export.ID, "error", err)
+		}
+	}
+}
+
+func (r *ExportRegistry) lookup(c *gin.Context, user *User) (DataExport, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	export, exists := r.exports[c.Param("exportId")]
+	if !exists || export.userID != user.ID || export.ExpiresAt <= getCurrentTimestamp() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return DataExport{}, false
+	}
+	return *export, true
+}
+
+func requestExport(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+
+	now := time.Now()
+	export := &DataExport{
+		ID:        generateID(),
+		Status:    ExportPending,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(exportTTL).Unix(),
+		userID:    user.ID,
+	}
+
+	exports.mu.Lock()
+	for _, other := range exports.exports {
+		if other.userID == user.ID && other.Status == ExportPending {
+			pending := *other
+			exports.mu.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": "An export is already being prepared", "export": pending})
+			return
+		}
+	}
+	exports.exports[export.ID] = export
+	snapshot := *export
+	exports.mu.Unlock()
+
+	go func() {
+		archive, err := buildExport(user)
+		if err == nil {
+			err = blobs.Put(context.Background(), export.blobKey(), archive)
+		}
+		exports.mu.Lock()
+		export.CompletedAt = getCurrentTimestamp()
+		if err != nil {
+			export.Status, export.Error = ExportFailed, "The export could not be built"
+			exports.mu.Unlock()
+			logger.Error("building data export failed", "user", user.ID, "error", err)
+			notifications.Notify(user.ID, Notification{Type: NotifyExport, Text: "Your data export could not be built", Data: gin.H{"exportId": export.ID, "status": ExportFailed}})
+			return
+		}
+		export.Status, export.Size = ExportReady, len(archive)
+		_, live := exports.exports[export.ID]
+		exports.mu.Unlock()
+		if !live {
+			// Pruned while it was being built.
+			blobs.Delete(context.Background(), export.blobKey())
+			return
+		}
+		notifications.Notify(user.ID, Notification{Type: NotifyExport, Text: "Your data export is ready to download", Data: gin.H{"exportId": export.ID, "status": ExportReady}})
+	}()
+
+	auditRequest(c, "user.export", "user", user.ID, gin.H{"exportId": export.ID})
+	c.Header("Location", apiPrefix+"/users/me/exports/"+export.ID)
+	c.JSON(http.StatusAccepted, snapshot)
+}
+
+func getExport(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	if export, ok := exports.lookup(c, user); ok {
+		c.JSON(http.StatusOK, export)
+	}
+}
+
+func downloadExport(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	export, ok := exports.lookup(c, user)
+	if !ok {
+		return
+	}
+	if export.Status != ExportReady {
+		c.JSON(http.StatusConflict, gin.H{"error": "The export is not ready", "export": export})
+		return
+	}
+	filename := "tango-export-" + export.ID + ".zip"
+	if redirectToBlob(c, export.blobKey(), "application/zip", filename) {
+		return
+	}
+	archive, err := blobs.Get(c.Request.Context(), export.blobKey())
+	if errors.Is(err, ErrBlobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Data(http.StatusOK, "application/zip", archive)
+}
+
+// buildExport gathers the user's profile, linked sign-ins, memberships,
+// the sessions they created with their annotations, usage, and the audit
+// trail of their actions into a zip of JSON files.
+func buildExport(user *User) ([]byte, error) {
+	files := make(map[string]interface{})
+
+	users.mu.Lock()
+	identities := []string{}
+	for key, linked := range users.identities {
+		if linked == user {
+			identities = append(identities, key)
+		}
+	}
+	profile := *user
+	users.mu.Unlock()
+	sort.Strings(identities)
+	files["profile.json"] = gin.H{"user": profile, "identities": identities}
+	files["workspaces.json"] = workspaces.listFor(user)
+	files["usage.json"] = usageReport(ScopeUser, user.ID, user.Email)
+	files["comments.json"] = comments.By(user.ID)
+	files["notifications.json"], _ = notifications.List(user.ID, false, maxNotificationsPerUser)
+	files["favorites.json"] = gin.H{"starred": favorites.starredBy(user.ID), "recent": favorites.recentFor(user.ID)}
+	files["email_preferences.json"] = emailPreferences.get(user.ID)
+	files["templates.json"] = templates.By(user.ID)
+	files["guides.json"] = guides.By(user.ID)
+
+	for _, session := range store.sessionList() {
+		session.mu.Lock()
+		if session.CreatedBy != user.ID {
+			session.mu.Unlock()
+			continue
+		}
+		data, err := json.MarshalIndent(gin.H{
+			"session":     session,
+			"annotations": annotations.Strokes(session.ID),
+			"polls":       polls.List(session.ID),
+			"questions":   questions.List(session.ID, true),
+			"captions":    captions.List(session.ID),
+			"chat":        chat.List(session.ID, 0),
+			"screenshots": screenshots.List(session.ID),
+		}, "", "  ")
+		session.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		files["sessions/"+session.ID+".json"] = json.RawMessage(data)
+	}
+
+	entries, _ := audit.Query(AuditFilter{Actor: "user:" + user.ID, Limit: auditMemoryLimit})
+	files["audit.json"] = entries
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range names {
+		data, ok := files[name].(json.RawMessage)
+		if !ok {
+			var err error
+			if data, err = json.MarshalIndent(files[name], "", "  "); err != nil {
+				return nil, err
+			}
+		}
+		w, err := archive.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// soleOwnerships lists the workspaces that would be left without an owner
+// but still have other members if user went away.
+func soleOwnerships(user *User) []string {
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+
+	ids := []string{}
+	for id, ws := range workspaces.Workspaces {
+		member, ok := ws.Members[user.ID]
+		if ok && member.Role == RoleOwner && ws.owners() == 1 && len(ws.Members) > 1 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// scheduleDeletion queues the caller's account for deletion once the grace
+// period has passed. Until then it can be called off.
+func scheduleDeletion(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	if blocking := soleOwnerships(user); len(blocking) > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":      "Make someone else an owner of these workspaces first",
+			"workspaces": blocking,
+		})
+		return
+	}
+
+	deleteAt := getCurrentTimestamp() + int64(config.DeletionGrace)
+	users.mu.Lock()
+	user.DeletionScheduledAt = deleteAt
+	users.mu.Unlock()
+	auditRequest(c, "user.delete.schedule", "user", user.ID, gin.H{"deleteAt": deleteAt})
+
+	if config.DeletionGrace == 0 {
+		deleteAccount(user)
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"deletionScheduledAt": deleteAt})
+}
+
+func cancelDeletion(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	users.mu.Lock()
+	scheduled := user.DeletionScheduledAt != 0
+	user.DeletionScheduledAt = 0
+	users.mu.Unlock()
+	if !scheduled {
+		c.JSON(http.StatusConflict, gin.H{"error": "No deletion is scheduled"})
+		return
+	}
+	auditRequest(c, "user.delete.cancel", "user", user.ID, nil)
+	c.Status(http.StatusNoContent)
+}
+
+// runAccountDeletions deletes the accounts whose grace period is over.
+func runAccountDeletions(now int64) int {
+	users.mu.Lock()
+	due := []*User{}
+	for _, user := range users.Users {
+		if user.DeletionScheduledAt != 0 && user.DeletionScheduledAt <= now {
+			due = append(due, user)
+		}
+	}
+	users.mu.Unlock()
+
+	for _, user := range due {
+		deleteAccount(user)
+	}
+	return len(due)
+}
+
+// deleteAccount erases a user. Sessions they created outside any
+// workspace are purged; sessions in a workspace belong to the workspace and
+// are kept with the user's name taken off them. Workspaces left without
+// members are removed along with their sessions and webhooks, and a
+// workspace left without an owner passes to its longest-standing member.
+// Audit entries are kept as security records, under the user's ID only.
+func deleteAccount(user *User) {
+	removed := make(map[string]bool)
+
+	workspaces.mu.Lock()
+	for id, ws := range workspaces.Workspaces {
+		if _, ok := ws.Members[user.ID]; !ok {
+			continue
+		}
+		delete(ws.Members, user.ID)
+		if len(ws.Members) == 0 {
+			removed[id] = true
+			delete(workspaces.Workspaces, id)
+			continue
+		}
+		if ws.owners() == 0 {
+			var heir *Membership
+			for _, member := range ws.Members {
+				if heir == nil || member.JoinedAt < heir.JoinedAt {
+					heir = member
+				}
+			}
+			heir.Role, heir.Managed = RoleOwner, false
+			audit.Record(ActorSystem, "workspace.role", "user", heir.UserID, "", gin.H{"workspaceId": id, "to": RoleOwner, "reason": "owner deleted"})
+		}
+	}
+	for hash, invitation := range workspaces.invitations {
+		if invitation.Email == user.Email || removed[invitation.WorkspaceID] {
+			delete(workspaces.invitations, hash)
+		} else if invitation.InvitedBy == user.ID {
+			invitation.InvitedBy = ""
+		}
+	}
+	workspaces.mu.Unlock()
+
+	purged, anonymized := 0, 0
+	store.mu.Lock()
+	for _, session := range store.Sessions {
+		session.mu.Lock()
+		switch {
+		case removed[session.WorkspaceID],
+			session.CreatedBy == user.ID && session.WorkspaceID == "":
+			purgeSession(session)
+			purged++
+		case session.CreatedBy == user.ID:
+			session.CreatedBy = ""
+			if strings.EqualFold(session.Owner, user.Email) {
+				session.Owner = ""
+			}
+			anonymized++
+		}
+		session.mu.Unlock()
+	}
+	store.mu.Unlock()
+
+	webhooks.mu.Lock()
+	for id, hook := range webhooks.Webhooks {
+		if removed[hook.WorkspaceID] {
+			delete(webhooks.Webhooks, id)
+			delete(webhooks.Deliveries, id)
+		}
+	}
+	webhooks.mu.Unlock()
+
+	meter.mu.Lock()
+	delete(meter.users, user.ID)
+	for id := range removed {
+		delete(meter.workspaces, id)
+	}
+	meter.mu.Unlock()
+
+	users.mu.Lock()
+	for hash, grant := range users.tokens {
+		if grant.user == user {
+			delete(users.tokens, hash)
+		}
+	}
+	for key, linked := range users.identities {
+		if linked == user {
+			delete(users.identities, key)
+		}
+	}
+	delete(users.byEmail, user.Email)
+	delete(users.Users, user.ID)
+	users.mu.Unlock()
+
+	favorites.forgetUser(user.ID)
+	notifications.forgetUser(user.ID)
+	emailPreferences.forgetUser(user.ID)
+	calendars.forgetUser(user.ID)
+	templates.forgetUser(user.ID, removed)
+	guides.forgetUser(user.ID, removed)
+	comments.forgetAuthor(user.ID)
+	sessionHistory.forgetAuthor(user.ID)
+	guideHistory.forgetAuthor(user.ID)
+	exports.prune(getCurrentTimestamp(), user.ID)
+	guideExports.prune(getCurrentTimestamp(), user.ID)
+
+	audit.Record(ActorSystem, "user.delete", "user", user.ID, "", gin.H{
+		"sessionsPurged":     purged,
+		"sessionsAnonymized": anonymized,
+		"workspacesRemoved":  len(removed),
+	})
+}
@@ -0,0 +1,246 @@
+package tango
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EncodingText    = "text"
+	EncodingBase64  = "base64"
+	EncodingDataURL = "data-url"
+)
+
+// InboundMessage is a frame received from a client. Frames that are not a
+// JSON envelope are treated as legacy screen_data carrying raw text.
+type InboundMessage struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+	raw     []byte
+}
+
+type ScreenData struct {
+	Encoding string `json:"encoding"`
+	Data     string `json:"data"`
+	Frame    string `json:"frame,omitempty"`
+	Seq      int64  `json:"seq,omitempty"`
+}
+
+func decodeInbound(frame []byte) InboundMessage {
+	trimmed := bytes.TrimSpace(frame)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var msg InboundMessage
+		if err := json.Unmarshal(trimmed, &msg); err == nil && msg.Type != "" {
+			msg.raw = frame
+			return msg
+		}
+	}
+	return InboundMessage{Type: "screen_data", raw: frame}
+}
+
+// screenData extracts and validates a screen_data payload against its
+// declared encoding.
+func (m InboundMessage) screenData() (ScreenData, error) {
+	if m.Payload == nil {
+		if !utf8.Valid(m.raw) {
+			return ScreenData{}, errors.New("raw frames must be valid UTF-8 text")
+		}
+		return ScreenData{Encoding: EncodingText, Data: string(m.raw)}, nil
+	}
+
+	var data ScreenData
+	if err := json.Unmarshal(m.Payload, &data); err != nil {
+		return ScreenData{}, errors.New("screen_data payload must be an object with encoding and data")
+	}
+	if data.Encoding == "" {
+		data.Encoding = EncodingText
+	}
+	if data.Frame != FrameFull && data.Frame != FrameKey && data.Frame != FrameDelta {
+		return ScreenData{}, errors.New("frame must be key or delta")
+	}
+
+	switch data.Encoding {
+	case EncodingText:
+		if !utf8.ValidString(data.Data) {
+			return ScreenData{}, errors.New("text data must be valid UTF-8")
+		}
+	case EncodingBase64, EncodingE2EE:
+		if _, err := base64.StdEncoding.DecodeString(data.Data); err != nil {
+			return ScreenData{}, errors.New("data is not valid base64")
+		}
+	case EncodingDataURL:
+		comma := strings.IndexByte(data.Data, ',')
+		if !strings.HasPrefix(data.Data, "data:") || comma < 0 || !strings.HasSuffix(data.Data[:comma], ";base64") {
+			return ScreenData{}, errors.New("data is not a base64 data URL")
+		}
+		if _, err := base64.StdEncoding.DecodeString(data.Data[comma+1:]); err != nil {
+			return ScreenData{}, errors.New("data URL body is not valid base64")
+		}
+	default:
+		return ScreenData{}, errors.New("unsupported encoding " + data.Encoding)
+	}
+	return data, nil
+}
+
+// sendError reports a protocol problem to client without closing the
+// connection.
+func sendError(client *Client, code, message string) {
+	client.send(Message{
+		Type: "error",
+		Payload: gin.H{
+			"code":    code,
+			"message": message,
+		},
+	})
+}
+
+// inboundMessageTypes lists the frame types clients may send, as advertised
+// by /api/v1/server-info.
+var inboundMessageTypes = []string{
+	"join",
+	"screen_data",
+	"cursor",
+	"annotation",
+	"annotation_clear",
+	"reaction",
+	"raise_hand",
+	"control_request",
+	"control_grant",
+	"control_deny",
+	"control_revoke",
+	"control_release",
+	"input",
+	"webrtc_offer",
+	"webrtc_answer",
+	"webrtc_ice",
+	"sfu_publish",
+	"sfu_subscribe",
+	"set_quality",
+	"ack",
+	"resend",
+	"edit_join",
+	"edit_leave",
+	"edit_focus",
+	"edit_op",
+	"edit_tags",
+	"edit_lock",
+	"edit_unlock",
+	"waiting_admit",
+	"waiting_reject",
+	"poll_create",
+	"poll_vote",
+	"poll_close",
+	"qa_ask",
+	"qa_upvote",
+	"qa_moderate",
+	"caption",
+	"e2ee_key",
+	"e2ee_key_share",
+}
+
+// handleInbound dispatches a client frame by type.
+func handleInbound(client *Client, session *Session, span *Span, msg InboundMessage) {
+	span.SetAttr("message.type", msg.Type)
+
+	switch msg.Type {
+	case "screen_data":
+		if session.SFU {
+			sendError(client, "sfu_enabled", errSFUScreenData.Error())
+			return
+		}
+		data, err := msg.screenData()
+		if err != nil {
+			span.SetError(err)
+			sendError(client, "invalid_payload", err.Error())
+			return
+		}
+
+		if session.E2EE != (data.Encoding == EncodingE2EE) {
+			err := errE2EEFrames
+			if !session.E2EE {
+				err = errPlaintextFrame
+			}
+			span.SetError(err)
+			sendError(client, "invalid_payload", err.Error())
+			return
+		}
+		if err := relayFrame(span, session, client, data); err != nil {
+			span.SetError(err)
+			sendError(client, "invalid_delta", err.Error())
+		}
+	case "set_quality":
+		handleSetQuality(client, session, msg)
+	case "ack":
+		handleAck(client, session, msg)
+	case "resend":
+		handleResend(client, session, msg)
+	case "annotation":
+		handleAnnotation(client, session, span, msg)
+	case "annotation_clear":
+		handleAnnotationClear(client, session, span)
+	case "reaction":
+		handleReaction(client, session, msg)
+	case "raise_hand":
+		handleRaiseHand(client, session, span, msg)
+	case "control_request":
+		handleControlRequest(client, session)
+	case "control_grant":
+		handleControlAnswer(client, session, msg, true)
+	case "control_deny":
+		handleControlAnswer(client, session, msg, false)
+	case "control_revoke", "control_release":
+		handleControlRevoke(client, session)
+	case "sfu_publish", "sfu_subscribe":
+		handleSFUNegotiation(client, session, span, msg)
+	case "webrtc_offer", "webrtc_answer", "webrtc_ice":
+		handleSignal(client, session, span, msg)
+	case "edit_join":
+		handleEditJoin(client, session)
+	case "edit_leave":
+		handleEditLeave(client, session)
+	case "edit_focus":
+		handleEditFocus(client, session, msg)
+	case "edit_op":
+		handleEditOp(client, session, msg)
+	case "edit_tags":
+		handleEditTags(client, session, msg)
+	case "edit_lock":
+		handleEditLock(client, session, msg, true)
+	case "edit_unlock":
+		handleEditLock(client, session, msg, false)
+	case "waiting_admit":
+		handleWaitingAnswer(client, session, msg, true)
+	case "waiting_reject":
+		handleWaitingAnswer(client, session, msg, false)
+	case "poll_create":
+		handlePollCreate(client, session, span, msg)
+	case "poll_vote":
+		handlePollVote(client, session, msg)
+	case "poll_close":
+		handlePollClose(client, session, span, msg)
+	case "qa_ask":
+		handleQuestionAsk(client, session, span, msg)
+	case "qa_upvote":
+		handleQuestionUpvote(client, session, span, msg)
+	case "qa_moderate":
+		handleQuestionModerate(client, session, span, msg)
+	case "caption":
+		handleCaption(client, session, span, msg)
+	case "chat":
+		handleChat(client, session, span, msg)
+	case "e2ee_key":
+		handleE2EEKey(client, session, span, msg)
+	case "e2ee_key_share":
+		handleE2EEKeyShare(client, session, span, msg)
+	case "join":
+		sendError(client, "already_joined", "The join handshake has already completed")
+	default:
+		sendError(client, "unknown_type", "Unknown message type: "+msg.Type)
+	}
+}
@@ -0,0 +1,285 @@
+package tango
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// protobufCodec encodes envelopes as the message below, with payloads using
+// the well-known google.protobuf.Value so any generated client can decode
+// them without a tango-specific schema per message type:
+//
+//	message Envelope {
+//	  string type = 1;
+//	  google.protobuf.Value payload = 2;
+//	  int64 seq = 3;
+//	}
+//
+// Binary data has no Value representation and is sent as a base64 string,
+// matching the JSON encoding.
+type protobufCodec struct{}
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+// google.protobuf.Value field numbers.
+const (
+	valueNull   = 1
+	valueNumber = 2
+	valueString = 3
+	valueBool   = 4
+	valueStruct = 5
+	valueList   = 6
+)
+
+func (protobufCodec) Encode(dst []byte, message Message) ([]byte, error) {
+	payload, err := genericValue(message.Payload)
+	if err != nil {
+		return dst, err
+	}
+	b := appendProtoString(dst, 1, message.Type)
+	value, err := appendProtoValue(nil, payload)
+	if err != nil {
+		return dst, err
+	}
+	b = appendProtoBytes(b, 2, value)
+	if message.Seq != 0 {
+		b = appendProtoTag(b, 3, protoVarint)
+		b = appendUvarint(b, uint64(message.Seq))
+	}
+	return b, nil
+}
+
+func (protobufCodec) Decode(frame []byte) (InboundMessage, error) {
+	envelope := map[string]interface{}{}
+	err := walkProto(frame, func(field int, wire int, data []byte, _ uint64) error {
+		switch {
+		case field == 1 && wire == protoBytes:
+			envelope["type"] = string(data)
+		case field == 2 && wire == protoBytes:
+			value, err := decodeProtoValue(data, 0)
+			if err != nil {
+				return err
+			}
+			envelope["payload"] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return InboundMessage{}, err
+	}
+	return binaryInbound(envelope, frame)
+}
+
+func (protobufCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func appendProtoTag(b []byte, field, wire int) []byte {
+	return appendUvarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendProtoValue(b []byte, v interface{}) ([]byte, error) {
+	switch value := v.(type) {
+	case nil:
+		b = appendProtoTag(b, valueNull, protoVarint)
+		return append(b, 0), nil
+	case bool:
+		b = appendProtoTag(b, valueBool, protoVarint)
+		if value {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case int64:
+		return appendProtoNumber(b, float64(value)), nil
+	case uint64:
+		return appendProtoNumber(b, float64(value)), nil
+	case float64:
+		return appendProtoNumber(b, value), nil
+	case string:
+		return appendProtoString(b, valueString, value), nil
+	case []byte:
+		return appendProtoString(b, valueString, base64.StdEncoding.EncodeToString(value)), nil
+	case []interface{}:
+		var list []byte
+		for _, item := range value {
+			encoded, err := appendProtoValue(nil, item)
+			if err != nil {
+				return nil, err
+			}
+			list = appendProtoBytes(list, 1, encoded)
+		}
+		return appendProtoBytes(b, valueList, list), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var fields []byte
+		for _, k := range keys {
+			encoded, err := appendProtoValue(nil, value[k])
+			if err != nil {
+				return nil, err
+			}
+			entry := appendProtoString(nil, 1, k)
+			entry = appendProtoBytes(entry, 2, encoded)
+			fields = appendProtoBytes(fields, 1, entry)
+		}
+		return appendProtoBytes(b, valueStruct, fields), nil
+	}
+	return nil, fmt.Errorf("protobuf: cannot encode %T", v)
+}
+
+func appendProtoNumber(b []byte, n float64) []byte {
+	b = appendProtoTag(b, valueNumber, protoFixed64)
+	bits := math.Float64bits(n)
+	return append(b, byte(bits), byte(bits>>8), byte(bits>>16), byte(bits>>24),
+		byte(bits>>32), byte(bits>>40), byte(bits>>48), byte(bits>>56))
+}
+
+var errProtoShort = errors.New("protobuf: unexpected end of data")
+
+// walkProto calls fn for each field in data. Length-delimited fields get
+// their bytes; varint and fixed64 fields get their raw value.
+func walkProto(data []byte, fn func(field, wire int, value []byte, n uint64) error) error {
+	for len(data) > 0 {
+		tag, size := binary.Uvarint(data)
+		if size <= 0 {
+			return errProtoShort
+		}
+		data = data[size:]
+		field, wire := int(tag>>3), int(tag&7)
+
+		var value []byte
+		var n uint64
+		switch wire {
+		case protoVarint:
+			n, size = binary.Uvarint(data)
+			if size <= 0 {
+				return errProtoShort
+			}
+			data = data[size:]
+		case protoFixed64:
+			if len(data) < 8 {
+				return errProtoShort
+			}
+			n = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case protoBytes:
+			length, size := binary.Uvarint(data)
+			if size <= 0 || uint64(len(data)-size) < length {
+				return errProtoShort
+			}
+			value = data[size : size+int(length)]
+			data = data[size+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return errProtoShort
+			}
+			n = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", wire)
+		}
+
+		if err := fn(field, wire, value, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeProtoValue(data []byte, depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("protobuf: nesting too deep")
+	}
+
+	var result interface{}
+	err := walkProto(data, func(field, wire int, value []byte, n uint64) error {
+		switch field {
+		case valueNull:
+			result = nil
+		case valueNumber:
+			result = math.Float64frombits(n)
+		case valueString:
+			result = string(value)
+		case valueBool:
+			result = n != 0
+		case valueStruct:
+			fields := map[string]interface{}{}
+			err := walkProto(value, func(field, wire int, entry []byte, _ uint64) error {
+				if field != 1 || wire != protoBytes {
+					return nil
+				}
+				var key string
+				var item interface{}
+				err := walkProto(entry, func(field, wire int, data []byte, _ uint64) error {
+					if wire != protoBytes {
+						return nil
+					}
+					switch field {
+					case 1:
+						key = string(data)
+					case 2:
+						decoded, err := decodeProtoValue(data, depth+1)
+						if err != nil {
+							return err
+						}
+						item = decoded
+					}
+					return nil
+				})
+				fields[key] = item
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			result = fields
+		case valueList:
+			list := []interface{}{}
+			err := walkProto(value, func(field, wire int, data []byte, _ uint64) error {
+				if field != 1 || wire != protoBytes {
+					return nil
+				}
+				item, err := decodeProtoValue(data, depth+1)
+				list = append(list, item)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			result = list
+		}
+		return nil
+	})
+	return result, err
+}
+
+func appendUvarint(b []byte, n uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], n)]...)
+}
@@ -0,0 +1,189 @@
+package tango
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PublishKafka = "kafka"
+	PublishNATS  = "nats"
+
+	publishQueueSize       = 1024
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+)
+
+// PublishedEvent is the schema of every event published to Kafka or NATS: a
+// CloudEvents 1.0 envelope in structured mode. Type is the webhook event
+// name, Subject the session it concerns, and Data the webhook payload.
+type PublishedEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            string      `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// eventPublisher sends encoded events to a broker. Publish returns once the
+// broker has the event; key picks the partition where there are any, so a
+// session's events stay in order.
+type eventPublisher interface {
+	Publish(ctx context.Context, key string, event []byte) error
+	Close() error
+}
+
+type publishJob struct {
+	event string
+	key   string
+	body  []byte
+}
+
+// publisher hands lifecycle events to the configured broker from a queue,
+// so emitting an event never waits on the network. Events are dropped
+// rather than queued without bound while the broker is unreachable.
+var publisher struct {
+	sink   eventPublisher
+	events map[string]bool
+	queue  chan publishJob
+	stop   chan struct{}
+	done   chan struct{}
+
+	published int64
+	failed    int64
+	dropped   int64
+}
+
+func startPublisher(cfg PublishConfig) error {
+	var sink eventPublisher
+	var err error
+	switch cfg.Driver {
+	case "":
+		return nil
+	case PublishNATS:
+		sink = newNATSPublisher(cfg)
+	case PublishKafka:
+		sink, err = newKafkaPublisher(cfg)
+	default:
+		err = fmt.Errorf("unknown publish driver %q", cfg.Driver)
+	}
+	if err != nil {
+		return err
+	}
+
+	publisher.sink = sink
+	publisher.events = make(map[string]bool)
+	for _, event := range cfg.Events {
+		publisher.events[event] = true
+	}
+	publisher.queue = make(chan publishJob, publishQueueSize)
+	publisher.stop = make(chan struct{})
+	publisher.done = make(chan struct{})
+	go runPublisher()
+	return nil
+}
+
+// publishEvent queues event for the broker if publishing is on and the
+// event is one of those configured, or any event when none are.
+func publishEvent(event string, payload interface{}) {
+	if publisher.queue == nil || len(publisher.events) > 0 && !publisher.events[event] {
+		return
+	}
+	sessionID := eventSessionID(payload)
+	body, err := json.Marshal(PublishedEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              generateID(),
+		Source:          "tango",
+		Type:            event,
+		Subject:         sessionID,
+		Time:            time.Now().UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            payload,
+	})
+	if err != nil {
+		logger.Error("encoding published event failed", "event", event, "error", err)
+		return
+	}
+
+	select {
+	case publisher.queue <- publishJob{event: event, key: sessionID, body: body}:
+	default:
+		atomic.AddInt64(&publisher.dropped, 1)
+		logger.Warn("publish queue full, dropping event", "event", event)
+	}
+}
+
+func runPublisher() {
+	defer close(publisher.done)
+	for {
+		select {
+		case job := <-publisher.queue:
+			deliverPublished(job)
+		case <-publisher.stop:
+			for {
+				select {
+				case job := <-publisher.queue:
+					deliverPublished(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliverPublished sends job, retrying with the same backoff as outbound
+// HTTP calls.
+func deliverPublished(job publishJob) {
+	var err error
+	for attempt := 1; attempt <= outboundMaxAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), outboundTimeout)
+		err = publisher.sink.Publish(ctx, job.key, job.body)
+		cancel()
+		if err == nil {
+			atomic.AddInt64(&publisher.published, 1)
+			return
+		}
+		if attempt < outboundMaxAttempts {
+			time.Sleep(backoff(attempt))
+		}
+	}
+	atomic.AddInt64(&publisher.failed, 1)
+	logger.Error("publishing event failed", "event", job.event, "error", err)
+}
+
+// stopPublisher delivers the events still queued, until ctx is done, and
+// closes the broker connection.
+func stopPublisher(ctx context.Context) {
+	if publisher.queue == nil {
+		return
+	}
+	close(publisher.stop)
+	select {
+	case <-publisher.done:
+	case <-ctx.Done():
+		logger.Warn("publish queue not drained", "events", len(publisher.queue))
+	}
+	publisher.sink.Close()
+}
+
+func getPublisherStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"driver":    config.Publish.Driver,
+		"topic":     config.Publish.Topic,
+		"events":    config.Publish.Events,
+		"queued":    len(publisher.queue),
+		"published": atomic.LoadInt64(&publisher.published),
+		"failed":    atomic.LoadInt64(&publisher.failed),
+		"dropped":   atomic.LoadInt64(&publisher.dropped),
+	})
+}
@@ -0,0 +1,411 @@
+package tango
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Session search queries combine field comparisons with AND, OR, NOT and
+// parentheses, e.g. `participants>10 AND createdAt<2024-01-01 AND
+// org:acme`. Fields are resolved against a fixed whitelist, so queries
+// cannot reach anything the list endpoint would not already return. Queries
+// are capped in length and nesting, so parsing one is cheap.
+
+const (
+	maxQueryLength = 1024
+	maxQueryDepth  = 16
+)
+
+type QueryError struct {
+	Pos   int
+	Token string
+	Msg   string
+}
+
+func (e *QueryError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("query error at position %d: %s", e.Pos, e.Msg)
+	}
+	return fmt.Sprintf("query error at position %d near %q: %s", e.Pos, e.Token, e.Msg)
+}
+
+type queryToken struct {
+	kind string
+	text string
+	pos  int
+}
+
+const (
+	tokWord   = "word"
+	tokOp     = "op"
+	tokLParen = "("
+	tokRParen = ")"
+	tokEOF    = "eof"
+)
+
+func lexQuery(input string) ([]queryToken, error) {
+	var tokens []queryToken
+	i := 0
+	for i < len(input) {
+		ch := rune(input[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case ch == '(' || ch == ')':
+			tokens = append(tokens, queryToken{kind: string(ch), text: string(ch), pos: i})
+			i++
+		case strings.ContainsRune(":=!<>", ch):
+			start := i
+			i++
+			if i < len(input) && input[i] == '=' && ch != ':' && ch != '=' {
+				i++
+			}
+			op := input[start:i]
+			if op == "!" {
+				return nil, &QueryError{Pos: start, Token: op, Msg: "expected !="}
+			}
+			tokens = append(tokens, queryToken{kind: tokOp, text: op, pos: start})
+		case ch == '"':
+			start := i
+			i++
+			var b strings.Builder
+			for i < len(input) && input[i] != '"' {
+				b.WriteByte(input[i])
+				i++
+			}
+			if i >= len(input) {
+				return nil, &QueryError{Pos: start, Token: input[start:], Msg: "unterminated string"}
+			}
+			i++
+			tokens = append(tokens, queryToken{kind: tokWord, text: b.String(), pos: start})
+		default:
+			start := i
+			for i < len(input) && !unicode.IsSpace(rune(input[i])) && !strings.ContainsRune(`():=!<>"`, rune(input[i])) {
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: tokWord, text: input[start:i], pos: start})
+		}
+	}
+	return append(tokens, queryToken{kind: tokEOF, pos: len(input)}), nil
+}
+
+type queryFieldKind int
+
+const (
+	fieldString queryFieldKind = iota
+	fieldNumber
+	fieldTime
+	// fieldOrg compares the name of the session's workspace.
+	fieldOrg
+)
+
+// sessionQueryFields maps each searchable field to its type. Fields under
+// metadata.<key> are handled separately as strings.
+var sessionQueryFields = map[string]queryFieldKind{
+	"id":           fieldString,
+	"name":         fieldString,
+	"status":       fieldString,
+	"externalId":   fieldString,
+	"externalRef":  fieldString,
+	"owner":        fieldString,
+	"collectionId": fieldString,
+	"workspaceId":  fieldString,
+	"org":          fieldOrg,
+	"participants": fieldNumber,
+	"createdAt":    fieldTime,
+	"endedAt":      fieldTime,
+}
+
+type SessionQuery interface {
+	Match(s *Session) bool
+}
+
+type queryAnd struct{ left, right SessionQuery }
+type queryOr struct{ left, right SessionQuery }
+type queryNot struct{ inner SessionQuery }
+
+type queryCompare struct {
+	field  string
+	op     string
+	kind   queryFieldKind
+	text   string
+	number float64
+	// orgs holds the IDs of the workspaces whose names match, resolved
+	// when the query is parsed so matching needs no workspace lookups.
+	// The empty ID stands for sessions outside any workspace.
+	orgs map[string]bool
+}
+
+func (q queryAnd) Match(s *Session) bool { return q.left.Match(s) && q.right.Match(s) }
+func (q queryOr) Match(s *Session) bool  { return q.left.Match(s) || q.right.Match(s) }
+func (q queryNot) Match(s *Session) bool { return !q.inner.Match(s) }
+
+func (q queryCompare) Match(s *Session) bool {
+	switch q.kind {
+	case fieldNumber, fieldTime:
+		return compareNumbers(sessionNumberField(s, q.field), q.op, q.number)
+	case fieldOrg:
+		return q.orgs[s.WorkspaceID]
+	}
+	return q.matchString(sessionStringField(s, q.field))
+}
+
+func (q queryCompare) matchString(value string) bool {
+	switch q.op {
+	case ":":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(q.text))
+	case "=":
+		return value == q.text
+	case "!=":
+		return value != q.text
+	}
+	return compareStrings(value, q.op, q.text)
+}
+
+func compareNumbers(a float64, op string, b float64) bool {
+	switch op {
+	case ":", "=":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
+
+func compareStrings(a, op, b string) bool {
+	switch op {
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
+
+func sessionStringField(s *Session, field string) string {
+	if strings.HasPrefix(field, metadataQueryPrefix) {
+		return s.Metadata[strings.TrimPrefix(field, metadataQueryPrefix)]
+	}
+	switch field {
+	case "id":
+		return s.ID
+	case "name":
+		return s.Name
+	case "status":
+		return s.Status
+	case "externalId":
+		return s.ExternalID
+	case "externalRef":
+		return s.ExternalRef
+	case "owner":
+		return s.Owner
+	case "collectionId":
+		return s.CollectionID
+	case "workspaceId":
+		return s.WorkspaceID
+	}
+	return ""
+}
+
+// sessionNumberField reads numeric fields. Callers must hold s.mu.
+func sessionNumberField(s *Session, field string) float64 {
+	switch field {
+	case "participants":
+		return float64(len(s.Clients))
+	case "createdAt":
+		return float64(s.CreatedAt)
+	case "endedAt":
+		return float64(s.EndedAt)
+	}
+	return 0
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	depth  int
+}
+
+func ParseSessionQuery(input string) (SessionQuery, error) {
+	if len(input) > maxQueryLength {
+		return nil, &QueryError{Pos: maxQueryLength, Msg: fmt.Sprintf("query is longer than %d bytes", maxQueryLength)}
+	}
+	tokens, err := lexQuery(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, &QueryError{Pos: tok.pos, Token: tok.text, Msg: "unexpected token"}
+	}
+	return q, nil
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *queryParser) keyword(word string) bool {
+	tok := p.peek()
+	if tok.kind == tokWord && strings.EqualFold(tok.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// enter counts a level of nesting, by NOT or parentheses, and refuses to go
+// deeper than maxQueryDepth. The caller leaves it again with p.depth--.
+func (p *queryParser) enter(tok queryToken) error {
+	if p.depth++; p.depth > maxQueryDepth {
+		return &QueryError{Pos: tok.pos, Token: tok.text, Msg: fmt.Sprintf("query is nested more than %d levels deep", maxQueryDepth)}
+	}
+	return nil
+}
+
+func (p *queryParser) parseOr() (SessionQuery, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = queryOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (SessionQuery, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = queryAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseUnary() (SessionQuery, error) {
+	if tok := p.peek(); p.keyword("NOT") {
+		if err := p.enter(tok); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		p.depth--
+		return queryNot{inner}, nil
+	}
+
+	if p.peek().kind == tokLParen {
+		open := p.next()
+		if err := p.enter(open); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.depth--
+		if p.peek().kind != tokRParen {
+			return nil, &QueryError{Pos: open.pos, Token: "(", Msg: "unclosed parenthesis"}
+		}
+		p.next()
+		return inner, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseComparison() (SessionQuery, error) {
+	field := p.next()
+	if field.kind != tokWord {
+		return nil, &QueryError{Pos: field.pos, Token: field.text, Msg: "expected field name"}
+	}
+
+	kind, known := sessionQueryFields[field.text]
+	if !known && !strings.HasPrefix(field.text, metadataQueryPrefix) {
+		return nil, &QueryError{Pos: field.pos, Token: field.text, Msg: "unknown field"}
+	}
+
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, &QueryError{Pos: op.pos, Token: op.text, Msg: "expected operator after " + field.text}
+	}
+
+	value := p.next()
+	if value.kind != tokWord {
+		return nil, &QueryError{Pos: value.pos, Token: value.text, Msg: "expected value"}
+	}
+
+	cmp := queryCompare{field: field.text, op: op.text, kind: kind, text: value.text}
+	switch kind {
+	case fieldNumber:
+		n, err := strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			return nil, &QueryError{Pos: value.pos, Token: value.text, Msg: "expected a number"}
+		}
+		cmp.number = n
+	case fieldTime:
+		t, err := parseQueryTime(value.text)
+		if err != nil {
+			return nil, &QueryError{Pos: value.pos, Token: value.text, Msg: "expected a date (YYYY-MM-DD), RFC 3339 time or unix timestamp"}
+		}
+		cmp.number = float64(t)
+	case fieldOrg:
+		cmp.orgs = workspaces.matchingNames(cmp.matchString)
+		cmp.orgs[""] = cmp.matchString("")
+	}
+	return cmp, nil
+}
+
+func parseQueryTime(value string) (int64, error) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
@@ -0,0 +1,314 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	QuestionPending   = "pending"
+	QuestionApproved  = "approved"
+	QuestionAnswered  = "answered"
+	QuestionDismissed = "dismissed"
+
+	maxQuestionBytes       = 500
+	maxQuestionsPerSession = 500
+)
+
+var (
+	errQuestionNotFound = errors.New("question not found")
+	errTooManyQuestions = fmt.Errorf("a session can have at most %d questions", maxQuestionsPerSession)
+)
+
+// Questions go through a moderated queue: viewers' questions wait for a
+// host to approve them before the session sees them, while hosts' own are
+// approved at once. Approved questions can be upvoted, once per voter, and
+// are later marked answered or dismissed.
+
+type Question struct {
+	ID         string `json:"id"`
+	Text       string `json:"text"`
+	ClientID   string `json:"clientId"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Upvotes    int    `json:"upvotes"`
+	AskedAt    int64  `json:"askedAt"`
+	AnsweredAt int64  `json:"answeredAt,omitempty"`
+
+	upvoters map[string]bool
+}
+
+// visible reports whether everyone in the session sees the question, not
+// just hosts and whoever asked it.
+func (q *Question) visible() bool {
+	return q.Status == QuestionApproved || q.Status == QuestionAnswered
+}
+
+func (q *Question) snapshot() Question {
+	snapshot := *q
+	snapshot.upvoters = nil
+	return snapshot
+}
+
+// QuestionBoard keeps each session's questions, oldest first.
+type QuestionBoard struct {
+	questions map[string][]*Question
+	mu        sync.Mutex
+}
+
+var questions = &QuestionBoard{questions: make(map[string][]*Question)}
+
+func (b *QuestionBoard) add(sessionID string, question *Question) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.questions[sessionID]) >= maxQuestionsPerSession {
+		return errTooManyQuestions
+	}
+	b.questions[sessionID] = append(b.questions[sessionID], question)
+	return nil
+}
+
+// find returns a session's question. Callers must hold b.mu.
+func (b *QuestionBoard) find(sessionID, questionID string) *Question {
+	for _, question := range b.questions[sessionID] {
+		if question.ID == questionID {
+			return question
+		}
+	}
+	return nil
+}
+
+// upvote adds or takes back voter's upvote and reports whether the count
+// changed.
+func (b *QuestionBoard) upvote(sessionID, questionID, voter string, upvoted bool) (Question, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	question := b.find(sessionID, questionID)
+	if question == nil || question.Status != QuestionApproved {
+		return Question{}, false, errQuestionNotFound
+	}
+	if question.upvoters[voter] == upvoted {
+		return question.snapshot(), false, nil
+	}
+	if upvoted {
+		question.upvoters[voter] = true
+		question.Upvotes++
+	} else {
+		delete(question.upvoters, voter)
+		question.Upvotes--
+	}
+	return question.snapshot(), true, nil
+}
+
+// moderate moves a question to status and returns it as it was and is.
+func (b *QuestionBoard) moderate(sessionID, questionID, status string) (Question, Question, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	question := b.find(sessionID, questionID)
+	if question == nil {
+		return Question{}, Question{}, errQuestionNotFound
+	}
+	before := question.snapshot()
+	question.Status = status
+	if status == QuestionAnswered {
+		question.AnsweredAt = getCurrentTimestamp()
+	}
+	return before, question.snapshot(), nil
+}
+
+// List returns a session's questions. Unless all is set, only those the
+// whole session sees are included.
+func (b *QuestionBoard) List(sessionID string, all bool) []Question {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := []Question{}
+	for _, question := range b.questions[sessionID] {
+		if all || question.visible() {
+			list = append(list, question.snapshot())
+		}
+	}
+	return list
+}
+
+func (b *QuestionBoard) Forget(sessionID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.questions, sessionID)
+}
+
+// announceQuestion sends a new or changed question to everyone when it is
+// or was visible, and otherwise only to hosts and whoever asked it.
+func announceQuestion(span *Span, session *Session, question Question, wasVisible bool) {
+	msg := Message{Type: "qa_question", Payload: question}
+	if wasVisible || question.visible() {
+		broadcastToSession(span, session.ID, msg, "")
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	sendToHosts(session, msg)
+	if asker, ok := session.Clients[question.ClientID]; ok && !isHost(asker) {
+		deliver(asker, msg)
+	}
+}
+
+func handleQuestionAsk(client *Client, session *Session, span *Span, msg InboundMessage) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		sendError(client, "invalid_payload", "qa_ask payload must be an object with text")
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" || len(req.Text) > maxQuestionBytes {
+		sendError(client, "invalid_payload", fmt.Sprintf("questions must be 1-%d bytes", maxQuestionBytes))
+		return
+	}
+
+	session.mu.Lock()
+	host := isHost(client)
+	session.mu.Unlock()
+	question := &Question{
+		ID:       generateID(),
+		Text:     req.Text,
+		ClientID: client.ID,
+		Name:     client.Name,
+		Status:   QuestionPending,
+		AskedAt:  getCurrentTimestamp(),
+		upvoters: make(map[string]bool),
+	}
+	if host {
+		question.Status = QuestionApproved
+	}
+	if err := questions.add(session.ID, question); err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	announceQuestion(span, session, question.snapshot(), false)
+}
+
+func handleQuestionUpvote(client *Client, session *Session, span *Span, msg InboundMessage) {
+	var req struct {
+		QuestionID string `json:"questionId"`
+		Upvoted    *bool  `json:"upvoted"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.QuestionID == "" {
+		sendError(client, "invalid_payload", "qa_upvote payload must be an object with questionId")
+		return
+	}
+	upvoted := req.Upvoted == nil || *req.Upvoted
+	question, changed, err := questions.upvote(session.ID, req.QuestionID, voterOf(client), upvoted)
+	if err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	if !changed {
+		return
+	}
+	broadcastToSession(span, session.ID, Message{
+		Type: "qa_upvotes",
+		Payload: gin.H{
+			"questionId": question.ID,
+			"upvotes":    question.Upvotes,
+		},
+	}, "")
+}
+
+var moderationStatuses = map[string]bool{
+	QuestionApproved:  true,
+	QuestionAnswered:  true,
+	QuestionDismissed: true,
+}
+
+func handleQuestionModerate(client *Client, session *Session, span *Span, msg InboundMessage) {
+	session.mu.Lock()
+	host := isHost(client)
+	session.mu.Unlock()
+	if !host {
+		sendError(client, "forbidden", "Only the host can moderate questions")
+		return
+	}
+
+	var req struct {
+		QuestionID string `json:"questionId"`
+		Status     string `json:"status"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.QuestionID == "" || !moderationStatuses[req.Status] {
+		sendError(client, "invalid_payload", "qa_moderate payload must be an object with questionId and a status of approved, answered or dismissed")
+		return
+	}
+	before, question, err := questions.moderate(session.ID, req.QuestionID, req.Status)
+	if err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	if before.Status == question.Status {
+		return
+	}
+	auditClient(client, "question."+question.Status, "question", question.ID, gin.H{"sessionId": session.ID})
+	announceQuestion(span, session, question, before.visible())
+}
+
+// sendQuestionSync brings a client that just joined up to date with the
+// questions it may see: all of them for hosts.
+func sendQuestionSync(client *Client, session *Session) {
+	session.mu.Lock()
+	host := isHost(client)
+	session.mu.Unlock()
+	list := questions.List(session.ID, host)
+	if len(list) == 0 {
+		return
+	}
+	client.send(Message{
+		Type: "qa_sync",
+		Payload: gin.H{
+			"sessionId": session.ID,
+			"questions": list,
+		},
+	})
+}
+
+// getQuestions lists a session's questions, most upvoted first, optionally
+// narrowed to one status, as JSON or, with format=csv, as a spreadsheet.
+func getQuestions(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	status := c.Query("status")
+	if status != "" && status != QuestionPending && !moderationStatuses[status] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, approved, answered or dismissed"})
+		return
+	}
+	list := []Question{}
+	for _, question := range questions.List(session.ID, true) {
+		if status == "" || question.Status == status {
+			list = append(list, question)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Upvotes > list[j].Upvotes })
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, gin.H{"questions": list})
+		return
+	}
+
+	rows := [][]string{{"question_id", "text", "name", "status", "upvotes", "asked_at", "answered_at"}}
+	for _, q := range list {
+		answeredAt := ""
+		if q.AnsweredAt != 0 {
+			answeredAt = strconv.FormatInt(q.AnsweredAt, 10)
+		}
+		rows = append(rows, []string{q.ID, q.Text, q.Name, q.Status, strconv.Itoa(q.Upvotes), strconv.FormatInt(q.AskedAt, 10), answeredAt})
+	}
+	writeCSV(c, "questions.csv", rows)
+}
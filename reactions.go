@@ -0,0 +1,142 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	reactionWindow = 5 * time.Second
+	// reactionMaxRate and handMaxRate bound how often one client may react
+	// or toggle its hand; extra frames are dropped without notice.
+	reactionMaxRate = 5
+	handMaxRate     = 2
+)
+
+var reactionEmoji = map[string]bool{
+	"👍": true, "👏": true, "❤️": true, "😂": true,
+	"😮": true, "🎉": true, "🤔": true, "👎": true,
+}
+
+// ReactionTally aggregates reactions per session so a busy session gets one
+// reactions frame per window instead of one frame per reaction.
+type ReactionTally struct {
+	counts map[string]map[string]int
+	mu     sync.Mutex
+}
+
+var reactions = &ReactionTally{counts: make(map[string]map[string]int)}
+
+func startReactionFlusher(window time.Duration) {
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		for range ticker.C {
+			reactions.flush(window)
+		}
+	}()
+}
+
+func (t *ReactionTally) Add(sessionID, emoji string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts, exists := t.counts[sessionID]
+	if !exists {
+		counts = make(map[string]int)
+		t.counts[sessionID] = counts
+	}
+	counts[emoji]++
+}
+
+func (t *ReactionTally) flush(window time.Duration) {
+	t.mu.Lock()
+	pending := t.counts
+	t.counts = make(map[string]map[string]int)
+	t.mu.Unlock()
+
+	for sessionID, counts := range pending {
+		broadcastToSession(nil, sessionID, Message{
+			Type: "reactions",
+			Payload: gin.H{
+				"counts":   counts,
+				"windowMs": window.Milliseconds(),
+			},
+		}, "")
+	}
+}
+
+func handleReaction(client *Client, session *Session, msg InboundMessage) {
+	if ok, _, _ := client.reactionLimiter.Allow(); !ok {
+		return
+	}
+
+	var req struct {
+		Emoji string `json:"emoji"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || !reactionEmoji[req.Emoji] {
+		sendError(client, "invalid_payload", "reaction payload must name a supported emoji")
+		return
+	}
+	reactions.Add(session.ID, req.Emoji)
+}
+
+// handleRaiseHand raises or lowers a hand. Clients change their own hand;
+// a host may also lower someone else's by naming their clientId.
+func handleRaiseHand(client *Client, session *Session, span *Span, msg InboundMessage) {
+	if ok, _, _ := client.handLimiter.Allow(); !ok {
+		return
+	}
+
+	var req struct {
+		Raised   bool   `json:"raised"`
+		ClientID string `json:"clientId"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		sendError(client, "invalid_payload", "raise_hand payload must be an object with raised")
+		return
+	}
+
+	session.mu.Lock()
+	target, err := handTarget(client, session, req.ClientID, req.Raised)
+	if err != nil {
+		session.mu.Unlock()
+		sendError(client, "forbidden", err.Error())
+		return
+	}
+	changed := target.HandRaised != req.Raised
+	target.HandRaised = req.Raised
+	session.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	broadcastToSession(span, session.ID, Message{
+		Type: "hand_raised",
+		Payload: gin.H{
+			"clientId": target.ID,
+			"raised":   req.Raised,
+			"by":       client.ID,
+		},
+	}, "")
+}
+
+// handTarget resolves whose hand a raise_hand frame changes. Callers must
+// hold session.mu.
+func handTarget(client *Client, session *Session, targetID string, raised bool) (*Client, error) {
+	if targetID == "" || targetID == client.ID {
+		return client, nil
+	}
+	if raised || !isHost(client) {
+		return nil, errors.New("only the host can lower another participant's hand")
+	}
+	target, exists := session.Clients[targetID]
+	if !exists {
+		return nil, errors.New("client is not in this session")
+	}
+	return target, nil
+}
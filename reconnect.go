@@ -0,0 +1,166 @@
+package tango
+
+import (
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	ClientConnected    = "connected"
+	ClientReconnecting = "reconnecting"
+)
+
+var errUnknownResume = errors.New("no client is waiting to be resumed with that id and token")
+
+// holdForReconnect keeps a disconnected client in its session for the grace
+// window instead of announcing that it left. It reports false when the
+// client should leave immediately: grace is disabled, the session no longer
+// takes joins, or the server is draining. Callers must hold session.mu.
+func holdForReconnect(client *Client, session *Session) bool {
+	grace := config.ReconnectGraceWindow()
+	if grace <= 0 || !session.acceptsJoins() || isDraining() || session.Clients[client.ID] != client {
+		return false
+	}
+
+	client.Status = ClientReconnecting
+	client.graceTimer = time.AfterFunc(grace, func() {
+		store.mu.Lock()
+		session.mu.Lock()
+		if client.Status != ClientReconnecting || session.Clients[client.ID] != client {
+			session.mu.Unlock()
+			store.mu.Unlock()
+			return
+		}
+		removeClient(client, session)
+		session.mu.Unlock()
+		store.mu.Unlock()
+
+		client.log.Debug("reconnect grace expired")
+		announceLeave(client, session)
+	})
+	return true
+}
+
+// resumeClient swaps conn, or events, in for the client's previous
+// connection. A client that is still marked connected is taken over, which
+// covers a reconnect that beats the server noticing the old socket is dead.
+// Callers must hold session.mu.
+func resumeClient(session *Session, join JoinRequest, conn *websocket.Conn, events *eventStream) (*Client, error) {
+	client, exists := session.Clients[join.ResumeClientID]
+	if !exists || subtle.ConstantTimeCompare([]byte(client.resumeToken), []byte(join.ResumeToken)) != 1 {
+		return nil, errUnknownResume
+	}
+
+	if client.graceTimer != nil {
+		client.graceTimer.Stop()
+		client.graceTimer = nil
+	}
+	client.connMu.Lock()
+	client.closeTransport()
+	client.Conn, client.events = conn, events
+	client.connMu.Unlock()
+	client.Status = ClientConnected
+	client.touch()
+	return client, nil
+}
+
+// removeClient drops client from the store. Callers must hold store.mu and
+// session.mu.
+func removeClient(client *Client, session *Session) {
+	delete(store.Clients, client.ID)
+	delete(session.Clients, client.ID)
+	passHost(session, client)
+	releaseControl(client, session)
+	leaveEditing(client, session)
+	if session.SFU {
+		go sfu.Leave(session.ID, client.ID)
+	}
+	if len(session.Clients) == 0 {
+		session.IdleSince = getCurrentTimestamp()
+		if session.AutoEnd {
+			endSession(session)
+		}
+	}
+}
+
+func announceLeave(client *Client, session *Session) {
+	emitEvent(EventClientLeft, gin.H{
+		"sessionId": session.ID,
+		"clientId":  client.ID,
+	})
+
+	broadcastToSession(nil, session.ID, Message{
+		Type: "client_left",
+		Payload: gin.H{
+			"clientId": client.ID,
+		},
+	}, "")
+}
+
+// resume takes a client back within its grace window over conn or events.
+// It returns the client with the session's current sequence number, or an
+// *admissionError or errUnknownResume.
+func resume(session *Session, join JoinRequest, conn *websocket.Conn, events *eventStream) (*Client, int64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if refusal := admit(session, true); refusal != nil {
+		return nil, 0, refusal
+	}
+	client, err := resumeClient(session, join, conn, events)
+	if err != nil {
+		return nil, 0, err
+	}
+	return client, session.stream.seq, nil
+}
+
+// resumeWebSocket completes a resume handshake on conn.
+func resumeWebSocket(c *gin.Context, session *Session, join JoinRequest, conn *websocket.Conn) {
+	client, seq, err := resume(session, join, conn, nil)
+	var refusal *admissionError
+	if errors.As(err, &refusal) {
+		refuseUpgraded(conn, session.ID, refusal)
+		return
+	}
+	if err != nil {
+		rejectHandshake(conn, err)
+		return
+	}
+	welcomeBack(c, session, client, seq)
+	go handleMessages(client, session, conn)
+}
+
+// welcomeBack sends a resumed client its session_joined and the session's
+// state, and tells the others it is back.
+func welcomeBack(c *gin.Context, session *Session, client *Client, seq int64) {
+	client.log.Debug("client resumed")
+
+	client.send(Message{
+		Type: "session_joined",
+		Payload: gin.H{
+			"sessionId":   session.ID,
+			"clientId":    client.ID,
+			"resumeToken": client.resumeToken,
+			"resumed":     true,
+			"seq":         seq,
+		},
+	})
+	sendPresenceSync(client, session)
+	sendAnnotationSync(client, session)
+	sendPollSync(client, session)
+	sendQuestionSync(client, session)
+	sendFrameSync(client, session)
+	sendE2EEKeySync(client, session)
+
+	broadcastToSession(requestSpan(c), session.ID, Message{
+		Type: "client_reconnected",
+		Payload: gin.H{
+			"clientId": client.ID,
+		},
+	}, client.ID)
+}
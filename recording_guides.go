@@ -0,0 +1,273 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RecordingGuideProcessing = "processing"
+	RecordingGuideDone       = "done"
+	RecordingGuideFailed     = "failed"
+
+	recordingGuideTimeout = 10 * time.Minute
+	// navigationSettle is how long after a navigation its frame is taken,
+	// so the new page has had time to draw.
+	navigationSettle = 1500
+	// keyframeScene is how much of the picture, from 0 to 1, has to change
+	// for a frame to count as a new moment in a recording without events.
+	keyframeScene = 0.3
+)
+
+var (
+	errNoMoments = errors.New("no steps could be found in the recording")
+	ptsTime      = regexp.MustCompile(`Parsed_showinfo.*pts_time:\s*([0-9.]+)`)
+)
+
+// recordingMoment is a point in a recording, in milliseconds, that becomes
+// a step of the guide made from it.
+type recordingMoment struct {
+	at       int64
+	pageURL  string
+	selector string
+}
+
+// eventMoments turns a recording's events, in order, into moments. A
+// navigation sets the page of the clicks after it, and its frame is taken
+// once the page has drawn. An event on the same page and element as the
+// one before adds nothing.
+func eventMoments(events []RecordingEvent) []recordingMoment {
+	var moments []recordingMoment
+	page := ""
+	for _, event := range events {
+		if event.PageURL != "" {
+			page = event.PageURL
+		}
+		moment := recordingMoment{at: event.At, pageURL: page}
+		if event.Type == "click" {
+			moment.selector = event.Selector
+		} else {
+			moment.at += navigationSettle
+		}
+		if n := len(moments); n > 0 && moments[n-1].pageURL == moment.pageURL && moments[n-1].selector == moment.selector {
+			continue
+		}
+		moments = append(moments, moment)
+		if len(moments) == maxImportSteps {
+			break
+		}
+	}
+	return moments
+}
+
+// detectKeyframes has ffmpeg find the frames of the recording at path where
+// the picture changes, taking the first frame as the first moment.
+func detectKeyframes(ctx context.Context, path string) ([]recordingMoment, error) {
+	cmd := exec.CommandContext(ctx, config.FFmpegCommand, "-hide_banner", "-nostats", "-i", path,
+		"-vf", fmt.Sprintf("select='eq(n,0)+gt(scene,%g)',showinfo", keyframeScene),
+		"-vsync", "vfr", "-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, lastLine(stderr.Bytes()))
+	}
+	var moments []recordingMoment
+	for _, match := range ptsTime.FindAllSubmatch(stderr.Bytes(), maxImportSteps) {
+		seconds, err := strconv.ParseFloat(string(match[1]), 64)
+		if err == nil {
+			moments = append(moments, recordingMoment{at: int64(seconds * 1000)})
+		}
+	}
+	return moments, nil
+}
+
+// extractFrame has ffmpeg take the frame at ms into the recording at path
+// as a PNG. It returns nothing when ms is past the end.
+func extractFrame(ctx context.Context, path string, ms int64) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, config.FFmpegCommand, "-hide_banner", "-loglevel", "error",
+		"-ss", strconv.FormatFloat(float64(ms)/1000, 'f', 3, 64), "-i", path,
+		"-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "-")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, lastLine(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func lastLine(output []byte) []byte {
+	output = bytes.TrimSpace(output)
+	if i := bytes.LastIndexByte(output, '\n'); i >= 0 {
+		return output[i+1:]
+	}
+	return output
+}
+
+// makeRecordingGuide starts drafting a guide from a recording in the
+// background. The recording's guideStatus says how it went, and its
+// guideId names the guide.
+func makeRecordingGuide(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	session.mu.Lock()
+	trashed := session.Status == SessionTrashed
+	guide := &Guide{
+		ID:          generateID(),
+		Title:       session.Name,
+		Description: session.Description,
+		Status:      GuideDraft,
+		WorkspaceID: session.WorkspaceID,
+		SessionID:   session.ID,
+		RecordingID: c.Param("recordingId"),
+		CreatedBy:   user.ID,
+	}
+	session.mu.Unlock()
+	if trashed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if session.E2EE {
+		rejectEncrypted(c, "guides")
+		return
+	}
+	if !canTranscode() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Guides from recordings need ffmpeg on the server"})
+		return
+	}
+	started := false
+	recording, exists := recordings.update(session.ID, guide.RecordingID, func(recording *Recording) {
+		if recording.GuideStatus != RecordingGuideProcessing {
+			recording.GuideID, recording.GuideStatus = guide.ID, RecordingGuideProcessing
+			started = true
+		}
+	})
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return
+	}
+	if !started {
+		c.JSON(http.StatusConflict, gin.H{"error": "A guide is already being made from the recording"})
+		return
+	}
+
+	auditRequest(c, "guide.create", "guide", guide.ID, gin.H{"sessionId": session.ID, "recordingId": recording.ID})
+	go buildRecordingGuide(guide, recording)
+	c.JSON(http.StatusAccepted, recording)
+}
+
+func buildRecordingGuide(guide *Guide, recording Recording) {
+	ctx, cancel := context.WithTimeout(context.Background(), recordingGuideTimeout)
+	defer cancel()
+
+	created, err := recordingGuide(ctx, guide, recording)
+	status := RecordingGuideDone
+	if err != nil {
+		status = RecordingGuideFailed
+		logger.Warn("making guide from recording failed", "recording", recording.ID, "error", err)
+	}
+	updated, exists := recordings.update(recording.SessionID, recording.ID, func(current *Recording) {
+		if current.GuideID == guide.ID {
+			current.GuideStatus = status
+		}
+	})
+	if exists {
+		broadcastToSession(nil, recording.SessionID, Message{Type: "recording", Payload: updated}, "")
+	}
+	if err == nil {
+		emitEvent(EventGuideCreated, created)
+	}
+}
+
+// recordingGuide fills in guide's steps from a recording, a step for each
+// moment, from its events or else where the picture changes, with the
+// frame at that moment as its image, and adds the guide.
+func recordingGuide(ctx context.Context, guide *Guide, recording Recording) (Guide, error) {
+	data, err := blobs.Get(ctx, recording.blobKey())
+	if err != nil {
+		return Guide{}, err
+	}
+	file, err := os.CreateTemp("", "tango-recording-*")
+	if err != nil {
+		return Guide{}, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Guide{}, err
+	}
+
+	moments := eventMoments(recording.Events)
+	if len(moments) == 0 {
+		if moments, err = detectKeyframes(ctx, file.Name()); err != nil {
+			return Guide{}, err
+		}
+	}
+
+	var frames [][]byte
+	var size int64
+	for _, moment := range moments {
+		frame, err := extractFrame(ctx, file.Name(), moment.at)
+		if err != nil {
+			return Guide{}, err
+		}
+		bounds, err := png.DecodeConfig(bytes.NewReader(frame))
+		if err != nil {
+			// Past the end of the recording.
+			continue
+		}
+		guide.Steps = append(guide.Steps, GuideStep{
+			ID:       generateID(),
+			Title:    stepTitle(moment.pageURL, moment.selector, len(guide.Steps)+1),
+			PageURL:  moment.pageURL,
+			Selector: moment.selector,
+			Image:    &GuideImage{ContentType: "image/png", Size: len(frame), Width: bounds.Width, Height: bounds.Height},
+		})
+		frames = append(frames, frame)
+		size += int64(len(frame))
+	}
+	if len(guide.Steps) == 0 {
+		return Guide{}, errNoMoments
+	}
+
+	if breach := meter.reserveStorage(guide.CreatedBy, guide.WorkspaceID, size); breach != nil {
+		return Guide{}, errors.New(breach.message())
+	}
+	for i, step := range guide.Steps {
+		if err := blobs.Put(ctx, stepBlobKey(guide.ID, step.ID), frames[i]); err != nil {
+			guide.Steps = guide.Steps[:i]
+			discardGuide(guide)
+			meter.releaseStorage(guide.CreatedBy, guide.WorkspaceID, size-guide.imageBytes())
+			return Guide{}, err
+		}
+	}
+
+	guide.CreatedAt = getCurrentTimestamp()
+	created := guides.add(guide)
+	if ocrEnabled() {
+		for _, step := range created.Steps {
+			queueStepOCR(created.ID, step.ID)
+		}
+	}
+	return created, nil
+}
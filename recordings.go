@@ -0,0 +1,638 @@
+package tango
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxRecordingBytes       = 1 << 30
+	maxRecordingChunkBytes  = 16 << 20
+	maxRecordingsPerSession = 50
+	maxRecordingNameBytes   = 255
+	// recordingUploadIdle is how long an upload may go without a chunk
+	// before it is given up.
+	recordingUploadIdle = 24 * time.Hour
+
+	uploadOffsetHeader   = "Upload-Offset"
+	uploadChecksumHeader = "Upload-Checksum"
+)
+
+var errTooManyRecordings = fmt.Errorf("a session can have at most %d recordings", maxRecordingsPerSession)
+
+// Recording is a video of a session recorded on a client and uploaded in
+// chunks. Its bytes are kept in the BlobStore and count towards the storage
+// quota of the session's owner and workspace. Events are what the client
+// saw the user do while recording, which a guide made from the recording
+// takes its steps from.
+type Recording struct {
+	ID          string           `json:"id"`
+	SessionID   string           `json:"sessionId"`
+	Filename    string           `json:"filename"`
+	ContentType string           `json:"contentType"`
+	Size        int64            `json:"size"`
+	SHA256      string           `json:"sha256"`
+	UploadedBy  string           `json:"uploadedBy,omitempty"`
+	CreatedAt   int64            `json:"createdAt"`
+	Events      []RecordingEvent `json:"events,omitempty"`
+	// ExternalID and Metadata are the uploader's own references, as for
+	// sessions. External IDs are unique among the recordings of a
+	// workspace.
+	ExternalID string            `json:"externalId,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	// GuideID is the guide last made from the recording, and GuideStatus
+	// how making it went.
+	GuideID     string `json:"guideId,omitempty"`
+	GuideStatus string `json:"guideStatus,omitempty"`
+	// Encrypted is set for recordings of end-to-end encrypted sessions,
+	// which clients decrypt to play.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	workspaceID string
+}
+
+// RecordingEvent is something done at At milliseconds into a recording: a
+// click on the element at Selector, or a navigation to PageURL.
+type RecordingEvent struct {
+	At       int64  `json:"at" binding:"min=0"`
+	Type     string `json:"type" binding:"required,oneof=click navigate"`
+	PageURL  string `json:"pageUrl"`
+	Selector string `json:"selector"`
+}
+
+func (r *Recording) blobKey() string {
+	return "recordings/" + r.SessionID + "/" + r.ID
+}
+
+// RecordingStore keeps each session's recordings, oldest first.
+type RecordingStore struct {
+	recordings map[string][]*Recording
+	mu         sync.Mutex
+}
+
+var recordings = &RecordingStore{recordings: make(map[string][]*Recording)}
+
+func (s *RecordingStore) add(recording *Recording) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.recordings[recording.SessionID]) >= maxRecordingsPerSession {
+		return errTooManyRecordings
+	}
+	if recording.ExternalID != "" && s.externalIDTaken(recording.workspaceID, recording.ExternalID) {
+		return errExternalIDTaken
+	}
+	s.recordings[recording.SessionID] = append(s.recordings[recording.SessionID], recording)
+	return nil
+}
+
+// externalIDTaken reports whether a recording in the workspace carries
+// externalID. Callers must hold s.mu.
+func (s *RecordingStore) externalIDTaken(workspaceID, externalID string) bool {
+	for _, list := range s.recordings {
+		for _, recording := range list {
+			if recording.ExternalID == externalID && recording.workspaceID == workspaceID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *RecordingStore) find(sessionID, id string) (Recording, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, recording := range s.recordings[sessionID] {
+		if recording.ID == id {
+			return *recording, true
+		}
+	}
+	return Recording{}, false
+}
+
+// update applies change to a recording and returns the result.
+func (s *RecordingStore) update(sessionID, id string, change func(*Recording)) (Recording, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, recording := range s.recordings[sessionID] {
+		if recording.ID == id {
+			change(recording)
+			return *recording, true
+		}
+	}
+	return Recording{}, false
+}
+
+func (s *RecordingStore) remove(sessionID, id string) (Recording, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.recordings[sessionID]
+	for i, recording := range list {
+		if recording.ID == id {
+			s.recordings[sessionID] = append(list[:i:i], list[i+1:]...)
+			return *recording, true
+		}
+	}
+	return Recording{}, false
+}
+
+func (s *RecordingStore) List(sessionID string) []Recording {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []Recording{}
+	for _, recording := range s.recordings[sessionID] {
+		list = append(list, *recording)
+	}
+	return list
+}
+
+// Forget drops session's recordings and unfinished uploads, deleting their
+// blobs and giving their storage back. Callers must hold session.mu.
+func (s *RecordingStore) Forget(session *Session) {
+	s.mu.Lock()
+	list := s.recordings[session.ID]
+	delete(s.recordings, session.ID)
+	s.mu.Unlock()
+	recordingUploads.forgetSession(session.ID)
+
+	var size int64
+	for _, recording := range list {
+		size += recording.Size
+	}
+	if size > 0 {
+		meter.releaseStorage(session.CreatedBy, session.WorkspaceID, size)
+	}
+	if len(list) > 0 {
+		go func() {
+			for _, recording := range list {
+				if err := blobs.Delete(context.Background(), recording.blobKey()); err != nil {
+					logger.Warn("deleting recording failed", "recording", recording.ID, "error", err)
+				}
+			}
+		}()
+	}
+}
+
+// RecordingUpload is a recording on its way to the server. The client
+// sends it in chunks of at most maxRecordingChunkBytes, each at the offset
+// the server has so far, and finishes it once all Size bytes are there.
+// The chunks are kept in a temporary file, so an upload interrupted by a
+// bad connection picks up at Offset instead of starting over. Its storage
+// is reserved from the start.
+type RecordingUpload struct {
+	ID          string `json:"id"`
+	SessionID   string `json:"sessionId"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	Offset      int64  `json:"offset"`
+	SHA256      string `json:"sha256"`
+	CreatedAt   int64  `json:"createdAt"`
+	ExpiresAt   int64  `json:"expiresAt"`
+
+	events             []RecordingEvent
+	externalID         string
+	metadata           map[string]string
+	uploadedBy         string
+	owner, workspaceID string
+	file               *os.File
+	digest             hash.Hash
+	timer              *time.Timer
+	// done is set once the upload is finished or given up, under mu.
+	done bool
+	mu   sync.Mutex
+}
+
+// abandon deletes the upload's file and gives its storage back. Callers
+// must hold u.mu.
+func (u *RecordingUpload) abandon() {
+	if u.done {
+		return
+	}
+	u.done = true
+	u.timer.Stop()
+	u.file.Close()
+	os.Remove(u.file.Name())
+	meter.releaseStorage(u.owner, u.workspaceID, u.Size)
+}
+
+type RecordingUploadStore struct {
+	uploads map[string]*RecordingUpload
+	mu      sync.Mutex
+}
+
+var recordingUploads = &RecordingUploadStore{uploads: make(map[string]*RecordingUpload)}
+
+func (s *RecordingUploadStore) find(sessionID, id string) (*RecordingUpload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, exists := s.uploads[id]
+	if !exists || upload.SessionID != sessionID {
+		return nil, false
+	}
+	return upload, true
+}
+
+func (s *RecordingUploadStore) drop(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, id)
+}
+
+// giveUp abandons an upload and forgets it.
+func (s *RecordingUploadStore) giveUp(upload *RecordingUpload) {
+	upload.mu.Lock()
+	upload.abandon()
+	upload.mu.Unlock()
+	s.drop(upload.ID)
+}
+
+// forgetSession gives up a session's uploads. It runs under session.mu,
+// which handlers take while holding an upload's lock, so the uploads are
+// abandoned in the background.
+func (s *RecordingUploadStore) forgetSession(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, upload := range s.uploads {
+		if upload.SessionID == sessionID {
+			delete(s.uploads, id)
+			go s.giveUp(upload)
+		}
+	}
+}
+
+// recordingUploadFor finds the upload named in the path of a request on a
+// session the caller may use, or responds.
+func recordingUploadFor(c *gin.Context) (*Session, *RecordingUpload, bool) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return nil, nil, false
+	}
+	upload, exists := recordingUploads.find(session.ID, c.Param("uploadId"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, nil, false
+	}
+	return session, upload, true
+}
+
+type RecordingUploadRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType" binding:"required,oneof=video/webm video/mp4 application/octet-stream"`
+	Size        int64  `json:"size" binding:"required,min=1"`
+	SHA256      string `json:"sha256" binding:"required,len=64,hexadecimal"`
+	// Events are what the user did while recording, in any order.
+	Events     []RecordingEvent  `json:"events" binding:"max=1000,dive"`
+	ExternalID string            `json:"externalId"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+// startRecordingUpload opens an upload for a recording of the given size,
+// type and SHA-256 digest, and reserves its storage.
+func startRecordingUpload(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	var req RecordingUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Size > maxRecordingBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Recordings must be at most %d bytes", maxRecordingBytes)})
+		return
+	}
+	if session.E2EE != (req.ContentType == encryptedContentType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Recordings of end-to-end encrypted sessions, and only those, are uploaded encrypted as " + encryptedContentType})
+		return
+	}
+	for _, event := range req.Events {
+		if !checkScreenshotSource(c, event.PageURL, event.Selector) {
+			return
+		}
+	}
+	if err := validateMetadata(req.Metadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sort.SliceStable(req.Events, func(i, j int) bool { return req.Events[i].At < req.Events[j].At })
+	req.Filename = strings.TrimSpace(req.Filename)
+	if len(req.Filename) > maxRecordingNameBytes || strings.ContainsAny(req.Filename, "/\\\"") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("filename must be at most %d bytes, without slashes or quotes", maxRecordingNameBytes)})
+		return
+	}
+
+	session.mu.Lock()
+	trashed := session.Status == SessionTrashed
+	owner, workspaceID := session.CreatedBy, session.WorkspaceID
+	session.mu.Unlock()
+	if trashed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if req.ExternalID != "" {
+		recordings.mu.Lock()
+		taken := recordings.externalIDTaken(workspaceID, req.ExternalID)
+		recordings.mu.Unlock()
+		if taken {
+			c.JSON(http.StatusConflict, gin.H{"error": errExternalIDTaken.Error()})
+			return
+		}
+	}
+	if breach := meter.reserveStorage(owner, workspaceID, req.Size); breach != nil {
+		rejectQuota(c, breach)
+		return
+	}
+	file, err := os.CreateTemp("", "tango-recording-*")
+	if err != nil {
+		meter.releaseStorage(owner, workspaceID, req.Size)
+		logger.Error("creating recording upload failed", "session", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The upload could not be started"})
+		return
+	}
+
+	now := time.Now()
+	upload := &RecordingUpload{
+		ID:          generateID(),
+		SessionID:   session.ID,
+		Filename:    req.Filename,
+		ContentType: req.ContentType,
+		Size:        req.Size,
+		SHA256:      strings.ToLower(req.SHA256),
+		CreatedAt:   now.Unix(),
+		ExpiresAt:   now.Add(recordingUploadIdle).Unix(),
+		events:      req.Events,
+		externalID:  req.ExternalID,
+		metadata:    req.Metadata,
+		owner:       owner,
+		workspaceID: workspaceID,
+		file:        file,
+		digest:      sha256.New(),
+	}
+	if upload.Filename == "" {
+		upload.Filename = "recording-" + upload.ID + "." + strings.TrimPrefix(req.ContentType, "video/")
+		if upload.ContentType == encryptedContentType {
+			upload.Filename = "recording-" + upload.ID + ".bin"
+		}
+	}
+	if user := currentUser(c); user != nil {
+		upload.uploadedBy = user.ID
+	}
+	upload.timer = time.AfterFunc(recordingUploadIdle, func() { recordingUploads.giveUp(upload) })
+	recordingUploads.mu.Lock()
+	recordingUploads.uploads[upload.ID] = upload
+	recordingUploads.mu.Unlock()
+
+	c.Header(uploadOffsetHeader, "0")
+	c.JSON(http.StatusCreated, upload)
+}
+
+// getRecordingUpload reports how much of an upload the server has, which
+// is where a client resumes.
+func getRecordingUpload(c *gin.Context) {
+	_, upload, ok := recordingUploadFor(c)
+	if !ok {
+		return
+	}
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	c.Header(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	c.JSON(http.StatusOK, upload)
+}
+
+// appendRecordingChunk adds the request body to an upload. Upload-Offset
+// must be the upload's offset, so a chunk that was already received is not
+// appended twice. With Upload-Checksum set to "sha256 <base64 digest>",
+// a chunk damaged on the way is turned away.
+func appendRecordingChunk(c *gin.Context) {
+	_, upload, ok := recordingUploadFor(c)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": uploadOffsetHeader + " must be the byte offset of the chunk"})
+		return
+	}
+	var want []byte
+	if checksum := c.GetHeader(uploadChecksumHeader); checksum != "" {
+		algorithm, encoded, _ := strings.Cut(checksum, " ")
+		if want, err = base64.StdEncoding.DecodeString(encoded); algorithm != "sha256" || err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": uploadChecksumHeader + " must be sha256 and a base64 digest"})
+			return
+		}
+	}
+	chunk, err := io.ReadAll(io.LimitReader(c.Request.Body, maxRecordingChunkBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read the chunk"})
+		return
+	}
+	if len(chunk) > maxRecordingChunkBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Chunks must be at most %d bytes", maxRecordingChunkBytes)})
+		return
+	}
+	if want != nil {
+		if sum := sha256.Sum256(chunk); string(sum[:]) != string(want) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The chunk does not match its checksum"})
+			return
+		}
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if upload.done {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	c.Header(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	if offset != upload.Offset {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("The upload continues at offset %d", upload.Offset), "offset": upload.Offset})
+		return
+	}
+	if upload.Offset+int64(len(chunk)) > upload.Size {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The chunk goes past the upload's %d bytes", upload.Size)})
+		return
+	}
+	if _, err := upload.file.WriteAt(chunk, upload.Offset); err != nil {
+		upload.file.Truncate(upload.Offset)
+		logger.Error("writing recording chunk failed", "upload", upload.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The chunk could not be stored"})
+		return
+	}
+	upload.digest.Write(chunk)
+	upload.Offset += int64(len(chunk))
+	upload.ExpiresAt = time.Now().Add(recordingUploadIdle).Unix()
+	upload.timer.Reset(recordingUploadIdle)
+
+	c.Header(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	c.JSON(http.StatusOK, upload)
+}
+
+// finishRecordingUpload turns a complete upload into a recording once its
+// digest matches the one it was started with. One that does not match is
+// discarded, as there is no telling which chunk went wrong.
+func finishRecordingUpload(c *gin.Context) {
+	session, upload, ok := recordingUploadFor(c)
+	if !ok {
+		return
+	}
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if upload.done {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	if upload.Offset != upload.Size {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("The upload has %d of its %d bytes", upload.Offset, upload.Size), "offset": upload.Offset})
+		return
+	}
+	if digest := hex.EncodeToString(upload.digest.Sum(nil)); digest != upload.SHA256 {
+		upload.abandon()
+		recordingUploads.drop(upload.ID)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "The upload does not match its sha256 and was discarded", "sha256": digest})
+		return
+	}
+	data, err := os.ReadFile(upload.file.Name())
+	if err != nil {
+		logger.Error("reading recording upload failed", "upload", upload.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The recording could not be stored"})
+		return
+	}
+
+	recording := &Recording{
+		ID:          upload.ID,
+		SessionID:   session.ID,
+		Filename:    upload.Filename,
+		ContentType: upload.ContentType,
+		Size:        upload.Size,
+		SHA256:      upload.SHA256,
+		UploadedBy:  upload.uploadedBy,
+		CreatedAt:   getCurrentTimestamp(),
+		Events:      upload.events,
+		ExternalID:  upload.externalID,
+		Metadata:    upload.metadata,
+		Encrypted:   upload.ContentType == encryptedContentType,
+		workspaceID: upload.workspaceID,
+	}
+	if err := blobs.Put(c.Request.Context(), recording.blobKey(), data); err != nil {
+		logger.Error("storing recording failed", "session", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The recording could not be stored"})
+		return
+	}
+	if err := recordings.add(recording); err != nil {
+		blobs.Delete(context.Background(), recording.blobKey())
+		if errors.Is(err, errExternalIDTaken) {
+			upload.abandon()
+			recordingUploads.drop(upload.ID)
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	// The reserved storage now belongs to the recording.
+	upload.done = true
+	upload.timer.Stop()
+	upload.file.Close()
+	os.Remove(upload.file.Name())
+	recordingUploads.drop(upload.ID)
+
+	created := *recording
+	auditRequest(c, "recording.upload", "recording", recording.ID, gin.H{"sessionId": session.ID, "size": recording.Size})
+	emitEvent(EventRecordingFinished, created)
+	broadcastToSession(requestSpan(c), session.ID, Message{Type: "recording", Payload: created}, "")
+	c.JSON(http.StatusCreated, created)
+}
+
+func cancelRecordingUpload(c *gin.Context) {
+	_, upload, ok := recordingUploadFor(c)
+	if !ok {
+		return
+	}
+	recordingUploads.giveUp(upload)
+	c.Status(http.StatusNoContent)
+}
+
+func getRecordings(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	query := c.Request.URL.Query()
+	list := []Recording{}
+	for _, recording := range recordings.List(session.ID) {
+		if matchesResourceFilter(query, recording.ExternalID, recording.Metadata) {
+			list = append(list, recording)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"recordings": list})
+}
+
+func downloadRecording(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	recording, exists := recordings.find(session.ID, c.Param("recordingId"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return
+	}
+	observeDownload(c, session.WorkspaceID)
+	if redirectToBlob(c, recording.blobKey(), recording.ContentType, recording.Filename) {
+		return
+	}
+	data, err := blobs.Get(c.Request.Context(), recording.blobKey())
+	if errors.Is(err, ErrBlobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return
+	}
+	if err != nil {
+		logger.Error("reading recording failed", "recording", recording.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The recording could not be read"})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+recording.Filename+`"`)
+	c.Data(http.StatusOK, recording.ContentType, data)
+}
+
+func deleteRecording(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	recording, exists := recordings.remove(session.ID, c.Param("recordingId"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return
+	}
+	session.mu.Lock()
+	owner, workspaceID := session.CreatedBy, session.WorkspaceID
+	session.mu.Unlock()
+	meter.releaseStorage(owner, workspaceID, recording.Size)
+	if err := blobs.Delete(c.Request.Context(), recording.blobKey()); err != nil {
+		logger.Warn("deleting recording failed", "recording", recording.ID, "error", err)
+	}
+
+	auditRequest(c, "recording.delete", "recording", recording.ID, gin.H{"sessionId": session.ID})
+	broadcastToSession(requestSpan(c), session.ID, Message{Type: "recording_deleted", Payload: gin.H{"recordingId": recording.ID}}, "")
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,230 @@
+package tango
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Replication keeps a warm standby for the in-memory store. The primary
+// periodically streams a full snapshot of sessions and membership to the
+// standby over a gRPC stream it keeps open, in chunks, and the standby
+// acknowledges each snapshot once it has applied it. The standby stays out
+// of rotation until it is promoted, so a failover loses at most one
+// interval of changes. Both ends need a binary built with -tags grpc.
+const (
+	RolePrimary = "primary"
+	RoleStandby = "standby"
+)
+
+type ReplicationSnapshot struct {
+	Version  int64               `json:"version"`
+	SentAt   int64               `json:"sentAt"`
+	Sessions json.RawMessage     `json:"sessions"`
+	Members  map[string][]string `json:"members"`
+}
+
+type ReplicationStatus struct {
+	Role       string `json:"role"`
+	Peer       string `json:"peer,omitempty"`
+	Version    int64  `json:"version"`
+	LastSync   int64  `json:"lastSync,omitempty"`
+	LastError  string `json:"lastError,omitempty"`
+	Sessions   int    `json:"sessions"`
+	Members    int    `json:"members"`
+	lastDigest [32]byte
+}
+
+type Replicator struct {
+	status ReplicationStatus
+	mu     sync.Mutex
+}
+
+var replicator = &Replicator{}
+
+// replicationAckTimeout is how long the primary waits for a snapshot to be
+// sent and acknowledged before it drops the stream and opens a new one.
+const replicationAckTimeout = 5 * time.Second
+
+func (r *Replicator) Role() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status.Role
+}
+
+func (r *Replicator) IsStandby() bool {
+	return r.Role() == RoleStandby
+}
+
+func startReplication(cfg ReplicationConfig) {
+	replicator.mu.Lock()
+	replicator.status.Role = cfg.Role
+	replicator.status.Peer = cfg.PeerURL
+	replicator.mu.Unlock()
+
+	if cfg.Role == RolePrimary && cfg.PeerURL != "" {
+		go replicator.run(cfg)
+	}
+}
+
+func (r *Replicator) run(cfg ReplicationConfig) {
+	ticker := time.NewTicker(time.Duration(cfg.IntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if r.Role() != RolePrimary {
+			return
+		}
+		if err := r.push(cfg); err != nil {
+			r.mu.Lock()
+			r.status.LastError = err.Error()
+			r.mu.Unlock()
+			logger.Warn("replication push failed", "peer", cfg.PeerURL, "error", err)
+		}
+	}
+}
+
+func snapshotMembers() map[string][]string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	members := make(map[string][]string, len(store.Sessions))
+	for id, session := range store.Sessions {
+		session.mu.Lock()
+		for clientID := range session.Clients {
+			members[id] = append(members[id], clientID)
+		}
+		session.mu.Unlock()
+	}
+	return members
+}
+
+func (r *Replicator) push(cfg ReplicationConfig) error {
+	sessions, err := snapshotSessions()
+	if err != nil {
+		return err
+	}
+	members := snapshotMembers()
+
+	membersJSON, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(append(sessions, membersJSON...))
+
+	r.mu.Lock()
+	unchanged := digest == r.status.lastDigest && r.status.LastError == ""
+	version := r.status.Version + 1
+	r.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	body, err := json.Marshal(ReplicationSnapshot{
+		Version:  version,
+		SentAt:   time.Now().UnixMilli(),
+		Sessions: sessions,
+		Members:  members,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := sendSnapshot(cfg, version, body); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.status.Version = version
+	r.status.LastSync = getCurrentTimestamp()
+	r.status.LastError = ""
+	r.status.lastDigest = digest
+	r.mu.Unlock()
+	return nil
+}
+
+// validReplicationToken reports whether an Authorization value carries the
+// shared replication token.
+func validReplicationToken(got string) bool {
+	want := "Bearer " + config.Replication.Token
+	return config.Replication.Token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func replicationAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !validReplicationToken(c.GetHeader("Authorization")) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// applySnapshot replaces a standby's sessions with those of a snapshot
+// from the primary.
+func applySnapshot(data []byte) error {
+	var snapshot ReplicationSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	n, err := restoreSessions(snapshot.Sessions, true)
+	if err != nil {
+		return err
+	}
+
+	members := 0
+	for _, ids := range snapshot.Members {
+		members += len(ids)
+	}
+
+	replicator.mu.Lock()
+	replicator.status.Version = snapshot.Version
+	replicator.status.LastSync = getCurrentTimestamp()
+	replicator.status.Sessions = n
+	replicator.status.Members = members
+	replicator.mu.Unlock()
+	return nil
+}
+
+// standbyGuard keeps a standby read-only; anything it accepted would be
+// overwritten by the next snapshot from the primary.
+func standbyGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if replicator.IsStandby() && c.Request.Method != http.MethodGet {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Instance is a read-only standby"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func getReplicationStatus(c *gin.Context) {
+	replicator.mu.Lock()
+	status := replicator.status
+	replicator.mu.Unlock()
+
+	c.JSON(http.StatusOK, status)
+}
+
+// promoteStandby turns a standby into a primary. Clients that were
+// connected to the old primary reconnect and rejoin the replicated sessions.
+func promoteStandby(c *gin.Context) {
+	replicator.mu.Lock()
+	defer replicator.mu.Unlock()
+
+	if replicator.status.Role != RoleStandby {
+		c.JSON(http.StatusConflict, gin.H{"error": "Instance is not a standby"})
+		return
+	}
+
+	replicator.status.Role = RolePrimary
+	replicator.status.Peer = ""
+	logger.Warn("standby promoted to primary", "version", replicator.status.Version)
+	auditRequest(c, "replication.promote", "server", "", nil)
+	c.JSON(http.StatusOK, replicator.status)
+}
@@ -0,0 +1,259 @@
+//go:build grpc
+
+package tango
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	replicationService = "tango.v1.Replication"
+
+	// replicationChunkSize is how much of a snapshot goes in one message,
+	// well under gRPC's default 4 MB message limit.
+	replicationChunkSize = 1 << 20
+	// maxReplicationSnapshot bounds what a standby buffers for one
+	// snapshot.
+	maxReplicationSnapshot = 1 << 30
+)
+
+var errReplicationAckTimeout = errors.New("standby did not acknowledge the snapshot in time")
+
+// replicationLink is the primary's stream to the standby. It is opened on
+// the first push and again after any error, and only the replicator's
+// goroutine uses it.
+var replicationLink struct {
+	conn   *grpc.ClientConn
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+// sendSnapshot streams body, the encoded snapshot of version, to the
+// standby and waits for it to be applied.
+func sendSnapshot(cfg ReplicationConfig, version int64, body []byte) error {
+	if replicationLink.stream == nil {
+		if err := openReplicationLink(cfg); err != nil {
+			return err
+		}
+	}
+	if err := streamSnapshot(version, body); err != nil {
+		closeReplicationLink()
+		return err
+	}
+	return nil
+}
+
+func openReplicationLink(cfg ReplicationConfig) error {
+	peer, err := url.Parse(cfg.PeerURL)
+	if err != nil {
+		return err
+	}
+	creds := insecure.NewCredentials()
+	if peer.Scheme == "grpcs" {
+		creds = credentials.NewTLS(&tls.Config{ServerName: peer.Hostname()})
+	}
+	conn, err := grpc.Dial(peer.Host,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(),
+		"authorization", "Bearer "+cfg.Token))
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{
+		StreamName:    "Replicate",
+		ServerStreams: true,
+		ClientStreams: true,
+	}, "/"+replicationService+"/Replicate")
+	if err != nil {
+		cancel()
+		conn.Close()
+		return err
+	}
+	replicationLink.conn, replicationLink.stream, replicationLink.cancel = conn, stream, cancel
+	return nil
+}
+
+func closeReplicationLink() {
+	if replicationLink.conn == nil {
+		return
+	}
+	replicationLink.cancel()
+	replicationLink.conn.Close()
+	replicationLink.conn, replicationLink.stream, replicationLink.cancel = nil, nil, nil
+}
+
+func streamSnapshot(version int64, body []byte) error {
+	stream, cancel := replicationLink.stream, replicationLink.cancel
+	timer := time.AfterFunc(replicationAckTimeout, cancel)
+	defer timer.Stop()
+
+	for offset := 0; ; offset += replicationChunkSize {
+		end := offset + replicationChunkSize
+		if end > len(body) {
+			end = len(body)
+		}
+		chunk := encodeReplicationChunk(version, body[offset:end], end == len(body))
+		if err := stream.SendMsg(&rawFrame{data: chunk}); err != nil {
+			return replicationError(err, timer)
+		}
+		if end == len(body) {
+			break
+		}
+	}
+
+	var ack rawFrame
+	if err := stream.RecvMsg(&ack); err != nil {
+		return replicationError(err, timer)
+	}
+	acked, err := decodeReplicationAck(ack.data)
+	if err != nil {
+		return err
+	}
+	if acked != version {
+		return fmt.Errorf("standby acknowledged version %d, not %d", acked, version)
+	}
+	return nil
+}
+
+// replicationError explains a failed send or receive, which is how the
+// stream reports being cancelled by the timeout.
+func replicationError(err error, timer *time.Timer) error {
+	if !timer.Stop() {
+		return errReplicationAckTimeout
+	}
+	if err == io.EOF {
+		// The standby closed the stream; RecvMsg has its reason.
+		var frame rawFrame
+		if recvErr := replicationLink.stream.RecvMsg(&frame); recvErr != nil && recvErr != io.EOF {
+			return recvErr
+		}
+	}
+	return err
+}
+
+func replicationServiceDesc() *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: replicationService,
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Replicate",
+			Handler:       receiveReplication,
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+		Metadata: "proto/tango.proto",
+	}
+}
+
+// receiveReplication is the standby's end of the stream: it gathers each
+// snapshot's chunks, applies the snapshot and acknowledges it.
+func receiveReplication(_ interface{}, stream grpc.ServerStream) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	auth := md.Get("authorization")
+	if len(auth) == 0 || !validReplicationToken(auth[0]) {
+		return status.Error(codes.Unauthenticated, "invalid replication token")
+	}
+
+	var buf []byte
+	var version int64
+	for {
+		var frame rawFrame
+		if err := stream.RecvMsg(&frame); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		chunk, err := decodeReplicationChunk(frame.data)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if chunk.version != version {
+			buf, version = buf[:0], chunk.version
+		}
+		if len(buf)+len(chunk.data) > maxReplicationSnapshot {
+			return status.Error(codes.ResourceExhausted, "snapshot is too large")
+		}
+		buf = append(buf, chunk.data...)
+		if !chunk.last {
+			continue
+		}
+
+		if !replicator.IsStandby() {
+			return status.Error(codes.FailedPrecondition, "instance is not a standby")
+		}
+		if err := applySnapshot(buf); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		buf = buf[:0]
+		if err := stream.SendMsg(&rawFrame{data: encodeReplicationAck(version)}); err != nil {
+			return err
+		}
+	}
+}
+
+// replicationChunk is a ReplicationChunk of tango.proto: part of the JSON
+// snapshot of version.
+type replicationChunk struct {
+	version int64
+	data    []byte
+	last    bool
+}
+
+func encodeReplicationChunk(version int64, data []byte, last bool) []byte {
+	b := appendProtoTag(nil, 1, protoVarint)
+	b = appendUvarint(b, uint64(version))
+	b = appendProtoBytes(b, 2, data)
+	if last {
+		b = appendProtoTag(b, 3, protoVarint)
+		b = append(b, 1)
+	}
+	return b
+}
+
+func decodeReplicationChunk(data []byte) (replicationChunk, error) {
+	var chunk replicationChunk
+	err := walkProto(data, func(field, wire int, value []byte, n uint64) error {
+		switch field {
+		case 1:
+			chunk.version = int64(n)
+		case 2:
+			chunk.data = value
+		case 3:
+			chunk.last = n != 0
+		}
+		return nil
+	})
+	return chunk, err
+}
+
+func encodeReplicationAck(version int64) []byte {
+	b := appendProtoTag(nil, 1, protoVarint)
+	return appendUvarint(b, uint64(version))
+}
+
+func decodeReplicationAck(data []byte) (int64, error) {
+	var version int64
+	err := walkProto(data, func(field, wire int, value []byte, n uint64) error {
+		if field == 1 {
+			version = int64(n)
+		}
+		return nil
+	})
+	return version, err
+}
@@ -0,0 +1,222 @@
+package tango
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+const secondsPerDay = 86400
+
+// RetentionPolicy tells the janitor what to delete in a workspace. Zero
+// keeps data for as long as the server otherwise would.
+type RetentionPolicy struct {
+	// InactiveSessionDays purges sessions nobody has used for that long.
+	InactiveSessionDays int `json:"inactiveSessionDays,omitempty" binding:"min=0"`
+	// HistoryDays drops older lifecycle history, and the annotations of
+	// sessions inactive for that long.
+	HistoryDays int `json:"historyDays,omitempty" binding:"min=0"`
+}
+
+func (p *RetentionPolicy) empty() bool {
+	return p == nil || p.InactiveSessionDays == 0 && p.HistoryDays == 0
+}
+
+// RetentionReport lists what a policy deletes, or would delete on a dry run.
+type RetentionReport struct {
+	WorkspaceID        string   `json:"workspaceId"`
+	DryRun             bool     `json:"dryRun"`
+	At                 int64    `json:"at"`
+	Sessions           []string `json:"sessions"`
+	HistoryEntries     int      `json:"historyEntries"`
+	AnnotationSessions []string `json:"annotationSessions"`
+}
+
+func (r *RetentionReport) deletes() bool {
+	return len(r.Sessions) > 0 || r.HistoryEntries > 0 || len(r.AnnotationSessions) > 0
+}
+
+// lastActive is when session was last in use: now while clients are
+// connected. Callers must hold session.mu.
+func (s *Session) lastActive(now int64) int64 {
+	if len(s.Clients) > 0 {
+		return now
+	}
+	last := s.CreatedAt
+	for _, at := range []int64{s.EndedAt, s.IdleSince, s.DeletedAt, s.stats.startedAt} {
+		if at > last {
+			last = at
+		}
+	}
+	if !s.lastFrame.IsZero() && s.lastFrame.Unix() > last {
+		last = s.lastFrame.Unix()
+	}
+	return last
+}
+
+// PruneBefore drops a session's entries recorded before cutoff, a unix
+// time in milliseconds, and returns how many there were. With dryRun it
+// only counts them.
+func (j *Journal) PruneBefore(sessionID string, cutoff int64, dryRun bool) int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := j.entries[sessionID]
+	n := sort.Search(len(entries), func(i int) bool { return entries[i].At >= cutoff })
+	if n > 0 && !dryRun {
+		j.entries[sessionID] = append([]JournalEntry(nil), entries[n:]...)
+		j.truncated[sessionID] = true
+	}
+	return n
+}
+
+func (b *AnnotationBoard) has(sessionID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.strokes[sessionID]) > 0
+}
+
+// applyRetention enforces policy on the workspace's sessions, or with
+// dryRun only reports what it would delete.
+func applyRetention(workspaceID string, policy RetentionPolicy, now int64, dryRun bool) RetentionReport {
+	report := RetentionReport{
+		WorkspaceID:        workspaceID,
+		DryRun:             dryRun,
+		At:                 now,
+		Sessions:           []string{},
+		AnnotationSessions: []string{},
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, session := range store.Sessions {
+		session.mu.Lock()
+		if session.WorkspaceID != workspaceID {
+			session.mu.Unlock()
+			continue
+		}
+		id := session.ID
+		inactive := now - session.lastActive(now)
+
+		if days := policy.InactiveSessionDays; days > 0 && inactive >= int64(days)*secondsPerDay {
+			report.Sessions = append(report.Sessions, id)
+			if !dryRun {
+				purgeSession(session)
+				journal.Forget(id)
+				audit.Record(ActorSystem, "session.purge", "session", id, "", gin.H{"reason": "retention policy", "workspaceId": workspaceID})
+			}
+			session.mu.Unlock()
+			continue
+		}
+		if days := policy.HistoryDays; days > 0 {
+			cutoff := now - int64(days)*secondsPerDay
+			report.HistoryEntries += journal.PruneBefore(id, cutoff*1000, dryRun)
+			if inactive >= int64(days)*secondsPerDay && annotations.has(id) {
+				report.AnnotationSessions = append(report.AnnotationSessions, id)
+				if !dryRun {
+					annotations.Forget(id)
+				}
+			}
+		}
+		session.mu.Unlock()
+	}
+
+	sort.Strings(report.Sessions)
+	sort.Strings(report.AnnotationSessions)
+	return report
+}
+
+// runRetention enforces every workspace's retention policy.
+func runRetention(now int64) int {
+	policies := make(map[string]RetentionPolicy)
+	workspaces.mu.Lock()
+	for id, ws := range workspaces.Workspaces {
+		if !ws.Retention.empty() {
+			policies[id] = *ws.Retention
+		}
+	}
+	workspaces.mu.Unlock()
+
+	purged := 0
+	for id, policy := range policies {
+		report := applyRetention(id, policy, now, false)
+		if report.deletes() {
+			audit.Record(ActorSystem, "workspace.retention", "workspace", id, "", gin.H{
+				"sessions":           len(report.Sessions),
+				"historyEntries":     report.HistoryEntries,
+				"annotationSessions": len(report.AnnotationSessions),
+			})
+		}
+		purged += len(report.Sessions)
+	}
+	return purged
+}
+
+func workspaceRetention(id string) (RetentionPolicy, bool) {
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+	ws, exists := workspaces.Workspaces[id]
+	if !exists || ws.Retention == nil {
+		return RetentionPolicy{}, exists
+	}
+	return *ws.Retention, true
+}
+
+// getRetention returns the workspace's policy along with a dry run of what
+// the janitor would delete under it right now.
+func getRetention(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleAdmin) == nil {
+		return
+	}
+	policy, exists := workspaceRetention(id)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"retention": policy,
+		"report":    applyRetention(id, policy, getCurrentTimestamp(), true),
+	})
+}
+
+// updateRetention replaces the workspace's policy. With ?dryRun=true the
+// policy is only tried out: the response reports what it would delete and
+// nothing is saved.
+func updateRetention(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleAdmin) == nil {
+		return
+	}
+
+	var req RetentionPolicy
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dryRun := c.Query("dryRun") == "true"
+	report := applyRetention(id, req, getCurrentTimestamp(), true)
+	if dryRun {
+		c.JSON(http.StatusOK, gin.H{"retention": req, "report": report})
+		return
+	}
+
+	workspaces.mu.Lock()
+	ws, exists := workspaces.Workspaces[id]
+	if exists {
+		ws.Retention = nil
+		if !req.empty() {
+			ws.Retention = &req
+		}
+	}
+	workspaces.mu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+
+	auditRequest(c, "workspace.retention.update", "workspace", id, gin.H{"retention": req})
+	c.JSON(http.StatusOK, gin.H{"retention": req, "report": report})
+}
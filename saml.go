@@ -0,0 +1,316 @@
+package tango
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/gin-gonic/gin"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+)
+
+// ProviderSAML is the identity provider name of SAML sign-ins. Like
+// ProviderSSO it counts as single sign-on for workspaces that require it.
+const ProviderSAML = "saml"
+
+const (
+	samlStateCookie  = "tango_saml_state"
+	samlMetadataTTL  = time.Hour
+	samlMetadataMax  = 1 << 20
+	samlNameIDFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+)
+
+// samlProviderCache holds the service provider built from the IdP's
+// metadata. Like the OIDC discovery document it is loaded on first use and
+// refreshed hourly, so the IdP can rotate its signing certificates.
+type samlProviderCache struct {
+	sp      *saml.ServiceProvider
+	fetched time.Time
+	mu      sync.Mutex
+}
+
+var samlProvider = &samlProviderCache{}
+
+func (s *samlProviderCache) serviceProvider() (*saml.ServiceProvider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sp == nil || time.Since(s.fetched) > samlMetadataTTL {
+		sp, err := newSAMLServiceProvider()
+		if err != nil {
+			return nil, err
+		}
+		s.sp = sp
+		s.fetched = time.Now()
+	}
+	return s.sp, nil
+}
+
+func newSAMLServiceProvider() (*saml.ServiceProvider, error) {
+	cfg := config.OAuth.SAML
+	idp, err := samlIdPMetadata(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimSuffix(config.OAuth.RedirectBaseURL, "/") + apiPrefix + "/auth/saml"
+	metadataURL, err := url.Parse(base + "/metadata")
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := url.Parse(base + "/acs")
+	if err != nil {
+		return nil, err
+	}
+	sp := &saml.ServiceProvider{
+		EntityID:          cfg.EntityID,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idp,
+		AuthnNameIDFormat: saml.PersistentNameIDFormat,
+	}
+	if sp.EntityID == "" {
+		sp.EntityID = metadataURL.String()
+	}
+	if cfg.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("saml key pair: %v", err)
+		}
+		key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("saml key pair: the key must be RSA")
+		}
+		if sp.Certificate, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("saml key pair: %v", err)
+		}
+		sp.Key = key
+	}
+	return sp, nil
+}
+
+// samlIdPMetadata reads the IdP's metadata. Aggregates are accepted as long
+// as the first entity describes an IdP.
+func samlIdPMetadata(cfg SAMLConfig) (*saml.EntityDescriptor, error) {
+	var data []byte
+	if cfg.IdPMetadataFile != "" {
+		var err error
+		if data, err = os.ReadFile(cfg.IdPMetadataFile); err != nil {
+			return nil, err
+		}
+	} else {
+		resp, err := oauthClient.Get(cfg.IdPMetadataURL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("IdP metadata: status %d", resp.StatusCode)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, samlMetadataMax)); err != nil {
+			return nil, err
+		}
+	}
+
+	// encoding/xml doesn't round-trip every document faithfully; refuse the
+	// ones it would misread rather than trust certificates parsed from them.
+	if err := xrv.Validate(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("IdP metadata: %v", err)
+	}
+	entity := &saml.EntityDescriptor{}
+	if err := xml.Unmarshal(data, entity); err != nil {
+		entities := &saml.EntitiesDescriptor{}
+		if xml.Unmarshal(data, entities) != nil || len(entities.EntityDescriptors) == 0 {
+			return nil, fmt.Errorf("IdP metadata: %v", err)
+		}
+		entity = &entities.EntityDescriptors[0]
+	}
+	if len(entity.IDPSSODescriptors) == 0 {
+		return nil, errors.New("IdP metadata describes no identity provider")
+	}
+	return entity, nil
+}
+
+// lookupSAML answers 404 when SAML isn't configured and 502 when the IdP's
+// metadata can't be loaded.
+func lookupSAML(c *gin.Context) (*saml.ServiceProvider, bool) {
+	if !config.OAuth.SAML.Enabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SAML sign-in is not configured"})
+		return nil, false
+	}
+	sp, err := samlProvider.serviceProvider()
+	if err != nil {
+		requestLog(c).Warn("saml metadata failed", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not reach the SAML identity provider"})
+		return nil, false
+	}
+	return sp, true
+}
+
+// getSAMLMetadata serves the service provider metadata an IdP administrator
+// registers the server with. Only the POST binding is advertised for
+// assertions, as the artifact binding is not supported.
+func getSAMLMetadata(c *gin.Context) {
+	sp, ok := lookupSAML(c)
+	if !ok {
+		return
+	}
+	metadata := sp.Metadata()
+	for i := range metadata.SPSSODescriptors {
+		descriptor := &metadata.SPSSODescriptors[i]
+		services := descriptor.AssertionConsumerServices[:0]
+		for _, service := range descriptor.AssertionConsumerServices {
+			if service.Binding == saml.HTTPPostBinding {
+				services = append(services, service)
+			}
+		}
+		descriptor.AssertionConsumerServices = services
+	}
+	data, err := xml.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not build SAML metadata"})
+		return
+	}
+	c.Data(http.StatusOK, "application/samlmetadata+xml", data)
+}
+
+// startSAML sends the browser to the IdP with an authentication request.
+// The RelayState names the sign-in attempt, which is also kept in a cookie
+// so the assertion can only complete the attempt of the browser that began
+// it.
+func startSAML(c *gin.Context) {
+	sp, ok := lookupSAML(c)
+	if !ok {
+		return
+	}
+	returnTo := c.Query("returnTo")
+	if !validReturnTo(returnTo) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "returnTo must be a relative path or an allowed origin"})
+		return
+	}
+
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		requestLog(c).Warn("saml authentication request failed", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The SAML identity provider offers no redirect sign-in"})
+		return
+	}
+	key := randomToken(24)
+	redirect, err := req.Redirect(key, sp)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start SAML sign-in"})
+		return
+	}
+	oauthStates.put(key, oauthState{
+		provider:  ProviderSAML,
+		requestID: req.ID,
+		returnTo:  returnTo,
+		expiresAt: time.Now().Add(oauthStateTTL),
+	})
+
+	// The IdP posts back from its own origin, so the cookie must be
+	// SameSite=None, which browsers only accept on Secure cookies.
+	c.SetSameSite(http.SameSiteNoneMode)
+	c.SetCookie(samlStateCookie, key, int(oauthStateTTL.Seconds()), apiPrefix+"/auth/saml", "", true, true)
+	c.Redirect(http.StatusFound, redirect.String())
+}
+
+// samlACS is the assertion consumer service the IdP posts its response to.
+// Only responses to a request we made are accepted; IdP-initiated sign-in
+// and the artifact binding are not supported.
+func samlACS(c *gin.Context) {
+	sp, ok := lookupSAML(c)
+	if !ok {
+		return
+	}
+	key := c.PostForm("RelayState")
+	cookie, _ := c.Cookie(samlStateCookie)
+	state, exists := oauthStates.take(key)
+	if key == "" || !exists || state.provider != ProviderSAML || subtle.ConstantTimeCompare([]byte(cookie), []byte(key)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in attempt; start again"})
+		return
+	}
+	c.SetSameSite(http.SameSiteNoneMode)
+	c.SetCookie(samlStateCookie, "", -1, apiPrefix+"/auth/saml", "", true, true)
+
+	raw, err := base64.StdEncoding.DecodeString(c.PostForm("SAMLResponse"))
+	if err != nil || len(raw) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "SAMLResponse is required"})
+		return
+	}
+	assertion, err := sp.ParseXMLResponse(raw, []string{state.requestID})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			err = invalid.PrivateErr
+		}
+		requestLog(c).Warn("saml response rejected", "error", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "The SAML response could not be verified"})
+		return
+	}
+
+	profile := samlProfile(assertion, config.OAuth.SAML)
+	if profile.Subject == "" || profile.Email == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your SAML identity provider sent no email address"})
+		return
+	}
+	completeSignIn(c, ProviderSAML, AuthSSO, profile, state.returnTo)
+}
+
+// samlProfile reads the person's identity from a verified assertion. The
+// IdP is trusted for the email address, as it is the organisation's own
+// directory; an email-format NameID serves when no attribute carries it.
+func samlProfile(assertion *saml.Assertion, cfg SAMLConfig) oauthProfile {
+	profile := oauthProfile{Verified: true}
+	if subject := assertion.Subject; subject != nil && subject.NameID != nil {
+		profile.Subject = subject.NameID.Value
+		if subject.NameID.Format == samlNameIDFormat {
+			profile.Email = subject.NameID.Value
+		}
+	}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			values := make([]string, 0, len(attr.Values))
+			for _, value := range attr.Values {
+				values = append(values, value.Value)
+			}
+			if len(values) == 0 {
+				continue
+			}
+			switch cfg.name(attr) {
+			case cfg.EmailAttribute:
+				profile.Email = values[0]
+			case cfg.NameAttribute:
+				profile.Name = values[0]
+			case cfg.GroupsAttribute:
+				profile.Groups = append(profile.Groups, values...)
+			}
+		}
+	}
+	return profile
+}
+
+// name matches an attribute by its URI name or, failing that, its friendly
+// name, so configs can say "email" for IdPs that send both.
+func (s SAMLConfig) name(attr saml.Attribute) string {
+	for _, want := range []string{s.EmailAttribute, s.NameAttribute, s.GroupsAttribute} {
+		if attr.Name == want {
+			return want
+		}
+	}
+	return attr.FriendlyName
+}
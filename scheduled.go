@@ -0,0 +1,101 @@
+package tango
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A session created with a startAt stays scheduled and refuses joins until
+// that time, when the session-start job opens it. Its creator is reminded
+// SESSION_REMINDER_SECONDS beforehand.
+
+var errStartInPast = errors.New("startAt must be in the future")
+
+// startPending reports whether session is waiting for its start time.
+// Callers must hold session.mu.
+func (s *Session) startPending(now int64) bool {
+	return s.Status == SessionScheduled && s.StartAt > now
+}
+
+// startsIn is the number of seconds until startAt, rounded up.
+func startsIn(startAt int64) int64 {
+	if n := startAt - getCurrentTimestamp(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// openSession starts a scheduled session. Callers must hold session.mu.
+func openSession(session *Session, now int64) {
+	session.Status = SessionLive
+	session.IdleSince = now
+	emitEvent(EventSessionStarted, session)
+}
+
+// reschedule moves a scheduled session's start to startAt. Zero opens a
+// session that is waiting for its start right away. Callers must hold
+// session.mu.
+func reschedule(session *Session, startAt int64) {
+	now := getCurrentTimestamp()
+	session.RemindedAt = 0
+	if startAt != 0 {
+		session.StartAt = startAt
+		session.IdleSince = 0
+		return
+	}
+	if session.startPending(now) {
+		session.StartAt = now
+		openSession(session, now)
+	}
+}
+
+type sessionReminder struct {
+	userID    string
+	sessionID string
+	name      string
+	startAt   int64
+}
+
+// startScheduledSessions opens the sessions whose start time has come and
+// reminds the creators of those about to start.
+func startScheduledSessions(now int64) (started, reminded int) {
+	var reminders []sessionReminder
+
+	store.mu.RLock()
+	for _, session := range store.Sessions {
+		session.mu.Lock()
+		switch {
+		case session.Status != SessionScheduled || session.StartAt == 0:
+		case session.StartAt <= now:
+			openSession(session, now)
+			audit.Record(ActorSystem, "session.start", "session", session.ID, "", gin.H{"startAt": session.StartAt})
+			started++
+		case session.RemindedAt == 0 && config.ReminderLead > 0 && session.StartAt-now <= int64(config.ReminderLead):
+			session.RemindedAt = now
+			emitEvent(EventSessionReminder, session)
+			if session.CreatedBy != "" {
+				reminders = append(reminders, sessionReminder{session.CreatedBy, session.ID, session.Name, session.StartAt})
+			}
+			reminded++
+		}
+		session.mu.Unlock()
+	}
+	store.mu.RUnlock()
+
+	for _, r := range reminders {
+		minutes := (r.startAt - now + 59) / 60
+		text := r.name + " starts in " + strconv.FormatInt(minutes, 10) + " minutes"
+		if minutes == 1 {
+			text = r.name + " starts in a minute"
+		}
+		notifications.Notify(r.userID, Notification{
+			Type:      NotifyReminder,
+			Text:      text,
+			SessionID: r.sessionID,
+			Data:      gin.H{"startAt": r.startAt},
+		})
+	}
+	return started, reminded
+}
@@ -0,0 +1,276 @@
+package tango
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	JobSessionExpiry = "session-expiry"
+	JobSessionStart  = "session-start"
+	JobRetention     = "retention"
+	JobSweep         = "sweep"
+	JobStatsRollup   = "stats-rollup"
+	JobEmailDigest   = "email-digest"
+)
+
+// defaultSchedules gives each job its schedule when the config does not.
+// Its keys are the jobs there are.
+func defaultSchedules(cfg *Config) map[string]string {
+	return map[string]string{
+		JobSessionExpiry: "@every 30s",
+		JobSessionStart:  "@every 10s",
+		JobRetention:     "@every 30s",
+		JobSweep:         "@every " + cfg.SweepInterval().String(),
+		JobStatsRollup:   "@daily",
+		JobEmailDigest:   "@daily",
+	}
+}
+
+// ScheduledJob is a background task run on a cron schedule. Leader-only
+// jobs change shared state, so only the leader runs them: the holder of
+// the scheduler lease when instances elect one, and otherwise the
+// replication primary or the only instance. A standby never leads until it
+// is promoted.
+type ScheduledJob struct {
+	Name       string  `json:"name"`
+	Schedule   string  `json:"schedule"`
+	LeaderOnly bool    `json:"leaderOnly"`
+	Running    bool    `json:"running"`
+	Runs       int64   `json:"runs"`
+	Failures   int64   `json:"failures"`
+	NextRun    int64   `json:"nextRun,omitempty"`
+	LastRun    *JobRun `json:"lastRun,omitempty"`
+
+	run      func(now int64) (gin.H, error)
+	schedule cronSchedule
+}
+
+type JobRun struct {
+	Trigger    string `json:"trigger"`
+	StartedAt  int64  `json:"startedAt"`
+	DurationMs int64  `json:"durationMs"`
+	Result     gin.H  `json:"result,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type Scheduler struct {
+	jobs map[string]*ScheduledJob
+	mu   sync.Mutex
+}
+
+var scheduler = &Scheduler{jobs: make(map[string]*ScheduledJob)}
+
+var errJobRunning = errors.New("job is already running")
+
+func init() {
+	scheduler.register(JobSessionExpiry, true, func(now int64) (gin.H, error) {
+		expired, purged, purgedGuides := expireIdleSessions(now), purgeTrash(now), purgeTrashedGuides(now)
+		if expired > 0 {
+			logger.Info("expired idle sessions", "count", expired)
+		}
+		if purged > 0 {
+			logger.Info("purged trashed sessions", "count", purged)
+		}
+		if purgedGuides > 0 {
+			logger.Info("purged trashed guides", "count", purgedGuides)
+		}
+		return gin.H{"expired": expired, "purged": purged, "purgedGuides": purgedGuides}, nil
+	})
+	scheduler.register(JobSessionStart, true, func(now int64) (gin.H, error) {
+		started, reminded := startScheduledSessions(now)
+		if started > 0 {
+			logger.Info("started scheduled sessions", "count", started)
+		}
+		return gin.H{"started": started, "reminded": reminded}, nil
+	})
+	scheduler.register(JobRetention, true, func(now int64) (gin.H, error) {
+		purged, deleted := runRetention(now), runAccountDeletions(now)
+		if purged > 0 {
+			logger.Info("purged sessions under retention policies", "count", purged)
+		}
+		if deleted > 0 {
+			logger.Info("deleted accounts", "count", deleted)
+		}
+		exports.prune(now, "")
+		guideExports.prune(now, "")
+		return gin.H{"purged": purged, "accountsDeleted": deleted}, nil
+	})
+	scheduler.register(JobSweep, false, func(int64) (gin.H, error) {
+		report := sweeper.Run(false)
+		logger.Debug("sweep finished", "repairs", report.Repairs)
+		return gin.H{"repairs": report.Repairs}, nil
+	})
+	scheduler.register(JobStatsRollup, false, func(int64) (gin.H, error) {
+		// Opens the new day even if nothing happens in it, carrying over
+		// the clients still connected, and drops days past the window.
+		day := analytics.today()
+		store.mu.RLock()
+		clients := len(store.Clients)
+		store.mu.RUnlock()
+		day.observePeak(clients)
+		return gin.H{"date": day.stats.Date}, nil
+	})
+	scheduler.register(JobEmailDigest, true, func(now int64) (gin.H, error) {
+		return gin.H{"sent": sendDigests(now)}, nil
+	})
+}
+
+func (s *Scheduler) register(name string, leaderOnly bool, run func(now int64) (gin.H, error)) {
+	s.jobs[name] = &ScheduledJob{Name: name, LeaderOnly: leaderOnly, run: run}
+}
+
+func isLeader() bool {
+	if replicator.IsStandby() {
+		return false
+	}
+	return leaderElection == nil || leaderElection.IsLeader()
+}
+
+// startScheduler runs every job on its configured schedule.
+func startScheduler(cfg *Config) {
+	defaults := defaultSchedules(cfg)
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	for name, job := range scheduler.jobs {
+		job.Schedule = defaults[name]
+		if schedule := cfg.Schedules[name]; schedule != "" {
+			job.Schedule = schedule
+		}
+		// Validate has already parsed it.
+		job.schedule, _ = parseCron(job.Schedule)
+		go scheduler.loop(job)
+	}
+}
+
+func (s *Scheduler) loop(job *ScheduledJob) {
+	for {
+		now := time.Now()
+		next := job.schedule.next(now)
+		if next.IsZero() {
+			logger.Warn("job schedule never fires", "job", job.Name, "schedule", job.Schedule)
+			return
+		}
+		s.mu.Lock()
+		job.NextRun = next.Unix()
+		s.mu.Unlock()
+
+		time.Sleep(time.Until(next))
+		if job.LeaderOnly && !isLeader() {
+			continue
+		}
+		if _, err := s.Run(job.Name, "schedule"); err != nil && err != errJobRunning {
+			logger.Error("scheduled job failed", "job", job.Name, "error", err)
+		}
+	}
+}
+
+// Run runs a job now, unless it is already running, and records the run.
+func (s *Scheduler) Run(name, trigger string) (*JobRun, error) {
+	s.mu.Lock()
+	job, exists := s.jobs[name]
+	if !exists {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("unknown job %q", name)
+	}
+	if job.Running {
+		s.mu.Unlock()
+		return nil, errJobRunning
+	}
+	job.Running = true
+	s.mu.Unlock()
+
+	start := time.Now()
+	result, err := job.run(start.Unix())
+	run := &JobRun{
+		Trigger:    trigger,
+		StartedAt:  start.Unix(),
+		DurationMs: time.Since(start).Milliseconds(),
+		Result:     result,
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.Running = false
+	job.Runs++
+	if err != nil {
+		job.Failures++
+	}
+	job.LastRun = run
+	return run, err
+}
+
+// validateSchedules checks the configured schedules name known jobs and
+// parse.
+func validateSchedules(cfg *Config) []string {
+	var problems []string
+	defaults := defaultSchedules(cfg)
+	for name, schedule := range cfg.Schedules {
+		if _, known := defaults[name]; !known {
+			problems = append(problems, fmt.Sprintf("no job named %q to schedule", name))
+			continue
+		}
+		if schedule == "" {
+			continue
+		}
+		if _, err := parseCron(schedule); err != nil {
+			problems = append(problems, fmt.Sprintf("schedule for %s: %v", name, err))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// scheduleEnv is the environment variable that sets a job's schedule, such
+// as SCHEDULE_SESSION_EXPIRY.
+func scheduleEnv(job string) string {
+	return "SCHEDULE_" + strings.ToUpper(strings.ReplaceAll(job, "-", "_"))
+}
+
+func getJobs(c *gin.Context) {
+	scheduler.mu.Lock()
+	jobs := make([]ScheduledJob, 0, len(scheduler.jobs))
+	for _, job := range scheduler.jobs {
+		jobs = append(jobs, *job)
+	}
+	scheduler.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	resp := gin.H{"leader": isLeader(), "jobs": jobs}
+	if leaderElection != nil {
+		resp["lease"] = leaderElection.Status()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func runJob(c *gin.Context) {
+	name := c.Param("name")
+	scheduler.mu.Lock()
+	job, exists := scheduler.jobs[name]
+	scheduler.mu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if job.LeaderOnly && !isLeader() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only the leader runs this job"})
+		return
+	}
+
+	auditRequest(c, "job.run", "job", name, nil)
+	run, err := scheduler.Run(name, "manual")
+	if err == errJobRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is already running"})
+		return
+	}
+	c.JSON(http.StatusOK, run)
+}
@@ -0,0 +1,232 @@
+package tango
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultScreenshotLinkHours = 7 * 24
+	maxLinksPerScreenshot      = 20
+)
+
+var errTooManyLinks = fmt.Errorf("a screenshot can have at most %d links", maxLinksPerScreenshot)
+
+// ScreenshotLink lets anyone holding its URL see a screenshot, with the
+// workspace's watermark, until it expires or is revoked. Only a hash of
+// the token in the URL is kept, so URL is only set when it is created.
+type ScreenshotLink struct {
+	ID           string `json:"id"`
+	SessionID    string `json:"sessionId"`
+	ScreenshotID string `json:"screenshotId"`
+	URL          string `json:"url,omitempty"`
+	CreatedBy    string `json:"createdBy,omitempty"`
+	CreatedAt    int64  `json:"createdAt"`
+	ExpiresAt    int64  `json:"expiresAt"`
+}
+
+// ScreenshotLinkStore keeps links by the hash of their token.
+type ScreenshotLinkStore struct {
+	links map[string]*ScreenshotLink
+	mu    sync.Mutex
+}
+
+var screenshotLinks = &ScreenshotLinkStore{links: make(map[string]*ScreenshotLink)}
+
+// create registers link under a new token, which it returns. Expired links
+// are dropped on the way.
+func (s *ScreenshotLinkStore) create(link *ScreenshotLink) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for hash, other := range s.links {
+		if other.ExpiresAt <= link.CreatedAt {
+			delete(s.links, hash)
+		} else if other.SessionID == link.SessionID && other.ScreenshotID == link.ScreenshotID {
+			count++
+		}
+	}
+	if count >= maxLinksPerScreenshot {
+		return "", errTooManyLinks
+	}
+	token := randomToken(24)
+	s.links[hashToken(token)] = link
+	return token, nil
+}
+
+func (s *ScreenshotLinkStore) byToken(token string) (ScreenshotLink, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, exists := s.links[hashToken(token)]
+	if !exists || link.ExpiresAt <= getCurrentTimestamp() {
+		return ScreenshotLink{}, false
+	}
+	return *link, true
+}
+
+// list returns a screenshot's live links, oldest first.
+func (s *ScreenshotLinkStore) list(sessionID, screenshotID string) []ScreenshotLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := getCurrentTimestamp()
+	list := []ScreenshotLink{}
+	for _, link := range s.links {
+		if link.SessionID == sessionID && link.ScreenshotID == screenshotID && link.ExpiresAt > now {
+			list = append(list, *link)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt < list[j].CreatedAt })
+	return list
+}
+
+func (s *ScreenshotLinkStore) revoke(sessionID, screenshotID, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, link := range s.links {
+		if link.ID == id && link.SessionID == sessionID && link.ScreenshotID == screenshotID {
+			delete(s.links, hash)
+			return true
+		}
+	}
+	return false
+}
+
+// forget revokes the links to the given screenshots of a session, or to
+// all of them if none are given.
+func (s *ScreenshotLinkStore) forget(sessionID string, screenshotIDs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, link := range s.links {
+		if link.SessionID == sessionID && (len(screenshotIDs) == 0 || containsString(screenshotIDs, link.ScreenshotID)) {
+			delete(s.links, hash)
+		}
+	}
+}
+
+type CreateScreenshotLinkRequest struct {
+	ExpiresInHours int `json:"expiresInHours" binding:"omitempty,min=1,max=720"`
+}
+
+func createScreenshotLink(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	var req CreateScreenshotLinkRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	shot, exists := screenshots.find(session.ID, c.Param("screenshotId"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Screenshot not found"})
+		return
+	}
+	if shot.Encrypted {
+		rejectEncrypted(c, "screenshot_links")
+		return
+	}
+	if req.ExpiresInHours == 0 {
+		req.ExpiresInHours = defaultScreenshotLinkHours
+	}
+	now := getCurrentTimestamp()
+	link := &ScreenshotLink{
+		ID:           generateID(),
+		SessionID:    session.ID,
+		ScreenshotID: shot.ID,
+		CreatedBy:    user.ID,
+		CreatedAt:    now,
+		ExpiresAt:    now + int64(time.Duration(req.ExpiresInHours)*time.Hour/time.Second),
+	}
+	token, err := screenshotLinks.create(link)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	auditRequest(c, "screenshot.link.create", "screenshot", shot.ID, gin.H{"sessionId": session.ID, "linkId": link.ID, "expiresAt": link.ExpiresAt})
+	created := *link
+	created.URL = requestOrigin(c) + apiPrefix + "/shared/screenshots/" + token
+	c.JSON(http.StatusCreated, created)
+}
+
+func getScreenshotLinks(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	if _, exists := screenshots.find(session.ID, c.Param("screenshotId")); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Screenshot not found"})
+		return
+	}
+	c.JSON(http.StatusOK, screenshotLinks.list(session.ID, c.Param("screenshotId")))
+}
+
+func revokeScreenshotLink(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	if !screenshotLinks.revoke(session.ID, c.Param("screenshotId"), c.Param("linkId")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Link not found"})
+		return
+	}
+	auditRequest(c, "screenshot.link.revoke", "screenshot", c.Param("screenshotId"), gin.H{"sessionId": session.ID, "linkId": c.Param("linkId")})
+	c.Status(http.StatusNoContent)
+}
+
+// getSharedScreenshot serves a screenshot to whoever holds a link to it,
+// which is the credential, watermarked for the session's workspace.
+func getSharedScreenshot(c *gin.Context) {
+	link, exists := screenshotLinks.byToken(c.Param("token"))
+	var session *Session
+	if exists {
+		session, _ = store.session(link.SessionID)
+	}
+	var shot Screenshot
+	if session != nil {
+		shot, exists = screenshots.find(session.ID, link.ScreenshotID)
+	}
+	if session == nil || !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Screenshot not found"})
+		return
+	}
+	session.mu.Lock()
+	trashed, workspaceID := session.Status == SessionTrashed, session.WorkspaceID
+	session.mu.Unlock()
+	if trashed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Screenshot not found"})
+		return
+	}
+
+	data, err := blobs.Get(c.Request.Context(), shot.blobKey())
+	if errors.Is(err, ErrBlobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Screenshot not found"})
+		return
+	}
+	if watermark := workspaceWatermark(workspaceID); err == nil && watermark != nil {
+		data, err = watermarkImage(data, watermark)
+	}
+	if err != nil {
+		logger.Error("reading shared screenshot failed", "screenshot", shot.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The screenshot could not be read"})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Data(http.StatusOK, shot.ContentType, data)
+}
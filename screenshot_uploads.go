@@ -0,0 +1,228 @@
+package tango
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// directUploadGrace is how long after its URL expires an unclaimed upload
+// is kept, so an upload that started just in time can still finish.
+const directUploadGrace = 5 * time.Minute
+
+// DirectUpload is a screenshot a client puts straight into blob storage
+// with a signed URL, sending Headers along, and claims once it is there.
+// Its storage is reserved from when it is started until it is claimed or
+// given up.
+type DirectUpload struct {
+	ID        string            `json:"id"`
+	SessionID string            `json:"sessionId"`
+	URL       string            `json:"url"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	Size      int               `json:"size"`
+	ExpiresAt int64             `json:"expiresAt"`
+
+	pageURL, selector  string
+	uploadedBy         string
+	owner, workspaceID string
+}
+
+// blobKey is where the image goes: the key of the screenshot it becomes.
+func (u *DirectUpload) blobKey() string {
+	return (&Screenshot{ID: u.ID, SessionID: u.SessionID}).blobKey()
+}
+
+type DirectUploadStore struct {
+	uploads map[string]*DirectUpload
+	mu      sync.Mutex
+}
+
+var directUploads = &DirectUploadStore{uploads: make(map[string]*DirectUpload)}
+
+func (s *DirectUploadStore) find(sessionID, id string) (*DirectUpload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, exists := s.uploads[id]
+	if !exists || upload.SessionID != sessionID {
+		return nil, false
+	}
+	return upload, true
+}
+
+// take removes an upload, reporting whether it was still pending.
+func (s *DirectUploadStore) take(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.uploads[id]
+	delete(s.uploads, id)
+	return exists
+}
+
+// abandon gives up an upload that was taken: its storage goes back and its
+// blob, if any, is deleted.
+func (u *DirectUpload) abandon() {
+	meter.releaseStorage(u.owner, u.workspaceID, int64(u.Size))
+	if err := blobs.Delete(context.Background(), u.blobKey()); err != nil {
+		logger.Warn("deleting abandoned upload failed", "upload", u.ID, "error", err)
+	}
+}
+
+type DirectUploadRequest struct {
+	ContentType string `json:"contentType" binding:"required,oneof=image/png image/jpeg"`
+	Size        int    `json:"size" binding:"required,min=1"`
+	URL         string `json:"url"`
+	Selector    string `json:"selector"`
+}
+
+// startScreenshotUpload hands out a signed URL to upload a screenshot of
+// the given size and type to, and reserves its storage. Uploads that are
+// not claimed in time are deleted.
+func startScreenshotUpload(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	var req DirectUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkScreenshotSource(c, req.URL, req.Selector) {
+		return
+	}
+	if session.E2EE {
+		rejectEncrypted(c, "direct_uploads")
+		return
+	}
+	if req.Size > maxScreenshotBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Screenshots must be at most %d bytes", maxScreenshotBytes)})
+		return
+	}
+	signer, ok := blobs.(URLSigner)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Direct uploads need S3, Cloud Storage or Azure blob storage; upload the image to the screenshots endpoint instead"})
+		return
+	}
+
+	session.mu.Lock()
+	trashed := session.Status == SessionTrashed
+	owner, workspaceID := session.CreatedBy, session.WorkspaceID
+	session.mu.Unlock()
+	if trashed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	upload := &DirectUpload{
+		ID:          generateID(),
+		SessionID:   session.ID,
+		Method:      http.MethodPut,
+		Size:        req.Size,
+		ExpiresAt:   time.Now().Add(signedURLs()).Unix(),
+		pageURL:     req.URL,
+		selector:    req.Selector,
+		owner:       owner,
+		workspaceID: workspaceID,
+	}
+	if user := currentUser(c); user != nil {
+		upload.uploadedBy = user.ID
+	}
+	var err error
+	upload.URL, upload.Headers, err = signer.SignURL(upload.blobKey(), URLOptions{
+		Method:      http.MethodPut,
+		ContentType: req.ContentType,
+		Expires:     signedURLs(),
+	})
+	if err != nil {
+		logger.Error("signing upload url failed", "session", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The upload could not be prepared"})
+		return
+	}
+	if breach := meter.reserveStorage(owner, workspaceID, int64(req.Size)); breach != nil {
+		rejectQuota(c, breach)
+		return
+	}
+
+	directUploads.mu.Lock()
+	directUploads.uploads[upload.ID] = upload
+	directUploads.mu.Unlock()
+	time.AfterFunc(signedURLs()+directUploadGrace, func() {
+		if directUploads.take(upload.ID) {
+			upload.abandon()
+		}
+	})
+	c.JSON(http.StatusCreated, upload)
+}
+
+// claimScreenshotUpload turns a finished upload into a screenshot. The
+// image is checked as if it had been sent to the server; one that does not
+// pass is deleted.
+func claimScreenshotUpload(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	session.mu.Lock()
+	trashed := session.Status == SessionTrashed
+	session.mu.Unlock()
+	if trashed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	upload, exists := directUploads.find(session.ID, c.Param("uploadId"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	data, err := blobs.Get(c.Request.Context(), upload.blobKey())
+	if errors.Is(err, ErrBlobNotFound) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Nothing has been uploaded yet"})
+		return
+	}
+	if err != nil {
+		logger.Error("reading upload failed", "upload", upload.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The upload could not be read"})
+		return
+	}
+	if !directUploads.take(upload.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	if len(data) != upload.Size {
+		upload.abandon()
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The upload is %d bytes, not the %d it was started with", len(data), upload.Size)})
+		return
+	}
+	contentType, bounds, ok := checkScreenshotImage(c, data)
+	if !ok {
+		upload.abandon()
+		return
+	}
+	if settler, ok := blobs.(blobSettler); ok {
+		if err := settler.settle(c.Request.Context(), upload.blobKey(), data); err != nil {
+			logger.Warn("settling upload failed", "upload", upload.ID, "error", err)
+		}
+	}
+
+	shot := &Screenshot{
+		ID:          upload.ID,
+		SessionID:   session.ID,
+		ContentType: contentType,
+		Size:        upload.Size,
+		Width:       bounds.Width,
+		Height:      bounds.Height,
+		PageURL:     upload.pageURL,
+		Selector:    upload.selector,
+		UploadedBy:  upload.uploadedBy,
+		CreatedAt:   getCurrentTimestamp(),
+	}
+	addScreenshot(c, session, shot, upload.owner, upload.workspaceID)
+}
@@ -0,0 +1,414 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	OCRPending = "pending"
+	OCRDone    = "done"
+	OCRFailed  = "failed"
+
+	maxScreenshotBytes       = 10 << 20
+	maxScreenshotsPerSession = 500
+	maxScreenshotURLBytes    = 2048
+	maxSelectorBytes         = 500
+	maxScreenshotTitleBytes  = 200
+	maxScreenshotDescBytes   = 2000
+)
+
+var errTooManyScreenshots = fmt.Errorf("a session can have at most %d screenshots", maxScreenshotsPerSession)
+
+// Screenshot is an image uploaded to a session. Its bytes are kept in the
+// BlobStore and count towards the storage quota of the session's owner and
+// workspace. PageURL and Selector say where it was taken, if the uploader
+// knew. With OCR configured, the text read from it is searchable with the
+// session, as are its title and description.
+type Screenshot struct {
+	ID          string `json:"id"`
+	SessionID   string `json:"sessionId"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	PageURL     string `json:"pageUrl,omitempty"`
+	Selector    string `json:"selector,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	UploadedBy  string `json:"uploadedBy,omitempty"`
+	CreatedAt   int64  `json:"createdAt"`
+	OCRStatus   string `json:"ocrStatus,omitempty"`
+	Text        string `json:"text,omitempty"`
+	// Encrypted is set for screenshots of end-to-end encrypted sessions,
+	// whose bytes the server cannot read.
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+func (s *Screenshot) blobKey() string {
+	return "screenshots/" + s.SessionID + "/" + s.ID
+}
+
+// ScreenshotStore keeps each session's screenshots, oldest first.
+type ScreenshotStore struct {
+	shots map[string][]*Screenshot
+	mu    sync.Mutex
+}
+
+var screenshots = &ScreenshotStore{shots: make(map[string][]*Screenshot)}
+
+func (s *ScreenshotStore) add(shot *Screenshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.shots[shot.SessionID]) >= maxScreenshotsPerSession {
+		return errTooManyScreenshots
+	}
+	s.shots[shot.SessionID] = append(s.shots[shot.SessionID], shot)
+	return nil
+}
+
+func (s *ScreenshotStore) find(sessionID, id string) (Screenshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, shot := range s.shots[sessionID] {
+		if shot.ID == id {
+			return *shot, true
+		}
+	}
+	return Screenshot{}, false
+}
+
+// update applies change to a screenshot and returns the result.
+func (s *ScreenshotStore) update(sessionID, id string, change func(*Screenshot)) (Screenshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, shot := range s.shots[sessionID] {
+		if shot.ID == id {
+			change(shot)
+			return *shot, true
+		}
+	}
+	return Screenshot{}, false
+}
+
+func (s *ScreenshotStore) remove(sessionID, id string) (Screenshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shots := s.shots[sessionID]
+	for i, shot := range shots {
+		if shot.ID == id {
+			s.shots[sessionID] = append(shots[:i:i], shots[i+1:]...)
+			return *shot, true
+		}
+	}
+	return Screenshot{}, false
+}
+
+func (s *ScreenshotStore) List(sessionID string) []Screenshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []Screenshot{}
+	for _, shot := range s.shots[sessionID] {
+		list = append(list, *shot)
+	}
+	return list
+}
+
+// Text returns the titles, descriptions and text read from a session's
+// screenshots for the search index.
+func (s *ScreenshotStore) Text(sessionID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var texts []string
+	for _, shot := range s.shots[sessionID] {
+		for _, text := range []string{shot.Title, shot.Description, shot.Text} {
+			if text != "" {
+				texts = append(texts, text)
+			}
+		}
+	}
+	return strings.Join(texts, " ")
+}
+
+// Forget drops session's screenshots, deleting their blobs and giving
+// their storage back. Callers must hold session.mu.
+func (s *ScreenshotStore) Forget(session *Session) {
+	s.mu.Lock()
+	shots := s.shots[session.ID]
+	delete(s.shots, session.ID)
+	s.mu.Unlock()
+	screenshotLinks.forget(session.ID)
+
+	var size int64
+	for _, shot := range shots {
+		size += int64(shot.Size)
+	}
+	if size > 0 {
+		meter.releaseStorage(session.CreatedBy, session.WorkspaceID, size)
+	}
+	if len(shots) > 0 {
+		keys := make([]string, len(shots))
+		for i, shot := range shots {
+			keys[i] = shot.blobKey()
+		}
+		imageVariants.Forget(keys...)
+		go func() {
+			for _, shot := range shots {
+				if err := blobs.Delete(context.Background(), shot.blobKey()); err != nil {
+					logger.Warn("deleting screenshot failed", "screenshot", shot.ID, "error", err)
+				}
+			}
+		}()
+	}
+}
+
+// finishOCR records what OCR made of a screenshot and makes the text
+// searchable.
+func finishOCR(job ocrJob, text string, err error) {
+	shot, exists := screenshots.update(job.sessionID, job.screenshotID, func(shot *Screenshot) {
+		shot.OCRStatus, shot.Text = OCRDone, text
+		if err != nil {
+			shot.OCRStatus, shot.Text = OCRFailed, ""
+		}
+	})
+	if !exists {
+		return
+	}
+	broadcastToSession(nil, job.sessionID, Message{Type: "screenshot", Payload: shot}, "")
+	if session, exists := store.session(job.sessionID); exists && shot.Text != "" {
+		reindexSession(session)
+	}
+}
+
+// uploadScreenshot takes a PNG or JPEG image as the request body, and
+// where it was taken from the url and selector query parameters. In an
+// end-to-end encrypted session the body is the encrypted image, taken as
+// it is.
+func uploadScreenshot(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	pageURL, selector := c.Query("url"), c.Query("selector")
+	if !checkScreenshotSource(c, pageURL, selector) {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxScreenshotBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read the image"})
+		return
+	}
+	if len(data) > maxScreenshotBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Screenshots must be at most %d bytes", maxScreenshotBytes)})
+		return
+	}
+	contentType, bounds, ok := encryptedContentType, image.Config{}, true
+	if !session.E2EE {
+		contentType, bounds, ok = checkScreenshotImage(c, data)
+	}
+	if !ok {
+		return
+	}
+
+	session.mu.Lock()
+	trashed := session.Status == SessionTrashed
+	owner, workspaceID := session.CreatedBy, session.WorkspaceID
+	session.mu.Unlock()
+	if trashed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if breach := meter.reserveStorage(owner, workspaceID, int64(len(data))); breach != nil {
+		rejectQuota(c, breach)
+		return
+	}
+
+	shot := &Screenshot{
+		ID:          generateID(),
+		SessionID:   session.ID,
+		ContentType: contentType,
+		Size:        len(data),
+		Width:       bounds.Width,
+		Height:      bounds.Height,
+		PageURL:     pageURL,
+		Selector:    selector,
+		CreatedAt:   getCurrentTimestamp(),
+		Encrypted:   session.E2EE,
+	}
+	if user := currentUser(c); user != nil {
+		shot.UploadedBy = user.ID
+	}
+	if err := blobs.Put(c.Request.Context(), shot.blobKey(), data); err != nil {
+		meter.releaseStorage(owner, workspaceID, int64(len(data)))
+		logger.Error("storing screenshot failed", "session", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The screenshot could not be stored"})
+		return
+	}
+	addScreenshot(c, session, shot, owner, workspaceID)
+}
+
+func checkScreenshotSource(c *gin.Context, pageURL, selector string) bool {
+	if len(pageURL) > maxScreenshotURLBytes || len(selector) > maxSelectorBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("url must be at most %d bytes and selector at most %d", maxScreenshotURLBytes, maxSelectorBytes)})
+		return false
+	}
+	return true
+}
+
+// checkScreenshotImage responds unless data is a PNG or JPEG image, and
+// returns its type and size.
+func checkScreenshotImage(c *gin.Context, data []byte) (string, image.Config, bool) {
+	contentType := http.DetectContentType(data)
+	if contentType != "image/png" && contentType != "image/jpeg" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Screenshots must be PNG or JPEG images"})
+		return "", image.Config{}, false
+	}
+	bounds, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The image could not be decoded"})
+		return "", image.Config{}, false
+	}
+	return contentType, bounds, true
+}
+
+// addScreenshot adds shot, whose image is stored and whose storage is
+// reserved, to session and announces it. If the session is full, the
+// storage and blob are given back.
+func addScreenshot(c *gin.Context, session *Session, shot *Screenshot, owner, workspaceID string) {
+	if ocrEnabled() && !shot.Encrypted {
+		shot.OCRStatus = OCRPending
+	}
+	created := *shot
+	if err := screenshots.add(shot); err != nil {
+		meter.releaseStorage(owner, workspaceID, int64(shot.Size))
+		blobs.Delete(context.Background(), shot.blobKey())
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if shot.OCRStatus == OCRPending && queueOCR(session.ID, shot.ID) != nil {
+		created, _ = screenshots.update(session.ID, shot.ID, func(shot *Screenshot) { shot.OCRStatus = OCRFailed })
+	}
+
+	auditRequest(c, "screenshot.upload", "screenshot", shot.ID, gin.H{"sessionId": session.ID, "size": shot.Size})
+	broadcastToSession(requestSpan(c), session.ID, Message{Type: "screenshot", Payload: created}, "")
+	c.JSON(http.StatusCreated, created)
+}
+
+func getScreenshots(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"screenshots": screenshots.List(session.ID)})
+}
+
+type UpdateScreenshotRequest struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+}
+
+func updateScreenshot(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	var req UpdateScreenshotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Title != nil && len(*req.Title) > maxScreenshotTitleBytes || req.Description != nil && len(*req.Description) > maxScreenshotDescBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("title must be at most %d bytes and description at most %d", maxScreenshotTitleBytes, maxScreenshotDescBytes)})
+		return
+	}
+	shot, exists := screenshots.update(session.ID, c.Param("screenshotId"), func(shot *Screenshot) {
+		if req.Title != nil {
+			shot.Title = strings.TrimSpace(*req.Title)
+		}
+		if req.Description != nil {
+			shot.Description = strings.TrimSpace(*req.Description)
+		}
+	})
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Screenshot not found"})
+		return
+	}
+	broadcastToSession(requestSpan(c), session.ID, Message{Type: "screenshot", Payload: shot}, "")
+	reindexSession(session)
+	c.JSON(http.StatusOK, shot)
+}
+
+func getScreenshotImage(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	shot, exists := screenshots.find(session.ID, c.Param("screenshotId"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Screenshot not found"})
+		return
+	}
+	key, contentType := shot.blobKey(), shot.ContentType
+	if !shot.Encrypted {
+		key, contentType = negotiateImage(c, key, contentType)
+	}
+	if redirectToBlob(c, key, contentType, "") {
+		return
+	}
+	data, err := blobs.Get(c.Request.Context(), key)
+	if errors.Is(err, ErrBlobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Screenshot not found"})
+		return
+	}
+	if err != nil {
+		logger.Error("reading screenshot failed", "screenshot", shot.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The screenshot could not be read"})
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Data(http.StatusOK, contentType, data)
+}
+
+func deleteScreenshot(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	shot, exists := screenshots.remove(session.ID, c.Param("screenshotId"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Screenshot not found"})
+		return
+	}
+	session.mu.Lock()
+	owner, workspaceID := session.CreatedBy, session.WorkspaceID
+	session.mu.Unlock()
+	meter.releaseStorage(owner, workspaceID, int64(shot.Size))
+	if err := blobs.Delete(c.Request.Context(), shot.blobKey()); err != nil {
+		logger.Warn("deleting screenshot failed", "screenshot", shot.ID, "error", err)
+	}
+	imageVariants.Forget(shot.blobKey())
+	screenshotLinks.forget(session.ID, shot.ID)
+
+	auditRequest(c, "screenshot.delete", "screenshot", shot.ID, gin.H{"sessionId": session.ID})
+	broadcastToSession(requestSpan(c), session.ID, Message{Type: "screenshot_deleted", Payload: gin.H{"screenshotId": shot.ID}}, "")
+	if shot.Text != "" {
+		reindexSession(session)
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,538 @@
+package tango
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SearchSession = "session"
+	SearchGuide   = "guide"
+
+	defaultSearchPage = 20
+	maxSearchPage     = 100
+	searchSnippetLen  = 160
+)
+
+// searchTypes are the kinds of document the index holds.
+var searchTypes = map[string]bool{SearchSession: true, SearchGuide: true}
+
+// SearchResult is one document matching a search. Highlights holds, for
+// each field with a match, an HTML-escaped snippet of it with the matching
+// terms wrapped in <mark>.
+type SearchResult struct {
+	Type        string            `json:"type"`
+	ID          string            `json:"id"`
+	Title       string            `json:"title"`
+	WorkspaceID string            `json:"workspaceId,omitempty"`
+	Score       float64           `json:"score"`
+	Highlights  map[string]string `json:"highlights"`
+}
+
+type searchField struct {
+	name   string
+	text   string
+	weight float64
+}
+
+type searchDoc struct {
+	docType     string
+	id          string
+	title       string
+	workspaceID string
+	// ownerID is who may find a personal guide, one outside any
+	// workspace.
+	ownerID string
+	// tags and collectionID are what searches can be narrowed by.
+	tags         []string
+	collectionID string
+	fields       []searchField
+	// terms holds each term's frequency, weighted by the fields it is in.
+	terms map[string]float64
+}
+
+// searchBackend holds the text of sessions and guides and answers
+// searches over it. Sessions are kept up to date from lifecycle events and
+// rebuilt from the store when sessions are restored; guides are indexed as
+// the registry changes them. The index is kept in memory unless a Postgres
+// database is configured for it.
+type searchBackend interface {
+	// Put adds doc, replacing any earlier version of it.
+	Put(doc *searchDoc)
+	Remove(docType, id string)
+	// ReplaceSessions replaces every session in the index with docs.
+	ReplaceSessions(docs []*searchDoc)
+	// Search returns the documents of the given types, or of any type
+	// when none are given, that contain every term of q and that visible
+	// accepts, best match first. total counts every match, not just the
+	// page returned.
+	Search(q string, types map[string]bool, visible func(doc *searchDoc) bool, offset, limit int) (results []SearchResult, total int, err error)
+}
+
+var searchIndex searchBackend = NewMemorySearchIndex()
+
+// startSearch moves the index to Postgres when cfg names a database.
+func startSearch(cfg SearchConfig) error {
+	if cfg.DatabaseURL == "" {
+		return nil
+	}
+	index, err := OpenPostgresSearchIndex(cfg.DatabaseURL, cfg.Language)
+	if err != nil {
+		return err
+	}
+	searchIndex = index
+	return nil
+}
+
+// stopSearch writes the index changes still queued, until ctx is done.
+func stopSearch(ctx context.Context) {
+	if index, ok := searchIndex.(*PostgresSearchIndex); ok {
+		index.Close(ctx)
+	}
+}
+
+// MemorySearchIndex is an inverted index kept in memory.
+type MemorySearchIndex struct {
+	docs     map[string]*searchDoc
+	postings map[string]map[string]bool
+	mu       sync.RWMutex
+}
+
+func NewMemorySearchIndex() *MemorySearchIndex {
+	return &MemorySearchIndex{
+		docs:     make(map[string]*searchDoc),
+		postings: make(map[string]map[string]bool),
+	}
+}
+
+func init() {
+	eventFeed.listen(func(event string, payload interface{}) {
+		switch event {
+		case EventSessionTrashed, EventSessionDeleted, EventSessionExpired:
+			searchIndex.Remove(SearchSession, eventSessionID(payload))
+		default:
+			if session, ok := payload.(*Session); ok {
+				searchIndex.Put(sessionSearchDoc(session))
+			}
+		}
+	})
+}
+
+// reindexSession updates session's entry after a change that emits no
+// event, such as new captions, unless it has since been removed.
+func reindexSession(session *Session) {
+	if current, exists := store.session(session.ID); !exists || current != session {
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.Status != SessionTrashed {
+		searchIndex.Put(sessionSearchDoc(session))
+	}
+}
+
+// sessionSearchDoc describes session to the index. Callers must hold
+// session.mu.
+func sessionSearchDoc(session *Session) *searchDoc {
+	doc := &searchDoc{
+		docType:      SearchSession,
+		id:           session.ID,
+		title:        session.Name,
+		workspaceID:  session.WorkspaceID,
+		tags:         append([]string(nil), session.Tags...),
+		collectionID: session.CollectionID,
+		fields: []searchField{
+			{name: "name", text: session.Name, weight: 3},
+			{name: "tags", text: strings.Join(session.Tags, " "), weight: 2},
+			{name: "description", text: session.Description, weight: 1},
+			{name: "captions", text: captions.Text(session.ID), weight: 0.5},
+			{name: "chat", text: chat.Text(session.ID), weight: 0.5},
+			{name: "screenshots", text: screenshots.Text(session.ID), weight: 0.5},
+		},
+	}
+	keys := make([]string, 0, len(session.Metadata))
+	for key := range session.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		doc.fields = append(doc.fields, searchField{name: "metadata." + key, text: session.Metadata[key], weight: 1})
+	}
+	return doc
+}
+
+// guideSearchDoc describes guide to the index: its title, tags and
+// description, its steps' titles and descriptions, and the text read from
+// their images.
+func guideSearchDoc(guide *Guide) *searchDoc {
+	var steps, images []string
+	for _, step := range guide.Steps {
+		steps = append(steps, step.Title)
+		if step.Description != "" {
+			steps = append(steps, step.Description)
+		}
+		if step.Text != "" {
+			images = append(images, step.Text)
+		}
+	}
+	return &searchDoc{
+		docType:      SearchGuide,
+		id:           guide.ID,
+		title:        guide.Title,
+		workspaceID:  guide.WorkspaceID,
+		ownerID:      guide.CreatedBy,
+		tags:         append([]string(nil), guide.Tags...),
+		collectionID: guide.CollectionID,
+		fields: []searchField{
+			{name: "title", text: guide.Title, weight: 3},
+			{name: "tags", text: strings.Join(guide.Tags, " "), weight: 2},
+			{name: "description", text: guide.Description, weight: 1},
+			{name: "steps", text: strings.Join(steps, "\n"), weight: 1},
+			{name: "images", text: strings.Join(images, "\n"), weight: 0.5},
+		},
+	}
+}
+
+// reindexSessions replaces the sessions in the index with those in the
+// store.
+func reindexSessions() {
+	docs := make([]*searchDoc, 0)
+	for _, session := range store.sessionList() {
+		session.mu.Lock()
+		if session.Status != SessionTrashed {
+			docs = append(docs, sessionSearchDoc(session))
+		}
+		session.mu.Unlock()
+	}
+	searchIndex.ReplaceSessions(docs)
+}
+
+func (ix *MemorySearchIndex) ReplaceSessions(docs []*searchDoc) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for key, doc := range ix.docs {
+		if doc.docType == SearchSession {
+			ix.remove(key)
+		}
+	}
+	for _, doc := range docs {
+		ix.put(doc)
+	}
+}
+
+func searchKey(docType, id string) string {
+	return docType + "/" + id
+}
+
+func (ix *MemorySearchIndex) Put(doc *searchDoc) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.put(doc)
+}
+
+func (ix *MemorySearchIndex) put(doc *searchDoc) {
+	key := searchKey(doc.docType, doc.id)
+	ix.remove(key)
+	doc.terms = make(map[string]float64)
+	for _, field := range doc.fields {
+		for _, span := range termSpans(field.text) {
+			doc.terms[strings.ToLower(field.text[span[0]:span[1]])] += field.weight
+		}
+	}
+	for term := range doc.terms {
+		if ix.postings[term] == nil {
+			ix.postings[term] = make(map[string]bool)
+		}
+		ix.postings[term][key] = true
+	}
+	ix.docs[key] = doc
+}
+
+func (ix *MemorySearchIndex) Remove(docType, id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(searchKey(docType, id))
+}
+
+func (ix *MemorySearchIndex) remove(key string) {
+	doc, exists := ix.docs[key]
+	if !exists {
+		return
+	}
+	for term := range doc.terms {
+		delete(ix.postings[term], key)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+	delete(ix.docs, key)
+}
+
+// searchTerm is one term of a query. A prefix term, written with a
+// trailing *, matches every term it begins.
+type searchTerm struct {
+	text   string
+	prefix bool
+}
+
+func parseSearchQuery(q string) []searchTerm {
+	var terms []searchTerm
+	for _, word := range strings.Fields(q) {
+		spans := termSpans(word)
+		for i, span := range spans {
+			terms = append(terms, searchTerm{
+				text:   strings.ToLower(word[span[0]:span[1]]),
+				prefix: i == len(spans)-1 && strings.HasSuffix(word, "*"),
+			})
+		}
+	}
+	return terms
+}
+
+// Search ranks results by the weighted frequency of the terms, scaled by
+// how rare each is.
+func (ix *MemorySearchIndex) Search(q string, types map[string]bool, visible func(doc *searchDoc) bool, offset, limit int) (results []SearchResult, total int, err error) {
+	terms := parseSearchQuery(q)
+	results = []SearchResult{}
+	if len(terms) == 0 {
+		return results, 0, nil
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	// Each query term stands for the index terms it matches; a document
+	// has to contain one of them for every query term.
+	expanded := make([][]string, len(terms))
+	for i, term := range terms {
+		if !term.prefix {
+			if ix.postings[term.text] != nil {
+				expanded[i] = []string{term.text}
+			}
+		} else {
+			for indexed := range ix.postings {
+				if strings.HasPrefix(indexed, term.text) {
+					expanded[i] = append(expanded[i], indexed)
+				}
+			}
+		}
+		if len(expanded[i]) == 0 {
+			return results, 0, nil
+		}
+	}
+
+	n := float64(len(ix.docs))
+	for key, doc := range ix.docs {
+		if len(types) > 0 && !types[doc.docType] || !visible(doc) {
+			continue
+		}
+		score := 0.0
+		matched := make(map[string]bool)
+		for _, candidates := range expanded {
+			found := false
+			for _, term := range candidates {
+				if !ix.postings[term][key] {
+					continue
+				}
+				found = true
+				matched[term] = true
+				idf := math.Log(n/float64(len(ix.postings[term]))) + 1
+				score += doc.terms[term] * idf
+			}
+			if !found {
+				score = -1
+				break
+			}
+		}
+		if score < 0 {
+			continue
+		}
+		results = append(results, SearchResult{
+			Type:        doc.docType,
+			ID:          doc.id,
+			Title:       doc.title,
+			WorkspaceID: doc.workspaceID,
+			Score:       math.Round(score*1000) / 1000,
+			Highlights:  doc.highlights(matched),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].Title != results[j].Title {
+			return results[i].Title < results[j].Title
+		}
+		return results[i].ID < results[j].ID
+	})
+	results, total = pageResults(results, offset, limit)
+	return results, total, nil
+}
+
+func pageResults(results []SearchResult, offset, limit int) ([]SearchResult, int) {
+	total := len(results)
+	if offset >= total {
+		return results[:0], total
+	}
+	results = results[offset:]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, total
+}
+
+func (doc *searchDoc) highlights(matched map[string]bool) map[string]string {
+	highlights := make(map[string]string)
+	for _, field := range doc.fields {
+		if snippet, ok := highlight(field.text, matched); ok {
+			highlights[field.name] = snippet
+		}
+	}
+	return highlights
+}
+
+// highlight returns an escaped snippet of text around its first matching
+// term, with every matching term in it marked, and false if none match.
+func highlight(text string, matched map[string]bool) (string, bool) {
+	spans := termSpans(text)
+	first := -1
+	for i, span := range spans {
+		if matched[strings.ToLower(text[span[0]:span[1]])] {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return "", false
+	}
+
+	// Start a few words before the first match and stop at a word boundary
+	// once the snippet is long enough.
+	start := 0
+	if first > 4 {
+		start = spans[first-4][0]
+	}
+	end := len(text)
+	for _, span := range spans[first:] {
+		if span[1]-start > searchSnippetLen {
+			end = span[1]
+			break
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, span := range spans {
+		if span[0] < start || span[1] > end || !matched[strings.ToLower(text[span[0]:span[1]])] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:span[0]]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[span[0]:span[1]]))
+		b.WriteString("</mark>")
+		pos = span[1]
+	}
+	b.WriteString(html.EscapeString(text[pos:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+// termSpans returns the byte offsets of the terms in text: its runs of
+// letters and digits.
+func termSpans(text string) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range text {
+		inTerm := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case inTerm && start < 0:
+			start = i
+		case !inTerm && start >= 0:
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(text)})
+	}
+	return spans
+}
+
+// searchScope decides which documents a search shows: those of the
+// workspaces listingScope allows and, unless the search is narrowed to a
+// workspace, the caller's personal guides. ?tag= and ?collectionId=
+// narrow it as they do session and guide listings.
+func searchScope(c *gin.Context) func(doc *searchDoc) bool {
+	visible := listingScope(c)
+	user := currentUser(c)
+	tags, collectionID := c.QueryArray("tag"), c.Query("collectionId")
+	return func(doc *searchDoc) bool {
+		if !hasTags(doc.tags, tags) || !inCollection(doc.collectionID, collectionID) {
+			return false
+		}
+		if doc.docType == SearchGuide && doc.workspaceID == "" {
+			return user != nil && doc.ownerID == user.ID && c.Query("workspaceId") == ""
+		}
+		return visible(doc.workspaceID)
+	}
+}
+
+func runSearch(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	types := make(map[string]bool)
+	if value := c.Query("type"); value != "" {
+		for _, t := range strings.Split(value, ",") {
+			t = strings.TrimSpace(t)
+			if !searchTypes[t] {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown search type %q", t)})
+				return
+			}
+			types[t] = true
+		}
+	}
+	offset, limit := 0, defaultSearchPage
+	if value := c.Query("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative number"})
+			return
+		}
+		offset = n
+	}
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSearchPage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxSearchPage)})
+			return
+		}
+		limit = n
+	}
+
+	results, total, err := searchIndex.Search(q, types, searchScope(c), offset, limit)
+	if err != nil {
+		requestLog(c).Error("search failed", "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Search is unavailable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results, "total": total})
+}
@@ -0,0 +1,370 @@
+package tango
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const postgresSearchSchema = `
+CREATE TABLE IF NOT EXISTS tango_search (
+	doc_type      text NOT NULL,
+	id            text NOT NULL,
+	title         text NOT NULL,
+	workspace_id  text NOT NULL,
+	owner_id      text NOT NULL,
+	tags          text[] NOT NULL,
+	collection_id text NOT NULL,
+	fields        jsonb NOT NULL,
+	document      tsvector NOT NULL,
+	PRIMARY KEY (doc_type, id)
+);
+CREATE INDEX IF NOT EXISTS tango_search_document ON tango_search USING gin (document)`
+
+// Each field goes into the document with the tsvector weight class of its
+// search weight, A for titles down to D for captions, chat and OCR text.
+const postgresSearchUpsert = `
+INSERT INTO tango_search (doc_type, id, title, workspace_id, owner_id, tags, collection_id, fields, document)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8,
+	setweight(to_tsvector($9::regconfig, $10), 'A') ||
+	setweight(to_tsvector($9::regconfig, $11), 'B') ||
+	setweight(to_tsvector($9::regconfig, $12), 'C') ||
+	setweight(to_tsvector($9::regconfig, $13), 'D'))
+ON CONFLICT (doc_type, id) DO UPDATE SET
+	title = excluded.title, workspace_id = excluded.workspace_id, owner_id = excluded.owner_id,
+	tags = excluded.tags, collection_id = excluded.collection_id, fields = excluded.fields,
+	document = excluded.document`
+
+// The workspace and personal-guide checks of a search depend on the
+// caller's memberships and network, so they are made on the ranked rows
+// rather than in SQL.
+const postgresSearchQuery = `
+SELECT doc_type, id, title, workspace_id, owner_id, tags, collection_id, fields, ts_rank(document, query)
+FROM tango_search, to_tsquery($1::regconfig, $2) query
+WHERE document @@ query AND (cardinality($3::text[]) = 0 OR doc_type = ANY($3::text[]))
+ORDER BY 9 DESC, title, id`
+
+// searchChange is a write the index has yet to make: doc, or the removal
+// of docType/id when doc is nil.
+type searchChange struct {
+	docType string
+	id      string
+	doc     *searchDoc
+}
+
+// PostgresSearchIndex keeps the index in a Postgres table and searches it
+// with Postgres full-text search, so every instance shares one index that
+// outlives restarts. Changes are made from event listeners that may hold
+// session locks, so they are written in the background; only the latest
+// change to each document waits, which bounds the backlog by the number of
+// documents.
+type PostgresSearchIndex struct {
+	db       *sql.DB
+	language string
+
+	pending map[string]searchChange
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	mu      sync.Mutex
+}
+
+// OpenPostgresSearchIndex connects to the database at url and creates the
+// index table if it isn't there. language is the text search
+// configuration, such as simple or english.
+func OpenPostgresSearchIndex(url, language string) (*PostgresSearchIndex, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), outboundTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, postgresSearchSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating search table: %v", err)
+	}
+	ix := &PostgresSearchIndex{
+		db:       db,
+		language: language,
+		pending:  make(map[string]searchChange),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go ix.run()
+	return ix, nil
+}
+
+func (ix *PostgresSearchIndex) Put(doc *searchDoc) {
+	ix.queue(searchChange{docType: doc.docType, id: doc.id, doc: doc})
+}
+
+func (ix *PostgresSearchIndex) Remove(docType, id string) {
+	ix.queue(searchChange{docType: docType, id: id})
+}
+
+func (ix *PostgresSearchIndex) queue(change searchChange) {
+	ix.mu.Lock()
+	ix.pending[searchKey(change.docType, change.id)] = change
+	ix.mu.Unlock()
+	select {
+	case ix.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ReplaceSessions rewrites the sessions in one transaction, as it runs
+// when sessions are restored rather than under a lock.
+func (ix *PostgresSearchIndex) ReplaceSessions(docs []*searchDoc) {
+	err := ix.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM tango_search WHERE doc_type = $1`, SearchSession); err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err := ix.upsert(tx, doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("reindexing sessions failed", "error", err)
+	}
+}
+
+func (ix *PostgresSearchIndex) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := ix.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ix *PostgresSearchIndex) upsert(tx *sql.Tx, doc *searchDoc) error {
+	fields, err := json.Marshal(postgresFields(doc.fields))
+	if err != nil {
+		return err
+	}
+	var classes [4][]string
+	for _, field := range doc.fields {
+		class := searchWeightClass(field.weight)
+		classes[class] = append(classes[class], field.text)
+	}
+	_, err = tx.Exec(postgresSearchUpsert,
+		doc.docType, doc.id, doc.title, doc.workspaceID, doc.ownerID, pq.Array(doc.tags), doc.collectionID, string(fields),
+		ix.language,
+		strings.Join(classes[0], "\n"), strings.Join(classes[1], "\n"),
+		strings.Join(classes[2], "\n"), strings.Join(classes[3], "\n"))
+	return err
+}
+
+// searchWeightClass maps a field's weight to the tsvector weights A to D,
+// numbered from 0.
+func searchWeightClass(weight float64) int {
+	switch {
+	case weight >= 3:
+		return 0
+	case weight >= 2:
+		return 1
+	case weight >= 1:
+		return 2
+	}
+	return 3
+}
+
+// postgresField is a field as stored for highlighting.
+type postgresField struct {
+	Name   string  `json:"name"`
+	Text   string  `json:"text"`
+	Weight float64 `json:"weight"`
+}
+
+func postgresFields(fields []searchField) []postgresField {
+	stored := make([]postgresField, len(fields))
+	for i, field := range fields {
+		stored[i] = postgresField{Name: field.name, Text: field.text, Weight: field.weight}
+	}
+	return stored
+}
+
+func (ix *PostgresSearchIndex) run() {
+	defer close(ix.done)
+	for attempt := 1; ; {
+		select {
+		case <-ix.wake:
+		case <-ix.stop:
+			ix.flush()
+			return
+		}
+		if ix.flush() {
+			attempt = 1
+			continue
+		}
+		// Try again after a backoff that grows while the database stays
+		// unreachable.
+		select {
+		case ix.wake <- struct{}{}:
+		default:
+		}
+		select {
+		case <-time.After(backoff(attempt)):
+			if attempt < outboundMaxAttempts {
+				attempt++
+			}
+		case <-ix.stop:
+			ix.flush()
+			return
+		}
+	}
+}
+
+// flush writes the pending changes in one transaction and reports whether
+// it succeeded. Changes it fails to write go back to pending, unless they
+// have been superseded meanwhile.
+func (ix *PostgresSearchIndex) flush() bool {
+	ix.mu.Lock()
+	changes := ix.pending
+	ix.pending = make(map[string]searchChange)
+	ix.mu.Unlock()
+	if len(changes) == 0 {
+		return true
+	}
+
+	err := ix.withTx(func(tx *sql.Tx) error {
+		for _, change := range changes {
+			var err error
+			if change.doc != nil {
+				err = ix.upsert(tx, change.doc)
+			} else {
+				_, err = tx.Exec(`DELETE FROM tango_search WHERE doc_type = $1 AND id = $2`, change.docType, change.id)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		return true
+	}
+
+	logger.Warn("writing search index failed", "changes", len(changes), "error", err)
+	ix.mu.Lock()
+	for key, change := range changes {
+		if _, superseded := ix.pending[key]; !superseded {
+			ix.pending[key] = change
+		}
+	}
+	ix.mu.Unlock()
+	return false
+}
+
+// Close writes the changes still pending, until ctx is done, and closes
+// the database.
+func (ix *PostgresSearchIndex) Close(ctx context.Context) {
+	close(ix.stop)
+	select {
+	case <-ix.done:
+	case <-ctx.Done():
+		ix.mu.Lock()
+		logger.Warn("search index changes not written", "changes", len(ix.pending))
+		ix.mu.Unlock()
+	}
+	ix.db.Close()
+}
+
+// Search ranks results with ts_rank, which counts the terms found weighted
+// by the class of the fields they are in.
+func (ix *PostgresSearchIndex) Search(q string, types map[string]bool, visible func(doc *searchDoc) bool, offset, limit int) ([]SearchResult, int, error) {
+	terms := parseSearchQuery(q)
+	results := []SearchResult{}
+	if len(terms) == 0 {
+		return results, 0, nil
+	}
+	typeList := make([]string, 0, len(types))
+	for t := range types {
+		typeList = append(typeList, t)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), outboundTimeout)
+	defer cancel()
+	rows, err := ix.db.QueryContext(ctx, postgresSearchQuery, ix.language, postgresTSQuery(terms), pq.Array(typeList))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		doc := &searchDoc{}
+		var fields []byte
+		var rank float64
+		if err := rows.Scan(&doc.docType, &doc.id, &doc.title, &doc.workspaceID, &doc.ownerID,
+			pq.Array(&doc.tags), &doc.collectionID, &fields, &rank); err != nil {
+			return nil, 0, err
+		}
+		if !visible(doc) {
+			continue
+		}
+		var stored []postgresField
+		if err := json.Unmarshal(fields, &stored); err != nil {
+			return nil, 0, err
+		}
+		for _, field := range stored {
+			doc.fields = append(doc.fields, searchField{name: field.Name, text: field.Text, weight: field.Weight})
+		}
+		results = append(results, SearchResult{
+			Type:        doc.docType,
+			ID:          doc.id,
+			Title:       doc.title,
+			WorkspaceID: doc.workspaceID,
+			Score:       math.Round(rank*1000) / 1000,
+			Highlights:  doc.highlights(matchedTerms(doc, terms)),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	results, total := pageResults(results, offset, limit)
+	return results, total, nil
+}
+
+// postgresTSQuery writes terms as a tsquery requiring all of them. Terms
+// are runs of letters and digits, so quoting them needs no escaping.
+func postgresTSQuery(terms []searchTerm) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = "'" + term.text + "'"
+		if term.prefix {
+			parts[i] += ":*"
+		}
+	}
+	return strings.Join(parts, " & ")
+}
+
+// matchedTerms returns the terms of doc's fields that terms match, for
+// highlighting.
+func matchedTerms(doc *searchDoc, terms []searchTerm) map[string]bool {
+	matched := make(map[string]bool)
+	for _, field := range doc.fields {
+		for _, span := range termSpans(field.text) {
+			word := strings.ToLower(field.text[span[0]:span[1]])
+			for _, term := range terms {
+				if word == term.text || term.prefix && strings.HasPrefix(word, term.text) {
+					matched[word] = true
+				}
+			}
+		}
+	}
+	return matched
+}
@@ -0,0 +1,503 @@
+package tango
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server is the collaboration backend: the REST, WebSocket and admin APIs
+// over the session registry. The registries are package state, so a
+// process runs a single Server.
+//
+//	srv, err := tango.NewServer(tango.DefaultConfig(), tango.WithBlobStore(blobs))
+//	srv.RegisterRoutes(engine)
+type Server struct {
+	config  *Config
+	store   Store
+	blobs   BlobStore
+	handler http.Handler
+
+	mu       sync.Mutex
+	servers  []*http.Server
+	stopGRPC func()
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// Option customises a Server created by NewServer.
+type Option func(*Server)
+
+// WithStore persists sessions in store instead of the configured state
+// file.
+func WithStore(store Store) Option {
+	return func(s *Server) { s.store = store }
+}
+
+// WithBlobStore keeps binary objects in blobs instead of in memory or the
+// configured blob storage. Unless deduplication is turned off, identical
+// objects are put in blobs once, under content/ and their SHA-256 digest,
+// and with blob encryption configured they are encrypted first.
+func WithBlobStore(blobs BlobStore) Option {
+	return func(s *Server) { s.blobs = blobs }
+}
+
+var serverCreated int32
+
+// NewServer prepares the server described by cfg: it applies the
+// configuration, starts the background workers, opens the audit log and
+// restores persisted sessions. Serve it with Start, or mount its routes on
+// an engine of your own with RegisterRoutes.
+func NewServer(cfg *Config, opts ...Option) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if !atomic.CompareAndSwapInt32(&serverCreated, 0, 1) {
+		return nil, errors.New("a server already exists in this process")
+	}
+
+	s := &Server{config: cfg, blobs: NewMemoryBlobStore(), stopped: make(chan struct{})}
+	if cloud, err := newBlobStore(cfg.Blobs); err != nil {
+		return nil, fmt.Errorf("opening blob storage: %v", err)
+	} else if cloud != nil {
+		s.blobs = cloud
+	}
+	if cfg.Store.StateFile != "" {
+		s.store = FileStore{Path: cfg.Store.StateFile}
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	var encrypted *EncryptedBlobStore
+	if cfg.Blobs.Encryption.Enabled() {
+		var err error
+		if encrypted, err = NewEncryptedBlobStore(s.blobs, cfg.Blobs.Encryption); err != nil {
+			return nil, fmt.Errorf("blob encryption: %v", err)
+		}
+		s.blobs = encrypted
+	}
+	if cfg.Blobs.Dedup {
+		s.blobs = NewDedupBlobStore(s.blobs)
+	}
+
+	config = cfg
+	config.apply()
+	persistence, blobs, blobCipher = s.store, s.blobs, encrypted
+	startReplication(config.Replication)
+	if err := startLeaderElection(config.Leader); err != nil {
+		return nil, fmt.Errorf("starting leader election: %v", err)
+	}
+	startScheduler(config)
+	startCursorRelay(cursorTick)
+	startReactionFlusher(reactionWindow)
+	startBandwidthReports(bandwidthInterval)
+	startFanout(config.Fanout.Workers)
+
+	if err := openAuditLog(config.Store.AuditFile); err != nil {
+		return nil, fmt.Errorf("opening audit log %s: %v", config.Store.AuditFile, err)
+	}
+	if err := startPublisher(config.Publish); err != nil {
+		return nil, fmt.Errorf("starting event publisher: %v", err)
+	}
+	if err := startMailer(config.Email); err != nil {
+		return nil, fmt.Errorf("starting mailer: %v", err)
+	}
+	if err := startOCR(config.OCR); err != nil {
+		return nil, fmt.Errorf("starting ocr: %v", err)
+	}
+	if err := startSearch(config.Search); err != nil {
+		return nil, fmt.Errorf("opening search index: %v", err)
+	}
+	if err := openChangeLog(config.Store.ChangeLogFile); err != nil {
+		return nil, fmt.Errorf("opening change log %s: %v", config.Store.ChangeLogFile, err)
+	}
+	if err := loadState(); err != nil {
+		logger.Error("restoring state failed", "error", err)
+	}
+	return s, nil
+}
+
+// Logger is the logger the server writes to.
+func (s *Server) Logger() *Logger {
+	return logger
+}
+
+// RegisterRoutes adds the server's routes to engine under /api/v1, /ws,
+// /internal and the health probes. It also installs the request logging,
+// tracing and CORS middleware on engine, so routes added after it get them
+// too. Requests to the unversioned /api paths are only served by Handler.
+func (s *Server) RegisterRoutes(engine *gin.Engine) {
+	if len(config.TrustedProxies) > 0 {
+		// Validate has checked them.
+		_ = engine.SetTrustedProxies(config.TrustedProxies)
+	}
+	engine.Use(requestLogger())
+	engine.Use(tracing())
+
+	engine.Use(corsHandler())
+
+	api := engine.Group(apiPrefix)
+	api.Use(apiQuota())
+	api.Use(standbyGuard())
+	api.Use(identify())
+	{
+		api.GET("/server-info", getServerInfo)
+		api.GET("/openapi.json", getOpenAPI)
+		api.GET("/limits", getLimits)
+
+		api.GET("/search", runSearch)
+		api.GET("/sessions", getSessions)
+		api.POST("/sessions", createSession)
+		api.POST("/sessions/bulk", bulkUpdateSessions)
+		api.GET("/sessions/:id", getSession)
+		api.GET("/sessions/:id/clients", getSessionClients)
+		api.GET("/sessions/:id/comments", getComments)
+		api.POST("/sessions/:id/comments", createComment)
+		api.PATCH("/sessions/:id/comments/:commentId", updateComment)
+		api.DELETE("/sessions/:id/comments/:commentId", deleteComment)
+		api.POST("/sessions/:id/comments/:commentId/resolve", resolveComment)
+		api.POST("/sessions/:id/comments/:commentId/unresolve", unresolveComment)
+		api.PUT("/sessions/:id/star", starSession)
+		api.DELETE("/sessions/:id/star", unstarSession)
+		api.POST("/sessions/:id/share", shareSession)
+		api.GET("/sessions/:id/calendar.ics", getSessionCalendar)
+		api.GET("/sessions/:id/polls", getPolls)
+		api.GET("/sessions/:id/questions", getQuestions)
+		api.GET("/sessions/:id/captions", getCaptions)
+		api.POST("/sessions/:id/captions", postCaptions)
+		api.GET("/sessions/:id/chat", getChat)
+		api.GET("/sessions/:id/screenshots", getScreenshots)
+		api.POST("/sessions/:id/screenshots", uploadScreenshot)
+		api.POST("/sessions/:id/screenshots/polish", polishScreenshots)
+		api.POST("/sessions/:id/screenshots/uploads", startScreenshotUpload)
+		api.POST("/sessions/:id/screenshots/uploads/:uploadId", claimScreenshotUpload)
+		api.GET("/sessions/:id/screenshots/:screenshotId", getScreenshotImage)
+		api.PATCH("/sessions/:id/screenshots/:screenshotId", updateScreenshot)
+		api.POST("/sessions/:id/screenshots/:screenshotId/suggest", suggestScreenshot)
+		api.DELETE("/sessions/:id/screenshots/:screenshotId", deleteScreenshot)
+		api.GET("/sessions/:id/screenshots/:screenshotId/links", getScreenshotLinks)
+		api.POST("/sessions/:id/screenshots/:screenshotId/links", createScreenshotLink)
+		api.DELETE("/sessions/:id/screenshots/:screenshotId/links/:linkId", revokeScreenshotLink)
+		api.GET("/shared/screenshots/:token", getSharedScreenshot)
+		api.GET("/sessions/:id/recordings", getRecordings)
+		api.POST("/sessions/:id/recordings/uploads", startRecordingUpload)
+		api.GET("/sessions/:id/recordings/uploads/:uploadId", getRecordingUpload)
+		api.PATCH("/sessions/:id/recordings/uploads/:uploadId", appendRecordingChunk)
+		api.POST("/sessions/:id/recordings/uploads/:uploadId", finishRecordingUpload)
+		api.DELETE("/sessions/:id/recordings/uploads/:uploadId", cancelRecordingUpload)
+		api.GET("/sessions/:id/recordings/:recordingId", downloadRecording)
+		api.DELETE("/sessions/:id/recordings/:recordingId", deleteRecording)
+		api.POST("/sessions/:id/clone", cloneSession)
+		api.GET("/sessions/:id/waiting", getWaitingRoom)
+		api.POST("/sessions/:id/waiting/:clientId/admit", admitWaitingClient)
+		api.POST("/sessions/:id/waiting/:clientId/reject", rejectWaitingClient)
+		api.GET("/sessions/:id/versions", getSessionVersions)
+		api.GET("/sessions/:id/versions/diff", diffSessionVersions)
+		api.GET("/sessions/:id/versions/:version", getSessionVersion)
+		api.POST("/sessions/:id/versions/:version/rollback", rollbackSession)
+		api.GET("/sessions/:id/stats", getSessionStats)
+		api.GET("/stats/daily", getDailyStats)
+		api.GET("/usage", getUsage)
+		api.POST("/billing/portal", createBillingPortal)
+		api.POST("/billing/stripe/webhook", stripeWebhook)
+		api.PATCH("/sessions/:id", updateSession)
+		api.DELETE("/sessions/:id", deleteSession)
+		api.POST("/sessions/:id/end", endSessionHandler)
+		api.POST("/sessions/:id/archive", archiveSession)
+		api.POST("/sessions/:id/restore", restoreSession)
+		api.GET("/sessions/:id/events", getSessionEvents)
+		api.POST("/sessions/:id/events", postSessionEvent)
+
+		api.GET("/templates", getTemplates)
+		api.POST("/templates", createTemplate)
+		api.GET("/templates/:id", getTemplate)
+		api.PUT("/templates/:id", updateTemplate)
+		api.DELETE("/templates/:id", deleteTemplate)
+		api.POST("/templates/:id/instantiate", instantiateTemplate)
+
+		api.POST("/sessions/:id/guides", assembleGuide)
+		api.POST("/sessions/:id/recordings/:recordingId/guides", makeRecordingGuide)
+		api.GET("/guides", getGuides)
+		api.POST("/guides/import", importGuide)
+		api.GET("/guides/:id", getGuide)
+		api.PATCH("/guides/:id", updateGuide)
+		api.DELETE("/guides/:id", deleteGuide)
+		api.POST("/guides/:id/restore", restoreGuide)
+		api.POST("/guides/:id/clone", cloneGuide)
+		api.PUT("/guides/:id/star", starGuide)
+		api.DELETE("/guides/:id/star", unstarGuide)
+		api.GET("/guides/:id/edit", editGuide)
+		api.GET("/guides/:id/versions", getGuideVersions)
+		api.GET("/guides/:id/versions/diff", diffGuideVersions)
+		api.GET("/guides/:id/versions/:version", getGuideVersion)
+		api.POST("/guides/:id/versions/:version/rollback", rollbackGuide)
+		api.GET("/guides/:id/comments", getGuideComments)
+		api.POST("/guides/:id/comments", createGuideComment)
+		api.PATCH("/guides/:id/comments/:commentId", updateGuideComment)
+		api.DELETE("/guides/:id/comments/:commentId", deleteGuideComment)
+		api.POST("/guides/:id/comments/:commentId/resolve", resolveGuideComment)
+		api.POST("/guides/:id/comments/:commentId/unresolve", unresolveGuideComment)
+		api.GET("/guides/:id/document", getGuideDocument)
+		api.PATCH("/guides/:id/steps/:stepId", updateStep)
+		api.DELETE("/guides/:id/steps/:stepId", deleteStep)
+		api.POST("/guides/:id/steps/:stepId/suggest", suggestStep)
+		api.POST("/guides/:id/polish", polishGuide)
+		api.GET("/guides/:id/steps/:stepId/image", getStepImage)
+		api.POST("/guides/:id/exports", requestGuideExport)
+		api.GET("/guides/:id/exports/:exportId", getGuideExport)
+		api.GET("/guides/:id/exports/:exportId/download", downloadGuideExport)
+		api.GET("/guides/:id/pushes", getGuidePushes)
+		api.POST("/guides/:id/pushes", pushGuide)
+
+		api.GET("/me", getMe)
+		api.GET("/graphql", graphqlQuery)
+		api.POST("/graphql", graphqlQuery)
+		api.GET("/users/me/starred", getStarred)
+		api.GET("/users/me/recent", getRecent)
+		api.GET("/users/me/notifications", getNotifications)
+		api.GET("/users/me/notifications/unread", getUnreadCount)
+		api.POST("/users/me/notifications/read", markNotificationsRead)
+		api.GET("/users/me/email-preferences", getEmailPreferences)
+		api.PATCH("/users/me/email-preferences", updateEmailPreferences)
+		api.GET("/users/me/calendar", getCalendarSubscription)
+		api.POST("/users/me/calendar", createCalendarSubscription)
+		api.DELETE("/users/me/calendar", deleteCalendarSubscription)
+		api.GET("/calendars/:token", getCalendarFeed)
+		api.POST("/users/me/export", requestExport)
+		api.GET("/users/me/exports/:exportId", getExport)
+		api.GET("/users/me/exports/:exportId/download", downloadExport)
+		api.POST("/users/me/deletion", scheduleDeletion)
+		api.DELETE("/users/me/deletion", cancelDeletion)
+		api.GET("/auth/providers", getOAuthProviders)
+		api.POST("/auth/email", requestSignInLink)
+		api.POST("/auth/email/redeem", redeemSignInLink)
+		api.GET("/auth/oauth/:provider", startOAuth)
+		api.GET("/auth/oauth/:provider/callback", oauthCallback)
+		api.GET("/auth/saml/metadata", getSAMLMetadata)
+		api.GET("/auth/saml/login", startSAML)
+		api.POST("/auth/saml/acs", samlACS)
+		api.GET("/tags", getTags)
+		api.GET("/collections", getCollections)
+		api.POST("/collections", createCollection)
+		api.GET("/collections/:id", getCollection)
+		api.PATCH("/collections/:id", updateCollection)
+		api.DELETE("/collections/:id", deleteCollection)
+		api.GET("/workspaces", getWorkspaces)
+		api.POST("/workspaces", createWorkspace)
+		api.GET("/workspaces/:id", getWorkspace)
+		api.GET("/workspaces/:id/invitations", getInvitations)
+		api.POST("/workspaces/:id/invitations", createInvitation)
+		api.DELETE("/workspaces/:id/invitations/:invitationId", revokeInvitation)
+		api.PATCH("/workspaces/:id/members/:userId", updateMember)
+		api.DELETE("/workspaces/:id/members/:userId", removeMember)
+		api.PUT("/workspaces/:id/sso", updateWorkspaceSSO)
+		api.GET("/workspaces/:id/retention", getRetention)
+		api.PUT("/workspaces/:id/retention", updateRetention)
+		api.GET("/workspaces/:id/watermark", getWatermark)
+		api.PUT("/workspaces/:id/watermark", updateWatermark)
+		api.DELETE("/workspaces/:id/watermark", deleteWatermark)
+		api.GET("/workspaces/:id/network-policy", getNetworkPolicy)
+		api.PUT("/workspaces/:id/network-policy", updateNetworkPolicy)
+		api.DELETE("/workspaces/:id/network-policy", deleteNetworkPolicy)
+		api.GET("/workspaces/:id/integrations", getWikiIntegrations)
+		api.PUT("/workspaces/:id/integrations/confluence", updateConfluenceIntegration)
+		api.PUT("/workspaces/:id/integrations/notion", updateNotionIntegration)
+		api.DELETE("/workspaces/:id/integrations/:target", deleteWikiIntegration)
+		api.POST("/invitations/:token/accept", acceptInvitation)
+
+		api.GET("/webhooks", getWebhooks)
+		api.POST("/webhooks", createWebhook)
+		api.DELETE("/webhooks/:id", deleteWebhook)
+		api.GET("/webhooks/:id/deliveries", getWebhookDeliveries)
+
+		api.GET("/triggers", getTriggers)
+		api.GET("/triggers/:key", pollTrigger)
+		api.POST("/triggers/:key/subscriptions", subscribeTrigger)
+
+		api.GET("/webrtc/config", getWebRTCConfig)
+
+		api.GET("/integrations/slack", getSlackIntegrations)
+		api.POST("/integrations/slack", createSlackIntegration)
+		api.PATCH("/integrations/slack/:id", updateSlackIntegration)
+		api.DELETE("/integrations/slack/:id", deleteSlackIntegration)
+	}
+
+	// Everything for operators, including what exposes the server's
+	// configuration or state, goes in this group.
+	admin := api.Group("/admin", adminAuth())
+	{
+		admin.GET("/sessions", getAdminSessions)
+		admin.GET("/connections", getConnections)
+		admin.DELETE("/connections/:id", forceDisconnect)
+		admin.POST("/sessions/:id/terminate", terminateSession)
+		admin.GET("/config", getConfig)
+		admin.GET("/audit", getAuditLog)
+		admin.GET("/runtime", getRuntimeStats)
+		admin.GET("/log-level", getLogLevel)
+		admin.PUT("/log-level", setLogLevel)
+		admin.GET("/integrations/health", getIntegrationHealth)
+		admin.POST("/users", createUser)
+		admin.PUT("/workspaces/:id/quota", setWorkspaceQuota)
+		admin.GET("/workspaces/:id/archive", exportWorkspace)
+		admin.POST("/workspaces/import", importWorkspace)
+		admin.POST("/announcements", announce)
+		admin.GET("/sessions/:id/state", getSessionStateAt)
+		admin.PUT("/clients/:id/faults", setClientFaults)
+		admin.DELETE("/clients/:id/faults", clearClientFaults)
+		admin.GET("/compression", getCompressionStats)
+		admin.GET("/fanout", getFanoutStats)
+		admin.GET("/sweeper", getSweepStatus)
+		admin.POST("/sweeper/run", runSweep)
+		admin.GET("/changes", getChanges)
+		admin.GET("/changes/stream", streamChanges)
+		admin.GET("/publisher", getPublisherStats)
+		admin.GET("/email", getMailerStats)
+		admin.GET("/ocr", getOCRStats)
+		admin.GET("/jobs", getJobs)
+		admin.POST("/jobs/:name/run", runJob)
+		admin.GET("/blobs/rekey", getBlobRekey)
+		admin.POST("/blobs/rekey", startBlobRekey)
+	}
+
+	engine.GET("/ws/:sessionId", identify(), handleWebSocket)
+	engine.GET("/socket.io/", identify(), handleSocketIO)
+	engine.POST("/socket.io/", identify(), handleSocketIO)
+
+	internal := engine.Group("/internal", replicationAuth())
+	{
+		internal.GET("/replication", getReplicationStatus)
+		internal.POST("/replication/promote", promoteStandby)
+	}
+
+	engine.GET("/healthz", healthz)
+	engine.GET("/livez", livez)
+	engine.GET("/readyz", readyz)
+	if config.APIDocs {
+		api.GET("/docs", getAPIDocs)
+	}
+	apiRoutes = engine.Routes()
+}
+
+// Handler is the server's own router, which also serves the deprecated
+// unversioned API paths.
+func (s *Server) Handler() http.Handler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handler == nil {
+		engine := gin.New()
+		engine.Use(gin.Recovery())
+		s.RegisterRoutes(engine)
+		s.handler = versionedAPI(engine)
+	}
+	return s.handler
+}
+
+// Start serves Handler on the configured ports, with TLS and gRPC when they
+// are enabled. It blocks until Shutdown has finished, then returns nil, or
+// until a listener fails.
+func (s *Server) Start() error {
+	cfg := s.config
+	handler := s.Handler()
+	srv := &http.Server{Addr: cfg.Addr(), Handler: handler}
+	servers := []*http.Server{srv}
+
+	errs := make(chan error, 3)
+	if cfg.TLS.Enabled() {
+		plain, err := configureTLS(srv, cfg)
+		if err != nil {
+			return err
+		}
+
+		httpPort := cfg.TLS.HTTPPort
+		if httpPort == 0 && cfg.TLS.AutocertHost != "" {
+			httpPort = 80
+		}
+		if httpPort != 0 {
+			if plain == nil {
+				plain = http.HandlerFunc(redirectToHTTPS)
+			}
+			redirect := &http.Server{Addr: ":" + strconv.Itoa(httpPort), Handler: plain}
+			servers = append(servers, redirect)
+			go func() {
+				errs <- redirect.ListenAndServe()
+			}()
+		}
+
+		go func() {
+			errs <- srv.ListenAndServeTLS("", "")
+		}()
+	} else {
+		go func() {
+			errs <- srv.ListenAndServe()
+		}()
+	}
+
+	var stopGRPC func()
+	if cfg.GRPCPort != 0 {
+		stop, err := startGRPC(handler, cfg, srv.TLSConfig, errs)
+		if err != nil {
+			return err
+		}
+		stopGRPC = stop
+	}
+
+	s.mu.Lock()
+	s.servers, s.stopGRPC = servers, stopGRPC
+	s.mu.Unlock()
+	logger.Info("server starting", "addr", cfg.Addr(), "tls", cfg.TLS.Enabled())
+
+	err := <-errs
+	if errors.Is(err, http.ErrServerClosed) {
+		<-s.stopped
+		return nil
+	}
+	return err
+}
+
+// Shutdown drains the server: the listeners close, connected clients are
+// told to reconnect elsewhere and have until ctx is done to leave, then the
+// remaining sockets are closed and sessions are persisted. Without a
+// deadline on ctx the configured drain window applies.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.DrainWindow())
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+	atomic.StoreInt32(&draining, 1)
+
+	s.mu.Lock()
+	servers, stopGRPC := s.servers, s.stopGRPC
+	s.mu.Unlock()
+
+	notifyShutdown(time.Until(deadline))
+	changes.stop()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			logger.Warn("http shutdown failed", "addr", srv.Addr, "error", err)
+		}
+	}
+	waitForClients(ctx)
+	closeClients()
+	if stopGRPC != nil {
+		stopGRPC()
+	}
+	stopPublisher(ctx)
+	stopMailer(ctx)
+	stopOCR(ctx)
+	stopSearch(ctx)
+	stopLeaderElection(ctx)
+
+	err := persistState()
+	s.stopOnce.Do(func() { close(s.stopped) })
+	logger.Info("shutdown complete")
+	return err
+}
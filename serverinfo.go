@@ -0,0 +1,84 @@
+package tango
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Set at build time with -ldflags "-X github.com/tango-clone/backend.version=..."
+// and likewise for commit and buildDate.
+// commit and buildDate fall back to the VCS stamp the toolchain embeds.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// protocolVersions lists the WebSocket protocol revisions this server speaks.
+var protocolVersions = []string{"1"}
+
+func buildInfo() gin.H {
+	rev, date := commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && rev == "":
+				rev = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			}
+		}
+	}
+
+	return gin.H{
+		"version":   version,
+		"commit":    rev,
+		"buildDate": date,
+		"goVersion": runtime.Version(),
+	}
+}
+
+func getServerInfo(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"build": buildInfo(),
+		"features": gin.H{
+			"tls":            config.TLS.Enabled(),
+			"autocert":       autocertAvailable,
+			"tracing":        tracer != nil,
+			"faultInjection": config.FaultInjection,
+			"apiDocs":        config.APIDocs,
+			"grpc":           grpcAvailable && config.GRPCPort != 0,
+			"replication":    replicator.Role(),
+			"persistence":    config.Store.StateFile != "",
+			"webrtc":         true,
+			"turn":           len(config.WebRTC.TURNURLs) > 0,
+			"sfu":            sfuAvailable,
+			"e2ee":           true,
+			"oauth":          enabledOAuthProviders(),
+		},
+		"protocol": gin.H{
+			"versions":     protocolVersions,
+			"wireFormats":  []string{"json", "text", "msgpack", "protobuf"},
+			"subprotocols": upgrader.Subprotocols,
+			"transports":   []string{TransportWebSocket, TransportEvents, TransportSocketIO},
+			"encodings":    []string{EncodingText, EncodingBase64, EncodingDataURL, EncodingE2EE},
+			"messageTypes": inboundMessageTypes,
+		},
+		"api": gin.H{
+			"current":  apiVersion,
+			"versions": apiVersions,
+			"sunset":   config.APISunset,
+		},
+		"limits": gin.H{
+			"requestsPerMinute":     config.Limits.RequestsPerMinute,
+			"sessionCreatesPerHour": config.Limits.SessionCreatesPerHour,
+			"messagesPerSecond":     config.Limits.MessagesPerSecond,
+			"maxMessageBytes":       config.Limits.MaxMessageBytes,
+			"maxConnections":        config.Limits.MaxConnections,
+			"maxMetadataKeys":       metadataMaxKeys,
+		},
+	})
+}
@@ -0,0 +1,75 @@
+package tango
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// In SFU sessions the presenter publishes a single WebRTC stream to the
+// server, which forwards its RTP to every subscribed viewer. Negotiation is
+// non-trickle: clients send a complete offer over the WebSocket and get a
+// complete answer back. screen_data is refused in these sessions.
+type sfuRouter interface {
+	Publish(sessionID, clientID, offer string) (string, error)
+	Subscribe(sessionID, clientID, offer string) (string, error)
+	Leave(sessionID, clientID string)
+	Close(sessionID string)
+}
+
+var sfu = newSFURouter()
+
+func handleSFUNegotiation(client *Client, session *Session, span *Span, msg InboundMessage) {
+	var req struct {
+		SDP string `json:"sdp"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.SDP == "" || len(req.SDP) > maxSDPBytes {
+		sendError(client, "invalid_payload", msg.Type+" payload must carry an sdp offer")
+		return
+	}
+
+	if !session.SFU {
+		sendError(client, "sfu_disabled", "This session does not use the SFU")
+		return
+	}
+
+	var answer string
+	var err error
+	if msg.Type == "sfu_publish" {
+		if client.Role != RolePresenter {
+			sendError(client, "forbidden", "Only presenters can publish")
+			return
+		}
+		answer, err = sfu.Publish(session.ID, client.ID, req.SDP)
+	} else {
+		answer, err = sfu.Subscribe(session.ID, client.ID, req.SDP)
+	}
+	if err != nil {
+		span.SetError(err)
+		sendError(client, "sfu_failed", err.Error())
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	client.send(Message{
+		Type: "sfu_answer",
+		Payload: gin.H{
+			"sdp": answer,
+		},
+	})
+	if msg.Type == "sfu_publish" {
+		// Viewers that subscribed before the presenter published need to
+		// renegotiate to pick up the new tracks.
+		for id, viewer := range session.Clients {
+			if id != client.ID {
+				deliver(viewer, Message{Type: "sfu_renegotiate", Payload: gin.H{"publisherId": client.ID}})
+			}
+		}
+	}
+}
+
+var errSFUUnavailable = errors.New("SFU support is not compiled in; rebuild with -tags sfu")
+
+var errSFUScreenData = errors.New("screen_data is disabled in SFU sessions; publish a WebRTC stream instead")
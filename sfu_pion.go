@@ -0,0 +1,210 @@
+//go:build sfu
+
+package tango
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	sfuAvailable = true
+
+	// sfuKeyframeInterval is how often the publisher is asked for a
+	// keyframe so newly subscribed viewers can start decoding.
+	sfuKeyframeInterval = 3 * time.Second
+)
+
+type sfuRoom struct {
+	publisherID string
+	publisher   *webrtc.PeerConnection
+	tracks      []*webrtc.TrackLocalStaticRTP
+	subscribers map[string]*webrtc.PeerConnection
+}
+
+type pionSFU struct {
+	rooms map[string]*sfuRoom
+	mu    sync.Mutex
+}
+
+func newSFURouter() sfuRouter {
+	return &pionSFU{rooms: make(map[string]*sfuRoom)}
+}
+
+func (s *pionSFU) room(sessionID string) *sfuRoom {
+	room, exists := s.rooms[sessionID]
+	if !exists {
+		room = &sfuRoom{subscribers: make(map[string]*webrtc.PeerConnection)}
+		s.rooms[sessionID] = room
+	}
+	return room
+}
+
+func newPeerConnection(clientID string) (*webrtc.PeerConnection, error) {
+	var servers []webrtc.ICEServer
+	for _, server := range iceServers(config.WebRTC, clientID, time.Now()) {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return webrtc.NewPeerConnection(webrtc.Configuration{ICEServers: servers})
+}
+
+// answer completes non-trickle negotiation: it applies offer, adds tracks,
+// and returns the local answer once ICE gathering has finished.
+func answer(pc *webrtc.PeerConnection, offer string, tracks []*webrtc.TrackLocalStaticRTP) (string, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+	for _, track := range tracks {
+		if _, err := pc.AddTrack(track); err != nil {
+			return "", err
+		}
+	}
+	desc, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(desc); err != nil {
+		return "", err
+	}
+	<-gathered
+	return pc.LocalDescription().SDP, nil
+}
+
+func (s *pionSFU) Publish(sessionID, clientID, offer string) (string, error) {
+	pc, err := newPeerConnection(clientID)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	room := s.room(sessionID)
+	if room.publisher != nil {
+		s.mu.Unlock()
+		pc.Close()
+		return "", errors.New("another presenter is already publishing")
+	}
+	room.publisherID = clientID
+	room.publisher = pc
+	room.tracks = nil
+	s.mu.Unlock()
+
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), remote.StreamID())
+		if err != nil {
+			logger.Warn("sfu track setup failed", "sessionId", sessionID, "error", err)
+			return
+		}
+
+		s.mu.Lock()
+		room.tracks = append(room.tracks, local)
+		s.mu.Unlock()
+
+		go requestKeyframes(pc, remote)
+
+		for {
+			packet, _, err := remote.ReadRTP()
+			if err != nil {
+				return
+			}
+			if err := local.WriteRTP(packet); err != nil {
+				return
+			}
+		}
+	})
+
+	sdp, err := answer(pc, offer, nil)
+	if err != nil {
+		s.Leave(sessionID, clientID)
+		return "", err
+	}
+	return sdp, nil
+}
+
+func requestKeyframes(pc *webrtc.PeerConnection, remote *webrtc.TrackRemote) {
+	ticker := time.NewTicker(sfuKeyframeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pli := []rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remote.SSRC())}}
+		if err := pc.WriteRTCP(pli); err != nil {
+			return
+		}
+	}
+}
+
+// Subscribe answers a viewer's offer with every track the publisher has
+// sent so far. Viewers renegotiate when told a publisher has joined.
+func (s *pionSFU) Subscribe(sessionID, clientID, offer string) (string, error) {
+	pc, err := newPeerConnection(clientID)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	room := s.room(sessionID)
+	tracks := append([]*webrtc.TrackLocalStaticRTP(nil), room.tracks...)
+	previous := room.subscribers[clientID]
+	room.subscribers[clientID] = pc
+	s.mu.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+
+	sdp, err := answer(pc, offer, tracks)
+	if err != nil {
+		s.Leave(sessionID, clientID)
+		return "", err
+	}
+	return sdp, nil
+}
+
+func (s *pionSFU) Leave(sessionID, clientID string) {
+	s.mu.Lock()
+	room, exists := s.rooms[sessionID]
+	if !exists {
+		s.mu.Unlock()
+		return
+	}
+	var closing []*webrtc.PeerConnection
+	if room.publisherID == clientID && room.publisher != nil {
+		closing = append(closing, room.publisher)
+		room.publisher = nil
+		room.publisherID = ""
+		room.tracks = nil
+	}
+	if pc, subscribed := room.subscribers[clientID]; subscribed {
+		closing = append(closing, pc)
+		delete(room.subscribers, clientID)
+	}
+	s.mu.Unlock()
+
+	for _, pc := range closing {
+		pc.Close()
+	}
+}
+
+func (s *pionSFU) Close(sessionID string) {
+	s.mu.Lock()
+	room, exists := s.rooms[sessionID]
+	delete(s.rooms, sessionID)
+	s.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	if room.publisher != nil {
+		room.publisher.Close()
+	}
+	for _, pc := range room.subscribers {
+		pc.Close()
+	}
+}
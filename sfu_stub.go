@@ -0,0 +1,23 @@
+//go:build !sfu
+
+package tango
+
+const sfuAvailable = false
+
+type noSFU struct{}
+
+func newSFURouter() sfuRouter {
+	return noSFU{}
+}
+
+func (noSFU) Publish(sessionID, clientID, offer string) (string, error) {
+	return "", errSFUUnavailable
+}
+
+func (noSFU) Subscribe(sessionID, clientID, offer string) (string, error) {
+	return "", errSFUUnavailable
+}
+
+func (noSFU) Leave(sessionID, clientID string) {}
+
+func (noSFU) Close(sessionID string) {}
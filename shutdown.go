@@ -0,0 +1,126 @@
+package tango
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func notifyShutdown(window time.Duration) {
+	for _, client := range store.clientList() {
+		client.send(Message{
+			Type: "server_shutting_down",
+			Payload: gin.H{
+				"reconnect":      true,
+				"reconnectAfter": window.Milliseconds(),
+			},
+		})
+	}
+}
+
+func waitForClients(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		store.mu.RLock()
+		remaining := len(store.Clients)
+		store.mu.RUnlock()
+
+		if remaining == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Warn("drain window elapsed", "clients", remaining)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func closeClients() {
+	deadline := time.Now().Add(time.Second)
+	for _, client := range store.clientList() {
+		client.connMu.Lock()
+		if client.Conn != nil {
+			client.Conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), deadline)
+			client.Conn.Close()
+		}
+		if client.events != nil {
+			client.events.close()
+		}
+		client.connMu.Unlock()
+	}
+}
+
+// persistState saves every session to the server's Store so a restarted
+// instance can pick them up again with loadState.
+func persistState() error {
+	if persistence == nil {
+		return nil
+	}
+	data, err := snapshotSessions()
+	if err != nil {
+		return err
+	}
+	return persistence.Save(data)
+}
+
+func loadState() error {
+	if persistence == nil {
+		return nil
+	}
+	data, err := persistence.Load()
+	if err != nil || data == nil {
+		return err
+	}
+
+	n, err := restoreSessions(data, false)
+	if err != nil {
+		return err
+	}
+	logger.Info("restored state", "sessions", n)
+	return nil
+}
+
+func snapshotSessions() ([]byte, error) {
+	encoded, err := encodeSessions(store.sessionList())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encoded)
+}
+
+// restoreSessions loads the sessions in data into the store, dropping any
+// existing session that is not in data when replace is set. Restored
+// sessions have no connected clients, so their idle clock starts now.
+func restoreSessions(data []byte, replace bool) (int, error) {
+	var sessions []*Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return 0, err
+	}
+
+	store.mu.Lock()
+	if replace {
+		store.Sessions = make(map[string]*Session, len(sessions))
+	}
+	now := getCurrentTimestamp()
+	for _, session := range sessions {
+		session.Clients = make(map[string]*Client)
+		if session.IdleSince == 0 {
+			session.IdleSince = now
+		}
+		store.Sessions[session.ID] = session
+		workspaces.indexSession(session.ID, session.WorkspaceID)
+	}
+	store.mu.Unlock()
+
+	reindexSessions()
+	return len(sessions), nil
+}
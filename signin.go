@@ -0,0 +1,138 @@
+package tango
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	signInLinkTTL      = time.Hour
+	signInLinkInterval = time.Minute
+)
+
+type signInLink struct {
+	userID    string
+	expiresAt time.Time
+}
+
+// signInLinkStore holds the emailed sign-in links that have not been used.
+// Like other tokens, only a hash of each code is kept. sentAt throttles how
+// often one user is mailed a link.
+type signInLinkStore struct {
+	links  map[string]signInLink
+	sentAt map[string]time.Time
+	mu     sync.Mutex
+}
+
+var signInLinks = &signInLinkStore{
+	links:  make(map[string]signInLink),
+	sentAt: make(map[string]time.Time),
+}
+
+// issue returns a new code for the user, or false if one was sent too
+// recently.
+func (s *signInLinkStore) issue(userID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, link := range s.links {
+		if now.After(link.expiresAt) {
+			delete(s.links, key)
+		}
+	}
+	for id, at := range s.sentAt {
+		if now.Sub(at) >= signInLinkInterval {
+			delete(s.sentAt, id)
+		}
+	}
+	if _, recent := s.sentAt[userID]; recent {
+		return "", false
+	}
+	code := "sil_" + randomToken(24)
+	s.links[hashToken(code)] = signInLink{userID: userID, expiresAt: now.Add(signInLinkTTL)}
+	s.sentAt[userID] = now
+	return code, true
+}
+
+// take returns and forgets the link so each one is used at most once.
+func (s *signInLinkStore) take(code string) (signInLink, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hashToken(code)
+	link, exists := s.links[key]
+	delete(s.links, key)
+	if !exists || time.Now().After(link.expiresAt) {
+		return signInLink{}, false
+	}
+	return link, true
+}
+
+type EmailSignInRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// requestSignInLink emails a one-time sign-in link to a registered user,
+// which is how someone who lost their API token gets a new one. The
+// response is the same whether or not the address has an account.
+func requestSignInLink(c *gin.Context) {
+	var req EmailSignInRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !emailEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errEmailDisabled.Error()})
+		return
+	}
+
+	users.mu.Lock()
+	user := users.byEmail[normalizeEmail(req.Email)]
+	users.mu.Unlock()
+	if user != nil {
+		if code, ok := signInLinks.issue(user.ID); ok {
+			sendEmail(EmailSignIn, user.Email, gin.H{
+				"Link":    emailLink("/sign-in/email?" + url.Values{"code": {code}}.Encode()),
+				"Expires": "1 hour",
+			})
+		}
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "If that address has an account, a sign-in link is on its way"})
+}
+
+type RedeemSignInRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// redeemSignInLink exchanges the code from a sign-in link for a new API
+// token.
+func redeemSignInLink(c *gin.Context) {
+	var req RedeemSignInRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	link, ok := signInLinks.take(req.Code)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in link; ask for a new one"})
+		return
+	}
+
+	users.mu.Lock()
+	user := users.Users[link.userID]
+	var token string
+	if user != nil {
+		token = users.issueToken(user, AuthEmail)
+	}
+	users.mu.Unlock()
+	if user == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired sign-in link; ask for a new one"})
+		return
+	}
+
+	audit.Record("user:"+user.ID, "user.login", "user", user.ID, c.Writer.Header().Get(requestIDHeader), gin.H{"provider": "email"})
+	c.JSON(http.StatusOK, gin.H{"user": user, "token": token})
+}
@@ -0,0 +1,279 @@
+package tango
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var slackEvents = []string{EventSessionCreated, EventGuidePublished, EventCommentCreated}
+
+// SlackIntegration posts a workspace's events to a Slack channel. Only
+// admins of the workspace can see or change it.
+type SlackIntegration struct {
+	ID          string          `json:"id"`
+	WorkspaceID string          `json:"workspaceId"`
+	Team        string          `json:"team"`
+	WebhookURL  string          `json:"-"`
+	Events      map[string]bool `json:"events"`
+	CreatedAt   int64           `json:"createdAt"`
+}
+
+type SlackRegistry struct {
+	Integrations map[string]*SlackIntegration
+	mu           sync.Mutex
+}
+
+func NewSlackRegistry() *SlackRegistry {
+	return &SlackRegistry{
+		Integrations: make(map[string]*SlackIntegration),
+	}
+}
+
+var slack = NewSlackRegistry()
+
+func formatSlackMessage(event string, payload interface{}) string {
+	switch event {
+	case EventSessionCreated:
+		if session, ok := payload.(*Session); ok {
+			return fmt.Sprintf(":large_green_circle: Session *%s* has started", session.Name)
+		}
+		return ":large_green_circle: A new session has started"
+	case EventGuidePublished:
+		return ":book: A guide has been published"
+	case EventCommentCreated:
+		return ":speech_balloon: Someone left a comment"
+	}
+	return event
+}
+
+// notifySlack posts event to the Slack integrations of the workspace it
+// happened in that have it toggled on. Events outside any workspace are
+// not posted.
+func notifySlack(event, workspaceID string, payload interface{}) {
+	if workspaceID == "" {
+		return
+	}
+	slack.mu.Lock()
+	var targets []SlackIntegration
+	for _, integration := range slack.Integrations {
+		if integration.WorkspaceID == workspaceID && integration.Events[event] {
+			targets = append(targets, *integration)
+		}
+	}
+	slack.mu.Unlock()
+
+	if len(targets) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(gin.H{"text": formatSlackMessage(event, payload)})
+	if err != nil {
+		logger.Error("encoding Slack message failed", "event", event, "error", err)
+		return
+	}
+
+	for _, integration := range targets {
+		go postToSlack(integration, body)
+	}
+}
+
+func postToSlack(integration SlackIntegration, body []byte) {
+	_, _, err := outbound.DoPublic("slack:"+integration.ID, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, integration.WebhookURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		logger.Warn("posting to Slack failed", "integrationId", integration.ID, "team", integration.Team, "error", err)
+	}
+}
+
+func bindSlackEvents(requested map[string]bool) (map[string]bool, error) {
+	events := make(map[string]bool, len(slackEvents))
+	for _, event := range slackEvents {
+		events[event] = true
+	}
+	for event, enabled := range requested {
+		if _, known := events[event]; !known {
+			return nil, fmt.Errorf("Unknown event: %s", event)
+		}
+		events[event] = enabled
+	}
+	return events, nil
+}
+
+// getSlackIntegrations lists the integrations of the workspaces the caller
+// administers, narrowed to ?workspaceId= when given.
+func getSlackIntegrations(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	only := c.Query("workspaceId")
+	if only != "" && requireRole(c, only, RoleAdmin) == nil {
+		return
+	}
+	sso := signedInWithSSO(c)
+
+	slack.mu.Lock()
+	defer slack.mu.Unlock()
+
+	integrations := make([]*SlackIntegration, 0, len(slack.Integrations))
+	for _, integration := range slack.Integrations {
+		if only != "" && integration.WorkspaceID != only {
+			continue
+		}
+		role := workspaces.roleOf(integration.WorkspaceID, user, sso)
+		if workspaceRoleRank[role] >= workspaceRoleRank[RoleAdmin] && networkPermits(c, integration.WorkspaceID) {
+			integrations = append(integrations, integration)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"integrations": integrations,
+	})
+}
+
+type CreateSlackIntegrationRequest struct {
+	WorkspaceID string          `json:"workspaceId" binding:"required"`
+	Team        string          `json:"team" binding:"required"`
+	WebhookURL  string          `json:"webhookUrl" binding:"required,url"`
+	Events      map[string]bool `json:"events"`
+}
+
+func createSlackIntegration(c *gin.Context) {
+	var req CreateSlackIntegrationRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requireRole(c, req.WorkspaceID, RoleAdmin) == nil {
+		return
+	}
+
+	if err := checkPublicURL(c.Request.Context(), req.WebhookURL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhookUrl: " + err.Error()})
+		return
+	}
+
+	events, err := bindSlackEvents(req.Events)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	slack.mu.Lock()
+	defer slack.mu.Unlock()
+
+	integration := &SlackIntegration{
+		ID:          generateID(),
+		WorkspaceID: req.WorkspaceID,
+		Team:        req.Team,
+		WebhookURL:  req.WebhookURL,
+		Events:      events,
+		CreatedAt:   getCurrentTimestamp(),
+	}
+	slack.Integrations[integration.ID] = integration
+	auditRequest(c, "slack.create", "slack", integration.ID, gin.H{"team": integration.Team, "workspaceId": integration.WorkspaceID})
+
+	c.JSON(http.StatusCreated, integration)
+}
+
+// slackIntegrationFor looks up an integration the caller administers,
+// responding when there is none.
+func slackIntegrationFor(c *gin.Context, id string) bool {
+	slack.mu.Lock()
+	integration, exists := slack.Integrations[id]
+	var workspaceID string
+	if exists {
+		workspaceID = integration.WorkspaceID
+	}
+	slack.mu.Unlock()
+
+	if !exists || !canAccess(c, workspaceID) {
+		notFound(c, "Integration not found")
+		return false
+	}
+	return requireRole(c, workspaceID, RoleAdmin) != nil
+}
+
+type UpdateSlackIntegrationRequest struct {
+	WebhookURL string          `json:"webhookUrl" binding:"omitempty,url"`
+	Events     map[string]bool `json:"events"`
+}
+
+func updateSlackIntegration(c *gin.Context) {
+	id := c.Param("id")
+
+	var req UpdateSlackIntegrationRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !slackIntegrationFor(c, id) {
+		return
+	}
+	if req.WebhookURL != "" {
+		if err := checkPublicURL(c.Request.Context(), req.WebhookURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhookUrl: " + err.Error()})
+			return
+		}
+	}
+
+	slack.mu.Lock()
+	defer slack.mu.Unlock()
+
+	integration, exists := slack.Integrations[id]
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Integration not found"})
+		return
+	}
+
+	for event := range req.Events {
+		if _, known := integration.Events[event]; !known {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event: " + event})
+			return
+		}
+	}
+	for event, enabled := range req.Events {
+		integration.Events[event] = enabled
+	}
+	if req.WebhookURL != "" && req.WebhookURL != integration.WebhookURL {
+		integration.WebhookURL = req.WebhookURL
+		outbound.Forget("slack:" + id)
+	}
+	auditRequest(c, "slack.update", "slack", id, gin.H{"events": integration.Events, "webhookUrlChanged": req.WebhookURL != ""})
+
+	c.JSON(http.StatusOK, integration)
+}
+
+func deleteSlackIntegration(c *gin.Context) {
+	id := c.Param("id")
+
+	if !slackIntegrationFor(c, id) {
+		return
+	}
+
+	slack.mu.Lock()
+	defer slack.mu.Unlock()
+
+	if _, exists := slack.Integrations[id]; !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Integration not found"})
+		return
+	}
+
+	delete(slack.Integrations, id)
+	outbound.Forget("slack:" + id)
+	auditRequest(c, "slack.delete", "slack", id, nil)
+	c.Status(http.StatusNoContent)
+}
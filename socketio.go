@@ -0,0 +1,721 @@
+package tango
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Clients built on Socket.IO, such as the capture extension, join through
+// /socket.io/, which speaks Engine.IO 4. Like Socket.IO itself they start
+// with HTTP long polling and upgrade to a WebSocket when one gets through,
+// or open a WebSocket straight away.
+const (
+	TransportSocketIO = "socket.io"
+
+	engineIOVersion      = "4"
+	engineIOContentType  = "text/plain; charset=UTF-8"
+	socketIOPingInterval = 25 * time.Second
+	socketIOPingTimeout  = 20 * time.Second
+
+	// engineIOSeparator separates the packets of a polling request or
+	// response.
+	engineIOSeparator = '\x1e'
+)
+
+// Engine.IO packet types, and the Socket.IO packet types carried in an
+// Engine.IO message.
+const (
+	eioOpen    = '0'
+	eioClose   = '1'
+	eioPing    = '2'
+	eioPong    = '3'
+	eioMessage = '4'
+	eioUpgrade = '5'
+	eioNoop    = '6'
+
+	sioConnect      = '0'
+	sioDisconnect   = '1'
+	sioEvent        = '2'
+	sioAck          = '3'
+	sioConnectError = '4'
+)
+
+// socketIOConns holds the WebSocket connections that speak Socket.IO, so
+// codecFor frames messages for them as events.
+var socketIOConns sync.Map
+
+func isSocketIO(conn *websocket.Conn) bool {
+	_, ok := socketIOConns.Load(conn)
+	return ok
+}
+
+// socketIOCodec frames messages as events on the default namespace. The
+// event name is the message type and its argument the payload; stream
+// messages add {"seq": n} as a second argument.
+type socketIOCodec struct{}
+
+func (socketIOCodec) Encode(dst []byte, message Message) ([]byte, error) {
+	args := []interface{}{message.Type, message.Payload}
+	if message.Seq > 0 {
+		args = append(args, gin.H{"seq": message.Seq})
+	}
+	data, err := json.Marshal(args)
+	if err != nil {
+		return dst, err
+	}
+	dst = append(dst, eioMessage, sioEvent)
+	return append(dst, data...), nil
+}
+
+func (socketIOCodec) Decode(frame []byte) (InboundMessage, error) {
+	if len(frame) < 2 || frame[0] != eioMessage || frame[1] != sioEvent {
+		return InboundMessage{}, errors.New("expected a Socket.IO event")
+	}
+	body := frame[2+len(socketIOAckID(frame)):]
+	var args []json.RawMessage
+	if err := json.Unmarshal(body, &args); err != nil || len(args) == 0 {
+		return InboundMessage{}, errors.New("events must be a JSON array starting with the event name")
+	}
+	var name string
+	if err := json.Unmarshal(args[0], &name); err != nil || name == "" {
+		return InboundMessage{}, errors.New("event name must be a string")
+	}
+
+	msg := InboundMessage{Type: socketIOMessageType(name)}
+	if len(args) > 1 {
+		msg.Payload = args[1]
+		msg.raw = args[1]
+	}
+	return msg, nil
+}
+
+func (socketIOCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+// socketIOAckID returns the id of an event that asks for an
+// acknowledgement, or "" if it does not.
+func socketIOAckID(frame []byte) string {
+	end := 2
+	for end < len(frame) && frame[end] >= '0' && frame[end] <= '9' {
+		end++
+	}
+	return string(frame[2:end])
+}
+
+// socketIOMessageType maps an event name to a message type. Legacy clients
+// name events in camelCase or kebab-case, so screenData and screen-data
+// both mean screen_data.
+func socketIOMessageType(name string) string {
+	var b strings.Builder
+	prev := rune(0)
+	for _, r := range name {
+		switch {
+		case r == '-':
+			b.WriteByte('_')
+		case unicode.IsUpper(r):
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+// handleSocketIO serves Engine.IO on both transports. The session is picked
+// by the sessionId query parameter. The join fields come from the query, as
+// on /ws, or from the auth payload of the CONNECT packet.
+func handleSocketIO(c *gin.Context) {
+	if c.Query("EIO") != engineIOVersion {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 5, "message": "Unsupported protocol version"})
+		return
+	}
+	switch c.Query("transport") {
+	case "polling":
+		handleSocketIOPolling(c)
+	case "websocket":
+		if websocket.IsWebSocketUpgrade(c.Request) {
+			handleSocketIOWebSocket(c)
+			return
+		}
+		fallthrough
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"code": 0, "message": "Transport unknown"})
+	}
+}
+
+// socketIOSession finds the session a Socket.IO request is for, answering
+// 404 if the caller may not see it. Every request of a polling client
+// carries the query, token included, so each is checked.
+func socketIOSession(c *gin.Context) (*Session, bool) {
+	signInFromQuery(c)
+	session, exists := store.session(c.Query("sessionId"))
+	if !exists || (currentUser(c) != nil && !canAccess(c, session.WorkspaceID)) {
+		notFound(c, "Session not found")
+		return nil, false
+	}
+	return session, true
+}
+
+// handleSocketIOWebSocket joins a session over a WebSocket, or moves a
+// polling client named by sid onto one.
+func handleSocketIOWebSocket(c *gin.Context) {
+	session, ok := socketIOSession(c)
+	if !ok {
+		return
+	}
+	var poll *engineIOPoll
+	if c.Query("sid") != "" {
+		if poll = socketIOPoll(c, session); poll == nil {
+			return
+		}
+	} else if !admitRequest(c, session, c.Query("resumeClientId") != "") {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(countingWriter{c.Writer}, c.Request, nil)
+	if err != nil {
+		requestLog(c).Warn("socket.io upgrade failed", "sessionId", session.ID, "error", err)
+		return
+	}
+	conn.SetCompressionLevel(config.Compression.Level)
+	socketIOConns.Store(conn, struct{}{})
+	defer socketIOConns.Delete(conn)
+
+	var client *Client
+	if poll != nil {
+		client, err = poll.upgrade(conn)
+		if err != nil {
+			requestLog(c).Info("socket.io upgrade refused", "sessionId", session.ID, "error", err)
+			conn.Close()
+			return
+		}
+	} else if err := conn.WriteMessage(websocket.TextMessage, socketIOOpen(randomToken(16), []string{})); err != nil {
+		conn.Close()
+		return
+	}
+
+	// A client that upgraded after its CONNECT was welcomed on the poll;
+	// otherwise the CONNECT comes over the WebSocket.
+	if client == nil {
+		join, err := readSocketIOConnect(c, conn)
+		var seq int64
+		var refusal *admissionError
+		if err != nil {
+			refusal = socketIOHandshakeError(c, session, err)
+		} else {
+			client, seq, refusal = joinSocketIO(c, session, join)
+		}
+		if refusal != nil {
+			refuseSocketIO(conn, refusal.Message, refusal.Reason)
+			return
+		}
+
+		// Broadcasts skip the client until the CONNECT is acknowledged,
+		// since Socket.IO drops events that arrive before it.
+		client.connMu.Lock()
+		client.closeTransport()
+		client.Conn = conn
+		conn.SetWriteDeadline(time.Now().Add(config.Fanout.WriteTimeout()))
+		conn.WriteMessage(websocket.TextMessage, socketIOConnectAck(client))
+		client.connMu.Unlock()
+		welcomeSocketIO(c, session, client, join, seq)
+	}
+
+	stop := make(chan struct{})
+	go pingSocketIO(client, conn, stop)
+	readSocketIO(client, session, conn)
+	close(stop)
+	conn.Close()
+	connectionEnded(client, session, func() bool { return client.releaseConn(conn) })
+}
+
+// socketIOOpen is the OPEN packet that starts an Engine.IO connection.
+func socketIOOpen(sid string, upgrades []string) []byte {
+	open, _ := json.Marshal(gin.H{
+		"sid":          sid,
+		"upgrades":     upgrades,
+		"pingInterval": socketIOPingInterval.Milliseconds(),
+		"pingTimeout":  socketIOPingTimeout.Milliseconds(),
+		"maxPayload":   socketIOMaxPayload(),
+	})
+	return append([]byte{eioOpen}, open...)
+}
+
+// socketIOMaxPayload is the most a client may send in one packet, or in
+// one POST of the polling transport.
+func socketIOMaxPayload() int64 {
+	return 2 * config.Limits.MaxMessageBytes
+}
+
+func socketIOConnectAck(client *Client) []byte {
+	ack, _ := json.Marshal(gin.H{"sid": client.ID})
+	return append([]byte{eioMessage, sioConnect}, ack...)
+}
+
+// readSocketIOConnect waits for the CONNECT packet on conn.
+func readSocketIOConnect(c *gin.Context, conn *websocket.Conn) (JoinRequest, error) {
+	conn.SetReadLimit(handshakeMaxBytes)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, frame, err := conn.ReadMessage()
+	if err != nil {
+		return JoinRequest{}, err
+	}
+	return socketIOJoin(c, frame)
+}
+
+// socketIOJoin reads a CONNECT packet to the default namespace and merges
+// its auth payload over the join fields in the query.
+func socketIOJoin(c *gin.Context, packet []byte) (JoinRequest, error) {
+	if len(packet) < 2 || packet[0] != eioMessage || packet[1] != sioConnect {
+		return JoinRequest{}, errors.New("the first packet must be a CONNECT")
+	}
+	if len(packet) > 2 && packet[2] == '/' {
+		return JoinRequest{}, errors.New("only the default namespace is served")
+	}
+
+	join, _ := joinFromQuery(c)
+	if auth := packet[2:]; len(auth) > 0 {
+		if err := json.Unmarshal(auth, &join); err != nil {
+			return JoinRequest{}, errors.New("auth must be an object with name, role and features")
+		}
+	}
+	return join, nil
+}
+
+func socketIOHandshakeError(c *gin.Context, session *Session, err error) *admissionError {
+	requestLog(c).Info("socket.io handshake rejected", "sessionId", session.ID, "error", err)
+	return &admissionError{Status: http.StatusBadRequest, Reason: "handshake_required", Message: err.Error()}
+}
+
+// joinSocketIO adds the client a CONNECT asks for, or resumes it along with
+// the session's current sequence number. The client has no transport yet.
+func joinSocketIO(c *gin.Context, session *Session, join JoinRequest) (*Client, int64, *admissionError) {
+	if err := join.validate(); err != nil {
+		return nil, 0, socketIOHandshakeError(c, session, err)
+	}
+	if _, ok := joinFor(c, session.ID, join); !ok {
+		return nil, 0, refusedJoin(c)
+	}
+
+	var refusal *admissionError
+	if join.ResumeClientID != "" {
+		client, seq, err := resume(session, join, nil, nil)
+		if errors.As(err, &refusal) {
+			return nil, 0, refusal
+		}
+		if err != nil {
+			return nil, 0, &admissionError{Status: http.StatusForbidden, Reason: "resume_failed", Message: err.Error()}
+		}
+		return client, seq, nil
+	}
+	client := newClient(session.ID, join)
+	if refusal = addClient(c, session, client); refusal != nil {
+		return nil, 0, refusal
+	}
+	return client, 0, nil
+}
+
+func welcomeSocketIO(c *gin.Context, session *Session, client *Client, join JoinRequest, seq int64) {
+	if join.ResumeClientID != "" {
+		welcomeBack(c, session, client, seq)
+	} else {
+		welcomeClient(c, session, client)
+	}
+}
+
+// readSocketIO handles the client's packets until it disconnects or stops
+// answering pings.
+func readSocketIO(client *Client, session *Session, conn *websocket.Conn) {
+	maxBytes := config.Limits.MaxMessageBytes
+	conn.SetReadLimit(socketIOMaxPayload())
+	reply := func(packet []byte) error { return writeSocketIO(client, conn, packet) }
+	for {
+		conn.SetReadDeadline(time.Now().Add(socketIOPingInterval + socketIOPingTimeout))
+		_, frame, err := conn.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			client.log.Warn("closing client over message size limit", "limit", maxBytes)
+			return
+		}
+		if err != nil {
+			client.log.Debug("socket.io read ended", "error", err)
+			return
+		}
+		if !handleSocketIOPacket(client, session, frame, reply) {
+			return
+		}
+	}
+}
+
+// handleSocketIOPacket acts on a packet from a connected client and reports
+// whether the client stays. reply sends a packet back on the transport the
+// client is using.
+func handleSocketIOPacket(client *Client, session *Session, packet []byte, reply func([]byte) error) bool {
+	if len(packet) == 0 {
+		return true
+	}
+	switch packet[0] {
+	case eioPong:
+	case eioClose:
+		return false
+	case eioMessage:
+		if len(packet) > 1 && packet[1] == sioDisconnect {
+			return false
+		}
+		if len(packet) > 1 && packet[1] != sioEvent {
+			sendError(client, "invalid_frame", "only events are supported")
+			return true
+		}
+		receive(client, session, packet, socketIOCodec{})
+		// Events sent with a callback get an empty acknowledgement once
+		// handled.
+		if id := socketIOAckID(packet); id != "" {
+			reply(append([]byte{eioMessage, sioAck}, id+"[]"...))
+		}
+	default:
+		client.log.Debug("ignoring engine.io packet", "type", string(packet[0]))
+	}
+	return true
+}
+
+// engineIOPoll is a Socket.IO client on the long-polling transport. Its
+// packets wait in events, which stands in for the client's connection,
+// until its next GET collects them, and it sends its own with POSTs. The
+// client leaves when it closes the connection or misses pings, unless it
+// has moved to a WebSocket by then.
+type engineIOPoll struct {
+	sid       string
+	sessionID string
+	events    *eventStream
+	// upgraded is closed once the client has moved to a WebSocket.
+	upgraded chan struct{}
+	// lastPong is a Unix time in nanoseconds, accessed atomically.
+	lastPong int64
+	// client is set once the CONNECT is accepted, and polling while a GET
+	// is waiting. Both are guarded by mu.
+	client  *Client
+	polling bool
+	mu      sync.Mutex
+}
+
+// engineIOPolls holds the polling connections by their Engine.IO sid.
+var engineIOPolls sync.Map
+
+// socketIOPoll finds the polling connection the sid query parameter names,
+// answering 400 unless it is one into session.
+func socketIOPoll(c *gin.Context, session *Session) *engineIOPoll {
+	value, ok := engineIOPolls.Load(c.Query("sid"))
+	if !ok || value.(*engineIOPoll).sessionID != session.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 1, "message": "Session ID unknown"})
+		return nil
+	}
+	return value.(*engineIOPoll)
+}
+
+// handleSocketIOPolling opens a polling connection with a GET without sid,
+// and then serves its GETs and POSTs.
+func handleSocketIOPolling(c *gin.Context) {
+	session, ok := socketIOSession(c)
+	if !ok {
+		return
+	}
+	if c.Query("sid") == "" {
+		if c.Request.Method != http.MethodGet {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 2, "message": "Bad handshake method"})
+			return
+		}
+		if !admitRequest(c, session, c.Query("resumeClientId") != "") {
+			return
+		}
+		openSocketIOPoll(c, session)
+		return
+	}
+
+	poll := socketIOPoll(c, session)
+	if poll == nil {
+		return
+	}
+	if c.Request.Method == http.MethodGet {
+		poll.collect(c)
+	} else {
+		poll.receive(c, session)
+	}
+}
+
+func openSocketIOPoll(c *gin.Context, session *Session) {
+	events := newEventStream(c.ClientIP())
+	events.packets = true
+	poll := &engineIOPoll{
+		sid:       randomToken(16),
+		sessionID: session.ID,
+		events:    events,
+		upgraded:  make(chan struct{}),
+		lastPong:  time.Now().UnixNano(),
+	}
+	engineIOPolls.Store(poll.sid, poll)
+	go poll.run(session)
+	c.Data(http.StatusOK, engineIOContentType, socketIOOpen(poll.sid, []string{TransportWebSocket}))
+}
+
+// run pings the client until the poll ends and then lets the client go,
+// unless it has moved to a WebSocket.
+func (p *engineIOPoll) run(session *Session) {
+	ticker := time.NewTicker(socketIOPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&p.lastPong))) > socketIOPingInterval+socketIOPingTimeout {
+				p.events.close()
+				continue
+			}
+			p.events.push([]byte{eioPing}, false)
+		case <-p.upgraded:
+			engineIOPolls.Delete(p.sid)
+			return
+		case <-p.events.done:
+			// The client's next GET still collects what is left, such as
+			// a connect_error, followed by a CLOSE.
+			time.AfterFunc(socketIOPingTimeout, func() { engineIOPolls.Delete(p.sid) })
+			if client := p.connected(); client != nil {
+				connectionEnded(client, session, func() bool { return client.releaseEvents(p.events) })
+			}
+			return
+		}
+	}
+}
+
+func (p *engineIOPoll) connected() *Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.client
+}
+
+// collect answers a GET with the packets queued for the client, waiting
+// for some if there are none. Once the poll has ended it adds a CLOSE.
+func (p *engineIOPoll) collect(c *gin.Context) {
+	p.mu.Lock()
+	if p.polling {
+		p.mu.Unlock()
+		c.JSON(http.StatusBadRequest, gin.H{"code": 3, "message": "Bad request"})
+		return
+	}
+	p.polling = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.polling = false
+		p.mu.Unlock()
+	}()
+
+	packets, open := p.events.poll(c.Request.Context())
+	if !open {
+		packets = append(packets, []byte{eioClose})
+	}
+	c.Data(http.StatusOK, engineIOContentType, bytes.Join(packets, []byte{engineIOSeparator}))
+}
+
+// receive handles the packets of a POST.
+func (p *engineIOPoll) receive(c *gin.Context, session *Session) {
+	maxPayload := socketIOMaxPayload()
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPayload+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 3, "message": "Bad request"})
+		return
+	}
+	if int64(len(body)) > maxPayload {
+		logger.Warn("closing socket.io poll over payload size limit", "sessionId", session.ID, "limit", maxPayload)
+		p.events.close()
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"code": 3, "message": "Bad request"})
+		return
+	}
+
+	for _, packet := range bytes.Split(body, []byte{engineIOSeparator}) {
+		if !p.handle(c, session, packet) {
+			p.events.close()
+			break
+		}
+	}
+	c.Data(http.StatusOK, engineIOContentType, []byte("ok"))
+}
+
+// handle acts on one packet and reports whether the client stays.
+func (p *engineIOPoll) handle(c *gin.Context, session *Session, packet []byte) bool {
+	if len(packet) > 0 && packet[0] == eioPong {
+		atomic.StoreInt64(&p.lastPong, time.Now().UnixNano())
+		return true
+	}
+	client := p.connected()
+	if client == nil {
+		if len(packet) > 1 && packet[0] == eioMessage && packet[1] == sioConnect {
+			p.connect(c, session, packet)
+		}
+		return len(packet) == 0 || packet[0] != eioClose
+	}
+	return handleSocketIOPacket(client, session, packet, func(reply []byte) error { return p.write(client, reply) })
+}
+
+// connect joins the client a CONNECT asks for and acknowledges it on the
+// poll, or refuses it and ends the poll. p.mu is held throughout, so a
+// repeated CONNECT is ignored.
+func (p *engineIOPoll) connect(c *gin.Context, session *Session, packet []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil {
+		return
+	}
+
+	join, err := socketIOJoin(c, packet)
+	var client *Client
+	var seq int64
+	var refusal *admissionError
+	if err != nil {
+		refusal = socketIOHandshakeError(c, session, err)
+	} else {
+		client, seq, refusal = joinSocketIO(c, session, join)
+	}
+	if refusal != nil {
+		p.events.push(socketIOConnectError(refusal.Message, refusal.Reason), false)
+		p.events.close()
+		return
+	}
+
+	p.client = client
+	client.connMu.Lock()
+	client.closeTransport()
+	client.events = p.events
+	p.events.push(socketIOConnectAck(client), false)
+	client.connMu.Unlock()
+	welcomeSocketIO(c, session, client, join, seq)
+}
+
+// write queues packet for client while the poll is still its transport.
+func (p *engineIOPoll) write(client *Client, packet []byte) error {
+	client.connMu.Lock()
+	defer client.connMu.Unlock()
+	if client.events != p.events {
+		return websocket.ErrCloseSent
+	}
+	return p.events.push(packet, false)
+}
+
+// upgrade answers the client's probe on conn and, once the client asks to
+// upgrade, makes conn its transport in place of the poll. Packets the poll
+// has not delivered go out on conn first; if that fails, reading from conn
+// fails too and the client leaves as usual. It returns nil if the client
+// has not sent its CONNECT yet.
+func (p *engineIOPoll) upgrade(conn *websocket.Conn) (*Client, error) {
+	conn.SetReadLimit(handshakeMaxBytes)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, frame, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if string(frame) != "2probe" {
+		return nil, errors.New("expected a probe")
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("3probe")); err != nil {
+		return nil, err
+	}
+	// The client upgrades once its waiting GET has returned.
+	p.events.push([]byte{eioNoop}, false)
+	if _, frame, err = conn.ReadMessage(); err != nil {
+		return nil, err
+	}
+	if len(frame) != 1 || frame[0] != eioUpgrade {
+		return nil, errors.New("expected an upgrade")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.upgraded:
+		return nil, errors.New("the poll has already been upgraded")
+	case <-p.events.done:
+		return nil, errors.New("the poll has ended")
+	default:
+	}
+	close(p.upgraded)
+	client := p.client
+	if client == nil {
+		return nil, nil
+	}
+
+	client.connMu.Lock()
+	defer client.connMu.Unlock()
+	if client.events != p.events {
+		return nil, errors.New("the client has moved to another connection")
+	}
+	conn.SetWriteDeadline(time.Now().Add(config.Fanout.WriteTimeout()))
+	for _, packet := range p.events.drain() {
+		if len(packet) == 1 && packet[0] == eioNoop {
+			continue
+		}
+		if conn.WriteMessage(websocket.TextMessage, packet) != nil {
+			break
+		}
+	}
+	client.events, client.Conn = nil, conn
+	return client, nil
+}
+
+// pingSocketIO sends Engine.IO pings, which the client must answer within
+// the ping timeout, until stop is closed.
+func pingSocketIO(client *Client, conn *websocket.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(socketIOPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := writeSocketIO(client, conn, []byte{eioPing}); err != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// writeSocketIO writes packet to conn while it is still client's
+// connection.
+func writeSocketIO(client *Client, conn *websocket.Conn, packet []byte) error {
+	client.connMu.Lock()
+	defer client.connMu.Unlock()
+	if client.Conn != conn {
+		return websocket.ErrCloseSent
+	}
+	conn.SetWriteDeadline(time.Now().Add(config.Fanout.WriteTimeout()))
+	return conn.WriteMessage(websocket.TextMessage, packet)
+}
+
+// refuseSocketIO answers the CONNECT with a connect_error and closes the
+// connection.
+func refuseSocketIO(conn *websocket.Conn, message, reason string) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.WriteMessage(websocket.TextMessage, socketIOConnectError(message, reason))
+	conn.Close()
+}
+
+func socketIOConnectError(message, reason string) []byte {
+	packet, _ := json.Marshal(gin.H{"message": message, "data": gin.H{"reason": reason}})
+	return append([]byte{eioMessage, sioConnectError}, packet...)
+}
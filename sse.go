@@ -0,0 +1,275 @@
+package tango
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	TransportWebSocket = "websocket"
+	TransportEvents    = "sse"
+
+	eventQueueSize    = 256
+	eventKeepAlive    = 15 * time.Second
+	clientTokenHeader = "Client-Token"
+)
+
+var errSlowEventStream = errors.New("event stream fell too far behind")
+
+// eventStream is the server-sent events connection of a client whose
+// network does not let WebSockets through. send queues messages and the
+// request's goroutine writes them in serve, so a slow reader never holds up
+// a broadcast. The client sends its own messages with POST requests.
+type eventStream struct {
+	queue      chan []byte
+	done       chan struct{}
+	closeOnce  sync.Once
+	remoteAddr string
+	// packets is set when the stream holds the Engine.IO packets of a
+	// Socket.IO client on the long-polling transport rather than events.
+	packets bool
+}
+
+func newEventStream(remoteAddr string) *eventStream {
+	return &eventStream{
+		queue:      make(chan []byte, eventQueueSize),
+		done:       make(chan struct{}),
+		remoteAddr: remoteAddr,
+	}
+}
+
+// send queues message as an event whose data is its JSON frame and whose id
+// is its sequence number, or as a Socket.IO event packet. Once the queue is
+// full lossy messages are shed, and anything else closes the stream so the
+// client reconnects and resyncs. Callers must hold the client's connMu.
+func (e *eventStream) send(message Message) error {
+	if e.packets {
+		packet, err := socketIOCodec{}.Encode(nil, message)
+		if err != nil {
+			return err
+		}
+		return e.push(packet, lossyTypes[message.Type])
+	}
+
+	data, err := jsonCodec{}.Encode(nil, message)
+	if err != nil {
+		return err
+	}
+	event := make([]byte, 0, len(data)+32)
+	if message.Seq > 0 {
+		event = append(event, "id: "...)
+		event = strconv.AppendInt(event, message.Seq, 10)
+		event = append(event, '\n')
+	}
+	event = append(event, "data: "...)
+	event = append(event, data...)
+	event = append(event, "\n\n"...)
+	return e.push(event, lossyTypes[message.Type])
+}
+
+func (e *eventStream) push(event []byte, lossy bool) error {
+	select {
+	case e.queue <- event:
+		return nil
+	default:
+	}
+	if lossy {
+		atomic.AddInt64(&fanout.shed, 1)
+		return nil
+	}
+	atomic.AddInt64(&fanout.disconnects, 1)
+	e.close()
+	return errSlowEventStream
+}
+
+func (e *eventStream) close() {
+	e.closeOnce.Do(func() { close(e.done) })
+}
+
+// poll waits for packets and returns all those queued, for a long-polling
+// request. Once the stream is closed it returns what is left and false.
+func (e *eventStream) poll(ctx context.Context) ([][]byte, bool) {
+	select {
+	case packet := <-e.queue:
+		packets := append([][]byte{packet}, e.drain()...)
+		select {
+		case <-e.done:
+			return packets, false
+		default:
+			return packets, true
+		}
+	case <-e.done:
+		return e.drain(), false
+	case <-ctx.Done():
+		return nil, true
+	}
+}
+
+// drain takes everything queued without waiting.
+func (e *eventStream) drain() [][]byte {
+	var packets [][]byte
+	for {
+		select {
+		case packet := <-e.queue:
+			packets = append(packets, packet)
+		default:
+			return packets
+		}
+	}
+}
+
+// serve writes queued events to the response until the stream is closed or
+// the client goes away. Events queued before the close are still written.
+func (e *eventStream) serve(c *gin.Context) {
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event := <-e.queue:
+			if _, err := c.Writer.Write(event); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-keepAlive.C:
+			if _, err := io.WriteString(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-e.done:
+			for {
+				select {
+				case event := <-e.queue:
+					c.Writer.Write(event)
+				default:
+					c.Writer.Flush()
+					return
+				}
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// releaseEvents detaches events from the client and reports whether it was
+// still the client's stream.
+func (c *Client) releaseEvents(events *eventStream) bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.events != events {
+		return false
+	}
+	c.events = nil
+	return true
+}
+
+// getSessionEvents joins a session over server-sent events. It takes the
+// handshake as query parameters, like the WebSocket endpoint, and streams
+// what a WebSocket client would receive.
+func getSessionEvents(c *gin.Context) {
+	signInFromQuery(c)
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	join, _ := joinFromQuery(c)
+	if err := join.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !admitRequest(c, session, join.ResumeClientID != "") {
+		return
+	}
+
+	events := newEventStream(c.ClientIP())
+	var client *Client
+	if join.ResumeClientID != "" {
+		var seq int64
+		var err error
+		client, seq, err = resume(session, join, nil, events)
+		var refusal *admissionError
+		if errors.As(err, &refusal) {
+			refuse(c, refusal)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "reason": "resume_failed"})
+			return
+		}
+		startEventStream(c)
+		welcomeBack(c, session, client, seq)
+	} else {
+		client = newClient(session.ID, join)
+		client.events = events
+		if refusal := addClient(c, session, client); refusal != nil {
+			refuse(c, refusal)
+			return
+		}
+		startEventStream(c)
+		welcomeClient(c, session, client)
+	}
+
+	events.serve(c)
+	events.close()
+	connectionEnded(client, session, func() bool { return client.releaseEvents(events) })
+}
+
+func startEventStream(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream.
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+}
+
+// postSessionEvent takes a message from a client, identified by its id and
+// resume token, and handles it as if it had arrived on its WebSocket.
+func postSessionEvent(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	session.mu.Lock()
+	client, exists := session.Clients[c.Query("clientId")]
+	valid := exists && subtle.ConstantTimeCompare([]byte(client.resumeToken), []byte(c.GetHeader(clientTokenHeader))) == 1
+	session.mu.Unlock()
+	if !valid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unknown client or token"})
+		return
+	}
+	client.connMu.Lock()
+	streaming := client.events != nil
+	client.connMu.Unlock()
+	if !streaming {
+		c.JSON(http.StatusConflict, gin.H{"error": "Client is not connected over server-sent events"})
+		return
+	}
+
+	maxBytes := config.Limits.MaxMessageBytes
+	message, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if int64(len(message)) > maxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Messages are limited to %d bytes", maxBytes)})
+		return
+	}
+	receive(client, session, message, jsonCodec{})
+	c.Status(http.StatusAccepted)
+}
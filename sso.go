@@ -0,0 +1,233 @@
+package tango
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProviderSSO is the OAuth provider name of the enterprise OpenID Connect
+// identity provider.
+const ProviderSSO = "sso"
+
+const oidcDiscoveryTTL = time.Hour
+
+type oidcDocument struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+}
+
+// oidcDiscoveryCache holds the IdP's discovery document. It is fetched on
+// first use rather than at startup so an unreachable IdP doesn't keep the
+// server from starting, and refetched hourly to follow endpoint changes.
+type oidcDiscoveryCache struct {
+	doc     oidcDocument
+	fetched time.Time
+	mu      sync.Mutex
+}
+
+var oidcDiscovery = &oidcDiscoveryCache{}
+
+func ssoClient() OAuthProviderConfig {
+	if !config.OAuth.SSO.Enabled() {
+		return OAuthProviderConfig{}
+	}
+	return OAuthProviderConfig{ClientID: config.OAuth.SSO.ClientID, ClientSecret: config.OAuth.SSO.ClientSecret}
+}
+
+func ssoEndpoints() (oauthEndpoints, error) {
+	oidcDiscovery.mu.Lock()
+	defer oidcDiscovery.mu.Unlock()
+
+	if time.Since(oidcDiscovery.fetched) > oidcDiscoveryTTL {
+		issuer := config.OAuth.SSO.Issuer
+		req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", nil)
+		if err != nil {
+			return oauthEndpoints{}, err
+		}
+		req.Header.Set("Accept", "application/json")
+		var doc oidcDocument
+		if err := oauthJSON(req, &doc); err != nil {
+			return oauthEndpoints{}, err
+		}
+		if doc.Issuer != issuer {
+			return oauthEndpoints{}, fmt.Errorf("discovery document names issuer %q", doc.Issuer)
+		}
+		if !strings.HasPrefix(doc.AuthURL, "https://") || !strings.HasPrefix(doc.TokenURL, "https://") {
+			return oauthEndpoints{}, errors.New("discovery document lacks https authorization and token endpoints")
+		}
+		oidcDiscovery.doc = doc
+		oidcDiscovery.fetched = time.Now()
+	}
+	return oauthEndpoints{AuthURL: oidcDiscovery.doc.AuthURL, TokenURL: oidcDiscovery.doc.TokenURL}, nil
+}
+
+// ssoProfile reads the claims of the ID token. The token comes straight
+// from the IdP's token endpoint over TLS, which OpenID Connect accepts in
+// place of checking its signature. The email is only trusted, and so only
+// linked to an existing account, when email_verified is true.
+func ssoProfile(tokens oauthTokens) (oauthProfile, error) {
+	parts := strings.Split(tokens.IDToken, ".")
+	if len(parts) != 3 {
+		return oauthProfile{}, errors.New("token response carried no ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return oauthProfile{}, fmt.Errorf("ID token payload: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return oauthProfile{}, fmt.Errorf("ID token payload: %v", err)
+	}
+
+	sso := config.OAuth.SSO
+	if iss, _ := claims["iss"].(string); iss != sso.Issuer {
+		return oauthProfile{}, fmt.Errorf("ID token issued by %q", iss)
+	}
+	if !containsString(claimStrings(claims["aud"]), sso.ClientID) {
+		return oauthProfile{}, errors.New("ID token is not meant for this client")
+	}
+	if azp, present := claims["azp"].(string); present && azp != sso.ClientID {
+		return oauthProfile{}, errors.New("ID token was issued to another client")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().Unix() >= int64(exp) {
+		return oauthProfile{}, errors.New("ID token has expired")
+	}
+
+	profile := oauthProfile{Groups: claimStrings(claims[sso.GroupsClaim])}
+	profile.Subject, _ = claims["sub"].(string)
+	profile.Email, _ = claims["email"].(string)
+	profile.Nonce, _ = claims["nonce"].(string)
+	profile.Verified, _ = claims["email_verified"].(bool)
+	if profile.Name, _ = claims["name"].(string); profile.Name == "" {
+		profile.Name, _ = claims["preferred_username"].(string)
+	}
+	if profile.Subject == "" {
+		return oauthProfile{}, errors.New("ID token carried no subject")
+	}
+	return profile, nil
+}
+
+// claimStrings reads a claim that may be a single string or a list.
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// WorkspaceSSO ties a workspace to the IdP. GroupRoles maps IdP groups to
+// the role their members get; with Required set, members can only use the
+// workspace with a token issued through single sign-on.
+type WorkspaceSSO struct {
+	Required   bool              `json:"required"`
+	GroupRoles map[string]string `json:"groupRoles,omitempty"`
+}
+
+// roleFor returns the highest role any of groups maps to.
+func (s *WorkspaceSSO) roleFor(groups []string) string {
+	role := ""
+	for _, group := range groups {
+		if mapped := s.GroupRoles[group]; workspaceRoleRank[mapped] > workspaceRoleRank[role] {
+			role = mapped
+		}
+	}
+	return role
+}
+
+// syncGroups applies each workspace's group mapping to a user who just
+// signed in through the IdP. Memberships the mapping created follow the
+// user's groups and are removed once no group maps to a role; memberships
+// granted any other way are only ever raised. It returns the user's
+// resulting role in each workspace with a mapping, "" where it was removed.
+func (r *WorkspaceRegistry) syncGroups(user *User, groups []string) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	roles := make(map[string]string)
+	for id, ws := range r.Workspaces {
+		if ws.SSO == nil || len(ws.SSO.GroupRoles) == 0 {
+			continue
+		}
+		mapped := ws.SSO.roleFor(groups)
+		member, exists := ws.Members[user.ID]
+		switch {
+		case mapped == "" && exists && member.Managed:
+			delete(ws.Members, user.ID)
+			roles[id] = ""
+			continue
+		case mapped == "":
+			continue
+		case !exists:
+			member = &Membership{UserID: user.ID, Email: user.Email, Role: mapped, JoinedAt: getCurrentTimestamp(), Managed: true}
+			ws.Members[user.ID] = member
+		case member.Managed || workspaceRoleRank[mapped] > workspaceRoleRank[member.Role]:
+			member.Role = mapped
+		}
+		roles[id] = member.Role
+	}
+	return roles
+}
+
+// updateWorkspaceSSO replaces a workspace's single sign-on settings.
+func updateWorkspaceSSO(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleOwner) == nil {
+		return
+	}
+	if !config.OAuth.SSO.Enabled() && !config.OAuth.SAML.Enabled() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Single sign-on is not configured on this server"})
+		return
+	}
+
+	var req WorkspaceSSO
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for group, role := range req.GroupRoles {
+		if role != RoleMember && role != RoleAdmin {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "group " + group + " must map to member or admin"})
+			return
+		}
+	}
+	// Requiring SSO from a session that didn't use it would lock the
+	// caller out on the next request.
+	if req.Required && !signedInWithSSO(c) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Sign in with single sign-on before requiring it"})
+		return
+	}
+
+	workspaces.mu.Lock()
+	ws, exists := workspaces.Workspaces[id]
+	if !exists {
+		workspaces.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+	ws.SSO = nil
+	if req.Required || len(req.GroupRoles) > 0 {
+		ws.SSO = &req
+	}
+	workspaces.mu.Unlock()
+
+	auditRequest(c, "workspace.sso", "workspace", id, gin.H{"required": req.Required, "groupRoles": req.GroupRoles})
+	c.JSON(http.StatusOK, gin.H{"sso": req})
+}
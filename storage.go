@@ -0,0 +1,159 @@
+package tango
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Store persists the server's sessions between runs. The snapshot is
+// written at shutdown and read back by the next instance at startup.
+type Store interface {
+	// Load returns the saved snapshot, or nil if there is none.
+	Load() ([]byte, error)
+	Save(snapshot []byte) error
+}
+
+// FileStore keeps the snapshot in a file, replaced atomically on save.
+type FileStore struct {
+	Path string
+}
+
+func (f FileStore) Load() ([]byte, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (f FileStore) Save(snapshot []byte) error {
+	tmp := f.Path + ".tmp"
+	if err := os.WriteFile(tmp, snapshot, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Path)
+}
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore holds binary objects, such as data export archives, by key.
+// Get returns ErrBlobNotFound for a missing key, and deleting one is not
+// an error.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// MemoryBlobStore is the default BlobStore. Its contents are lost when the
+// process exits.
+type MemoryBlobStore struct {
+	blobs map[string][]byte
+	mu    sync.RWMutex
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (m *MemoryBlobStore) Put(_ context.Context, key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[key] = data
+	return nil
+}
+
+func (m *MemoryBlobStore) Get(_ context.Context, key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, exists := m.blobs[key]
+	if !exists {
+		return nil, ErrBlobNotFound
+	}
+	return data, nil
+}
+
+func (m *MemoryBlobStore) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blobs, key)
+	return nil
+}
+
+func (m *MemoryBlobStore) listKeys(_ context.Context, fn func(key string) error) error {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.blobs))
+	for key := range m.blobs {
+		keys = append(keys, key)
+	}
+	m.mu.RUnlock()
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// URLOptions describe a signed URL: the Method it may be used with on the
+// blob, and how long it stays valid. An upload must send ContentType; a
+// download is served as ContentType, and as an attachment when Filename is
+// set.
+type URLOptions struct {
+	Method      string
+	ContentType string
+	Filename    string
+	Expires     time.Duration
+}
+
+// URLSigner is a BlobStore clients can reach directly, with URLs that grant
+// access to one blob for a while. SignURL also returns the headers a
+// request to the URL must carry.
+type URLSigner interface {
+	SignURL(key string, opts URLOptions) (string, map[string]string, error)
+}
+
+// signedURLs is how long the URLs handed to clients stay valid.
+func signedURLs() time.Duration {
+	return time.Duration(config.Blobs.SignedURLSeconds) * time.Second
+}
+
+// redirectToBlob sends a download straight to blob storage when the store
+// signs URLs, and reports whether it did. Otherwise the caller serves the
+// blob itself.
+func redirectToBlob(c *gin.Context, key, contentType, filename string) bool {
+	signer, ok := blobs.(URLSigner)
+	if !ok {
+		return false
+	}
+	location, _, err := signer.SignURL(key, URLOptions{
+		Method:      http.MethodGet,
+		ContentType: contentType,
+		Filename:    filename,
+		Expires:     signedURLs(),
+	})
+	if err != nil {
+		if !errors.Is(err, ErrBlobNotFound) {
+			logger.Warn("signing blob url failed", "key", key, "error", err)
+		}
+		return false
+	}
+	c.Header("Cache-Control", "private, no-store")
+	c.Redirect(http.StatusFound, location)
+	return true
+}
+
+// persistence and blobs are the stores of the running Server. persistence
+// is nil when sessions are not persisted, and blobCipher when blobs are
+// not encrypted.
+var (
+	persistence Store
+	blobs       BlobStore = NewMemoryBlobStore()
+	blobCipher  *EncryptedBlobStore
+)
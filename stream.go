@@ -0,0 +1,177 @@
+package tango
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every message broadcast to a session takes the next number in the
+// session's stream, so a client that sees seq jump knows it missed
+// something. Clients acknowledge the highest seq they have processed with
+// ack, which lets the server measure delivery lag per viewer, and recover
+// gaps with resend while the messages are still in the replay buffer.
+//
+// Screen frames are numbered but not buffered: a stale frame is worthless
+// and buffering them would pin megabytes per session. Resending a frame
+// range instead marks the client as needing a keyframe.
+const replayBufferSize = 1024
+
+type streamEntry struct {
+	seq     int64
+	message Message
+	sentAt  time.Time
+	exclude string
+	frame   bool
+}
+
+type sessionStream struct {
+	seq     int64
+	entries []streamEntry
+}
+
+// stamp numbers message and records it in the replay buffer. Callers must
+// hold session.mu.
+func (s *sessionStream) stamp(message Message, exclude string) Message {
+	s.seq++
+	message.Seq = s.seq
+
+	entry := streamEntry{seq: s.seq, sentAt: time.Now(), exclude: exclude}
+	if message.Type == "screen_data" {
+		entry.frame = true
+	} else {
+		entry.message = message
+	}
+	if s.entries == nil {
+		s.entries = make([]streamEntry, replayBufferSize)
+	}
+	s.entries[s.seq%replayBufferSize] = entry
+	return message
+}
+
+// oldest returns the lowest seq still in the replay buffer.
+func (s *sessionStream) oldest() int64 {
+	if s.seq < replayBufferSize {
+		return 1
+	}
+	return s.seq - replayBufferSize + 1
+}
+
+func (s *sessionStream) entry(seq int64) (streamEntry, bool) {
+	if seq < s.oldest() || seq > s.seq || s.entries == nil {
+		return streamEntry{}, false
+	}
+	return s.entries[seq%replayBufferSize], true
+}
+
+// StreamPosition is a client's progress through its session's stream.
+type StreamPosition struct {
+	Seq   int64 `json:"seq"`
+	Acked int64 `json:"acked"`
+	LagMs int64 `json:"lagMs"`
+}
+
+func handleAck(client *Client, session *Session, msg InboundMessage) {
+	var req struct {
+		Seq int64 `json:"seq"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.Seq < 1 {
+		sendError(client, "invalid_ack", "ack payload must be an object with a positive seq")
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	stream := &session.stream
+	if req.Seq > stream.seq {
+		sendError(client, "invalid_ack", fmt.Sprintf("seq %d has not been sent yet", req.Seq))
+		return
+	}
+	if req.Seq <= client.ackedSeq {
+		return
+	}
+	client.ackedSeq = req.Seq
+	if req.Seq >= stream.oldest()-1 {
+		client.resyncSent = false
+	}
+	if entry, ok := stream.entry(req.Seq); ok {
+		client.ackLag = time.Since(entry.sentAt)
+	}
+
+	// A client this far behind can no longer close its gaps with resend.
+	if req.Seq < stream.oldest()-1 && !client.resyncSent {
+		client.resyncSent = true
+		deliver(client, Message{
+			Type: "resync_required",
+			Payload: gin.H{
+				"acked":  req.Seq,
+				"oldest": stream.oldest(),
+				"seq":    stream.seq,
+			},
+		})
+	}
+}
+
+func handleResend(client *Client, session *Session, msg InboundMessage) {
+	var req struct {
+		From int64 `json:"from"`
+		To   int64 `json:"to"`
+	}
+	if err := json.Unmarshal(msg.Payload, &req); err != nil || req.From < 1 {
+		sendError(client, "invalid_resend", "resend payload must be an object with a positive from")
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	stream := &session.stream
+	if req.To == 0 {
+		req.To = stream.seq
+	}
+	if req.To < req.From || req.To > stream.seq {
+		sendError(client, "invalid_resend", fmt.Sprintf("resend range must lie within 1..%d", stream.seq))
+		return
+	}
+
+	from := req.From
+	if oldest := stream.oldest(); from < oldest {
+		from = oldest
+	}
+
+	resent := 0
+	skipped := []int64{}
+	needsKey := false
+	for seq := from; seq <= req.To; seq++ {
+		entry, _ := stream.entry(seq)
+		switch {
+		case entry.frame:
+			needsKey = true
+			skipped = append(skipped, seq)
+		case entry.exclude == client.ID:
+			skipped = append(skipped, seq)
+		default:
+			deliver(client, entry.message)
+			resent++
+		}
+	}
+	if needsKey {
+		client.frames.needsKey = true
+		requestSessionKeyframe(session, client, "resend")
+	}
+
+	deliver(client, Message{
+		Type: "resend_complete",
+		Payload: gin.H{
+			"from":        req.From,
+			"to":          req.To,
+			"resent":      resent,
+			"skipped":     skipped,
+			"unavailable": from > req.From,
+			"oldest":      stream.oldest(),
+		},
+	})
+}
@@ -0,0 +1,351 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	suggestTimeout = 30 * time.Second
+	// maxSuggestText is how much of a screenshot's OCR text goes into a
+	// prompt.
+	maxSuggestText = 4000
+)
+
+var errNothingToSuggestFrom = errors.New("there is no text, page URL or selector to go on")
+
+const suggestInstructions = `You write the steps of how-to guides from screenshots of a web app.
+Given the page URL, the selector of the element the user interacted with and
+the text on the screen, reply with only a JSON object {"title": "...",
+"description": "..."}. The title is an imperative instruction of at most
+eight words, such as "Open the billing settings". The description is one or
+two sentences telling the reader what to do and what they will see.`
+
+// Suggestion is a proposed title and description for a screenshot or a
+// guide step.
+type Suggestion struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+func suggestEnabled() bool {
+	return config.Suggest.URL != ""
+}
+
+var suggestClient = &http.Client{Timeout: suggestTimeout}
+
+// suggestFor asks the configured chat completions endpoint to describe
+// what was done on pageURL with the element at selector, text being what
+// was on the screen.
+func suggestFor(ctx context.Context, pageURL, selector, text string) (Suggestion, error) {
+	if text == "" && pageURL == "" && selector == "" {
+		return Suggestion{}, errNothingToSuggestFrom
+	}
+	if len(text) > maxSuggestText {
+		text = strings.ToValidUTF8(text[:maxSuggestText], "")
+	}
+	prompt := fmt.Sprintf("Page URL: %s\nSelector: %s\nText on screen:\n%s", pageURL, selector, text)
+	payload, err := json.Marshal(gin.H{
+		"model": config.Suggest.Model,
+		"messages": []gin.H{
+			{"role": "system", "content": suggestInstructions},
+			{"role": "user", "content": prompt},
+		},
+		"temperature":     0.2,
+		"response_format": gin.H{"type": "json_object"},
+	})
+	if err != nil {
+		return Suggestion{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.Suggest.URL, bytes.NewReader(payload))
+	if err != nil {
+		return Suggestion{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.Suggest.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Suggest.APIKey)
+	}
+	resp, err := suggestClient.Do(req)
+	if err != nil {
+		return Suggestion{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return Suggestion{}, fmt.Errorf("suggest endpoint returned %d: %s", resp.StatusCode, bytes.TrimSpace(detail))
+	}
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&completion); err != nil {
+		return Suggestion{}, fmt.Errorf("decoding completion: %v", err)
+	}
+	if len(completion.Choices) == 0 {
+		return Suggestion{}, errors.New("completion has no choices")
+	}
+	return parseSuggestion(completion.Choices[0].Message.Content)
+}
+
+// parseSuggestion reads the model's reply, tolerating a Markdown code
+// fence around the JSON.
+func parseSuggestion(content string) (Suggestion, error) {
+	content = strings.TrimSpace(content)
+	content = strings.TrimPrefix(content, "```json")
+	content = strings.Trim(content, "`\n ")
+	var suggestion Suggestion
+	if err := json.Unmarshal([]byte(content), &suggestion); err != nil {
+		return Suggestion{}, fmt.Errorf("completion is not a JSON suggestion: %v", err)
+	}
+	suggestion.Title = strings.TrimSpace(suggestion.Title)
+	suggestion.Description = strings.TrimSpace(suggestion.Description)
+	if suggestion.Title == "" {
+		return Suggestion{}, errors.New("completion has no title")
+	}
+	if len(suggestion.Title) > maxScreenshotTitleBytes {
+		suggestion.Title = strings.ToValidUTF8(suggestion.Title[:maxScreenshotTitleBytes], "")
+	}
+	if len(suggestion.Description) > maxScreenshotDescBytes {
+		suggestion.Description = strings.ToValidUTF8(suggestion.Description[:maxScreenshotDescBytes], "")
+	}
+	return suggestion, nil
+}
+
+// suggestScreenshot proposes a title and description for a screenshot
+// without applying them.
+func suggestScreenshot(c *gin.Context) {
+	if !suggestEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Suggestions are not configured"})
+		return
+	}
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	shot, exists := screenshots.find(session.ID, c.Param("screenshotId"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Screenshot not found"})
+		return
+	}
+	if shot.Encrypted {
+		rejectEncrypted(c, "suggestions")
+		return
+	}
+	if shot.OCRStatus == OCRPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "The screenshot's text is still being read"})
+		return
+	}
+	suggestion, err := suggestFor(c.Request.Context(), shot.PageURL, shot.Selector, shot.Text)
+	if errors.Is(err, errNothingToSuggestFrom) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Warn("suggesting screenshot title failed", "screenshot", shot.ID, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The suggestion service failed"})
+		return
+	}
+	c.JSON(http.StatusOK, suggestion)
+}
+
+// polishing holds the sessions whose screenshots, and the guides whose
+// steps, are being polished, keyed by searchKey.
+var polishing = struct {
+	running map[string]bool
+	mu      sync.Mutex
+}{running: make(map[string]bool)}
+
+// startPolishing claims the polishing of a session or guide, reporting
+// false if it is already under way.
+func startPolishing(docType, id string) bool {
+	polishing.mu.Lock()
+	defer polishing.mu.Unlock()
+	if polishing.running[searchKey(docType, id)] {
+		return false
+	}
+	polishing.running[searchKey(docType, id)] = true
+	return true
+}
+
+func stopPolishing(docType, id string) {
+	polishing.mu.Lock()
+	delete(polishing.running, searchKey(docType, id))
+	polishing.mu.Unlock()
+}
+
+// polishScreenshots gives every screenshot of the session without a title
+// a suggested title and description, in the background.
+func polishScreenshots(c *gin.Context) {
+	if !suggestEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Suggestions are not configured"})
+		return
+	}
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	if session.E2EE {
+		rejectEncrypted(c, "suggestions")
+		return
+	}
+	var untitled []Screenshot
+	for _, shot := range screenshots.List(session.ID) {
+		if shot.Title == "" && shot.OCRStatus != OCRPending {
+			untitled = append(untitled, shot)
+		}
+	}
+
+	if len(untitled) > 0 && !startPolishing(SearchSession, session.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The screenshots are already being polished"})
+		return
+	}
+
+	auditRequest(c, "screenshots.polish", "session", session.ID, gin.H{"screenshots": len(untitled)})
+	if len(untitled) > 0 {
+		go polish(session, untitled)
+	}
+	c.JSON(http.StatusAccepted, gin.H{"screenshots": len(untitled)})
+}
+
+func polish(session *Session, untitled []Screenshot) {
+	defer stopPolishing(SearchSession, session.ID)
+
+	polished := 0
+	for _, shot := range untitled {
+		ctx, cancel := context.WithTimeout(context.Background(), suggestTimeout)
+		suggestion, err := suggestFor(ctx, shot.PageURL, shot.Selector, shot.Text)
+		cancel()
+		if err != nil {
+			if !errors.Is(err, errNothingToSuggestFrom) {
+				logger.Warn("polishing screenshot failed", "screenshot", shot.ID, "error", err)
+			}
+			continue
+		}
+		// Leave alone a title someone wrote meanwhile.
+		updated, exists := screenshots.update(session.ID, shot.ID, func(shot *Screenshot) {
+			if shot.Title == "" {
+				shot.Title, shot.Description = suggestion.Title, suggestion.Description
+			}
+		})
+		if exists && updated.Title == suggestion.Title {
+			polished++
+			broadcastToSession(nil, session.ID, Message{Type: "screenshot", Payload: updated}, "")
+		}
+	}
+	if polished > 0 {
+		reindexSession(session)
+	}
+	logger.Info("polished screenshots", "session", session.ID, "polished", polished, "of", len(untitled))
+}
+
+// suggestStep proposes a title and description for a guide step without
+// applying them.
+func suggestStep(c *gin.Context) {
+	if !suggestEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Suggestions are not configured"})
+		return
+	}
+	_, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	var step *GuideStep
+	for i := range guide.Steps {
+		if guide.Steps[i].ID == c.Param("stepId") {
+			step = &guide.Steps[i]
+		}
+	}
+	if step == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errStepNotFound.Error()})
+		return
+	}
+	suggestion, err := suggestFor(c.Request.Context(), step.PageURL, step.Selector, step.Text)
+	if errors.Is(err, errNothingToSuggestFrom) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Warn("suggesting step title failed", "guide", guide.ID, "step", step.ID, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The suggestion service failed"})
+		return
+	}
+	c.JSON(http.StatusOK, suggestion)
+}
+
+// polishGuide rewrites the title and description of every step of a guide
+// that there is something to go on for, in the background.
+func polishGuide(c *gin.Context) {
+	if !suggestEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Suggestions are not configured"})
+		return
+	}
+	user, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	var steps []GuideStep
+	for _, step := range guide.Steps {
+		if step.Text != "" || step.PageURL != "" || step.Selector != "" {
+			steps = append(steps, step)
+		}
+	}
+	if len(steps) > 0 && !startPolishing(SearchGuide, guide.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The guide is already being polished"})
+		return
+	}
+
+	auditRequest(c, "guide.polish", "guide", guide.ID, gin.H{"steps": len(steps)})
+	if len(steps) > 0 {
+		go polishSteps(guide.ID, user.ID, steps)
+	}
+	c.JSON(http.StatusAccepted, gin.H{"steps": len(steps)})
+}
+
+func polishSteps(guideID, userID string, steps []GuideStep) {
+	defer stopPolishing(SearchGuide, guideID)
+
+	polished := 0
+	for _, step := range steps {
+		ctx, cancel := context.WithTimeout(context.Background(), suggestTimeout)
+		suggestion, err := suggestFor(ctx, step.PageURL, step.Selector, step.Text)
+		cancel()
+		if err != nil {
+			logger.Warn("polishing guide step failed", "guide", guideID, "step", step.ID, "error", err)
+			continue
+		}
+		// Leave alone a step someone edited or removed meanwhile.
+		_, err = guides.update(guideID, userID, func(guide *Guide) error {
+			for i := range guide.Steps {
+				current := &guide.Steps[i]
+				if current.ID == step.ID && current.Title == step.Title && current.Description == step.Description {
+					current.Title, current.Description = suggestion.Title, suggestion.Description
+					return nil
+				}
+			}
+			return errStepNotFound
+		})
+		if errors.Is(err, errGuideNotFound) {
+			break
+		}
+		if err == nil {
+			polished++
+		}
+	}
+	logger.Info("polished guide", "guide", guideID, "polished", polished, "of", len(steps))
+}
@@ -0,0 +1,235 @@
+package tango
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The sweeper reconciles state that can drift after crashes or races:
+// clients registered without a live session, session members the store no
+// longer tracks, and bookkeeping kept by side subsystems for resources that
+// have since been deleted. In dry-run mode it only reports what it would do.
+const (
+	RepairOrphanedClients  = "orphaned_clients"
+	RepairDanglingMembers  = "dangling_members"
+	RepairStaleRollups     = "stale_anomaly_rollups"
+	RepairExpiredQuotas    = "expired_quota_windows"
+	RepairOrphanDeliveries = "orphaned_webhook_deliveries"
+	RepairOrphanedBreakers = "orphaned_circuit_breakers"
+	RepairStaleAnnotations = "stale_annotation_boards"
+)
+
+type SweepReport struct {
+	DryRun     bool           `json:"dryRun"`
+	StartedAt  int64          `json:"startedAt"`
+	DurationMs int64          `json:"durationMs"`
+	Repairs    map[string]int `json:"repairs"`
+}
+
+type Sweeper struct {
+	last   *SweepReport
+	totals map[string]int
+	runs   int
+	mu     sync.Mutex
+}
+
+var sweeper = &Sweeper{totals: make(map[string]int)}
+
+func (s *Sweeper) Run(dryRun bool) SweepReport {
+	start := time.Now()
+	report := SweepReport{
+		DryRun:    dryRun,
+		StartedAt: start.Unix(),
+		Repairs:   make(map[string]int),
+	}
+
+	sessionIDs := sweepStore(dryRun, report.Repairs)
+	sweepRollups(sessionIDs, dryRun, report.Repairs)
+	sweepAnnotations(sessionIDs, dryRun, report.Repairs)
+	sweepQuotas(dryRun, report.Repairs)
+	sweepIntegrations(dryRun, report.Repairs)
+
+	report.DurationMs = time.Since(start).Milliseconds()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = &report
+	s.runs++
+	if !dryRun {
+		for category, n := range report.Repairs {
+			s.totals[category] += n
+		}
+	}
+	return report
+}
+
+// sweepStore repairs client bookkeeping and returns the IDs of all sessions.
+func sweepStore(dryRun bool, repairs map[string]int) map[string]bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	sessionIDs := make(map[string]bool, len(store.Sessions))
+	for id, session := range store.Sessions {
+		sessionIDs[id] = true
+		session.mu.Lock()
+		for clientID, client := range session.Clients {
+			if _, tracked := store.Clients[clientID]; tracked {
+				continue
+			}
+			repairs[RepairDanglingMembers]++
+			if !dryRun {
+				delete(session.Clients, clientID)
+				leaveEditing(client, session)
+			}
+		}
+		session.mu.Unlock()
+	}
+
+	for id, client := range store.Clients {
+		session, exists := store.Sessions[client.SessionID]
+		if exists {
+			session.mu.Lock()
+			_, member := session.Clients[id]
+			session.mu.Unlock()
+			if member {
+				continue
+			}
+		}
+		repairs[RepairOrphanedClients]++
+		if !dryRun {
+			client.closeConn()
+			delete(store.Clients, id)
+		}
+	}
+	return sessionIDs
+}
+
+func sweepRollups(sessionIDs map[string]bool, dryRun bool, repairs map[string]int) {
+	workspaceIDs := make(map[string]bool)
+	workspaces.mu.Lock()
+	for id := range workspaces.Workspaces {
+		workspaceIDs[id] = true
+	}
+	workspaces.mu.Unlock()
+
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	for key, rollup := range detector.rollups {
+		switch {
+		case strings.HasPrefix(key, "session:"):
+			if sessionIDs[strings.TrimPrefix(key, "session:")] {
+				continue
+			}
+		case strings.HasPrefix(key, "workspace:"):
+			if workspaceIDs[strings.TrimPrefix(key, "workspace:")] {
+				continue
+			}
+		case time.Since(rollup.windowStart) < staleRollupAge:
+			continue
+		}
+		repairs[RepairStaleRollups]++
+		if !dryRun {
+			delete(detector.rollups, key)
+		}
+	}
+}
+
+func sweepAnnotations(sessionIDs map[string]bool, dryRun bool, repairs map[string]int) {
+	annotations.mu.Lock()
+	defer annotations.mu.Unlock()
+
+	for id := range annotations.strokes {
+		if sessionIDs[id] {
+			continue
+		}
+		repairs[RepairStaleAnnotations]++
+		if !dryRun {
+			delete(annotations.strokes, id)
+		}
+	}
+}
+
+func sweepQuotas(dryRun bool, repairs map[string]int) {
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+
+	now := time.Now()
+	for caller, windows := range quotas.usage {
+		live := false
+		for category, w := range windows {
+			if now.Sub(w.start) < quotas.Quotas[category].Window {
+				live = true
+				break
+			}
+		}
+		if live {
+			continue
+		}
+		repairs[RepairExpiredQuotas]++
+		if !dryRun {
+			delete(quotas.usage, caller)
+		}
+	}
+}
+
+func sweepIntegrations(dryRun bool, repairs map[string]int) {
+	targets := make(map[string]bool)
+
+	webhooks.mu.Lock()
+	for id := range webhooks.Webhooks {
+		targets["webhook:"+id] = true
+	}
+	for id := range webhooks.Deliveries {
+		if _, exists := webhooks.Webhooks[id]; exists {
+			continue
+		}
+		repairs[RepairOrphanDeliveries]++
+		if !dryRun {
+			delete(webhooks.Deliveries, id)
+		}
+	}
+	webhooks.mu.Unlock()
+
+	slack.mu.Lock()
+	for id := range slack.Integrations {
+		targets["slack:"+id] = true
+	}
+	slack.mu.Unlock()
+
+	outbound.mu.Lock()
+	defer outbound.mu.Unlock()
+	for target := range outbound.breakers {
+		if targets[target] {
+			continue
+		}
+		repairs[RepairOrphanedBreakers]++
+		if !dryRun {
+			delete(outbound.breakers, target)
+		}
+	}
+}
+
+func runSweep(c *gin.Context) {
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+	if !dryRun {
+		auditRequest(c, "sweeper.run", "server", "", nil)
+	}
+	c.JSON(http.StatusOK, sweeper.Run(dryRun))
+}
+
+func getSweepStatus(c *gin.Context) {
+	sweeper.mu.Lock()
+	defer sweeper.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"runs":    sweeper.runs,
+		"last":    sweeper.last,
+		"repairs": sweeper.totals,
+	})
+}
@@ -0,0 +1,382 @@
+package tango
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errTemplateNotFound = errors.New("Template not found")
+
+// SessionTemplate is a saved session configuration that new sessions are
+// created from. Templates in a workspace are shared with its members; those
+// outside any workspace belong to the user who made them.
+type SessionTemplate struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	WorkspaceID string `json:"workspaceId,omitempty"`
+	CreatedBy   string `json:"createdBy,omitempty"`
+	CreatedAt   int64  `json:"createdAt"`
+	UpdatedAt   int64  `json:"updatedAt,omitempty"`
+	// NamePattern names each session made from the template. {n} is
+	// replaced with its number of uses, counting this one, and {date} and
+	// {time} with the current UTC date and time.
+	NamePattern       string            `json:"namePattern"`
+	Description       string            `json:"description,omitempty"`
+	Tags              []string          `json:"tags,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	CollectionID      string            `json:"collectionId,omitempty"`
+	AutoEnd           bool              `json:"autoEnd"`
+	MaxClients        int               `json:"maxClients,omitempty"`
+	IdleTTL           int               `json:"idleTtlSeconds,omitempty"`
+	ViewerAnnotations bool              `json:"viewerAnnotations"`
+	SFU               bool              `json:"sfu"`
+	E2EE              bool              `json:"e2ee"`
+	MaxFPS            int               `json:"maxFps,omitempty"`
+	WaitingRoom       bool              `json:"waitingRoom"`
+	WaitingTimeout    int               `json:"waitingTimeoutSeconds,omitempty"`
+	Uses              int               `json:"uses"`
+}
+
+type TemplateRegistry struct {
+	Templates map[string]*SessionTemplate
+	mu        sync.Mutex
+}
+
+var templates = &TemplateRegistry{Templates: make(map[string]*SessionTemplate)}
+
+func (r *TemplateRegistry) get(id string) (SessionTemplate, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tmpl, exists := r.Templates[id]
+	if !exists {
+		return SessionTemplate{}, false
+	}
+	return *tmpl, true
+}
+
+// use counts a new session made from the template and returns the count.
+func (r *TemplateRegistry) use(id string) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tmpl, exists := r.Templates[id]
+	if !exists {
+		return 0, false
+	}
+	tmpl.Uses++
+	return tmpl.Uses, true
+}
+
+// By returns the templates userID made.
+func (r *TemplateRegistry) By(userID string) []SessionTemplate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := []SessionTemplate{}
+	for _, tmpl := range r.Templates {
+		if tmpl.CreatedBy == userID {
+			list = append(list, *tmpl)
+		}
+	}
+	return list
+}
+
+// forgetUser deletes the user's personal templates and those of removed
+// workspaces, and takes the user's name off the rest.
+func (r *TemplateRegistry) forgetUser(userID string, removed map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, tmpl := range r.Templates {
+		switch {
+		case removed[tmpl.WorkspaceID], tmpl.WorkspaceID == "" && tmpl.CreatedBy == userID:
+			delete(r.Templates, id)
+		case tmpl.CreatedBy == userID:
+			tmpl.CreatedBy = ""
+		}
+	}
+}
+
+// canSeeTemplate reports whether user may use tmpl: any member of its
+// workspace, or its author for a personal one.
+func canSeeTemplate(c *gin.Context, user *User, tmpl SessionTemplate) bool {
+	if tmpl.WorkspaceID == "" {
+		return tmpl.CreatedBy == user.ID
+	}
+	return canAccess(c, tmpl.WorkspaceID)
+}
+
+// templateFor looks up a template the signed-in caller may use, responding
+// when there is none.
+func templateFor(c *gin.Context) (*User, SessionTemplate, bool) {
+	user := requireUser(c)
+	if user == nil {
+		return nil, SessionTemplate{}, false
+	}
+	tmpl, exists := templates.get(c.Param("id"))
+	if !exists || !canSeeTemplate(c, user, tmpl) {
+		c.JSON(http.StatusNotFound, gin.H{"error": errTemplateNotFound.Error()})
+		return nil, SessionTemplate{}, false
+	}
+	return user, tmpl, true
+}
+
+// renderName fills in the placeholders of a name pattern.
+func renderName(pattern string, n int, now time.Time) string {
+	now = now.UTC()
+	return strings.NewReplacer(
+		"{n}", strconv.Itoa(n),
+		"{date}", now.Format("2006-01-02"),
+		"{time}", now.Format("15:04"),
+	).Replace(pattern)
+}
+
+// TemplateRequest is the configuration a template is created or replaced
+// with.
+type TemplateRequest struct {
+	Name              string            `json:"name" binding:"required,max=200"`
+	WorkspaceID       string            `json:"workspaceId"`
+	NamePattern       string            `json:"namePattern" binding:"required,max=200"`
+	Description       string            `json:"description" binding:"max=2000"`
+	Tags              []string          `json:"tags"`
+	Metadata          map[string]string `json:"metadata"`
+	CollectionID      string            `json:"collectionId"`
+	AutoEnd           bool              `json:"autoEnd"`
+	MaxClients        int               `json:"maxClients" binding:"min=0"`
+	IdleTTL           int               `json:"idleTtlSeconds" binding:"min=0"`
+	ViewerAnnotations bool              `json:"viewerAnnotations"`
+	SFU               bool              `json:"sfu"`
+	E2EE              bool              `json:"e2ee"`
+	MaxFPS            int               `json:"maxFps" binding:"min=0,max=120"`
+	WaitingRoom       bool              `json:"waitingRoom"`
+	WaitingTimeout    int               `json:"waitingTimeoutSeconds" binding:"min=0"`
+}
+
+// validate checks req as createSession would check the sessions made from
+// it.
+func (req TemplateRequest) validate() error {
+	if err := validateTags(req.Tags); err != nil {
+		return err
+	}
+	if err := validateMetadata(req.Metadata); err != nil {
+		return err
+	}
+	if err := collections.checkMove(req.WorkspaceID, req.CollectionID); err != nil {
+		return err
+	}
+	if req.SFU && req.E2EE {
+		return errE2EESFU
+	}
+	if req.SFU && !sfuAvailable {
+		return errSFUUnavailable
+	}
+	return nil
+}
+
+func (req TemplateRequest) apply(tmpl *SessionTemplate) {
+	tmpl.Name = req.Name
+	tmpl.NamePattern = req.NamePattern
+	tmpl.Description = req.Description
+	tmpl.Tags = req.Tags
+	tmpl.Metadata = req.Metadata
+	tmpl.CollectionID = req.CollectionID
+	tmpl.AutoEnd = req.AutoEnd
+	tmpl.MaxClients = req.MaxClients
+	tmpl.IdleTTL = req.IdleTTL
+	tmpl.ViewerAnnotations = req.ViewerAnnotations
+	tmpl.SFU = req.SFU
+	tmpl.E2EE = req.E2EE
+	tmpl.MaxFPS = req.MaxFPS
+	tmpl.WaitingRoom = req.WaitingRoom
+	tmpl.WaitingTimeout = req.WaitingTimeout
+}
+
+func createTemplate(c *gin.Context) {
+	var req TemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var user *User
+	if req.WorkspaceID != "" {
+		user = requireRole(c, req.WorkspaceID, RoleMember)
+	} else {
+		user = requireUser(c)
+	}
+	if user == nil {
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tmpl := &SessionTemplate{
+		ID:          generateID(),
+		WorkspaceID: req.WorkspaceID,
+		CreatedBy:   user.ID,
+		CreatedAt:   getCurrentTimestamp(),
+	}
+	req.apply(tmpl)
+
+	templates.mu.Lock()
+	templates.Templates[tmpl.ID] = tmpl
+	created := *tmpl
+	templates.mu.Unlock()
+
+	auditRequest(c, "template.create", "template", created.ID, gin.H{"name": created.Name})
+	c.JSON(http.StatusCreated, created)
+}
+
+// getTemplates lists the caller's personal templates and those of their
+// workspaces, narrowed to one workspace with ?workspaceId=.
+func getTemplates(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	visible := listingScope(c)
+	only := c.Query("workspaceId")
+
+	templates.mu.Lock()
+	list := []SessionTemplate{}
+	for _, tmpl := range templates.Templates {
+		if tmpl.WorkspaceID == "" && only == "" && tmpl.CreatedBy == user.ID ||
+			tmpl.WorkspaceID != "" && visible(tmpl.WorkspaceID) {
+			list = append(list, *tmpl)
+		}
+	}
+	templates.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	c.JSON(http.StatusOK, gin.H{"templates": list})
+}
+
+func getTemplate(c *gin.Context) {
+	_, tmpl, ok := templateFor(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, tmpl)
+}
+
+// updateTemplate replaces a template's configuration. Its workspace cannot
+// change.
+func updateTemplate(c *gin.Context) {
+	var req TemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	_, current, ok := templateFor(c)
+	if !ok {
+		return
+	}
+	req.WorkspaceID = current.WorkspaceID
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	templates.mu.Lock()
+	tmpl, exists := templates.Templates[current.ID]
+	if !exists {
+		templates.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": errTemplateNotFound.Error()})
+		return
+	}
+	req.apply(tmpl)
+	tmpl.UpdatedAt = getCurrentTimestamp()
+	updated := *tmpl
+	templates.mu.Unlock()
+
+	auditRequest(c, "template.update", "template", updated.ID, gin.H{"name": updated.Name})
+	c.JSON(http.StatusOK, updated)
+}
+
+func deleteTemplate(c *gin.Context) {
+	_, tmpl, ok := templateFor(c)
+	if !ok {
+		return
+	}
+
+	templates.mu.Lock()
+	delete(templates.Templates, tmpl.ID)
+	templates.mu.Unlock()
+
+	auditRequest(c, "template.delete", "template", tmpl.ID, gin.H{"name": tmpl.Name})
+	c.Status(http.StatusNoContent)
+}
+
+type InstantiateTemplateRequest struct {
+	Name        string `json:"name"`
+	ExternalRef string `json:"externalRef"`
+	ExternalID  string `json:"externalId"`
+	StartAt     int64  `json:"startAt" binding:"min=0"`
+}
+
+// instantiateTemplate creates a session from a template. The session is
+// named from the pattern unless the body gives a name, and is created in
+// the template's workspace.
+func instantiateTemplate(c *gin.Context) {
+	var req InstantiateTemplateRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	_, tmpl, ok := templateFor(c)
+	if !ok {
+		return
+	}
+
+	n, exists := templates.use(tmpl.ID)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": errTemplateNotFound.Error()})
+		return
+	}
+	name := req.Name
+	if name == "" {
+		name = renderName(tmpl.NamePattern, n, time.Now())
+	}
+	if strings.TrimSpace(name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The template's name pattern gives an empty name"})
+		return
+	}
+
+	metadata := make(map[string]string, len(tmpl.Metadata))
+	for key, value := range tmpl.Metadata {
+		metadata[key] = value
+	}
+	startSession(c, CreateSessionRequest{
+		Name:              name,
+		ExternalRef:       req.ExternalRef,
+		ExternalID:        req.ExternalID,
+		Description:       tmpl.Description,
+		Tags:              append([]string(nil), tmpl.Tags...),
+		Metadata:          metadata,
+		AutoEnd:           tmpl.AutoEnd,
+		MaxClients:        tmpl.MaxClients,
+		IdleTTL:           tmpl.IdleTTL,
+		ViewerAnnotations: tmpl.ViewerAnnotations,
+		SFU:               tmpl.SFU,
+		E2EE:              tmpl.E2EE,
+		MaxFPS:            tmpl.MaxFPS,
+		WaitingRoom:       tmpl.WaitingRoom,
+		WaitingTimeout:    tmpl.WaitingTimeout,
+		StartAt:           req.StartAt,
+		WorkspaceID:       tmpl.WorkspaceID,
+		CollectionID:      tmpl.CollectionID,
+		templateID:        tmpl.ID,
+	})
+}
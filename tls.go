@@ -0,0 +1,90 @@
+package tango
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const certReloadInterval = 30 * time.Second
+
+// certReloader serves the configured certificate and picks up renewed files
+// from disk without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+	mu       sync.Mutex
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = info.ModTime()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= certReloadInterval {
+		r.checked = time.Now()
+		if info, err := os.Stat(r.certFile); err == nil && info.ModTime().After(r.modTime) {
+			if err := r.load(); err != nil {
+				logger.Warn("reloading TLS certificate failed", "error", err)
+			} else {
+				logger.Info("reloaded TLS certificate", "file", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// configureTLS prepares srv to terminate TLS according to cfg. It returns
+// an optional handler that must be served on the plain HTTP port, used for
+// ACME challenges and redirects when autocert is enabled.
+func configureTLS(srv *http.Server, cfg *Config) (http.Handler, error) {
+	if cfg.TLS.AutocertHost != "" {
+		tlsConfig, challenge, err := autocertTLS(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = tlsConfig
+		return challenge, nil
+	}
+
+	reloader, err := newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	return nil, nil
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	target := "https://" + r.Host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
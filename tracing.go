@@ -0,0 +1,298 @@
+package tango
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Spans are exported to an OTLP/HTTP collector as JSON. Tracing is disabled
+// unless OTEL_EXPORTER_OTLP_ENDPOINT is set, in which case every span method
+// is a no-op on the nil *Span returned by startSpan.
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindProducer = 4
+
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+	traceQueueSize     = 4096
+)
+
+type Span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]interface{}
+	Err      string
+	mu       sync.Mutex
+	finished bool
+}
+
+type Tracer struct {
+	endpoint string
+	service  string
+	queue    chan *Span
+	client   *http.Client
+}
+
+func NewTracer() *Tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return nil
+	}
+
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "tango-backend"
+	}
+
+	t := &Tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service:  service,
+		queue:    make(chan *Span, traceQueueSize),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	go t.run()
+	return t
+}
+
+var tracer = NewTracer()
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSpan begins a span as a child of parent, or as a new trace root when
+// parent is nil.
+func startSpan(parent *Span, name string, kind int) *Span {
+	if tracer == nil {
+		return nil
+	}
+
+	span := &Span{
+		SpanID: randomHex(8),
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+		Attrs:  make(map[string]interface{}),
+	}
+	if parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.TraceID = randomHex(16)
+	}
+	return span
+}
+
+// startRemoteSpan continues a trace from a W3C traceparent header value.
+func startRemoteSpan(traceparent, name string, kind int) *Span {
+	span := startSpan(nil, name, kind)
+	if span == nil {
+		return nil
+	}
+
+	parts := strings.Split(traceparent, "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		span.TraceID = parts[1]
+		span.ParentID = parts[2]
+	}
+	return span
+}
+
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Attrs[key] = value
+	s.mu.Unlock()
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Err = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + s.TraceID + "-" + s.SpanID + "-01"
+}
+
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	select {
+	case tracer.queue <- s:
+	default:
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, traceBatchSize)
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttr(key string, value interface{}) otlpAttribute {
+	var v otlpValue
+	switch x := value.(type) {
+	case int:
+		s := strconv.Itoa(x)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &x
+	case bool:
+		v.BoolValue = &x
+	default:
+		s := fmt.Sprint(x)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
+
+func (t *Tracer) export(batch []*Span) {
+	spans := make([]gin.H, 0, len(batch))
+	for _, s := range batch {
+		attrs := make([]otlpAttribute, 0, len(s.Attrs))
+		for key, value := range s.Attrs {
+			attrs = append(attrs, otlpAttr(key, value))
+		}
+		status := gin.H{"code": 1}
+		if s.Err != "" {
+			status = gin.H{"code": 2, "message": s.Err}
+		}
+		spans = append(spans, gin.H{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"parentSpanId":      s.ParentID,
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        attrs,
+			"status":            status,
+		})
+	}
+
+	body, err := json.Marshal(gin.H{
+		"resourceSpans": []gin.H{{
+			"resource": gin.H{
+				"attributes": []otlpAttribute{otlpAttr("service.name", t.service)},
+			},
+			"scopeSpans": []gin.H{{
+				"scope": gin.H{"name": "tango"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		logger.Error("encoding spans failed", "error", err)
+		return
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("exporting spans failed", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Warn("exporting spans failed", "status", resp.StatusCode)
+	}
+}
+
+// tracing opens a server span for every request, continuing any trace
+// propagated through the traceparent header.
+func tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		span := startRemoteSpan(c.GetHeader("traceparent"), c.Request.Method+" "+c.FullPath(), SpanKindServer)
+		if span == nil {
+			c.Next()
+			return
+		}
+		c.Set("span", span)
+		c.Header("traceparent", span.Traceparent())
+
+		c.Next()
+
+		span.SetAttr("http.method", c.Request.Method)
+		span.SetAttr("http.route", c.FullPath())
+		span.SetAttr("http.status_code", c.Writer.Status())
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("status %d", c.Writer.Status()))
+		}
+		span.Finish()
+	}
+}
+
+func requestSpan(c *gin.Context) *Span {
+	if s, ok := c.Get("span"); ok {
+		return s.(*Span)
+	}
+	return nil
+}
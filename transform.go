@@ -0,0 +1,163 @@
+package tango
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/interpreter"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Transforms are CEL expressions evaluated against the outgoing event,
+// whose fields (id, event, createdAt and payload) are variables; the value
+// of the expression is sent as the payload. CEL has no unbounded loops or
+// side effects, and each evaluation is further held to a cost budget, a
+// deadline and a cap on the memory its operations allocate.
+const (
+	transformMaxSource = 4 << 10
+	transformMaxCost   = 10000
+	transformMaxMemory = 1 << 20
+	transformMaxOutput = 64 << 10
+	transformTimeout   = 100 * time.Millisecond
+
+	// transformInterruptEvery is how many comprehension iterations pass
+	// between checks of the deadline.
+	transformInterruptEvery = 100
+)
+
+var (
+	errTransformTooLarge = errors.New("transform exceeds size limit")
+	errTransformBudget   = errors.New("transform exceeded its cost budget")
+	errTransformMemory   = errors.New("transform exceeded its memory limit")
+	errTransformTimeout  = errors.New("transform took too long")
+)
+
+var transformEnv = mustTransformEnv()
+
+func mustTransformEnv() *cel.Env {
+	env, err := cel.NewEnv(
+		cel.Variable("id", cel.StringType),
+		cel.Variable("event", cel.StringType),
+		cel.Variable("createdAt", cel.DynType),
+		cel.Variable("payload", cel.DynType),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}
+
+type Transform struct {
+	ast *cel.Ast
+}
+
+func compileTransform(source string) (*Transform, error) {
+	if len(source) > transformMaxSource {
+		return nil, errTransformTooLarge
+	}
+	ast, issues := transformEnv.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	// Planning catches what checking doesn't, such as bad regexes.
+	if _, err := transformEnv.Program(ast); err != nil {
+		return nil, err
+	}
+	return &Transform{ast: ast}, nil
+}
+
+// Apply evaluates the expression against input, which must be the JSON
+// event envelope, and returns the result as JSON.
+func (t *Transform) Apply(input []byte) ([]byte, error) {
+	var vars map[string]interface{}
+	if err := json.Unmarshal(input, &vars); err != nil {
+		return nil, err
+	}
+
+	// Each evaluation gets its own program, since the meter counting its
+	// allocations is part of it.
+	meter := &transformMeter{}
+	program, err := transformEnv.Program(t.ast,
+		cel.CostLimit(transformMaxCost),
+		cel.CostTracking(meter),
+		cel.InterruptCheckFrequency(transformInterruptEvery),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), transformTimeout)
+	defer cancel()
+
+	out, _, err := program.ContextEval(ctx, vars)
+	if err != nil {
+		var cancelled interpreter.EvalCancelledError
+		switch {
+		case meter.exceeded:
+			return nil, errTransformMemory
+		case !errors.As(err, &cancelled):
+			return nil, err
+		case cancelled.Cause == interpreter.CostLimitExceeded:
+			return nil, errTransformBudget
+		}
+		return nil, errTransformTimeout
+	}
+
+	native, err := out.ConvertToNative(reflect.TypeOf(&structpb.Value{}))
+	if err != nil {
+		return nil, fmt.Errorf("result is not JSON: %v", err)
+	}
+	body, err := json.Marshal(native.(*structpb.Value).AsInterface())
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > transformMaxOutput {
+		return nil, errTransformTooLarge
+	}
+	return body, nil
+}
+
+// transformMeter adds up what the functions an evaluation calls allocate.
+// CEL's cost budget tracks work, not memory: concatenating a string with
+// itself costs little but doubles it. Once over the cap, the meter reports
+// a cost past the budget, which is how an observer can stop evaluation.
+type transformMeter struct {
+	allocated uint64
+	exceeded  bool
+}
+
+var transformOverBudget = uint64(transformMaxCost + 1)
+
+func (m *transformMeter) CallCost(function, overloadID string, args []ref.Val, result ref.Val) *uint64 {
+	m.allocated += transformSize(result)
+	if m.allocated > transformMaxMemory {
+		m.exceeded = true
+		return &transformOverBudget
+	}
+	// Leave the cost to CEL's own estimates.
+	return nil
+}
+
+// transformSize approximates the bytes held by a value a function made:
+// the length of strings and bytes, and a word per element of a list or
+// map, whose elements are counted when they are made.
+func transformSize(value ref.Val) uint64 {
+	switch v := value.(type) {
+	case types.String:
+		return uint64(len(v))
+	case types.Bytes:
+		return uint64(len(v))
+	case traits.Sizer:
+		if size, ok := v.Size().(types.Int); ok && size > 0 {
+			return uint64(size) * 8
+		}
+	}
+	return 8
+}
@@ -0,0 +1,113 @@
+package tango
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trashSession soft-deletes session, ending it first if clients are still
+// connected. Callers must hold session.mu.
+func trashSession(session *Session) {
+	if session.Status == SessionLive {
+		endSession(session)
+	}
+	session.TrashedFrom = session.Status
+	session.Status = SessionTrashed
+	session.DeletedAt = getCurrentTimestamp()
+	emitEvent(EventSessionTrashed, session)
+}
+
+// purgeSession removes session and everything hanging off it for good.
+// Callers must hold store.mu and session.mu.
+func purgeSession(session *Session) {
+	for _, client := range session.Clients {
+		client.closeConn()
+		delete(store.Clients, client.ID)
+	}
+	turnAwayAll(session, "session_ended")
+
+	id := session.ID
+	emitEvent(EventSessionDeleted, gin.H{"sessionId": id})
+	delete(store.Sessions, id)
+	workspaces.forgetSession(id)
+	favorites.forgetItem(itemRef{Type: FavoriteSession, ID: id})
+	detector.Forget("session:" + id)
+	annotations.Forget(id)
+	polls.Forget(id)
+	questions.Forget(id)
+	captions.Forget(id)
+	chat.Forget(id)
+	screenshots.Forget(session)
+	recordings.Forget(session)
+	comments.Forget(id)
+	sessionHistory.Forget(id)
+	calendars.forgetSession(id)
+	go sfu.Close(id)
+}
+
+// purgeTrash permanently deletes sessions that have been in the trash for
+// longer than the retention window.
+func purgeTrash(now int64) int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	purged := 0
+	for _, session := range store.Sessions {
+		session.mu.Lock()
+		if session.Status == SessionTrashed && now-session.DeletedAt >= int64(config.TrashRetention) {
+			purgeSession(session)
+			audit.Record(ActorSystem, "session.purge", "session", session.ID, "", gin.H{"reason": "retention"})
+			purged++
+		}
+		session.mu.Unlock()
+	}
+	return purged
+}
+
+// purgeTrashedGuides permanently deletes guides that have been in the
+// trash for longer than the retention window.
+func purgeTrashedGuides(now int64) int {
+	guides.mu.Lock()
+	var expired []string
+	for id, guide := range guides.Guides {
+		if guide.TrashedAt != 0 && now-guide.TrashedAt >= int64(config.TrashRetention) {
+			expired = append(expired, id)
+		}
+	}
+	guides.mu.Unlock()
+	for _, id := range expired {
+		guides.purge(id)
+		audit.Record(ActorSystem, "guide.purge", "guide", id, "", gin.H{"reason": "retention"})
+	}
+	return len(expired)
+}
+
+func restoreSession(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.Status != SessionTrashed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session is not in the trash"})
+		return
+	}
+
+	session.Status = session.TrashedFrom
+	if session.Status == "" {
+		session.Status = SessionEnded
+	}
+	session.TrashedFrom = ""
+	session.DeletedAt = 0
+	if session.IdleSince != 0 {
+		session.IdleSince = getCurrentTimestamp()
+	}
+	emitEvent(EventSessionRestored, session)
+	auditRequest(c, "session.restore", "session", session.ID, nil)
+	c.JSON(http.StatusOK, session)
+}
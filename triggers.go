@@ -0,0 +1,238 @@
+package tango
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Trigger is an event low-code platforms such as Zapier can start a
+// workflow from, either by polling for new items or by subscribing a
+// webhook to it. Sample shows what an item's payload looks like.
+type Trigger struct {
+	Key         string      `json:"key"`
+	Event       string      `json:"event"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Sample      interface{} `json:"sample"`
+}
+
+// TriggerItem is an occurrence of a trigger. Its ID is the change log
+// offset of the event, so it stays the same however often it is polled,
+// and the payload is what the event's webhooks receive.
+type TriggerItem struct {
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt int64           `json:"createdAt"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+func sampleSession(status string, endedAt int64) *Session {
+	return &Session{
+		ID:          "s_sample",
+		Name:        "Onboarding walkthrough",
+		WorkspaceID: "ws_sample",
+		Owner:       "alice@example.com",
+		CreatedBy:   "u_sample",
+		CreatedAt:   1767225600,
+		Status:      status,
+		EndedAt:     endedAt,
+		AutoEnd:     true,
+	}
+}
+
+var triggerCatalog = []Trigger{
+	{
+		Key:         "new_guide",
+		Event:       EventGuideCreated,
+		Name:        "New guide",
+		Description: "A guide was assembled from a session.",
+		Sample: Guide{
+			ID:          "g_sample",
+			Title:       "Onboarding walkthrough",
+			Status:      GuideDraft,
+			WorkspaceID: "ws_sample",
+			SessionID:   "s_sample",
+			CreatedBy:   "u_sample",
+			CreatedAt:   1767229200,
+			Steps: []GuideStep{{
+				ID:       "st_sample",
+				Title:    "Click #signup on app.example.com/welcome",
+				PageURL:  "https://app.example.com/welcome",
+				Selector: "#signup",
+				At:       1767225660,
+				Image:    &GuideImage{ContentType: "image/png", Size: 182044, Width: 1440, Height: 900},
+			}},
+		},
+	},
+	{
+		Key:         "new_session",
+		Event:       EventSessionCreated,
+		Name:        "New session",
+		Description: "A session was created.",
+		Sample:      sampleSession(SessionLive, 0),
+	},
+	{
+		Key:         "session_ended",
+		Event:       EventSessionEnded,
+		Name:        "Session ended",
+		Description: "A session ended, by its host or on its own.",
+		Sample:      sampleSession(SessionEnded, 1767227400),
+	},
+}
+
+func triggerFor(c *gin.Context) (Trigger, bool) {
+	for _, trigger := range triggerCatalog {
+		if trigger.Key == c.Param("key") {
+			return trigger, true
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Trigger not found"})
+	return Trigger{}, false
+}
+
+func getTriggers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"triggers": triggerCatalog})
+}
+
+// triggerScope decides which events a poll shows: those of the caller's
+// workspaces, narrowed to ?workspaceId= when given, sessions outside any
+// workspace, and the caller's own personal guides.
+func triggerScope(c *gin.Context, user *User) func(ChangeEvent) bool {
+	mine := workspaces.memberships(user, signedInWithSSO(c))
+	only := c.Query("workspaceId")
+	return func(event ChangeEvent) bool {
+		var subject struct {
+			WorkspaceID string `json:"workspaceId"`
+			CreatedBy   string `json:"createdBy"`
+		}
+		if err := json.Unmarshal(event.Data, &subject); err != nil {
+			return false
+		}
+		switch {
+		case only != "":
+			return subject.WorkspaceID == only && mine[only] && networkPermits(c, only)
+		case subject.WorkspaceID != "":
+			return mine[subject.WorkspaceID] && networkPermits(c, subject.WorkspaceID)
+		case event.Type == EventGuideCreated:
+			return subject.CreatedBy == user.ID
+		}
+		return true
+	}
+}
+
+// pollTrigger lists a trigger's items newest first. Without a cursor it
+// returns the latest ones; with ?after= it returns the next page of those
+// that came after the cursor, and more is set while pages remain. Either
+// way the response's cursor is where the next poll picks up.
+func pollTrigger(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	trigger, ok := triggerFor(c)
+	if !ok {
+		return
+	}
+	limit := defaultPageSize
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageSize)})
+			return
+		}
+		limit = n
+	}
+
+	filter := ChangeFilter{Type: trigger.Event}
+	var (
+		events []ChangeEvent
+		next   int64
+		more   bool
+	)
+	if value := c.Query("after"); value != "" {
+		after, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || after < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "after must be a cursor from an earlier poll"})
+			return
+		}
+		if events, next, more, _, err = changes.Read(after, filter, limit); err != nil {
+			changesDropped(c)
+			return
+		}
+	} else {
+		events, next = changes.latest(filter, limit)
+	}
+
+	visible := triggerScope(c, user)
+	items := []TriggerItem{}
+	for i := len(events) - 1; i >= 0; i-- {
+		if event := events[i]; visible(event) {
+			items = append(items, TriggerItem{
+				ID:        strconv.FormatInt(event.Offset, 10),
+				Event:     event.Type,
+				CreatedAt: event.At / 1000,
+				Payload:   event.Data,
+			})
+		}
+	}
+	resp := gin.H{"items": items, "cursor": strconv.FormatInt(next, 10)}
+	if more {
+		resp["more"] = true
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type SubscribeTriggerRequest struct {
+	TargetURL   string `json:"targetUrl" binding:"required,url"`
+	WorkspaceID string `json:"workspaceId"`
+}
+
+// subscribeTrigger adds a webhook for the trigger's event, the way REST
+// hook subscriptions expect. The webhook's secret is only returned here;
+// unsubscribing deletes the webhook.
+func subscribeTrigger(c *gin.Context) {
+	var req SubscribeTriggerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if requireUser(c) == nil {
+		return
+	}
+	trigger, ok := triggerFor(c)
+	if !ok {
+		return
+	}
+	if req.WorkspaceID != "" && requireRole(c, req.WorkspaceID, RoleAdmin) == nil {
+		return
+	}
+	if err := checkPublicURL(c.Request.Context(), req.TargetURL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid targetUrl: " + err.Error()})
+		return
+	}
+
+	hook := &Webhook{
+		ID:          generateID(),
+		URL:         req.TargetURL,
+		Secret:      randomToken(24),
+		Events:      []string{trigger.Event},
+		CreatedAt:   getCurrentTimestamp(),
+		WorkspaceID: req.WorkspaceID,
+	}
+	webhooks.mu.Lock()
+	webhooks.Webhooks[hook.ID] = hook
+	webhooks.mu.Unlock()
+	auditRequest(c, "webhook.create", "webhook", hook.ID, gin.H{"url": hook.URL, "trigger": trigger.Key})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":          hook.ID,
+		"trigger":     trigger.Key,
+		"targetUrl":   hook.URL,
+		"workspaceId": hook.WorkspaceID,
+		"secret":      hook.Secret,
+	})
+}
@@ -0,0 +1,202 @@
+package tango
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// User is a person who can belong to workspaces. Users authenticate to the
+// API with bearer tokens; only a hash of each token is kept.
+type User struct {
+	ID        string `json:"id"`
+	Email     string `json:"email"`
+	Name      string `json:"name,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+	// DeletionScheduledAt is when the account will be erased, if its owner
+	// asked for that. Guarded by users.mu.
+	DeletionScheduledAt int64 `json:"deletionScheduledAt,omitempty"`
+}
+
+// How an API token was obtained. Workspaces that require single sign-on
+// only accept tokens issued through the IdP.
+const (
+	AuthToken      = "token"
+	AuthInvitation = "invitation"
+	AuthOAuth      = "oauth"
+	AuthSSO        = "sso"
+	AuthEmail      = "email"
+)
+
+type tokenGrant struct {
+	user   *User
+	method string
+}
+
+type UserRegistry struct {
+	Users   map[string]*User
+	byEmail map[string]*User
+	tokens  map[string]tokenGrant
+	// identities maps "provider:subject" from OAuth sign-ins to users.
+	identities map[string]*User
+	mu         sync.Mutex
+}
+
+func NewUserRegistry() *UserRegistry {
+	return &UserRegistry{
+		Users:   make(map[string]*User),
+		byEmail: make(map[string]*User),
+		tokens:  make(map[string]tokenGrant),
+
+		identities: make(map[string]*User),
+	}
+}
+
+var users = NewUserRegistry()
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ensure returns the user registered under email, creating it if needed.
+// Callers must hold r.mu.
+func (r *UserRegistry) ensure(email, name string) *User {
+	email = normalizeEmail(email)
+	if user, exists := r.byEmail[email]; exists {
+		return user
+	}
+	user := &User{
+		ID:        generateID(),
+		Email:     email,
+		Name:      name,
+		CreatedAt: getCurrentTimestamp(),
+	}
+	r.Users[user.ID] = user
+	r.byEmail[email] = user
+	return user
+}
+
+// signIn returns the user behind an external identity. An identity seen for
+// the first time is linked to the user with the same email, or to a new
+// user; linked reports that it was attached to an existing account.
+// Callers must hold r.mu.
+func (r *UserRegistry) signIn(provider string, profile oauthProfile) (user *User, linked bool) {
+	key := provider + ":" + profile.Subject
+	if user, exists := r.identities[key]; exists {
+		return user, false
+	}
+	_, linked = r.byEmail[normalizeEmail(profile.Email)]
+	user = r.ensure(profile.Email, profile.Name)
+	r.identities[key] = user
+	return user, linked
+}
+
+// issueToken mints a new API token for user, remembering how the user
+// signed in. Callers must hold r.mu.
+func (r *UserRegistry) issueToken(user *User, method string) string {
+	token := "tk_" + randomToken(32)
+	r.tokens[hashToken(token)] = tokenGrant{user: user, method: method}
+	return token
+}
+
+func (r *UserRegistry) byToken(token string) (*User, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	grant := r.tokens[hashToken(token)]
+	return grant.user, grant.method
+}
+
+// identify attaches the user behind a bearer token to the request. Unknown
+// tokens are not rejected here: the admin and replication APIs carry their
+// own bearer tokens, and anonymous callers still reach unscoped resources.
+func identify() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "); token != "" {
+			if user, method := users.byToken(token); user != nil {
+				c.Set("user", user)
+				c.Set("authMethod", method)
+			}
+		}
+		c.Next()
+	}
+}
+
+// signInWithToken attaches the user behind an API token that came some
+// other way than the Authorization header, such as in the query string of
+// a browser's WebSocket handshake. A request already signed in is left as
+// it is.
+func signInWithToken(c *gin.Context, token string) {
+	if token == "" || currentUser(c) != nil {
+		return
+	}
+	if user, method := users.byToken(token); user != nil {
+		c.Set("user", user)
+		c.Set("authMethod", method)
+	}
+}
+
+func currentUser(c *gin.Context) *User {
+	if u, ok := c.Get("user"); ok {
+		return u.(*User)
+	}
+	return nil
+}
+
+func signedInWithSSO(c *gin.Context) bool {
+	return c.GetString("authMethod") == AuthSSO
+}
+
+// requireUser responds 401 and returns nil when the request is anonymous.
+func requireUser(c *gin.Context) *User {
+	user := currentUser(c)
+	if user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign in with an API token to use workspaces"})
+	}
+	return user
+}
+
+type CreateUserRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	Name  string `json:"name" binding:"max=200"`
+}
+
+// createUser lets an operator provision a user and hand out its first API
+// token.
+func createUser(c *gin.Context) {
+	var req CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	users.mu.Lock()
+	user := users.ensure(req.Email, req.Name)
+	token := users.issueToken(user, AuthToken)
+	users.mu.Unlock()
+
+	auditRequest(c, "user.token", "user", user.ID, gin.H{"email": user.Email})
+	c.JSON(http.StatusCreated, gin.H{"user": user, "token": token})
+}
+
+func getMe(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	users.mu.Lock()
+	profile := *user
+	users.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{
+		"user":       profile,
+		"workspaces": workspaces.listFor(user),
+	})
+}
@@ -1,23 +1,35 @@
-package main
+package tango
 
 import (
 	"math/rand"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func randomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
+func getCurrentTimestamp() int64 {
+	return time.Now().Unix()
+}
+
+func containsString(list []string, want string) bool {
+	for _, item := range list {
+		if item == want {
+			return true
+		}
 	}
-	return string(b)
+	return false
 }
 
-func getCurrentTimestamp() int64 {
-	return time.Now().Unix()
+// requestOrigin is the scheme and host the client reached the server at,
+// for links it is given to use without credentials.
+func requestOrigin(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
 }
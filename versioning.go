@@ -0,0 +1,116 @@
+package tango
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The REST API is versioned by path: routes are registered under
+// /api/<version>. Requests to the unversioned /api paths are served by the
+// version named in their API-Version header, the current one by default,
+// and answered with deprecation headers pointing at the versioned path.
+const (
+	apiVersion       = "v1"
+	apiPrefix        = "/api/" + apiVersion
+	apiVersionHeader = "API-Version"
+)
+
+// apiVersions lists the versions the server still serves, oldest first.
+var apiVersions = []string{apiVersion}
+
+type legacyPathKey struct{}
+
+// parseAPIVersion accepts a version as "v1" or "1".
+func parseAPIVersion(value string) (string, bool) {
+	v := strings.ToLower(strings.TrimSpace(value))
+	if !strings.HasPrefix(v, "v") {
+		v = "v" + v
+	}
+	return v, containsString(apiVersions, v)
+}
+
+// isVersionSegment reports whether segment looks like a version, supported
+// or not, so /api/v9/... is not mistaken for a legacy path.
+func isVersionSegment(segment string) bool {
+	if len(segment) < 2 || segment[0] != 'v' {
+		return false
+	}
+	for _, ch := range segment[1:] {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func writeVersionError(w http.ResponseWriter, requested string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(gin.H{
+		"error":     "Unsupported API version " + requested,
+		"supported": apiVersions,
+	})
+}
+
+// versionedAPI routes unversioned /api requests to a versioned path and
+// checks the API-Version header of versioned ones against their path.
+func versionedAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/api")
+		if rest == r.URL.Path || rest != "" && rest[0] != '/' {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		requested := r.Header.Get(apiVersionHeader)
+		segment := strings.SplitN(strings.TrimPrefix(rest, "/"), "/", 2)[0]
+		if isVersionSegment(segment) {
+			if requested != "" {
+				if v, _ := parseAPIVersion(requested); v != segment {
+					writeVersionError(w, requested)
+					return
+				}
+			}
+			w.Header().Set(apiVersionHeader, segment)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		version := apiVersion
+		if requested != "" {
+			v, ok := parseAPIVersion(requested)
+			if !ok {
+				writeVersionError(w, requested)
+				return
+			}
+			version = v
+		}
+
+		original := r.URL.Path
+		successor := "/api/" + version + rest
+		w.Header().Set(apiVersionHeader, version)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		if sunset, err := time.Parse(dayLayout, config.APISunset); err == nil {
+			w.Header().Set("Sunset", sunset.Format(http.TimeFormat))
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), legacyPathKey{}, original))
+		r.URL.Path = successor
+		if r.URL.RawPath != "" {
+			r.URL.RawPath = "/api/" + version + strings.TrimPrefix(r.URL.RawPath, "/api")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// legacyPath returns the unversioned path a request was made to, if any.
+func legacyPath(c *gin.Context) string {
+	path, _ := c.Request.Context().Value(legacyPathKey{}).(string)
+	return path
+}
@@ -0,0 +1,341 @@
+package tango
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	ClientWaiting = "waiting"
+
+	defaultWaitingTimeout = 10 * time.Minute
+)
+
+// Sessions with a waiting room hold viewers outside the session until a
+// host lets them in. A held client gets a waiting message instead of
+// session_joined, is left out of the session's clients and broadcasts, and
+// may not send anything. Hosts are sent the queue as waiting_room whenever
+// it changes and answer with waiting_admit or waiting_reject. Whoever is
+// not admitted within the session's timeout is turned away.
+
+// waitingClient is a client held in a session's waiting room. announced is
+// set once the client has been told it is waiting, and only then do hosts
+// see it and its timer run.
+type waitingClient struct {
+	client    *Client
+	since     int64
+	announced bool
+	timer     *time.Timer
+}
+
+// WaitingEntry is how a held client appears in the admission queue.
+type WaitingEntry struct {
+	ClientID string `json:"clientId"`
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+	Since    int64  `json:"since"`
+}
+
+func (s *Session) waitingTimeout() time.Duration {
+	if s.WaitingTimeout > 0 {
+		return time.Duration(s.WaitingTimeout) * time.Second
+	}
+	return defaultWaitingTimeout
+}
+
+// errWaitingRoomHost refuses a waiting room nobody could run.
+var errWaitingRoomHost = errors.New("a waiting room needs a host; create the session signed in or in a workspace")
+
+// hostless reports whether a session created by createdBy in workspaceID
+// could have no hosts.
+func hostless(createdBy, workspaceID string) bool {
+	return createdBy == "" && workspaceID == ""
+}
+
+// holdsInWaitingRoom reports whether client must wait to be admitted.
+// Hosts go straight in. Callers must hold session.mu.
+func holdsInWaitingRoom(session *Session, client *Client) bool {
+	return session.WaitingRoom && !isHost(client)
+}
+
+// holdClient puts client in the waiting room. Callers must hold session.mu.
+func holdClient(session *Session, client *Client) {
+	if session.waiting == nil {
+		session.waiting = make(map[string]*waitingClient)
+	}
+	client.Status = ClientWaiting
+	client.held = true
+	atomic.StoreInt32(&client.waiting, 1)
+	session.waiting[client.ID] = &waitingClient{client: client, since: getCurrentTimestamp()}
+}
+
+// isWaiting reports whether client is still held, without taking locks.
+func isWaiting(client *Client) bool {
+	return atomic.LoadInt32(&client.waiting) == 1
+}
+
+// announceWaiting tells a held client it is waiting, once its connection is
+// ready, and shows it to the hosts. It reports false if the client was
+// admitted in the meantime and should be welcomed as usual.
+func announceWaiting(session *Session, client *Client) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	entry := session.waiting[client.ID]
+	if entry == nil {
+		if session.Clients[client.ID] == client {
+			return false
+		}
+		// Turned away before its connection was ready.
+		client.closeConn()
+		return true
+	}
+	entry.announced = true
+	timeout := session.waitingTimeout()
+	entry.timer = time.AfterFunc(timeout, func() {
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		if session.waiting[client.ID] == entry {
+			turnAway(session, client, "timeout")
+		}
+	})
+	client.send(Message{
+		Type: "waiting",
+		Payload: gin.H{
+			"sessionId":      session.ID,
+			"clientId":       client.ID,
+			"timeoutSeconds": int(timeout.Seconds()),
+		},
+	})
+	broadcastWaitingRoom(session)
+	return true
+}
+
+// waitingList returns the admission queue, oldest first. Callers must hold
+// session.mu.
+func waitingList(session *Session) []WaitingEntry {
+	list := []WaitingEntry{}
+	for _, entry := range session.waiting {
+		if entry.announced {
+			list = append(list, WaitingEntry{
+				ClientID: entry.client.ID,
+				Name:     entry.client.Name,
+				Role:     entry.client.Role,
+				Since:    entry.since,
+			})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Since != list[j].Since {
+			return list[i].Since < list[j].Since
+		}
+		return list[i].ClientID < list[j].ClientID
+	})
+	return list
+}
+
+// broadcastWaitingRoom sends the admission queue to the session's hosts.
+// Callers must hold session.mu.
+func broadcastWaitingRoom(session *Session) {
+	sendToHosts(session, Message{Type: "waiting_room", Payload: gin.H{"waiting": waitingList(session)}})
+}
+
+// sendWaitingRoom brings a host that just joined up to date.
+func sendWaitingRoom(client *Client, session *Session) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.WaitingRoom || len(session.waiting) > 0 {
+		deliver(client, Message{Type: "waiting_room", Payload: gin.H{"waiting": waitingList(session)}})
+	}
+}
+
+// release takes client out of the waiting room. Callers must hold
+// session.mu.
+func (entry *waitingClient) release(session *Session) {
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	delete(session.waiting, entry.client.ID)
+	atomic.StoreInt32(&entry.client.waiting, 0)
+}
+
+// turnAway refuses a held client and closes its connection. reason is
+// rejected, timeout or session_ended. Callers must hold session.mu.
+func turnAway(session *Session, client *Client, reason string) {
+	entry := session.waiting[client.ID]
+	if entry == nil {
+		return
+	}
+	entry.release(session)
+	closeWith(client, Message{Type: "admission_rejected", Payload: gin.H{"reason": reason}}, websocket.ClosePolicyViolation, reason)
+	broadcastWaitingRoom(session)
+}
+
+// turnAwayAll empties the waiting room when the session stops taking
+// joins. Callers must hold session.mu.
+func turnAwayAll(session *Session, reason string) {
+	for _, entry := range session.waiting {
+		turnAway(session, entry.client, reason)
+	}
+}
+
+// leaveWaitingRoom drops a held client whose connection went away. Callers
+// must hold session.mu.
+func leaveWaitingRoom(session *Session, client *Client) {
+	if entry := session.waiting[client.ID]; entry != nil {
+		entry.release(session)
+		broadcastWaitingRoom(session)
+	}
+}
+
+// admitWaiting lets a held client into the session, subject to the usual
+// admission checks. The client is welcomed here unless its own join has yet
+// to announce it, which then welcomes it instead.
+func admitWaiting(session *Session, clientID string) *admissionError {
+	store.mu.Lock()
+	session.mu.Lock()
+	entry := session.waiting[clientID]
+	if entry == nil || !entry.announced {
+		session.mu.Unlock()
+		store.mu.Unlock()
+		return &admissionError{http.StatusNotFound, "not_waiting", "That client is not in the waiting room", nil, 0}
+	}
+	if refusal := admit(session, false); refusal != nil {
+		session.mu.Unlock()
+		store.mu.Unlock()
+		return refusal
+	}
+	entry.release(session)
+	client := entry.client
+	client.Status = ClientConnected
+	registerClient(session, client)
+	broadcastWaitingRoom(session)
+	session.mu.Unlock()
+	store.mu.Unlock()
+
+	greetClient(nil, session, client)
+	return nil
+}
+
+// admitAll lets in everyone waiting, when the waiting room is turned off.
+func admitAll(session *Session) {
+	session.mu.Lock()
+	var ids []string
+	for id, entry := range session.waiting {
+		if entry.announced {
+			ids = append(ids, id)
+		}
+	}
+	session.mu.Unlock()
+	for _, id := range ids {
+		admitWaiting(session, id)
+	}
+}
+
+func handleWaitingAnswer(client *Client, session *Session, msg InboundMessage, admitted bool) {
+	targetID, err := controlTarget(msg)
+	if err != nil {
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+	if !isHost(client) {
+		sendError(client, "forbidden", "Only the host can admit or reject waiting clients")
+		return
+	}
+
+	if admitted {
+		if refusal := admitWaiting(session, targetID); refusal != nil {
+			sendError(client, refusal.Reason, refusal.Message)
+			return
+		}
+		auditClient(client, "client.admit", "client", targetID, gin.H{"sessionId": session.ID})
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	entry := session.waiting[targetID]
+	if entry == nil || !entry.announced {
+		sendError(client, "not_waiting", "That client is not in the waiting room")
+		return
+	}
+	turnAway(session, entry.client, "rejected")
+	auditClient(client, "client.reject", "client", targetID, gin.H{"sessionId": session.ID})
+}
+
+// requireHost responds and returns false unless the caller is signed in as
+// one of the session's hosts.
+func requireHost(c *gin.Context, session *Session) bool {
+	user := requireUser(c)
+	if user == nil {
+		return false
+	}
+	if !session.hostedBy(user.ID, signedInWithSSO(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the session's hosts can run its waiting room"})
+		return false
+	}
+	return true
+}
+
+func getWaitingRoom(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	if !requireHost(c, session) {
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"enabled": session.WaitingRoom, "waiting": waitingList(session)})
+}
+
+func admitWaitingClient(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	if !requireHost(c, session) {
+		return
+	}
+	clientID := c.Param("clientId")
+	if refusal := admitWaiting(session, clientID); refusal != nil {
+		c.JSON(refusal.Status, gin.H{"error": refusal.Message, "reason": refusal.Reason})
+		return
+	}
+	auditRequest(c, "client.admit", "client", clientID, gin.H{"sessionId": session.ID})
+	c.Status(http.StatusNoContent)
+}
+
+func rejectWaitingClient(c *gin.Context) {
+	session, exists := sessionFor(c, c.Param("id"))
+	if !exists {
+		notFound(c, "Session not found")
+		return
+	}
+	if !requireHost(c, session) {
+		return
+	}
+	clientID := c.Param("clientId")
+
+	session.mu.Lock()
+	entry := session.waiting[clientID]
+	if entry == nil || !entry.announced {
+		session.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "That client is not in the waiting room"})
+		return
+	}
+	turnAway(session, entry.client, "rejected")
+	session.mu.Unlock()
+
+	auditRequest(c, "client.reject", "client", clientID, gin.H{"sessionId": session.ID})
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,245 @@
+package tango
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+	WatermarkCenter      = "center"
+
+	defaultWatermarkOpacity = 0.5
+	maxWatermarkLogoBytes   = 256 << 10
+	maxWatermarkLogoSide    = 2048
+)
+
+// Watermark is a workspace's mark, a logo, a line of text or both, drawn
+// over its images where they leave the workspace: public screenshot links,
+// guide exports and wiki pushes. Stored images are never marked. Logo is a
+// base64 PNG or JPEG.
+type Watermark struct {
+	Text     string  `json:"text,omitempty" binding:"max=100"`
+	Logo     string  `json:"logo,omitempty"`
+	Position string  `json:"position,omitempty" binding:"omitempty,oneof=top-left top-right bottom-left bottom-right center"`
+	Opacity  float64 `json:"opacity,omitempty" binding:"gte=0,lte=1"`
+
+	logo image.Image
+}
+
+// prepare fills in defaults and decodes the logo, returning an error that
+// can be shown to the client if the watermark is unusable.
+func (w *Watermark) prepare() error {
+	if w.Text == "" && w.Logo == "" {
+		return errors.New("a watermark needs text, a logo or both")
+	}
+	if w.Position == "" {
+		w.Position = WatermarkBottomRight
+	}
+	if w.Opacity == 0 {
+		w.Opacity = defaultWatermarkOpacity
+	}
+	if w.Logo == "" {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(w.Logo)
+	if err != nil {
+		return errors.New("the logo must be base64")
+	}
+	if len(data) > maxWatermarkLogoBytes {
+		return fmt.Errorf("the logo must be at most %d bytes", maxWatermarkLogoBytes)
+	}
+	logo, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil || (format != "png" && format != "jpeg") {
+		return errors.New("the logo must be a PNG or JPEG image")
+	}
+	if b := logo.Bounds(); b.Dx() > maxWatermarkLogoSide || b.Dy() > maxWatermarkLogoSide {
+		return fmt.Errorf("the logo must be at most %d pixels on each side", maxWatermarkLogoSide)
+	}
+	w.logo = logo
+	return nil
+}
+
+// workspaceWatermark returns the watermark of a workspace, or nil. A
+// watermark is replaced rather than changed, so it can be used unlocked.
+func workspaceWatermark(workspaceID string) *Watermark {
+	if workspaceID == "" {
+		return nil
+	}
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+	if ws, exists := workspaces.Workspaces[workspaceID]; exists {
+		return ws.Watermark
+	}
+	return nil
+}
+
+// apply draws the watermark over area of dst, sized to the area: the logo
+// fits a fifth of its width and a sixth of its height, and the text is as
+// tall as the logo can be, within reason.
+func (w *Watermark) apply(dst *image.RGBA, area image.Rectangle) {
+	if w == nil || area.Empty() {
+		return
+	}
+	margin := area.Dx() / 40
+	if margin < 4 {
+		margin = 4
+	}
+	var logoSize image.Point
+	if w.logo != nil {
+		lb := w.logo.Bounds()
+		boxW, boxH := area.Dx()/5, area.Dy()/6
+		logoSize = image.Pt(boxW, lb.Dy()*boxW/lb.Dx())
+		if logoSize.Y > boxH {
+			logoSize = image.Pt(lb.Dx()*boxH/lb.Dy(), boxH)
+		}
+	}
+	scale := area.Dx() / 320
+	if scale < 1 {
+		scale = 1
+	}
+	textSize := image.Point{}
+	if w.Text != "" {
+		runes := len([]rune(w.Text))
+		textSize = image.Pt(runes*(glyphWidth+1)*scale-scale, glyphHeight*scale)
+	}
+	gap := 0
+	if logoSize.X > 0 && textSize.X > 0 {
+		gap = margin / 2
+	}
+	block := image.Pt(logoSize.X+gap+textSize.X, logoSize.Y)
+	if textSize.Y > block.Y {
+		block.Y = textSize.Y
+	}
+
+	var origin image.Point
+	switch w.Position {
+	case WatermarkTopLeft:
+		origin = image.Pt(area.Min.X+margin, area.Min.Y+margin)
+	case WatermarkTopRight:
+		origin = image.Pt(area.Max.X-margin-block.X, area.Min.Y+margin)
+	case WatermarkBottomLeft:
+		origin = image.Pt(area.Min.X+margin, area.Max.Y-margin-block.Y)
+	case WatermarkCenter:
+		origin = image.Pt(area.Min.X+(area.Dx()-block.X)/2, area.Min.Y+(area.Dy()-block.Y)/2)
+	default:
+		origin = image.Pt(area.Max.X-margin-block.X, area.Max.Y-margin-block.Y)
+	}
+
+	// The mark is drawn opaque on a layer of its own, which is then laid
+	// over the image at the watermark's opacity.
+	layer := image.NewRGBA(area)
+	if logoSize.X > 0 && logoSize.Y > 0 {
+		drawScaled(layer, image.Rectangle{Min: image.Pt(origin.X, origin.Y+(block.Y-logoSize.Y)/2), Max: image.Pt(origin.X+logoSize.X, origin.Y+(block.Y+logoSize.Y)/2)}, w.logo)
+	}
+	if textSize.X > 0 {
+		at := image.Pt(origin.X+logoSize.X+gap, origin.Y+(block.Y-textSize.Y)/2)
+		drawText(layer, at.Add(image.Pt(scale, scale)), w.Text, scale, color.Black)
+		drawText(layer, at, w.Text, scale, color.White)
+	}
+	alpha := image.NewUniform(color.Alpha{A: uint8(w.Opacity * 0xff)})
+	draw.DrawMask(dst, area, layer, area.Min, alpha, image.Point{}, draw.Over)
+}
+
+// drawScaled draws src into r, nearest neighbour, keeping its transparency.
+func drawScaled(dst *image.RGBA, r image.Rectangle, src image.Image) {
+	sb := src.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		sy := sb.Min.Y + (y-r.Min.Y)*sb.Dy()/r.Dy()
+		for x := r.Min.X; x < r.Max.X; x++ {
+			dst.Set(x, y, src.At(sb.Min.X+(x-r.Min.X)*sb.Dx()/r.Dx(), sy))
+		}
+	}
+}
+
+// watermarkImage returns a PNG or JPEG image with w drawn over it, in the
+// format it came in.
+func watermarkImage(data []byte, w *Watermark) ([]byte, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	marked := image.NewRGBA(img.Bounds())
+	draw.Draw(marked, marked.Bounds(), img, img.Bounds().Min, draw.Src)
+	w.apply(marked, marked.Bounds())
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, marked, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, marked)
+	}
+	return buf.Bytes(), err
+}
+
+func getWatermark(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleMember) == nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"watermark": workspaceWatermark(id)})
+}
+
+// updateWatermark replaces the workspace's watermark. Images already
+// exported or pushed keep the mark they were made with.
+func updateWatermark(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleAdmin) == nil {
+		return
+	}
+	var req Watermark
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.prepare(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	workspaces.mu.Lock()
+	ws, exists := workspaces.Workspaces[id]
+	if exists {
+		ws.Watermark = &req
+	}
+	workspaces.mu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+
+	auditRequest(c, "workspace.watermark.update", "workspace", id, gin.H{"text": req.Text, "logo": req.Logo != "", "position": req.Position, "opacity": req.Opacity})
+	c.JSON(http.StatusOK, gin.H{"watermark": req})
+}
+
+func deleteWatermark(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleAdmin) == nil {
+		return
+	}
+	workspaces.mu.Lock()
+	ws, exists := workspaces.Workspaces[id]
+	if exists {
+		ws.Watermark = nil
+	}
+	workspaces.mu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+	auditRequest(c, "workspace.watermark.delete", "workspace", id, nil)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,383 @@
+package tango
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EventSessionCreated    = "session.created"
+	EventSessionUpdated    = "session.updated"
+	EventSessionEnded      = "session.ended"
+	EventSessionArchived   = "session.archived"
+	EventSessionDeleted    = "session.deleted"
+	EventSessionExpired    = "session.expired"
+	EventSessionTrashed    = "session.trashed"
+	EventSessionRestored   = "session.restored"
+	EventSessionReminder   = "session.reminder"
+	EventSessionStarted    = "session.started"
+	EventClientJoined      = "client.joined"
+	EventClientLeft        = "client.left"
+	EventRecordingFinished = "recording.finished"
+	EventGuideCreated      = "guide.created"
+	EventGuidePublished    = "guide.published"
+	EventCommentCreated    = "comment.created"
+	EventCommentMentioned  = "comment.mentioned"
+)
+
+const webhookDeliveryLimit = 100
+
+var knownEvents = map[string]bool{
+	EventSessionCreated:    true,
+	EventSessionUpdated:    true,
+	EventSessionEnded:      true,
+	EventSessionArchived:   true,
+	EventSessionDeleted:    true,
+	EventSessionExpired:    true,
+	EventSessionTrashed:    true,
+	EventSessionRestored:   true,
+	EventSessionReminder:   true,
+	EventSessionStarted:    true,
+	EventClientJoined:      true,
+	EventClientLeft:        true,
+	EventRecordingFinished: true,
+	EventGuideCreated:      true,
+	EventGuidePublished:    true,
+	EventCommentCreated:    true,
+	EventCommentMentioned:  true,
+}
+
+type Webhook struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"-"`
+	Events    []string `json:"events"`
+	Transform string   `json:"transform,omitempty"`
+	CreatedAt int64    `json:"createdAt"`
+	// WorkspaceID limits the webhook to events from that workspace's
+	// sessions. Webhooks outside any workspace only receive events from
+	// outside any workspace.
+	WorkspaceID string `json:"workspaceId,omitempty"`
+
+	transform *Transform
+}
+
+type WebhookDelivery struct {
+	ID         string `json:"id"`
+	WebhookID  string `json:"webhookId"`
+	Event      string `json:"event"`
+	Attempts   int    `json:"attempts"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Delivered  bool   `json:"delivered"`
+	CreatedAt  int64  `json:"createdAt"`
+}
+
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt int64       `json:"createdAt"`
+	Payload   interface{} `json:"payload"`
+}
+
+type WebhookRegistry struct {
+	Webhooks   map[string]*Webhook
+	Deliveries map[string][]*WebhookDelivery
+	mu         sync.Mutex
+}
+
+func NewWebhookRegistry() *WebhookRegistry {
+	return &WebhookRegistry{
+		Webhooks:   make(map[string]*Webhook),
+		Deliveries: make(map[string][]*WebhookDelivery),
+	}
+}
+
+var webhooks = NewWebhookRegistry()
+
+func (w *Webhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event || e == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// eventWorkspace returns the workspace an event payload belongs to.
+func eventWorkspace(payload interface{}) string {
+	switch p := payload.(type) {
+	case *Session:
+		return p.WorkspaceID
+	case Guide:
+		return p.WorkspaceID
+	case Recording:
+		return workspaces.sessionWorkspace(p.SessionID)
+	case gin.H:
+		if id, ok := p["sessionId"].(string); ok {
+			return workspaces.sessionWorkspace(id)
+		}
+		if id, ok := p["workspaceId"].(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// eventListener is told about every lifecycle event as it is emitted. It
+// runs inline, often under store and session locks, so it must not block.
+type eventListener func(event string, payload interface{})
+
+// EventFeed hands lifecycle events to in-process listeners, such as
+// GraphQL subscriptions.
+type EventFeed struct {
+	listeners map[int]eventListener
+	next      int
+	mu        sync.Mutex
+}
+
+var eventFeed = &EventFeed{listeners: make(map[int]eventListener)}
+
+// listen registers fn and returns a function that unregisters it.
+func (f *EventFeed) listen(fn eventListener) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next++
+	id := f.next
+	f.listeners[id] = fn
+	return func() {
+		f.mu.Lock()
+		delete(f.listeners, id)
+		f.mu.Unlock()
+	}
+}
+
+func (f *EventFeed) publish(event string, payload interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, fn := range f.listeners {
+		fn(event, payload)
+	}
+}
+
+// emitEvent fans a lifecycle event out to every webhook subscribed to it.
+// Deliveries run in the background so callers may hold store and session
+// locks.
+func emitEvent(event string, payload interface{}) {
+	journal.Record(event, payload)
+	changes.Record(event, payload)
+	publishEvent(event, payload)
+	workspaceID := eventWorkspace(payload)
+	notifySlack(event, workspaceID, payload)
+	eventFeed.publish(event, payload)
+
+	body, err := json.Marshal(WebhookEvent{
+		ID:        generateID(),
+		Event:     event,
+		CreatedAt: getCurrentTimestamp(),
+		Payload:   payload,
+	})
+	if err != nil {
+		logger.Error("encoding event failed", "event", event, "error", err)
+		return
+	}
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+
+	for _, hook := range webhooks.Webhooks {
+		if !hook.wants(event) || hook.WorkspaceID != workspaceID {
+			continue
+		}
+		delivery := &WebhookDelivery{
+			ID:        generateID(),
+			WebhookID: hook.ID,
+			Event:     event,
+			CreatedAt: getCurrentTimestamp(),
+		}
+		webhooks.recordDelivery(delivery)
+		go webhooks.deliver(*hook, delivery, body)
+	}
+}
+
+func (r *WebhookRegistry) recordDelivery(delivery *WebhookDelivery) {
+	entries := append(r.Deliveries[delivery.WebhookID], delivery)
+	if len(entries) > webhookDeliveryLimit {
+		entries = entries[len(entries)-webhookDeliveryLimit:]
+	}
+	r.Deliveries[delivery.WebhookID] = entries
+}
+
+// deliver sends an event to a webhook, through its transform if it has
+// one. A transform that fails is recorded in place of a delivery attempt.
+func (r *WebhookRegistry) deliver(hook Webhook, delivery *WebhookDelivery, body []byte) {
+	if hook.transform != nil {
+		transformed, err := hook.transform.Apply(body)
+		if err != nil {
+			r.mu.Lock()
+			delivery.Error = "transform: " + err.Error()
+			r.mu.Unlock()
+			return
+		}
+		body = transformed
+	}
+	status, attempts, err := outbound.DoPublic("webhook:"+hook.ID, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Webhook-Event", delivery.Event)
+		req.Header.Set("X-Webhook-Signature", signPayload(hook.Secret, body))
+		return req, nil
+	})
+
+	r.mu.Lock()
+	delivery.Attempts = attempts
+	delivery.StatusCode = status
+	if err != nil {
+		delivery.Error = err.Error()
+	} else {
+		delivery.Delivered = true
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		logger.Warn("webhook delivery failed", "webhookId", hook.ID, "event", delivery.Event, "attempts", attempts, "error", err)
+	}
+}
+
+func getWebhooks(c *gin.Context) {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+
+	visible := listingScope(c)
+	hooks := make([]*Webhook, 0, len(webhooks.Webhooks))
+	for _, hook := range webhooks.Webhooks {
+		if visible(hook.WorkspaceID) {
+			hooks = append(hooks, hook)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"webhooks": hooks,
+	})
+}
+
+type CreateWebhookRequest struct {
+	URL         string   `json:"url" binding:"required,url"`
+	Secret      string   `json:"secret" binding:"required"`
+	Events      []string `json:"events"`
+	Transform   string   `json:"transform"`
+	WorkspaceID string   `json:"workspaceId"`
+}
+
+func createWebhook(c *gin.Context) {
+	var req CreateWebhookRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.WorkspaceID != "" && requireRole(c, req.WorkspaceID, RoleAdmin) == nil {
+		return
+	}
+
+	if err := checkPublicURL(c.Request.Context(), req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid url: " + err.Error()})
+		return
+	}
+
+	for _, event := range req.Events {
+		if event != "*" && !knownEvents[event] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event: " + event})
+			return
+		}
+	}
+
+	var transform *Transform
+	if req.Transform != "" {
+		var err error
+		if transform, err = compileTransform(req.Transform); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transform: " + err.Error()})
+			return
+		}
+	}
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+
+	hook := &Webhook{
+		ID:          generateID(),
+		URL:         req.URL,
+		Secret:      req.Secret,
+		Events:      req.Events,
+		Transform:   req.Transform,
+		CreatedAt:   getCurrentTimestamp(),
+		WorkspaceID: req.WorkspaceID,
+		transform:   transform,
+	}
+	webhooks.Webhooks[hook.ID] = hook
+	auditRequest(c, "webhook.create", "webhook", hook.ID, gin.H{"url": hook.URL})
+
+	c.JSON(http.StatusCreated, hook)
+}
+
+func deleteWebhook(c *gin.Context) {
+	id := c.Param("id")
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+
+	hook, exists := webhooks.Webhooks[id]
+	if !exists || !canAccess(c, hook.WorkspaceID) {
+		notFound(c, "Webhook not found")
+		return
+	}
+	if hook.WorkspaceID != "" && requireRole(c, hook.WorkspaceID, RoleAdmin) == nil {
+		return
+	}
+
+	delete(webhooks.Webhooks, id)
+	delete(webhooks.Deliveries, id)
+	outbound.Forget("webhook:" + id)
+	auditRequest(c, "webhook.delete", "webhook", id, nil)
+	c.Status(http.StatusNoContent)
+}
+
+func getWebhookDeliveries(c *gin.Context) {
+	id := c.Param("id")
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+
+	if hook, exists := webhooks.Webhooks[id]; !exists || !canAccess(c, hook.WorkspaceID) {
+		notFound(c, "Webhook not found")
+		return
+	}
+
+	deliveries := make([]WebhookDelivery, 0, len(webhooks.Deliveries[id]))
+	for _, delivery := range webhooks.Deliveries[id] {
+		deliveries = append(deliveries, *delivery)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deliveries": deliveries,
+	})
+}
@@ -0,0 +1,27 @@
+package tango
+
+import "testing"
+
+func TestEmitEventKeepsWorkspaceEventsFromUnscopedWebhooks(t *testing.T) {
+	webhooks = NewWebhookRegistry()
+	defer func() { webhooks = NewWebhookRegistry() }()
+
+	for _, hook := range []*Webhook{
+		{ID: "unscoped", URL: "http://192.0.2.1/hook", Events: []string{"*"}},
+		{ID: "scoped", URL: "http://192.0.2.1/hook", Events: []string{"*"}, WorkspaceID: "ws_a"},
+		{ID: "other", URL: "http://192.0.2.1/hook", Events: []string{"*"}, WorkspaceID: "ws_b"},
+	} {
+		webhooks.Webhooks[hook.ID] = hook
+	}
+
+	emitEvent(EventSessionCreated, &Session{ID: "s_a", Name: "In a workspace", WorkspaceID: "ws_a"})
+	emitEvent(EventSessionCreated, &Session{ID: "s_none", Name: "Outside any workspace"})
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	for id, want := range map[string]int{"unscoped": 1, "scoped": 1, "other": 0} {
+		if got := len(webhooks.Deliveries[id]); got != want {
+			t.Errorf("webhook %s got %d deliveries, want %d", id, got, want)
+		}
+	}
+}
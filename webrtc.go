@@ -0,0 +1,122 @@
+package tango
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxSDPBytes       = 64 << 10
+	maxCandidateBytes = 1 << 10
+)
+
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// iceServers builds the STUN/TURN list handed to clients. With a shared
+// TURN secret the credentials are minted per caller following the TURN REST
+// API convention, so they expire instead of being long-lived.
+func iceServers(cfg WebRTCConfig, user string, now time.Time) []ICEServer {
+	var servers []ICEServer
+	if len(cfg.STUNURLs) > 0 {
+		servers = append(servers, ICEServer{URLs: cfg.STUNURLs})
+	}
+	if len(cfg.TURNURLs) == 0 {
+		return servers
+	}
+
+	turn := ICEServer{URLs: cfg.TURNURLs, Username: cfg.TURNUsername, Credential: cfg.TURNCredential}
+	if cfg.TURNSecret != "" {
+		expiry := now.Add(cfg.CredentialTTL()).Unix()
+		turn.Username = strconv.FormatInt(expiry, 10) + ":" + user
+		mac := hmac.New(sha1.New, []byte(cfg.TURNSecret))
+		mac.Write([]byte(turn.Username))
+		turn.Credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	return append(servers, turn)
+}
+
+func getWebRTCConfig(c *gin.Context) {
+	user := c.Query("clientId")
+	if user == "" {
+		user = "tango"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"iceServers": iceServers(config.WebRTC, user, time.Now()),
+		"ttl":        config.WebRTC.CredentialTTLSeconds,
+	})
+}
+
+// SignalMessage carries WebRTC negotiation between two clients of the same
+// session. The server only checks the envelope and relays it; the SDP and
+// candidates are opaque to it.
+type SignalMessage struct {
+	To        string          `json:"to"`
+	SDP       string          `json:"sdp,omitempty"`
+	Candidate json.RawMessage `json:"candidate,omitempty"`
+}
+
+func decodeSignal(msg InboundMessage) (SignalMessage, error) {
+	var signal SignalMessage
+	if err := json.Unmarshal(msg.Payload, &signal); err != nil || signal.To == "" {
+		return signal, errors.New(msg.Type + " payload must name a recipient in to")
+	}
+
+	switch msg.Type {
+	case "webrtc_offer", "webrtc_answer":
+		if signal.SDP == "" || len(signal.SDP) > maxSDPBytes {
+			return signal, errors.New("sdp must be 1-" + strconv.Itoa(maxSDPBytes) + " bytes")
+		}
+	case "webrtc_ice":
+		if len(signal.Candidate) > maxCandidateBytes {
+			return signal, errors.New("candidate exceeds " + strconv.Itoa(maxCandidateBytes) + " bytes")
+		}
+	}
+	return signal, nil
+}
+
+// handleSignal relays an offer, answer or ICE candidate to its recipient.
+func handleSignal(client *Client, session *Session, span *Span, msg InboundMessage) {
+	signal, err := decodeSignal(msg)
+	if err != nil {
+		span.SetError(err)
+		sendError(client, "invalid_payload", err.Error())
+		return
+	}
+
+	payload := gin.H{"from": client.ID}
+	if signal.SDP != "" {
+		payload["sdp"] = signal.SDP
+	}
+	if signal.Candidate != nil {
+		payload["candidate"] = signal.Candidate
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	target, exists := session.Clients[signal.To]
+	if !exists {
+		client.send(Message{
+			Type: "error",
+			Payload: gin.H{
+				"code":    "unknown_recipient",
+				"message": "Client " + signal.To + " is not in this session",
+			},
+		})
+		return
+	}
+	span.SetError(deliver(target, Message{Type: msg.Type, Payload: payload}))
+}
@@ -0,0 +1,389 @@
+package tango
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	WikiConfluence = "confluence"
+	WikiNotion     = "notion"
+
+	wikiTimeout     = 30 * time.Second
+	wikiPushTimeout = 2 * time.Minute
+	// maxGuidePushes is how many push reports a guide keeps.
+	maxGuidePushes = 20
+)
+
+// GuidePush reports what pushing a guide into a wiki created there: the
+// pages, and for each step the image uploaded for it. A push that failed
+// part way lists what it had created by then.
+type GuidePush struct {
+	ID       string       `json:"id"`
+	Target   string       `json:"target"`
+	PushedBy string       `json:"pushedBy,omitempty"`
+	PushedAt int64        `json:"pushedAt"`
+	Pages    []PushedPage `json:"pages"`
+	Steps    []PushedStep `json:"steps"`
+	Error    string       `json:"error,omitempty"`
+}
+
+type PushedPage struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	URL   string `json:"url,omitempty"`
+}
+
+type PushedStep struct {
+	StepID string `json:"stepId"`
+	PageID string `json:"pageId,omitempty"`
+	Title  string `json:"title"`
+	// Image is the ID the wiki gave the step's uploaded image.
+	Image string `json:"image,omitempty"`
+}
+
+// wikiClient only connects to public addresses, as a workspace admin
+// chooses the Confluence site it talks to.
+var wikiClient = &http.Client{Timeout: wikiTimeout, Transport: &http.Transport{
+	DialContext:         (&net.Dialer{Timeout: wikiTimeout, Control: dialPublic}).DialContext,
+	TLSHandshakeTimeout: wikiTimeout,
+	MaxIdleConns:        100,
+	IdleConnTimeout:     90 * time.Second,
+}}
+
+// wikiCall sends req and decodes the JSON reply into out, if given. A
+// failed call reports only its status, not what the wiki replied, as
+// errors are shown to callers.
+func wikiCall(req *http.Request, out interface{}) error {
+	resp, err := wikiClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s failed", req.Method, req.URL.Path)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned %d", req.Method, req.URL.Path, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out); err != nil {
+		return fmt.Errorf("%s %s returned an unexpected reply", req.Method, req.URL.Path)
+	}
+	return nil
+}
+
+// jsonRequest builds a request with payload encoded as its JSON body.
+func jsonRequest(ctx context.Context, method, url string, payload interface{}) (*http.Request, error) {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// fileRequest builds a multipart/form-data request that uploads data as
+// the form's file field.
+func fileRequest(ctx context.Context, url, filename, contentType string, data []byte) (*http.Request, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, filename))
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(data); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req, nil
+}
+
+// stepImage reads a step's image, returning nil for a step without one.
+func stepImage(ctx context.Context, guideID string, step GuideStep) ([]byte, error) {
+	if step.Image == nil {
+		return nil, nil
+	}
+	data, err := blobs.Get(ctx, stepBlobKey(guideID, step.ID))
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// publishedStepImage reads a step's image as it is published, with the
+// guide's workspace watermark, if any, drawn over it.
+func publishedStepImage(ctx context.Context, guide Guide, step GuideStep) ([]byte, error) {
+	data, err := stepImage(ctx, guide.ID, step)
+	watermark := workspaceWatermark(guide.WorkspaceID)
+	if data == nil || err != nil || watermark == nil {
+		return data, err
+	}
+	return watermarkImage(data, watermark)
+}
+
+func stepImageName(n int, step GuideStep) string {
+	if step.Image != nil && step.Image.ContentType == "image/jpeg" {
+		return fmt.Sprintf("step-%d.jpg", n)
+	}
+	return fmt.Sprintf("step-%d.png", n)
+}
+
+// wikiCredentials returns the workspace's credentials for target, or nil
+// when it has none.
+func wikiCredentials(workspaceID, target string) interface{} {
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+	ws, exists := workspaces.Workspaces[workspaceID]
+	switch {
+	case !exists:
+	case target == WikiConfluence && ws.Confluence != nil:
+		return *ws.Confluence
+	case target == WikiNotion && ws.Notion != nil:
+		return *ws.Notion
+	}
+	return nil
+}
+
+// getWikiIntegrations lists the workspace's wiki integrations, without
+// their secrets.
+func getWikiIntegrations(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleAdmin) == nil {
+		return
+	}
+	integrations := gin.H{}
+	workspaces.mu.Lock()
+	if ws, exists := workspaces.Workspaces[id]; exists {
+		if ws.Confluence != nil {
+			integrations[WikiConfluence] = *ws.Confluence
+		}
+		if ws.Notion != nil {
+			integrations[WikiNotion] = *ws.Notion
+		}
+	}
+	workspaces.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"integrations": integrations})
+}
+
+// updateConfluenceIntegration checks the credentials against Confluence
+// and saves them for the workspace.
+func updateConfluenceIntegration(c *gin.Context) {
+	id := c.Param("id")
+	user := requireRole(c, id, RoleAdmin)
+	if user == nil {
+		return
+	}
+	var req ConfluenceCredentialsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkPublicURL(c.Request.Context(), req.BaseURL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid baseUrl: " + err.Error()})
+		return
+	}
+	creds := ConfluenceCredentials{
+		BaseURL:      strings.TrimRight(req.BaseURL, "/"),
+		Email:        req.Email,
+		SpaceKey:     req.SpaceKey,
+		ParentPageID: req.ParentPageID,
+		UpdatedBy:    user.ID,
+		UpdatedAt:    getCurrentTimestamp(),
+		apiToken:     req.APIToken,
+	}
+	if err := creds.verify(c.Request.Context()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Confluence did not accept the credentials: " + err.Error()})
+		return
+	}
+	if !saveWikiIntegration(c, id, func(ws *Workspace) { ws.Confluence = &creds }) {
+		return
+	}
+	auditRequest(c, "workspace.integration.update", "workspace", id, gin.H{"target": WikiConfluence, "baseUrl": creds.BaseURL, "spaceKey": creds.SpaceKey})
+	c.JSON(http.StatusOK, creds)
+}
+
+// updateNotionIntegration checks the token can reach the parent page and
+// saves it for the workspace.
+func updateNotionIntegration(c *gin.Context) {
+	id := c.Param("id")
+	user := requireRole(c, id, RoleAdmin)
+	if user == nil {
+		return
+	}
+	var req NotionCredentialsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	creds := NotionCredentials{
+		ParentPageID: req.ParentPageID,
+		UpdatedBy:    user.ID,
+		UpdatedAt:    getCurrentTimestamp(),
+		token:        req.Token,
+	}
+	if err := creds.verify(c.Request.Context()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Notion did not accept the token: " + err.Error()})
+		return
+	}
+	if !saveWikiIntegration(c, id, func(ws *Workspace) { ws.Notion = &creds }) {
+		return
+	}
+	auditRequest(c, "workspace.integration.update", "workspace", id, gin.H{"target": WikiNotion, "parentPageId": creds.ParentPageID})
+	c.JSON(http.StatusOK, creds)
+}
+
+func saveWikiIntegration(c *gin.Context, id string, save func(*Workspace)) bool {
+	workspaces.mu.Lock()
+	ws, exists := workspaces.Workspaces[id]
+	if exists {
+		save(ws)
+	}
+	workspaces.mu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+	}
+	return exists
+}
+
+func deleteWikiIntegration(c *gin.Context) {
+	id, target := c.Param("id"), c.Param("target")
+	if requireRole(c, id, RoleAdmin) == nil {
+		return
+	}
+	removed := false
+	workspaces.mu.Lock()
+	if ws, exists := workspaces.Workspaces[id]; exists {
+		switch {
+		case target == WikiConfluence && ws.Confluence != nil:
+			ws.Confluence, removed = nil, true
+		case target == WikiNotion && ws.Notion != nil:
+			ws.Notion, removed = nil, true
+		}
+	}
+	workspaces.mu.Unlock()
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Integration not found"})
+		return
+	}
+	auditRequest(c, "workspace.integration.delete", "workspace", id, gin.H{"target": target})
+	c.Status(http.StatusNoContent)
+}
+
+type PushGuideRequest struct {
+	Target string `json:"target" binding:"required,oneof=confluence notion"`
+	// ParentPageID puts the page under another parent than the
+	// integration's.
+	ParentPageID string `json:"parentPageId"`
+}
+
+// pushGuide creates a page for the guide in one of its workspace's wikis
+// and answers with the report of what was created, which the guide keeps.
+func pushGuide(c *gin.Context) {
+	var req PushGuideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	if guide.WorkspaceID == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only guides in a workspace can be pushed to a wiki"})
+		return
+	}
+	creds := wikiCredentials(guide.WorkspaceID, req.Target)
+	if creds == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "The workspace has no " + req.Target + " integration"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), wikiPushTimeout)
+	defer cancel()
+	push := &GuidePush{
+		ID:       generateID(),
+		Target:   req.Target,
+		PushedBy: user.ID,
+		PushedAt: getCurrentTimestamp(),
+		Pages:    []PushedPage{},
+		Steps:    []PushedStep{},
+	}
+	var err error
+	switch creds := creds.(type) {
+	case ConfluenceCredentials:
+		if req.ParentPageID != "" {
+			creds.ParentPageID = req.ParentPageID
+		}
+		err = creds.push(ctx, guide, push)
+	case NotionCredentials:
+		if req.ParentPageID != "" {
+			creds.ParentPageID = req.ParentPageID
+		}
+		err = creds.push(ctx, guide, push)
+	}
+	if err != nil {
+		push.Error = err.Error()
+		logger.Warn("pushing guide failed", "guide", guide.ID, "target", req.Target, "error", err)
+	}
+
+	guides.update(guide.ID, "", func(guide *Guide) error {
+		guide.Pushes = append(guide.Pushes, *push)
+		if len(guide.Pushes) > maxGuidePushes {
+			guide.Pushes = guide.Pushes[len(guide.Pushes)-maxGuidePushes:]
+		}
+		return nil
+	})
+	auditRequest(c, "guide.push", "guide", guide.ID, gin.H{"target": req.Target, "pages": len(push.Pages), "failed": err != nil})
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The guide could not be pushed to " + req.Target, "push": push})
+		return
+	}
+	c.JSON(http.StatusCreated, push)
+}
+
+// getGuidePushes lists a guide's push reports, newest first.
+func getGuidePushes(c *gin.Context) {
+	_, guide, ok := guideFor(c)
+	if !ok {
+		return
+	}
+	pushes := make([]GuidePush, 0, len(guide.Pushes))
+	for i := len(guide.Pushes) - 1; i >= 0; i-- {
+		pushes = append(pushes, guide.Pushes[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"pushes": pushes})
+}
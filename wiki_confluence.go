@@ -0,0 +1,134 @@
+package tango
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ConfluenceCredentials let a workspace push guides into a Confluence
+// space, as Email with an API token. BaseURL is the wiki's root, such as
+// https://acme.atlassian.net/wiki.
+type ConfluenceCredentials struct {
+	BaseURL      string `json:"baseUrl"`
+	Email        string `json:"email"`
+	SpaceKey     string `json:"spaceKey"`
+	ParentPageID string `json:"parentPageId,omitempty"`
+	UpdatedBy    string `json:"updatedBy,omitempty"`
+	UpdatedAt    int64  `json:"updatedAt"`
+
+	apiToken string
+}
+
+type ConfluenceCredentialsRequest struct {
+	BaseURL      string `json:"baseUrl" binding:"required,url"`
+	Email        string `json:"email" binding:"required,email"`
+	APIToken     string `json:"apiToken" binding:"required"`
+	SpaceKey     string `json:"spaceKey" binding:"required,max=255"`
+	ParentPageID string `json:"parentPageId"`
+}
+
+func (cc ConfluenceCredentials) request(ctx context.Context, method, path string, payload interface{}) (*http.Request, error) {
+	req, err := jsonRequest(ctx, method, cc.BaseURL+"/rest/api"+path, payload)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(cc.Email, cc.apiToken)
+	return req, nil
+}
+
+// verify checks the credentials can see the space.
+func (cc ConfluenceCredentials) verify(ctx context.Context) error {
+	req, err := cc.request(ctx, http.MethodGet, "/space/"+url.PathEscape(cc.SpaceKey), nil)
+	if err != nil {
+		return err
+	}
+	return wikiCall(req, nil)
+}
+
+// push creates a page for guide in storage format, with each step's image
+// attached to it. The page refers to the attachments by file name, so it
+// is created first and shows the images once they are uploaded.
+func (cc ConfluenceCredentials) push(ctx context.Context, guide Guide, push *GuidePush) error {
+	page := map[string]interface{}{
+		"type":  "page",
+		"title": guide.Title,
+		"space": map[string]string{"key": cc.SpaceKey},
+		"body": map[string]interface{}{
+			"storage": map[string]string{"value": confluenceStorage(guide), "representation": "storage"},
+		},
+	}
+	if cc.ParentPageID != "" {
+		page["ancestors"] = []map[string]string{{"id": cc.ParentPageID}}
+	}
+	req, err := cc.request(ctx, http.MethodPost, "/content", page)
+	if err != nil {
+		return err
+	}
+	var created struct {
+		ID    string `json:"id"`
+		Links struct {
+			Base  string `json:"base"`
+			WebUI string `json:"webui"`
+		} `json:"_links"`
+	}
+	if err := wikiCall(req, &created); err != nil {
+		return err
+	}
+	pageURL := ""
+	if created.Links.WebUI != "" {
+		pageURL = created.Links.Base + created.Links.WebUI
+	}
+	push.Pages = append(push.Pages, PushedPage{ID: created.ID, Title: guide.Title, URL: pageURL})
+
+	for i, step := range guide.Steps {
+		pushed := PushedStep{StepID: step.ID, PageID: created.ID, Title: step.Title}
+		data, err := publishedStepImage(ctx, guide, step)
+		if err != nil {
+			return fmt.Errorf("reading step %d's image: %v", i+1, err)
+		}
+		if data != nil {
+			req, err := fileRequest(ctx, cc.BaseURL+"/rest/api/content/"+url.PathEscape(created.ID)+"/child/attachment",
+				stepImageName(i+1, step), step.Image.ContentType, data)
+			if err != nil {
+				return err
+			}
+			req.SetBasicAuth(cc.Email, cc.apiToken)
+			req.Header.Set("X-Atlassian-Token", "no-check")
+			var attached struct {
+				Results []struct {
+					ID string `json:"id"`
+				} `json:"results"`
+			}
+			if err := wikiCall(req, &attached); err != nil {
+				return fmt.Errorf("attaching step %d's image: %v", i+1, err)
+			}
+			if len(attached.Results) > 0 {
+				pushed.Image = attached.Results[0].ID
+			}
+		}
+		push.Steps = append(push.Steps, pushed)
+	}
+	return nil
+}
+
+// confluenceStorage renders guide in Confluence's XHTML storage format.
+func confluenceStorage(guide Guide) string {
+	var b strings.Builder
+	if guide.Description != "" {
+		fmt.Fprintf(&b, "<p>%s</p>", html.EscapeString(guide.Description))
+	}
+	for i, step := range guide.Steps {
+		fmt.Fprintf(&b, "<h2>%d. %s</h2>", i+1, html.EscapeString(step.Title))
+		if step.Description != "" {
+			fmt.Fprintf(&b, "<p>%s</p>", html.EscapeString(step.Description))
+		}
+		if step.Image != nil {
+			fmt.Fprintf(&b, `<p><ac:image><ri:attachment ri:filename="%s" /></ac:image></p>`, stepImageName(i+1, step))
+		}
+	}
+	return b.String()
+}
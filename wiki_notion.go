@@ -0,0 +1,159 @@
+package tango
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const (
+	notionAPI     = "https://api.notion.com/v1"
+	notionVersion = "2022-06-28"
+	// maxNotionBlocks is how many blocks Notion takes in one request.
+	maxNotionBlocks = 100
+	// maxNotionText is how long a piece of rich text may be.
+	maxNotionText = 2000
+)
+
+// NotionCredentials let a workspace push guides into Notion as pages
+// under ParentPageID, which must be shared with the integration the token
+// belongs to.
+type NotionCredentials struct {
+	ParentPageID string `json:"parentPageId"`
+	UpdatedBy    string `json:"updatedBy,omitempty"`
+	UpdatedAt    int64  `json:"updatedAt"`
+
+	token string
+}
+
+type NotionCredentialsRequest struct {
+	Token        string `json:"token" binding:"required"`
+	ParentPageID string `json:"parentPageId" binding:"required"`
+}
+
+func (nc NotionCredentials) authorize(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+nc.token)
+	req.Header.Set("Notion-Version", notionVersion)
+}
+
+func (nc NotionCredentials) call(ctx context.Context, method, path string, payload, out interface{}) error {
+	req, err := jsonRequest(ctx, method, notionAPI+path, payload)
+	if err != nil {
+		return err
+	}
+	nc.authorize(req)
+	return wikiCall(req, out)
+}
+
+// verify checks the token can read the parent page.
+func (nc NotionCredentials) verify(ctx context.Context) error {
+	return nc.call(ctx, http.MethodGet, "/pages/"+url.PathEscape(nc.ParentPageID), nil, nil)
+}
+
+// upload sends an image to Notion and returns the ID blocks refer to it
+// by.
+func (nc NotionCredentials) upload(ctx context.Context, filename, contentType string, data []byte) (string, error) {
+	var upload struct {
+		ID string `json:"id"`
+	}
+	err := nc.call(ctx, http.MethodPost, "/file_uploads", map[string]string{
+		"mode":         "single_part",
+		"filename":     filename,
+		"content_type": contentType,
+	}, &upload)
+	if err != nil {
+		return "", err
+	}
+	req, err := fileRequest(ctx, notionAPI+"/file_uploads/"+url.PathEscape(upload.ID)+"/send", filename, contentType, data)
+	if err != nil {
+		return "", err
+	}
+	nc.authorize(req)
+	if err := wikiCall(req, nil); err != nil {
+		return "", err
+	}
+	return upload.ID, nil
+}
+
+// push uploads the steps' images, then creates a page for guide with a
+// heading, description and image block per step. Notion takes at most a
+// hundred blocks per request, so longer guides are appended in batches.
+func (nc NotionCredentials) push(ctx context.Context, guide Guide, push *GuidePush) error {
+	var blocks []map[string]interface{}
+	if guide.Description != "" {
+		blocks = append(blocks, notionBlock("paragraph", guide.Description))
+	}
+	for i, step := range guide.Steps {
+		blocks = append(blocks, notionBlock("heading_2", fmt.Sprintf("%d. %s", i+1, step.Title)))
+		if step.Description != "" {
+			blocks = append(blocks, notionBlock("paragraph", step.Description))
+		}
+		pushed := PushedStep{StepID: step.ID, Title: step.Title}
+		data, err := publishedStepImage(ctx, guide, step)
+		if err != nil {
+			return fmt.Errorf("reading step %d's image: %v", i+1, err)
+		}
+		if data != nil {
+			id, err := nc.upload(ctx, stepImageName(i+1, step), step.Image.ContentType, data)
+			if err != nil {
+				return fmt.Errorf("uploading step %d's image: %v", i+1, err)
+			}
+			pushed.Image = id
+			blocks = append(blocks, map[string]interface{}{
+				"type":  "image",
+				"image": map[string]interface{}{"type": "file_upload", "file_upload": map[string]string{"id": id}},
+			})
+		}
+		push.Steps = append(push.Steps, pushed)
+	}
+
+	first := blocks
+	if len(first) > maxNotionBlocks {
+		first = first[:maxNotionBlocks]
+	}
+	var page struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	err := nc.call(ctx, http.MethodPost, "/pages", map[string]interface{}{
+		"parent":     map[string]string{"page_id": nc.ParentPageID},
+		"properties": map[string]interface{}{"title": map[string]interface{}{"title": notionText(guide.Title)}},
+		"children":   first,
+	}, &page)
+	if err != nil {
+		return err
+	}
+	push.Pages = append(push.Pages, PushedPage{ID: page.ID, Title: guide.Title, URL: page.URL})
+	for i := range push.Steps {
+		push.Steps[i].PageID = page.ID
+	}
+
+	for rest := blocks[len(first):]; len(rest) > 0; {
+		batch := rest
+		if len(batch) > maxNotionBlocks {
+			batch = batch[:maxNotionBlocks]
+		}
+		rest = rest[len(batch):]
+		err := nc.call(ctx, http.MethodPatch, "/blocks/"+url.PathEscape(page.ID)+"/children", map[string]interface{}{"children": batch}, nil)
+		if err != nil {
+			return fmt.Errorf("appending steps: %v", err)
+		}
+	}
+	return nil
+}
+
+func notionText(content string) []map[string]interface{} {
+	runes := []rune(content)
+	if len(runes) > maxNotionText {
+		content = string(runes[:maxNotionText])
+	}
+	return []map[string]interface{}{{"type": "text", "text": map[string]string{"content": content}}}
+}
+
+func notionBlock(kind, content string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": kind,
+		kind:   map[string]interface{}{"rich_text": notionText(content)},
+	}
+}
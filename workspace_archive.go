@@ -0,0 +1,623 @@
+package tango
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	workspaceArchiveFormat  = "tango.workspace"
+	workspaceArchiveVersion = 1
+
+	maxWorkspaceArchiveBytes = 4 << 30
+)
+
+// WorkspaceManifest opens a workspace archive: a zip holding the
+// workspace's settings and members, collections, templates, sessions with
+// everything recorded in them, and guides, as JSON, and their screenshots
+// and images under media/, by the key they are stored under.
+type WorkspaceManifest struct {
+	Format      string `json:"format"`
+	Version     int    `json:"version"`
+	ExportedAt  int64  `json:"exportedAt"`
+	WorkspaceID string `json:"workspaceId"`
+	Sessions    int    `json:"sessions"`
+	Guides      int    `json:"guides"`
+	Templates   int    `json:"templates"`
+	Collections int    `json:"collections"`
+	Media       int    `json:"media"`
+}
+
+// archivedWorkspace is a workspace's settings. Integrations and webhooks
+// hold secrets, and billing belongs to the deployment, so neither is kept.
+type archivedWorkspace struct {
+	Name      string           `json:"name"`
+	CreatedAt int64            `json:"createdAt"`
+	SSO       *WorkspaceSSO    `json:"sso,omitempty"`
+	Quota     *UsageQuota      `json:"quota,omitempty"`
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+	Watermark *Watermark       `json:"watermark,omitempty"`
+	Members   []Membership     `json:"members"`
+}
+
+type archivedSession struct {
+	Session     *Session     `json:"session"`
+	Annotations []Stroke     `json:"annotations"`
+	Polls       []Poll       `json:"polls"`
+	Questions   []Question   `json:"questions"`
+	Captions    []Caption    `json:"captions"`
+	Screenshots []Screenshot `json:"screenshots"`
+	Comments    []Comment    `json:"comments"`
+}
+
+// WorkspaceImport reports what importing an archive created, with the new
+// ID of each session, guide, template and collection by its old one.
+type WorkspaceImport struct {
+	Workspace    *Workspace        `json:"workspace"`
+	Members      int               `json:"members"`
+	CreatedUsers []string          `json:"createdUsers"`
+	Sessions     map[string]string `json:"sessions"`
+	Guides       map[string]string `json:"guides"`
+	Templates    map[string]string `json:"templates"`
+	Collections  map[string]string `json:"collections"`
+	Media        int               `json:"media"`
+	Warnings     []string          `json:"warnings,omitempty"`
+}
+
+// exportWorkspace streams an archive of the workspace for backups and for
+// moving it to another deployment.
+func exportWorkspace(c *gin.Context) {
+	id := c.Param("id")
+	workspaces.mu.Lock()
+	ws, exists := workspaces.Workspaces[id]
+	var settings archivedWorkspace
+	if exists {
+		settings = archivedWorkspace{Name: ws.Name, CreatedAt: ws.CreatedAt, SSO: ws.SSO, Quota: ws.Quota, Retention: ws.Retention, Watermark: ws.Watermark, Members: []Membership{}}
+		for _, member := range ws.Members {
+			settings.Members = append(settings.Members, *member)
+		}
+	}
+	workspaces.mu.Unlock()
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+	sort.Slice(settings.Members, func(i, j int) bool { return settings.Members[i].JoinedAt < settings.Members[j].JoinedAt })
+
+	files := map[string]interface{}{"workspace.json": settings}
+	var media []string
+
+	collected := []Collection{}
+	collections.mu.Lock()
+	for _, collection := range collections.Collections {
+		if collection.WorkspaceID == id {
+			collected = append(collected, *collection)
+		}
+	}
+	collections.mu.Unlock()
+	files["collections.json"] = collected
+
+	tmpls := []SessionTemplate{}
+	templates.mu.Lock()
+	for _, tmpl := range templates.Templates {
+		if tmpl.WorkspaceID == id {
+			tmpls = append(tmpls, *tmpl)
+		}
+	}
+	templates.mu.Unlock()
+	files["templates.json"] = tmpls
+
+	sessions := 0
+	for _, session := range store.sessionList() {
+		session.mu.Lock()
+		if session.WorkspaceID != id {
+			session.mu.Unlock()
+			continue
+		}
+		archived := archivedSession{
+			Annotations: annotations.Strokes(session.ID),
+			Polls:       polls.List(session.ID),
+			Questions:   questions.List(session.ID, true),
+			Captions:    captions.List(session.ID),
+			Screenshots: screenshots.List(session.ID),
+			Comments:    []Comment{},
+		}
+		for _, thread := range comments.Threads(session.ID, func(*Comment) bool { return true }) {
+			archived.Comments = append(archived.Comments, thread.Comment)
+			archived.Comments = append(archived.Comments, thread.Replies...)
+		}
+		archived.Session = session
+		data, err := json.MarshalIndent(archived, "", "  ")
+		session.mu.Unlock()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		files["sessions/"+session.ID+".json"] = json.RawMessage(data)
+		for _, shot := range archived.Screenshots {
+			media = append(media, shot.blobKey())
+		}
+		sessions++
+	}
+
+	guideCount := 0
+	guides.mu.Lock()
+	for _, guide := range guides.Guides {
+		if guide.WorkspaceID != id {
+			continue
+		}
+		files["guides/"+guide.ID+".json"] = guide.snapshot()
+		for _, step := range guide.Steps {
+			if step.Image != nil {
+				media = append(media, stepBlobKey(guide.ID, step.ID))
+			}
+		}
+		guideCount++
+	}
+	guides.mu.Unlock()
+
+	files["manifest.json"] = WorkspaceManifest{
+		Format:      workspaceArchiveFormat,
+		Version:     workspaceArchiveVersion,
+		ExportedAt:  getCurrentTimestamp(),
+		WorkspaceID: id,
+		Sessions:    sessions,
+		Guides:      guideCount,
+		Templates:   len(tmpls),
+		Collections: len(collected),
+		Media:       len(media),
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sort.Strings(media)
+
+	auditRequest(c, "workspace.archive", "workspace", id, gin.H{"sessions": sessions, "guides": guideCount, "media": len(media)})
+	c.Header("Content-Disposition", `attachment; filename="tango-workspace-`+id+`.zip"`)
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+	archive := zip.NewWriter(c.Writer)
+	err := func() error {
+		for _, name := range names {
+			data, ok := files[name].(json.RawMessage)
+			if !ok {
+				var err error
+				if data, err = json.MarshalIndent(files[name], "", "  "); err != nil {
+					return err
+				}
+			}
+			w, err := archive.Create(name)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+		for _, key := range media {
+			data, err := blobs.Get(c.Request.Context(), key)
+			if errors.Is(err, ErrBlobNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			w, err := archive.CreateHeader(&zip.FileHeader{Name: "media/" + key, Method: zip.Store})
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+		return archive.Close()
+	}()
+	if err != nil {
+		// The status has gone out; a truncated zip is all the client can be
+		// told.
+		logger.Error("writing workspace archive failed", "workspace", id, "error", err)
+	}
+}
+
+// workspaceArchive is an uploaded archive being read.
+type workspaceArchive struct {
+	files map[string]*zip.File
+}
+
+func (a workspaceArchive) decode(name string, v interface{}) error {
+	file, exists := a.files[name]
+	if !exists {
+		return fmt.Errorf("the archive has no %s", name)
+	}
+	r, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// media reads a stored object from the archive, reporting false when the
+// archive does not have it.
+func (a workspaceArchive) media(key string) ([]byte, bool, error) {
+	file, exists := a.files["media/"+key]
+	if !exists {
+		return nil, false, nil
+	}
+	r, err := file.Open()
+	if err != nil {
+		return nil, false, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	return data, err == nil, err
+}
+
+// importWorkspace loads an archive from exportWorkspace into a new
+// workspace. Everything gets a new ID, so an archive can be imported next
+// to the workspace it came from. Members are matched to accounts by email,
+// and accounts are created for those who have none here; they can sign in
+// with a sign-in link or single sign-on.
+func importWorkspace(c *gin.Context) {
+	tmp, err := os.CreateTemp("", "tango-workspace-*.zip")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, io.LimitReader(c.Request.Body, maxWorkspaceArchiveBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read the archive"})
+		return
+	}
+	if size > maxWorkspaceArchiveBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Archives must be at most %d bytes", maxWorkspaceArchiveBytes)})
+		return
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The body is not a zip archive"})
+		return
+	}
+	archive := workspaceArchive{files: make(map[string]*zip.File)}
+	for _, file := range zr.File {
+		archive.files[file.Name] = file
+	}
+
+	var manifest WorkspaceManifest
+	var settings archivedWorkspace
+	err = archive.decode("manifest.json", &manifest)
+	switch {
+	case err != nil:
+	case manifest.Format != workspaceArchiveFormat:
+		err = fmt.Errorf("format must be %s", workspaceArchiveFormat)
+	case manifest.Version > workspaceArchiveVersion:
+		err = fmt.Errorf("version %d is newer than this server reads", manifest.Version)
+	default:
+		err = archive.decode("workspace.json", &settings)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(settings.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "workspace.json has no name"})
+		return
+	}
+
+	report, err := loadWorkspaceArchive(c.Request.Context(), archive, settings)
+	if err != nil {
+		var bad *archiveError
+		if errors.As(err, &bad) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		logger.Error("importing workspace failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The archive could not be imported"})
+		return
+	}
+	auditRequest(c, "workspace.import", "workspace", report.Workspace.ID, gin.H{
+		"from":     manifest.WorkspaceID,
+		"sessions": len(report.Sessions),
+		"guides":   len(report.Guides),
+		"media":    report.Media,
+	})
+	c.JSON(http.StatusCreated, report)
+}
+
+// archiveError is a problem with the archive's contents rather than with
+// storing them.
+type archiveError struct{ err error }
+
+func (e *archiveError) Error() string { return e.err.Error() }
+
+// loadWorkspaceArchive reads the archive's contents, stores its media, and
+// only then registers the workspace and everything in it, so a failed
+// import leaves nothing behind.
+func loadWorkspaceArchive(ctx context.Context, archive workspaceArchive, settings archivedWorkspace) (WorkspaceImport, error) {
+	ws := &Workspace{
+		ID:        generateID(),
+		Name:      settings.Name,
+		CreatedAt: settings.CreatedAt,
+		SSO:       settings.SSO,
+		Quota:     settings.Quota,
+		Retention: settings.Retention,
+		Watermark: settings.Watermark,
+		Members:   make(map[string]*Membership),
+	}
+	report := WorkspaceImport{
+		Workspace:    ws,
+		CreatedUsers: []string{},
+		Sessions:     make(map[string]string),
+		Guides:       make(map[string]string),
+		Templates:    make(map[string]string),
+		Collections:  make(map[string]string),
+	}
+
+	if ws.Watermark != nil {
+		if err := ws.Watermark.prepare(); err != nil {
+			return report, &archiveError{fmt.Errorf("watermark: %v", err)}
+		}
+	}
+
+	userIDs := make(map[string]string)
+	users.mu.Lock()
+	for _, member := range settings.Members {
+		if member.Email == "" || workspaceRoleRank[member.Role] == 0 {
+			continue
+		}
+		if _, exists := users.byEmail[normalizeEmail(member.Email)]; !exists {
+			report.CreatedUsers = append(report.CreatedUsers, normalizeEmail(member.Email))
+		}
+		user := users.ensure(member.Email, "")
+		userIDs[member.UserID] = user.ID
+		ws.Members[user.ID] = &Membership{UserID: user.ID, Email: user.Email, Role: member.Role, JoinedAt: member.JoinedAt, Managed: member.Managed}
+	}
+	users.mu.Unlock()
+	report.Members = len(ws.Members)
+	if ws.owners() == 0 {
+		return report, &archiveError{errors.New("the archive's workspace has no owner")}
+	}
+	// Authors who are no longer members stay anonymous, as they do when an
+	// account is deleted.
+	user := func(id string) string { return userIDs[id] }
+
+	var collected []Collection
+	var tmpls []SessionTemplate
+	if err := archive.decode("collections.json", &collected); err != nil {
+		return report, &archiveError{err}
+	}
+	if err := archive.decode("templates.json", &tmpls); err != nil {
+		return report, &archiveError{err}
+	}
+	for i := range collected {
+		report.Collections[collected[i].ID] = generateID()
+	}
+	for i := range tmpls {
+		report.Templates[tmpls[i].ID] = generateID()
+	}
+
+	var sessions []archivedSession
+	var guideList []Guide
+	for name := range archive.files {
+		switch {
+		case strings.HasPrefix(name, "sessions/") && strings.HasSuffix(name, ".json"):
+			var archived archivedSession
+			if err := archive.decode(name, &archived); err != nil {
+				return report, &archiveError{err}
+			}
+			if archived.Session == nil || archived.Session.ID == "" {
+				return report, &archiveError{fmt.Errorf("%s has no session", name)}
+			}
+			sessions = append(sessions, archived)
+		case strings.HasPrefix(name, "guides/") && strings.HasSuffix(name, ".json"):
+			var guide Guide
+			if err := archive.decode(name, &guide); err != nil {
+				return report, &archiveError{err}
+			}
+			guideList = append(guideList, guide)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Session.CreatedAt < sessions[j].Session.CreatedAt })
+	sort.Slice(guideList, func(i, j int) bool { return guideList[i].CreatedAt < guideList[j].CreatedAt })
+
+	store.mu.Lock()
+	for _, archived := range sessions {
+		report.Sessions[archived.Session.ID] = store.newSessionID()
+	}
+	store.mu.Unlock()
+	for _, guide := range guideList {
+		report.Guides[guide.ID] = generateID()
+	}
+
+	// Store the media first, keyed by the new IDs, and take it all back if
+	// any of it fails.
+	var stored []string
+	put := func(oldKey, newKey string) (bool, error) {
+		data, found, err := archive.media(oldKey)
+		if err != nil || !found {
+			return false, err
+		}
+		if err := blobs.Put(ctx, newKey, data); err != nil {
+			return false, err
+		}
+		stored = append(stored, newKey)
+		return true, nil
+	}
+	var err error
+	defer func() {
+		if err != nil {
+			for _, key := range stored {
+				blobs.Delete(context.Background(), key)
+			}
+		}
+	}()
+
+	for i := range collected {
+		collection := &collected[i]
+		collection.ID = report.Collections[collection.ID]
+		collection.WorkspaceID = ws.ID
+		collection.CreatedBy = user(collection.CreatedBy)
+	}
+	for i := range tmpls {
+		tmpl := &tmpls[i]
+		tmpl.ID = report.Templates[tmpl.ID]
+		tmpl.WorkspaceID = ws.ID
+		tmpl.CreatedBy = user(tmpl.CreatedBy)
+		tmpl.CollectionID = report.Collections[tmpl.CollectionID]
+	}
+
+	storage := make(map[string]int64)
+	for _, archived := range sessions {
+		session := archived.Session
+		oldID := session.ID
+		session.ID = report.Sessions[oldID]
+		session.WorkspaceID = ws.ID
+		session.CreatedBy = user(session.CreatedBy)
+		session.CollectionID = report.Collections[session.CollectionID]
+		session.TemplateID = report.Templates[session.TemplateID]
+		session.ClonedFrom = report.Sessions[session.ClonedFrom]
+		session.Clients = make(map[string]*Client)
+		for i := range archived.Screenshots {
+			shot := &archived.Screenshots[i]
+			oldKey := shot.blobKey()
+			shot.SessionID = session.ID
+			shot.UploadedBy = user(shot.UploadedBy)
+			var found bool
+			if found, err = put(oldKey, shot.blobKey()); err != nil {
+				return report, err
+			}
+			if found {
+				storage[session.CreatedBy] += int64(shot.Size)
+				report.Media++
+			}
+		}
+		for i := range archived.Comments {
+			comment := &archived.Comments[i]
+			comment.SessionID = session.ID
+			comment.AuthorID = user(comment.AuthorID)
+			comment.ResolvedBy = user(comment.ResolvedBy)
+			mentions := comment.Mentions[:0]
+			for _, id := range comment.Mentions {
+				if mapped := user(id); mapped != "" {
+					mentions = append(mentions, mapped)
+				}
+			}
+			comment.Mentions = mentions
+		}
+	}
+	for i := range guideList {
+		guide := &guideList[i]
+		oldID := guide.ID
+		guide.ID = report.Guides[oldID]
+		guide.WorkspaceID = ws.ID
+		guide.SessionID = report.Sessions[guide.SessionID]
+		guide.CollectionID = report.Collections[guide.CollectionID]
+		guide.CreatedBy = user(guide.CreatedBy)
+		guide.Pushes = nil
+		for j := range guide.Steps {
+			step := &guide.Steps[j]
+			if step.Image == nil {
+				continue
+			}
+			var found bool
+			if found, err = put(stepBlobKey(oldID, step.ID), stepBlobKey(guide.ID, step.ID)); err != nil {
+				return report, err
+			}
+			if found {
+				storage[guide.CreatedBy] += int64(step.Image.Size)
+				report.Media++
+			} else {
+				step.Image = nil
+			}
+		}
+	}
+
+	// Everything is in hand: register it.
+	workspaces.mu.Lock()
+	workspaces.Workspaces[ws.ID] = ws
+	workspaces.mu.Unlock()
+	for userID, n := range storage {
+		meter.chargeStorage(userID, ws.ID, n)
+	}
+	collections.mu.Lock()
+	for i := range collected {
+		collections.Collections[collected[i].ID] = &collected[i]
+	}
+	collections.mu.Unlock()
+	templates.mu.Lock()
+	for i := range tmpls {
+		templates.Templates[tmpls[i].ID] = &tmpls[i]
+	}
+	templates.mu.Unlock()
+
+	for _, archived := range sessions {
+		session := archived.Session
+		store.mu.Lock()
+		store.Sessions[session.ID] = session
+		store.mu.Unlock()
+		workspaces.indexSession(session.ID, ws.ID)
+		sessionHistory.created(session, session.CreatedBy)
+
+		for _, stroke := range archived.Annotations {
+			annotations.Add(session.ID, stroke)
+		}
+		for i := range archived.Polls {
+			poll := archived.Polls[i]
+			poll.ballots = make(map[string][]int)
+			polls.create(session.ID, &poll)
+		}
+		for i := range archived.Questions {
+			question := archived.Questions[i]
+			question.upvoters = make(map[string]bool)
+			questions.add(session.ID, &question)
+		}
+		for i := range archived.Screenshots {
+			shot := archived.Screenshots[i]
+			pending := shot.OCRStatus == OCRPending
+			if pending && !ocrEnabled() {
+				shot.OCRStatus = OCRFailed
+			}
+			if screenshots.add(&shot) == nil && pending && ocrEnabled() {
+				queueOCR(session.ID, shot.ID)
+			}
+		}
+		for i := range archived.Comments {
+			comment := archived.Comments[i]
+			comments.Add(&comment)
+		}
+		reindex := false
+		for _, caption := range archived.Captions {
+			reindex = captions.add(session.ID, caption) || reindex
+		}
+		if reindex {
+			captions.reindexLater(session)
+		} else {
+			reindexSession(session)
+		}
+	}
+
+	for i := range guideList {
+		guides.add(&guideList[i])
+	}
+
+	logger.Info("imported workspace", "workspace", ws.ID, "sessions", len(sessions), "guides", len(guideList), "media", report.Media)
+	return report, nil
+}
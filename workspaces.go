@@ -0,0 +1,593 @@
+package tango
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+
+	invitationTTL = 7 * 24 * time.Hour
+)
+
+var workspaceRoleRank = map[string]int{
+	RoleMember: 1,
+	RoleAdmin:  2,
+	RoleOwner:  3,
+}
+
+// Membership is a user's place in a workspace. Managed memberships were
+// created from IdP groups and follow them on every single sign-on.
+type Membership struct {
+	UserID   string `json:"userId"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	JoinedAt int64  `json:"joinedAt"`
+	Managed  bool   `json:"managed,omitempty"`
+}
+
+type Workspace struct {
+	ID                 string                 `json:"id"`
+	Name               string                 `json:"name"`
+	CreatedAt          int64                  `json:"createdAt"`
+	SSO                *WorkspaceSSO          `json:"sso,omitempty"`
+	Plan               string                 `json:"plan,omitempty"`
+	SubscriptionStatus string                 `json:"subscriptionStatus,omitempty"`
+	Quota              *UsageQuota            `json:"quota,omitempty"`
+	Retention          *RetentionPolicy       `json:"retention,omitempty"`
+	Watermark          *Watermark             `json:"-"`
+	NetworkPolicy      *NetworkPolicy         `json:"-"`
+	Confluence         *ConfluenceCredentials `json:"-"`
+	Notion             *NotionCredentials     `json:"-"`
+	Members            map[string]*Membership `json:"-"`
+
+	billing workspaceBilling
+}
+
+// admits reports whether a member signed in the given way may use ws.
+// Callers must hold workspaces.mu.
+func (ws *Workspace) admits(viaSSO bool) bool {
+	return viaSSO || ws.SSO == nil || !ws.SSO.Required
+}
+
+// Invitation lets whoever holds its token join a workspace as Email. Only
+// a hash of the token is kept.
+type Invitation struct {
+	ID          string `json:"id"`
+	WorkspaceID string `json:"workspaceId"`
+	Email       string `json:"email"`
+	Role        string `json:"role"`
+	InvitedBy   string `json:"invitedBy"`
+	CreatedAt   int64  `json:"createdAt"`
+	ExpiresAt   int64  `json:"expiresAt"`
+
+	tokenHash string
+}
+
+// WorkspaceRegistry holds workspaces, their pending invitations, and which
+// workspace each session belongs to, so event routing can scope deliveries
+// without taking store or session locks.
+type WorkspaceRegistry struct {
+	Workspaces  map[string]*Workspace
+	invitations map[string]*Invitation
+	sessions    map[string]string
+	mu          sync.Mutex
+}
+
+func NewWorkspaceRegistry() *WorkspaceRegistry {
+	return &WorkspaceRegistry{
+		Workspaces:  make(map[string]*Workspace),
+		invitations: make(map[string]*Invitation),
+		sessions:    make(map[string]string),
+	}
+}
+
+var workspaces = NewWorkspaceRegistry()
+
+func (r *WorkspaceRegistry) indexSession(sessionID, workspaceID string) {
+	if workspaceID == "" {
+		return
+	}
+	r.mu.Lock()
+	r.sessions[sessionID] = workspaceID
+	r.mu.Unlock()
+}
+
+func (r *WorkspaceRegistry) forgetSession(sessionID string) {
+	r.mu.Lock()
+	delete(r.sessions, sessionID)
+	r.mu.Unlock()
+}
+
+func (r *WorkspaceRegistry) sessionWorkspace(sessionID string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[sessionID]
+}
+
+// roleOf returns the user's role in the workspace, or "" for non-members.
+// Members of a workspace that requires single sign-on only count viaSSO.
+func (r *WorkspaceRegistry) roleOf(workspaceID string, user *User, viaSSO bool) string {
+	if user == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ws, exists := r.Workspaces[workspaceID]; exists && ws.admits(viaSSO) {
+		if member, ok := ws.Members[user.ID]; ok {
+			return member.Role
+		}
+	}
+	return ""
+}
+
+// memberships returns the IDs of the workspaces user belongs to and may
+// use when signed in the given way.
+func (r *WorkspaceRegistry) memberships(user *User, viaSSO bool) map[string]bool {
+	ids := make(map[string]bool)
+	if user == nil {
+		return ids
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, ws := range r.Workspaces {
+		if _, ok := ws.Members[user.ID]; ok && ws.admits(viaSSO) {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// matchingNames returns the IDs of the workspaces whose names match.
+func (r *WorkspaceRegistry) matchingNames(match func(name string) bool) map[string]bool {
+	ids := make(map[string]bool)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, ws := range r.Workspaces {
+		if match(ws.Name) {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func (r *WorkspaceRegistry) listFor(user *User) []gin.H {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := []gin.H{}
+	for _, ws := range r.Workspaces {
+		if member, ok := ws.Members[user.ID]; ok {
+			list = append(list, gin.H{"workspace": ws, "role": member.Role})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i]["workspace"].(*Workspace).ID < list[j]["workspace"].(*Workspace).ID
+	})
+	return list
+}
+
+// canAccess reports whether the caller may see resources of workspaceID,
+// as a member reaching it from where its network policy allows. Resources
+// outside any workspace stay open to everyone.
+func canAccess(c *gin.Context, workspaceID string) bool {
+	if workspaceID == "" {
+		return true
+	}
+	if workspaces.roleOf(workspaceID, currentUser(c), signedInWithSSO(c)) == "" {
+		return false
+	}
+	if !networkPermits(c, workspaceID) {
+		denyNetwork(c, workspaceID)
+		return false
+	}
+	return true
+}
+
+// listingScope decides which workspaces a listing shows: the caller's own,
+// narrowed to ?workspaceId= when given, or only unscoped resources for
+// anonymous callers.
+func listingScope(c *gin.Context) func(workspaceID string) bool {
+	user := currentUser(c)
+	if user == nil {
+		return func(workspaceID string) bool { return workspaceID == "" }
+	}
+	mine := workspaces.memberships(user, signedInWithSSO(c))
+	if only := c.Query("workspaceId"); only != "" {
+		return func(workspaceID string) bool { return workspaceID == only && mine[only] && networkPermits(c, only) }
+	}
+	return func(workspaceID string) bool { return mine[workspaceID] && networkPermits(c, workspaceID) }
+}
+
+// sessionFor looks up a session the caller is allowed to see. Sessions in
+// other workspaces are reported as missing rather than forbidden.
+func sessionFor(c *gin.Context, id string) (*Session, bool) {
+	session, exists := store.session(id)
+	if !exists || !canAccess(c, session.WorkspaceID) {
+		return nil, false
+	}
+	return session, true
+}
+
+// joinFor is sessionFor for a realtime join, whose handshake may carry the
+// API token of a browser that cannot send an Authorization header.
+func joinFor(c *gin.Context, id string, join JoinRequest) (*Session, bool) {
+	signInWithToken(c, join.Token)
+	return sessionFor(c, id)
+}
+
+// hiddenSession refuses a join, after the upgrade, to a session the caller
+// may not see.
+var hiddenSession = &admissionError{http.StatusNotFound, "session_not_found", "Session not found", nil, 0}
+
+// requireRole responds and returns nil unless the caller holds at least
+// role in the workspace.
+func requireRole(c *gin.Context, workspaceID, role string) *User {
+	user := requireUser(c)
+	if user == nil {
+		return nil
+	}
+	have := workspaces.roleOf(workspaceID, user, signedInWithSSO(c))
+	if have == "" && workspaces.roleOf(workspaceID, user, true) != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This workspace requires signing in with single sign-on"})
+		return nil
+	}
+	if have == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return nil
+	}
+	if reason := networkBlock(c, workspaceID); reason != "" {
+		rejectNetwork(c, workspaceID, reason)
+		return nil
+	}
+	if workspaceRoleRank[have] < workspaceRoleRank[role] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This needs the " + role + " role in the workspace"})
+		return nil
+	}
+	return user
+}
+
+type CreateWorkspaceRequest struct {
+	Name string `json:"name" binding:"required,max=200"`
+}
+
+func createWorkspace(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+
+	var req CreateWorkspaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := getCurrentTimestamp()
+	ws := &Workspace{
+		ID:        generateID(),
+		Name:      req.Name,
+		CreatedAt: now,
+		Members: map[string]*Membership{
+			user.ID: {UserID: user.ID, Email: user.Email, Role: RoleOwner, JoinedAt: now},
+		},
+	}
+
+	workspaces.mu.Lock()
+	workspaces.Workspaces[ws.ID] = ws
+	workspaces.mu.Unlock()
+
+	auditRequest(c, "workspace.create", "workspace", ws.ID, gin.H{"name": ws.Name})
+	c.JSON(http.StatusCreated, ws)
+}
+
+func getWorkspaces(c *gin.Context) {
+	user := requireUser(c)
+	if user == nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"workspaces": workspaces.listFor(user)})
+}
+
+func getWorkspace(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleMember) == nil {
+		return
+	}
+
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+
+	ws, exists := workspaces.Workspaces[id]
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+	members := make([]*Membership, 0, len(ws.Members))
+	for _, member := range ws.Members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].JoinedAt < members[j].JoinedAt })
+	c.JSON(http.StatusOK, gin.H{"workspace": ws, "members": members})
+}
+
+type CreateInvitationRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	Role  string `json:"role"`
+}
+
+func createInvitation(c *gin.Context) {
+	id := c.Param("id")
+	user := requireRole(c, id, RoleAdmin)
+	if user == nil {
+		return
+	}
+
+	var req CreateInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Role == "" {
+		req.Role = RoleMember
+	}
+	if _, known := workspaceRoleRank[req.Role]; !known {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, admin or member"})
+		return
+	}
+	if workspaceRoleRank[req.Role] > workspaceRoleRank[workspaces.roleOf(id, user, signedInWithSSO(c))] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot invite someone to a role above your own"})
+		return
+	}
+
+	now := time.Now()
+	token := "inv_" + randomToken(24)
+	invitation := &Invitation{
+		ID:          generateID(),
+		WorkspaceID: id,
+		Email:       normalizeEmail(req.Email),
+		Role:        req.Role,
+		InvitedBy:   user.ID,
+		CreatedAt:   now.Unix(),
+		ExpiresAt:   now.Add(invitationTTL).Unix(),
+		tokenHash:   hashToken(token),
+	}
+
+	workspaces.mu.Lock()
+	workspaces.invitations[invitation.tokenHash] = invitation
+	name := workspaces.Workspaces[id].Name
+	workspaces.mu.Unlock()
+
+	auditRequest(c, "workspace.invite", "workspace", id, gin.H{"email": invitation.Email, "role": invitation.Role})
+	// Someone who already has an account can accept from the notification.
+	users.mu.Lock()
+	invitee := users.byEmail[invitation.Email]
+	users.mu.Unlock()
+	if invitee != nil {
+		notifications.Notify(invitee.ID, Notification{
+			Type:    NotifyInvitation,
+			Text:    displayName(user) + " invited you to the workspace " + name,
+			ActorID: user.ID,
+			Data:    gin.H{"workspaceId": id, "invitationId": invitation.ID, "role": invitation.Role, "token": token},
+		})
+	}
+	emailed := wantsEmail(invitation.Email, EmailInvitation) && sendEmail(EmailInvitation, invitation.Email, gin.H{
+		"Inviter":   displayName(user),
+		"Workspace": name,
+		"Role":      invitation.Role,
+		"Link":      emailLink("/invitations/" + token),
+		"Expires":   time.Unix(invitation.ExpiresAt, 0).UTC().Format("January 2, 2006"),
+	}) == nil
+	c.JSON(http.StatusCreated, gin.H{"invitation": invitation, "token": token, "emailed": emailed})
+}
+
+func getInvitations(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleAdmin) == nil {
+		return
+	}
+
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+
+	now := getCurrentTimestamp()
+	pending := []*Invitation{}
+	for _, invitation := range workspaces.invitations {
+		if invitation.WorkspaceID == id && invitation.ExpiresAt > now {
+			pending = append(pending, invitation)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].CreatedAt < pending[j].CreatedAt })
+	c.JSON(http.StatusOK, gin.H{"invitations": pending})
+}
+
+func revokeInvitation(c *gin.Context) {
+	id := c.Param("id")
+	if requireRole(c, id, RoleAdmin) == nil {
+		return
+	}
+
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+
+	for hash, invitation := range workspaces.invitations {
+		if invitation.WorkspaceID == id && invitation.ID == c.Param("invitationId") {
+			delete(workspaces.invitations, hash)
+			auditRequest(c, "workspace.uninvite", "workspace", id, gin.H{"email": invitation.Email})
+			c.Status(http.StatusNoContent)
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+}
+
+// acceptInvitation adds the invitee to the workspace. Holding the token
+// proves control of the invited address, so an anonymous caller is signed
+// up under it and handed an API token.
+func acceptInvitation(c *gin.Context) {
+	hash := hashToken(c.Param("token"))
+
+	workspaces.mu.Lock()
+	invitation, exists := workspaces.invitations[hash]
+	workspaces.mu.Unlock()
+	if !exists || invitation.ExpiresAt <= getCurrentTimestamp() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found or expired"})
+		return
+	}
+
+	user := currentUser(c)
+	if user != nil && user.Email != invitation.Email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This invitation is for a different email address"})
+		return
+	}
+	resp := gin.H{}
+	if user == nil {
+		users.mu.Lock()
+		user = users.ensure(invitation.Email, "")
+		resp["token"] = users.issueToken(user, AuthInvitation)
+		users.mu.Unlock()
+	}
+
+	workspaces.mu.Lock()
+	if _, pending := workspaces.invitations[hash]; !pending {
+		workspaces.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found or expired"})
+		return
+	}
+	delete(workspaces.invitations, hash)
+	ws, exists := workspaces.Workspaces[invitation.WorkspaceID]
+	if !exists {
+		workspaces.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+	member, already := ws.Members[user.ID]
+	if !already {
+		member = &Membership{UserID: user.ID, Email: user.Email, JoinedAt: getCurrentTimestamp()}
+		ws.Members[user.ID] = member
+	}
+	if workspaceRoleRank[invitation.Role] > workspaceRoleRank[member.Role] {
+		member.Role = invitation.Role
+	}
+	resp["workspace"] = ws
+	resp["membership"] = *member
+	resp["user"] = user
+	workspaces.mu.Unlock()
+
+	audit.Record("user:"+user.ID, "workspace.join", "workspace", ws.ID, c.Writer.Header().Get(requestIDHeader), gin.H{"role": member.Role})
+	c.JSON(http.StatusOK, resp)
+}
+
+// owners counts the owners of ws. Callers must hold workspaces.mu.
+func (ws *Workspace) owners() int {
+	n := 0
+	for _, member := range ws.Members {
+		if member.Role == RoleOwner {
+			n++
+		}
+	}
+	return n
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+func updateMember(c *gin.Context) {
+	id := c.Param("id")
+	user := requireRole(c, id, RoleAdmin)
+	if user == nil {
+		return
+	}
+
+	var req UpdateMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, known := workspaceRoleRank[req.Role]; !known {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, admin or member"})
+		return
+	}
+
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+
+	ws := workspaces.Workspaces[id]
+	member, exists := ws.Members[c.Param("userId")]
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+	caller, stillMember := ws.Members[user.ID]
+	if !stillMember {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+	callerRole := caller.Role
+	if (req.Role == RoleOwner || member.Role == RoleOwner) && callerRole != RoleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only owners can grant or take away ownership"})
+		return
+	}
+	if member.Role == RoleOwner && req.Role != RoleOwner && ws.owners() == 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A workspace needs at least one owner"})
+		return
+	}
+
+	// A role set by hand is kept even when the user's IdP groups change.
+	from := member.Role
+	member.Role = req.Role
+	member.Managed = false
+	auditRequest(c, "workspace.role", "user", member.UserID, gin.H{"workspaceId": id, "from": from, "to": req.Role})
+	c.JSON(http.StatusOK, member)
+}
+
+// removeMember takes a user out of the workspace. Admins may remove others
+// and anyone may leave.
+func removeMember(c *gin.Context) {
+	id := c.Param("id")
+	user := requireRole(c, id, RoleMember)
+	if user == nil {
+		return
+	}
+	targetID := c.Param("userId")
+
+	workspaces.mu.Lock()
+	defer workspaces.mu.Unlock()
+
+	ws := workspaces.Workspaces[id]
+	member, exists := ws.Members[targetID]
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+	caller, stillMember := ws.Members[user.ID]
+	if !stillMember {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return
+	}
+	callerRole := caller.Role
+	if targetID != user.ID && workspaceRoleRank[callerRole] < workspaceRoleRank[RoleAdmin] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This needs the admin role in the workspace"})
+		return
+	}
+	if member.Role == RoleOwner && targetID != user.ID && callerRole != RoleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only owners can remove an owner"})
+		return
+	}
+	if member.Role == RoleOwner && ws.owners() == 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A workspace needs at least one owner"})
+		return
+	}
+
+	delete(ws.Members, targetID)
+	auditRequest(c, "workspace.remove", "user", targetID, gin.H{"workspaceId": id})
+	c.Status(http.StatusNoContent)
+}